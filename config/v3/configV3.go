@@ -16,28 +16,106 @@ package v3
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	v2 "github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
 	"github.com/fstab/grok_exporter/tailer/glob"
 	"github.com/fstab/grok_exporter/template"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v2"
 )
 
 const (
 	defaultRetentionCheckInterval = 53 * time.Second
+	defaultPositionsSyncInterval  = 10 * time.Second
+	defaultStateSyncInterval      = 10 * time.Second
+	defaultMultilineTimeout       = time.Second
+	defaultMultilineMaxLines      = 500
+	defaultMaxLineLengthAction    = "truncate"
+	defaultBackpressureAction     = "block"
+	defaultRegexEngine            = "oniguruma"
+	defaultLookupReloadInterval   = time.Minute
+	defaultWebhookMaxBodySize     = 10 * 1024 * 1024
+	defaultRemoteWriteInterval    = 15 * time.Second
+	defaultRemoteWriteTimeout     = 30 * time.Second
+	defaultMaxSamplesPerSend      = 2000
+	defaultMinBackoff             = 30 * time.Millisecond
+	defaultMaxBackoff             = 5 * time.Second
+	defaultOTLPInterval           = 15 * time.Second
+	defaultOTLPTimeout            = 10 * time.Second
 	inputTypeStdin                = "stdin"
 	inputTypeFile                 = "file"
 	inputTypeWebhook              = "webhook"
 	inputTypeKafka                = "kafka"
+	inputTypeJournald             = "journald"
+	inputTypeSyslog               = "syslog"
+	inputTypeKubernetes           = "kubernetes"
+	inputTypeSocket               = "socket"
+	inputTypeGelf                 = "gelf"
+	inputTypeS3                   = "s3"
+	inputTypeNats                 = "nats"
+	inputTypeMqtt                 = "mqtt"
 	importMetricsType             = "metrics"
 	importPatternsType            = "grok_patterns"
 )
 
+// Values for metrics.anchor and global.anchor.
+const (
+	AnchorNone  = "none"  // the patterns may match anywhere in the line
+	AnchorStart = "start" // the patterns must match at the beginning of the line
+	AnchorFull  = "full"  // the patterns must match the full line
+)
+
+func isAnchor(anchor string) bool {
+	return anchor == AnchorNone || anchor == AnchorStart || anchor == AnchorFull
+}
+
+// Values for metrics.regex_flags.
+const (
+	RegexFlagIgnoreCase = "ignore_case" // letters match upper and lower case, like (?i)
+	RegexFlagMultiline  = "multiline"   // . matches line breaks in multiline records, like (?m) in Oniguruma's Ruby syntax
+	RegexFlagExtended   = "extended"    // whitespace and comments starting with # are ignored, like (?x)
+)
+
+func isRegexFlag(flag string) bool {
+	return flag == RegexFlagIgnoreCase || flag == RegexFlagMultiline || flag == RegexFlagExtended
+}
+
+// Values for metrics.operation of gauge metrics.
+const (
+	GaugeSet = "set" // the gauge is set to the value, this is the default unless cumulative is true
+	GaugeInc = "inc" // the gauge is increased by the value, which defaults to 1
+	GaugeDec = "dec" // the gauge is decreased by the value, which defaults to 1
+	GaugeAdd = "add" // the gauge is increased by the value, like cumulative: true
+	GaugeSub = "sub" // the gauge is decreased by the value
+)
+
+func isGaugeOperation(operation string) bool {
+	return operation == GaugeSet || operation == GaugeInc || operation == GaugeDec || operation == GaugeAdd || operation == GaugeSub
+}
+
+// Values for metrics.label_values.action.
+const (
+	LabelValuesOther = "other" // values that are not allowed are replaced with "other", this is the default
+	LabelValuesDrop  = "drop"  // lines with values that are not allowed are not recorded
+)
+
+// Values for metrics.max_series_action.
+const (
+	MaxSeriesDrop  = "drop"  // lines with new label values are not recorded, this is the default
+	MaxSeriesOther = "other" // lines with new label values are recorded with all label values set to "other"
+)
+
 func Unmarshal(config []byte) (*Config, error) {
 	return unmarshal(config, NewFileLoader())
 }
@@ -53,7 +131,11 @@ func unmarshal(config []byte, fileLoader FileLoader) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	for _, metric := range cfg.OrigMetrics {
+	origMetrics, err := expandMetricGroups(cfg.OrigMetrics)
+	if err != nil {
+		return nil, err
+	}
+	for _, metric := range origMetrics {
 		cfg.AllMetrics = append(cfg.AllMetrics, metric)
 	}
 	for _, metric := range importedMetrics {
@@ -79,42 +161,197 @@ func Convert(v2cfg *v2.Config) (*Config, error) {
 }
 
 type Config struct {
-	Global       GlobalConfig       `yaml:",omitempty"`
-	Input        InputConfig        `yaml:",omitempty"`
-	Imports      ImportsConfig      `yaml:",omitempty"`
-	GrokPatterns GrokPatternsConfig `yaml:"grok_patterns,omitempty"`
-	OrigMetrics  MetricsConfig      `yaml:"metrics,omitempty"` // not including imported config files
-	AllMetrics   MetricsConfig      `yaml:"-"`                 // including metrics from imported config files
-	Server       ServerConfig       `yaml:",omitempty"`
+	Global             GlobalConfig             `yaml:",omitempty"`
+	Input              InputConfig              `yaml:",omitempty"`
+	Inputs             []InputConfig            `yaml:",omitempty"` // alternative to Input if multiple inputs are needed
+	Imports            ImportsConfig            `yaml:",omitempty"`
+	GrokPatterns       GrokPatternsConfig       `yaml:"grok_patterns,omitempty"`
+	AdditionalPatterns AdditionalPatternsConfig `yaml:"additional_patterns,omitempty"` // name -> regex, overrides imported patterns
+	Filter             FilterConfig             `yaml:",omitempty"`                    // applied to all lines before the metrics
+	LookupTables       LookupTablesConfig       `yaml:"lookup_tables,omitempty"`       // tables for {{lookup "name" .field}} in the templates
+	GeoIP              GeoIPConfig              `yaml:"geoip,omitempty"`               // databases for {{geoip "country" .field}} in the templates
+	OrigMetrics        MetricsConfig            `yaml:"metrics,omitempty"`             // not including imported config files
+	AllMetrics         MetricsConfig            `yaml:"-"`                             // including metrics from imported config files
+	Server             ServerConfig             `yaml:",omitempty"`
+	RemoteWrite        RemoteWriteConfig        `yaml:"remote_write,omitempty"` // Prometheus remote write endpoints where the metrics are sent
+	OTLP               OTLPConfig               `yaml:"otlp,omitempty"`         // OpenTelemetry OTLP/gRPC receivers where the metrics are sent
 }
 
 type GlobalConfig struct {
-	ConfigVersion          int           `yaml:"config_version,omitempty"`
-	RetentionCheckInterval time.Duration `yaml:"retention_check_interval,omitempty"` // implicitly parsed with time.ParseDuration()
+	ConfigVersion          int               `yaml:"config_version,omitempty"`
+	RetentionCheckInterval time.Duration     `yaml:"retention_check_interval,omitempty"` // implicitly parsed with time.ParseDuration()
+	RegexEngine            string            `yaml:"regex_engine,omitempty"`             // oniguruma, re2, or auto
+	BundledPatterns        string            `yaml:"bundled_patterns,omitempty"`         // legacy, ecs-v1, or none. Empty means legacy if the bundled patterns are installed.
+	Anchor                 string            `yaml:"anchor,omitempty"`                   // default for metrics.anchor
+	MatchTimeout           time.Duration     `yaml:"match_timeout,omitempty"`            // time budget for each Oniguruma match, 0 means no budget
+	Labels                 map[string]string `yaml:",omitempty"`                         // constant labels added to all exported series, including the built-in metrics
+	Namespace              string            `yaml:",omitempty"`                         // prefix for the names of all metrics, except the built-in metrics
+	Subsystem              string            `yaml:",omitempty"`                         // prefix for the names of all metrics after the namespace
+	StateFile              string            `yaml:"state_file,omitempty"`               // where the values of the counters and gauges are saved, so that they are restored after a restart
+	StateSyncInterval      time.Duration     `yaml:"state_sync_interval,omitempty"`      // how often the values are written to the state_file
 }
 
 type InputConfig struct {
+	Id                         string `yaml:",omitempty"`
 	Type                       string `yaml:",omitempty"`
 	PathsAndGlobs              `yaml:",inline"`
 	FailOnMissingLogfileString string        `yaml:"fail_on_missing_logfile,omitempty"` // cannot use bool directly, because yaml.v2 doesn't support true as default value.
 	FailOnMissingLogfile       bool          `yaml:"-"`
+	Exclude                    []string      `yaml:"exclude,omitempty"` // glob patterns for file names that are not read, like *.gz
 	Readall                    bool          `yaml:",omitempty"`
-	PollInterval               time.Duration `yaml:"poll_interval,omitempty"` // implicitly parsed with time.ParseDuration()
+	StartPosition              string        `yaml:"start_position,omitempty"` // beginning, end, saved, byte:<offset>, or line:<number>
+	StartPositionType          string        `yaml:"-"`                        // beginning, end, byte, line, or timestamp. For saved, this is the position for files without a saved position.
+	StartPositionOffset        int64         `yaml:"-"`
+	RestorePositions           bool          `yaml:"-"`                    // true if start_position is saved, or if it is empty and positions_file is configured
+	StartFromString            string        `yaml:"start_from,omitempty"` // parsed with time.RFC3339
+	StartFrom                  time.Time     `yaml:"-"`
+	StartFromPattern           string        `yaml:"start_from_pattern,omitempty"` // grok pattern with a 'timestamp' field
+	StartFromLayout            string        `yaml:"start_from_layout,omitempty"`  // layout for time.Parse(), like "2006-01-02 15:04:05"
+	ReadCompressedBackups      bool          `yaml:"read_compressed_backups,omitempty"`
+	Olddir                     string        `yaml:"olddir,omitempty"` // like logrotate's olddir, relative to the log file's directory if not absolute
+	FollowPath                 bool          `yaml:"follow_path,omitempty"`
+	Format                     string        `yaml:"format,omitempty"`             // plain, json, or csv
+	CsvDelimiter               string        `yaml:"csv_delimiter,omitempty"`      // a single character, default is ','
+	CsvFields                  []string      `yaml:"csv_fields,omitempty"`         // field names for format csv, "-" skips a field
+	Match                      string        `yaml:"match,omitempty"`              // grok pattern, the fields it captures can be used in the templates of the input's metrics
+	TimestampPattern           string        `yaml:"timestamp_pattern,omitempty"`  // grok pattern with a 'timestamp' field, for the log time of each line
+	TimestampLayout            string        `yaml:"timestamp_layout,omitempty"`   // layout for time.Parse(), like "2006-01-02 15:04:05"
+	TimestampTimezone          string        `yaml:"timestamp_timezone,omitempty"` // time zone of timestamps without a time zone, like Europe/Berlin, default is UTC
+	DropOlderThan              time.Duration `yaml:"drop_older_than,omitempty"`    // implicitly parsed with time.ParseDuration()
+	LineDelimiter              string        `yaml:"line_delimiter,omitempty"`
+	LineDelimiterPattern       string        `yaml:"line_delimiter_pattern,omitempty"` // regular expression in Go's regexp syntax
+	Charset                    string        `yaml:"charset,omitempty"`
+	MaxLineLength              int           `yaml:"max_line_length,omitempty"`
+	MaxLineLengthAction        string        `yaml:"max_line_length_action,omitempty"` // truncate or split
+	PollInterval               time.Duration `yaml:"poll_interval,omitempty"`          // implicitly parsed with time.ParseDuration()
+	IdleTimeout                time.Duration `yaml:"idle_timeout,omitempty"`           // implicitly parsed with time.ParseDuration()
+	PartialLineTimeout         time.Duration `yaml:"partial_line_timeout,omitempty"`   // implicitly parsed with time.ParseDuration()
+	PositionsFile              string        `yaml:"positions_file,omitempty"`
+	PositionsSyncInterval      time.Duration `yaml:"positions_sync_interval,omitempty"` // implicitly parsed with time.ParseDuration()
 	MaxLinesInBuffer           int           `yaml:"max_lines_in_buffer,omitempty"`
+	RateLimit                  int           `yaml:"rate_limit,omitempty"` // lines per second
+	LineBufferSize             int           `yaml:"line_buffer_size,omitempty"`
+	BackpressureAction         string        `yaml:"backpressure_action,omitempty"` // block or drop
+	DedupWindow                time.Duration `yaml:"dedup_window,omitempty"`        // implicitly parsed with time.ParseDuration(), 0 disables deduplication
+	MultilineStartPattern      string        `yaml:"multiline_start_pattern,omitempty"`
+	MultilineTimeout           time.Duration `yaml:"multiline_timeout,omitempty"` // implicitly parsed with time.ParseDuration()
+	MultilineMaxLines          int           `yaml:"multiline_max_lines,omitempty"`
 	WebhookPath                string        `yaml:"webhook_path,omitempty"`
 	WebhookFormat              string        `yaml:"webhook_format,omitempty"`
 	WebhookJsonSelector        string        `yaml:"webhook_json_selector,omitempty"`
 	WebhookTextBulkSeparator   string        `yaml:"webhook_text_bulk_separator,omitempty"`
+	WebhookMaxBodySize         int           `yaml:"webhook_max_body_size,omitempty"` // in bytes, larger requests are rejected
 	KafkaVersion               string        `yaml:"kafka_version,omitempty"`
 	KafkaBrokers               []string      `yaml:"kafka_brokers,omitempty"`
 	KafkaTopics                []string      `yaml:"kafka_topics,omitempty"`
 	KafkaPartitionAssignor     string        `yaml:"kafka_partition_assignor,omitempty"`
 	KafkaConsumerGroupName     string        `yaml:"kafka_consumer_group_name,omitempty"`
 	KafkaConsumeFromOldest     bool          `yaml:"kafka_consume_from_oldest,omitempty"`
+	JournaldUnits              []string      `yaml:"journald_units,omitempty"`
+	SyslogProtocol             string        `yaml:"syslog_protocol,omitempty"`
+	SyslogAddress              string        `yaml:"syslog_address,omitempty"`
+	KubernetesApiServer        string        `yaml:"kubernetes_api_server,omitempty"`
+	KubernetesNamespace        string        `yaml:"kubernetes_namespace,omitempty"`
+	KubernetesLabelSelector    string        `yaml:"kubernetes_label_selector,omitempty"`
+	KubernetesContainer        string        `yaml:"kubernetes_container,omitempty"`
+	SocketNetwork              string        `yaml:"socket_network,omitempty"`
+	SocketAddress              string        `yaml:"socket_address,omitempty"`
+	SocketMaxConnections       int           `yaml:"socket_max_connections,omitempty"`
+	SocketMaxLineLength        int           `yaml:"socket_max_line_length,omitempty"`
+	GelfProtocol               string        `yaml:"gelf_protocol,omitempty"`
+	GelfAddress                string        `yaml:"gelf_address,omitempty"`
+	S3Bucket                   string        `yaml:"s3_bucket,omitempty"`
+	S3Prefix                   string        `yaml:"s3_prefix,omitempty"`
+	S3Region                   string        `yaml:"s3_region,omitempty"`
+	S3Endpoint                 string        `yaml:"s3_endpoint,omitempty"`
+	S3StartTimeString          string        `yaml:"s3_start_time,omitempty"` // parsed with time.RFC3339
+	S3StartTime                time.Time     `yaml:"-"`
+	S3EndTimeString            string        `yaml:"s3_end_time,omitempty"` // parsed with time.RFC3339
+	S3EndTime                  time.Time     `yaml:"-"`
+	NatsUrl                    string        `yaml:"nats_url,omitempty"`
+	NatsSubjects               []string      `yaml:"nats_subjects,omitempty"`
+	NatsQueueGroup             string        `yaml:"nats_queue_group,omitempty"`
+	MqttUrl                    string        `yaml:"mqtt_url,omitempty"`
+	MqttTopics                 []string      `yaml:"mqtt_topics,omitempty"`
+	MqttClientId               string        `yaml:"mqtt_client_id,omitempty"`
 }
 
 type GrokPatternsConfig []string
 
+type AdditionalPatternsConfig map[string]string
+
+type FilterConfig struct {
+	Include []string `yaml:",omitempty"` // grok patterns, lines matching none of them are dropped. Empty means all lines are included.
+	Exclude []string `yaml:",omitempty"` // grok patterns, lines matching any of them are dropped
+}
+
+type GeoIPConfig struct {
+	Databases []string `yaml:",omitempty"` // MaxMind DB files, like GeoLite2-City.mmdb and GeoLite2-ASN.mmdb
+}
+
+type RemoteWriteConfig []RemoteWriteEndpointConfig
+
+// RemoteWriteEndpointConfig is similar to remote_write in the Prometheus config.
+type RemoteWriteEndpointConfig struct {
+	URL           string            `yaml:"url,omitempty"`
+	Interval      time.Duration     `yaml:"interval,omitempty"`       // how often the metrics are sent
+	RemoteTimeout time.Duration     `yaml:"remote_timeout,omitempty"` // timeout of each request
+	Headers       map[string]string `yaml:"headers,omitempty"`
+	BasicAuth     BasicAuthConfig   `yaml:"basic_auth,omitempty"`
+	BearerToken   string            `yaml:"bearer_token,omitempty"`
+	TLSConfig     TLSConfig         `yaml:"tls_config,omitempty"`
+	QueueConfig   QueueConfig       `yaml:"queue_config,omitempty"`
+}
+
+type BasicAuthConfig struct {
+	Username     string `yaml:"username,omitempty"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"` // read for each request, so that the password can be rotated
+}
+
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+type QueueConfig struct {
+	MaxSamplesPerSend int           `yaml:"max_samples_per_send,omitempty"`
+	MinBackoff        time.Duration `yaml:"min_backoff,omitempty"` // wait before the first retry, doubled for each retry until the next interval
+	MaxBackoff        time.Duration `yaml:"max_backoff,omitempty"`
+}
+
+type OTLPConfig []OTLPEndpointConfig
+
+// OTLPEndpointConfig is similar to the otlp exporter in the OpenTelemetry Collector config.
+type OTLPEndpointConfig struct {
+	Endpoint           string            `yaml:"endpoint,omitempty"` // host:port of the gRPC receiver, like otel-collector:4317
+	Insecure           bool              `yaml:"insecure,omitempty"` // plaintext HTTP/2 instead of TLS
+	Interval           time.Duration     `yaml:"interval,omitempty"` // how often the metrics are sent
+	Timeout            time.Duration     `yaml:"timeout,omitempty"`  // timeout of each request
+	Headers            map[string]string `yaml:"headers,omitempty"`  // gRPC metadata
+	ResourceAttributes map[string]string `yaml:"resource_attributes,omitempty"`
+	TLSConfig          TLSConfig         `yaml:"tls_config,omitempty"`
+	RetryOnFailure     RetryConfig       `yaml:"retry_on_failure,omitempty"`
+}
+
+type RetryConfig struct {
+	InitialInterval time.Duration `yaml:"initial_interval,omitempty"` // wait before the first retry, doubled for each retry until the next interval
+	MaxInterval     time.Duration `yaml:"max_interval,omitempty"`
+}
+
+type LookupTablesConfig []LookupTableConfig
+
+type LookupTableConfig struct {
+	Name           string        `yaml:",omitempty"`
+	File           string        `yaml:",omitempty"`
+	Format         string        `yaml:",omitempty"`                // csv or yaml, the default is derived from the file extension
+	Default        string        `yaml:",omitempty"`                // value for keys that are not in the table
+	ReloadInterval time.Duration `yaml:"reload_interval,omitempty"` // how often the file is checked for changes
+}
+
 type PathsAndGlobs struct {
 	Path  string      `yaml:",omitempty"`
 	Paths []string    `yaml:",omitempty"`
@@ -126,19 +363,62 @@ type MetricConfig struct {
 	Name                 string `yaml:",omitempty"`
 	Help                 string `yaml:",omitempty"`
 	PathsAndGlobs        `yaml:",inline"`
-	Match                string              `yaml:",omitempty"`
-	Retention            time.Duration       `yaml:",omitempty"` // implicitly parsed with time.ParseDuration()
-	Value                string              `yaml:",omitempty"`
-	Cumulative           bool                `yaml:",omitempty"`
-	Buckets              []float64           `yaml:",flow,omitempty"`
-	Quantiles            map[float64]float64 `yaml:",flow,omitempty"`
-	MaxAge               time.Duration       `yaml:"max_age,omitempty"`
-	Labels               map[string]string   `yaml:",omitempty"`
-	LabelTemplates       []template.Template `yaml:"-"` // parsed version of Labels, will not be serialized to yaml.
-	ValueTemplate        template.Template   `yaml:"-"` // parsed version of Value, will not be serialized to yaml.
-	DeleteMatch          string              `yaml:"delete_match,omitempty"`
-	DeleteLabels         map[string]string   `yaml:"delete_labels,omitempty"` // TODO: Make sure that DeleteMatch is not nil if DeleteLabels are used.
-	DeleteLabelTemplates []template.Template `yaml:"-"`                       // parsed version of DeleteLabels, will not be serialized to yaml.
+	Sources              []string                     `yaml:",flow,omitempty"` // ids of the inputs this metric applies to, empty means all inputs
+	Match                string                       `yaml:",omitempty"`
+	Matches              []string                     `yaml:",omitempty"`                  // alternative to Match, the metric matches if any of the patterns matches
+	DropIfMatch          string                       `yaml:"drop_if_match,omitempty"`     // lines matching this pattern are ignored, even if they match Match
+	MatchField           string                       `yaml:"match_field,omitempty"`       // path in the extra object, like http.path. The patterns are matched against this field instead of the line.
+	MatchGrokField       string                       `yaml:"match_grok_field,omitempty"`  // field of the input's match pattern, like message. The patterns are matched against its value instead of the line.
+	Anchor               string                       `yaml:"anchor,omitempty"`            // none, start, or full: where match, matches, and delete_match must match. Empty means global.anchor.
+	RegexFlags           []string                     `yaml:"regex_flags,flow,omitempty"`  // ignore_case, multiline, and extended, for all patterns of the metric
+	SampleRate           float64                      `yaml:"sample_rate,omitempty"`       // fraction of the lines that the patterns are tried on, like 0.1. Empty means all lines.
+	UseLogTimestamp      bool                         `yaml:"use_log_timestamp,omitempty"` // the samples have the log time of the last matching line, see InputConfig.TimestampPattern
+	Retention            time.Duration                `yaml:",omitempty"`                  // implicitly parsed with time.ParseDuration()
+	Value                string                       `yaml:",omitempty"`
+	Cumulative           bool                         `yaml:",omitempty"`
+	Operation            string                       `yaml:",omitempty"`               // set, inc, dec, add, or sub for gauges. Empty means set, or add if cumulative is true.
+	ValueIsTotal         bool                         `yaml:"value_is_total,omitempty"` // for counters: the value is a running total, the counter increases by the difference to the previous value
+	Buckets              []float64                    `yaml:",flow,omitempty"`
+	ExponentialBuckets   *ExponentialBuckets          `yaml:"exponential_buckets,flow,omitempty"` // alternative to Buckets, like prometheus.ExponentialBuckets()
+	LinearBuckets        *LinearBuckets               `yaml:"linear_buckets,flow,omitempty"`      // alternative to Buckets, like prometheus.LinearBuckets()
+	NativeBucketFactor   float64                      `yaml:"native_bucket_factor,omitempty"`     // growth factor of native histogram buckets, like 1.1. Empty means no native histogram.
+	Quantiles            map[float64]float64          `yaml:",flow,omitempty"`
+	MaxAge               time.Duration                `yaml:"max_age,omitempty"`
+	AgeBuckets           int                          `yaml:"age_buckets,omitempty"`    // number of buckets the max_age window is divided into. Empty means 5.
+	FieldDefaults        map[string]string            `yaml:"field_defaults,omitempty"` // grok field name -> value used if the capture group is empty, like in an optional part of the pattern
+	Labels               map[string]string            `yaml:",omitempty"`
+	ConstLabels          map[string]string            `yaml:"const_labels,omitempty"`      // constant labels, unlike Labels these are not templates
+	MaxSeries            int                          `yaml:"max_series,omitempty"`        // limit for the number of label value combinations. Empty means no limit.
+	MaxSeriesAction      string                       `yaml:"max_series_action,omitempty"` // drop or other, for lines with new label values once max_series is reached. Empty means drop.
+	LabelValues          map[string]LabelValuesConfig `yaml:"label_values,omitempty"`      // label name -> allowed or denied values
+	LabelTemplates       []template.Template          `yaml:"-"`                           // parsed version of Labels, will not be serialized to yaml.
+	ValueTemplate        template.Template            `yaml:"-"`                           // parsed version of Value, will not be serialized to yaml.
+	DeleteMatch          string                       `yaml:"delete_match,omitempty"`
+	DeleteLabels         map[string]string            `yaml:"delete_labels,omitempty"` // TODO: Make sure that DeleteMatch is not nil if DeleteLabels are used.
+	DeleteLabelTemplates []template.Template          `yaml:"-"`                       // parsed version of DeleteLabels, will not be serialized to yaml.
+	Metrics              []MetricConfig               `yaml:",omitempty"`              // metrics fed from the same match, see expandMetricGroups()
+	MatchGroup           string                       `yaml:"-"`                       // name of the first metric of the metrics block this metric was declared in, empty if it was declared on its own
+}
+
+// LabelValuesConfig restricts the values of a label to the Allow list, or to all values except the Deny list.
+type LabelValuesConfig struct {
+	Allow  []string `yaml:",flow,omitempty"`
+	Deny   []string `yaml:",flow,omitempty"`
+	Action string   `yaml:",omitempty"` // other or drop, for lines with a value that is not allowed. Empty means other.
+}
+
+// ExponentialBuckets are Count histogram buckets, where the first upper bound is Start, and each following upper bound is Factor times the previous one.
+type ExponentialBuckets struct {
+	Start  float64 `yaml:",omitempty"`
+	Factor float64 `yaml:",omitempty"`
+	Count  int     `yaml:",omitempty"`
+}
+
+// LinearBuckets are Count histogram buckets, where the first upper bound is Start, and each following upper bound is Width more than the previous one.
+type LinearBuckets struct {
+	Start float64 `yaml:",omitempty"`
+	Width float64 `yaml:",omitempty"`
+	Count int     `yaml:",omitempty"`
 }
 
 type MetricsConfig []MetricConfig
@@ -154,10 +434,12 @@ type ImportConfig struct {
 
 type DefaultConfig struct {
 	PathsAndGlobs `yaml:",inline"`
+	Sources       []string            `yaml:",flow,omitempty"`
 	Retention     time.Duration       `yaml:",omitempty"` // implicitly parsed with time.ParseDuration()
 	Buckets       []float64           `yaml:",flow,omitempty"`
 	Quantiles     map[float64]float64 `yaml:",flow,omitempty"`
 	MaxAge        time.Duration       `yaml:"max_age,omitempty"`
+	AgeBuckets    int                 `yaml:"age_buckets,omitempty"`
 	Labels        map[string]string   `yaml:",omitempty"`
 }
 
@@ -170,6 +452,32 @@ type ServerConfig struct {
 	Key        string `yaml:",omitempty"`
 	ClientCA   string `yaml:"client_ca,omitempty"`
 	ClientAuth string `yaml:"client_auth,omitempty"`
+	// UnixSocket is the path of a Unix domain socket, an alternative to host and port.
+	UnixSocket string `yaml:"unix_socket,omitempty"`
+	// Listeners is an alternative to protocol, host, port, unix_socket, and the TLS settings if the endpoints are served on multiple addresses.
+	Listeners []ListenerConfig `yaml:",omitempty"`
+	// ReloadToken enables the /-/reload endpoint, requests must have the header 'Authorization: Bearer <token>'.
+	ReloadToken string `yaml:"reload_token,omitempty"`
+	// AdminToken enables the /-/delete endpoint, with the same Authorization header as the ReloadToken.
+	AdminToken string `yaml:"admin_token,omitempty"`
+	// BasicAuthUsers maps user names to bcrypt password hashes, like basic_auth_users in Prometheus' web config file.
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users,omitempty"`
+	// BearerTokens are accepted in the header 'Authorization: Bearer <token>'. Like BasicAuthUsers, they protect the metrics and the /debug/unmatched endpoint.
+	BearerTokens []string `yaml:"bearer_tokens,omitempty"`
+	// UnmatchedLines is the number of recent lines matching no metric that are listed on the /debug/unmatched endpoint, 0 disables the endpoint.
+	UnmatchedLines int `yaml:"unmatched_lines,omitempty"`
+}
+
+// ListenerConfig is an address where the endpoints of the server section are served, see ServerConfig.
+type ListenerConfig struct {
+	Protocol   string `yaml:",omitempty"`
+	Host       string `yaml:",omitempty"`
+	Port       int    `yaml:",omitempty"`
+	UnixSocket string `yaml:"unix_socket,omitempty"`
+	Cert       string `yaml:",omitempty"`
+	Key        string `yaml:",omitempty"`
+	ClientCA   string `yaml:"client_ca,omitempty"`
+	ClientAuth string `yaml:"client_auth,omitempty"`
 }
 
 func importMetrics(importsConfig ImportsConfig, fileLoader FileLoader) (MetricsConfig, error) {
@@ -201,6 +509,10 @@ func importMetrics(importsConfig ImportsConfig, fileLoader FileLoader) (MetricsC
 			if err != nil {
 				return nil, fmt.Errorf("%v: %v", file.Path, err)
 			}
+			metricsConfig, err = expandMetricGroups(metricsConfig)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", file.Path, err)
+			}
 			for i := range metricsConfig {
 				applyImportDefaults(&metricsConfig[i], importConfig.Defaults)
 				result = append(result, metricsConfig[i])
@@ -210,6 +522,56 @@ func importMetrics(importsConfig ImportsConfig, fileLoader FileLoader) (MetricsC
 	return result, nil
 }
 
+// expandMetricGroups replaces each entry with a metrics block by the metrics in the block.
+// The entry defines how lines are matched, the metrics define what they export, so that a pattern
+// feeding several metrics is only compiled and searched once. The metrics get the entry's match fields and a MatchGroup.
+func expandMetricGroups(metrics MetricsConfig) (MetricsConfig, error) {
+	result := make(MetricsConfig, 0, len(metrics))
+	for _, group := range metrics {
+		if len(group.Metrics) == 0 {
+			result = append(result, group)
+			continue
+		}
+		var matchFields MetricConfig
+		matchFields.setMatchFields(&group)
+		matchFields.Metrics = group.Metrics
+		if !reflect.DeepEqual(group, matchFields) {
+			return nil, fmt.Errorf("Invalid metric configuration: an entry with 'metrics.metrics' can only define %v, the other options must be defined for each of the metrics", matchFieldNames)
+		}
+		for _, metric := range group.Metrics {
+			if len(metric.Metrics) > 0 {
+				return nil, fmt.Errorf("Invalid metric configuration: metric %v: 'metrics.metrics' cannot be nested", metric.Name)
+			}
+			var empty MetricConfig
+			empty.setMatchFields(&metric)
+			if !reflect.DeepEqual(empty, MetricConfig{}) {
+				return nil, fmt.Errorf("Invalid metric configuration: metric %v: %v cannot be used in 'metrics.metrics', they are defined by the enclosing entry", metric.Name, matchFieldNames)
+			}
+			metric.setMatchFields(&group)
+			metric.MatchGroup = group.Metrics[0].Name
+			result = append(result, metric)
+		}
+	}
+	return result, nil
+}
+
+const matchFieldNames = "path, paths, sources, match, matches, drop_if_match, match_field, match_grok_field, anchor, regex_flags, and field_defaults"
+
+// setMatchFields copies the fields defining how lines are matched, see matchFieldNames.
+func (c *MetricConfig) setMatchFields(from *MetricConfig) {
+	c.Path = from.Path
+	c.Paths = from.Paths
+	c.Sources = from.Sources
+	c.Match = from.Match
+	c.Matches = from.Matches
+	c.DropIfMatch = from.DropIfMatch
+	c.MatchField = from.MatchField
+	c.MatchGrokField = from.MatchGrokField
+	c.Anchor = from.Anchor
+	c.RegexFlags = from.RegexFlags
+	c.FieldDefaults = from.FieldDefaults
+}
+
 func applyImportDefaults(metricConfig *MetricConfig, defaults DefaultConfig) {
 	for key, value := range defaults.Labels {
 		if _, exists := metricConfig.Labels[key]; !exists {
@@ -219,13 +581,17 @@ func applyImportDefaults(metricConfig *MetricConfig, defaults DefaultConfig) {
 			metricConfig.Labels[key] = value
 		}
 	}
-	if metricConfig.Type == "summary" && len(metricConfig.Quantiles) == 0 {
+	if (metricConfig.Type == "summary" || metricConfig.Type == "quantile") && len(metricConfig.Quantiles) == 0 {
 		metricConfig.Quantiles = defaults.Quantiles
 	}
-	if metricConfig.Type == "summary" && metricConfig.MaxAge == 0 {
+	hasMaxAge := metricConfig.Type == "summary" || metricConfig.Type == "distinct" || metricConfig.Type == "aggregate" || metricConfig.Type == "quantile"
+	if hasMaxAge && metricConfig.MaxAge == 0 {
 		metricConfig.MaxAge = defaults.MaxAge
 	}
-	if metricConfig.Type == "histogram" && len(metricConfig.Buckets) == 0 {
+	if hasMaxAge && metricConfig.AgeBuckets == 0 {
+		metricConfig.AgeBuckets = defaults.AgeBuckets
+	}
+	if metricConfig.Type == "histogram" && len(metricConfig.Buckets) == 0 && metricConfig.ExponentialBuckets == nil && metricConfig.LinearBuckets == nil {
 		metricConfig.Buckets = defaults.Buckets
 	}
 	if metricConfig.Retention == 0 {
@@ -235,16 +601,40 @@ func applyImportDefaults(metricConfig *MetricConfig, defaults DefaultConfig) {
 		metricConfig.Path = defaults.Path
 		metricConfig.Paths = defaults.Paths
 	}
+	if len(metricConfig.Sources) == 0 {
+		metricConfig.Sources = defaults.Sources
+	}
 }
 
 func (cfg *Config) addDefaults() {
 	cfg.Global.addDefaults()
-	cfg.Input.addDefaults()
+	for _, input := range cfg.AllInputs() {
+		input.addDefaults()
+	}
 	cfg.GrokPatterns.addDefaults()
+	cfg.LookupTables.addDefaults()
 	if cfg.AllMetrics != nil {
-		cfg.AllMetrics.addDefaults()
+		cfg.AllMetrics.addDefaults(cfg.Global.Anchor)
+		cfg.AllMetrics.addNamePrefix(cfg.Global.Namespace, cfg.Global.Subsystem)
 	}
 	cfg.Server.addDefaults()
+	cfg.RemoteWrite.addDefaults()
+	cfg.OTLP.addDefaults()
+}
+
+// addNamePrefix prepends global.namespace and global.subsystem to the metric names, like prometheus.BuildFQName().
+func (c *MetricsConfig) addNamePrefix(namespace, subsystem string) {
+	for i := range *c {
+		metric := &(*c)[i]
+		if metric.Name == "" {
+			continue // error in validate()
+		}
+		for _, prefix := range []string{subsystem, namespace} {
+			if prefix != "" {
+				metric.Name = prefix + "_" + metric.Name
+			}
+		}
+	}
 }
 
 func (c *GlobalConfig) addDefaults() {
@@ -254,6 +644,12 @@ func (c *GlobalConfig) addDefaults() {
 	if c.RetentionCheckInterval == 0 {
 		c.RetentionCheckInterval = defaultRetentionCheckInterval
 	}
+	if c.RegexEngine == "" {
+		c.RegexEngine = defaultRegexEngine
+	}
+	if c.StateFile != "" && c.StateSyncInterval == 0 {
+		c.StateSyncInterval = defaultStateSyncInterval
+	}
 }
 
 func (c *InputConfig) addDefaults() {
@@ -263,6 +659,23 @@ func (c *InputConfig) addDefaults() {
 	if c.Type == inputTypeFile && len(c.FailOnMissingLogfileString) == 0 {
 		c.FailOnMissingLogfileString = "true"
 	}
+	if c.Type == inputTypeFile && c.PositionsFile != "" && c.PositionsSyncInterval == 0 {
+		c.PositionsSyncInterval = defaultPositionsSyncInterval
+	}
+	if c.MaxLineLength > 0 && c.MaxLineLengthAction == "" {
+		c.MaxLineLengthAction = defaultMaxLineLengthAction
+	}
+	if (c.RateLimit > 0 || c.LineBufferSize > 0) && c.BackpressureAction == "" {
+		c.BackpressureAction = defaultBackpressureAction
+	}
+	if c.MultilineStartPattern != "" {
+		if c.MultilineTimeout == 0 {
+			c.MultilineTimeout = defaultMultilineTimeout
+		}
+		if c.MultilineMaxLines == 0 {
+			c.MultilineMaxLines = defaultMultilineMaxLines
+		}
+	}
 	if c.Type == inputTypeWebhook {
 		if len(c.WebhookPath) == 0 {
 			c.WebhookPath = "/webhook"
@@ -276,6 +689,9 @@ func (c *InputConfig) addDefaults() {
 		if len(c.WebhookTextBulkSeparator) == 0 {
 			c.WebhookTextBulkSeparator = "\n\n"
 		}
+		if c.WebhookMaxBodySize == 0 {
+			c.WebhookMaxBodySize = defaultWebhookMaxBodySize
+		}
 	}
 	if c.Type == inputTypeKafka {
 		c.KafkaConsumeFromOldest = false
@@ -290,36 +706,189 @@ func (c *InputConfig) addDefaults() {
 			c.KafkaConsumerGroupName = "grok_exporter"
 		}
 	}
+	if c.Type == inputTypeSyslog {
+		if c.SyslogProtocol == "" {
+			c.SyslogProtocol = "udp"
+		}
+		if c.SyslogAddress == "" {
+			c.SyslogAddress = ":514"
+		}
+	}
+	if c.Type == inputTypeSocket {
+		if c.SocketNetwork == "" {
+			c.SocketNetwork = "tcp"
+		}
+		if c.SocketMaxConnections == 0 {
+			c.SocketMaxConnections = 100
+		}
+		if c.SocketMaxLineLength == 0 {
+			c.SocketMaxLineLength = 64 * 1024
+		}
+	}
+	if c.Type == inputTypeGelf {
+		if c.GelfProtocol == "" {
+			c.GelfProtocol = "udp"
+		}
+		if c.GelfAddress == "" {
+			c.GelfAddress = ":12201"
+		}
+	}
+	if c.Type == inputTypeS3 && c.S3Region == "" {
+		c.S3Region = "us-east-1"
+	}
+	if c.Type == inputTypeNats && c.NatsUrl == "" {
+		c.NatsUrl = "nats://localhost:4222"
+	}
+	if c.Type == inputTypeMqtt && c.MqttUrl == "" {
+		c.MqttUrl = "tcp://localhost:1883"
+	}
 }
 
 func (c *GrokPatternsConfig) addDefaults() {}
 
-func (c *MetricsConfig) addDefaults() {
+func (c LookupTablesConfig) addDefaults() {
+	for i := range c {
+		if c[i].Format == "" {
+			c[i].Format = lookupTableFormat(c[i].File)
+		}
+		if c[i].ReloadInterval == 0 {
+			c[i].ReloadInterval = defaultLookupReloadInterval
+		}
+	}
+}
+
+func (c RemoteWriteConfig) addDefaults() {
+	for i := range c {
+		if c[i].Interval == 0 {
+			c[i].Interval = defaultRemoteWriteInterval
+		}
+		if c[i].RemoteTimeout == 0 {
+			c[i].RemoteTimeout = defaultRemoteWriteTimeout
+		}
+		if c[i].QueueConfig.MaxSamplesPerSend == 0 {
+			c[i].QueueConfig.MaxSamplesPerSend = defaultMaxSamplesPerSend
+		}
+		if c[i].QueueConfig.MinBackoff == 0 {
+			c[i].QueueConfig.MinBackoff = defaultMinBackoff
+		}
+		if c[i].QueueConfig.MaxBackoff == 0 {
+			c[i].QueueConfig.MaxBackoff = defaultMaxBackoff
+		}
+	}
+}
+
+func (c OTLPConfig) addDefaults() {
+	for i := range c {
+		if c[i].Interval == 0 {
+			c[i].Interval = defaultOTLPInterval
+		}
+		if c[i].Timeout == 0 {
+			c[i].Timeout = defaultOTLPTimeout
+		}
+		if c[i].RetryOnFailure.InitialInterval == 0 {
+			c[i].RetryOnFailure.InitialInterval = defaultMinBackoff
+		}
+		if c[i].RetryOnFailure.MaxInterval == 0 {
+			c[i].RetryOnFailure.MaxInterval = defaultMaxBackoff
+		}
+	}
+}
+
+// lookupTableFormat derives the format from the file extension, or returns "" if the extension is unknown.
+func lookupTableFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".csv":
+		return "csv"
+	case ".yml", ".yaml":
+		return "yaml"
+	default:
+		return ""
+	}
+}
+
+func (c *MetricsConfig) addDefaults(defaultAnchor string) {
 	for i := range *c {
 		metric := &(*c)[i]
-		if metric.Type == "counter" && len(metric.Value) == 0 {
+		if (metric.Type == "counter" || metric.Type == "info") && len(metric.Value) == 0 {
+			metric.Value = "1.0"
+		}
+		if metric.Type == "gauge" && (metric.Operation == GaugeInc || metric.Operation == GaugeDec) && len(metric.Value) == 0 {
 			metric.Value = "1.0"
 		}
+		if len(metric.Anchor) == 0 {
+			metric.Anchor = defaultAnchor
+		}
+		if len(metric.Anchor) == 0 {
+			metric.Anchor = AnchorNone
+		}
 	}
 }
 
 func (c *ServerConfig) addDefaults() {
-	if c.Protocol == "" {
-		c.Protocol = "http"
+	if len(c.Listeners) == 0 {
+		listener := c.listener()
+		listener.addDefaults()
+		c.Protocol, c.Port, c.ClientAuth = listener.Protocol, listener.Port, listener.ClientAuth
 	}
-	if c.Port == 0 {
-		c.Port = 9144
+	for i := range c.Listeners {
+		c.Listeners[i].addDefaults()
 	}
 	if c.Path == "" {
 		c.Path = "/metrics"
 	}
+}
+
+func (c *ListenerConfig) addDefaults() {
+	if c.Protocol == "" {
+		c.Protocol = "http"
+	}
+	if c.Port == 0 && c.UnixSocket == "" {
+		c.Port = 9144
+	}
 	if len(c.ClientCA) > 0 && len(c.ClientAuth) == 0 {
 		c.ClientAuth = "RequireAndVerifyClientCert"
 	}
 }
 
+// AllListeners returns the listeners from 'server.listeners', or the single listener configured directly in the 'server' section.
+func (c *ServerConfig) AllListeners() []ListenerConfig {
+	if len(c.Listeners) == 0 {
+		return []ListenerConfig{c.listener()}
+	}
+	return c.Listeners
+}
+
+func (c *ServerConfig) listener() ListenerConfig {
+	return ListenerConfig{
+		Protocol:   c.Protocol,
+		Host:       c.Host,
+		Port:       c.Port,
+		UnixSocket: c.UnixSocket,
+		Cert:       c.Cert,
+		Key:        c.Key,
+		ClientCA:   c.ClientCA,
+		ClientAuth: c.ClientAuth,
+	}
+}
+
+// AllInputs returns the inputs from the 'inputs' section, or the single input from the 'input' section.
+func (cfg *Config) AllInputs() []*InputConfig {
+	if len(cfg.Inputs) == 0 {
+		return []*InputConfig{&cfg.Input}
+	}
+	result := make([]*InputConfig, 0, len(cfg.Inputs))
+	for i := range cfg.Inputs {
+		result = append(result, &cfg.Inputs[i])
+	}
+	return result
+}
+
 func (cfg *Config) validate() error {
-	err := cfg.Input.validate()
+	err := cfg.Global.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.validateInputs()
 	if err != nil {
 		return err
 	}
@@ -327,14 +896,50 @@ func (cfg *Config) validate() error {
 	if err != nil {
 		return err
 	}
+	err = cfg.AdditionalPatterns.validate()
+	if err != nil {
+		return err
+	}
 	err = cfg.Imports.validate()
 	if err != nil {
 		return err
 	}
+	err = cfg.Filter.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.LookupTables.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.GeoIP.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.RemoteWrite.validate()
+	if err != nil {
+		return err
+	}
+	err = cfg.OTLP.validate()
+	if err != nil {
+		return err
+	}
 	err = cfg.AllMetrics.validate()
 	if err != nil {
 		return err
 	}
+	err = cfg.validateGlobalLabels()
+	if err != nil {
+		return err
+	}
+	err = cfg.validateTemplateReferences()
+	if err != nil {
+		return err
+	}
+	err = cfg.validateSources()
+	if err != nil {
+		return err
+	}
 	err = cfg.Server.validate()
 	if err != nil {
 		return err
@@ -342,6 +947,246 @@ func (cfg *Config) validate() error {
 	return nil
 }
 
+// validateGlobalLabels checks that the metrics do not define the global.labels, as Prometheus does not allow duplicate label names.
+func (cfg *Config) validateGlobalLabels() error {
+	for _, metric := range cfg.AllMetrics {
+		for name := range cfg.Global.Labels {
+			_, isLabel := metric.Labels[name]
+			_, isConstLabel := metric.ConstLabels[name]
+			if isLabel || isConstLabel {
+				return fmt.Errorf("invalid metric configuration: metric %v: label %v is already defined in 'global.labels'", metric.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *GlobalConfig) validate() error {
+	if c.RegexEngine != "oniguruma" && c.RegexEngine != "re2" && c.RegexEngine != "auto" {
+		return fmt.Errorf("invalid global configuration: 'global.regex_engine' must be \"oniguruma|re2|auto\"")
+	}
+	if c.BundledPatterns != "" && c.BundledPatterns != "legacy" && c.BundledPatterns != "ecs-v1" && c.BundledPatterns != "none" {
+		return fmt.Errorf("invalid global configuration: 'global.bundled_patterns' must be \"legacy|ecs-v1|none\"")
+	}
+	if c.Anchor != "" && !isAnchor(c.Anchor) {
+		return fmt.Errorf("invalid global configuration: 'global.anchor' must be \"none|start|full\"")
+	}
+	if c.MatchTimeout < 0 {
+		return fmt.Errorf("invalid global configuration: 'global.match_timeout' must not be negative")
+	}
+	if c.StateFile == "" && c.StateSyncInterval != 0 {
+		return fmt.Errorf("invalid global configuration: cannot use 'global.state_sync_interval' without 'global.state_file'")
+	}
+	if c.StateSyncInterval < 0 {
+		return fmt.Errorf("invalid global configuration: 'global.state_sync_interval' must not be negative")
+	}
+	err := validateConstLabels(c.Labels, "invalid global configuration: 'global.labels'")
+	if err != nil {
+		return err
+	}
+	for _, name := range builtinLabelNames {
+		if _, exists := c.Labels[name]; exists {
+			return fmt.Errorf("invalid global configuration: 'global.labels': %v cannot be used, because it is a label of the built-in metrics", name)
+		}
+	}
+	return nil
+}
+
+// TimestampLocation returns the timestamp_timezone, or UTC if it is not configured.
+func (c *InputConfig) TimestampLocation() *time.Location {
+	if c.TimestampTimezone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(c.TimestampTimezone)
+	if err != nil {
+		return time.UTC // cannot happen, the time zone was checked in validate()
+	}
+	return location
+}
+
+// CsvDelimiterRune returns the csv_delimiter, or ',' if it is not configured.
+func (c *InputConfig) CsvDelimiterRune() rune {
+	if c.CsvDelimiter == "" {
+		return ','
+	}
+	r, _ := utf8.DecodeRuneInString(c.CsvDelimiter)
+	return r
+}
+
+func (c *InputConfig) parseStartPosition() error {
+	if c.StartPosition == "" {
+		c.RestorePositions = c.PositionsFile != ""
+		if c.Readall {
+			c.StartPositionType = "beginning"
+		} else {
+			c.StartPositionType = "end"
+		}
+		return nil
+	}
+	if c.Readall {
+		return fmt.Errorf("invalid input configuration: cannot use both 'input.readall' and 'input.start_position'")
+	}
+	parts := strings.SplitN(c.StartPosition, ":", 2)
+	c.StartPositionType = parts[0]
+	switch {
+	case len(parts) == 1 && (c.StartPositionType == "beginning" || c.StartPositionType == "end"):
+	case len(parts) == 1 && c.StartPositionType == "saved":
+		if c.PositionsFile == "" {
+			return fmt.Errorf("invalid input configuration: 'input.start_position: saved' requires 'input.positions_file'")
+		}
+		c.RestorePositions = true
+		c.StartPositionType = "end"
+	case len(parts) == 2 && (c.StartPositionType == "byte" || c.StartPositionType == "line"):
+		offset, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || offset < 0 || (c.StartPositionType == "line" && offset == 0) {
+			return fmt.Errorf("invalid input configuration: '%v' is not a valid offset in 'input.start_position'", parts[1])
+		}
+		c.StartPositionOffset = offset
+	default:
+		return fmt.Errorf("invalid input configuration: '%v' is not a valid 'input.start_position', use beginning, end, saved, byte:<offset>, or line:<number>", c.StartPosition)
+	}
+	return nil
+}
+
+// parseStartFrom must be called after parseStartPosition().
+func (c *InputConfig) parseStartFrom() error {
+	var err error
+	if c.StartFromString == "" {
+		if c.StartFromPattern != "" || c.StartFromLayout != "" {
+			return fmt.Errorf("invalid input configuration: 'input.start_from_pattern' and 'input.start_from_layout' require 'input.start_from'")
+		}
+		return nil
+	}
+	if c.Readall || (c.StartPosition != "" && c.StartPosition != "saved") {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.start_from' with 'input.readall' or 'input.start_position', except for 'input.start_position: saved'")
+	}
+	c.StartFrom, err = time.Parse(time.RFC3339, c.StartFromString)
+	if err != nil {
+		return fmt.Errorf("invalid input configuration: '%v' is not a valid RFC3339 timestamp in 'input.start_from'", c.StartFromString)
+	}
+	if c.StartFromPattern == "" || c.StartFromLayout == "" {
+		return fmt.Errorf("invalid input configuration: 'input.start_from' requires 'input.start_from_pattern' and 'input.start_from_layout'")
+	}
+	c.StartPositionType = "timestamp"
+	return nil
+}
+
+func (c *InputConfig) parseTimestamp() error {
+	var err error
+	if (c.TimestampPattern == "") != (c.TimestampLayout == "") {
+		return fmt.Errorf("invalid input configuration: 'input.timestamp_pattern' and 'input.timestamp_layout' must be used together")
+	}
+	if c.TimestampPattern == "" && (c.TimestampTimezone != "" || c.DropOlderThan != 0) {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.timestamp_timezone' or 'input.drop_older_than' without 'input.timestamp_pattern'")
+	}
+	if c.DropOlderThan < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.drop_older_than' must not be negative")
+	}
+	if c.TimestampTimezone != "" {
+		_, err = time.LoadLocation(c.TimestampTimezone)
+		if err != nil {
+			return fmt.Errorf("invalid input configuration: '%v' is not a valid time zone in 'input.timestamp_timezone': %v", c.TimestampTimezone, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) validateInputs() error {
+	if len(cfg.Inputs) == 0 {
+		return cfg.Input.validate()
+	}
+	if !reflect.DeepEqual(cfg.Input, InputConfig{}) {
+		return fmt.Errorf("invalid configuration: cannot use both 'input' and 'inputs'")
+	}
+	ids := make(map[string]bool)
+	types := make(map[string]bool)
+	positionsFiles := make(map[string]bool)
+	for _, input := range cfg.AllInputs() {
+		if input.Id == "" {
+			return fmt.Errorf("invalid input configuration: 'id' is required for each input in 'inputs'")
+		}
+		if ids[input.Id] {
+			return fmt.Errorf("invalid input configuration: duplicate input id '%v'", input.Id)
+		}
+		ids[input.Id] = true
+		// stdin can only be read once, and there is only one webhook handler
+		if (input.Type == inputTypeStdin || input.Type == inputTypeWebhook) && types[input.Type] {
+			return fmt.Errorf("invalid input configuration: only one input of type %v is supported", input.Type)
+		}
+		types[input.Type] = true
+		if input.PositionsFile != "" && positionsFiles[input.PositionsFile] {
+			return fmt.Errorf("invalid input configuration: input '%v': positions file %v is used by another input", input.Id, input.PositionsFile)
+		}
+		positionsFiles[input.PositionsFile] = true
+		err := input.validate()
+		if err != nil {
+			return fmt.Errorf("input '%v': %v", input.Id, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) validateSources() error {
+	ids := make(map[string]bool)
+	for _, input := range cfg.AllInputs() {
+		ids[input.Id] = true
+	}
+	for _, metric := range cfg.AllMetrics {
+		for _, source := range metric.Sources {
+			if source == "" || !ids[source] {
+				return fmt.Errorf("invalid metric configuration: metric %v: 'sources' references unknown input id '%v'", metric.Name, source)
+			}
+		}
+		// Without match, the metric matches all lines that match the input's match pattern, or all lines that have the match_field.
+		if metric.Match == "" && len(metric.Matches) == 0 && metric.MatchField == "" && !cfg.hasMatch(metric.Sources) {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.match' must not be empty.")
+		}
+		if metric.MatchGrokField != "" && !cfg.hasMatch(metric.Sources) {
+			return fmt.Errorf("invalid metric configuration: metric %v: 'match_grok_field' requires that all of the metric's inputs have a 'match' pattern", metric.Name)
+		}
+		if metric.UseLogTimestamp && !cfg.hasLogTime(metric.Sources) {
+			return fmt.Errorf("invalid metric configuration: metric %v: 'use_log_timestamp' requires an input with 'timestamp_pattern'", metric.Name)
+		}
+	}
+	return nil
+}
+
+// hasLogTime is true if any of the inputs with the ids in sources has a timestamp_pattern. Empty sources means all inputs.
+func (cfg *Config) hasLogTime(sources []string) bool {
+	for _, input := range cfg.AllInputs() {
+		if input.TimestampPattern == "" {
+			continue
+		}
+		if len(sources) == 0 {
+			return true
+		}
+		for _, source := range sources {
+			if source == input.Id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasMatch is true if all of the inputs with the ids in sources have a match pattern. Empty sources means all inputs.
+func (cfg *Config) hasMatch(sources []string) bool {
+	for _, input := range cfg.AllInputs() {
+		if input.Match != "" {
+			continue
+		}
+		if len(sources) == 0 {
+			return false
+		}
+		for _, source := range sources {
+			if source == input.Id {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func validateGlobs(p *PathsAndGlobs, optional bool, prefix string) error {
 	if !optional && len(p.Path) == 0 && len(p.Paths) == 0 {
 		return fmt.Errorf("%v: one of 'path' or 'paths' is required", prefix)
@@ -371,6 +1216,127 @@ func validateGlobs(p *PathsAndGlobs, optional bool, prefix string) error {
 
 func (c *InputConfig) validate() error {
 	var err error
+	if c.Type != inputTypeFile && c.PositionsFile != "" {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.positions_file' when 'input.type' is %v", c.Type)
+	}
+	if c.Type != inputTypeFile && c.ReadCompressedBackups {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.read_compressed_backups' when 'input.type' is %v", c.Type)
+	}
+	if c.Type != inputTypeFile && c.Olddir != "" {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.olddir' when 'input.type' is %v", c.Type)
+	}
+	if c.Type != inputTypeFile && c.FollowPath {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.follow_path' when 'input.type' is %v", c.Type)
+	}
+	if c.Type != inputTypeFile && c.StartPosition != "" {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.start_position' when 'input.type' is %v", c.Type)
+	}
+	if c.Format != "" && c.Format != "plain" && c.Format != "json" && c.Format != "csv" {
+		return fmt.Errorf("invalid input configuration: 'input.format' must be \"plain|json|csv\"")
+	}
+	if (c.Format == "json" || c.Format == "csv") && c.Type != inputTypeFile && c.Type != inputTypeStdin && c.Type != inputTypeKafka && c.Type != inputTypeS3 {
+		// the other input types provide their own extra fields
+		return fmt.Errorf("invalid input configuration: cannot use 'input.format: %v' when 'input.type' is %v", c.Format, c.Type)
+	}
+	if c.Format != "csv" && (c.CsvDelimiter != "" || len(c.CsvFields) > 0) {
+		return fmt.Errorf("invalid input configuration: 'input.csv_delimiter' and 'input.csv_fields' can only be used with 'input.format: csv'")
+	}
+	if c.Format == "csv" && len(c.CsvFields) == 0 {
+		return fmt.Errorf("invalid input configuration: 'input.format: csv' requires 'input.csv_fields'")
+	}
+	if c.CsvDelimiter != "" && (utf8.RuneCountInString(c.CsvDelimiter) != 1 || strings.ContainsAny(c.CsvDelimiter, "\"\r\n")) {
+		return fmt.Errorf("invalid input configuration: 'input.csv_delimiter' must be a single character other than a quote or a line break")
+	}
+	if c.Type != inputTypeFile && (c.StartFromString != "" || c.StartFromPattern != "" || c.StartFromLayout != "") {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.start_from' when 'input.type' is %v", c.Type)
+	}
+	if c.Type != inputTypeFile && c.Type != inputTypeStdin && (c.LineDelimiter != "" || c.LineDelimiterPattern != "") {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.line_delimiter' or 'input.line_delimiter_pattern' when 'input.type' is %v", c.Type)
+	}
+	if c.LineDelimiter != "" && c.LineDelimiterPattern != "" {
+		return fmt.Errorf("invalid input configuration: cannot use both 'input.line_delimiter' and 'input.line_delimiter_pattern'")
+	}
+	if c.LineDelimiterPattern != "" {
+		delimiterRegex, err := regexp.Compile(c.LineDelimiterPattern)
+		if err != nil {
+			return fmt.Errorf("invalid input configuration: invalid regular expression in 'input.line_delimiter_pattern': %v", err)
+		}
+		if delimiterRegex.MatchString("") {
+			return fmt.Errorf("invalid input configuration: 'input.line_delimiter_pattern' must not match the empty string")
+		}
+	}
+	if c.Charset != "" {
+		if c.Type != inputTypeFile && c.Type != inputTypeStdin {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.charset' when 'input.type' is %v", c.Type)
+		}
+		_, err = fswatcher.LookupCharset(c.Charset)
+		if err != nil {
+			return fmt.Errorf("invalid input configuration: 'input.charset': %v", err)
+		}
+		if c.LineDelimiterPattern != "" {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.line_delimiter_pattern' with 'input.charset'")
+		}
+	}
+	if c.Type != inputTypeFile && c.Type != inputTypeStdin && (c.MaxLineLength != 0 || c.MaxLineLengthAction != "") {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.max_line_length' or 'input.max_line_length_action' when 'input.type' is %v", c.Type)
+	}
+	if c.MaxLineLength < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.max_line_length' must not be negative")
+	}
+	if c.MaxLineLength == 0 && c.MaxLineLengthAction != "" {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.max_line_length_action' without 'input.max_line_length'")
+	}
+	if c.MaxLineLengthAction != "" && c.MaxLineLengthAction != "truncate" && c.MaxLineLengthAction != "split" {
+		return fmt.Errorf("invalid input configuration: 'input.max_line_length_action' must be \"truncate|split\"")
+	}
+	if c.RateLimit < 0 || c.LineBufferSize < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.rate_limit' and 'input.line_buffer_size' must not be negative")
+	}
+	if c.RateLimit == 0 && c.LineBufferSize == 0 && c.BackpressureAction != "" {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.backpressure_action' without 'input.rate_limit' or 'input.line_buffer_size'")
+	}
+	if c.BackpressureAction != "" && c.BackpressureAction != "block" && c.BackpressureAction != "drop" {
+		return fmt.Errorf("invalid input configuration: 'input.backpressure_action' must be \"block|drop\"")
+	}
+	if c.DedupWindow < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.dedup_window' must not be negative")
+	}
+	if c.MultilineStartPattern == "" && (c.MultilineTimeout != 0 || c.MultilineMaxLines != 0) {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.multiline_timeout' or 'input.multiline_max_lines' without 'input.multiline_start_pattern'")
+	}
+	if c.MultilineTimeout < 0 || c.MultilineMaxLines < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.multiline_timeout' and 'input.multiline_max_lines' must not be negative")
+	}
+	if c.Type != inputTypeFile && len(c.Exclude) > 0 {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.exclude' when 'input.type' is %v", c.Type)
+	}
+	for _, pattern := range c.Exclude {
+		if !glob.IsPatternValid(pattern) {
+			return fmt.Errorf("invalid input configuration: 'input.exclude': %q: invalid glob pattern", pattern)
+		}
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			return fmt.Errorf("invalid input configuration: 'input.exclude': %q: patterns must match file names, not paths", pattern)
+		}
+	}
+	if c.Type != inputTypeFile && c.IdleTimeout != 0 {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.idle_timeout' when 'input.type' is %v", c.Type)
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.idle_timeout' must not be negative")
+	}
+	if c.Type != inputTypeFile && c.PartialLineTimeout != 0 {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.partial_line_timeout' when 'input.type' is %v", c.Type)
+	}
+	if c.PartialLineTimeout < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.partial_line_timeout' must not be negative")
+	}
+	if c.PositionsFile == "" && c.PositionsSyncInterval > 0 {
+		return fmt.Errorf("invalid input configuration: cannot use 'input.positions_sync_interval' without 'input.positions_file'")
+	}
+	err = c.parseTimestamp()
+	if err != nil {
+		return err
+	}
 	switch {
 	case c.Type == inputTypeStdin:
 		if len(c.Path) > 0 {
@@ -390,6 +1356,17 @@ func (c *InputConfig) validate() error {
 		if err != nil {
 			return err
 		}
+		err = c.parseStartPosition()
+		if err != nil {
+			return err
+		}
+		err = c.parseStartFrom()
+		if err != nil {
+			return err
+		}
+		if c.ReadCompressedBackups && c.StartPositionType != "beginning" {
+			return fmt.Errorf("invalid input configuration: 'input.read_compressed_backups' requires 'input.readall: true' or 'input.start_position: beginning'")
+		}
 		if len(c.FailOnMissingLogfileString) > 0 {
 			c.FailOnMissingLogfile, err = strconv.ParseBool(c.FailOnMissingLogfileString)
 			if err != nil {
@@ -422,6 +1399,9 @@ func (c *InputConfig) validate() error {
 		} else if c.WebhookJsonSelector[0] != '.' {
 			return fmt.Errorf("invalid input configuration: 'input.webhook_json_selector' must start with \".\"")
 		}
+		if c.WebhookMaxBodySize < 0 {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_max_body_size' must not be negative")
+		}
 		if c.WebhookFormat == "text_bulk" && c.WebhookTextBulkSeparator == "" {
 			return fmt.Errorf("invalid input configuration: 'input.webhook_text_bulk_separator' is required for input type \"webhook\" and webhook_format \"text_bulk\"")
 		}
@@ -445,6 +1425,173 @@ func (c *InputConfig) validate() error {
 			return fmt.Errorf("invalid input configuration: Kafka 'input.kafka_version' must be >= 0.8.0")
 		}
 
+	case c.Type == inputTypeJournald:
+		if c.Path != "" {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.path' when 'input.type' is %v", inputTypeJournald)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.paths' when 'input.type' is %v", inputTypeJournald)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.poll_interval' when 'input.type' is %v", inputTypeJournald)
+		}
+	case c.Type == inputTypeSyslog:
+		if c.Path != "" {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.path' when 'input.type' is %v", inputTypeSyslog)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.paths' when 'input.type' is %v", inputTypeSyslog)
+		}
+		if c.Readall {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.readall' when 'input.type' is %v", inputTypeSyslog)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.poll_interval' when 'input.type' is %v", inputTypeSyslog)
+		}
+		if c.SyslogProtocol != "udp" && c.SyslogProtocol != "tcp" {
+			return fmt.Errorf("invalid input configuration: 'input.syslog_protocol' must be \"udp|tcp\"")
+		}
+		if _, _, err := net.SplitHostPort(c.SyslogAddress); err != nil {
+			return fmt.Errorf("invalid input configuration: 'input.syslog_address' must be in the format \"host:port\": %v", err)
+		}
+	case c.Type == inputTypeKubernetes:
+		if c.Path != "" {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.path' when 'input.type' is %v", inputTypeKubernetes)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.paths' when 'input.type' is %v", inputTypeKubernetes)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.poll_interval' when 'input.type' is %v", inputTypeKubernetes)
+		}
+		if c.KubernetesApiServer != "" && !strings.HasPrefix(c.KubernetesApiServer, "https://") && !strings.HasPrefix(c.KubernetesApiServer, "http://") {
+			return fmt.Errorf("invalid input configuration: 'input.kubernetes_api_server' must start with \"https://\" or \"http://\"")
+		}
+	case c.Type == inputTypeSocket:
+		if c.Path != "" {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.path' when 'input.type' is %v", inputTypeSocket)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.paths' when 'input.type' is %v", inputTypeSocket)
+		}
+		if c.Readall {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.readall' when 'input.type' is %v", inputTypeSocket)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.poll_interval' when 'input.type' is %v", inputTypeSocket)
+		}
+		if c.SocketNetwork != "tcp" && c.SocketNetwork != "unix" {
+			return fmt.Errorf("invalid input configuration: 'input.socket_network' must be \"tcp|unix\"")
+		}
+		if c.SocketAddress == "" {
+			return fmt.Errorf("invalid input configuration: 'input.socket_address' is required for input type \"socket\"")
+		}
+		if c.SocketNetwork == "tcp" {
+			if _, _, err := net.SplitHostPort(c.SocketAddress); err != nil {
+				return fmt.Errorf("invalid input configuration: 'input.socket_address' must be in the format \"host:port\": %v", err)
+			}
+		}
+		if c.SocketMaxConnections < 0 {
+			return fmt.Errorf("invalid input configuration: 'input.socket_max_connections' must be positive")
+		}
+		if c.SocketMaxLineLength < 0 {
+			return fmt.Errorf("invalid input configuration: 'input.socket_max_line_length' must be positive")
+		}
+	case c.Type == inputTypeGelf:
+		if c.Path != "" {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.path' when 'input.type' is %v", inputTypeGelf)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.paths' when 'input.type' is %v", inputTypeGelf)
+		}
+		if c.Readall {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.readall' when 'input.type' is %v", inputTypeGelf)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.poll_interval' when 'input.type' is %v", inputTypeGelf)
+		}
+		if c.GelfProtocol != "udp" && c.GelfProtocol != "tcp" {
+			return fmt.Errorf("invalid input configuration: 'input.gelf_protocol' must be \"udp|tcp\"")
+		}
+		if _, _, err := net.SplitHostPort(c.GelfAddress); err != nil {
+			return fmt.Errorf("invalid input configuration: 'input.gelf_address' must be in the format \"host:port\": %v", err)
+		}
+	case c.Type == inputTypeS3:
+		if c.Path != "" {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.path' when 'input.type' is %v", inputTypeS3)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.paths' when 'input.type' is %v", inputTypeS3)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.poll_interval' when 'input.type' is %v", inputTypeS3)
+		}
+		if c.S3Bucket == "" {
+			return fmt.Errorf("invalid input configuration: 'input.s3_bucket' is required for input type \"s3\"")
+		}
+		if c.S3Endpoint != "" && !strings.HasPrefix(c.S3Endpoint, "https://") && !strings.HasPrefix(c.S3Endpoint, "http://") {
+			return fmt.Errorf("invalid input configuration: 'input.s3_endpoint' must start with \"https://\" or \"http://\"")
+		}
+		if len(c.S3StartTimeString) > 0 {
+			c.S3StartTime, err = time.Parse(time.RFC3339, c.S3StartTimeString)
+			if err != nil {
+				return fmt.Errorf("invalid input configuration: '%v' is not a valid RFC3339 timestamp in 'input.s3_start_time'", c.S3StartTimeString)
+			}
+		}
+		if len(c.S3EndTimeString) > 0 {
+			c.S3EndTime, err = time.Parse(time.RFC3339, c.S3EndTimeString)
+			if err != nil {
+				return fmt.Errorf("invalid input configuration: '%v' is not a valid RFC3339 timestamp in 'input.s3_end_time'", c.S3EndTimeString)
+			}
+		}
+		if !c.S3StartTime.IsZero() && !c.S3EndTime.IsZero() && !c.S3StartTime.Before(c.S3EndTime) {
+			return fmt.Errorf("invalid input configuration: 'input.s3_start_time' must be before 'input.s3_end_time'")
+		}
+	case c.Type == inputTypeNats:
+		if c.Path != "" {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.path' when 'input.type' is %v", inputTypeNats)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.paths' when 'input.type' is %v", inputTypeNats)
+		}
+		if c.Readall {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.readall' when 'input.type' is %v", inputTypeNats)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.poll_interval' when 'input.type' is %v", inputTypeNats)
+		}
+		if len(c.NatsSubjects) == 0 {
+			return fmt.Errorf("invalid input configuration: 'input.nats_subjects' is required for input type \"nats\"")
+		}
+		u, err := url.Parse(c.NatsUrl)
+		if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Hostname() == "" {
+			return fmt.Errorf("invalid input configuration: 'input.nats_url' must be in the format \"nats://host:port\" or \"tls://host:port\"")
+		}
+	case c.Type == inputTypeMqtt:
+		if c.Path != "" {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.path' when 'input.type' is %v", inputTypeMqtt)
+		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.paths' when 'input.type' is %v", inputTypeMqtt)
+		}
+		if c.Readall {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.readall' when 'input.type' is %v", inputTypeMqtt)
+		}
+		if c.PollInterval > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.poll_interval' when 'input.type' is %v", inputTypeMqtt)
+		}
+		if len(c.MqttTopics) == 0 {
+			return fmt.Errorf("invalid input configuration: 'input.mqtt_topics' is required for input type \"mqtt\"")
+		}
+		u, err := url.Parse(c.MqttUrl)
+		if err != nil || u.Hostname() == "" {
+			return fmt.Errorf("invalid input configuration: 'input.mqtt_url' must be in the format \"tcp://host:port\" or \"ssl://host:port\"")
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt", "ssl", "tls", "mqtts":
+		default:
+			return fmt.Errorf("invalid input configuration: unsupported scheme %q in 'input.mqtt_url', use \"tcp\" or \"ssl\"", u.Scheme)
+		}
 	default:
 		return fmt.Errorf("unsupported 'input.type': %v", c.Type)
 	}
@@ -464,6 +1611,7 @@ func (c ImportConfig) validate() error {
 			{"buckets", len(c.Defaults.Buckets) > 0},
 			{"quantiles", len(c.Defaults.Quantiles) > 0},
 			{"max_age", c.Defaults.MaxAge != 0},
+			{"age_buckets", c.Defaults.AgeBuckets != 0},
 			{"labels", len(c.Defaults.Labels) > 0},
 		} {
 			if field.present {
@@ -491,6 +1639,228 @@ func (c *GrokPatternsConfig) validate() error {
 	return nil
 }
 
+var patternNameRegex = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var metricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// builtinLabelNames are the label names of the built-in metrics, they cannot be used in global.labels.
+var builtinLabelNames = []string{"metric", "input", "status", "version", "builddate", "branch", "revision", "goversion", "platform", "set", "code", "le", "quantile"}
+
+func validateConstLabels(labels map[string]string, where string) error {
+	for name, value := range labels {
+		if !labelNameRegex.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("%v: '%v' is not a valid label name", where, name)
+		}
+		if len(value) == 0 {
+			return fmt.Errorf("%v: label %v is empty", where, name)
+		}
+	}
+	return nil
+}
+
+// expandEnv replaces ${VAR} and $VAR in the label values with the environment variable, and ${VAR:-default} with
+// the default if VAR is not set. It is an error if a variable without default is not set.
+func expandEnv(labels map[string]string, where string) error {
+	var err error
+	for name, value := range labels {
+		labels[name] = os.Expand(value, func(variable string) string {
+			variable, defaultValue, hasDefault := cutString(variable, ":-")
+			result, ok := os.LookupEnv(variable)
+			switch {
+			case ok:
+				return result
+			case hasDefault:
+				return defaultValue
+			}
+			if err == nil {
+				err = fmt.Errorf("%v: label %v: environment variable %v is not set", where, name, variable)
+			}
+			return ""
+		})
+	}
+	return err
+}
+
+func cutString(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func (c *FilterConfig) validate() error {
+	for _, pattern := range c.Include {
+		if pattern == "" {
+			return fmt.Errorf("invalid filter configuration: 'filter.include' must not contain empty patterns")
+		}
+	}
+	for _, pattern := range c.Exclude {
+		if pattern == "" {
+			return fmt.Errorf("invalid filter configuration: 'filter.exclude' must not contain empty patterns")
+		}
+	}
+	return nil
+}
+
+func (c LookupTablesConfig) validate() error {
+	names := make(map[string]bool)
+	for _, table := range c {
+		switch {
+		case table.Name == "":
+			return fmt.Errorf("invalid lookup_tables configuration: 'name' is required for each lookup table")
+		case names[table.Name]:
+			return fmt.Errorf("invalid lookup_tables configuration: duplicate lookup table name '%v'", table.Name)
+		case table.File == "":
+			return fmt.Errorf("invalid lookup_tables configuration: lookup table %v: 'file' is required", table.Name)
+		case table.Format == "":
+			return fmt.Errorf("invalid lookup_tables configuration: lookup table %v: cannot derive the format from the file extension of %v, please configure 'format'", table.Name, table.File)
+		case table.Format != "csv" && table.Format != "yaml":
+			return fmt.Errorf("invalid lookup_tables configuration: lookup table %v: 'format' must be \"csv|yaml\"", table.Name)
+		case table.ReloadInterval < 0:
+			return fmt.Errorf("invalid lookup_tables configuration: lookup table %v: 'reload_interval' must not be negative", table.Name)
+		}
+		names[table.Name] = true
+	}
+	return nil
+}
+
+func (c RemoteWriteConfig) validate() error {
+	urls := make(map[string]bool)
+	for _, endpoint := range c {
+		u, err := url.Parse(endpoint.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid remote_write configuration: 'url' must be an http or https URL, but got '%v'", endpoint.URL)
+		}
+		prefix := fmt.Sprintf("invalid remote_write configuration: %v", u.Redacted())
+		auth := endpoint.BasicAuth
+		tlsConfig := endpoint.TLSConfig
+		queue := endpoint.QueueConfig
+		switch {
+		case urls[endpoint.URL]:
+			return fmt.Errorf("%v: duplicate url", prefix)
+		case endpoint.Interval < 0:
+			return fmt.Errorf("%v: 'interval' must not be negative", prefix)
+		case endpoint.RemoteTimeout < 0:
+			return fmt.Errorf("%v: 'remote_timeout' must not be negative", prefix)
+		case auth != (BasicAuthConfig{}) && auth.Username == "":
+			return fmt.Errorf("%v: 'basic_auth.username' is required", prefix)
+		case auth.Password != "" && auth.PasswordFile != "":
+			return fmt.Errorf("%v: cannot use both 'basic_auth.password' and 'basic_auth.password_file'", prefix)
+		case auth.Username != "" && endpoint.BearerToken != "":
+			return fmt.Errorf("%v: cannot use both 'basic_auth' and 'bearer_token'", prefix)
+		case (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == ""):
+			return fmt.Errorf("%v: 'tls_config.cert_file' and 'tls_config.key_file' must be configured together", prefix)
+		case tlsConfig != (TLSConfig{}) && u.Scheme != "https":
+			return fmt.Errorf("%v: 'tls_config' can only be configured for https URLs", prefix)
+		case queue.MaxSamplesPerSend < 0:
+			return fmt.Errorf("%v: 'queue_config.max_samples_per_send' must not be negative", prefix)
+		case queue.MinBackoff < 0 || queue.MaxBackoff < 0:
+			return fmt.Errorf("%v: 'queue_config.min_backoff' and 'queue_config.max_backoff' must not be negative", prefix)
+		case queue.MinBackoff > 0 && queue.MaxBackoff > 0 && queue.MinBackoff > queue.MaxBackoff:
+			return fmt.Errorf("%v: 'queue_config.min_backoff' must not be greater than 'queue_config.max_backoff'", prefix)
+		}
+		urls[endpoint.URL] = true
+	}
+	return nil
+}
+
+func (c OTLPConfig) validate() error {
+	endpoints := make(map[string]bool)
+	for _, endpoint := range c {
+		host, port, err := net.SplitHostPort(endpoint.Endpoint)
+		if err != nil || host == "" || port == "" {
+			return fmt.Errorf("invalid otlp configuration: 'endpoint' must be host:port, like otel-collector:4317, but got '%v'", endpoint.Endpoint)
+		}
+		prefix := fmt.Sprintf("invalid otlp configuration: %v", endpoint.Endpoint)
+		tlsConfig := endpoint.TLSConfig
+		retry := endpoint.RetryOnFailure
+		switch {
+		case endpoints[endpoint.Endpoint]:
+			return fmt.Errorf("%v: duplicate endpoint", prefix)
+		case endpoint.Interval < 0:
+			return fmt.Errorf("%v: 'interval' must not be negative", prefix)
+		case endpoint.Timeout < 0:
+			return fmt.Errorf("%v: 'timeout' must not be negative", prefix)
+		case (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == ""):
+			return fmt.Errorf("%v: 'tls_config.cert_file' and 'tls_config.key_file' must be configured together", prefix)
+		case tlsConfig != (TLSConfig{}) && endpoint.Insecure:
+			return fmt.Errorf("%v: cannot use both 'tls_config' and 'insecure: true'", prefix)
+		case retry.InitialInterval < 0 || retry.MaxInterval < 0:
+			return fmt.Errorf("%v: 'retry_on_failure.initial_interval' and 'retry_on_failure.max_interval' must not be negative", prefix)
+		case retry.InitialInterval > 0 && retry.MaxInterval > 0 && retry.InitialInterval > retry.MaxInterval:
+			return fmt.Errorf("%v: 'retry_on_failure.initial_interval' must not be greater than 'retry_on_failure.max_interval'", prefix)
+		}
+		for name := range endpoint.Headers {
+			if !isValidGrpcMetadataKey(name) {
+				return fmt.Errorf("%v: invalid header '%v': gRPC metadata keys must consist of lowercase letters, digits, '-', '_', and '.', and must not start with 'grpc-'", prefix, name)
+			}
+		}
+		endpoints[endpoint.Endpoint] = true
+	}
+	return nil
+}
+
+func isValidGrpcMetadataKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "grpc-") {
+		return false
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateTemplateReferences makes sure that the tables in {{lookup "name" .field}} are defined in the lookup_tables section,
+// and that a database is configured if {{geoip "country" .field}} is used.
+func (cfg *Config) validateTemplateReferences() error {
+	names := make(map[string]bool)
+	for _, table := range cfg.LookupTables {
+		names[table.Name] = true
+	}
+	for _, metric := range cfg.AllMetrics {
+		templates := append(append([]template.Template{metric.ValueTemplate}, metric.LabelTemplates...), metric.DeleteLabelTemplates...)
+		for _, t := range templates {
+			if t == nil {
+				continue
+			}
+			for _, name := range t.LookupTables() {
+				if !names[name] {
+					return fmt.Errorf("invalid metric configuration: metric %v: lookup table %v is not defined in the lookup_tables section", metric.Name, name)
+				}
+			}
+			if t.UsesGeoIP() && len(cfg.GeoIP.Databases) == 0 {
+				return fmt.Errorf("invalid metric configuration: metric %v: the geoip function is used, but there are no databases in the geoip section", metric.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c GeoIPConfig) validate() error {
+	for _, database := range c.Databases {
+		if len(database) == 0 {
+			return fmt.Errorf("invalid geoip configuration: 'geoip.databases' must not contain empty paths")
+		}
+	}
+	return nil
+}
+
+func (c AdditionalPatternsConfig) validate() error {
+	for name, regex := range c {
+		if !patternNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid additional_patterns configuration: '%v' is not a valid pattern name, names may contain letters, digits, and '_'", name)
+		}
+		if len(regex) == 0 {
+			return fmt.Errorf("invalid additional_patterns configuration: pattern %v is empty", name)
+		}
+	}
+	return nil
+}
+
 func (c *ImportsConfig) validate() error {
 	for _, cfg := range *c {
 		err := cfg.validate()
@@ -529,16 +1899,79 @@ func (c *MetricsConfig) validate() error {
 	return nil
 }
 
+func (c *MetricConfig) validateBuckets() error {
+	nBucketConfigs := 0
+	for _, present := range []bool{len(c.Buckets) > 0, c.ExponentialBuckets != nil, c.LinearBuckets != nil} {
+		if present {
+			nBucketConfigs++
+		}
+	}
+	if nBucketConfigs > 1 {
+		return fmt.Errorf("invalid metric configuration: metric %v: use only one of 'metrics.buckets', 'metrics.exponential_buckets', and 'metrics.linear_buckets'", c.Name)
+	}
+	for i := 1; i < len(c.Buckets); i++ {
+		if c.Buckets[i] <= c.Buckets[i-1] {
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.buckets' must be in increasing order", c.Name)
+		}
+	}
+	if b := c.ExponentialBuckets; b != nil {
+		switch {
+		case b.Count < 1:
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.exponential_buckets.count' must be at least 1", c.Name)
+		case b.Start <= 0:
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.exponential_buckets.start' must be greater than 0", c.Name)
+		case b.Factor <= 1:
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.exponential_buckets.factor' must be greater than 1", c.Name)
+		}
+	}
+	if b := c.LinearBuckets; b != nil {
+		switch {
+		case b.Count < 1:
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.linear_buckets.count' must be at least 1", c.Name)
+		case b.Width <= 0:
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.linear_buckets.width' must be greater than 0", c.Name)
+		}
+	}
+	if c.NativeBucketFactor != 0 && c.NativeBucketFactor <= 1 {
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.native_bucket_factor' must be greater than 1", c.Name)
+	}
+	return nil
+}
+
 func (c *MetricConfig) validate() error {
 	switch {
 	case c.Type == "":
 		return fmt.Errorf("Invalid metric configuration: 'metrics.type' must not be empty.")
 	case c.Name == "":
 		return fmt.Errorf("Invalid metric configuration: 'metrics.name' must not be empty.")
+	case !metricNameRegex.MatchString(c.Name):
+		return fmt.Errorf("Invalid metric configuration: metric %v: not a valid metric name, the name including 'global.namespace' and 'global.subsystem' must match %v", c.Name, metricNameRegex)
 	case c.Help == "":
 		return fmt.Errorf("Invalid metric configuration: 'metrics.help' must not be empty.")
-	case c.Match == "":
-		return fmt.Errorf("Invalid metric configuration: 'metrics.match' must not be empty.")
+	case c.Match != "" && len(c.Matches) > 0:
+		return fmt.Errorf("invalid metric configuration: metric %v defines both match and matches, you should use either one or the other", c.Name)
+	}
+	for _, match := range c.Matches {
+		if match == "" {
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.matches' must not contain empty patterns", c.Name)
+		}
+	}
+	if !isAnchor(c.Anchor) {
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.anchor' must be \"none|start|full\"", c.Name)
+	}
+	for _, flag := range c.RegexFlags {
+		if !isRegexFlag(flag) {
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.regex_flags' must contain only \"ignore_case|multiline|extended\", but found '%v'", c.Name, flag)
+		}
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.sample_rate' must be greater than 0 and at most 1", c.Name)
+	}
+	if c.MatchField != "" && strings.Contains("."+c.MatchField+".", "..") {
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.match_field' must be a field name or a path like http.request.path", c.Name)
+	}
+	if c.MatchField != "" && c.MatchGrokField != "" {
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.match_field' and 'metrics.match_grok_field' cannot be used together", c.Name)
 	}
 	err := validateGlobs(&c.PathsAndGlobs, true, fmt.Sprintf("invalid metric configuration: %v", c.Name))
 	if err != nil {
@@ -554,6 +1987,18 @@ func (c *MetricConfig) validate() error {
 		cumulativeAllowed, bucketsAllowed, quantilesAllowed, maxAgeAllowed = false, true, false, false
 	case "summary":
 		cumulativeAllowed, bucketsAllowed, quantilesAllowed, maxAgeAllowed = false, false, true, true
+	case "distinct", "aggregate":
+		cumulativeAllowed, bucketsAllowed, quantilesAllowed, maxAgeAllowed = false, false, false, true
+	case "quantile":
+		cumulativeAllowed, bucketsAllowed, quantilesAllowed, maxAgeAllowed = false, false, true, true
+		if len(c.Quantiles) == 0 {
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.quantiles' must not be empty for quantile metrics", c.Name)
+		}
+	case "info":
+		cumulativeAllowed, bucketsAllowed, quantilesAllowed, maxAgeAllowed = false, false, false, false
+		if len(c.Labels) == 0 {
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.labels' must not be empty for info metrics", c.Name)
+		}
 	default:
 		return fmt.Errorf("Invalid 'metrics.type': '%v'. We currently only support 'counter' and 'gauge'.", c.Type)
 	}
@@ -562,12 +2007,55 @@ func (c *MetricConfig) validate() error {
 		return fmt.Errorf("Invalid metric configuration: 'metrics.value' must not be empty for %v metrics.", c.Type)
 	case !cumulativeAllowed && c.Cumulative:
 		return fmt.Errorf("Invalid metric configuration: 'metrics.cumulative' cannot be used for %v metrics.", c.Type)
+	case c.Type != "counter" && c.ValueIsTotal:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.value_is_total' cannot be used for %v metrics.", c.Type)
+	case !cumulativeAllowed && c.Operation != "":
+		return fmt.Errorf("Invalid metric configuration: 'metrics.operation' cannot be used for %v metrics.", c.Type)
+	case c.Operation != "" && !isGaugeOperation(c.Operation):
+		return fmt.Errorf("Invalid metric configuration: metric %v: 'metrics.operation' must be \"set|inc|dec|add|sub\".", c.Name)
+	case c.Operation != "" && c.Cumulative:
+		return fmt.Errorf("Invalid metric configuration: metric %v: 'metrics.cumulative' and 'metrics.operation' cannot be used together, 'cumulative: true' is the same as 'operation: add'.", c.Name)
 	case !bucketsAllowed && len(c.Buckets) > 0:
 		return fmt.Errorf("Invalid metric configuration: 'metrics.buckets' cannot be used for %v metrics.", c.Type)
+	case !bucketsAllowed && c.ExponentialBuckets != nil:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.exponential_buckets' cannot be used for %v metrics.", c.Type)
+	case !bucketsAllowed && c.LinearBuckets != nil:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.linear_buckets' cannot be used for %v metrics.", c.Type)
+	case !bucketsAllowed && c.NativeBucketFactor != 0:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.native_bucket_factor' cannot be used for %v metrics.", c.Type)
 	case !quantilesAllowed && len(c.Quantiles) > 0:
 		return fmt.Errorf("Invalid metric configuration: 'metrics.quantiles' cannot be used for %v metrics.", c.Type)
 	case !maxAgeAllowed && c.MaxAge != 0:
 		return fmt.Errorf("Invalid metric configuration: 'metrics.max_age' cannot be used for %v metrics.", c.Type)
+	case !maxAgeAllowed && c.AgeBuckets != 0:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.age_buckets' cannot be used for %v metrics.", c.Type)
+	case c.MaxAge < 0:
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.max_age' must not be negative", c.Name)
+	case c.AgeBuckets < 0:
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.age_buckets' must not be negative", c.Name)
+	}
+	err = c.validateBuckets()
+	if err != nil {
+		return err
+	}
+	for quantile, uncertainty := range c.Quantiles {
+		if quantile <= 0 || quantile >= 1 || uncertainty <= 0 || uncertainty >= 1 {
+			return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.quantiles' must map quantiles between 0 and 1 to uncertainties between 0 and 1, like {0.5: 0.05, 0.99: 0.001}", c.Name)
+		}
+	}
+	if c.Type == "aggregate" {
+		_, inLabels := c.Labels["aggregation"]
+		_, inConstLabels := c.ConstLabels["aggregation"]
+		if inLabels || inConstLabels {
+			return fmt.Errorf("invalid metric configuration: metric %v: the label 'aggregation' cannot be used for aggregate metrics, because it is the label for min, max, and avg", c.Name)
+		}
+	}
+	if c.Type == "quantile" {
+		_, inLabels := c.Labels["quantile"]
+		_, inConstLabels := c.ConstLabels["quantile"]
+		if inLabels || inConstLabels {
+			return fmt.Errorf("invalid metric configuration: metric %v: the label 'quantile' cannot be used for quantile metrics, because it is the label for the quantiles", c.Name)
+		}
 	}
 	if len(c.DeleteMatch) > 0 && len(c.Labels) == 0 {
 		return fmt.Errorf("Invalid metric configuration: 'metrics.delete_match' is only supported for metrics with labels.")
@@ -575,6 +2063,41 @@ func (c *MetricConfig) validate() error {
 	if len(c.DeleteMatch) == 0 && len(c.DeleteLabelTemplates) > 0 {
 		return fmt.Errorf("Invalid metric configuration: 'metrics.delete_labels' can only be used when 'metrics.delete_match' is present.")
 	}
+	switch {
+	case c.MaxSeries < 0:
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.max_series' must not be negative", c.Name)
+	case c.MaxSeries > 0 && len(c.Labels) == 0:
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.max_series' is only supported for metrics with labels", c.Name)
+	case c.MaxSeriesAction != "" && c.MaxSeries == 0:
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.max_series_action' can only be used when 'metrics.max_series' is present", c.Name)
+	case c.MaxSeriesAction != "" && c.MaxSeriesAction != MaxSeriesDrop && c.MaxSeriesAction != MaxSeriesOther:
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.max_series_action' must be \"drop\" or \"other\"", c.Name)
+	}
+	for name, labelValues := range c.LabelValues {
+		prefix := fmt.Sprintf("invalid metric configuration: metric %v: 'metrics.label_values.%v'", c.Name, name)
+		switch {
+		case len(c.Labels[name]) == 0:
+			return fmt.Errorf("%v: there is no label %v in 'metrics.labels'", prefix, name)
+		case len(labelValues.Allow) > 0 && len(labelValues.Deny) > 0:
+			return fmt.Errorf("%v: 'allow' and 'deny' cannot be used together", prefix)
+		case len(labelValues.Allow) == 0 && len(labelValues.Deny) == 0:
+			return fmt.Errorf("%v: either 'allow' or 'deny' must be present", prefix)
+		case labelValues.Action != "" && labelValues.Action != LabelValuesOther && labelValues.Action != LabelValuesDrop:
+			return fmt.Errorf("%v: 'action' must be \"other\" or \"drop\"", prefix)
+		}
+	}
+	err = validateConstLabels(c.ConstLabels, fmt.Sprintf("invalid metric configuration: metric %v: 'metrics.const_labels'", c.Name))
+	if err != nil {
+		return err
+	}
+	for name := range c.ConstLabels {
+		if _, exists := c.Labels[name]; exists {
+			return fmt.Errorf("invalid metric configuration: metric %v: label %v is defined in both 'metrics.labels' and 'metrics.const_labels'", c.Name, name)
+		}
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("invalid metric configuration: metric %v: 'metrics.retention' must not be negative", c.Name)
+	}
 	if c.Retention > 0 && len(c.Labels) == 0 {
 		return fmt.Errorf("Invalid metric configuration: 'metrics.retention' is only supported for metrics with labels.")
 	}
@@ -595,6 +2118,47 @@ func (c *MetricConfig) validate() error {
 }
 
 func (c *ServerConfig) validate() error {
+	if err := c.validateAuth(); err != nil {
+		return err
+	}
+	switch {
+	case !strings.HasPrefix(c.Path, "/"):
+		return fmt.Errorf("invalid server configuration: 'server.path' must start with '/'.")
+	case len(c.ReloadToken) > 0 && c.Path == "/-/reload":
+		return fmt.Errorf("invalid server configuration: 'server.path' cannot be /-/reload, because this path is used for reloading the config.")
+	case len(c.AdminToken) > 0 && c.Path == "/-/delete":
+		return fmt.Errorf("invalid server configuration: 'server.path' cannot be /-/delete, because this path is used for deleting time series.")
+	case c.UnmatchedLines < 0:
+		return fmt.Errorf("invalid 'server.unmatched_lines': '%v'. Expecting a positive number of lines, or 0 for disabling the /debug/unmatched endpoint.", c.UnmatchedLines)
+	case c.UnmatchedLines > 0 && c.Path == "/debug/unmatched":
+		return fmt.Errorf("invalid server configuration: 'server.path' cannot be /debug/unmatched, because this path is used for the unmatched lines.")
+	}
+	if len(c.Listeners) == 0 {
+		listener := c.listener()
+		return listener.validate("server")
+	}
+	if c.listener() != (ListenerConfig{}) {
+		return fmt.Errorf("invalid server configuration: cannot use 'server.listeners' together with protocol, host, port, unix_socket, or TLS settings in the 'server' section")
+	}
+	addresses := make(map[string]bool)
+	for i, listener := range c.Listeners {
+		prefix := fmt.Sprintf("server.listeners[%v]", i)
+		if err := listener.validate(prefix); err != nil {
+			return err
+		}
+		address := listener.UnixSocket
+		if address == "" {
+			address = fmt.Sprintf("%v:%v", listener.Host, listener.Port)
+		}
+		if addresses[address] {
+			return fmt.Errorf("invalid server configuration: '%v': address %v is used by another listener", prefix, address)
+		}
+		addresses[address] = true
+	}
+	return nil
+}
+
+func (c *ListenerConfig) validate(prefix string) error {
 
 	clientAuthTypes := map[string]interface{}{
 		"NoClientCert":               nil,
@@ -606,17 +2170,17 @@ func (c *ServerConfig) validate() error {
 
 	switch {
 	case c.Protocol != "https" && c.Protocol != "http":
-		return fmt.Errorf("invalid 'server.protocol': '%v'. Expecting 'http' or 'https'.", c.Protocol)
-	case c.Port <= 0:
-		return fmt.Errorf("invalid 'server.port': '%v'.", c.Port)
-	case !strings.HasPrefix(c.Path, "/"):
-		return fmt.Errorf("invalid server configuration: 'server.path' must start with '/'.")
+		return fmt.Errorf("invalid '%v.protocol': '%v'. Expecting 'http' or 'https'.", prefix, c.Protocol)
+	case len(c.UnixSocket) > 0 && (len(c.Host) > 0 || c.Port != 0):
+		return fmt.Errorf("invalid server configuration: '%v.unix_socket' cannot be combined with '%v.host' or '%v.port'.", prefix, prefix, prefix)
+	case len(c.UnixSocket) == 0 && c.Port <= 0:
+		return fmt.Errorf("invalid '%v.port': '%v'.", prefix, c.Port)
 	case c.Protocol == "https":
 		if c.Cert != "" && c.Key == "" {
-			return fmt.Errorf("invalid server configuration: 'server.cert' must not be specified without 'server.key'")
+			return fmt.Errorf("invalid server configuration: '%v.cert' must not be specified without '%v.key'", prefix, prefix)
 		}
 		if c.Cert == "" && c.Key != "" {
-			return fmt.Errorf("invalid server configuration: 'server.key' must not be specified without 'server.cert'")
+			return fmt.Errorf("invalid server configuration: '%v.key' must not be specified without '%v.cert'", prefix, prefix)
 		}
 		if len(c.ClientAuth) > 0 {
 			if len(c.ClientCA) == 0 {
@@ -628,7 +2192,7 @@ func (c *ServerConfig) validate() error {
 		}
 	case c.Protocol == "http":
 		if c.Cert != "" || c.Key != "" {
-			return fmt.Errorf("invalid server configuration: 'server.cert' and 'server.key' can only be configured for protocol 'https'")
+			return fmt.Errorf("invalid server configuration: '%v.cert' and '%v.key' can only be configured for protocol 'https'", prefix, prefix)
 		}
 		if len(c.ClientCA) > 0 {
 			return fmt.Errorf("invalid server configuration: client_ca can only be configured for protocol 'https'")
@@ -640,11 +2204,36 @@ func (c *ServerConfig) validate() error {
 	return nil
 }
 
+func (c *ServerConfig) validateAuth() error {
+	for user, hash := range c.BasicAuthUsers {
+		if len(user) == 0 || strings.Contains(user, ":") {
+			return fmt.Errorf("invalid 'server.basic_auth_users': user name '%v' must not be empty and must not contain ':'.", user)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid 'server.basic_auth_users': the password of user '%v' is not a valid bcrypt hash: %v", user, err)
+		}
+	}
+	for _, token := range c.BearerTokens {
+		if len(token) == 0 {
+			return fmt.Errorf("invalid 'server.bearer_tokens': tokens must not be empty.")
+		}
+	}
+	return nil
+}
+
 // Made this public so it can be called when converting config v1 to config v2.
 func AddDefaultsAndValidate(cfg *Config) error {
 	var err error
 	cfg.addDefaults()
+	err = expandEnv(cfg.Global.Labels, "invalid global configuration: 'global.labels'")
+	if err != nil {
+		return err
+	}
 	for i := range []MetricConfig(cfg.AllMetrics) {
+		err = expandEnv(cfg.AllMetrics[i].ConstLabels, fmt.Sprintf("invalid metric configuration: metric %v: 'metrics.const_labels'", cfg.AllMetrics[i].Name))
+		if err != nil {
+			return err
+		}
 		err = cfg.AllMetrics[i].InitTemplates()
 		if err != nil {
 			return err
@@ -696,8 +2285,76 @@ func (cfg *Config) String() string {
 	if stripped.Global.RetentionCheckInterval == defaultRetentionCheckInterval {
 		stripped.Global.RetentionCheckInterval = 0
 	}
-	if stripped.Input.FailOnMissingLogfileString == "true" {
-		stripped.Input.FailOnMissingLogfileString = ""
+	if stripped.Global.RegexEngine == defaultRegexEngine {
+		stripped.Global.RegexEngine = ""
+	}
+	if stripped.Global.StateSyncInterval == defaultStateSyncInterval {
+		stripped.Global.StateSyncInterval = 0
+	}
+	for _, input := range stripped.AllInputs() {
+		if input.FailOnMissingLogfileString == "true" {
+			input.FailOnMissingLogfileString = ""
+		}
+		if input.PositionsSyncInterval == defaultPositionsSyncInterval {
+			input.PositionsSyncInterval = 0
+		}
+		if input.MaxLineLengthAction == defaultMaxLineLengthAction {
+			input.MaxLineLengthAction = ""
+		}
+		if input.BackpressureAction == defaultBackpressureAction {
+			input.BackpressureAction = ""
+		}
+		if input.MultilineTimeout == defaultMultilineTimeout {
+			input.MultilineTimeout = 0
+		}
+		if input.MultilineMaxLines == defaultMultilineMaxLines {
+			input.MultilineMaxLines = 0
+		}
+		if len(input.Paths) == 1 {
+			input.Path = input.Paths[0]
+			input.Paths = nil
+		}
+	}
+	for i := range stripped.RemoteWrite {
+		endpoint := &stripped.RemoteWrite[i]
+		if endpoint.Interval == defaultRemoteWriteInterval {
+			endpoint.Interval = 0
+		}
+		if endpoint.RemoteTimeout == defaultRemoteWriteTimeout {
+			endpoint.RemoteTimeout = 0
+		}
+		if endpoint.QueueConfig.MaxSamplesPerSend == defaultMaxSamplesPerSend {
+			endpoint.QueueConfig.MaxSamplesPerSend = 0
+		}
+		if endpoint.QueueConfig.MinBackoff == defaultMinBackoff {
+			endpoint.QueueConfig.MinBackoff = 0
+		}
+		if endpoint.QueueConfig.MaxBackoff == defaultMaxBackoff {
+			endpoint.QueueConfig.MaxBackoff = 0
+		}
+	}
+	for i := range stripped.OTLP {
+		endpoint := &stripped.OTLP[i]
+		if endpoint.Interval == defaultOTLPInterval {
+			endpoint.Interval = 0
+		}
+		if endpoint.Timeout == defaultOTLPTimeout {
+			endpoint.Timeout = 0
+		}
+		if endpoint.RetryOnFailure.InitialInterval == defaultMinBackoff {
+			endpoint.RetryOnFailure.InitialInterval = 0
+		}
+		if endpoint.RetryOnFailure.MaxInterval == defaultMaxBackoff {
+			endpoint.RetryOnFailure.MaxInterval = 0
+		}
+	}
+	for i := range stripped.LookupTables {
+		if stripped.LookupTables[i].Format == lookupTableFormat(stripped.LookupTables[i].File) {
+			stripped.LookupTables[i].Format = ""
+		}
+		if stripped.LookupTables[i].ReloadInterval == defaultLookupReloadInterval {
+			stripped.LookupTables[i].ReloadInterval = 0
+		}
 	}
 	if stripped.Server.Path == "/metrics" {
 		stripped.Server.Path = ""
@@ -705,9 +2362,10 @@ func (cfg *Config) String() string {
 	if stripped.Server.ClientAuth == "RequireAndVerifyClientCert" {
 		stripped.Server.ClientAuth = ""
 	}
-	if len(stripped.Input.Paths) == 1 {
-		stripped.Input.Path = stripped.Input.Paths[0]
-		stripped.Input.Paths = nil
+	for i := range stripped.Server.Listeners {
+		if stripped.Server.Listeners[i].ClientAuth == "RequireAndVerifyClientCert" {
+			stripped.Server.Listeners[i].ClientAuth = ""
+		}
 	}
 	for i := range stripped.OrigMetrics {
 		if len(stripped.OrigMetrics[i].Paths) == 1 {
@@ -729,7 +2387,9 @@ func (cfg *Config) copy() *Config {
 
 func (cfg *Config) marshalToString() string {
 	var newlineEscape = "___GROK_EXPORTER_NEWLINE_ESCAPE___"
-	cfg.Input.WebhookTextBulkSeparator = strings.Replace(cfg.Input.WebhookTextBulkSeparator, "\n", newlineEscape, -1)
+	for _, input := range cfg.AllInputs() {
+		input.WebhookTextBulkSeparator = strings.Replace(input.WebhookTextBulkSeparator, "\n", newlineEscape, -1)
+	}
 	out, err := yaml.Marshal(cfg)
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "unexpected fatal error: failed to marshal config: %v", err)
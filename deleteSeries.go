@@ -0,0 +1,113 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/fstab/grok_exporter/exporter"
+)
+
+const deletePath = "/-/delete"
+
+var errUnknownMetric = errors.New("unknown metric")
+
+// deleteRequest is sent from the /-/delete endpoint to the main loop, because the metrics are updated in the main loop.
+type deleteRequest struct {
+	metric string
+	labels map[string]string // missing labels match all values
+	result chan<- deleteResult
+}
+
+type deleteResult struct {
+	deleted int
+	err     error
+}
+
+// deleteSeries deletes the time series of the request's metric, and returns how many were deleted.
+func deleteSeries(metrics []exporter.Metric, request deleteRequest) (int, error) {
+	for _, metric := range metrics {
+		if metric.Name() == request.metric {
+			deleted, err := metric.DeleteSeries(request.labels)
+			if err != nil {
+				return 0, err
+			}
+			fmt.Fprintf(os.Stderr, "deleted %v time series of metric %v\n", deleted, metric.Name())
+			return deleted, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %v", errUnknownMetric, request.metric)
+}
+
+// deleteHandler serves the /-/delete endpoint. The query parameter 'metric' is the name of the metric,
+// and the parameters 'match[<label>]=<value>' select the time series. Without match parameters, all time series of the metric are deleted.
+func deleteHandler(token string, deleteRequests chan<- deleteRequest) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "use POST or PUT to delete time series", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		request, err := parseDeleteRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result := make(chan deleteResult, 1)
+		request.result = result
+		deleteRequests <- request
+		response := <-result
+		switch {
+		case errors.Is(response.err, errUnknownMetric):
+			http.Error(w, response.err.Error(), http.StatusNotFound)
+		case response.err != nil:
+			http.Error(w, response.err.Error(), http.StatusBadRequest)
+		default:
+			fmt.Fprintf(w, "deleted %v time series\n", response.deleted)
+		}
+	})
+}
+
+func parseDeleteRequest(r *http.Request) (deleteRequest, error) {
+	request := deleteRequest{
+		labels: make(map[string]string),
+	}
+	for key, values := range r.URL.Query() {
+		if len(values) != 1 {
+			return request, fmt.Errorf("query parameter %v must be given once", key)
+		}
+		switch {
+		case key == "metric":
+			request.metric = values[0]
+		case strings.HasPrefix(key, "match[") && strings.HasSuffix(key, "]"):
+			request.labels[key[len("match["):len(key)-1]] = values[0]
+		default:
+			return request, fmt.Errorf("unknown query parameter %v, expecting 'metric' and 'match[<label>]'", key)
+		}
+	}
+	if len(request.metric) == 0 {
+		return request, fmt.Errorf("missing query parameter 'metric'")
+	}
+	return request, nil
+}
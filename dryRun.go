@@ -0,0 +1,254 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/fstab/grok_exporter/tailer"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+const (
+	dryRunSamples   = 10    // number of unmatched line samples in the report
+	dryRunMaxShapes = 10000 // limit for the distinct unmatched lines that are counted, so that the memory is bounded for large files
+)
+
+type metricStats struct {
+	lines, matches, deleteMatches, errors, timeouts int
+	time                                            time.Duration
+}
+
+type unmatchedLines struct {
+	count  int
+	sample string
+	order  int // the first unmatched line with this shape is reported first if the counts are equal
+}
+
+type replayStats struct {
+	lines, matched, ignored, filtered, tooOld int
+	metrics                                   map[string]*metricStats
+	unmatched                                 map[string]*unmatchedLines
+	otherUnmatched                            int // unmatched lines that were not counted because of dryRunMaxShapes
+}
+
+// runDryRun implements '-dry-run -replay <file>'. The file is processed like lines of the first input by the config's metrics,
+// and a report with the matches per metric, the time spent matching, and the most frequent unmatched lines is written to out.
+// The metrics are not exported and no HTTP server is started.
+func runDryRun(cfg *v3.Config, path string, out io.Writer) error {
+	err := exporter.SetMatchTimeout(cfg.Global.MatchTimeout)
+	if err != nil {
+		return err
+	}
+	patterns, _, err := initPatterns(cfg)
+	if err != nil {
+		return err
+	}
+	metrics, err := createMetrics(cfg, patterns)
+	if err != nil {
+		return err
+	}
+	defer freeMetrics(metrics)
+	engine := exporter.RegexEngine(cfg.Global.RegexEngine)
+	filter, err := exporter.NewFilter(cfg.Filter, patterns, engine)
+	if err != nil {
+		return err
+	}
+	defer filter.Free()
+	err = exporter.NewLookupTables().Load(cfg.LookupTables)
+	if err != nil {
+		return err
+	}
+	err = exporter.LoadGeoIPDatabases(cfg.GeoIP)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	input := cfg.AllInputs()[0]
+	format, err := lineFormat(input)
+	if err != nil {
+		return err
+	}
+	tail, err := parsingTailer(tailer.RunOneshotReaderTailer(file, format), input, patterns, engine)
+	if err != nil {
+		return err
+	}
+	defer tail.Close()
+	stats := &replayStats{
+		metrics:   make(map[string]*metricStats, len(metrics)),
+		unmatched: make(map[string]*unmatchedLines),
+	}
+	for _, metric := range metrics {
+		stats.metrics[metric.Name()] = &metricStats{}
+	}
+	metricsForInput := routeMetrics(cfg, metrics)[input.Id]
+	start := time.Now()
+	for {
+		select {
+		case line, open := <-tail.Lines():
+			if !open {
+				stats.print(out, path, metrics, time.Since(start))
+				return nil
+			}
+			line.Input = input.Id
+			stats.lines++
+			err = stats.process(line, input, filter, metricsForInput)
+			if err != nil {
+				return fmt.Errorf("line %v: %v", stats.lines, err)
+			}
+		case err := <-tail.Errors():
+			return fmt.Errorf("error reading log lines: %v", err.Error())
+		}
+	}
+}
+
+// process handles the line like the main loop, and counts the result.
+func (s *replayStats) process(line *fswatcher.Line, input *v3.InputConfig, filter *exporter.Filter, metrics []exporter.Metric) error {
+	if !line.LogTime.IsZero() && input.DropOlderThan > 0 && time.Since(line.LogTime) > input.DropOlderThan {
+		s.tooOld++
+		return nil
+	}
+	accepted, err := filter.Accept(line.Line)
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		s.filtered++
+		return nil
+	}
+	matched, unsampled := false, false
+	if input.Match == "" || line.Captures != nil {
+		for _, metric := range metrics {
+			if !metric.PathMatches(line.File) {
+				continue
+			}
+			stats := s.metrics[metric.Name()]
+			stats.lines++
+			start := time.Now()
+			match, err := metric.ProcessMatch(line.Line, makeAdditionalFields(line))
+			stats.count(err)
+			if match != nil && match.Unsampled {
+				unsampled = true
+			} else if match != nil {
+				stats.matches++
+				matched = true
+			}
+			deleteMatch, err := metric.ProcessDeleteMatch(line.Line, makeAdditionalFields(line))
+			stats.count(err)
+			if deleteMatch != nil {
+				stats.deleteMatches++
+				matched = true
+			}
+			stats.time += time.Since(start)
+		}
+	}
+	if lineStatus(matched, unsampled) == number_of_lines_matched_label {
+		s.matched++
+	} else {
+		s.ignored++
+		s.addUnmatched(line.Line)
+	}
+	return nil
+}
+
+func (s *metricStats) count(err error) {
+	if err != nil {
+		s.errors++
+		if errors.Is(err, exporter.ErrMatchTimeout) {
+			s.timeouts++
+		}
+	}
+}
+
+func (s *replayStats) addUnmatched(line string) {
+	shape := lineShape(line)
+	if u, ok := s.unmatched[shape]; ok {
+		u.count++
+	} else if len(s.unmatched) < dryRunMaxShapes {
+		s.unmatched[shape] = &unmatchedLines{count: 1, sample: line, order: len(s.unmatched)}
+	} else {
+		s.otherUnmatched++
+	}
+}
+
+// lineShape replaces each number in the line with #, so that lines that differ only in numbers, like timestamps and ids, are counted together.
+func lineShape(line string) string {
+	var result strings.Builder
+	inNumber := false
+	for _, c := range line {
+		if c >= '0' && c <= '9' {
+			if !inNumber {
+				result.WriteByte('#')
+			}
+			inNumber = true
+			continue
+		}
+		inNumber = false
+		result.WriteRune(c)
+	}
+	return result.String()
+}
+
+func (s *replayStats) print(out io.Writer, path string, metrics []exporter.Metric, elapsed time.Duration) {
+	fmt.Fprintf(out, "replayed %v lines from %v in %v\n", s.lines, path, elapsed.Round(time.Microsecond))
+	fmt.Fprintf(out, "%v matched, %v ignored, %v filtered, %v too old\n\n", s.matched, s.ignored, s.filtered, s.tooOld)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "metric\tlines\tmatches\tdelete matches\terrors\ttimeouts\tmatch time\ttime per line\n")
+	for _, metric := range metrics {
+		stats := s.metrics[metric.Name()]
+		perLine := time.Duration(0)
+		if stats.lines > 0 {
+			perLine = stats.time / time.Duration(stats.lines)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", metric.Name(), stats.lines, stats.matches, stats.deleteMatches, stats.errors, stats.timeouts, stats.time.Round(time.Microsecond), perLine)
+	}
+	w.Flush()
+	if s.ignored == 0 {
+		return
+	}
+	unmatched := make([]*unmatchedLines, 0, len(s.unmatched))
+	for _, u := range s.unmatched {
+		unmatched = append(unmatched, u)
+	}
+	sort.Slice(unmatched, func(i, j int) bool {
+		if unmatched[i].count != unmatched[j].count {
+			return unmatched[i].count > unmatched[j].count
+		}
+		return unmatched[i].order < unmatched[j].order
+	})
+	if len(unmatched) > dryRunSamples {
+		unmatched = unmatched[:dryRunSamples]
+	}
+	fmt.Fprintf(out, "\nmost frequent unmatched lines, lines that differ only in numbers are counted together:\n")
+	for _, u := range unmatched {
+		fmt.Fprintf(out, "%8v  %v\n", u.count, u.sample)
+	}
+	if s.otherUnmatched > 0 {
+		fmt.Fprintf(out, "%8v  other unmatched lines were not grouped\n", s.otherUnmatched)
+	}
+}
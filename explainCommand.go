@@ -0,0 +1,115 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fstab/grok_exporter/config"
+	"github.com/fstab/grok_exporter/exporter"
+)
+
+const explainUsage = `Usage: grok_exporter explain [-config <path>] <grok pattern>
+
+Prints the regular expression for the grok pattern, and the definition of each
+grok pattern it references, with the references in these definitions indented
+below. The bundled patterns are used, and the config's patterns if -config is
+given.
+`
+
+// runExplainCommand implements 'grok_exporter explain'.
+func runExplainCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, explainUsage)
+		flags.PrintDefaults()
+	}
+	explainConfigPath := flags.String("config", "", "Path to the config file.")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		os.Exit(-1) // the flag package already printed the error and the usage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(-1)
+	}
+	var (
+		pattern  = flags.Arg(0)
+		patterns *exporter.Patterns
+		engine   = exporter.Oniguruma
+		err      error
+	)
+	if *explainConfigPath != "" {
+		cfg, warn, err := config.LoadConfigFile(*explainConfigPath)
+		if len(warn) > 0 {
+			fmt.Fprintf(os.Stderr, "%v\n", warn)
+		}
+		if err != nil {
+			return err
+		}
+		patterns, _, err = initPatterns(cfg)
+		if err != nil {
+			return err
+		}
+		engine = exporter.RegexEngine(cfg.Global.RegexEngine)
+	} else {
+		patterns = exporter.InitPatterns()
+		_, err = addBundledPatterns(patterns, "")
+		if err != nil {
+			return err
+		}
+	}
+	references, err := exporter.Explain(pattern, patterns)
+	if err != nil {
+		return err
+	}
+	regex, err := exporter.Expand(pattern, patterns)
+	if err != nil {
+		return err
+	}
+	compiled, err := exporter.Compile(pattern, patterns, engine)
+	if err != nil {
+		return err
+	}
+	defer compiled.Free()
+	fmt.Fprintf(out, "pattern: %v\n", pattern)
+	fmt.Fprintf(out, "engine:  %v\n", compiled.Engine())
+	fmt.Fprintf(out, "regex:   %v\n", regex)
+	if len(references) > 0 {
+		fmt.Fprintf(out, "\n")
+		printReferences(out, references, 0, make(map[string]bool))
+	}
+	return nil
+}
+
+// printReferences prints the definition of each grok pattern once. Patterns used again, like %{INT}, refer to the first definition.
+func printReferences(out io.Writer, references []exporter.PatternReference, depth int, printed map[string]bool) {
+	indent := strings.Repeat("    ", depth)
+	for _, reference := range references {
+		if printed[reference.Name] {
+			fmt.Fprintf(out, "%v%v  see %%{%v} above\n", indent, reference.Reference, reference.Name)
+			continue
+		}
+		printed[reference.Name] = true
+		fmt.Fprintf(out, "%v%v  %v\n", indent, reference.Reference, reference.Definition)
+		printReferences(out, reference.References, depth+1, printed)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// aggregationLabel is the label of aggregate metrics with the values min, max, and avg.
+const aggregationLabel = "aggregation"
+
+// aggregateBucket keeps the min, max, and sum of the values observed within a sub-window.
+type aggregateBucket struct {
+	count         uint64
+	sum, min, max float64
+}
+
+func (b *aggregateBucket) observe(value float64) {
+	if b.count == 0 || value < b.min {
+		b.min = value
+	}
+	if b.count == 0 || value > b.max {
+		b.max = value
+	}
+	b.count++
+	b.sum += value
+}
+
+func (b *aggregateBucket) merge(other *aggregateBucket) {
+	if other.count == 0 {
+		return
+	}
+	if b.count == 0 || other.min < b.min {
+		b.min = other.min
+	}
+	if b.count == 0 || other.max > b.max {
+		b.max = other.max
+	}
+	b.count += other.count
+	b.sum += other.sum
+}
+
+// aggregateWindow keeps the min, max, and average of the values within the sliding window max_age.
+type aggregateWindow struct {
+	slidingWindow
+	buckets []aggregateBucket
+}
+
+func newAggregateWindow(now time.Time, maxAge time.Duration, ageBuckets int) *aggregateWindow {
+	window := newSlidingWindow(now, maxAge, ageBuckets)
+	return &aggregateWindow{
+		slidingWindow: window,
+		buckets:       make([]aggregateBucket, window.size),
+	}
+}
+
+func (w *aggregateWindow) rotate(now time.Time) {
+	w.slidingWindow.rotate(now, func(bucket int) {
+		w.buckets[bucket] = aggregateBucket{}
+	})
+}
+
+// aggregations returns min, max, and avg. Like the quantiles of a summary without observations, they are NaN
+// if there were no values within the window.
+func (w *aggregateWindow) aggregations() (float64, float64, float64) {
+	var merged aggregateBucket
+	for i := range w.buckets {
+		merged.merge(&w.buckets[i])
+	}
+	if merged.count == 0 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	return merged.min, merged.max, merged.sum / float64(merged.count)
+}
+
+// aggregateCollector exports the min, max, and average of the values within the window as gauges for each label value combination.
+// The lines are processed in the main loop, while the samples are collected by the HTTP server, so access is synchronized.
+type aggregateCollector struct {
+	mutex      sync.Mutex
+	desc       *prometheus.Desc
+	labelNames []string
+	maxAge     time.Duration
+	ageBuckets int
+	now        func() time.Time // time.Now, except in tests
+	windows    map[string]*aggregateSeries
+}
+
+type aggregateSeries struct {
+	labelValues []string // same order as aggregateCollector.labelNames
+	window      *aggregateWindow
+}
+
+func newAggregateCollector(opts prometheus.Opts, labelNames []string, maxAge time.Duration, ageBuckets int) *aggregateCollector {
+	return &aggregateCollector{
+		desc:       prometheus.NewDesc(opts.Name, opts.Help, append(append([]string{}, labelNames...), aggregationLabel), opts.ConstLabels),
+		labelNames: labelNames,
+		maxAge:     maxAge,
+		ageBuckets: ageBuckets,
+		now:        time.Now,
+		windows:    make(map[string]*aggregateSeries),
+	}
+}
+
+func (c *aggregateCollector) observe(labels map[string]string, value float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	key := labelsKey(labels)
+	series, exists := c.windows[key]
+	if !exists {
+		series = &aggregateSeries{
+			labelValues: orderedLabelValues(c.labelNames, labels),
+			window:      newAggregateWindow(now, c.maxAge, c.ageBuckets),
+		}
+		c.windows[key] = series
+	}
+	series.window.rotate(now)
+	series.window.buckets[series.window.current].observe(value)
+}
+
+// Delete removes the time series with the labels, for delete_match and retention.
+func (c *aggregateCollector) Delete(labels prometheus.Labels) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := labelsKey(labels)
+	_, exists := c.windows[key]
+	delete(c.windows, key)
+	return exists
+}
+
+func (c *aggregateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *aggregateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	for _, series := range c.windows {
+		series.window.rotate(now)
+		min, max, avg := series.window.aggregations()
+		for _, aggregation := range []struct {
+			name  string
+			value float64
+		}{{"min", min}, {"max", max}, {"avg", avg}} {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, aggregation.value, append(series.labelValues, aggregation.name)...)
+		}
+	}
+}
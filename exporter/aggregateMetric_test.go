@@ -0,0 +1,126 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+)
+
+func TestAggregateWindow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	c := newAggregateCollector(prometheus.Opts{Name: "latency", Help: "latency"}, nil, 5*time.Minute, 5)
+	c.now = func() time.Time { return now }
+	for _, data := range []struct {
+		elapsed       time.Duration
+		values        []float64
+		min, max, avg float64
+	}{
+		{0, []float64{3, 1}, 1, 3, 2},
+		{2 * time.Minute, []float64{8}, 1, 8, 4},
+		{4 * time.Minute, []float64{2}, 2, 8, 5}, // 10:06, 3 and 1 from 10:00 expired
+		{10 * time.Minute, nil, math.NaN(), math.NaN(), math.NaN()},
+	} {
+		now = now.Add(data.elapsed)
+		for _, value := range data.values {
+			c.observe(nil, value)
+		}
+		ch := make(chan prometheus.Metric, 3)
+		c.Collect(ch)
+		close(ch)
+		expected := map[string]float64{"min": data.min, "max": data.max, "avg": data.avg}
+		for m := range ch {
+			labels, value := gaugeSample(t, m)
+			aggregation := labels[aggregationLabel]
+			if value != expected[aggregation] && !(math.IsNaN(value) && math.IsNaN(expected[aggregation])) {
+				t.Fatalf("%v: expected %v %v, but got %v", now, aggregation, expected[aggregation], value)
+			}
+		}
+	}
+}
+
+func TestAggregateVecMetric(t *testing.T) {
+	regex := initGaugeRegex(t)
+	aggregate := NewAggregateMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:  "temperature_window",
+		Value: "{{.temperature}}",
+		Labels: map[string]string{
+			"city": "{{.city}}",
+		},
+	}), regex, nil)
+	for _, line := range []string{
+		"Temperature in Berlin: 32",
+		"Temperature in Berlin: 20",
+		"Temperature in Moscow: -5",
+	} {
+		_, err := aggregate.ProcessMatch(line, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]float64{
+		"Berlin/min": 20, "Berlin/max": 32, "Berlin/avg": 26,
+		"Moscow/min": -5, "Moscow/max": -5, "Moscow/avg": -5,
+	}
+	ch := make(chan prometheus.Metric, len(expected))
+	aggregate.Collector().Collect(ch)
+	close(ch)
+	if len(ch) != len(expected) {
+		t.Fatalf("expected %v time series, but got %v", len(expected), len(ch))
+	}
+	for m := range ch {
+		labels, value := gaugeSample(t, m)
+		key := labels["city"] + "/" + labels[aggregationLabel]
+		if value != expected[key] {
+			t.Errorf("%v: expected %v, but got %v", key, expected[key], value)
+		}
+	}
+}
+
+func TestAggregateUseLogTimestamp(t *testing.T) {
+	regex := initGaugeRegex(t)
+	aggregate := NewAggregateMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:            "temperature_window",
+		Value:           "{{.temperature}}",
+		UseLogTimestamp: true,
+		Labels: map[string]string{
+			"city": "{{.city}}",
+		},
+	}), regex, nil)
+	_, err := aggregate.ProcessMatch("Temperature in Berlin: 32", map[string]interface{}{LogTimeField: 1577872800.5}) // 2020-01-01T10:00:00.5Z
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan prometheus.Metric, 3)
+	aggregate.Collector().Collect(ch)
+	close(ch)
+	if len(ch) != 3 {
+		t.Fatalf("expected 3 time series, but got %v", len(ch))
+	}
+	for m := range ch {
+		pb := io_prometheus_client.Metric{}
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		if pb.GetTimestampMs() != 1577872800500 {
+			t.Errorf("%v: expected timestamp 1577872800500, but got %v", pb.Label, pb.GetTimestampMs())
+		}
+	}
+}
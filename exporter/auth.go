@@ -0,0 +1,67 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	config "github.com/fstab/grok_exporter/config/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared with the password of unknown users, so that the response time does not reveal which users exist.
+// It is the hash of "grok_exporter" with bcrypt's default cost.
+const dummyHash = "$2a$10$YSrXRSJZbQvI5/wWCqNhte4u996wmx5LwdJeIVLCfDvnAB3BtfEOK"
+
+// NewAuthHandler wraps the handler so that only requests with one of the server.basic_auth_users or server.bearer_tokens are served.
+// If neither is configured, the handler is returned unchanged.
+func NewAuthHandler(cfg config.ServerConfig, handler http.Handler) http.Handler {
+	if len(cfg.BasicAuthUsers) == 0 && len(cfg.BearerTokens) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAuthorized(cfg, r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if len(cfg.BasicAuthUsers) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="grok_exporter"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func isAuthorized(cfg config.ServerConfig, r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok && len(cfg.BasicAuthUsers) > 0 {
+		hash, exists := cfg.BasicAuthUsers[user]
+		if !exists {
+			hash = dummyHash
+		}
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil && exists
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	authorized := false
+	for _, token := range cfg.BearerTokens {
+		if subtle.ConstantTimeCompare([]byte(header), []byte("Bearer "+token)) == 1 {
+			authorized = true
+		}
+	}
+	return authorized
+}
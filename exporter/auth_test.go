@@ -0,0 +1,65 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	config "github.com/fstab/grok_exporter/config/v3"
+)
+
+func TestAuthHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	handler := NewAuthHandler(config.ServerConfig{
+		BasicAuthUsers: map[string]string{
+			"alice": "$2a$04$OPxXfa9ezbnMioydgQgif.rC8prB4hRVyXUF4.znmfo9WQdVBDmla", // secret
+		},
+		BearerTokens: []string{"token1", "token2"},
+	}, ok)
+	for _, data := range []struct {
+		user, password, bearer string
+		expected               int
+	}{
+		{"", "", "", http.StatusUnauthorized},
+		{"alice", "secret", "", http.StatusOK},
+		{"alice", "wrong", "", http.StatusUnauthorized},
+		{"bob", "secret", "", http.StatusUnauthorized},
+		{"", "", "token2", http.StatusOK},
+		{"", "", "token3", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if len(data.user) > 0 {
+			r.SetBasicAuth(data.user, data.password)
+		}
+		if len(data.bearer) > 0 {
+			r.Header.Set("Authorization", "Bearer "+data.bearer)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != data.expected {
+			t.Errorf("user %q, bearer token %q: expected status %v, but got %v", data.user, data.bearer, data.expected, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("user %q, bearer token %q: WWW-Authenticate header missing", data.user, data.bearer)
+		}
+	}
+	if NewAuthHandler(config.ServerConfig{}, ok) == nil {
+		t.Fatal("expected the handler to be returned if no authentication is configured")
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// charSet is a set of runes as pairs of ranges [lo, hi], like syntax.Regexp.Rune for character classes.
+type charSet []rune
+
+// HasBacktrackingRisk is true if the Oniguruma regular expression may backtrack catastrophically.
+// This is the case for a repetition containing another repetition, where characters matched by the inner repetition may also be matched by what follows it,
+// like `(\w+\s?)*`: On a line that almost matches, the regex engine tries every way of splitting the text between the iterations,
+// which takes exponential time. Atomic groups like `(?>...)` don't give back characters, so they are not considered.
+// The analysis is a heuristic. If the regular expression cannot be parsed with Go's regexp/syntax package, the result is false.
+func HasBacktrackingRisk(regex string) bool {
+	translated, err := re2Syntax(relax(withoutAtomicGroups(regex)), false)
+	if err != nil {
+		return false
+	}
+	parsed, err := syntax.Parse(translated, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	return hasRiskyRepetition(parsed)
+}
+
+// RequiresLiteral is true if each match of the Oniguruma regular expression contains a literal string, see requiredLiterals().
+func RequiresLiteral(regex string) bool {
+	return len(requiredLiterals(regex)) > 0
+}
+
+// withoutAtomicGroups replaces atomic groups with empty groups.
+func withoutAtomicGroups(regex string) string {
+	var result strings.Builder
+	for i := 0; i < len(regex); i++ {
+		switch {
+		case regex[i] == '\\' && i+1 < len(regex):
+			result.WriteString(regex[i : i+2])
+			i++
+		case regex[i] == '[':
+			end := classEnd(regex, i)
+			if end < 0 {
+				return regex
+			}
+			result.WriteString(regex[i:end])
+			i = end - 1
+		case strings.HasPrefix(regex[i:], "(?>"):
+			result.WriteString("(?:)")
+			i = groupEnd(regex, i)
+		default:
+			result.WriteByte(regex[i])
+		}
+	}
+	return result.String()
+}
+
+// hasRiskyRepetition is true if re contains an unbounded repetition with an ambiguous inner repetition.
+func hasRiskyRepetition(re *syntax.Regexp) bool {
+	if isUnbounded(re) && hasAmbiguousRepetition(re.Sub[0], first(re.Sub[0])) {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasRiskyRepetition(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAmbiguousRepetition is true if re contains an unbounded repetition that may match a character that can also follow it.
+// follow are the characters that may follow re, including the beginning of the next iteration of the enclosing repetition.
+func hasAmbiguousRepetition(re *syntax.Regexp, follow charSet) bool {
+	switch re.Op {
+	case syntax.OpConcat:
+		for i := len(re.Sub) - 1; i >= 0; i-- {
+			if hasAmbiguousRepetition(re.Sub[i], follow) {
+				return true
+			}
+			if nullable(re.Sub[i]) {
+				follow = union(first(re.Sub[i]), follow)
+			} else {
+				follow = first(re.Sub[i])
+			}
+		}
+		return false
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if hasAmbiguousRepetition(sub, follow) {
+				return true
+			}
+		}
+		return false
+	case syntax.OpCapture, syntax.OpQuest:
+		return hasAmbiguousRepetition(re.Sub[0], follow)
+	case syntax.OpStar, syntax.OpPlus, syntax.OpRepeat:
+		if isUnbounded(re) && overlaps(chars(re.Sub[0]), follow) {
+			return true
+		}
+		if re.Op == syntax.OpRepeat && re.Max == 1 {
+			return hasAmbiguousRepetition(re.Sub[0], follow)
+		}
+		return hasAmbiguousRepetition(re.Sub[0], union(first(re.Sub[0]), follow))
+	default:
+		return false
+	}
+}
+
+func isUnbounded(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpStar || re.Op == syntax.OpPlus || (re.Op == syntax.OpRepeat && re.Max == -1)
+}
+
+// nullable is true if re matches the empty string.
+func nullable(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpLiteral, syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL, syntax.OpNoMatch:
+		return false
+	case syntax.OpCapture, syntax.OpPlus:
+		return nullable(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Min == 0 || nullable(re.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if !nullable(sub) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if nullable(sub) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true // empty match, zero-width assertions, star, and quest
+	}
+}
+
+// first returns the characters that a match of re may start with.
+func first(re *syntax.Regexp) charSet {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return literalChars(re.Rune[:1], re.Flags)
+	case syntax.OpConcat:
+		var result charSet
+		for _, sub := range re.Sub {
+			result = union(result, first(sub))
+			if !nullable(sub) {
+				break
+			}
+		}
+		return result
+	case syntax.OpAlternate:
+		var result charSet
+		for _, sub := range re.Sub {
+			result = union(result, first(sub))
+		}
+		return result
+	case syntax.OpCapture, syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		return first(re.Sub[0])
+	default:
+		return chars(re)
+	}
+}
+
+// chars returns all characters that a match of re may contain.
+func chars(re *syntax.Regexp) charSet {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return literalChars(re.Rune, re.Flags)
+	case syntax.OpCharClass:
+		return charSet(re.Rune)
+	case syntax.OpAnyChar:
+		return charSet{0, unicode.MaxRune}
+	case syntax.OpAnyCharNotNL:
+		return charSet{0, '\n' - 1, '\n' + 1, unicode.MaxRune}
+	default:
+		var result charSet
+		for _, sub := range re.Sub {
+			result = union(result, chars(sub))
+		}
+		return result
+	}
+}
+
+func literalChars(runes []rune, flags syntax.Flags) charSet {
+	var result charSet
+	for _, r := range runes {
+		result = append(result, r, r)
+		if flags&syntax.FoldCase != 0 {
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				result = append(result, f, f)
+			}
+		}
+	}
+	return result
+}
+
+func union(a, b charSet) charSet {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	return append(append(charSet{}, a...), b...)
+}
+
+func overlaps(a, b charSet) bool {
+	for i := 0; i+1 < len(a); i += 2 {
+		for j := 0; j+1 < len(b); j += 2 {
+			if a[i] <= b[j+1] && b[j] <= a[i+1] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"testing"
+)
+
+func TestBacktrackingRisk(t *testing.T) {
+	for _, regex := range []string{
+		`^(\w+\s?)*$`,
+		`(.*,)*x`,
+		`(x+x+)+y`,
+		`(?:[a-z]+=[^ ]* ?)*$`,
+		`(?i)(a|A+)*b`,
+	} {
+		if !HasBacktrackingRisk(regex) {
+			t.Errorf("%v: expected a backtracking risk", regex)
+		}
+	}
+	for _, regex := range []string{
+		`^(?:\w+\s)*$`,
+		`(?:/[a-z0-9]*)+`,
+		`\d+(?:\.\d+)*`,
+		`(?>(\w+\s?)*)$`,
+		`.*error.*`,
+		`(\w+\s?){1,3}$`,
+	} {
+		if HasBacktrackingRisk(regex) {
+			t.Errorf("%v: unexpected backtracking risk", regex)
+		}
+	}
+}
+
+func TestBacktrackingRiskOfBundledPatterns(t *testing.T) {
+	patterns := loadPatternDir(t)
+	for pattern, expected := range map[string]bool{
+		"%{URIPATH}":         false,
+		"%{QUOTEDSTRING}":    false, // atomic groups
+		"%{COMMONAPACHELOG}": false,
+		"%{UNIXPATH}":        true, // (/([\w_%!$@:.,+~-]+|\\.)*)+
+	} {
+		regex, err := Expand(pattern, patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if HasBacktrackingRisk(regex) != expected {
+			t.Errorf("%v: expected backtracking risk %v", pattern, expected)
+		}
+	}
+}
+
+func TestRequiresLiteral(t *testing.T) {
+	if !RequiresLiteral(`\d+ error`) {
+		t.Error("expected a required literal in '\\d+ error'")
+	}
+	if RequiresLiteral(`\d+`) {
+		t.Error("unexpected required literal in '\\d+'")
+	}
+}
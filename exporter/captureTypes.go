@@ -0,0 +1,123 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CaptureType is the type of a capture group, defined in the grok pattern like %{NUMBER:val:float}.
+// Typed capture groups are converted before they are used in the label and value templates.
+type CaptureType string
+
+const (
+	// Untyped capture groups are strings.
+	Untyped CaptureType = ""
+	// Int is an integer number, like 42 or -3.
+	Int CaptureType = "int"
+	// Float is a floating point number, like 1.5 or 2e-3.
+	Float CaptureType = "float"
+	// Duration is a duration with a unit, like 250ms or 1m30s, converted to seconds.
+	Duration CaptureType = "duration"
+	// Bytes is a size with an optional unit, like 512, 10KB or 1.5 GiB, converted to bytes.
+	Bytes CaptureType = "bytes"
+)
+
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"m":   1e6,
+	"mb":  1e6,
+	"g":   1e9,
+	"gb":  1e9,
+	"t":   1e12,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// number is a converted float, duration, or bytes value. Unlike float64, it isn't formatted in exponent notation in templates.
+type number float64
+
+func (n number) String() string {
+	return strconv.FormatFloat(float64(n), 'f', -1, 64)
+}
+
+func parseCaptureType(s string) (CaptureType, error) {
+	switch t := CaptureType(s); t {
+	case Int, Float, Duration, Bytes:
+		return t, nil
+	default:
+		return Untyped, fmt.Errorf("unknown type %v, valid types are int, float, duration, and bytes", s)
+	}
+}
+
+// convertCapture converts the value of a capture group to its type. Empty values are not converted,
+// like capture groups in an optional part of the pattern that didn't match.
+func convertCapture(value string, captureType CaptureType) (interface{}, error) {
+	if captureType == Untyped || value == "" {
+		return value, nil
+	}
+	switch captureType {
+	case Int:
+		result, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %q to %v", value, captureType)
+		}
+		return result, nil
+	case Float:
+		result, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %q to %v", value, captureType)
+		}
+		return number(result), nil
+	case Duration:
+		result, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %q to %v, expected a number with a unit like ms or s", value, captureType)
+		}
+		return number(result.Seconds()), nil
+	case Bytes:
+		return parseBytes(value)
+	default:
+		return nil, fmt.Errorf("unknown type %v", captureType)
+	}
+}
+
+// parseBytes parses sizes like 512, 10KB or 1.5 GiB. The units are case insensitive, KB is 1000 bytes and KiB is 1024 bytes.
+func parseBytes(value string) (interface{}, error) {
+	end := strings.IndexFunc(value, func(c rune) bool {
+		return !(c >= '0' && c <= '9' || c == '.')
+	})
+	if end < 0 {
+		end = len(value)
+	}
+	result, err := strconv.ParseFloat(value[:end], 64)
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert %q to %v", value, Bytes)
+	}
+	factor, ok := byteUnits[strings.ToLower(strings.TrimSpace(value[end:]))]
+	if !ok {
+		return nil, fmt.Errorf("cannot convert %q to %v, unknown unit %q", value, Bytes, strings.TrimSpace(value[end:]))
+	}
+	return number(result * factor), nil
+}
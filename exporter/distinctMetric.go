@@ -0,0 +1,188 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// hyperLogLogPrecision is the number of hash bits selecting the register. 2^12 registers take 4 KiB
+// and estimate the number of distinct values with a standard error of about 1.6%.
+const hyperLogLogPrecision = 12
+
+// hyperLogLog estimates the number of distinct values, see Flajolet et al., "HyperLogLog: the analysis of a
+// near-optimal cardinality estimation algorithm". Each register keeps the maximum number of leading zeros + 1
+// of the hashes that were assigned to it.
+type hyperLogLog struct {
+	registers [1 << hyperLogLogPrecision]uint8
+}
+
+func (h *hyperLogLog) add(value string) {
+	hash := hashValue(value)
+	index := hash >> (64 - hyperLogLogPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<hyperLogLogPrecision|1<<(hyperLogLogPrecision-1)) + 1)
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// merge adds the values of other to h.
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+func (h *hyperLogLog) reset() {
+	h.registers = [1 << hyperLogLogPrecision]uint8{}
+}
+
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	result := alpha * m * m / sum
+	if result <= 2.5*m && zeros > 0 {
+		// For small numbers of distinct values, linear counting of the empty registers is more accurate.
+		result = m * math.Log(m/float64(zeros))
+	}
+	return math.Round(result)
+}
+
+// hashValue is 64 bit FNV-1a with the splitmix64 finalizer, because HyperLogLog needs all bits evenly distributed,
+// and FNV-1a doesn't mix the high bits well for short values.
+func hashValue(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// distinctWindow counts the distinct values within the sliding window max_age, with a hyperLogLog per sub-window.
+type distinctWindow struct {
+	slidingWindow
+	buckets []hyperLogLog
+}
+
+func newDistinctWindow(now time.Time, maxAge time.Duration, ageBuckets int) *distinctWindow {
+	window := newSlidingWindow(now, maxAge, ageBuckets)
+	return &distinctWindow{
+		slidingWindow: window,
+		buckets:       make([]hyperLogLog, window.size),
+	}
+}
+
+func (w *distinctWindow) rotate(now time.Time) {
+	w.slidingWindow.rotate(now, func(bucket int) {
+		w.buckets[bucket].reset()
+	})
+}
+
+func (w *distinctWindow) estimate() float64 {
+	var merged hyperLogLog
+	for i := range w.buckets {
+		merged.merge(&w.buckets[i])
+	}
+	return merged.estimate()
+}
+
+// distinctCollector exports the estimated number of distinct values within the window as a gauge for each label value combination.
+// The lines are processed in the main loop, while the samples are collected by the HTTP server, so access is synchronized.
+type distinctCollector struct {
+	mutex      sync.Mutex
+	desc       *prometheus.Desc
+	labelNames []string
+	maxAge     time.Duration
+	ageBuckets int
+	now        func() time.Time // time.Now, except in tests
+	windows    map[string]*distinctSeries
+}
+
+type distinctSeries struct {
+	labelValues []string // same order as distinctCollector.labelNames
+	window      *distinctWindow
+}
+
+func newDistinctCollector(opts prometheus.Opts, labelNames []string, maxAge time.Duration, ageBuckets int) *distinctCollector {
+	return &distinctCollector{
+		desc:       prometheus.NewDesc(opts.Name, opts.Help, labelNames, opts.ConstLabels),
+		labelNames: labelNames,
+		maxAge:     maxAge,
+		ageBuckets: ageBuckets,
+		now:        time.Now,
+		windows:    make(map[string]*distinctSeries),
+	}
+}
+
+func (c *distinctCollector) add(labels map[string]string, value string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	key := labelsKey(labels)
+	series, exists := c.windows[key]
+	if !exists {
+		series = &distinctSeries{
+			labelValues: orderedLabelValues(c.labelNames, labels),
+			window:      newDistinctWindow(now, c.maxAge, c.ageBuckets),
+		}
+		c.windows[key] = series
+	}
+	series.window.rotate(now)
+	series.window.buckets[series.window.current].add(value)
+}
+
+// Delete removes the time series with the labels, for delete_match and retention.
+func (c *distinctCollector) Delete(labels prometheus.Labels) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := labelsKey(labels)
+	_, exists := c.windows[key]
+	delete(c.windows, key)
+	return exists
+}
+
+func (c *distinctCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *distinctCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	for _, series := range c.windows {
+		series.window.rotate(now)
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, series.window.estimate(), series.labelValues...)
+	}
+}
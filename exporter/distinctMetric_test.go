@@ -0,0 +1,118 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		var h hyperLogLog
+		for i := 0; i < n; i++ {
+			h.add(fmt.Sprintf("10.0.%v.%v", i/256, i%256))
+			h.add(fmt.Sprintf("10.0.%v.%v", i/256, i%256)) // duplicates must not be counted
+		}
+		estimate := h.estimate()
+		if math.Abs(estimate-float64(n)) > 0.05*float64(n) {
+			t.Errorf("expected about %v distinct values, but got %v", n, estimate)
+		}
+	}
+}
+
+func TestDistinctWindow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	c := newDistinctCollector(prometheus.Opts{Name: "clients", Help: "clients"}, nil, 10*time.Minute, 5)
+	c.now = func() time.Time { return now }
+	for _, data := range []struct {
+		elapsed  time.Duration
+		values   []string
+		expected float64
+	}{
+		{0, []string{"a", "b"}, 2},
+		{3 * time.Minute, []string{"b", "c"}, 3},
+		{6 * time.Minute, nil, 3},  // a and b from 10:00 are still in the window
+		{2 * time.Minute, nil, 2},  // 10:11, a and b from 10:00 expired
+		{30 * time.Minute, nil, 0}, // all expired
+		{0, []string{"d"}, 1},
+	} {
+		now = now.Add(data.elapsed)
+		for _, value := range data.values {
+			c.add(nil, value)
+		}
+		ch := make(chan prometheus.Metric, 1)
+		c.Collect(ch)
+		if _, value := gaugeSample(t, <-ch); value != data.expected {
+			t.Fatalf("%v: expected %v distinct values, but got %v", now, data.expected, value)
+		}
+	}
+}
+
+func TestDistinctVecMetric(t *testing.T) {
+	regex := initGaugeRegex(t)
+	distinct := NewDistinctMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:  "distinct_temperatures",
+		Value: "{{.temperature}}",
+		Labels: map[string]string{
+			"city": "{{.city}}",
+		},
+	}), regex, nil)
+	for _, line := range []string{
+		"Temperature in Berlin: 32",
+		"Temperature in Berlin: 32",
+		"Temperature in Berlin: 28",
+		"Temperature in Moscow: -5",
+	} {
+		match, err := distinct.ProcessMatch(line, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match == nil {
+			t.Fatalf("%v: expected a match", line)
+		}
+	}
+	expected := map[string]float64{"Berlin": 2, "Moscow": 1}
+	ch := make(chan prometheus.Metric, len(expected))
+	distinct.Collector().Collect(ch)
+	close(ch)
+	if len(ch) != len(expected) {
+		t.Fatalf("expected %v time series, but got %v", len(expected), len(ch))
+	}
+	for m := range ch {
+		labels, value := gaugeSample(t, m)
+		if city := labels["city"]; value != expected[city] {
+			t.Errorf("%v: expected %v distinct values, but got %v", city, expected[city], value)
+		}
+	}
+}
+
+func gaugeSample(t *testing.T, m prometheus.Metric) (map[string]string, float64) {
+	pb := io_prometheus_client.Metric{}
+	if err := m.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string]string, len(pb.Label))
+	for _, label := range pb.Label {
+		labels[label.GetName()] = label.GetValue()
+	}
+	return labels, pb.Gauge.GetValue()
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+)
+
+// Filter drops lines before they are matched against the metrics, so that irrelevant lines are discarded once
+// instead of being matched against each metric.
+type Filter struct {
+	include Regex // nil means all lines are included
+	exclude Regex // nil means no lines are excluded
+}
+
+// NewFilter compiles the include and exclude patterns of the filter configuration.
+func NewFilter(cfg configuration.FilterConfig, patterns *Patterns, engine RegexEngine) (*Filter, error) {
+	var (
+		result = &Filter{}
+		err    error
+	)
+	if len(cfg.Include) > 0 {
+		result.include, err = CompileAlternatives(cfg.Include, patterns, engine)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize filter.include: %v", err)
+		}
+	}
+	if len(cfg.Exclude) > 0 {
+		result.exclude, err = CompileAlternatives(cfg.Exclude, patterns, engine)
+		if err != nil {
+			result.Free()
+			return nil, fmt.Errorf("failed to initialize filter.exclude: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// Accept returns true if the line matches one of the include patterns, or if there are no include patterns,
+// and if the line matches none of the exclude patterns.
+func (f *Filter) Accept(line string) (bool, error) {
+	if f.include != nil {
+		matched, err := isMatch(f.include, line)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	if f.exclude != nil {
+		matched, err := isMatch(f.exclude, line)
+		if err != nil || matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Free releases the compiled patterns.
+func (f *Filter) Free() {
+	if f.include != nil {
+		f.include.Free()
+	}
+	if f.exclude != nil {
+		f.exclude.Free()
+	}
+}
+
+func isMatch(regex Regex, line string) (bool, error) {
+	result, err := regex.Search(line)
+	if err != nil {
+		return false, err
+	}
+	defer result.Free()
+	return result.IsMatch(), nil
+}
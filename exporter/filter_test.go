@@ -0,0 +1,79 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	patterns := loadPatternDir(t)
+	for _, data := range []struct {
+		cfg      configuration.FilterConfig
+		accepted []string
+		dropped  []string
+	}{
+		{
+			cfg:      configuration.FilterConfig{},
+			accepted: []string{"DEBUG a", "ERROR b"},
+		},
+		{
+			cfg:      configuration.FilterConfig{Include: []string{`^%{TIMESTAMP_ISO8601} (ERROR|WARN)`, "panic:"}},
+			accepted: []string{"2020-07-01T12:00:00 ERROR a", "2020-07-01T12:00:00 WARN b", "panic: c"},
+			dropped:  []string{"2020-07-01T12:00:00 DEBUG d", "ERROR e"},
+		},
+		{
+			cfg:      configuration.FilterConfig{Exclude: []string{`DEBUG`, `^%{TIMESTAMP_ISO8601} INFO health check`}},
+			accepted: []string{"2020-07-01T12:00:00 INFO started", "2020-07-01T12:00:00 ERROR failed"},
+			dropped:  []string{"2020-07-01T12:00:00 DEBUG a", "2020-07-01T12:00:00 INFO health check ok"},
+		},
+		{
+			cfg:      configuration.FilterConfig{Include: []string{`ERROR`}, Exclude: []string{`connection reset`}},
+			accepted: []string{"ERROR failed"},
+			dropped:  []string{"ERROR connection reset by peer", "INFO ok"},
+		},
+	} {
+		filter, err := NewFilter(data.cfg, patterns, Oniguruma)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range append(data.accepted, data.dropped...) {
+			accepted, err := filter.Accept(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := !contains(data.dropped, line)
+			if accepted != expected {
+				t.Fatalf("%v: %q: expected accepted=%v, but got %v", data.cfg, line, expected, accepted)
+			}
+		}
+		filter.Free()
+	}
+	_, err := NewFilter(configuration.FilterConfig{Exclude: []string{"%{UNDEFINED_PATTERN}"}}, patterns, Oniguruma)
+	if err == nil || !strings.Contains(err.Error(), "filter.exclude") {
+		t.Fatalf("expected error message saying that filter.exclude is invalid, but got %v", err)
+	}
+}
+
+func contains(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
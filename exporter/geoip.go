@@ -0,0 +1,47 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/geoip"
+	"github.com/fstab/grok_exporter/template"
+)
+
+// LoadGeoIPDatabases reads the databases from the geoip section for {{geoip "country" .field}} in the templates.
+// If a database cannot be read, an error is returned and the current databases remain active.
+func LoadGeoIPDatabases(cfg configuration.GeoIPConfig) error {
+	apply, err := PrepareGeoIPDatabases(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// PrepareGeoIPDatabases reads the databases like LoadGeoIPDatabases, but the current databases remain active until apply is called.
+func PrepareGeoIPDatabases(cfg configuration.GeoIPConfig) (apply func(), err error) {
+	databases := make([]*geoip.Reader, 0, len(cfg.Databases))
+	for _, path := range cfg.Databases {
+		db, err := geoip.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		databases = append(databases, db)
+	}
+	return func() {
+		template.SetGeoIPDatabases(databases)
+	}, nil
+}
@@ -23,20 +23,162 @@ import (
 	"strings"
 )
 
-// Compile a grok pattern string into a regular expression.
-func Compile(pattern string, patterns *Patterns) (*oniguruma.Regex, error) {
-	regex, err := expand(pattern, patterns)
+// Compile a grok pattern string into a regular expression for the engine.
+// With engine Auto, the pattern is matched with Oniguruma if Go's regexp package cannot match it with the same result.
+// With engine RE2, patterns with word boundaries \b are compiled, but they only treat ASCII characters as word characters.
+// Lines that don't contain the literal strings required by the pattern are rejected without running the regex engine.
+func Compile(pattern string, patterns *Patterns, engine RegexEngine) (Regex, error) {
+	regex, types, err := expand(pattern, patterns)
 	if err != nil {
 		return nil, err
 	}
+	if engine == RE2 || engine == Auto {
+		result, err := compileRE2(regex, engine == Auto)
+		if err == nil {
+			result.types = types
+			return withPrefilter(result, regex), nil
+		}
+		if engine == RE2 {
+			return nil, fmt.Errorf("failed to compile pattern %v: regular expression %v cannot be matched with the re2 regex engine: %v", pattern, regex, err.Error())
+		}
+	}
 	result, err := oniguruma.Compile(regex)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile pattern %v: error in regular expression %v: %v", pattern, regex, err.Error())
 	}
-	return result, nil
+	return withPrefilter(onigurumaRegex{result, types, captureGroupNames(regex)}, regex), nil
+}
+
+// Expand returns the regular expression for a grok pattern, i.e. the pattern with all %{...} references resolved.
+func Expand(pattern string, patterns *Patterns) (string, error) {
+	regex, _, err := expand(pattern, patterns)
+	return regex, err
+}
+
+// PatternReference is a %{..} reference in a grok pattern, see Explain.
+type PatternReference struct {
+	Reference  string             // like %{IP:client}
+	Name       string             // the name of the referenced grok pattern, like IP
+	Definition string             // the definition of the referenced grok pattern, like (?:%{IPV6}|%{IPV4}) for IP
+	References []PatternReference // the references in the definition
+}
+
+// Explain returns the references in the grok pattern, with the references in their definitions,
+// so that it can be shown which grok pattern contributed which part of the regular expression.
+func Explain(pattern string, patterns *Patterns) ([]PatternReference, error) {
+	_, err := Expand(pattern, patterns) // undefined and recursive patterns are reported here, so explainReferences terminates
+	if err != nil {
+		return nil, err
+	}
+	return explainReferences(pattern, patterns), nil
+}
+
+func explainReferences(regex string, patterns *Patterns) []PatternReference {
+	var result []PatternReference
+	for _, match := range patternRegex.FindAllStringSubmatch(regex, -1) {
+		name := strings.Split(match[1], ":")[0]
+		definition, _ := patterns.Find(name)
+		result = append(result, PatternReference{
+			Reference:  match[0],
+			Name:       name,
+			Definition: definition,
+			References: explainReferences(definition, patterns),
+		})
+	}
+	return result
+}
+
+// Anchor returns the grok pattern so that it must match at the beginning, or the full line, see metrics.anchor.
+// Unlike ^ and $, \A and \z don't match at line breaks, so a multiline record must match as a whole.
+func Anchor(pattern string, anchor string) string {
+	switch anchor {
+	case configuration.AnchorStart:
+		return `\A(?:` + pattern + `)`
+	case configuration.AnchorFull:
+		return `\A(?:` + pattern + `)\z`
+	default:
+		return pattern
+	}
+}
+
+// WithFlags returns the grok pattern with the flags of metrics.regex_flags applied.
+// The ignore_case and multiline flags apply to the grok patterns referenced by the pattern as well.
+// The extended flag removes whitespace and comments from the pattern itself, but not from the referenced grok patterns,
+// like the space in %{COMMONAPACHELOG}, so it is applied before the pattern is expanded, unlike (?x).
+func WithFlags(pattern string, flags []string) string {
+	options := ""
+	for _, flag := range flags {
+		switch flag {
+		case configuration.RegexFlagIgnoreCase:
+			options += "i"
+		case configuration.RegexFlagMultiline:
+			options += "m"
+		case configuration.RegexFlagExtended:
+			pattern = freeSpacing(pattern)
+		}
+	}
+	if options == "" {
+		return pattern
+	}
+	return "(?" + options + ":" + pattern + ")"
+}
+
+// freeSpacing removes whitespace and comments from # to the end of the line, except in character classes.
+// Escaped whitespace and \# remain as literal characters.
+func freeSpacing(pattern string) string {
+	var result strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			if isSpace(pattern[i+1]) {
+				result.WriteByte(pattern[i+1]) // Go's regexp package doesn't support escaped whitespace
+			} else {
+				result.WriteString(pattern[i : i+2])
+			}
+			i++
+		case c == '[':
+			end := classEnd(pattern, i)
+			if end < 0 {
+				end = len(pattern)
+			}
+			result.WriteString(pattern[i:end])
+			i = end - 1
+		case c == '#':
+			for i+1 < len(pattern) && pattern[i+1] != '\n' {
+				i++
+			}
+		case isSpace(c):
+		default:
+			result.WriteByte(c)
+		}
+	}
+	return result.String()
 }
 
-func VerifyFieldNames(m *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex, additionalFieldDefinitions map[string]string) error {
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// CompileAlternatives compiles grok patterns into one regular expression that matches if any of the patterns matches.
+// Capture groups with the same name in different patterns are merged, i.e. the capture group is taken from the pattern that matched.
+func CompileAlternatives(alternatives []string, patterns *Patterns, engine RegexEngine) (Regex, error) {
+	if len(alternatives) == 1 {
+		return Compile(alternatives[0], patterns, engine)
+	}
+	groups := make([]string, 0, len(alternatives))
+	for _, alternative := range alternatives {
+		// Compile each pattern on its own first, so that an unbalanced parenthesis is reported and cannot change the other patterns.
+		regex, err := Compile(alternative, patterns, engine)
+		if err != nil {
+			return nil, err
+		}
+		regex.Free()
+		groups = append(groups, "(?:"+alternative+")")
+	}
+	return Compile(strings.Join(groups, "|"), patterns, engine)
+}
+
+func VerifyFieldNames(m *configuration.MetricConfig, regex, deleteRegex Regex, additionalFieldDefinitions map[string]string) error {
 	for _, template := range m.LabelTemplates {
 		err := verifyFieldName(m.Name, template, regex, additionalFieldDefinitions)
 		if err != nil {
@@ -58,7 +200,28 @@ func VerifyFieldNames(m *configuration.MetricConfig, regex, deleteRegex *oniguru
 	return nil
 }
 
-func verifyFieldName(metricName string, template template.Template, regex *oniguruma.Regex, additionalFieldDefinitions map[string]string) error {
+// VerifyFieldDefaults checks that each field in metrics.field_defaults is a capture group of the match or delete_match pattern,
+// and that the default value can be converted to the type of the capture group.
+func VerifyFieldDefaults(m *configuration.MetricConfig, regex, deleteRegex Regex) error {
+	for name, value := range m.FieldDefaults {
+		found := false
+		for _, r := range []Regex{regex, deleteRegex} {
+			if r == nil || !r.HasCaptureGroup(name) {
+				continue
+			}
+			found = true
+			if _, err := convertCapture(value, r.CaptureType(name)); err != nil {
+				return fmt.Errorf("%v: field_defaults: grok field %v: %v", m.Name, name, err)
+			}
+		}
+		if !found {
+			return fmt.Errorf("%v: field_defaults: grok field %v not found in match pattern", m.Name, name)
+		}
+	}
+	return nil
+}
+
+func verifyFieldName(metricName string, template template.Template, regex Regex, additionalFieldDefinitions map[string]string) error {
 	if template != nil {
 		for _, grokFieldName := range template.ReferencedGrokFields() {
 			if description, ok := additionalFieldDefinitions[grokFieldName]; ok {
@@ -81,35 +244,77 @@ func verifyFieldName(metricName string, template template.Template, regex *onigu
 // PATTERN_RE matches the %{..} patterns. There are three possibilities:
 // 1) %{USER}               - grok pattern
 // 2) %{IP:clientip}        - grok pattern with name
-// 3) %{INT:clientport:int} - grok pattern with name and type (type is currently ignored)
+// 3) %{INT:clientport:int} - grok pattern with name and type, see CaptureType
 const PATTERN_RE = `%{(.+?)}`
 
-// Expand recursively resolves all grok patterns %{..} and returns a regular expression.
-func expand(pattern string, patterns *Patterns) (string, error) {
-	result := pattern
-	for i := 0; i < 1000; i++ { // After 1000 replacements, we assume this is an infinite loop and abort.
-		match := regexp.MustCompile(PATTERN_RE).FindStringSubmatch(result)
-		if match == nil {
-			// No match means all grok patterns %{..} are expanded. We are done.
-			return result, nil
-		}
-		parts := strings.Split(match[1], ":")
-		regex, exists := patterns.Find(parts[0])
-		if !exists {
-			return "", fmt.Errorf("Pattern %v not defined.", match[0])
-		}
-		var replacement string
-		switch {
-		case len(parts) == 1:
+var patternRegex = regexp.MustCompile(PATTERN_RE)
+
+// Expand recursively resolves all grok patterns %{..} and returns a regular expression and the types of the typed capture groups.
+func expand(pattern string, patterns *Patterns) (string, map[string]CaptureType, error) {
+	types := make(map[string]CaptureType)
+	regex, err := expandRecursively(pattern, patterns, nil, make(map[string]string), types)
+	if err != nil {
+		return "", nil, err
+	}
+	return regex, types, nil
+}
+
+// expandRecursively resolves the grok patterns %{..} in regex. The stack contains the names of the grok patterns
+// that are being resolved, like [A B] if regex is the definition of B and B is used in A. This is used for detecting
+// cycles, like if A uses B and B uses A. The expanded map caches the resolved definitions, so that patterns used
+// many times, like %{INT}, are resolved only once. The types of typed capture groups like %{INT:port:int} are added to types.
+func expandRecursively(regex string, patterns *Patterns, stack []string, expanded map[string]string, types map[string]CaptureType) (string, error) {
+	var (
+		result strings.Builder
+		last   = 0
+		err    error
+	)
+	for _, loc := range patternRegex.FindAllStringSubmatchIndex(regex, -1) {
+		result.WriteString(regex[last:loc[0]])
+		last = loc[1]
+		match := regex[loc[0]:loc[1]]
+		parts := strings.Split(regex[loc[2]:loc[3]], ":")
+		if len(parts) > 3 {
+			return "", fmt.Errorf("%v is not a valid pattern.", match)
+		}
+		for i, name := range stack {
+			if name == parts[0] {
+				return "", fmt.Errorf("Pattern %%{%v} is defined recursively: %v -> %v.", name, strings.Join(stack[i:], " -> "), name)
+			}
+		}
+		definition, ok := expanded[parts[0]]
+		if !ok {
+			definition, ok = patterns.Find(parts[0])
+			if !ok && len(stack) > 0 {
+				return "", fmt.Errorf("Pattern %v not defined, it is used in the definition of %%{%v}.", match, stack[len(stack)-1])
+			}
+			if !ok {
+				return "", fmt.Errorf("Pattern %v not defined.", match)
+			}
+			definition, err = expandRecursively(definition, patterns, append(stack, parts[0]), expanded, types)
+			if err != nil {
+				return "", err
+			}
+			expanded[parts[0]] = definition
+		}
+		if len(parts) == 3 {
+			captureType, err := parseCaptureType(parts[2])
+			if err != nil {
+				return "", fmt.Errorf("%v: %v", match, err)
+			}
+			if previous, ok := types[parts[1]]; ok && previous != captureType {
+				return "", fmt.Errorf("%v: capture group %v is also defined with type %v", match, parts[1], previous)
+			}
+			types[parts[1]] = captureType
+		}
+		if len(parts) == 1 {
 			// If the grok pattern has no name, we don't need to capture, so we use ?:
-			replacement = fmt.Sprintf("(?:%v)", regex)
-		case len(parts) == 2 || len(parts) == 3:
+			fmt.Fprintf(&result, "(?:%v)", definition)
+		} else {
 			// If the grok pattern has a name, we create a named capturing group with ?<>
-			replacement = fmt.Sprintf("(?<%v>%v)", parts[1], regex)
-		default:
-			return "", fmt.Errorf("%v is not a valid pattern.", match[0])
+			fmt.Fprintf(&result, "(?<%v>%v)", parts[1], definition)
 		}
-		result = strings.Replace(result, match[0], replacement, -1)
 	}
-	return "", fmt.Errorf("Deep recursion while expanding pattern '%v'.", pattern)
+	result.WriteString(regex[last:])
+	return result.String(), nil
 }
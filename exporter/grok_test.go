@@ -16,7 +16,6 @@ package exporter
 
 import (
 	configuration "github.com/fstab/grok_exporter/config/v3"
-	"github.com/fstab/grok_exporter/oniguruma"
 	"gopkg.in/yaml.v2"
 	"strings"
 	"testing"
@@ -38,6 +37,30 @@ func TestGrok(t *testing.T) {
 	t.Run("compile invalid regexp", func(t *testing.T) {
 		testCompileInvalidRegexp(t, patterns)
 	})
+	t.Run("compile alternatives", func(t *testing.T) {
+		testCompileAlternatives(t, patterns)
+	})
+	t.Run("compile recursive pattern", func(t *testing.T) {
+		testCompileRecursivePattern(t, patterns)
+	})
+	t.Run("compile additional pattern", func(t *testing.T) {
+		testCompileAdditionalPattern(t, patterns)
+	})
+	t.Run("compile typed capture groups", func(t *testing.T) {
+		testCompileTypedCaptureGroups(t, patterns)
+	})
+	t.Run("compile anchored pattern", func(t *testing.T) {
+		testCompileAnchoredPattern(t, patterns)
+	})
+	t.Run("compile pattern with regex flags", func(t *testing.T) {
+		testCompileFlaggedPattern(t, patterns)
+	})
+	t.Run("explain pattern", func(t *testing.T) {
+		testExplainPattern(t, patterns)
+	})
+	t.Run("compile capture group names", func(t *testing.T) {
+		testCompileCaptureGroupNames(t, patterns)
+	})
 	t.Run("verify capture group", func(t *testing.T) {
 		testVerifyCaptureGroup(t, patterns)
 	})
@@ -48,29 +71,249 @@ func TestGrok(t *testing.T) {
 
 func testCompileAllPatterns(t *testing.T, patterns *Patterns) {
 	for pattern := range *patterns {
-		_, err := Compile("%{"+pattern+"}", patterns)
+		_, err := Compile("%{"+pattern+"}", patterns, Oniguruma)
 		if err != nil {
 			t.Errorf("%v", err.Error())
 		}
 	}
 }
 
+func testCompileAlternatives(t *testing.T, patterns *Patterns) {
+	alternatives := []string{`^user %{USER:user} logged in from %{IP:ip}`, `^login: ip=%{IP:ip} user=%{USER:user}$`}
+	for _, engine := range []RegexEngine{Oniguruma, Auto} {
+		regex, err := CompileAlternatives(alternatives, patterns, engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range []struct{ line, user, ip string }{
+			{"user alice logged in from 10.0.0.1", "alice", "10.0.0.1"},
+			{"login: ip=10.0.0.2 user=bob", "bob", "10.0.0.2"},
+			{"logout: ip=10.0.0.2 user=bob", "", ""},
+		} {
+			result, err := regex.Search(data.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.IsMatch() != (data.user != "") {
+				t.Fatalf("%v: %q: unexpected match result %v", engine, data.line, result.IsMatch())
+			}
+			user, _ := result.GetCaptureGroupByName("user")
+			ip, _ := result.GetCaptureGroupByName("ip")
+			if user != data.user || ip != data.ip {
+				t.Fatalf("%v: %q: expected user=%q ip=%q, but got user=%q ip=%q", engine, data.line, data.user, data.ip, user, ip)
+			}
+			result.Free()
+		}
+		regex.Free()
+	}
+	_, err := CompileAlternatives([]string{"%{USER:user})|(", "%{INT}"}, patterns, Oniguruma)
+	if err == nil || !strings.Contains(err.Error(), "%{USER:user})|(") {
+		t.Fatalf("expected error message saying which pattern is invalid, but got %v", err)
+	}
+}
+
+func testCompileRecursivePattern(t *testing.T, patterns *Patterns) {
+	p := copyPatterns(patterns)
+	for _, definition := range []string{"A a %{B}", "B b %{C}", "C %{A}", "D d %{UNKNOWN}"} {
+		if err := p.AddPattern(definition); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := Compile("%{USER} %{A}", p, Oniguruma)
+	if err == nil || !strings.Contains(err.Error(), "A -> B -> C -> A") {
+		t.Fatalf("expected error message showing the cycle, but got %v", err)
+	}
+	_, err = Compile("%{D}", p, Oniguruma)
+	if err == nil || !strings.Contains(err.Error(), "%{UNKNOWN} not defined, it is used in the definition of %{D}") {
+		t.Fatalf("expected error message showing where the undefined pattern is used, but got %v", err)
+	}
+}
+
+func testCompileAdditionalPattern(t *testing.T, patterns *Patterns) {
+	p := copyPatterns(patterns)
+	if err := p.AddDefinition("INT", "[0-9]+"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddDefinition("MYAPP_ID", "id-%{INT}"); err != nil {
+		t.Fatal(err)
+	}
+	regex, err := Compile("%{MYAPP_ID:id}", p, Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regex.Free()
+	result, err := regex.Search("id--3 id-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Free()
+	id, err := result.GetCaptureGroupByName("id")
+	if err != nil || id != "id-42" {
+		t.Fatalf("expected the overridden INT pattern to match id-42, but got %q, %v", id, err)
+	}
+	if err = p.AddDefinition("MY-APP", "x"); err == nil {
+		t.Fatal("expected error for invalid pattern name")
+	}
+}
+
+func testCompileTypedCaptureGroups(t *testing.T, patterns *Patterns) {
+	for _, engine := range []RegexEngine{Oniguruma, RE2} {
+		regex, err := Compile(`%{INT:status:int} %{INT:time:float} %{NOTSPACE:duration:duration} %{NOTSPACE:size:bytes} %{USER:user}`, patterns, engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, expected := range map[string]CaptureType{"status": Int, "time": Float, "duration": Duration, "size": Bytes, "user": Untyped} {
+			if regex.CaptureType(name) != expected {
+				t.Fatalf("%v: expected type %q for %v, but got %q", engine, expected, name, regex.CaptureType(name))
+			}
+		}
+		regex.Free()
+	}
+	for pattern, expectedError := range map[string]string{
+		`%{INT:status:long}`:                          "unknown type long",
+		`%{INT:status:int} %{NUMBER:status:float}`:    "also defined with type int",
+		`%{INT:status:int} (%{INT:status:int})?`:      "",
+		`%{INT:status:int}|%{WORD:status}`:            "",
+		`%{INT:a:int:float}`:                          "not a valid pattern",
+		`%{NUMBER:duration:duration}|%{USER:message}`: "",
+	} {
+		regex, err := Compile(pattern, patterns, Oniguruma)
+		if expectedError == "" && err != nil {
+			t.Fatalf("%v: unexpected error: %v", pattern, err)
+		}
+		if expectedError != "" && (err == nil || !strings.Contains(err.Error(), expectedError)) {
+			t.Fatalf("%v: expected error containing %q, but got %v", pattern, expectedError, err)
+		}
+		if err == nil {
+			regex.Free()
+		}
+	}
+}
+
+func testCompileAnchoredPattern(t *testing.T, patterns *Patterns) {
+	for _, engine := range []RegexEngine{Oniguruma, RE2} {
+		for _, data := range []struct {
+			anchor  string
+			matches map[string]bool
+		}{
+			{configuration.AnchorNone, map[string]bool{"GET 200": true, "x GET 200": true, "GET 200 x": true, "GET 200\nx": true}},
+			{configuration.AnchorStart, map[string]bool{"GET 200": true, "x GET 200": false, "GET 200 x": true, "GET 200\nx": true}},
+			{configuration.AnchorFull, map[string]bool{"GET 200": true, "x GET 200": false, "GET 200 x": false, "GET 200\nx": false}},
+		} {
+			regex, err := Compile(Anchor(`%{WORD:method} %{INT:status}|%{INT:status} %{WORD:method}`, data.anchor), patterns, engine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for line, expected := range data.matches {
+				result, err := regex.Search(line)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.IsMatch() != expected {
+					t.Fatalf("%v: anchor %v: %q: expected match %v, but got %v", engine, data.anchor, line, expected, result.IsMatch())
+				}
+				result.Free()
+			}
+			regex.Free()
+		}
+	}
+}
+
+func testCompileFlaggedPattern(t *testing.T, patterns *Patterns) {
+	extended := `
+		level=(ERROR|WARN)  # the log level
+		\ %{WORD:user}      # escaped space
+		[ #]+               # not a comment in a character class
+		%{COMMONAPACHELOG}  # spaces in grok patterns are kept
+	`
+	apacheLog := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`
+	for _, engine := range []RegexEngine{Oniguruma, Auto} {
+		for _, data := range []struct {
+			pattern string
+			flags   []string
+			matches map[string]bool
+		}{
+			{`level=ERROR`, nil, map[string]bool{"level=ERROR": true, "level=error": false}},
+			{`level=ERROR`, []string{configuration.RegexFlagIgnoreCase}, map[string]bool{"level=ERROR": true, "level=error": true, "LEVEL=Error": true}},
+			{`start.*end`, nil, map[string]bool{"start end": true, "start\nend": false}},
+			{`start.*end`, []string{configuration.RegexFlagMultiline}, map[string]bool{"start end": true, "start\nend": true}},
+			{extended, []string{configuration.RegexFlagExtended}, map[string]bool{"level=ERROR alice # " + apacheLog: true, "level=ERRORalice " + apacheLog: false, "level=warn alice " + apacheLog: false}},
+			{extended, []string{configuration.RegexFlagExtended, configuration.RegexFlagIgnoreCase}, map[string]bool{"level=warn alice " + apacheLog: true}},
+		} {
+			regex, err := Compile(WithFlags(data.pattern, data.flags), patterns, engine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for line, expected := range data.matches {
+				result, err := regex.Search(line)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.IsMatch() != expected {
+					t.Fatalf("%v: flags %v: %q: expected match %v, but got %v", engine, data.flags, line, expected, result.IsMatch())
+				}
+				result.Free()
+			}
+			regex.Free()
+		}
+	}
+}
+
+func testExplainPattern(t *testing.T, patterns *Patterns) {
+	references, err := Explain(`%{IPORHOST:client} %{WORD}`, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(references) != 2 || references[0].Reference != "%{IPORHOST:client}" || references[0].Definition != "(?:%{IP}|%{HOSTNAME})" || references[1].Definition != `\b\w+\b` {
+		t.Fatalf("unexpected references %v", references)
+	}
+	ip, hostname := references[0].References[0], references[0].References[1]
+	if ip.Reference != "%{IP}" || len(ip.References) != 2 || ip.References[1].Reference != "%{IPV4}" || hostname.Name != "HOSTNAME" || len(hostname.References) != 0 {
+		t.Fatalf("unexpected references %v of IPORHOST", references[0].References)
+	}
+	_, err = Explain(`%{UNDEFINED}`, patterns)
+	if err == nil {
+		t.Fatal("expected error for undefined pattern")
+	}
+}
+
+func testCompileCaptureGroupNames(t *testing.T, patterns *Patterns) {
+	for _, engine := range []RegexEngine{Oniguruma, RE2} {
+		regex, err := Compile(`%{INT:status} (%{USER:user}|%{INT:status}) \(?<escaped>x\) \\(?<word>\w+)`, patterns, engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(regex.CaptureGroupNames(), ",") != "status,user,word" {
+			t.Fatalf("%v: expected capture group names status,user,word, but got %v", engine, regex.CaptureGroupNames())
+		}
+		regex.Free()
+	}
+}
+
+func copyPatterns(patterns *Patterns) *Patterns {
+	result := make(Patterns, len(*patterns))
+	for name, regex := range *patterns {
+		result[name] = regex
+	}
+	return &result
+}
+
 func testCompileUnknownPattern(t *testing.T, patterns *Patterns) {
-	_, err := Compile("%{USER} [a-z] %{SOME_UNKNOWN_PATTERN}.*", patterns)
+	_, err := Compile("%{USER} [a-z] %{SOME_UNKNOWN_PATTERN}.*", patterns, Oniguruma)
 	if err == nil || !strings.Contains(err.Error(), "SOME_UNKNOWN_PATTERN") {
 		t.Error("expected error message saying which pattern is undefined.")
 	}
 }
 
 func testCompileInvalidRegexp(t *testing.T, patterns *Patterns) {
-	_, err := Compile("%{USER} [a-z] \\", patterns) // wrong because regex cannot end with backslash
+	_, err := Compile("%{USER} [a-z] \\", patterns, Oniguruma) // wrong because regex cannot end with backslash
 	if err == nil || !strings.Contains(err.Error(), "%{USER} [a-z] \\") {
 		t.Error("expected error message saying which pattern is invalid.")
 	}
 }
 
 func testVerifyCaptureGroup(t *testing.T, patterns *Patterns) {
-	regex, err := Compile("host %{HOSTNAME:host} user %{USER:user} value %{NUMBER:val}.", patterns)
+	regex, err := Compile("host %{HOSTNAME:host} user %{USER:user} value %{NUMBER:val}.", patterns, Oniguruma)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -96,7 +339,7 @@ func testVerifyCaptureGroup(t *testing.T, patterns *Patterns) {
 }
 
 func testVerifyFieldNames(t *testing.T, patterns *Patterns) {
-	regex, err := Compile("log file %{WORD:logfile} user %{USER:user}", patterns)
+	regex, err := Compile("log file %{WORD:logfile} user %{USER:user}", patterns, Oniguruma)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -114,15 +357,15 @@ func testVerifyFieldNames(t *testing.T, patterns *Patterns) {
 	regex.Free()
 }
 
-func expectOK(t *testing.T, regex *oniguruma.Regex, config string) {
+func expectOK(t *testing.T, regex Regex, config string) {
 	expect(t, regex, config, false)
 }
 
-func expectError(t *testing.T, regex *oniguruma.Regex, config string) {
+func expectError(t *testing.T, regex Regex, config string) {
 	expect(t, regex, config, true)
 }
 
-func expect(t *testing.T, regex *oniguruma.Regex, config string, isErrorExpected bool) {
+func expect(t *testing.T, regex Regex, config string, isErrorExpected bool) {
 	cfg := &configuration.MetricConfig{}
 	err := yaml.Unmarshal([]byte(config), cfg)
 	if err != nil {
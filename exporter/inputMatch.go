@@ -0,0 +1,63 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+// InputMatch is the match pattern of an input. The pattern is matched once per line, and the fields it captures
+// are available in the templates of all metrics of the input, so that the metrics don't need to repeat an expensive pattern.
+type InputMatch struct {
+	regex Regex
+}
+
+// NewInputMatch compiles the match pattern of an input.
+func NewInputMatch(pattern string, patterns *Patterns, engine RegexEngine) (*InputMatch, error) {
+	regex, err := Compile(pattern, patterns, engine)
+	if err != nil {
+		return nil, err
+	}
+	return &InputMatch{regex: regex}, nil
+}
+
+// Fields returns the names of the fields captured by the pattern.
+func (m *InputMatch) Fields() []string {
+	return m.regex.CaptureGroupNames()
+}
+
+// Captures returns the fields captured by the pattern, or nil if the line doesn't match.
+// Typed fields like %{INT:port:int} are converted. If a field cannot be converted, the line doesn't match.
+func (m *InputMatch) Captures(line string) map[string]interface{} {
+	searchResult, err := m.regex.Search(line)
+	if err != nil {
+		return nil
+	}
+	defer searchResult.Free()
+	if !searchResult.IsMatch() {
+		return nil
+	}
+	result := make(map[string]interface{}, len(m.regex.CaptureGroupNames()))
+	for _, name := range m.regex.CaptureGroupNames() {
+		value, err := searchResult.GetCaptureGroupByName(name)
+		if err != nil {
+			return nil
+		}
+		if result[name], err = convertCapture(value, m.regex.CaptureType(name)); err != nil {
+			return nil
+		}
+	}
+	return result
+}
+
+func (m *InputMatch) Free() {
+	m.regex.Free()
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInputMatch(t *testing.T) {
+	patterns := loadPatternDir(t)
+	inputMatch, err := NewInputMatch(`%{USER:user} sent %{INT:bytes:int} bytes`, patterns, Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inputMatch.Free()
+	if strings.Join(inputMatch.Fields(), ",") != "user,bytes" {
+		t.Fatalf("unexpected fields %v", inputMatch.Fields())
+	}
+	captures := inputMatch.Captures("alice sent 1024 bytes")
+	if captures["user"] != "alice" || captures["bytes"] != int64(1024) {
+		t.Fatalf("unexpected captures %v", captures)
+	}
+	if captures := inputMatch.Captures("alice received 1024 bytes"); captures != nil {
+		t.Fatalf("expected no captures for a line that doesn't match, but got %v", captures)
+	}
+}
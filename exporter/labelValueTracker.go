@@ -24,6 +24,10 @@ type LabelValueTracker interface {
 	Observe(labels map[string]string) (bool, error)
 	DeleteByLabels(labels map[string]string) ([]map[string]string, error)
 	DeleteByRetention(retention time.Duration) []map[string]string
+	// Contains is true if the label values were observed and not deleted.
+	Contains(labels map[string]string) bool
+	// Len is the number of label value combinations that were observed and not deleted.
+	Len() int
 }
 
 // Represents the label values for a single time series, i.e. if a time series was created with
@@ -102,6 +106,20 @@ func (observed *observedLabels) DeleteByRetention(retention time.Duration) []map
 	return deleted
 }
 
+func (observed *observedLabels) Contains(labels map[string]string) bool {
+	values := observed.makeLabelValues(labels)
+	for _, observedValues := range observed.values {
+		if equals(values, observedValues.values) {
+			return true
+		}
+	}
+	return false
+}
+
+func (observed *observedLabels) Len() int {
+	return len(observed.values)
+}
+
 func (observed *observedLabels) values2map(observedValues *observedLabelValues) map[string]string {
 	result := make(map[string]string)
 	for i := range observedValues.values {
@@ -142,3 +142,23 @@ func nEntries(t *testing.T, tracker LabelValueTracker) int {
 		return len(trackerInternal.values)
 	}
 }
+
+func TestContains(t *testing.T) {
+	tracker := NewLabelValueTracker([]string{"service", "user"})
+	tracker.Observe(map[string]string{"service": "service a", "user": "alice"})
+	tracker.Observe(map[string]string{"service": "service b", "user": "bob"})
+	tracker.Observe(map[string]string{"service": "service a", "user": "alice"})
+	if tracker.Len() != 2 {
+		t.Fatalf("expected 2 label value combinations, but got %v", tracker.Len())
+	}
+	if !tracker.Contains(map[string]string{"service": "service a", "user": "alice"}) {
+		t.Fatalf("expected service a / alice to be observed")
+	}
+	if tracker.Contains(map[string]string{"service": "service a", "user": "bob"}) {
+		t.Fatalf("service a / bob was not observed")
+	}
+	tracker.DeleteByLabels(map[string]string{"user": "alice"})
+	if tracker.Len() != 1 || tracker.Contains(map[string]string{"service": "service a", "user": "alice"}) {
+		t.Fatalf("expected service a / alice to be deleted")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lastTotals keeps the last value of counters with value_is_total, where the log line contains a running total
+// like "total requests served: 123456" instead of the increase.
+// It is only used in the main loop, so access is not synchronized.
+type lastTotals struct {
+	totals map[string]float64 // label values -> last total
+}
+
+func newLastTotals() *lastTotals {
+	return &lastTotals{
+		totals: make(map[string]float64),
+	}
+}
+
+// increase returns how much the counter with the labels increases for the new total.
+// The first total of a time series is the increase from zero. A total smaller than the previous one means the
+// application was restarted and counts from zero again, so the increase is the new total.
+func (t *lastTotals) increase(labels map[string]string, total float64) float64 {
+	key := labelsKey(labels)
+	previous, ok := t.totals[key]
+	t.totals[key] = total
+	if !ok || total < previous {
+		return total
+	}
+	return total - previous
+}
+
+// deleter deletes the last totals along with the time series of the vec, for delete_match and retention.
+func (t *lastTotals) deleter(vec deleterMetric) deleterMetric {
+	if t == nil {
+		return vec
+	}
+	return &lastTotalsDeleter{
+		deleterMetric: vec,
+		lastTotals:    t,
+	}
+}
+
+type lastTotalsDeleter struct {
+	deleterMetric
+	lastTotals *lastTotals
+}
+
+func (d *lastTotalsDeleter) Delete(labels prometheus.Labels) bool {
+	delete(d.lastTotals.totals, labelsKey(labels))
+	return d.deleterMetric.Delete(labels)
+}
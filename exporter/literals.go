@@ -0,0 +1,242 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"regexp/syntax"
+	"strings"
+)
+
+// Alternatives with more literals than this are not used for the pre-filter, as checking them would be as slow as the regex.
+const maxRequiredLiterals = 16
+
+// prefilteredRegex skips the regex engine for lines that cannot match, because they contain none of the required literals.
+// Most log lines don't match most metrics, and strings.Contains() is much cheaper than a regex search.
+type prefilteredRegex struct {
+	Regex
+	literals []string // each match contains at least one of these strings
+}
+
+func (r *prefilteredRegex) Search(input string) (SearchResult, error) {
+	for _, literal := range r.literals {
+		if strings.Contains(input, literal) {
+			return r.Regex.Search(input)
+		}
+	}
+	return noMatch{}, nil
+}
+
+// withPrefilter wraps the compiled regex with a pre-filter, if every match of the Oniguruma regular expression contains a literal string.
+func withPrefilter(compiled Regex, regex string) Regex {
+	literals := requiredLiterals(regex)
+	if len(literals) == 0 {
+		return compiled
+	}
+	return &prefilteredRegex{
+		Regex:    compiled,
+		literals: literals,
+	}
+}
+
+// requiredLiterals returns strings so that each match of the regular expression contains at least one of them,
+// like ["GET", "POST"] for `(GET|POST) %{URIPATH:path}`. The result is nil if there are no such strings.
+// The regular expression is analyzed with Go's regexp/syntax package, after removing Oniguruma features that Go doesn't support.
+// If it still cannot be parsed, like with conditionals or character class intersections, there is no pre-filter.
+func requiredLiterals(regex string) []string {
+	translated, err := re2Syntax(relax(regex), false)
+	if err != nil {
+		return nil
+	}
+	parsed, err := syntax.Parse(translated, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	return literalsOf(parsed.Simplify())
+}
+
+// relax removes look-arounds, atomic groups, possessive quantifiers, and back references from an Oniguruma regular expression.
+// The result matches all lines that the original regular expression matches, and maybe more,
+// so the literals that are required by the result are also required by the original regular expression.
+func relax(regex string) string {
+	var (
+		result          strings.Builder
+		inClass         = false
+		afterQuantifier = false
+	)
+	for i := 0; i < len(regex); i++ {
+		c := regex[i]
+		wasAfterQuantifier := afterQuantifier
+		afterQuantifier = false
+		switch {
+		case c == '\\' && i+1 < len(regex):
+			switch e := regex[i+1]; {
+			case inClass:
+				result.WriteString(regex[i : i+2])
+			case e >= '1' && e <= '9':
+				result.WriteString("(?s:.*)") // back reference
+				for i+2 < len(regex) && regex[i+2] >= '0' && regex[i+2] <= '9' {
+					i++
+				}
+			case e == 'k' && strings.HasPrefix(regex[i+2:], "<") && strings.IndexByte(regex[i:], '>') > 0:
+				result.WriteString("(?s:.*)") // named back reference like \k<name>
+				i += strings.IndexByte(regex[i:], '>') - 1
+			case e == 'G' || e == 'K' || e == 'Z':
+				// zero-width assertions, removed
+			case e == 'h' || e == 'H' || e == 'R' || e == 'X':
+				result.WriteString("(?s:.+)")
+			default:
+				result.WriteString(regex[i : i+2])
+			}
+			i++
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			result.WriteByte(c)
+		case c == '[':
+			inClass = true
+			result.WriteByte(c)
+			if strings.HasPrefix(regex[i+1:], "^") {
+				i++
+				result.WriteByte('^')
+			}
+			if strings.HasPrefix(regex[i+1:], "]") {
+				i++
+				result.WriteByte(']')
+			}
+		case strings.HasPrefix(regex[i:], "(?=") || strings.HasPrefix(regex[i:], "(?!") || strings.HasPrefix(regex[i:], "(?<=") || strings.HasPrefix(regex[i:], "(?<!"):
+			i = groupEnd(regex, i) // look-arounds don't consume characters, removed
+		case strings.HasPrefix(regex[i:], "(?>"):
+			result.WriteString("(?:") // atomic group
+			i += 2
+		case strings.HasPrefix(regex[i:], "(?"):
+			result.WriteString("(?") // so that the ? is not taken for a quantifier
+			i++
+		case c == '+' && wasAfterQuantifier:
+			// possessive quantifier like a++, removed
+		case c == '*' || c == '+' || c == '?' || c == '}':
+			result.WriteByte(c)
+			afterQuantifier = true
+		default:
+			result.WriteByte(c)
+		}
+	}
+	return result.String()
+}
+
+// groupEnd returns the index of the ) closing the group that starts at regex[start].
+func groupEnd(regex string, start int) int {
+	depth, inClass := 0, false
+	for i := start; i < len(regex); i++ {
+		switch c := regex[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+			if strings.HasPrefix(regex[i+1:], "]") || strings.HasPrefix(regex[i+1:], "^]") {
+				i += strings.IndexByte(regex[i+1:], ']') + 1
+			}
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(regex) - 1
+}
+
+func literalsOf(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil // case insensitive, like (?i)error
+		}
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return literalsOf(re.Sub[0])
+	case syntax.OpConcat:
+		return literalsOfConcat(re.Sub)
+	case syntax.OpAlternate:
+		var result []string
+		for _, sub := range re.Sub {
+			literals := literalsOf(sub)
+			if len(literals) == 0 || len(result)+len(literals) > maxRequiredLiterals {
+				return nil // a match of this alternative may not contain any literal
+			}
+			result = append(result, literals...)
+		}
+		return result
+	default:
+		return nil // like .* or [0-9]?, which may match without any literal
+	}
+}
+
+// literalsOfConcat returns the most selective literals of the parts of the concatenation, as a match contains all of them.
+// Adjacent literals are joined, like "HTTP/" in `HTTP/%{NUMBER:version}`.
+func literalsOfConcat(subs []*syntax.Regexp) []string {
+	var (
+		result  []string
+		literal strings.Builder
+	)
+	choose := func(candidate []string) {
+		if isMoreSelective(candidate, result) {
+			result = candidate
+		}
+	}
+	for _, sub := range subs {
+		if sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0 {
+			literal.WriteString(string(sub.Rune))
+			continue
+		}
+		if literal.Len() > 0 {
+			choose([]string{literal.String()})
+			literal.Reset()
+		}
+		choose(literalsOf(sub))
+	}
+	if literal.Len() > 0 {
+		choose([]string{literal.String()})
+	}
+	return result
+}
+
+// isMoreSelective prefers literals with a longer shortest element, and fewer elements if the shortest elements have the same length.
+func isMoreSelective(a, b []string) bool {
+	if len(a) == 0 {
+		return false
+	}
+	if len(b) == 0 {
+		return true
+	}
+	if minLength(a) != minLength(b) {
+		return minLength(a) > minLength(b)
+	}
+	return len(a) < len(b)
+}
+
+func minLength(literals []string) int {
+	result := len(literals[0])
+	for _, literal := range literals[1:] {
+		if len(literal) < result {
+			result = len(literal)
+		}
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequiredLiterals(t *testing.T) {
+	for regex, expected := range map[string]string{
+		`user (?<user>[a-z]+) logged in`:                         " logged in",
+		`HTTP/(?<version>[0-9.]+)`:                               "HTTP/",
+		`(?<method>GET|POST) (?<path>\S+)`:                       "GET|POST",
+		`(?:ERROR|WARN)[^:]*: (?<message>.*)`:                    "ERROR|WARN",
+		`(?:connection (?:refused|reset)|timeout)`:               "connection re|timeout",
+		`\A(?:status=(?<status>\d+))\z`:                          "status=",
+		`(?<x>abc)+`:                                             "abc",
+		`x{2,3}`:                                                 "xx",
+		`(?i)error: (?<message>.*)`:                              "",
+		`(?:error|.*)`:                                           "",
+		`(?:foo)?bar`:                                            "bar",
+		`(?<![0-9])(?<ip>[0-9.]+) request`:                       " request",
+		`(?>[+-]?[0-9]+)++ items`:                                " items",
+		`(?<quote>["'])(?<text>.*)\k<quote>`:                     "",
+		`(?<word>[a-z]+) \1 again`:                               " again",
+		`(?:a(?=b)|c)d`:                                          "d",
+		`\h+:(?<x>\d+)`:                                          ":",
+		`[a-z]+`:                                                 "",
+		`(?:a|b|c|d|e|f|g|h|i|j|k|l|m|n|o|p|q|r)x`:               "x",
+		`(?:ab|cd|ef|gh|ij|kl|mn|op|qr|st|uv|wx|yz|12|34|56|78)`: "",
+	} {
+		literals := strings.Join(requiredLiterals(regex), "|")
+		if literals != expected {
+			t.Fatalf("%v: expected required literals %q, but got %q", regex, expected, literals)
+		}
+	}
+}
+
+func TestPrefilter(t *testing.T) {
+	patterns := loadPatternDir(t)
+	for _, data := range []struct {
+		pattern string
+		lines   []string
+	}{
+		{
+			pattern: `user %{USER:user} id %{INT:id}`,
+			lines:   []string{"user alice id 3", "user bob", "id 3 user bob", "USER alice ID 3"},
+		},
+		{
+			pattern: `(?<method>GET|POST) %{URIPATH:path} HTTP/%{NUMBER:version}`,
+			lines:   []string{"GET /index.html HTTP/1.1", "PUT /index.html HTTP/1.1", "POST / HTTP/2", "GET /"},
+		},
+		{
+			pattern: `(?i)%{LOGLEVEL:level}: %{GREEDYDATA:message}`,
+			lines:   []string{"ERROR: failed", "error: failed", "info failed"},
+		},
+	} {
+		for _, engine := range []RegexEngine{Oniguruma, Auto} {
+			regex, err := Compile(data.pattern, patterns, engine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefiltered, ok := regex.(*prefilteredRegex)
+			if !ok {
+				if !strings.HasPrefix(data.pattern, "(?i)") {
+					t.Fatalf("%v: expected a pre-filter with %v", data.pattern, engine)
+				}
+				regex.Free()
+				continue
+			}
+			for _, line := range data.lines {
+				expectSameResult(t, data.pattern, prefiltered.Regex, prefiltered, line)
+			}
+			regex.Free()
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogTimeField is the additional field with the log time of the line in seconds since the epoch, see use_log_timestamp.
+const LogTimeField = "log_time"
+
+// logTimestamps keeps the log time of the last matching line for each time series of a metric.
+// The lines are processed in the main loop, while the samples are collected by the HTTP server, so access is synchronized.
+type logTimestamps struct {
+	mutex      sync.Mutex
+	labelNames map[string]bool      // names of the labels from the templates, other labels like const_labels are not part of the key
+	timestamps map[string]time.Time // label values -> log time
+}
+
+// logTimestampCollector exports the samples of the collector with the log time of the last matching line.
+// Time series that were not updated by a line with a log time are exported without timestamp.
+type logTimestampCollector struct {
+	prometheus.Collector
+	logTimestamps *logTimestamps
+}
+
+func newLogTimestamps(labelNames []string) *logTimestamps {
+	result := &logTimestamps{
+		labelNames: make(map[string]bool, len(labelNames)),
+		timestamps: make(map[string]time.Time),
+	}
+	for _, name := range labelNames {
+		result.labelNames[name] = true
+	}
+	return result
+}
+
+// observe records the log time from the additionalFields for the time series with the labels. Lines without log time are ignored.
+// The timestamp of a time series never goes back, because Prometheus rejects samples that are older than the last sample it has,
+// so a line with an older log time than the previous line, like from a second log file, keeps the previous timestamp.
+func (t *logTimestamps) observe(labels map[string]string, additionalFields map[string]interface{}) {
+	seconds, ok := additionalFields[LogTimeField].(float64)
+	if !ok {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := labelsKey(labels)
+	timestamp := time.Unix(0, int64(seconds*float64(time.Second)))
+	if previous, ok := t.timestamps[key]; !ok || timestamp.After(previous) {
+		t.timestamps[key] = timestamp
+	}
+}
+
+func (t *logTimestamps) collector(orig prometheus.Collector) prometheus.Collector {
+	if t == nil {
+		return orig
+	}
+	return &logTimestampCollector{
+		Collector:     orig,
+		logTimestamps: t,
+	}
+}
+
+func (c *logTimestampCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(metrics)
+		close(metrics)
+	}()
+	t := c.logTimestamps
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	remaining := make(map[string]time.Time, len(t.timestamps))
+	for metric := range metrics {
+		var pb io_prometheus_client.Metric
+		if err := metric.Write(&pb); err != nil {
+			ch <- metric
+			continue
+		}
+		labels := make(map[string]string, len(t.labelNames))
+		for _, label := range pb.Label {
+			if t.labelNames[label.GetName()] {
+				labels[label.GetName()] = label.GetValue()
+			}
+		}
+		key := labelsKey(labels)
+		timestamp, ok := t.timestamps[key]
+		if !ok {
+			ch <- metric
+			continue
+		}
+		// Only keep the timestamps of existing time series, the others were deleted with delete_match or retention.
+		remaining[key] = timestamp
+		ch <- prometheus.NewMetricWithTimestamp(timestamp, metric)
+	}
+	t.timestamps = remaining
+}
+
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var result strings.Builder
+	for _, name := range names {
+		result.WriteString(name)
+		result.WriteByte('=')
+		result.WriteString(labels[name])
+		result.WriteByte(0xff) // not valid in UTF-8, so it cannot be part of a label value
+	}
+	return result.String()
+}
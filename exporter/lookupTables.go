@@ -0,0 +1,181 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/template"
+	"gopkg.in/yaml.v2"
+)
+
+// LookupTables loads the files from the lookup_tables section for {{lookup "name" .field}} in the templates,
+// and reloads a file when its modification time or size changed.
+type LookupTables struct {
+	tables map[string]*lookupTableFile
+}
+
+type lookupTableFile struct {
+	cfg       configuration.LookupTableConfig
+	modTime   time.Time
+	size      int64
+	nextCheck time.Time
+}
+
+func NewLookupTables() *LookupTables {
+	return &LookupTables{
+		tables: make(map[string]*lookupTableFile),
+	}
+}
+
+// Load reads all tables in cfg and removes the tables that are no longer configured.
+// If a file cannot be read, an error is returned and the current tables remain active.
+func (t *LookupTables) Load(cfg configuration.LookupTablesConfig) error {
+	apply, err := t.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare reads all tables in cfg like Load, but the current tables remain active until apply is called.
+// This way, the config can be reloaded without changing the tables if another part of the config is invalid.
+func (t *LookupTables) Prepare(cfg configuration.LookupTablesConfig) (apply func(), err error) {
+	now := time.Now()
+	loaded := make(map[string]*lookupTableFile, len(cfg))
+	values := make(map[string]map[string]string, len(cfg))
+	for _, tableCfg := range cfg {
+		table := &lookupTableFile{cfg: tableCfg}
+		v, err := table.read(now)
+		if err != nil {
+			return nil, err
+		}
+		loaded[tableCfg.Name] = table
+		values[tableCfg.Name] = v
+	}
+	return func() {
+		for name := range t.tables {
+			if _, ok := loaded[name]; !ok {
+				template.RemoveLookupTable(name)
+			}
+		}
+		for name, table := range loaded {
+			template.SetLookupTable(name, values[name], table.cfg.Default)
+		}
+		t.tables = loaded
+	}, nil
+}
+
+// Reload reads the files that are due for their reload_interval and were modified since they were last read.
+// If a file cannot be read, a warning is printed and the table keeps its current values.
+func (t *LookupTables) Reload() {
+	now := time.Now()
+	for name, table := range t.tables {
+		if now.Before(table.nextCheck) {
+			continue
+		}
+		table.nextCheck = now.Add(table.cfg.ReloadInterval)
+		fileInfo, err := os.Stat(table.cfg.File)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: failed to reload lookup table %v, keeping the current values: %v\n", name, err.Error())
+			continue
+		}
+		if fileInfo.ModTime().Equal(table.modTime) && fileInfo.Size() == table.size {
+			continue
+		}
+		values, err := table.read(now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: failed to reload lookup table %v, keeping the current values: %v\n", name, err.Error())
+			continue
+		}
+		template.SetLookupTable(name, values, table.cfg.Default)
+	}
+}
+
+// CheckInterval is the shortest reload_interval, or 0 if there are no lookup tables.
+func (t *LookupTables) CheckInterval() time.Duration {
+	var result time.Duration
+	for _, table := range t.tables {
+		if result == 0 || table.cfg.ReloadInterval < result {
+			result = table.cfg.ReloadInterval
+		}
+	}
+	return result
+}
+
+func (table *lookupTableFile) read(now time.Time) (map[string]string, error) {
+	f, err := os.Open(table.cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lookup table %v: %v", table.cfg.Name, err.Error())
+	}
+	defer f.Close()
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lookup table %v: %v", table.cfg.Name, err.Error())
+	}
+	var values map[string]string
+	switch table.cfg.Format {
+	case "csv":
+		values, err = readCsvLookupTable(f)
+	default:
+		values, err = readYamlLookupTable(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load lookup table %v from %v: %v", table.cfg.Name, table.cfg.File, err.Error())
+	}
+	table.modTime, table.size = fileInfo.ModTime(), fileInfo.Size()
+	table.nextCheck = now.Add(table.cfg.ReloadInterval)
+	return values, nil
+}
+
+// readCsvLookupTable reads lines like 10.0.0.1,dc1 with the key in the first column and the value in the second column.
+// Lines starting with # are comments.
+func readCsvLookupTable(r io.Reader) (map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(records))
+	for _, record := range records {
+		result[strings.TrimSpace(record[0])] = strings.TrimSpace(record[1])
+	}
+	return result, nil
+}
+
+// readYamlLookupTable reads a map like {"10.0.0.1": "dc1"}.
+func readYamlLookupTable(r io.Reader) (map[string]string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	err = yaml.UnmarshalStrict(data, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/template"
+)
+
+func TestLookupTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_lookup_tables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	csvFile := filepath.Join(dir, "dc.csv")
+	yamlFile := filepath.Join(dir, "teams.yml")
+	writeLookupTableFile(t, csvFile, "# ip,datacenter\n10.0.0.1, dc1\n10.0.0.2,dc2\n")
+	writeLookupTableFile(t, yamlFile, "alice: dev\n1000: ops\n")
+	tables := NewLookupTables()
+	err = tables.Load(configuration.LookupTablesConfig{
+		{Name: "dc_map", File: csvFile, Format: "csv", Default: "unknown", ReloadInterval: time.Nanosecond},
+		{Name: "team_map", File: yamlFile, Format: "yaml", ReloadInterval: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tables.Load(nil)
+	if tables.CheckInterval() != time.Nanosecond {
+		t.Fatalf("expected the shortest reload_interval, but got %v", tables.CheckInterval())
+	}
+	expectLookup(t, `{{lookup "dc_map" .ip}}`, map[string]interface{}{"ip": "10.0.0.1"}, "dc1")
+	expectLookup(t, `{{lookup "dc_map" .ip}}`, map[string]interface{}{"ip": "10.0.0.3"}, "unknown")
+	expectLookup(t, `{{lookup "team_map" .uid}}`, map[string]interface{}{"uid": int64(1000)}, "ops")
+
+	// the csv file is reloaded, the yaml file is not due for its reload_interval
+	writeLookupTableFile(t, csvFile, "10.0.0.3,dc3\n")
+	writeLookupTableFile(t, yamlFile, "alice: ops\n")
+	tables.Reload()
+	expectLookup(t, `{{lookup "dc_map" .ip}}`, map[string]interface{}{"ip": "10.0.0.3"}, "dc3")
+	expectLookup(t, `{{lookup "team_map" .user}}`, map[string]interface{}{"user": "alice"}, "dev")
+
+	// invalid files keep the current values
+	writeLookupTableFile(t, csvFile, "10.0.0.4,dc4,extra column\n")
+	tables.Reload()
+	expectLookup(t, `{{lookup "dc_map" .ip}}`, map[string]interface{}{"ip": "10.0.0.3"}, "dc3")
+	err = tables.Load(configuration.LookupTablesConfig{
+		{Name: "dc_map", File: csvFile, Format: "csv", ReloadInterval: time.Minute},
+	})
+	if err == nil {
+		t.Fatal("expected error loading the invalid csv file")
+	}
+	expectLookup(t, `{{lookup "team_map" .user}}`, map[string]interface{}{"user": "alice"}, "dev")
+
+	// tables that are removed from the config are removed
+	err = tables.Load(configuration.LookupTablesConfig{
+		{Name: "team_map", File: yamlFile, Format: "yaml", ReloadInterval: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, `{{lookup "team_map" .user}}`, map[string]interface{}{"user": "alice"}, "ops")
+	tmplt, err := template.New("dc", `{{lookup "dc_map" .ip}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tmplt.Execute(map[string]interface{}{"ip": "10.0.0.3"}); err == nil {
+		t.Fatal("expected error, because dc_map was removed")
+	}
+}
+
+func TestLookupTablesPrepare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_lookup_tables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	currentFile := filepath.Join(dir, "dc.csv")
+	newFile := filepath.Join(dir, "dc_new.csv")
+	writeLookupTableFile(t, currentFile, "10.0.0.1,dc1\n")
+	writeLookupTableFile(t, newFile, "10.0.0.1,dc2\n")
+	tables := NewLookupTables()
+	err = tables.Load(configuration.LookupTablesConfig{
+		{Name: "dc_map", File: currentFile, Format: "csv", ReloadInterval: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tables.Load(nil)
+	apply, err := tables.Prepare(configuration.LookupTablesConfig{
+		{Name: "dc_map", File: newFile, Format: "csv", ReloadInterval: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the current table remains active until apply is called, like when the config is reloaded and another part is invalid
+	expectLookup(t, `{{lookup "dc_map" .ip}}`, map[string]interface{}{"ip": "10.0.0.1"}, "dc1")
+	if tables.CheckInterval() != time.Minute {
+		t.Fatalf("expected the reload_interval of the current table, but got %v", tables.CheckInterval())
+	}
+	apply()
+	expectLookup(t, `{{lookup "dc_map" .ip}}`, map[string]interface{}{"ip": "10.0.0.1"}, "dc2")
+	if tables.CheckInterval() != time.Hour {
+		t.Fatalf("expected the reload_interval of the new table, but got %v", tables.CheckInterval())
+	}
+}
+
+func writeLookupTableFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectLookup(t *testing.T, tmpltString string, fields map[string]interface{}, expected string) {
+	tmplt, err := template.New("lookup", tmpltString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := tmplt.Execute(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != expected {
+		t.Fatalf("%v: expected %q, but got %q", tmpltString, expected, result)
+	}
+}
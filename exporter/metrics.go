@@ -15,19 +15,26 @@
 package exporter
 
 import (
+	"encoding/json"
 	"fmt"
 	configuration "github.com/fstab/grok_exporter/config/v3"
-	"github.com/fstab/grok_exporter/oniguruma"
 	"github.com/fstab/grok_exporter/tailer/glob"
 	"github.com/fstab/grok_exporter/template"
 	"github.com/prometheus/client_golang/prometheus"
+	"math/rand"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Match struct {
-	Labels map[string]string
-	Value  float64
+	Labels   map[string]string
+	Value    float64
+	Overflow bool // the labels were new and the metric already had max_series label value combinations, see max_series_action
+	Denied   bool // a label value was not allowed by label_values, see label_values.action
+	// Unsampled is true if the patterns were not tried on the line because of sample_rate, so the metric was not updated.
+	// The other fields are empty, because it is not known whether the line would have matched.
+	Unsampled bool
 }
 
 type Metric interface {
@@ -35,21 +42,40 @@ type Metric interface {
 	Collector() prometheus.Collector
 
 	PathMatches(logfilePath string) bool
-	// Returns the match if the line matched, and nil if the line didn't match.
+	// Returns true if the metric applies to lines from the input with the given id.
+	SourceMatches(inputId string) bool
+	// Returns the match if the line matched, and nil if the line didn't match. If the line was skipped because of sample_rate, the match is Unsampled.
 	ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error)
+	// Like ProcessMatch, but the metric is updated as if the line was read repeat times, see tailer.DedupTailer().
+	ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error)
 	// Returns the match if the delete pattern matched, nil otherwise.
 	ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error)
+	// Returns the values of the capture groups if the line matched, nil otherwise. The metric is not updated.
+	Captures(line string, additionalFields map[string]interface{}) (map[string]string, error)
 	// Remove old metrics
-	ProcessRetention() error
+	// ProcessRetention deletes the label values that were not updated within the metric's retention, and returns how many were deleted.
+	ProcessRetention() (int, error)
+	// DeleteSeries deletes the time series with the labels, and returns how many were deleted. Missing labels match all values.
+	DeleteSeries(labels map[string]string) (int, error)
+	// Free releases the compiled patterns. The metric must not be used afterwards.
+	Free()
 }
 
 // Common values for incMetric and observeMetric
 type metric struct {
 	name        string
 	globs       []glob.Glob
-	regex       *oniguruma.Regex
-	deleteRegex *oniguruma.Regex
+	sources     []string
+	regex       Regex
+	deleteRegex Regex
+	matchField  []string // path in the extra object, empty means the patterns are matched against the line
+	grokField   string   // field of the input's match pattern, alternative to matchField
 	retention   time.Duration
+	// sampleRate is the fraction of the lines that the patterns are tried on, 0 means all lines.
+	sampleRate float64
+	random     *rand.Rand
+	// logTimestamps is nil unless the samples are exported with the log time of the last matching line.
+	logTimestamps *logTimestamps
 }
 
 type observeMetric struct {
@@ -62,6 +88,15 @@ type metricWithLabels struct {
 	labelTemplates       []template.Template
 	deleteLabelTemplates []template.Template
 	labelValueTracker    LabelValueTracker
+	maxSeries            int    // limit for the label value combinations, 0 means no limit
+	maxSeriesAction      string // drop or other, empty means drop
+	labelValueFilters    map[string]labelValueFilter
+}
+
+// labelValueFilter is the allow or deny list of a label, see label_values.
+type labelValueFilter struct {
+	allow, deny map[string]bool // allow is nil if the deny list is used
+	drop        bool
 }
 
 type observeMetricWithLabels struct {
@@ -71,24 +106,26 @@ type observeMetricWithLabels struct {
 
 type counterMetric struct {
 	observeMetric
-	counter prometheus.Counter
+	counter    prometheus.Counter
+	lastTotals *lastTotals // nil unless the value is a running total, see value_is_total
 }
 
 type counterVecMetric struct {
 	observeMetricWithLabels
 	counterVec *prometheus.CounterVec
+	lastTotals *lastTotals // nil unless the value is a running total, see value_is_total
 }
 
 type gaugeMetric struct {
 	observeMetric
-	cumulative bool
-	gauge      prometheus.Gauge
+	operation string // see metrics.operation, never empty
+	gauge     prometheus.Gauge
 }
 
 type gaugeVecMetric struct {
 	observeMetricWithLabels
-	cumulative bool
-	gaugeVec   *prometheus.GaugeVec
+	operation string // see metrics.operation, never empty
+	gaugeVec  *prometheus.GaugeVec
 }
 
 type histogramMetric struct {
@@ -111,10 +148,56 @@ type summaryVecMetric struct {
 	summaryVec *prometheus.SummaryVec
 }
 
+type distinctMetric struct {
+	observeMetric
+	distinct *distinctCollector
+}
+
+type distinctVecMetric struct {
+	observeMetricWithLabels
+	distinctVec *distinctCollector
+}
+
+type aggregateMetric struct {
+	observeMetric
+	aggregate *aggregateCollector
+}
+
+type aggregateVecMetric struct {
+	observeMetricWithLabels
+	aggregateVec *aggregateCollector
+}
+
+type quantileMetric struct {
+	observeMetric
+	quantile *quantileCollector
+}
+
+type quantileVecMetric struct {
+	observeMetricWithLabels
+	quantileVec *quantileCollector
+}
+
+// infoMetric has a single time series with the labels of the last matching line, see the info metric type.
+type infoMetric struct {
+	observeMetricWithLabels
+	gaugeVec *prometheus.GaugeVec
+	current  string // labelsKey() of the current time series
+}
+
 type deleterMetric interface {
 	Delete(prometheus.Labels) bool
 }
 
+func (m *metric) Free() {
+	if m.regex != nil {
+		m.regex.Free()
+	}
+	if m.deleteRegex != nil {
+		m.deleteRegex.Free()
+	}
+}
+
 func (m *metric) Name() string {
 	return m.name
 }
@@ -131,54 +214,170 @@ func (m *metric) PathMatches(logfilePath string) bool {
 	return false
 }
 
+func (m *metric) SourceMatches(inputId string) bool {
+	if len(m.sources) == 0 {
+		return true
+	}
+	for _, source := range m.sources {
+		if source == inputId {
+			return true
+		}
+	}
+	return false
+}
+
+// matchInput returns the text that the patterns are matched against, which is either the line, the match_field of the extra object,
+// or the match_grok_field captured by the input's match pattern.
+// The result is false if the extra object doesn't have the match_field, or if the field is not a string, number, or bool.
+// It is also false if the match_grok_field is empty, because it is in an optional part of the input's match pattern that did not match.
+func (m *metric) matchInput(line string, additionalFields map[string]interface{}) (string, bool) {
+	if len(m.grokField) > 0 {
+		value, ok := additionalFields[m.grokField]
+		if !ok || value == nil || value == "" {
+			return "", false
+		}
+		return fmt.Sprint(value), true
+	}
+	if len(m.matchField) == 0 {
+		return line, true
+	}
+	value := additionalFields["extra"]
+	for _, name := range m.matchField {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		value = object[name]
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
 func (m *counterMetric) Collector() prometheus.Collector {
-	return m.counter
+	return m.logTimestamps.collector(m.counter)
 }
 
 func (m *counterVecMetric) Collector() prometheus.Collector {
-	return m.counterVec
+	return m.logTimestamps.collector(m.counterVec)
 }
 
 func (m *gaugeMetric) Collector() prometheus.Collector {
-	return m.gauge
+	return m.logTimestamps.collector(m.gauge)
 }
 
 func (m *gaugeVecMetric) Collector() prometheus.Collector {
-	return m.gaugeVec
+	return m.logTimestamps.collector(m.gaugeVec)
 }
 
 func (m *histogramMetric) Collector() prometheus.Collector {
-	return m.histogram
+	return m.logTimestamps.collector(m.histogram)
 }
 
 func (m *histogramVecMetric) Collector() prometheus.Collector {
-	return m.histogramVec
+	return m.logTimestamps.collector(m.histogramVec)
 }
 
 func (m *summaryMetric) Collector() prometheus.Collector {
-	return m.summary
+	return m.logTimestamps.collector(m.summary)
 }
 
 func (m *summaryVecMetric) Collector() prometheus.Collector {
-	return m.summaryVec
+	return m.logTimestamps.collector(m.summaryVec)
+}
+
+func (m *distinctMetric) Collector() prometheus.Collector {
+	return m.logTimestamps.collector(m.distinct)
+}
+
+func (m *distinctVecMetric) Collector() prometheus.Collector {
+	return m.logTimestamps.collector(m.distinctVec)
 }
 
-func (m *observeMetric) processMatch(line string, callback func(value float64) (bool, error)) (*Match, error) {
+func (m *aggregateMetric) Collector() prometheus.Collector {
+	return m.logTimestamps.collector(m.aggregate)
+}
+
+func (m *aggregateVecMetric) Collector() prometheus.Collector {
+	return m.logTimestamps.collector(m.aggregateVec)
+}
+
+func (m *quantileMetric) Collector() prometheus.Collector {
+	return m.logTimestamps.collector(m.quantile)
+}
+
+func (m *quantileVecMetric) Collector() prometheus.Collector {
+	return m.logTimestamps.collector(m.quantileVec)
+}
+
+func (m *infoMetric) Collector() prometheus.Collector {
+	return m.logTimestamps.collector(m.gaugeVec)
+}
+
+// sampled is true if the patterns should be tried on the current line, see sample_rate.
+// Lines are picked randomly, so periodic patterns in the log, like request and response lines, don't skew the result.
+func (m *metric) sampled() bool {
+	return m.sampleRate == 0 || m.random.Float64() < m.sampleRate
+}
+
+// scaled extrapolates a counter increment from the sampled lines to all lines.
+func (m *metric) scaled(value float64) float64 {
+	if m.sampleRate == 0 {
+		return value
+	}
+	return value / m.sampleRate
+}
+
+func (m *observeMetric) processMatch(line string, additionalFields map[string]interface{}, repeat int, callback func(value float64) (bool, error)) (*Match, error) {
+	return m.processValueMatch(line, additionalFields, repeat, m.parseValue, func(value float64, _ string) (bool, error) {
+		return callback(value)
+	})
+}
+
+// processValueMatch is like processMatch, but the callback gets the result of the value template as well,
+// and toFloat converts it to the Match's Value.
+func (m *observeMetric) processValueMatch(line string, additionalFields map[string]interface{}, repeat int, toFloat func(string) (float64, error), callback func(value float64, stringValue string) (bool, error)) (*Match, error) {
+	line, ok := m.matchInput(line, additionalFields)
+	if !ok {
+		return nil, nil
+	}
+	if !m.sampled() {
+		return &Match{Unsampled: true}, nil
+	}
 	searchResult, err := m.regex.Search(line)
 	if err != nil {
-		return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
+		return nil, fmt.Errorf("error processing metric %v: %w", m.Name(), err)
 	}
 	defer searchResult.Free()
 	if searchResult.IsMatch() {
-		floatVal, err := floatValue(m.Name(), searchResult, m.valueTemplate, nil)
+		stringVal, err := stringValue(m.Name(), m.regex, searchResult, m.valueTemplate, additionalFields)
 		if err != nil {
 			return nil, err
 		}
-		match, err := callback(floatVal)
+		floatVal, err := toFloat(stringVal)
 		if err != nil {
 			return nil, err
 		}
+		match := false
+		for i := 0; i < repeat; i++ {
+			match, err = callback(floatVal, stringVal)
+			if err != nil {
+				return nil, err
+			}
+		}
 		if match {
+			if m.logTimestamps != nil {
+				m.logTimestamps.observe(nil, additionalFields)
+			}
 			return &Match{
 				Value: floatVal,
 			}, nil
@@ -187,36 +386,143 @@ func (m *observeMetric) processMatch(line string, callback func(value float64) (
 	return nil, nil
 }
 
-func (m *observeMetricWithLabels) processMatch(line string, additionalFields map[string]interface{}, callback func(value float64, labels map[string]string) (bool, error)) (*Match, error) {
+func (m *observeMetricWithLabels) processMatch(line string, additionalFields map[string]interface{}, repeat int, callback func(value float64, labels map[string]string) (bool, error)) (*Match, error) {
+	return m.processValueMatch(line, additionalFields, repeat, m.parseValue, func(value float64, _ string, labels map[string]string) (bool, error) {
+		return callback(value, labels)
+	})
+}
+
+func (m *observeMetricWithLabels) processValueMatch(line string, additionalFields map[string]interface{}, repeat int, toFloat func(string) (float64, error), callback func(value float64, stringValue string, labels map[string]string) (bool, error)) (*Match, error) {
+	line, ok := m.matchInput(line, additionalFields)
+	if !ok {
+		return nil, nil
+	}
+	if !m.sampled() {
+		return &Match{Unsampled: true}, nil
+	}
 	searchResult, err := m.regex.Search(line)
 	if err != nil {
-		return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
+		return nil, fmt.Errorf("error processing metric %v: %w", m.Name(), err)
 	}
 	defer searchResult.Free()
 	if searchResult.IsMatch() {
-		floatVal, err := floatValue(m.Name(), searchResult, m.valueTemplate, additionalFields)
+		stringVal, err := stringValue(m.Name(), m.regex, searchResult, m.valueTemplate, additionalFields)
 		if err != nil {
 			return nil, err
 		}
-		labels, err := labelValues(m.Name(), searchResult, m.labelTemplates, additionalFields)
+		floatVal, err := toFloat(stringVal)
 		if err != nil {
 			return nil, err
 		}
-		m.labelValueTracker.Observe(labels)
-		match, err := callback(floatVal, labels)
+		labels, err := labelValues(m.Name(), m.regex, searchResult, m.labelTemplates, additionalFields)
 		if err != nil {
 			return nil, err
 		}
-		if match {
+		labels, denied, drop := m.filterLabelValues(labels)
+		if drop {
 			return &Match{
 				Value:  floatVal,
 				Labels: labels,
+				Denied: true,
+			}, nil
+		}
+		overflow := m.maxSeries > 0 && m.labelValueTracker.Len() >= m.maxSeries && !m.labelValueTracker.Contains(labels)
+		if overflow && m.maxSeriesAction != configuration.MaxSeriesOther {
+			return &Match{
+				Value:    floatVal,
+				Labels:   labels,
+				Overflow: true,
+				Denied:   denied,
+			}, nil
+		}
+		if overflow {
+			labels = otherLabels(labels)
+		}
+		m.labelValueTracker.Observe(labels)
+		match := false
+		for i := 0; i < repeat; i++ {
+			match, err = callback(floatVal, stringVal, labels)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if match {
+			if m.logTimestamps != nil {
+				m.logTimestamps.observe(labels, additionalFields)
+			}
+			return &Match{
+				Value:    floatVal,
+				Labels:   labels,
+				Overflow: overflow,
+				Denied:   denied,
 			}, nil
 		}
 	}
 	return nil, nil
 }
 
+// filterLabelValues replaces the label values that are not allowed by label_values with "other".
+// denied is true if a value was not allowed, and drop is true if the line should not be recorded.
+func (m *metricWithLabels) filterLabelValues(labels map[string]string) (result map[string]string, denied, drop bool) {
+	result = labels
+	for name, filter := range m.labelValueFilters {
+		if filter.allowed(labels[name]) {
+			continue
+		}
+		if filter.drop {
+			return labels, true, true
+		}
+		if !denied {
+			result = make(map[string]string, len(labels))
+			for n, v := range labels {
+				result[n] = v
+			}
+			denied = true
+		}
+		result[name] = configuration.LabelValuesOther
+	}
+	return result, denied, false
+}
+
+func (f labelValueFilter) allowed(value string) bool {
+	if f.allow != nil {
+		return f.allow[value]
+	}
+	return !f.deny[value]
+}
+
+// otherLabels replaces all label values with "other", for lines exceeding max_series with max_series_action: other.
+func otherLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for name := range labels {
+		result[name] = configuration.MaxSeriesOther
+	}
+	return result
+}
+
+func (m *metric) Captures(line string, additionalFields map[string]interface{}) (map[string]string, error) {
+	line, ok := m.matchInput(line, additionalFields)
+	if !ok {
+		return nil, nil
+	}
+	searchResult, err := m.regex.Search(line)
+	if err != nil {
+		return nil, fmt.Errorf("error processing metric %v: %w", m.Name(), err)
+	}
+	defer searchResult.Free()
+	if !searchResult.IsMatch() {
+		return nil, nil
+	}
+	result := make(map[string]string)
+	for _, name := range m.regex.CaptureGroupNames() {
+		result[name], err = searchResult.GetCaptureGroupByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
+		}
+	}
+	return result, nil
+}
+
 func (m *metric) ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
 	if m.deleteRegex == nil {
 		return nil, nil
@@ -224,24 +530,32 @@ func (m *metric) ProcessDeleteMatch(line string, additionalFields map[string]int
 	return nil, fmt.Errorf("error processing metric %v: delete_match is currently only supported for metrics with labels.", m.Name())
 }
 
-func (m *metric) ProcessRetention() error {
+func (m *metric) ProcessRetention() (int, error) {
 	if m.retention == 0 {
-		return nil
+		return 0, nil
 	}
-	return fmt.Errorf("error processing metric %v: retention is currently only supported for metrics with labels.", m.Name())
+	return 0, fmt.Errorf("error processing metric %v: retention is currently only supported for metrics with labels.", m.Name())
+}
+
+func (m *metric) DeleteSeries(labels map[string]string) (int, error) {
+	return 0, fmt.Errorf("error deleting time series of metric %v: deleting is currently only supported for metrics with labels.", m.Name())
 }
 
 func (m *metricWithLabels) processDeleteMatch(line string, vec deleterMetric, additionalFields map[string]interface{}) (*Match, error) {
 	if m.deleteRegex == nil {
 		return nil, nil
 	}
+	line, ok := m.matchInput(line, additionalFields)
+	if !ok {
+		return nil, nil
+	}
 	searchResult, err := m.deleteRegex.Search(line)
 	if err != nil {
-		return nil, fmt.Errorf("error processing metric %v: %v", m.name, err.Error())
+		return nil, fmt.Errorf("error processing metric %v: %w", m.name, err)
 	}
 	defer searchResult.Free()
 	if searchResult.IsMatch() {
-		deleteLabels, err := labelValues(m.Name(), searchResult, m.deleteLabelTemplates, additionalFields)
+		deleteLabels, err := labelValues(m.Name(), m.deleteRegex, searchResult, m.deleteLabelTemplates, additionalFields)
 		if err != nil {
 			return nil, err
 		}
@@ -260,82 +574,139 @@ func (m *metricWithLabels) processDeleteMatch(line string, vec deleterMetric, ad
 	}
 }
 
-func (m *metricWithLabels) processRetention(vec deleterMetric) error {
-	if m.retention != 0 {
-		for _, label := range m.labelValueTracker.DeleteByRetention(m.retention) {
-			vec.Delete(label)
-		}
+func (m *metricWithLabels) processRetention(vec deleterMetric) (int, error) {
+	if m.retention == 0 {
+		return 0, nil
+	}
+	expired := m.labelValueTracker.DeleteByRetention(m.retention)
+	for _, label := range expired {
+		vec.Delete(label)
+	}
+	return len(expired), nil
+}
+
+func (m *metricWithLabels) deleteSeries(labels map[string]string, vec deleterMetric) (int, error) {
+	matchingLabels, err := m.labelValueTracker.DeleteByLabels(labels)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting time series of metric %v: %v", m.Name(), err)
 	}
-	return nil
+	for _, matchingLabel := range matchingLabels {
+		vec.Delete(matchingLabel)
+	}
+	return len(matchingLabels), nil
 }
 
 func (m *counterMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processMatch(line, func(value float64) (bool, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *counterMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64) (bool, error) {
 		if value < 0 {
 			return false, fmt.Errorf("Negative value with metric counter")
 		}
-		m.counter.Add(value)
+		if m.lastTotals != nil {
+			m.counter.Add(m.lastTotals.increase(nil, value))
+			return true, nil
+		}
+		m.counter.Add(m.scaled(value))
 		return true, nil
 	})
 }
 
 func (m *counterVecMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processMatch(line, additionalFields, func(value float64, labels map[string]string) (bool, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *counterVecMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64, labels map[string]string) (bool, error) {
 		if value < 0 {
 			return false, fmt.Errorf("Negative value with metric counter")
 		}
-		m.counterVec.With(labels).Add(value)
+		if m.lastTotals != nil {
+			m.counterVec.With(labels).Add(m.lastTotals.increase(labels, value))
+			return true, nil
+		}
+		m.counterVec.With(labels).Add(m.scaled(value))
 		return true, nil
 	})
 }
 
 func (m *counterVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processDeleteMatch(line, m.counterVec, additionalFields)
+	return m.processDeleteMatch(line, m.lastTotals.deleter(m.counterVec), additionalFields)
+}
+
+func (m *counterVecMetric) ProcessRetention() (int, error) {
+	return m.processRetention(m.lastTotals.deleter(m.counterVec))
 }
 
-func (m *counterVecMetric) ProcessRetention() error {
-	return m.processRetention(m.counterVec)
+func (m *counterVecMetric) DeleteSeries(labels map[string]string) (int, error) {
+	return m.deleteSeries(labels, m.lastTotals.deleter(m.counterVec))
 }
 
 func (m *gaugeMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processMatch(line, func(value float64) (bool, error) {
-		if m.cumulative {
-			m.gauge.Add(value)
-		} else {
-			m.gauge.Set(value)
-		}
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *gaugeMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64) (bool, error) {
+		m.updateGauge(m.gauge, m.operation, value)
 		return true, nil
 	})
 }
 
 func (m *gaugeVecMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processMatch(line, additionalFields, func(value float64, labels map[string]string) (bool, error) {
-		if m.cumulative {
-			m.gaugeVec.With(labels).Add(value)
-		} else {
-			m.gaugeVec.With(labels).Set(value)
-		}
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *gaugeVecMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64, labels map[string]string) (bool, error) {
+		m.updateGauge(m.gaugeVec.With(labels), m.operation, value)
 		return true, nil
 	})
 }
 
+// updateGauge applies the metrics.operation with the value to the gauge.
+func (m *metric) updateGauge(gauge prometheus.Gauge, operation string, value float64) {
+	switch operation {
+	case configuration.GaugeInc, configuration.GaugeAdd:
+		gauge.Add(m.scaled(value))
+	case configuration.GaugeDec, configuration.GaugeSub:
+		gauge.Sub(m.scaled(value))
+	default:
+		gauge.Set(value)
+	}
+}
+
 func (m *gaugeVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
 	return m.processDeleteMatch(line, m.gaugeVec, additionalFields)
 }
 
-func (m *gaugeVecMetric) ProcessRetention() error {
+func (m *gaugeVecMetric) ProcessRetention() (int, error) {
 	return m.processRetention(m.gaugeVec)
 }
 
+func (m *gaugeVecMetric) DeleteSeries(labels map[string]string) (int, error) {
+	return m.deleteSeries(labels, m.gaugeVec)
+}
+
 func (m *histogramMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processMatch(line, func(value float64) (bool, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *histogramMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64) (bool, error) {
 		m.histogram.Observe(value)
 		return true, nil
 	})
 }
 
 func (m *histogramVecMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processMatch(line, additionalFields, func(value float64, labels map[string]string) (bool, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *histogramVecMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64, labels map[string]string) (bool, error) {
 		m.histogramVec.With(labels).Observe(value)
 		return true, nil
 	})
@@ -345,19 +716,31 @@ func (m *histogramVecMetric) ProcessDeleteMatch(line string, additionalFields ma
 	return m.processDeleteMatch(line, m.histogramVec, additionalFields)
 }
 
-func (m *histogramVecMetric) ProcessRetention() error {
+func (m *histogramVecMetric) ProcessRetention() (int, error) {
 	return m.processRetention(m.histogramVec)
 }
 
+func (m *histogramVecMetric) DeleteSeries(labels map[string]string) (int, error) {
+	return m.deleteSeries(labels, m.histogramVec)
+}
+
 func (m *summaryMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processMatch(line, func(value float64) (bool, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *summaryMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64) (bool, error) {
 		m.summary.Observe(value)
 		return true, nil
 	})
 }
 
 func (m *summaryVecMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
-	return m.processMatch(line, additionalFields, func(value float64, labels map[string]string) (bool, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *summaryVecMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64, labels map[string]string) (bool, error) {
 		m.summaryVec.With(labels).Observe(value)
 		return true, nil
 	})
@@ -367,88 +750,306 @@ func (m *summaryVecMetric) ProcessDeleteMatch(line string, additionalFields map[
 	return m.processDeleteMatch(line, m.summaryVec, additionalFields)
 }
 
-func (m *summaryVecMetric) ProcessRetention() error {
+func (m *summaryVecMetric) ProcessRetention() (int, error) {
 	return m.processRetention(m.summaryVec)
 }
 
-func newMetric(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) metric {
-	return metric{
+func (m *summaryVecMetric) DeleteSeries(labels map[string]string) (int, error) {
+	return m.deleteSeries(labels, m.summaryVec)
+}
+
+func (m *distinctMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *distinctMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processValueMatch(line, additionalFields, repeat, distinctMatchValue, func(_ float64, value string) (bool, error) {
+		m.distinct.add(nil, value)
+		return true, nil
+	})
+}
+
+func (m *distinctVecMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *distinctVecMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processValueMatch(line, additionalFields, repeat, distinctMatchValue, func(_ float64, value string, labels map[string]string) (bool, error) {
+		m.distinctVec.add(labels, value)
+		return true, nil
+	})
+}
+
+func (m *distinctVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.processDeleteMatch(line, m.distinctVec, additionalFields)
+}
+
+func (m *distinctVecMetric) ProcessRetention() (int, error) {
+	return m.processRetention(m.distinctVec)
+}
+
+func (m *distinctVecMetric) DeleteSeries(labels map[string]string) (int, error) {
+	return m.deleteSeries(labels, m.distinctVec)
+}
+
+// distinctMatchValue is the Match's Value for distinct metrics. The value template of a distinct metric is
+// the value to be counted, like a client IP address, so it is not a number.
+func distinctMatchValue(string) (float64, error) {
+	return 0, nil
+}
+
+func (m *aggregateMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *aggregateMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64) (bool, error) {
+		m.aggregate.observe(nil, value)
+		return true, nil
+	})
+}
+
+func (m *aggregateVecMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *aggregateVecMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64, labels map[string]string) (bool, error) {
+		m.aggregateVec.observe(labels, value)
+		return true, nil
+	})
+}
+
+func (m *aggregateVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.processDeleteMatch(line, m.aggregateVec, additionalFields)
+}
+
+func (m *aggregateVecMetric) ProcessRetention() (int, error) {
+	return m.processRetention(m.aggregateVec)
+}
+
+func (m *aggregateVecMetric) DeleteSeries(labels map[string]string) (int, error) {
+	return m.deleteSeries(labels, m.aggregateVec)
+}
+
+func (m *quantileMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *quantileMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64) (bool, error) {
+		m.quantile.observe(nil, value)
+		return true, nil
+	})
+}
+
+func (m *quantileVecMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *quantileVecMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64, labels map[string]string) (bool, error) {
+		m.quantileVec.observe(labels, value)
+		return true, nil
+	})
+}
+
+func (m *quantileVecMetric) ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.processDeleteMatch(line, m.quantileVec, additionalFields)
+}
+
+func (m *quantileVecMetric) ProcessRetention() (int, error) {
+	return m.processRetention(m.quantileVec)
+}
+
+func (m *quantileVecMetric) DeleteSeries(labels map[string]string) (int, error) {
+	return m.deleteSeries(labels, m.quantileVec)
+}
+
+func (m *infoMetric) ProcessMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.ProcessRepeatedMatch(line, additionalFields, 1)
+}
+
+func (m *infoMetric) ProcessRepeatedMatch(line string, additionalFields map[string]interface{}, repeat int) (*Match, error) {
+	return m.processMatch(line, additionalFields, repeat, func(value float64, labels map[string]string) (bool, error) {
+		if key := labelsKey(labels); key != m.current {
+			// The labels changed, like the version in a startup message, so the previous time series is replaced.
+			m.gaugeVec.Reset()
+			_, err := m.labelValueTracker.DeleteByLabels(map[string]string{})
+			if err != nil {
+				return false, err
+			}
+			m.labelValueTracker.Observe(labels)
+			m.current = key
+		}
+		m.gaugeVec.With(labels).Set(value)
+		return true, nil
+	})
+}
+
+func (m *infoMetric) ProcessDeleteMatch(line string, additionalFields map[string]interface{}) (*Match, error) {
+	return m.processDeleteMatch(line, m.gaugeVec, additionalFields)
+}
+
+func (m *infoMetric) ProcessRetention() (int, error) {
+	return m.processRetention(m.gaugeVec)
+}
+
+func (m *infoMetric) DeleteSeries(labels map[string]string) (int, error) {
+	n, err := m.deleteSeries(labels, m.gaugeVec)
+	if n > 0 {
+		m.current = "" // the next matching line creates the time series again
+	}
+	return n, err
+}
+
+func newMetric(cfg *configuration.MetricConfig, regex, deleteRegex Regex) metric {
+	var matchField []string
+	if len(cfg.MatchField) > 0 {
+		matchField = strings.Split(cfg.MatchField, ".")
+	}
+	result := metric{
 		name:        cfg.Name,
 		globs:       cfg.Globs,
+		sources:     cfg.Sources,
 		regex:       regex,
 		deleteRegex: deleteRegex,
+		matchField:  matchField,
+		grokField:   cfg.MatchGrokField,
 		retention:   cfg.Retention,
 	}
+	if cfg.SampleRate > 0 && cfg.SampleRate < 1 {
+		result.sampleRate = cfg.SampleRate
+		result.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if cfg.UseLogTimestamp {
+		result.logTimestamps = newLogTimestamps(prometheusLabels(cfg.LabelTemplates))
+	}
+	return result
 }
 
-func newMetricWithLabels(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) metricWithLabels {
+func newMetricWithLabels(cfg *configuration.MetricConfig, regex, deleteRegex Regex) metricWithLabels {
 	return metricWithLabels{
 		metric:               newMetric(cfg, regex, deleteRegex),
 		labelTemplates:       cfg.LabelTemplates,
 		deleteLabelTemplates: cfg.DeleteLabelTemplates,
 		labelValueTracker:    NewLabelValueTracker(prometheusLabels(cfg.LabelTemplates)),
+		maxSeries:            cfg.MaxSeries,
+		maxSeriesAction:      cfg.MaxSeriesAction,
+		labelValueFilters:    newLabelValueFilters(cfg.LabelValues),
+	}
+}
+
+func newLabelValueFilters(cfg map[string]configuration.LabelValuesConfig) map[string]labelValueFilter {
+	if len(cfg) == 0 {
+		return nil
+	}
+	result := make(map[string]labelValueFilter, len(cfg))
+	for name, labelValues := range cfg {
+		filter := labelValueFilter{
+			deny: make(map[string]bool, len(labelValues.Deny)),
+			drop: labelValues.Action == configuration.LabelValuesDrop,
+		}
+		if len(labelValues.Allow) > 0 {
+			filter.allow = make(map[string]bool, len(labelValues.Allow))
+		}
+		for _, value := range labelValues.Allow {
+			filter.allow[value] = true
+		}
+		for _, value := range labelValues.Deny {
+			filter.deny[value] = true
+		}
+		result[name] = filter
 	}
+	return result
 }
 
-func newObserveMetric(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) observeMetric {
+func newObserveMetric(cfg *configuration.MetricConfig, regex, deleteRegex Regex) observeMetric {
 	return observeMetric{
 		metric:        newMetric(cfg, regex, deleteRegex),
 		valueTemplate: cfg.ValueTemplate,
 	}
 }
 
-func newObserveMetricWithLabels(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) observeMetricWithLabels {
+func newObserveMetricWithLabels(cfg *configuration.MetricConfig, regex, deleteRegex Regex) observeMetricWithLabels {
 	return observeMetricWithLabels{
 		metricWithLabels: newMetricWithLabels(cfg, regex, deleteRegex),
 		valueTemplate:    cfg.ValueTemplate,
 	}
 }
 
-func NewCounterMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewCounterMetric(cfg *configuration.MetricConfig, regex Regex, deleteRegex Regex) Metric {
 	counterOpts := prometheus.CounterOpts{
-		Name: cfg.Name,
-		Help: cfg.Help,
+		Name:        cfg.Name,
+		Help:        cfg.Help,
+		ConstLabels: cfg.ConstLabels,
+	}
+	var totals *lastTotals
+	if cfg.ValueIsTotal {
+		totals = newLastTotals()
 	}
 	if len(cfg.Labels) == 0 {
 		return &counterMetric{
 			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
 			counter:       prometheus.NewCounter(counterOpts),
+			lastTotals:    totals,
 		}
 	} else {
 		return &counterVecMetric{
 			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
 			counterVec:              prometheus.NewCounterVec(counterOpts, prometheusLabels(cfg.LabelTemplates)),
+			lastTotals:              totals,
 		}
 	}
 }
 
-func NewGaugeMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewGaugeMetric(cfg *configuration.MetricConfig, regex Regex, deleteRegex Regex) Metric {
 	gaugeOpts := prometheus.GaugeOpts{
-		Name: cfg.Name,
-		Help: cfg.Help,
+		Name:        cfg.Name,
+		Help:        cfg.Help,
+		ConstLabels: cfg.ConstLabels,
 	}
 	if len(cfg.Labels) == 0 {
 		return &gaugeMetric{
 			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
-			cumulative:    cfg.Cumulative,
+			operation:     gaugeOperation(cfg),
 			gauge:         prometheus.NewGauge(gaugeOpts),
 		}
 	} else {
 		return &gaugeVecMetric{
 			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
-			cumulative:              cfg.Cumulative,
+			operation:               gaugeOperation(cfg),
 			gaugeVec:                prometheus.NewGaugeVec(gaugeOpts, prometheusLabels(cfg.LabelTemplates)),
 		}
 	}
 }
 
-func NewHistogramMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+// gaugeOperation returns the metrics.operation, where empty means set, or add if metrics.cumulative is true.
+func gaugeOperation(cfg *configuration.MetricConfig) string {
+	switch {
+	case len(cfg.Operation) > 0:
+		return cfg.Operation
+	case cfg.Cumulative:
+		return configuration.GaugeAdd
+	default:
+		return configuration.GaugeSet
+	}
+}
+
+func NewHistogramMetric(cfg *configuration.MetricConfig, regex Regex, deleteRegex Regex) Metric {
 	histogramOpts := prometheus.HistogramOpts{
-		Name: cfg.Name,
-		Help: cfg.Help,
+		Name:                        cfg.Name,
+		Help:                        cfg.Help,
+		ConstLabels:                 cfg.ConstLabels,
+		NativeHistogramBucketFactor: cfg.NativeBucketFactor,
 	}
-	if len(cfg.Buckets) > 0 {
+	switch {
+	case len(cfg.Buckets) > 0:
 		histogramOpts.Buckets = cfg.Buckets
+	case cfg.ExponentialBuckets != nil:
+		histogramOpts.Buckets = prometheus.ExponentialBuckets(cfg.ExponentialBuckets.Start, cfg.ExponentialBuckets.Factor, cfg.ExponentialBuckets.Count)
+	case cfg.LinearBuckets != nil:
+		histogramOpts.Buckets = prometheus.LinearBuckets(cfg.LinearBuckets.Start, cfg.LinearBuckets.Width, cfg.LinearBuckets.Count)
 	}
 	if len(cfg.Labels) == 0 {
 		return &histogramMetric{
@@ -463,10 +1064,11 @@ func NewHistogramMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex,
 	}
 }
 
-func NewSummaryMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewSummaryMetric(cfg *configuration.MetricConfig, regex Regex, deleteRegex Regex) Metric {
 	summaryOpts := prometheus.SummaryOpts{
-		Name: cfg.Name,
-		Help: cfg.Help,
+		Name:        cfg.Name,
+		Help:        cfg.Help,
+		ConstLabels: cfg.ConstLabels,
 	}
 	if len(cfg.Quantiles) > 0 {
 		summaryOpts.Objectives = cfg.Quantiles
@@ -474,6 +1076,9 @@ func NewSummaryMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, d
 	if cfg.MaxAge != 0 {
 		summaryOpts.MaxAge = cfg.MaxAge
 	}
+	if cfg.AgeBuckets != 0 {
+		summaryOpts.AgeBuckets = uint32(cfg.AgeBuckets)
+	}
 	if len(cfg.Labels) == 0 {
 		return &summaryMetric{
 			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
@@ -487,10 +1092,79 @@ func NewSummaryMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, d
 	}
 }
 
-func labelValues(metricName string, searchResult *oniguruma.SearchResult, templates []template.Template, additionalFields map[string]interface{}) (map[string]string, error) {
+func NewDistinctMetric(cfg *configuration.MetricConfig, regex Regex, deleteRegex Regex) Metric {
+	opts := prometheus.Opts{
+		Name:        cfg.Name,
+		Help:        cfg.Help,
+		ConstLabels: cfg.ConstLabels,
+	}
+	if len(cfg.Labels) == 0 {
+		return &distinctMetric{
+			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
+			distinct:      newDistinctCollector(opts, nil, cfg.MaxAge, cfg.AgeBuckets),
+		}
+	} else {
+		return &distinctVecMetric{
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
+			distinctVec:             newDistinctCollector(opts, prometheusLabels(cfg.LabelTemplates), cfg.MaxAge, cfg.AgeBuckets),
+		}
+	}
+}
+
+func NewAggregateMetric(cfg *configuration.MetricConfig, regex Regex, deleteRegex Regex) Metric {
+	opts := prometheus.Opts{
+		Name:        cfg.Name,
+		Help:        cfg.Help,
+		ConstLabels: cfg.ConstLabels,
+	}
+	if len(cfg.Labels) == 0 {
+		return &aggregateMetric{
+			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
+			aggregate:     newAggregateCollector(opts, nil, cfg.MaxAge, cfg.AgeBuckets),
+		}
+	} else {
+		return &aggregateVecMetric{
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
+			aggregateVec:            newAggregateCollector(opts, prometheusLabels(cfg.LabelTemplates), cfg.MaxAge, cfg.AgeBuckets),
+		}
+	}
+}
+
+func NewQuantileMetric(cfg *configuration.MetricConfig, regex Regex, deleteRegex Regex) Metric {
+	opts := prometheus.Opts{
+		Name:        cfg.Name,
+		Help:        cfg.Help,
+		ConstLabels: cfg.ConstLabels,
+	}
+	if len(cfg.Labels) == 0 {
+		return &quantileMetric{
+			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
+			quantile:      newQuantileCollector(opts, nil, cfg.MaxAge, cfg.AgeBuckets, cfg.Quantiles),
+		}
+	} else {
+		return &quantileVecMetric{
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
+			quantileVec:             newQuantileCollector(opts, prometheusLabels(cfg.LabelTemplates), cfg.MaxAge, cfg.AgeBuckets, cfg.Quantiles),
+		}
+	}
+}
+
+func NewInfoMetric(cfg *configuration.MetricConfig, regex Regex, deleteRegex Regex) Metric {
+	gaugeOpts := prometheus.GaugeOpts{
+		Name:        cfg.Name,
+		Help:        cfg.Help,
+		ConstLabels: cfg.ConstLabels,
+	}
+	return &infoMetric{
+		observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
+		gaugeVec:                prometheus.NewGaugeVec(gaugeOpts, prometheusLabels(cfg.LabelTemplates)),
+	}
+}
+
+func labelValues(metricName string, regex Regex, searchResult SearchResult, templates []template.Template, additionalFields map[string]interface{}) (map[string]string, error) {
 	result := make(map[string]string, len(templates))
 	for _, t := range templates {
-		value, err := evalTemplate(searchResult, t, additionalFields)
+		value, err := evalTemplate(regex, searchResult, t, additionalFields)
 		if err != nil {
 			return nil, fmt.Errorf("error processing metric %v: %v", metricName, err.Error())
 		}
@@ -499,32 +1173,41 @@ func labelValues(metricName string, searchResult *oniguruma.SearchResult, templa
 	return result, nil
 }
 
-func floatValue(metricName string, searchResult *oniguruma.SearchResult, valueTemplate template.Template, additionalFields map[string]interface{}) (float64, error) {
-	stringVal, err := evalTemplate(searchResult, valueTemplate, additionalFields)
+func stringValue(metricName string, regex Regex, searchResult SearchResult, valueTemplate template.Template, additionalFields map[string]interface{}) (string, error) {
+	stringVal, err := evalTemplate(regex, searchResult, valueTemplate, additionalFields)
 	if err != nil {
-		return 0, fmt.Errorf("error processing metric %v: %v", metricName, err.Error())
+		return "", fmt.Errorf("error processing metric %v: %v", metricName, err.Error())
 	}
+	return stringVal, nil
+}
+
+func (m *metric) parseValue(stringVal string) (float64, error) {
 	floatVal, err := strconv.ParseFloat(stringVal, 64)
 	if err != nil {
-		return 0, fmt.Errorf("error processing metric %v: value matches '%v', which is not a valid number", metricName, stringVal)
+		return 0, fmt.Errorf("error processing metric %v: value matches '%v', which is not a valid number", m.Name(), stringVal)
 	}
 	return floatVal, nil
 }
 
-func evalTemplate(searchResult *oniguruma.SearchResult, t template.Template, additionalFields map[string]interface{}) (string, error) {
+func evalTemplate(regex Regex, searchResult SearchResult, t template.Template, additionalFields map[string]interface{}) (string, error) {
 	var (
 		values = make(map[string]interface{}, len(t.ReferencedGrokFields()))
 		value  interface{}
+		group  string
 		ok     bool
 		err    error
 		field  string
 	)
 	for _, field = range t.ReferencedGrokFields() {
 		if value, ok = additionalFields[field]; !ok {
-			value, err = searchResult.GetCaptureGroupByName(field)
+			group, err = searchResult.GetCaptureGroupByName(field)
 			if err != nil {
 				return "", err
 			}
+			value, err = convertCapture(group, regex.CaptureType(field))
+			if err != nil {
+				return "", fmt.Errorf("grok field %v: %v", field, err)
+			}
 		}
 		values[field] = value
 	}
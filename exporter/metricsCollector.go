@@ -0,0 +1,52 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+// metricsCollector collects the configured metrics, which are replaced when the config is reloaded.
+// It is an unchecked collector, i.e. it doesn't describe the metrics, because the registry doesn't allow
+// a metric name to be registered again with a different help text or different labels.
+type metricsCollector struct {
+	mutex   sync.Mutex
+	metrics []Metric
+}
+
+func NewMetricsCollector(metrics []Metric) *metricsCollector {
+	return &metricsCollector{
+		metrics: metrics,
+	}
+}
+
+// SetMetrics replaces the collected metrics. Metrics that are not in the new list are no longer exported.
+func (c *metricsCollector) SetMetrics(metrics []Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.metrics = metrics
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	metrics := c.metrics
+	c.mutex.Unlock()
+	for _, m := range metrics {
+		m.Collector().Collect(ch)
+	}
+}
@@ -15,12 +15,15 @@
 package exporter
 
 import (
+	"encoding/json"
 	configuration "github.com/fstab/grok_exporter/config/v3"
-	"github.com/fstab/grok_exporter/oniguruma"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_model/go"
+	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCounterVec(t *testing.T) {
@@ -53,6 +56,206 @@ func TestCounterVec(t *testing.T) {
 	}
 }
 
+func TestCounterVecRetention(t *testing.T) {
+	regex := initCounterRegex(t)
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name: "exim_rejected_rcpt_total",
+		Labels: map[string]string{
+			"error_message": "{{.message}}",
+		},
+		Retention: 50 * time.Millisecond,
+	})
+	counter := NewCounterMetric(counterCfg, regex, nil)
+	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted", nil)
+	time.Sleep(100 * time.Millisecond)
+	counter.ProcessMatch("2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address", nil)
+
+	nExpired, err := counter.ProcessRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nExpired != 1 {
+		t.Fatalf("Expected 1 expired label value, but got %v.", nExpired)
+	}
+	ch := make(chan prometheus.Metric, 10)
+	counter.Collector().Collect(ch)
+	close(ch)
+	if len(ch) != 1 {
+		t.Fatalf("Expected 1 remaining time series, but got %v.", len(ch))
+	}
+	m := io_prometheus_client.Metric{}
+	(<-ch).Write(&m)
+	if m.Label[0].GetValue() != "Unrouteable address" {
+		t.Errorf("Expected the 'Unrouteable address' time series to remain, but got %v.", m.Label[0].GetValue())
+	}
+}
+
+func TestCounterVecMaxSeries(t *testing.T) {
+	regex := initCounterRegex(t)
+	lines := []string{
+		"2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted",
+		"2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address",
+		"2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted",
+	}
+	for _, data := range []struct {
+		action   string
+		expected map[string]float64
+	}{
+		{action: "", expected: map[string]float64{"relay not permitted": 2}},
+		{action: "other", expected: map[string]float64{"relay not permitted": 2, "other": 1}},
+	} {
+		counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+			Name: "exim_rejected_rcpt_total",
+			Labels: map[string]string{
+				"error_message": "{{.message}}",
+			},
+			MaxSeries:       1,
+			MaxSeriesAction: data.action,
+		})
+		counter := NewCounterMetric(counterCfg, regex, nil)
+		nOverflow := 0
+		for _, line := range lines {
+			match, err := counter.ProcessMatch(line, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match == nil {
+				t.Fatalf("max_series_action %q: Expected %v to match.", data.action, line)
+			}
+			if match.Overflow {
+				nOverflow++
+			}
+		}
+		if nOverflow != 1 {
+			t.Errorf("max_series_action %q: Expected 1 overflow, but got %v.", data.action, nOverflow)
+		}
+		ch := make(chan prometheus.Metric, 10)
+		counter.Collector().Collect(ch)
+		close(ch)
+		if len(ch) != len(data.expected) {
+			t.Fatalf("max_series_action %q: Expected %v time series, but got %v.", data.action, len(data.expected), len(ch))
+		}
+		for collected := range ch {
+			m := io_prometheus_client.Metric{}
+			collected.Write(&m)
+			if expected, ok := data.expected[m.Label[0].GetValue()]; !ok || *m.Counter.Value != expected {
+				t.Errorf("max_series_action %q: Unexpected time series %v with value %v.", data.action, m.Label[0].GetValue(), *m.Counter.Value)
+			}
+		}
+	}
+}
+
+func TestCounterVecLabelValues(t *testing.T) {
+	regex := initCounterRegex(t)
+	lines := []string{
+		"2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted",
+		"2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address",
+		"2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted",
+	}
+	for _, data := range []struct {
+		labelValues configuration.LabelValuesConfig
+		expected    map[string]float64
+	}{
+		{labelValues: configuration.LabelValuesConfig{Allow: []string{"relay not permitted"}}, expected: map[string]float64{"relay not permitted": 2, "other": 1}},
+		{labelValues: configuration.LabelValuesConfig{Deny: []string{"relay not permitted"}}, expected: map[string]float64{"Unrouteable address": 1, "other": 2}},
+		{labelValues: configuration.LabelValuesConfig{Deny: []string{"relay not permitted"}, Action: "drop"}, expected: map[string]float64{"Unrouteable address": 1}},
+	} {
+		counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+			Name: "exim_rejected_rcpt_total",
+			Labels: map[string]string{
+				"error_message": "{{.message}}",
+			},
+			LabelValues: map[string]configuration.LabelValuesConfig{
+				"error_message": data.labelValues,
+			},
+		})
+		counter := NewCounterMetric(counterCfg, regex, nil)
+		for _, line := range lines {
+			match, err := counter.ProcessMatch(line, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match == nil {
+				t.Fatalf("%v: Expected %v to match.", data.labelValues, line)
+			}
+		}
+		ch := make(chan prometheus.Metric, 10)
+		counter.Collector().Collect(ch)
+		close(ch)
+		if len(ch) != len(data.expected) {
+			t.Fatalf("%v: Expected %v time series, but got %v.", data.labelValues, len(data.expected), len(ch))
+		}
+		for collected := range ch {
+			m := io_prometheus_client.Metric{}
+			collected.Write(&m)
+			if expected, ok := data.expected[m.Label[0].GetValue()]; !ok || *m.Counter.Value != expected {
+				t.Errorf("%v: Unexpected time series %v with value %v.", data.labelValues, m.Label[0].GetValue(), *m.Counter.Value)
+			}
+		}
+	}
+}
+
+func TestCounterValueIsTotal(t *testing.T) {
+	patterns := loadPatternDir(t)
+	regex, err := Compile("%{WORD:server} total requests served: %{INT:total}", patterns, Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:  "requests_total",
+		Value: "{{.total}}",
+		Labels: map[string]string{
+			"server": "{{.server}}",
+		},
+		ValueIsTotal: true,
+	})
+	counter := NewCounterMetric(counterCfg, regex, nil)
+	for _, line := range []string{
+		"alpha total requests served: 100",
+		"beta total requests served: 7",
+		"alpha total requests served: 150",
+		"alpha total requests served: 150",
+		"alpha total requests served: 20", // restarted
+		"alpha total requests served: 30",
+	} {
+		counter.ProcessMatch(line, nil)
+	}
+	c := counter.Collector().(*prometheus.CounterVec)
+	for server, expected := range map[string]float64{"alpha": 180, "beta": 7} {
+		m := io_prometheus_client.Metric{}
+		c.WithLabelValues(server).Write(&m)
+		if *m.Counter.Value != expected {
+			t.Errorf("Expected %v for server %v, but got %v.", expected, server, *m.Counter.Value)
+		}
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	regex := initGaugeRegex(t)
+	gaugeCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:  "temperature",
+		Value: "{{.temperature}}",
+		Labels: map[string]string{
+			"city": "{{.city}}",
+		},
+		ConstLabels: map[string]string{
+			"unit": "celsius",
+		},
+	})
+	gauge := NewGaugeMetric(gaugeCfg, regex, nil)
+	gauge.ProcessMatch("Temperature in Berlin: 32", nil)
+
+	m := io_prometheus_client.Metric{}
+	gauge.Collector().(*prometheus.GaugeVec).WithLabelValues("Berlin").Write(&m)
+	labels := make(map[string]string)
+	for _, label := range m.Label {
+		labels[label.GetName()] = label.GetValue()
+	}
+	if len(labels) != 2 || labels["city"] != "Berlin" || labels["unit"] != "celsius" {
+		t.Errorf("Expected the labels city=Berlin and unit=celsius, but got %v.", labels)
+	}
+}
+
 func TestCounter(t *testing.T) {
 	regex := initCounterRegex(t)
 	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
@@ -77,6 +280,389 @@ func TestCounter(t *testing.T) {
 	}
 }
 
+func TestCounterDropIfMatch(t *testing.T) {
+	patterns := loadPatternDir(t)
+	drop, err := Compile("F=<%{EMAILADDRESS}> .*: relay not permitted", patterns, Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name: "exim_rejected_rcpt_total",
+		Labels: map[string]string{
+			"error_message": "{{.message}}",
+		},
+	})
+	counter := NewCounterMetric(counterCfg, Exclude(initCounterRegex(t), drop), nil)
+	for _, line := range []string{
+		"2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted",
+		"2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address",
+	} {
+		match, err := counter.ProcessMatch(line, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expectMatch := strings.HasSuffix(line, "Unrouteable address"); (match != nil) != expectMatch {
+			t.Fatalf("%v: expected match %v, but got %v", line, expectMatch, match)
+		}
+	}
+	c := counter.Collector().(*prometheus.CounterVec)
+	m := io_prometheus_client.Metric{}
+	c.WithLabelValues("Unrouteable address").Write(&m)
+	if *m.Counter.Value != float64(1) {
+		t.Errorf("Expected 1 match, but got %v matches.", *m.Counter.Value)
+	}
+}
+
+func TestMatchField(t *testing.T) {
+	regex, err := Compile(`^/api/%{WORD:endpoint}`, loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	histogramCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:       "api_request_bytes",
+		MatchField: "http.path",
+		Value:      "{{.extra.http.bytes}}",
+		Labels: map[string]string{
+			"endpoint": "{{.endpoint}}",
+			"status":   "{{.extra.http.status}}",
+		},
+	})
+	histogram := NewHistogramMetric(histogramCfg, regex, nil)
+	for _, data := range []struct {
+		extra    interface{}
+		expected *Match
+	}{
+		{jsonObject(t, `{"http": {"path": "/api/users", "status": 200, "bytes": 1000000}}`), &Match{Value: 1000000, Labels: map[string]string{"endpoint": "users", "status": "200"}}},
+		{jsonObject(t, `{"http": {"path": "/index.html", "status": 200, "bytes": 10}}`), nil},
+		{jsonObject(t, `{"http": {"status": 404, "bytes": 10}}`), nil},
+		{jsonObject(t, `{"http": "/api/users"}`), nil},
+		{nil, nil},
+	} {
+		match, err := histogram.ProcessMatch("/api/users", map[string]interface{}{"extra": data.extra})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(match, data.expected) {
+			t.Fatalf("%v: expected %v, but got %v", data.extra, data.expected, match)
+		}
+	}
+}
+
+func TestMatchFieldWithoutMatch(t *testing.T) {
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:       "requests_total",
+		MatchField: "path",
+		Labels: map[string]string{
+			"path": "{{.extra.path}}",
+		},
+	})
+	counter := NewCounterMetric(counterCfg, MatchAll(), nil)
+	for _, data := range []struct {
+		extra    interface{}
+		expected *Match
+	}{
+		{map[string]interface{}{"path": "/index.html"}, &Match{Value: 1, Labels: map[string]string{"path": "/index.html"}}},
+		{map[string]interface{}{"status": "200"}, nil},
+	} {
+		match, err := counter.ProcessMatch("/index.html,200", map[string]interface{}{"extra": data.extra})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(match, data.expected) {
+			t.Fatalf("%v: expected %v, but got %v", data.extra, data.expected, match)
+		}
+	}
+}
+
+func TestMatchGrokField(t *testing.T) {
+	regex, err := Compile(`user %{USER:user} logged in`, loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:           "logins_total",
+		MatchGrokField: "message",
+		Labels: map[string]string{
+			"user":    "{{.user}}",
+			"program": "{{.program}}",
+		},
+	}), regex, nil)
+	for _, data := range []struct {
+		captures map[string]interface{}
+		expected *Match
+	}{
+		{map[string]interface{}{"program": "sshd", "message": "user alice logged in"}, &Match{Value: 1, Labels: map[string]string{"user": "alice", "program": "sshd"}}},
+		{map[string]interface{}{"program": "user bob logged in", "message": "connection closed"}, nil},
+		{map[string]interface{}{"program": "sshd", "message": ""}, nil},
+	} {
+		match, err := counter.ProcessMatch("sshd: user carol logged in", data.captures)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(match, data.expected) {
+			t.Fatalf("%v: expected %v, but got %v", data.captures, data.expected, match)
+		}
+	}
+}
+
+func TestTypedCaptureGroups(t *testing.T) {
+	regex, err := Compile(`time=%{INT:response_time_us:int} size=%{NOTSPACE:size:bytes} duration=%{NOTSPACE:duration:duration}`, loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regex.Free()
+	for _, data := range []struct {
+		value, label string
+		line         string
+		expected     *Match
+		expectError  bool
+	}{
+		{"{{divide .response_time_us 1000000}}", "{{.size}}", "time=250000 size=1.5MB duration=1m30s", &Match{Value: 0.25, Labels: map[string]string{"label": "1500000"}}, false},
+		{"{{.duration}}", "{{.response_time_us}}", "time=007 size=1KiB duration=250ms", &Match{Value: 0.25, Labels: map[string]string{"label": "7"}}, false},
+		{"{{.size}}", "{{if gt .response_time_us 1000}}slow{{else}}fast{{end}}", "time=1001 size=2kb duration=1s", &Match{Value: 2000, Labels: map[string]string{"label": "slow"}}, false},
+		{"{{.duration}}", "{{.size}}", "time=3 size=1XB duration=1s", nil, true},
+		{"{{.duration}}", "{{.size}}", "time=3 size=1KB duration=1", nil, true},
+	} {
+		histogram := NewHistogramMetric(newMetricConfig(t, &configuration.MetricConfig{
+			Name:   "response_time_seconds",
+			Value:  data.value,
+			Labels: map[string]string{"label": data.label},
+		}), regex, nil)
+		match, err := histogram.ProcessMatch(data.line, nil)
+		if data.expectError {
+			if err == nil {
+				t.Fatalf("%v: expected error, but got %v", data.line, match)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(match, data.expected) {
+			t.Fatalf("%v: expected %v, but got %v", data.line, data.expected, match)
+		}
+	}
+}
+
+func TestFieldDefaults(t *testing.T) {
+	regex, err := Compile(`%{WORD:method} %{NOTSPACE:path}(?: status=%{INT:status:int})?(?: user=%{USER:user})?`, loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:          "requests_total",
+		FieldDefaults: map[string]string{"status": "0", "user": "anonymous"},
+		Labels: map[string]string{
+			"user":  "{{.user}}",
+			"class": "{{if ge .status 500}}error{{else}}ok{{end}}",
+		},
+	})
+	err = VerifyFieldDefaults(cfg, regex, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := NewCounterMetric(cfg, WithDefaults(regex, cfg.FieldDefaults), nil)
+	for line, expected := range map[string]map[string]string{
+		"GET /index.html status=503 user=alice": {"user": "alice", "class": "error"},
+		"GET /index.html":                       {"user": "anonymous", "class": "ok"},
+	} {
+		match, err := counter.ProcessMatch(line, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match == nil || !reflect.DeepEqual(match.Labels, expected) {
+			t.Fatalf("%v: expected labels %v, but got %v", line, expected, match)
+		}
+	}
+	for _, defaults := range []map[string]string{{"status": "none"}, {"missing": "x"}} {
+		cfg.FieldDefaults = defaults
+		if err = VerifyFieldDefaults(cfg, regex, nil); err == nil {
+			t.Fatalf("%v: expected error", defaults)
+		}
+	}
+}
+
+func TestUseLogTimestamp(t *testing.T) {
+	regex, err := Compile(`%{WORD:level}`, loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regex.Free()
+	counter := NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:            "messages_total",
+		UseLogTimestamp: true,
+		Labels: map[string]string{
+			"level": "{{.level}}",
+		},
+	}), regex, nil)
+	for line, logTime := range map[string]interface{}{
+		"info":  1577872800.5, // 2020-01-01T10:00:00.5Z
+		"error": nil,          // no log time
+	} {
+		_, err = counter.ProcessMatch(line, map[string]interface{}{LogTimeField: logTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(counter.Collector())
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 2 {
+		t.Fatalf("expected one metric with two time series, but got %v", families)
+	}
+	for _, m := range families[0].Metric {
+		switch level := m.Label[0].GetValue(); {
+		case level == "info" && m.GetTimestampMs() != 1577872800500:
+			t.Fatalf("expected timestamp 1577872800500 for %v, but got %v", level, m.GetTimestampMs())
+		case level == "error" && m.TimestampMs != nil:
+			t.Fatalf("expected no timestamp for %v, but got %v", level, m.GetTimestampMs())
+		}
+	}
+}
+
+func TestUseLogTimestampWithConstLabels(t *testing.T) {
+	regex, err := Compile(`%{WORD:level}`, loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regex.Free()
+	counter := NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:            "messages_total",
+		UseLogTimestamp: true,
+		Labels: map[string]string{
+			"level": "{{.level}}",
+		},
+		ConstLabels: map[string]string{
+			"app": "shop",
+		},
+	}), regex, nil)
+	_, err = counter.ProcessMatch("info", map[string]interface{}{LogTimeField: 1577872800.5}) // 2020-01-01T10:00:00.5Z
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(counter.Collector())
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 1 {
+		t.Fatalf("expected one metric with one time series, but got %v", families)
+	}
+	if m := families[0].Metric[0]; len(m.Label) != 2 || m.GetTimestampMs() != 1577872800500 {
+		t.Fatalf("expected labels app and level with timestamp 1577872800500, but got %v with timestamp %v", m.Label, m.GetTimestampMs())
+	}
+}
+
+func TestUseLogTimestampOutOfOrder(t *testing.T) {
+	regex, err := Compile(`%{WORD:level}`, loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regex.Free()
+	counter := NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:            "messages_total",
+		UseLogTimestamp: true,
+	}), regex, nil)
+	for _, logTime := range []float64{
+		1577872800, // 2020-01-01T10:00:00Z
+		1577872860, // 2020-01-01T10:01:00Z
+		1577872830, // 2020-01-01T10:00:30Z, older than the previous line
+	} {
+		_, err = counter.ProcessMatch("info", map[string]interface{}{LogTimeField: logTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(counter.Collector())
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 1 {
+		t.Fatalf("expected one metric with one time series, but got %v", families)
+	}
+	if m := families[0].Metric[0]; m.GetTimestampMs() != 1577872860000 || m.Counter.GetValue() != 3 {
+		t.Fatalf("expected value 3 with timestamp 1577872860000, but got %v with timestamp %v", m.Counter.GetValue(), m.GetTimestampMs())
+	}
+}
+
+func TestMetricsCollector(t *testing.T) {
+	regex, err := Compile(`%{WORD:level}`, loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regex.Free()
+	counter := NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name: "messages_total",
+		Help: "before reload",
+	}), regex, nil)
+	counter.ProcessMatch("info", nil)
+	collector := NewMetricsCollector([]Metric{counter})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	// After a reload, the same metric name may have a different help text and labels.
+	counterWithLabels := NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name: "messages_total",
+		Help: "after reload",
+		Labels: map[string]string{
+			"level": "{{.level}}",
+		},
+	}), regex, nil)
+	for _, expected := range []struct {
+		metrics []Metric
+		help    string
+		labels  int
+	}{
+		{[]Metric{counter}, "before reload", 0},
+		{[]Metric{counterWithLabels}, "after reload", 1},
+	} {
+		collector.SetMetrics(expected.metrics)
+		counterWithLabels.ProcessMatch("info", nil)
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(families) != 1 || families[0].GetHelp() != expected.help || len(families[0].Metric[0].Label) != expected.labels {
+			t.Fatalf("expected metric with help %q and %v labels, but got %v", expected.help, expected.labels, families)
+		}
+	}
+}
+
+func jsonObject(t *testing.T, s string) interface{} {
+	var result map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestSourceMatches(t *testing.T) {
+	regex := initCounterRegex(t)
+	all := NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{Name: "all_total"}), regex, nil)
+	restricted := NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:    "restricted_total",
+		Sources: []string{"exim", "app"},
+	}), regex, nil)
+	for _, inputId := range []string{"", "exim", "nginx"} {
+		if !all.SourceMatches(inputId) {
+			t.Errorf("metric without sources should match input %q", inputId)
+		}
+	}
+	if !restricted.SourceMatches("exim") || !restricted.SourceMatches("app") {
+		t.Errorf("metric should match its sources")
+	}
+	if restricted.SourceMatches("nginx") || restricted.SourceMatches("") {
+		t.Errorf("metric should not match inputs that are not in its sources")
+	}
+}
+
 func TestCounterValue(t *testing.T) {
 	regex := initCumulativeRegex(t)
 	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
@@ -100,6 +686,34 @@ func TestCounterValue(t *testing.T) {
 	}
 }
 
+func TestRepeatedMatch(t *testing.T) {
+	regex := initCumulativeRegex(t)
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:  "rainfall",
+		Value: "{{.rainfall}}",
+	})
+	counter := NewCounterMetric(cfg, regex, nil)
+	histogram := NewHistogramMetric(cfg, regex, nil)
+	for _, metric := range []Metric{counter, histogram} {
+		match, err := metric.ProcessRepeatedMatch("Rainfall in Berlin: 32", nil, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match == nil || match.Value != 32 {
+			t.Fatalf("expected match with value 32, but got %v", match)
+		}
+	}
+	m := io_prometheus_client.Metric{}
+	counter.Collector().(prometheus.Counter).Write(&m)
+	if *m.Counter.Value != float64(96) {
+		t.Errorf("Expected 96 as counter value, but got %v.", *m.Counter.Value)
+	}
+	histogram.Collector().(prometheus.Histogram).Write(&m)
+	if *m.Histogram.SampleCount != 3 || *m.Histogram.SampleSum != float64(96) {
+		t.Errorf("Expected 3 observations with sum 96, but got %v with sum %v.", *m.Histogram.SampleCount, *m.Histogram.SampleSum)
+	}
+}
+
 func TestLogfileLabel(t *testing.T) {
 	regex := initCounterRegex(t)
 	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
@@ -149,13 +763,44 @@ func TestLogfileLabel(t *testing.T) {
 	}
 }
 
-func initCounterRegex(t *testing.T) *oniguruma.Regex {
+func TestCounterSampleRate(t *testing.T) {
+	regex := initCounterRegex(t)
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:       "exim_rejected_rcpt_total",
+		SampleRate: 0.25,
+	})
+	counter := NewCounterMetric(counterCfg, regex, nil)
+	counter.(*counterMetric).random = rand.New(rand.NewSource(1))
+	nMatches := 0
+	for i := 0; i < 4000; i++ {
+		match, err := counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match == nil {
+			t.Fatal("Expected the line to be matched or skipped, but got nil.")
+		}
+		if !match.Unsampled {
+			nMatches++
+		}
+	}
+	if nMatches < 800 || nMatches > 1200 {
+		t.Fatalf("Expected about 1000 of 4000 lines to be sampled, but got %v.", nMatches)
+	}
+	m := io_prometheus_client.Metric{}
+	counter.Collector().(prometheus.Counter).Write(&m)
+	if *m.Counter.Value != float64(4*nMatches) {
+		t.Fatalf("Expected the counter to be scaled to %v, but got %v.", 4*nMatches, *m.Counter.Value)
+	}
+}
+
+func initCounterRegex(t *testing.T) Regex {
 	patterns := loadPatternDir(t)
 	err := patterns.AddPattern("EXIM_MESSAGE [a-zA-Z ]*")
 	if err != nil {
 		t.Error(err)
 	}
-	regex, err := Compile("%{EXIM_DATE} %{EXIM_REMOTE_HOST} F=<%{EMAILADDRESS}> rejected RCPT <%{EMAILADDRESS}>: %{EXIM_MESSAGE:message}", patterns)
+	regex, err := Compile("%{EXIM_DATE} %{EXIM_REMOTE_HOST} F=<%{EMAILADDRESS}> rejected RCPT <%{EMAILADDRESS}>: %{EXIM_MESSAGE:message}", patterns, Oniguruma)
 	if err != nil {
 		t.Error(err)
 	}
@@ -209,6 +854,72 @@ func TestGaugeCumulative(t *testing.T) {
 	}
 }
 
+func TestGaugeOperation(t *testing.T) {
+	patterns := loadPatternDir(t)
+	for _, data := range []struct {
+		operation string
+		value     string
+		expected  float64
+	}{
+		{operation: "set", value: "{{.n}}", expected: 3},
+		{operation: "add", value: "{{.n}}", expected: 15},
+		{operation: "sub", value: "{{.n}}", expected: -15},
+		{operation: "inc", expected: 3},
+		{operation: "dec", expected: -3},
+	} {
+		regex, err := Compile("queue depth %{INT:n}", patterns, Oniguruma)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gaugeCfg := newMetricConfig(t, &configuration.MetricConfig{
+			Name:      "queue_depth",
+			Value:     data.value,
+			Operation: data.operation,
+		})
+		gauge := NewGaugeMetric(gaugeCfg, regex, nil)
+
+		gauge.ProcessMatch("queue depth 7", nil)
+		gauge.ProcessMatch("queue depth 5", nil)
+		gauge.ProcessMatch("queue depth 3", nil)
+
+		m := io_prometheus_client.Metric{}
+		gauge.Collector().(prometheus.Gauge).Write(&m)
+		if *m.Gauge.Value != data.expected {
+			t.Errorf("operation %v: Expected %v as value, but got %v.", data.operation, data.expected, *m.Gauge.Value)
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	regex, err := Compile("starting version %{NOTSPACE:version}", loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := NewInfoMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name: "app_build_info",
+		Labels: map[string]string{
+			"version": "{{.version}}",
+		},
+	}), regex, nil)
+	for _, line := range []string{"starting version 1.2.3", "starting version 1.3.0", "starting version 1.3.0"} {
+		_, err = info.ProcessMatch(line, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ch := make(chan prometheus.Metric, 10)
+	info.Collector().Collect(ch)
+	close(ch)
+	if len(ch) != 1 {
+		t.Fatalf("Expected 1 time series, but got %v.", len(ch))
+	}
+	m := io_prometheus_client.Metric{}
+	(<-ch).Write(&m)
+	if m.Label[0].GetValue() != "1.3.0" || m.Gauge.GetValue() != 1 {
+		t.Errorf("Expected version 1.3.0 with value 1, but got version %v with value %v.", m.Label[0].GetValue(), m.Gauge.GetValue())
+	}
+}
+
 func TestGaugeVec(t *testing.T) {
 	regex := initGaugeRegex(t)
 	gaugeCfg := newMetricConfig(t, &configuration.MetricConfig{
@@ -240,18 +951,123 @@ func TestGaugeVec(t *testing.T) {
 	}
 }
 
-func initGaugeRegex(t *testing.T) *oniguruma.Regex {
+func TestGaugeVecDeleteSeries(t *testing.T) {
+	regex := initGaugeRegex(t)
+	gauge := NewGaugeMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:  "temperature",
+		Value: "{{.temperature}}",
+		Labels: map[string]string{
+			"city": "{{.city}}",
+		},
+	}), regex, nil)
+	for _, line := range []string{"Temperature in Berlin: 32", "Temperature in Moscow: -5", "Temperature in Paris: 25"} {
+		gauge.ProcessMatch(line, nil)
+	}
+	for _, data := range []struct {
+		labels            map[string]string
+		expectedDeleted   int
+		expectedRemaining int
+	}{
+		{map[string]string{"city": "Berlin"}, 1, 2},
+		{map[string]string{"city": "Berlin"}, 0, 2},
+		{map[string]string{}, 2, 0},
+	} {
+		deleted, err := gauge.DeleteSeries(data.labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != data.expectedDeleted {
+			t.Fatalf("%v: Expected %v deleted time series, but got %v.", data.labels, data.expectedDeleted, deleted)
+		}
+		ch := make(chan prometheus.Metric, 10)
+		gauge.Collector().Collect(ch)
+		if len(ch) != data.expectedRemaining {
+			t.Fatalf("%v: Expected %v remaining time series, but got %v.", data.labels, data.expectedRemaining, len(ch))
+		}
+	}
+	_, err := gauge.DeleteSeries(map[string]string{"country": "Germany"})
+	if err == nil {
+		t.Fatal("Expected an error, because the metric has no label country.")
+	}
+}
+
+func initGaugeRegex(t *testing.T) Regex {
 	patterns := loadPatternDir(t)
-	regex, err := Compile("Temperature in %{WORD:city}: %{INT:temperature}", patterns)
+	regex, err := Compile("Temperature in %{WORD:city}: %{INT:temperature}", patterns, Oniguruma)
 	if err != nil {
 		t.Error(err)
 	}
 	return regex
 }
 
-func initCumulativeRegex(t *testing.T) *oniguruma.Regex {
+func TestHistogramGeneratedBuckets(t *testing.T) {
+	regex := initGaugeRegex(t)
+	for _, data := range []struct {
+		cfg      *configuration.MetricConfig
+		expected []float64
+	}{
+		{
+			cfg:      &configuration.MetricConfig{ExponentialBuckets: &configuration.ExponentialBuckets{Start: 1, Factor: 10, Count: 3}},
+			expected: []float64{1, 10, 100},
+		},
+		{
+			cfg:      &configuration.MetricConfig{LinearBuckets: &configuration.LinearBuckets{Start: 10, Width: 5, Count: 4}},
+			expected: []float64{10, 15, 20, 25},
+		},
+	} {
+		data.cfg.Name = "temperature"
+		data.cfg.Value = "{{.temperature}}"
+		histogram := NewHistogramMetric(newMetricConfig(t, data.cfg), regex, nil)
+		histogram.ProcessMatch("Temperature in Berlin: 12", nil)
+
+		m := io_prometheus_client.Metric{}
+		histogram.Collector().(prometheus.Histogram).Write(&m)
+		buckets := m.Histogram.GetBucket()
+		if len(buckets) != len(data.expected) {
+			t.Fatalf("Expected %v buckets, but got %v.", len(data.expected), len(buckets))
+		}
+		for i, bucket := range buckets {
+			if bucket.GetUpperBound() != data.expected[i] {
+				t.Errorf("Expected %v as upper bound of bucket %v, but got %v.", data.expected[i], i, bucket.GetUpperBound())
+			}
+		}
+	}
+}
+
+func TestHistogramNativeBucketFactor(t *testing.T) {
+	regex := initGaugeRegex(t)
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:               "temperature",
+		Value:              "{{.temperature}}",
+		Buckets:            []float64{10, 20},
+		NativeBucketFactor: 1.1,
+	})
+	histogram := NewHistogramMetric(cfg, regex, nil)
+	histogram.ProcessMatch("Temperature in Berlin: 12", nil)
+	histogram.ProcessMatch("Temperature in Berlin: 25", nil)
+
+	m := io_prometheus_client.Metric{}
+	histogram.Collector().(prometheus.Histogram).Write(&m)
+	if len(m.Histogram.GetBucket()) != 2 {
+		t.Fatalf("Expected the 2 classic buckets to be kept, but got %v.", len(m.Histogram.GetBucket()))
+	}
+	if m.Histogram.Schema == nil || len(m.Histogram.GetPositiveSpan()) == 0 {
+		t.Fatalf("Expected a native histogram, but got schema %v and spans %v.", m.Histogram.Schema, m.Histogram.GetPositiveSpan())
+	}
+	// The native bucket counts are delta encoded.
+	var bucketCount, totalCount int64
+	for _, delta := range m.Histogram.GetPositiveDelta() {
+		bucketCount += delta
+		totalCount += bucketCount
+	}
+	if totalCount != 2 {
+		t.Errorf("Expected 2 observations in the native buckets, but got %v.", totalCount)
+	}
+}
+
+func initCumulativeRegex(t *testing.T) Regex {
 	patterns := loadPatternDir(t)
-	regex, err := Compile("Rainfall in %{WORD:city}: %{INT:rainfall}", patterns)
+	regex, err := Compile("Rainfall in %{WORD:city}: %{INT:rainfall}", patterns, Oniguruma)
 	if err != nil {
 		t.Error(err)
 	}
@@ -270,3 +1086,19 @@ func newMetricConfig(t *testing.T, cfg *configuration.MetricConfig) *configurati
 	}
 	return cfg
 }
+
+func TestMetricFree(t *testing.T) {
+	regex := &countingRegex{Regex: initCounterRegex(t)}
+	deleteRegex := &countingRegex{Regex: initCounterRegex(t)}
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name: "exim_rejected_rcpt_total",
+		Labels: map[string]string{
+			"error_message": "{{.message}}",
+		},
+	})
+	counter := NewCounterMetric(counterCfg, regex, deleteRegex)
+	counter.Free()
+	if regex.frees != 1 || deleteRegex.frees != 1 {
+		t.Fatalf("expected the match and delete patterns to be freed once, but got %v and %v", regex.frees, deleteRegex.frees)
+	}
+}
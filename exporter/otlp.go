@@ -0,0 +1,530 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	config "github.com/fstab/grok_exporter/config/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	otlpExportPath      = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpScopeName       = "github.com/fstab/grok_exporter"
+	otlpCumulative      = 2 // AGGREGATION_TEMPORALITY_CUMULATIVE
+	maxGrpcResponseSize = 1 << 20
+)
+
+// grpcCodes are the names of the gRPC status codes, as in the grpc-status trailer.
+var grpcCodes = []string{"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND", "ALREADY_EXISTS",
+	"PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL",
+	"UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED"}
+
+// retryableGrpcCodes are the codes that the OTLP specification considers temporary.
+var retryableGrpcCodes = map[int]bool{1: true, 4: true, 10: true, 11: true, 14: true, 15: true}
+
+// OTLPExporter sends the metrics to an OpenTelemetry OTLP/gRPC receiver, like the OpenTelemetry Collector,
+// so that they can be processed together with other telemetry.
+type OTLPExporter struct {
+	cfg              config.OTLPEndpointConfig
+	gatherer         prometheus.Gatherer
+	client           *http.Client
+	url              string
+	resource         []byte    // the encoded Resource message
+	startTime        time.Time // start_time_unix_nano of the cumulative data points
+	dataPoints       prometheus.Counter
+	failedDataPoints prometheus.Counter
+	stop             chan struct{}
+	stopped          chan struct{}
+	mutex            sync.Mutex       // send() is called by the ticker and by Stop()
+	lastTimestamp    map[string]int64 // data points with a log timestamp are only sent if the timestamp changed, see use_log_timestamp
+	now              func() time.Time // time.Now, except in tests
+}
+
+// partialSuccess is the ExportMetricsPartialSuccess in the response, if the receiver rejected some of the data points.
+type partialSuccess struct {
+	rejectedDataPoints int64
+	errorMessage       string
+}
+
+// NewOTLPExporters creates an OTLPExporter for each endpoint in the otlp section, and registers the counters of the sent and failed data points.
+func NewOTLPExporters(cfg config.OTLPConfig, gatherer prometheus.Gatherer, registry prometheus.Registerer) ([]*OTLPExporter, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	dataPoints := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_otlp_data_points_total",
+		Help: "Number of data points sent to the otlp endpoint.",
+	}, []string{"endpoint"})
+	failedDataPoints := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_otlp_failed_data_points_total",
+		Help: "Number of data points that could not be sent to the otlp endpoint or were rejected by the receiver.",
+	}, []string{"endpoint"})
+	registry.MustRegister(dataPoints)
+	registry.MustRegister(failedDataPoints)
+	result := make([]*OTLPExporter, 0, len(cfg))
+	for _, endpoint := range cfg {
+		client, err := newOTLPClient(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		scheme := "https"
+		if endpoint.Insecure {
+			scheme = "http"
+		}
+		result = append(result, &OTLPExporter{
+			cfg:              endpoint,
+			gatherer:         gatherer,
+			client:           client,
+			url:              scheme + "://" + endpoint.Endpoint + otlpExportPath,
+			resource:         encodeResource(endpoint.ResourceAttributes),
+			startTime:        time.Now(),
+			dataPoints:       dataPoints.WithLabelValues(endpoint.Endpoint),
+			failedDataPoints: failedDataPoints.WithLabelValues(endpoint.Endpoint),
+			stop:             make(chan struct{}),
+			stopped:          make(chan struct{}),
+			lastTimestamp:    make(map[string]int64),
+			now:              time.Now,
+		})
+	}
+	return result, nil
+}
+
+// newOTLPClient creates an HTTP/2 client, because gRPC requires HTTP/2. With insecure: true it uses plaintext HTTP/2
+// with prior knowledge (h2c), like gRPC clients with insecure credentials.
+func newOTLPClient(cfg config.OTLPEndpointConfig) (*http.Client, error) {
+	transport := &http2.Transport{}
+	if cfg.Insecure {
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, cfg.Timeout)
+		}
+	} else {
+		tlsCfg, err := newClientTLSConfig(cfg.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("otlp %v: %v", cfg.Endpoint, err)
+		}
+		transport.TLSClientConfig = tlsCfg
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+	}, nil
+}
+
+// Start sends the metrics every interval until Stop() is called.
+func (e *OTLPExporter) Start() {
+	go func() {
+		defer close(e.stopped)
+		ticker := time.NewTicker(e.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.send(e.stop)
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop sends the metrics a last time, so that the final values are not lost on shutdown or at the end of '-oneshot'.
+// The final send is not retried.
+func (e *OTLPExporter) Stop() {
+	close(e.stop)
+	<-e.stopped
+	e.send(nil)
+}
+
+// send gathers the metrics and sends them in a single request. A failed request is retried until the next interval,
+// the retries are canceled when cancel is closed.
+func (e *OTLPExporter) send(cancel <-chan struct{}) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	metricFamilies, err := e.gatherer.Gather()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: otlp %v: failed to gather metrics: %v\n", e.cfg.Endpoint, err)
+		if len(metricFamilies) == 0 {
+			return
+		}
+	}
+	metrics, n := e.toOTLPMetrics(metricFamilies)
+	if n == 0 {
+		return
+	}
+	request := encodeExportMetricsServiceRequest(e.resource, metrics)
+	var result partialSuccess
+	err = retryWithBackoff(func() (retry bool, err error) {
+		result, retry, err = e.export(request)
+		return retry, err
+	}, e.cfg.RetryOnFailure.InitialInterval, e.cfg.RetryOnFailure.MaxInterval, e.now().Add(e.cfg.Interval), e.now, cancel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: otlp %v: dropping %v data points: %v\n", e.cfg.Endpoint, n, err)
+		e.failedDataPoints.Add(float64(n))
+		return
+	}
+	if result.rejectedDataPoints > 0 || len(result.errorMessage) > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: otlp %v: the receiver rejected %v of %v data points: %v\n", e.cfg.Endpoint, result.rejectedDataPoints, n, result.errorMessage)
+	}
+	if result.rejectedDataPoints > int64(n) {
+		result.rejectedDataPoints = int64(n)
+	}
+	e.failedDataPoints.Add(float64(result.rejectedDataPoints))
+	e.dataPoints.Add(float64(int64(n) - result.rejectedDataPoints))
+}
+
+// toOTLPMetrics converts the metric families to encoded Metric messages, and returns the number of data points.
+// Counters become monotonic cumulative sums, gauges and untyped metrics become gauges, histograms and summaries are
+// converted to their OTLP equivalents. Data points without a log timestamp get the current time.
+func (e *OTLPExporter) toOTLPMetrics(metricFamilies []*io_prometheus_client.MetricFamily) ([][]byte, int) {
+	now := uint64(e.now().UnixNano())
+	start := uint64(e.startTime.UnixNano())
+	n := 0
+	metrics := make([][]byte, 0, len(metricFamilies))
+	lastTimestamp := make(map[string]int64) // only the current series, so that deleted series are removed
+	defer func() {
+		e.lastTimestamp = lastTimestamp
+	}()
+	for _, metricFamily := range metricFamilies {
+		var dataPoints [][]byte
+		for _, m := range metricFamily.Metric {
+			timestamp := now
+			if m.TimestampMs != nil {
+				key := seriesKey(metricFamily.GetName(), m.Label)
+				last, exists := e.lastTimestamp[key]
+				lastTimestamp[key] = m.GetTimestampMs()
+				if exists && last == m.GetTimestampMs() {
+					continue // already sent
+				}
+				timestamp = uint64(m.GetTimestampMs()) * uint64(time.Millisecond)
+			}
+			start := start
+			if timestamp < start {
+				start = 0 // the log line was written before grok_exporter started, like with readall
+			}
+			switch {
+			case m.Counter != nil:
+				dataPoints = append(dataPoints, encodeNumberDataPoint(m.Label, start, timestamp, m.Counter.GetValue()))
+			case m.Gauge != nil:
+				dataPoints = append(dataPoints, encodeNumberDataPoint(m.Label, 0, timestamp, m.Gauge.GetValue()))
+			case m.Untyped != nil:
+				dataPoints = append(dataPoints, encodeNumberDataPoint(m.Label, 0, timestamp, m.Untyped.GetValue()))
+			case m.Histogram != nil:
+				dataPoints = append(dataPoints, encodeHistogramDataPoint(m.Label, start, timestamp, m.Histogram))
+			case m.Summary != nil:
+				dataPoints = append(dataPoints, encodeSummaryDataPoint(m.Label, start, timestamp, m.Summary))
+			}
+		}
+		if len(dataPoints) == 0 {
+			continue
+		}
+		n += len(dataPoints)
+		var metric []byte
+		metric = appendString(metric, 1, metricFamily.GetName())
+		metric = appendString(metric, 2, metricFamily.GetHelp())
+		metric = appendMessage(metric, metricDataField(metricFamily.GetType()), encodeMetricData(metricFamily.GetType(), dataPoints))
+		metrics = append(metrics, metric)
+	}
+	return metrics, n
+}
+
+// export calls the Export method of the OTLP MetricsService. It returns retry=true for network errors and for the gRPC status codes
+// that the OTLP specification considers temporary. HTTP errors without gRPC status are mapped like in gRPC clients.
+func (e *OTLPExporter) export(request []byte) (result partialSuccess, retry bool, err error) {
+	body := make([]byte, 5, 5+len(request)) // uncompressed flag and message length
+	binary.BigEndian.PutUint32(body[1:], uint32(len(request)))
+	body = append(body, request...)
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return result, false, err
+	}
+	for name, value := range e.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("User-Agent", "grok_exporter")
+	req.Header.Set("Grpc-Timeout", fmt.Sprintf("%vm", e.cfg.Timeout.Nanoseconds()/int64(time.Millisecond)))
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return result, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxGrpcResponseSize))
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			retry = true
+		}
+		return result, retry, fmt.Errorf("server returned HTTP status %v", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxGrpcResponseSize)) // the trailers are available after the body was read
+	if err != nil {
+		return result, true, err
+	}
+	status, msg := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if len(status) == 0 {
+		status, msg = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message") // trailers-only response
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 0 {
+		return result, false, fmt.Errorf("server returned an invalid grpc-status '%v'", status)
+	}
+	if code != 0 {
+		if unescaped, err := url.PathUnescape(msg); err == nil {
+			msg = unescaped
+		}
+		return result, retryableGrpcCodes[code], fmt.Errorf("server returned gRPC status %v: %v", grpcCodeName(code), msg)
+	}
+	if len(data) > 5 {
+		result = decodeExportMetricsServiceResponse(data[5:])
+	}
+	return result, false, nil
+}
+
+func grpcCodeName(code int) string {
+	if code < len(grpcCodes) {
+		return grpcCodes[code]
+	}
+	return strconv.Itoa(code)
+}
+
+// The OTLP protobuf messages are encoded with protowire, like the remote write messages in encodeWriteRequest(), see
+// https://github.com/open-telemetry/opentelemetry-proto/tree/main/opentelemetry/proto/metrics/v1/metrics.proto:
+//
+//	message ExportMetricsServiceRequest { repeated ResourceMetrics resource_metrics = 1; }
+//	message ResourceMetrics { Resource resource = 1; repeated ScopeMetrics scope_metrics = 2; }
+//	message Resource { repeated KeyValue attributes = 1; }
+//	message ScopeMetrics { InstrumentationScope scope = 1; repeated Metric metrics = 2; }
+//	message InstrumentationScope { string name = 1; }
+//	message Metric { string name = 1; string description = 2; oneof data { Gauge gauge = 5; Sum sum = 7; Histogram histogram = 9; Summary summary = 11; } }
+//	message Gauge { repeated NumberDataPoint data_points = 1; }
+//	message Sum { repeated NumberDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; bool is_monotonic = 3; }
+//	message Histogram { repeated HistogramDataPoint data_points = 1; AggregationTemporality aggregation_temporality = 2; }
+//	message Summary { repeated SummaryDataPoint data_points = 1; }
+//	message NumberDataPoint { repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3; double as_double = 4; }
+//	message HistogramDataPoint { repeated KeyValue attributes = 9; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3;
+//	    fixed64 count = 4; double sum = 5; repeated fixed64 bucket_counts = 6; repeated double explicit_bounds = 7; }
+//	message SummaryDataPoint { repeated KeyValue attributes = 7; fixed64 start_time_unix_nano = 2; fixed64 time_unix_nano = 3;
+//	    fixed64 count = 4; double sum = 5; repeated ValueAtQuantile quantile_values = 6; }
+//	message ValueAtQuantile { double quantile = 1; double value = 2; }
+//	message KeyValue { string key = 1; AnyValue value = 2; }
+//	message AnyValue { string string_value = 1; }
+func encodeExportMetricsServiceRequest(resource []byte, metrics [][]byte) []byte {
+	var scope, scopeMetrics, resourceMetrics, result []byte
+	scope = appendString(scope, 1, otlpScopeName)
+	scopeMetrics = appendMessage(scopeMetrics, 1, scope)
+	for _, metric := range metrics {
+		scopeMetrics = appendMessage(scopeMetrics, 2, metric)
+	}
+	resourceMetrics = appendMessage(resourceMetrics, 1, resource)
+	resourceMetrics = appendMessage(resourceMetrics, 2, scopeMetrics)
+	return appendMessage(result, 1, resourceMetrics)
+}
+
+// encodeResource encodes the resource_attributes, service.name is grok_exporter unless configured otherwise.
+func encodeResource(attributes map[string]string) []byte {
+	labels := []*io_prometheus_client.LabelPair{}
+	if _, exists := attributes["service.name"]; !exists {
+		labels = append(labels, labelPair("service.name", "grok_exporter"))
+	}
+	for name, value := range attributes {
+		labels = append(labels, labelPair(name, value))
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+	return appendAttributes(nil, 1, labels)
+}
+
+func metricDataField(metricType io_prometheus_client.MetricType) protowire.Number {
+	switch metricType {
+	case io_prometheus_client.MetricType_COUNTER:
+		return 7
+	case io_prometheus_client.MetricType_HISTOGRAM:
+		return 9
+	case io_prometheus_client.MetricType_SUMMARY:
+		return 11
+	default:
+		return 5
+	}
+}
+
+func encodeMetricData(metricType io_prometheus_client.MetricType, dataPoints [][]byte) []byte {
+	var result []byte
+	for _, dataPoint := range dataPoints {
+		result = appendMessage(result, 1, dataPoint)
+	}
+	switch metricType {
+	case io_prometheus_client.MetricType_COUNTER:
+		result = appendVarint(result, 2, otlpCumulative)
+		result = appendVarint(result, 3, 1) // is_monotonic
+	case io_prometheus_client.MetricType_HISTOGRAM:
+		result = appendVarint(result, 2, otlpCumulative)
+	}
+	return result
+}
+
+// encodeNumberDataPoint encodes a counter, gauge, or untyped value.
+func encodeNumberDataPoint(labels []*io_prometheus_client.LabelPair, start, timestamp uint64, value float64) []byte {
+	var result []byte
+	result = appendTimes(result, start, timestamp)
+	result = appendFixed64(result, 4, math.Float64bits(value))
+	return appendAttributes(result, 7, labels)
+}
+
+// encodeHistogramDataPoint converts the cumulative buckets of the Prometheus histogram to the bucket counts of OTLP, where each
+// bucket counts only the observations between its bounds, and the last bucket counts the observations above the last bound.
+func encodeHistogramDataPoint(labels []*io_prometheus_client.LabelPair, start, timestamp uint64, histogram *io_prometheus_client.Histogram) []byte {
+	var (
+		result, bucketCounts, explicitBounds []byte
+		previous                             uint64
+	)
+	for _, bucket := range histogram.Bucket {
+		if math.IsInf(bucket.GetUpperBound(), +1) {
+			continue
+		}
+		bucketCounts = protowire.AppendFixed64(bucketCounts, bucket.GetCumulativeCount()-previous)
+		explicitBounds = protowire.AppendFixed64(explicitBounds, math.Float64bits(bucket.GetUpperBound()))
+		previous = bucket.GetCumulativeCount()
+	}
+	bucketCounts = protowire.AppendFixed64(bucketCounts, histogram.GetSampleCount()-previous)
+	result = appendTimes(result, start, timestamp)
+	result = appendFixed64(result, 4, histogram.GetSampleCount())
+	result = appendFixed64(result, 5, math.Float64bits(histogram.GetSampleSum()))
+	result = appendMessage(result, 6, bucketCounts) // packed
+	if len(explicitBounds) > 0 {
+		result = appendMessage(result, 7, explicitBounds)
+	}
+	return appendAttributes(result, 9, labels)
+}
+
+func encodeSummaryDataPoint(labels []*io_prometheus_client.LabelPair, start, timestamp uint64, summary *io_prometheus_client.Summary) []byte {
+	var result []byte
+	result = appendTimes(result, start, timestamp)
+	result = appendFixed64(result, 4, summary.GetSampleCount())
+	result = appendFixed64(result, 5, math.Float64bits(summary.GetSampleSum()))
+	for _, q := range summary.Quantile {
+		var quantile []byte
+		quantile = appendFixed64(quantile, 1, math.Float64bits(q.GetQuantile()))
+		quantile = appendFixed64(quantile, 2, math.Float64bits(q.GetValue()))
+		result = appendMessage(result, 6, quantile)
+	}
+	return appendAttributes(result, 7, labels)
+}
+
+// appendTimes appends start_time_unix_nano and time_unix_nano, which are field 2 and 3 in all data points.
+// start is 0 for gauges, as they have no start time.
+func appendTimes(b []byte, start, timestamp uint64) []byte {
+	if start > 0 {
+		b = appendFixed64(b, 2, start)
+	}
+	return appendFixed64(b, 3, timestamp)
+}
+
+// appendAttributes encodes the labels as KeyValue messages with string values.
+func appendAttributes(b []byte, num protowire.Number, labels []*io_prometheus_client.LabelPair) []byte {
+	for _, label := range labels {
+		var keyValue, anyValue []byte
+		anyValue = appendString(anyValue, 1, label.GetValue())
+		keyValue = appendString(keyValue, 1, label.GetName())
+		keyValue = appendMessage(keyValue, 2, anyValue)
+		b = appendMessage(b, num, keyValue)
+	}
+	return b
+}
+
+// decodeExportMetricsServiceResponse decodes the partial_success of the response, unknown fields are ignored:
+//
+//	message ExportMetricsServiceResponse { ExportMetricsPartialSuccess partial_success = 1; }
+//	message ExportMetricsPartialSuccess { int64 rejected_data_points = 1; string error_message = 2; }
+func decodeExportMetricsServiceResponse(data []byte) partialSuccess {
+	var result partialSuccess
+	forEachProtoField(data, func(num protowire.Number, typ protowire.Type, value []byte) {
+		if num != 1 || typ != protowire.BytesType {
+			return
+		}
+		forEachProtoField(value, func(num protowire.Number, typ protowire.Type, value []byte) {
+			switch {
+			case num == 1 && typ == protowire.VarintType:
+				v, _ := protowire.ConsumeVarint(value)
+				result.rejectedDataPoints = int64(v)
+			case num == 2 && typ == protowire.BytesType:
+				result.errorMessage = string(value)
+			}
+		})
+	})
+	return result
+}
+
+// forEachProtoField calls f with the raw value of each field, i.e. the varint or fixed bytes, or the content of a length-delimited field.
+// Decoding stops at the first invalid field.
+func forEachProtoField(data []byte, f func(num protowire.Number, typ protowire.Type, value []byte)) {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return
+		}
+		m := protowire.ConsumeFieldValue(num, typ, data[n:])
+		if m < 0 {
+			return
+		}
+		value := data[n : n+m]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		f(num, typ, value)
+		data = data[n+m:]
+	}
+}
+
+func appendMessage(b []byte, num protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
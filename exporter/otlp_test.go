@@ -0,0 +1,298 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/fstab/grok_exporter/config/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestOTLPExport(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		requests []string // decoded metrics of each request
+		status   = []string{"14", "0"}
+	)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path != otlpExportPath || r.Header.Get("Content-Type") != "application/grpc" || r.Header.Get("X-Tenant") != "team-a" {
+			t.Errorf("unexpected request %v %v", r.URL.Path, r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Fatalf("invalid gRPC message prefix")
+		}
+		requests = append(requests, decodeExportMetricsServiceRequest(t, body[5:]))
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", "application/grpc")
+		var response []byte
+		if status[0] == "0" {
+			var partialSuccess []byte
+			partialSuccess = appendVarint(partialSuccess, 1, 1)
+			partialSuccess = appendString(partialSuccess, 2, "temperature is out of range")
+			response = appendMessage(response, 1, partialSuccess)
+		}
+		prefix := make([]byte, 5)
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(response)))
+		w.Write(append(prefix, response...))
+		w.Header().Set("Grpc-Status", status[0])
+		w.Header().Set("Grpc-Message", "collector%20is%20starting")
+		status = status[1:]
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go (&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "lines_total", Help: "Number of lines."}, []string{"city"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "temperature", Help: "h", Buckets: []float64{10, 20}})
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{Name: "latency", Help: "h", Objectives: map[float64]float64{0.5: 0.05}})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_size", Help: "h"})
+	registry.MustRegister(counter, histogram, summary, gauge)
+	counter.WithLabelValues("Berlin").Add(3)
+	histogram.Observe(15)
+	histogram.Observe(25)
+	summary.Observe(2)
+	gauge.Set(7)
+
+	cfg := config.OTLPEndpointConfig{
+		Endpoint:           listener.Addr().String(),
+		Insecure:           true,
+		Interval:           time.Minute,
+		Timeout:            time.Second,
+		Headers:            map[string]string{"x-tenant": "team-a"},
+		ResourceAttributes: map[string]string{"host.name": "web-1"},
+		RetryOnFailure:     config.RetryConfig{InitialInterval: time.Millisecond, MaxInterval: time.Millisecond},
+	}
+	exporters, err := NewOTLPExporters(config.OTLPConfig{cfg}, registry, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := exporters[0]
+	exporter.startTime = time.Unix(1000, 0)
+	exporter.now = func() time.Time {
+		return time.Unix(2000, 0)
+	}
+	exporter.send(make(chan struct{}))
+
+	// The request is retried after UNAVAILABLE, then the receiver rejects one of the data points.
+	expected := `resource {host.name="web-1", service.name="grok_exporter"} scope github.com/fstab/grok_exporter: ` +
+		`latency "h" summary {} start=1000 time=2000 count=1 sum=2 quantiles=[0.5:2], ` +
+		`lines_total "Number of lines." sum(cumulative, monotonic) {city="Berlin"} start=1000 time=2000 value=3, ` +
+		`queue_size "h" gauge {} time=2000 value=7, ` +
+		`temperature "h" histogram(cumulative) {} start=1000 time=2000 count=2 sum=40 buckets=[0 1 1] bounds=[10 20]`
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, but got %v: %v", len(requests), requests)
+	}
+	for i := range requests {
+		if requests[i] != expected {
+			t.Errorf("request %v: expected\n%v\nbut got\n%v", i, expected, requests[i])
+		}
+	}
+	if sent, failed := counterValue(t, exporter.dataPoints), counterValue(t, exporter.failedDataPoints); sent != 3 || failed != 1 {
+		t.Errorf("expected 3 sent and 1 failed data point, but got %v and %v", sent, failed)
+	}
+
+	// The final send on shutdown is not retried.
+	status = []string{"14"}
+	exporter.send(nil)
+	if len(requests) != 3 || counterValue(t, exporter.failedDataPoints) != 5 {
+		t.Errorf("expected 1 request without retry and 5 failed data points, but got %v requests and %v failed data points", len(requests)-2, counterValue(t, exporter.failedDataPoints))
+	}
+}
+
+func TestOTLPLogTimestamps(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "temperature", Help: "h"})
+	gauge.Set(32)
+	timestamp := time.Unix(500, 0)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&timestampCollector{collector: gauge, timestamp: &timestamp})
+	exporter := &OTLPExporter{gatherer: registry, startTime: time.Unix(1000, 0), lastTimestamp: make(map[string]int64), now: time.Now}
+	for i, expected := range []int{1, 0} {
+		metricFamilies, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics, n := exporter.toOTLPMetrics(metricFamilies)
+		if n != expected || len(metrics) != expected {
+			t.Fatalf("send %v: expected %v data points, but got %v", i, expected, n)
+		}
+		if n > 0 && !strings.Contains(decodeMetric(t, metrics[0]), "time=500 ") {
+			t.Fatalf("send %v: expected the log timestamp, but got %v", i, decodeMetric(t, metrics[0]))
+		}
+	}
+}
+
+// decodeExportMetricsServiceRequest formats the request like 'resource {a="b"} scope name: metric "help" gauge {c="d"} time=1 value=2',
+// with the times in seconds, see encodeExportMetricsServiceRequest().
+func decodeExportMetricsServiceRequest(t *testing.T, data []byte) string {
+	var result []string
+	forEachField(t, data, func(_ protowire.Number, resourceMetrics []byte) {
+		forEachField(t, resourceMetrics, func(num protowire.Number, value []byte) {
+			switch num {
+			case 1:
+				result = append(result, fmt.Sprintf("resource {%v}", decodeAttributes(t, value, 1)))
+			case 2:
+				var metrics []string
+				forEachField(t, value, func(num protowire.Number, value []byte) {
+					if num == 1 {
+						forEachField(t, value, func(_ protowire.Number, name []byte) {
+							result = append(result, fmt.Sprintf("scope %v:", string(name)))
+						})
+					} else {
+						metrics = append(metrics, decodeMetric(t, value))
+					}
+				})
+				result = append(result, strings.Join(metrics, ", "))
+			}
+		})
+	})
+	return strings.Join(result, " ")
+}
+
+func decodeMetric(t *testing.T, data []byte) string {
+	var result []string
+	forEachField(t, data, func(num protowire.Number, value []byte) {
+		switch num {
+		case 1:
+			result = append(result, string(value))
+		case 2:
+			result = append(result, fmt.Sprintf("%q", string(value)))
+		default:
+			name := map[protowire.Number]string{5: "gauge", 7: "sum", 9: "histogram", 11: "summary"}[num]
+			var (
+				flags      []string
+				dataPoints []string
+			)
+			forEachProtoField(value, func(field protowire.Number, _ protowire.Type, v []byte) {
+				switch field {
+				case 1:
+					dataPoints = append(dataPoints, decodeDataPoint(t, num, v))
+				case 2:
+					if x, _ := protowire.ConsumeVarint(v); x == otlpCumulative {
+						flags = append(flags, "cumulative")
+					}
+				case 3:
+					if x, _ := protowire.ConsumeVarint(v); x == 1 {
+						flags = append(flags, "monotonic")
+					}
+				}
+			})
+			if len(flags) > 0 {
+				name = fmt.Sprintf("%v(%v)", name, strings.Join(flags, ", "))
+			}
+			result = append(result, name, strings.Join(dataPoints, " | "))
+		}
+	})
+	return strings.Join(result, " ")
+}
+
+func decodeDataPoint(t *testing.T, metricType protowire.Number, data []byte) string {
+	attributesField := map[protowire.Number]protowire.Number{5: 7, 7: 7, 9: 9, 11: 7}[metricType]
+	result := []string{fmt.Sprintf("{%v}", decodeAttributes(t, data, attributesField))}
+	float := func(v []byte) float64 {
+		bits, _ := protowire.ConsumeFixed64(v)
+		return math.Float64frombits(bits)
+	}
+	forEachProtoField(data, func(num protowire.Number, _ protowire.Type, v []byte) {
+		fixed, _ := protowire.ConsumeFixed64(v)
+		switch {
+		case num == attributesField:
+		case num == 2:
+			result = append(result, fmt.Sprintf("start=%v", fixed/uint64(time.Second)))
+		case num == 3:
+			result = append(result, fmt.Sprintf("time=%v", fixed/uint64(time.Second)))
+		case num == 4 && (metricType == 5 || metricType == 7):
+			result = append(result, fmt.Sprintf("value=%v", float(v)))
+		case num == 4:
+			result = append(result, fmt.Sprintf("count=%v", fixed))
+		case num == 5:
+			result = append(result, fmt.Sprintf("sum=%v", float(v)))
+		case num == 6 && metricType == 9:
+			var counts []string
+			for ; len(v) > 0; v = v[8:] {
+				c, _ := protowire.ConsumeFixed64(v)
+				counts = append(counts, fmt.Sprintf("%v", c))
+			}
+			result = append(result, fmt.Sprintf("buckets=[%v]", strings.Join(counts, " ")))
+		case num == 6:
+			var q, value float64
+			forEachProtoField(v, func(num protowire.Number, _ protowire.Type, v []byte) {
+				if num == 1 {
+					q = float(v)
+				} else {
+					value = float(v)
+				}
+			})
+			result = append(result, fmt.Sprintf("quantiles=[%v:%v]", q, value))
+		case num == 7:
+			var bounds []string
+			for ; len(v) > 0; v = v[8:] {
+				bounds = append(bounds, fmt.Sprintf("%v", float(v)))
+			}
+			result = append(result, fmt.Sprintf("bounds=[%v]", strings.Join(bounds, " ")))
+		default:
+			t.Errorf("unexpected data point field %v", num)
+		}
+	})
+	return strings.Join(result, " ")
+}
+
+// decodeAttributes formats the KeyValue messages in the field like a="b", c="d".
+func decodeAttributes(t *testing.T, data []byte, field protowire.Number) string {
+	var result []string
+	forEachProtoField(data, func(num protowire.Number, _ protowire.Type, keyValue []byte) {
+		if num != field {
+			return
+		}
+		var key, value string
+		forEachField(t, keyValue, func(num protowire.Number, v []byte) {
+			if num == 1 {
+				key = string(v)
+			} else {
+				forEachField(t, v, func(_ protowire.Number, s []byte) {
+					value = string(s)
+				})
+			}
+		})
+		result = append(result, fmt.Sprintf("%v=%q", key, value))
+	})
+	return strings.Join(result, ", ")
+}
@@ -27,6 +27,12 @@ import (
 
 type Patterns map[string]string
 
+// Pattern sets of the logstash-patterns-core library, see AddBundled().
+const (
+	BundledLegacy = "legacy" // the patterns used by logstash's grok filter with ecs_compatibility => disabled
+	BundledEcsV1  = "ecs-v1" // the patterns used by logstash's grok filter with ecs_compatibility => v1
+)
+
 func InitPatterns() *Patterns {
 	result := Patterns(make(map[string]string))
 	return &result
@@ -38,6 +44,9 @@ func (p *Patterns) AddDir(path string) error {
 		return fmt.Errorf("failed to read pattern directory %v: %v", path, err)
 	}
 	for _, file := range files {
+		if file.IsDir() {
+			continue // like the legacy and ecs-v1 directories of logstash-patterns-core, see AddBundled()
+		}
 		err = p.AddFile(filepath.Join(path, file.Name()))
 		if err != nil {
 			return err
@@ -82,6 +91,42 @@ func (p *Patterns) AddGlob(globString string) error {
 	return nil
 }
 
+// BundledPatternsDir is the patterns directory next to the grok_exporter executable,
+// where the release zip files contain the logstash-patterns-core library.
+func BundledPatternsDir() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the bundled patterns: %v", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the bundled patterns: %v", err)
+	}
+	return filepath.Join(filepath.Dir(executable), "patterns"), nil
+}
+
+// AddBundled adds the pattern set BundledLegacy or BundledEcsV1 from the logstash-patterns-core library in dir.
+// Since version 4.3, the library has a legacy and an ecs-v1 subdirectory. Older versions have the legacy patterns in dir itself.
+func (p *Patterns) AddBundled(dir string, set string) error {
+	if set != BundledLegacy && set != BundledEcsV1 {
+		return fmt.Errorf("%v: unknown pattern set", set)
+	}
+	setDir := filepath.Join(dir, set)
+	fileInfo, err := os.Stat(setDir)
+	switch {
+	case err == nil && fileInfo.IsDir():
+		return p.AddDir(setDir)
+	case os.IsNotExist(err) && set == BundledLegacy:
+		return p.AddDir(dir)
+	case os.IsNotExist(err):
+		return fmt.Errorf("the patterns in %v do not include the %v pattern set, logstash-patterns-core version 4.3 or newer is required", dir, set)
+	case err != nil:
+		return fmt.Errorf("failed to read pattern directory %v: %v", setDir, err)
+	default:
+		return fmt.Errorf("failed to read pattern directory %v: not a directory", setDir)
+	}
+}
+
 // pattern files see https://github.com/logstash-plugins/logstash-patterns-core/tree/master/patterns
 func (p *Patterns) AddFile(path string) error {
 	file, err := os.Open(path)
@@ -115,6 +160,15 @@ func (p *Patterns) AddPattern(pattern string) error {
 	return nil
 }
 
+// AddDefinition adds the grok pattern name, replacing the pattern if it is already defined.
+func (p *Patterns) AddDefinition(name string, regex string) error {
+	if !regexp.MustCompile(`^[A-Za-z0-9_]+$`).MatchString(name) || len(regex) == 0 {
+		return fmt.Errorf("'%v %v' is not a valid pattern definition", name, regex)
+	}
+	(*p)[name] = regex
+	return nil
+}
+
 func (p *Patterns) Find(pattern string) (string, bool) {
 	result, exists := (*p)[pattern]
 	return result, exists
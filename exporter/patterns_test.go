@@ -15,7 +15,7 @@
 package exporter
 
 import (
-	"github.com/fstab/grok_exporter/oniguruma"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -48,6 +48,61 @@ func loadPatternDir(t *testing.T) *Patterns {
 	return p
 }
 
+func TestBundledPatterns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_patterns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// layout of logstash-patterns-core before 4.3
+	writePatternFile(t, filepath.Join(dir, "grok-patterns"), "INT (?:[+-]?(?:[0-9]+))")
+	p := InitPatterns()
+	if err = p.AddBundled(dir, BundledLegacy); err != nil {
+		t.Fatal(err)
+	}
+	expectPattern(t, p, "INT", "(?:[+-]?(?:[0-9]+))")
+	if err = p.AddBundled(dir, BundledEcsV1); err == nil {
+		t.Fatal("expected error, because there are no ecs-v1 patterns")
+	}
+	// layout since 4.3, the legacy and ecs-v1 directories are skipped when the directory itself is imported
+	for _, set := range []string{BundledLegacy, BundledEcsV1} {
+		if err = os.Mkdir(filepath.Join(dir, set), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writePatternFile(t, filepath.Join(dir, set, "java"), "JAVACLASS "+set)
+	}
+	for _, set := range []string{BundledLegacy, BundledEcsV1} {
+		p = InitPatterns()
+		if err = p.AddBundled(dir, set); err != nil {
+			t.Fatal(err)
+		}
+		expectPattern(t, p, "JAVACLASS", set)
+		if _, exists := p.Find("INT"); exists {
+			t.Fatalf("%v: unexpected pattern INT from the parent directory", set)
+		}
+	}
+	p = InitPatterns()
+	if err = p.AddDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(*p) != 1 {
+		t.Fatalf("expected only the INT pattern, but got %v", *p)
+	}
+}
+
+func writePatternFile(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte("# test patterns\n"+content+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectPattern(t *testing.T, p *Patterns, name string, expected string) {
+	regex, exists := p.Find(name)
+	if !exists || regex != expected {
+		t.Fatalf("expected %v to be %v, but got %q", name, expected, regex)
+	}
+}
+
 func TestOptionalLabels(t *testing.T) {
 	for _, expected := range []struct {
 		input string
@@ -82,13 +137,13 @@ func TestOptionalLabels(t *testing.T) {
 	}
 }
 
-func matchFooBar(t *testing.T, input string) *oniguruma.SearchResult {
+func matchFooBar(t *testing.T, input string) SearchResult {
 	p := InitPatterns()
 	p.AddPattern("FOO foo")
 	p.AddPattern("BAR bar")
 	p.AddPattern("FOOBAR %{FOO:foo}%{BAR:bar}?")
 
-	regex, err := Compile("%{FOOBAR}", p)
+	regex, err := Compile("%{FOOBAR}", p, Oniguruma)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
@@ -108,7 +163,7 @@ func TestNginxExample(t *testing.T) {
 	p.AddPattern("ADDITIONAL_INFO client: %{URIHOST:client}|server: %{URIHOST:server}|request: \"%{REQUEST_START:request}\"|upstream: \"%{URI:upstream}\"|host: \"%{URIHOST:host}\"|referrer: \"%{URI:referrer}\"")
 	p.AddPattern("NGINX_ERROR ^%{ERRORDATE:time_local} \\[%{LOGLEVEL:level}\\] %{INT:process_id}#%{INT:thread_id}: \\*(%{INT:connection_id})? %{DATA:errormessage}(, %{ADDITIONAL_INFO})*$")
 
-	regex, err := Compile("%{NGINX_ERROR}", p)
+	regex, err := Compile("%{NGINX_ERROR}", p, Oniguruma)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
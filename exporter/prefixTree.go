@@ -0,0 +1,279 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var intervalRegex = regexp.MustCompile(`^\{[0-9]*(,[0-9]*)?\}`)
+
+// PrefixTree shares the common prefixes of the match patterns of different metrics, like %{COMMONAPACHELOG} in
+//
+//	%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}
+//	%{COMMONAPACHELOG} %{NUMBER:duration}
+//
+// A metric can only match a line if its prefix matches, so the prefix is a gate that is evaluated once per line for all metrics sharing it.
+// If a line doesn't match the prefix, which is true for most lines in logs with many different line formats, all these metrics are skipped.
+// If it matches, each metric matches its full pattern, because the rest of the pattern may change where the prefix ends.
+type PrefixTree struct {
+	gates []*prefixGate // the innermost gate for each pattern, nil if the pattern doesn't share a prefix
+	all   []*prefixGate // all gates, each holds a reference of the tree until Free() is called
+}
+
+// prefixGate is a node in the PrefixTree. The result for the last input is cached, so that it is evaluated once per line.
+type prefixGate struct {
+	regex      Regex
+	parent     *prefixGate // gate for a shorter prefix that is shared by more patterns, nil for the root
+	lastInput  string
+	lastResult bool
+	evaluated  bool
+	refs       int // the tree, the child gates, and the gated regexes using the gate, see release()
+}
+
+// gatedRegex is a Regex that is only searched if the line matches the gate.
+type gatedRegex struct {
+	Regex
+	gate *prefixGate
+}
+
+type prefixTreeNode struct {
+	prefix   string
+	children map[string]*prefixTreeNode
+	count    int // number of patterns with this prefix
+	gate     *prefixGate
+}
+
+// NewPrefixTree compiles gates for the prefixes that are shared by at least two of the grok patterns.
+// Empty patterns are ignored, like for metrics with matches instead of match. Free() must be called when the regexes were gated.
+func NewPrefixTree(matches []string, patterns *Patterns, engine RegexEngine) *PrefixTree {
+	root := &prefixTreeNode{children: make(map[string]*prefixTreeNode)}
+	units := make([][]string, len(matches))
+	for i, match := range matches {
+		units[i] = prefixUnits(match)
+		node := root
+		for _, unit := range units[i] {
+			child, ok := node.children[unit]
+			if !ok {
+				child = &prefixTreeNode{prefix: node.prefix + unit, children: make(map[string]*prefixTreeNode)}
+				node.children[unit] = child
+			}
+			child.count++
+			node = child
+		}
+	}
+	result := &PrefixTree{gates: make([]*prefixGate, len(matches))}
+	for i := range matches {
+		var gate *prefixGate
+		node := root
+		// The last unit is not a gate for this pattern, as the gate would be the full pattern.
+		for j := 0; j+1 < len(units[i]); j++ {
+			node = node.children[units[i][j]]
+			next := node.children[units[i][j+1]]
+			if node.count < 2 || next.count == node.count {
+				continue // not shared, or the next prefix is shared by the same patterns
+			}
+			if node.gate == nil {
+				regex, err := Compile(node.prefix, patterns, engine)
+				if err != nil {
+					continue // the pattern is compiled with the metric, which reports the error
+				}
+				if matchesEmptyString(regex) {
+					regex.Free() // like %{DATA}, this would not skip any line
+					continue
+				}
+				node.gate = &prefixGate{regex: regex, parent: gate, refs: 1}
+				if gate != nil {
+					gate.refs++
+				}
+				result.all = append(result.all, node.gate)
+			}
+			gate = node.gate
+		}
+		result.gates[i] = gate
+	}
+	return result
+}
+
+// Gate returns the regex for the i-th pattern, so that it is only searched if the line matches the shared prefix.
+// Free() on the returned regex frees regex, and the gates when they are no longer used.
+func (t *PrefixTree) Gate(i int, regex Regex) Regex {
+	if t == nil || t.gates[i] == nil {
+		return regex
+	}
+	t.gates[i].refs++
+	return &gatedRegex{
+		Regex: regex,
+		gate:  t.gates[i],
+	}
+}
+
+// Free releases the tree's references to the gates. The gates used by the regexes returned by Gate() are freed with these regexes.
+func (t *PrefixTree) Free() {
+	if t == nil {
+		return
+	}
+	for _, gate := range t.all {
+		gate.release()
+	}
+	t.all = nil
+}
+
+func (r *gatedRegex) Free() {
+	r.Regex.Free()
+	r.gate.release()
+}
+
+func (r *gatedRegex) Search(input string) (SearchResult, error) {
+	matches, err := r.gate.matches(input)
+	if err != nil || !matches {
+		return noMatch{}, err
+	}
+	return r.Regex.Search(input)
+}
+
+func (g *prefixGate) matches(input string) (bool, error) {
+	if g.evaluated && g.lastInput == input {
+		return g.lastResult, nil
+	}
+	result := true
+	if g.parent != nil {
+		var err error
+		if result, err = g.parent.matches(input); err != nil {
+			return false, err
+		}
+	}
+	if result {
+		searchResult, err := g.regex.Search(input)
+		if err != nil {
+			return false, err
+		}
+		result = searchResult.IsMatch()
+		searchResult.Free()
+	}
+	g.lastInput, g.lastResult, g.evaluated = input, result, true
+	return result, nil
+}
+
+func (g *prefixGate) release() {
+	g.refs--
+	if g.refs > 0 {
+		return
+	}
+	g.regex.Free()
+	if g.parent != nil {
+		g.parent.release()
+	}
+}
+
+func matchesEmptyString(regex Regex) bool {
+	searchResult, err := regex.Search("")
+	if err != nil {
+		return true
+	}
+	defer searchResult.Free()
+	return searchResult.IsMatch()
+}
+
+// prefixUnits splits a grok pattern into the parts that a prefix may consist of: %{...} references, groups, character classes,
+// and single characters, each with its quantifier. Cutting the pattern between the parts results in a valid prefix,
+// which matches wherever the full pattern matches. The result is nil for patterns with top-level alternatives like a|b,
+// because a|b matches lines where the prefix a does not match.
+func prefixUnits(pattern string) []string {
+	var result []string
+	for i := 0; i < len(pattern); {
+		end := unitEnd(pattern, i)
+		if end < 0 {
+			return nil
+		}
+		for end < len(pattern) {
+			if strings.IndexByte("*+?", pattern[end]) >= 0 {
+				end++
+			} else if interval := intervalRegex.FindString(pattern[end:]); len(interval) > 0 {
+				end += len(interval)
+			} else {
+				break
+			}
+		}
+		result = append(result, pattern[i:end])
+		i = end
+	}
+	return result
+}
+
+// unitEnd returns the end of the part starting at pattern[i], or -1 if it cannot be a part of a prefix.
+func unitEnd(pattern string, i int) int {
+	switch c := pattern[i]; {
+	case strings.HasPrefix(pattern[i:], "%{"):
+		end := strings.IndexByte(pattern[i:], '}')
+		if end < 0 {
+			return -1
+		}
+		return i + end + 1
+	case c == '\\':
+		if i+1 >= len(pattern) {
+			return -1
+		}
+		if strings.IndexByte("pPxk", pattern[i+1]) >= 0 && i+2 < len(pattern) && (pattern[i+2] == '{' || pattern[i+2] == '<') {
+			end := strings.IndexAny(pattern[i:], "}>")
+			if end < 0 {
+				return -1
+			}
+			return i + end + 1 // like \p{L}, \x{41}, or \k<name>
+		}
+		_, size := utf8.DecodeRuneInString(pattern[i+1:])
+		return i + 1 + size
+	case c == '[':
+		return classEnd(pattern, i)
+	case c == '(':
+		end := groupEnd(pattern, i)
+		if pattern[end] != ')' {
+			return -1
+		}
+		return end + 1
+	case c == '|' || c == ')':
+		return -1
+	default:
+		_, size := utf8.DecodeRuneInString(pattern[i:])
+		return i + size
+	}
+}
+
+// classEnd returns the end of the character class starting at pattern[i], including nested classes like [a-z&&[^x]].
+func classEnd(pattern string, i int) int {
+	depth := 0
+	for j := i; j < len(pattern); j++ {
+		switch pattern[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+			if strings.HasPrefix(pattern[j+1:], "^") {
+				j++
+			}
+			if strings.HasPrefix(pattern[j+1:], "]") {
+				j++ // a literal ] at the beginning of the character class
+			}
+		case ']':
+			depth--
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+	return -1
+}
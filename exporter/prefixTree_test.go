@@ -0,0 +1,114 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrefixUnits(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		`%{COMMONAPACHELOG} %{QS:agent}`: "%{COMMONAPACHELOG}| |%{QS:agent}",
+		`ab*c{2,3}?d`:                    "a|b*|c{2,3}?|d",
+		`(?<x>a|b)++[^]a-z\]]\d\p{L}x{y`: "(?<x>a|b)++|[^]a-z\\]]|\\d|\\p{L}|x|{|y",
+		`[a-z&&[^x]]+ \k<x>`:             "[a-z&&[^x]]+| |\\k<x>",
+		`ä(?:ö)`:                         "ä|(?:ö)",
+		`%{USER:user} logged in|.*error`: "",
+		`unbalanced (group`:              "",
+		`unterminated %{USER`:            "",
+	} {
+		units := strings.Join(prefixUnits(pattern), "|")
+		if units != expected {
+			t.Fatalf("%v: expected units %q, but got %q", pattern, expected, units)
+		}
+	}
+}
+
+func TestPrefixTree(t *testing.T) {
+	patterns := loadPatternDir(t)
+	matches := []string{
+		`%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+		`%{COMMONAPACHELOG} %{NUMBER:duration}`,
+		`%{COMMONAPACHELOG} %{NUMBER:duration} %{USER:user}`,
+		`%{DATA:message}error`,
+		`%{DATA:message}warning`,
+		`user %{USER:user} logged in|logged out`,
+		"",
+	}
+	tree := NewPrefixTree(matches, patterns, Oniguruma)
+	for i, expectGate := range []bool{true, true, true, false, false, false, false} {
+		if (tree.gates[i] != nil) != expectGate {
+			t.Fatalf("%v: expected gate %v", matches[i], expectGate)
+		}
+	}
+	if tree.gates[0] != tree.gates[1] || tree.gates[2].parent != tree.gates[1] {
+		t.Fatalf("expected gates to be shared")
+	}
+	lines := []string{
+		`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.0" 200 2326 "-" "curl"`,
+		`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.0" 200 2326 17 alice`,
+		`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.0" 200 2326 17`,
+		`GET /index.html HTTP/1.0 200 2326 17 alice`,
+	}
+	for i, match := range matches[:3] {
+		regex, err := Compile(match, patterns, Oniguruma)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gated := tree.Gate(i, regex)
+		for _, line := range lines {
+			expectSameResult(t, match, regex, gated, line)
+		}
+		gated.Free()
+	}
+	if tree.gates[1].lastInput != lines[3] || tree.gates[1].lastResult {
+		t.Fatalf("expected the result of the gate to be cached")
+	}
+	tree.Free()
+	for _, gate := range []*prefixGate{tree.gates[1], tree.gates[2]} {
+		if gate.refs != 0 {
+			t.Fatalf("expected the gates to be freed, but %v has %v references", gate.regex, gate.refs)
+		}
+	}
+}
+
+func TestPrefixTreeFree(t *testing.T) {
+	patterns := loadPatternDir(t)
+	matches := []string{
+		`%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+		`%{COMMONAPACHELOG} %{NUMBER:duration}`,
+	}
+	tree := NewPrefixTree(matches, patterns, Oniguruma)
+	regex, err := Compile(matches[1], patterns, Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gated := tree.Gate(1, regex) // the first pattern is not gated, as if its metric failed to initialize
+	tree.Free()
+	if tree.gates[1].refs != 1 {
+		t.Fatalf("expected the gate to be kept for the gated regex, but it has %v references", tree.gates[1].refs)
+	}
+	line := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.0" 200 2326 17`
+	searchResult, err := gated.Search(line)
+	if err != nil || !searchResult.IsMatch() {
+		t.Fatalf("expected %q to match, but got %v", line, err)
+	}
+	searchResult.Free()
+	gated.Free()
+	if tree.gates[1].refs != 0 {
+		t.Fatalf("expected the gate to be freed with the gated regex, but it has %v references", tree.gates[1].refs)
+	}
+}
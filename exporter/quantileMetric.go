@@ -0,0 +1,153 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/beorn7/perks/quantile"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// quantileLabel is the label of quantile metrics with the configured quantiles, like "0.99".
+const quantileLabel = "quantile"
+
+// quantileWindow estimates the quantiles of the values within the sliding window max_age, with the CKMS algorithm
+// that is also used for summaries. Like the age buckets of a summary, each value is inserted into the streams of all sub-windows,
+// and the stream of a sub-window is reset when the window moves to it. The stream after the current one is the oldest,
+// it has the values of the last age_buckets - 1 sub-windows and of the current one.
+type quantileWindow struct {
+	slidingWindow
+	streams []*quantile.Stream
+}
+
+func newQuantileWindow(now time.Time, maxAge time.Duration, ageBuckets int, objectives map[float64]float64) *quantileWindow {
+	window := newSlidingWindow(now, maxAge, ageBuckets)
+	streams := make([]*quantile.Stream, window.size)
+	for i := range streams {
+		streams[i] = quantile.NewTargeted(objectives)
+	}
+	return &quantileWindow{
+		slidingWindow: window,
+		streams:       streams,
+	}
+}
+
+func (w *quantileWindow) rotate(now time.Time) {
+	w.slidingWindow.rotate(now, func(bucket int) {
+		w.streams[bucket].Reset()
+	})
+}
+
+func (w *quantileWindow) observe(value float64) {
+	for _, stream := range w.streams {
+		stream.Insert(value)
+	}
+}
+
+// query returns the estimated quantile. Like the quantiles of a summary without observations, it is NaN
+// if there were no values within the window.
+func (w *quantileWindow) query(q float64) float64 {
+	oldest := w.streams[(w.current+1)%w.size]
+	if oldest.Count() == 0 {
+		return math.NaN()
+	}
+	return oldest.Query(q)
+}
+
+// quantileCollector exports the configured quantiles of the values within the window as gauges for each label value combination.
+// The lines are processed in the main loop, while the samples are collected by the HTTP server, so access is synchronized.
+type quantileCollector struct {
+	mutex      sync.Mutex
+	desc       *prometheus.Desc
+	labelNames []string
+	maxAge     time.Duration
+	ageBuckets int
+	objectives map[float64]float64
+	quantiles  []float64        // sorted keys of objectives
+	now        func() time.Time // time.Now, except in tests
+	windows    map[string]*quantileSeries
+}
+
+type quantileSeries struct {
+	labelValues []string // same order as quantileCollector.labelNames
+	window      *quantileWindow
+}
+
+func newQuantileCollector(opts prometheus.Opts, labelNames []string, maxAge time.Duration, ageBuckets int, objectives map[float64]float64) *quantileCollector {
+	quantiles := make([]float64, 0, len(objectives))
+	for q := range objectives {
+		quantiles = append(quantiles, q)
+	}
+	sort.Float64s(quantiles)
+	return &quantileCollector{
+		desc:       prometheus.NewDesc(opts.Name, opts.Help, append(append([]string{}, labelNames...), quantileLabel), opts.ConstLabels),
+		labelNames: labelNames,
+		maxAge:     maxAge,
+		ageBuckets: ageBuckets,
+		objectives: objectives,
+		quantiles:  quantiles,
+		now:        time.Now,
+		windows:    make(map[string]*quantileSeries),
+	}
+}
+
+func (c *quantileCollector) observe(labels map[string]string, value float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	key := labelsKey(labels)
+	series, exists := c.windows[key]
+	if !exists {
+		series = &quantileSeries{
+			labelValues: orderedLabelValues(c.labelNames, labels),
+			window:      newQuantileWindow(now, c.maxAge, c.ageBuckets, c.objectives),
+		}
+		c.windows[key] = series
+	}
+	series.window.rotate(now)
+	series.window.observe(value)
+}
+
+// Delete removes the time series with the labels, for delete_match and retention.
+func (c *quantileCollector) Delete(labels prometheus.Labels) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := labelsKey(labels)
+	_, exists := c.windows[key]
+	delete(c.windows, key)
+	return exists
+}
+
+func (c *quantileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *quantileCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	for _, series := range c.windows {
+		series.window.rotate(now)
+		for _, q := range c.quantiles {
+			labelValues := append(append([]string{}, series.labelValues...), strconv.FormatFloat(q, 'g', -1, 64))
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, series.window.query(q), labelValues...)
+		}
+	}
+}
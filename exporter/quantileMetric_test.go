@@ -0,0 +1,130 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+)
+
+func TestQuantileWindow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	c := newQuantileCollector(prometheus.Opts{Name: "latency", Help: "latency"}, nil, 5*time.Minute, 5, map[float64]float64{0.5: 0.01, 0.9: 0.01})
+	c.now = func() time.Time { return now }
+	for _, data := range []struct {
+		elapsed time.Duration
+		values  []float64
+		median  float64
+		p90     float64
+	}{
+		{0, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 5, 9},
+		{2 * time.Minute, []float64{100, 100, 100, 100, 100, 100, 100, 100, 100, 100}, 10, 100},
+		{4 * time.Minute, nil, 100, 100}, // 10:06, the values from 10:00 expired
+		{10 * time.Minute, nil, math.NaN(), math.NaN()},
+	} {
+		now = now.Add(data.elapsed)
+		for _, value := range data.values {
+			c.observe(nil, value)
+		}
+		ch := make(chan prometheus.Metric, 2)
+		c.Collect(ch)
+		close(ch)
+		expected := map[string]float64{"0.5": data.median, "0.9": data.p90}
+		for m := range ch {
+			labels, value := gaugeSample(t, m)
+			q := labels[quantileLabel]
+			if value != expected[q] && !(math.IsNaN(value) && math.IsNaN(expected[q])) {
+				t.Fatalf("%v: expected quantile %v to be %v, but got %v", now, q, expected[q], value)
+			}
+		}
+	}
+}
+
+func TestQuantileVecMetric(t *testing.T) {
+	regex := initGaugeRegex(t)
+	quantile := NewQuantileMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:  "temperature_quantiles",
+		Value: "{{.temperature}}",
+		Labels: map[string]string{
+			"city": "{{.city}}",
+		},
+		Quantiles: map[float64]float64{0.5: 0.05, 0.99: 0.001},
+	}), regex, nil)
+	for _, line := range []string{
+		"Temperature in Berlin: 32",
+		"Temperature in Berlin: 20",
+		"Temperature in Berlin: 25",
+		"Temperature in Moscow: -5",
+	} {
+		_, err := quantile.ProcessMatch(line, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]float64{
+		"Berlin/0.5": 25, "Berlin/0.99": 32,
+		"Moscow/0.5": -5, "Moscow/0.99": -5,
+	}
+	ch := make(chan prometheus.Metric, len(expected))
+	quantile.Collector().Collect(ch)
+	close(ch)
+	if len(ch) != len(expected) {
+		t.Fatalf("expected %v time series, but got %v", len(expected), len(ch))
+	}
+	for m := range ch {
+		labels, value := gaugeSample(t, m)
+		key := labels["city"] + "/" + labels[quantileLabel]
+		if value != expected[key] {
+			t.Errorf("%v: expected %v, but got %v", key, expected[key], value)
+		}
+	}
+}
+
+func TestQuantileUseLogTimestamp(t *testing.T) {
+	regex := initGaugeRegex(t)
+	quantile := NewQuantileMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:            "temperature_quantiles",
+		Value:           "{{.temperature}}",
+		UseLogTimestamp: true,
+		Labels: map[string]string{
+			"city": "{{.city}}",
+		},
+		Quantiles: map[float64]float64{0.5: 0.05, 0.99: 0.001},
+	}), regex, nil)
+	_, err := quantile.ProcessMatch("Temperature in Berlin: 32", map[string]interface{}{LogTimeField: 1577872800.5}) // 2020-01-01T10:00:00.5Z
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan prometheus.Metric, 2)
+	quantile.Collector().Collect(ch)
+	close(ch)
+	if len(ch) != 2 {
+		t.Fatalf("expected 2 time series, but got %v", len(ch))
+	}
+	for m := range ch {
+		pb := io_prometheus_client.Metric{}
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		if pb.GetTimestampMs() != 1577872800500 {
+			t.Errorf("%v: expected timestamp 1577872800500, but got %v", pb.Label, pb.GetTimestampMs())
+		}
+	}
+}
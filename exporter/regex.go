@@ -0,0 +1,545 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"github.com/fstab/grok_exporter/oniguruma"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RegexEngine is the regular expression library used for matching the grok patterns, see Compile().
+type RegexEngine string
+
+const (
+	// Oniguruma supports the full syntax of the grok patterns, including backtracking features like look-behind.
+	Oniguruma RegexEngine = "oniguruma"
+	// RE2 uses Go's regexp package. Compiling patterns that need Oniguruma's features fails.
+	RE2 RegexEngine = "re2"
+	// Auto uses Go's regexp package if it matches the pattern like Oniguruma, and Oniguruma otherwise.
+	Auto RegexEngine = "auto"
+)
+
+// ErrMatchTimeout is the error of Regex.Search() if the match exceeds the time budget, see SetMatchTimeout().
+var ErrMatchTimeout = oniguruma.ErrMatchTimeout
+
+// SetMatchTimeout sets the time budget for each match of the Oniguruma regular expressions, 0 means no budget.
+// Matches with Go's regexp package take linear time, so there is no budget for RE2.
+func SetMatchTimeout(timeout time.Duration) error {
+	return oniguruma.SetMatchTimeout(timeout)
+}
+
+// Regex is a compiled grok pattern.
+type Regex interface {
+	Search(input string) (SearchResult, error)
+	HasCaptureGroup(name string) bool
+	NumberOfCaptureGroups(name string) int
+	// CaptureType is the type of the capture group like %{INT:port:int}, or Untyped.
+	CaptureType(name string) CaptureType
+	// CaptureGroupNames returns the names of the capture groups in the order they appear in the pattern. Each name is returned once.
+	CaptureGroupNames() []string
+	// Engine is Oniguruma or RE2, depending on which library matches the pattern.
+	Engine() RegexEngine
+	Free()
+}
+
+// SearchResult is the result of Regex.Search(). Free() must be called when the result is no longer used.
+type SearchResult interface {
+	IsMatch() bool
+	GetCaptureGroupByName(name string) (string, error)
+	Free()
+}
+
+type onigurumaRegex struct {
+	*oniguruma.Regex
+	types map[string]CaptureType
+	names []string
+}
+
+func (r onigurumaRegex) Search(input string) (SearchResult, error) {
+	result, err := r.Regex.Search(input)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r onigurumaRegex) CaptureType(name string) CaptureType {
+	return r.types[name]
+}
+
+func (r onigurumaRegex) CaptureGroupNames() []string {
+	return r.names
+}
+
+func (r onigurumaRegex) Engine() RegexEngine {
+	return Oniguruma
+}
+
+// excludingRegex matches like regex, except for the lines that are also matched by exclude.
+type excludingRegex struct {
+	Regex
+	exclude Regex
+}
+
+type noMatch struct{}
+
+type matchAll struct{}
+
+type match struct{}
+
+// Exclude returns a Regex that does not match the lines matching exclude, even if regex matches them.
+// The capture groups are the capture groups of regex.
+func Exclude(regex, exclude Regex) Regex {
+	return &excludingRegex{
+		Regex:   regex,
+		exclude: exclude,
+	}
+}
+
+func (r *excludingRegex) Search(input string) (SearchResult, error) {
+	result, err := r.Regex.Search(input)
+	if err != nil || !result.IsMatch() {
+		return result, err
+	}
+	excludeResult, err := r.exclude.Search(input)
+	if err != nil {
+		result.Free()
+		return nil, err
+	}
+	defer excludeResult.Free()
+	if excludeResult.IsMatch() {
+		result.Free()
+		return noMatch{}, nil
+	}
+	return result, nil
+}
+
+func (r *excludingRegex) Free() {
+	r.Regex.Free()
+	r.exclude.Free()
+}
+
+type defaultingRegex struct {
+	Regex
+	defaults map[string]string
+}
+
+type defaultingResult struct {
+	SearchResult
+	defaults map[string]string
+}
+
+// WithDefaults returns a Regex whose empty capture groups have the values of defaults, see metrics.field_defaults.
+// A capture group is empty if it is in an optional part of the pattern that did not match, or if it matched the empty string.
+func WithDefaults(regex Regex, defaults map[string]string) Regex {
+	if len(defaults) == 0 {
+		return regex
+	}
+	return &defaultingRegex{
+		Regex:    regex,
+		defaults: defaults,
+	}
+}
+
+func (r *defaultingRegex) Search(input string) (SearchResult, error) {
+	result, err := r.Regex.Search(input)
+	if err != nil || !result.IsMatch() {
+		return result, err
+	}
+	return &defaultingResult{result, r.defaults}, nil
+}
+
+func (r *defaultingResult) GetCaptureGroupByName(name string) (string, error) {
+	value, err := r.SearchResult.GetCaptureGroupByName(name)
+	if err == nil && value == "" {
+		if defaultValue, ok := r.defaults[name]; ok {
+			return defaultValue, nil
+		}
+	}
+	return value, err
+}
+
+type sharedRegex struct {
+	Regex
+	lastInput  string
+	lastResult SearchResult // nil until the first successful search
+	refs       int          // number of metrics using the regex, see Free()
+}
+
+// sharedResult is the cached result of a sharedRegex. It is freed by the sharedRegex when the next input is searched.
+type sharedResult struct {
+	SearchResult
+}
+
+// Shared returns a Regex for the metrics of a metrics.metrics block. The regex is searched once per line,
+// the other metrics get the result of the previous search if they search the same input.
+// The metrics are processed one after the other in the main loop, so access is not synchronized.
+// The first metric of the block calls Shared with its regex, the others call Shared with the result of the first call.
+// Each metric calls Free() on the shared regex, which is released when the last metric freed it.
+func Shared(regex Regex) Regex {
+	if shared, ok := regex.(*sharedRegex); ok {
+		shared.refs++
+		return shared
+	}
+	return &sharedRegex{Regex: regex, refs: 1}
+}
+
+func (r *sharedRegex) Search(input string) (SearchResult, error) {
+	if r.lastResult != nil && r.lastInput == input {
+		return sharedResult{r.lastResult}, nil
+	}
+	if r.lastResult != nil {
+		r.lastResult.Free()
+		r.lastResult = nil
+	}
+	result, err := r.Regex.Search(input)
+	if err != nil {
+		return nil, err
+	}
+	r.lastInput, r.lastResult = input, result
+	return sharedResult{result}, nil
+}
+
+func (r *sharedRegex) Free() {
+	r.refs--
+	if r.refs > 0 {
+		return
+	}
+	if r.lastResult != nil {
+		r.lastResult.Free()
+		r.lastResult = nil
+	}
+	r.Regex.Free()
+}
+
+func (sharedResult) Free() {}
+
+// MatchAll returns a Regex that matches everything and has no capture groups, for metrics without a match pattern.
+func MatchAll() Regex {
+	return matchAll{}
+}
+
+func (matchAll) Search(input string) (SearchResult, error) {
+	return match{}, nil
+}
+
+func (matchAll) HasCaptureGroup(name string) bool {
+	return false
+}
+
+func (matchAll) NumberOfCaptureGroups(name string) int {
+	return 0
+}
+
+func (matchAll) CaptureType(name string) CaptureType {
+	return Untyped
+}
+
+func (matchAll) CaptureGroupNames() []string {
+	return nil
+}
+
+func (matchAll) Engine() RegexEngine {
+	return RE2 // doesn't need Oniguruma
+}
+
+func (matchAll) Free() {}
+
+func (match) IsMatch() bool {
+	return true
+}
+
+func (match) GetCaptureGroupByName(name string) (string, error) {
+	return "", fmt.Errorf("%v: no such capture group in pattern", name)
+}
+
+func (match) Free() {}
+
+func (noMatch) IsMatch() bool {
+	return false
+}
+
+func (noMatch) GetCaptureGroupByName(name string) (string, error) {
+	return "", nil // no match -> no capture group
+}
+
+func (noMatch) Free() {}
+
+type re2Regex struct {
+	regex  *regexp.Regexp
+	groups map[string][]int // capture group name -> group numbers, as names may be used more than once
+	types  map[string]CaptureType
+	names  []string
+}
+
+type re2SearchResult struct {
+	regex   *re2Regex
+	indexes []int // as returned by regexp.FindStringSubmatchIndex(), nil if there is no match
+	input   string
+}
+
+func compileRE2(regex string, strict bool) (*re2Regex, error) {
+	translated, err := re2Syntax(regex, strict)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := regexp.Compile(translated)
+	if err != nil {
+		return nil, err
+	}
+	result := &re2Regex{
+		regex:  compiled,
+		groups: make(map[string][]int),
+	}
+	for i, name := range compiled.SubexpNames() {
+		if name != "" {
+			if len(result.groups[name]) == 0 {
+				result.names = append(result.names, name)
+			}
+			result.groups[name] = append(result.groups[name], i)
+		}
+	}
+	return result, nil
+}
+
+func (r *re2Regex) Search(input string) (SearchResult, error) {
+	return &re2SearchResult{
+		regex:   r,
+		indexes: r.regex.FindStringSubmatchIndex(input),
+		input:   input,
+	}, nil
+}
+
+func (r *re2Regex) HasCaptureGroup(name string) bool {
+	return r.NumberOfCaptureGroups(name) > 0
+}
+
+func (r *re2Regex) NumberOfCaptureGroups(name string) int {
+	return len(r.groups[name])
+}
+
+func (r *re2Regex) CaptureType(name string) CaptureType {
+	return r.types[name]
+}
+
+func (r *re2Regex) CaptureGroupNames() []string {
+	return r.names
+}
+
+func (r *re2Regex) Engine() RegexEngine {
+	return RE2
+}
+
+func (r *re2Regex) Free() {
+	// nothing to do, the regex is garbage collected
+}
+
+func (m *re2SearchResult) IsMatch() bool {
+	return m.indexes != nil
+}
+
+// GetCaptureGroupByName returns the first non-empty capture group with that name, like oniguruma.SearchResult.
+func (m *re2SearchResult) GetCaptureGroupByName(name string) (string, error) {
+	if !m.IsMatch() {
+		return "", nil // no match -> no capture group
+	}
+	groupNums, ok := m.regex.groups[name]
+	if !ok {
+		return "", fmt.Errorf("%v: no such capture group in pattern", name)
+	}
+	for _, groupNum := range groupNums {
+		beg, end := m.indexes[2*groupNum], m.indexes[2*groupNum+1]
+		if beg >= 0 && end > beg {
+			return m.input[beg:end], nil
+		}
+	}
+	return "", nil
+}
+
+func (m *re2SearchResult) Free() {
+	// nothing to do
+}
+
+// Character classes matching the same characters as Oniguruma's \w and \s for UTF-8.
+// Go's \w and \s only match ASCII characters.
+const (
+	re2WordChars  = `\p{L}\p{M}\p{Nd}\p{Pc}`
+	re2SpaceChars = `\t-\r\x{85}\p{Z}`
+)
+
+// re2Syntax converts a regular expression in Oniguruma's Ruby syntax to Go's regexp syntax, so that it matches the same strings.
+// An error is returned for Oniguruma's features that Go doesn't support, or that would silently match something else in Go,
+// like Ruby's {,n} quantifier, which would be a literal string in Go. Features that Go doesn't support in any syntax, like
+// look-behind or back references, are left as they are, so that regexp.Compile() fails.
+// Word boundaries \b cannot be converted, in Go they are between ASCII word characters and other characters.
+// If strict is true, they are an error. Otherwise, they are kept with Go's meaning.
+func re2Syntax(regex string, strict bool) (string, error) {
+	var (
+		result  strings.Builder
+		inClass = false
+	)
+	result.WriteString("(?m)") // like in Oniguruma, ^ and $ match at line breaks, like in multiline log records
+	for i := 0; i < len(regex); i++ {
+		c := regex[i]
+		switch {
+		case c == '\\' && i+1 < len(regex):
+			i++
+			switch e := regex[i]; {
+			case e == 'd':
+				result.WriteString(`\p{Nd}`)
+			case e == 'D':
+				result.WriteString(`\P{Nd}`)
+			case (e == 'w' || e == 's') && inClass:
+				result.WriteString(unicodeChars(e))
+			case e == 'w' || e == 's':
+				result.WriteString("[" + unicodeChars(e) + "]")
+			case (e == 'W' || e == 'S') && inClass:
+				return "", fmt.Errorf("\\%c in a character class is not supported", e)
+			case e == 'W' || e == 'S':
+				result.WriteString("[^" + unicodeChars(e+'a'-'A') + "]")
+			case e >= '1' && e <= '9':
+				return "", fmt.Errorf("back references are not supported")
+			case (e == 'b' || e == 'B') && strict && !inClass:
+				return "", fmt.Errorf("\\%c is not supported", e)
+			case e == 'Q':
+				return "", fmt.Errorf("\\Q is not supported") // Go would quote the following text, Oniguruma matches a Q
+			case (e == 'p' || e == 'P' || e == 'x') && strings.HasPrefix(regex[i+1:], "{"):
+				end := strings.IndexByte(regex[i:], '}')
+				if end < 0 {
+					end = len(regex[i:]) - 1
+				}
+				result.WriteByte('\\')
+				result.WriteString(regex[i : i+end+1]) // like \p{L}, this is not an interval
+				i += end
+			default:
+				result.WriteByte('\\')
+				result.WriteByte(e)
+			}
+		case inClass && c == '[':
+			return "", fmt.Errorf("nested character classes and POSIX bracket expressions are not supported")
+		case inClass && strings.HasPrefix(regex[i:], "&&"):
+			return "", fmt.Errorf("character class intersections are not supported")
+		case inClass && c == ']':
+			inClass = false
+			result.WriteByte(c)
+		case c == '[':
+			inClass = true
+			result.WriteByte(c)
+			if strings.HasPrefix(regex[i+1:], "^") {
+				i++
+				result.WriteByte('^')
+			}
+			if strings.HasPrefix(regex[i+1:], "]") {
+				i++
+				result.WriteByte(']') // a literal ] at the beginning of the character class
+			}
+		case !inClass && c == '(' && strings.HasPrefix(regex[i:], "(?"):
+			group, n := re2Group(regex[i:])
+			result.WriteString(group)
+			i += n - 1
+		case !inClass && c == '{':
+			end := strings.IndexByte(regex[i:], '}')
+			if end < 0 {
+				result.WriteByte(c)
+				continue
+			}
+			interval := regex[i+1 : i+end]
+			if strings.HasPrefix(interval, ",") {
+				return "", fmt.Errorf("{,n} is not supported")
+			}
+			if isDigits(interval) && strings.HasPrefix(regex[i+end+1:], "?") {
+				return "", fmt.Errorf("{n}? is not supported") // in Ruby syntax, this means the interval is optional
+			}
+			result.WriteByte(c)
+		default:
+			result.WriteByte(c)
+		}
+	}
+	return result.String(), nil
+}
+
+// re2Group converts the beginning of a group that starts with (? like (?<name> or (?i: and returns how many bytes were converted.
+func re2Group(regex string) (string, int) {
+	if strings.HasPrefix(regex, "(?<") {
+		end := strings.IndexByte(regex, '>')
+		if end > 3 && isName(regex[3:end]) {
+			return "(?P<" + regex[3:end+1], end + 1
+		}
+		return "(?<", 3 // like look-behind (?<=, which is not supported and makes regexp.Compile() fail
+	}
+	for n := 2; n < len(regex); n++ {
+		switch c := regex[n]; {
+		case c == ':' || c == ')':
+			// The m option means that . matches line breaks in Oniguruma's Ruby syntax, which is option s in Go.
+			return strings.Replace(regex[:n+1], "m", "s", -1), n + 1
+		case c != '-' && (c < 'a' || c > 'z'):
+			return "(?", 2 // like (?= or (?>, which are not supported and make regexp.Compile() fail
+		}
+	}
+	return "(?", 2
+}
+
+var captureGroupRegex = regexp.MustCompile(`\(\?<([A-Za-z_][A-Za-z0-9_]*)>`)
+
+// captureGroupNames returns the names of the named groups (?<name>...) in an Oniguruma regular expression, each name once.
+func captureGroupNames(regex string) []string {
+	var (
+		result []string
+		found  = make(map[string]bool)
+	)
+	for _, match := range captureGroupRegex.FindAllStringSubmatchIndex(regex, -1) {
+		backslashes := 0
+		for i := match[0] - 1; i >= 0 && regex[i] == '\\'; i-- {
+			backslashes++
+		}
+		if backslashes%2 == 1 {
+			continue // escaped parenthesis, like \(?<x>
+		}
+		name := regex[match[2]:match[3]]
+		if !found[name] {
+			found[name] = true
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+func unicodeChars(escape byte) string {
+	if escape == 'w' {
+		return re2WordChars
+	}
+	return re2SpaceChars
+}
+
+func isName(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
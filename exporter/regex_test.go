@@ -0,0 +1,228 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRE2Syntax(t *testing.T) {
+	for _, data := range []struct {
+		regex, expected string
+	}{
+		{`(?<user>[a-z]+) (?<id>\d+)`, `(?m)(?P<user>[a-z]+) (?P<id>\p{Nd}+)`},
+		{`\w+\s\W\S`, `(?m)[\p{L}\p{M}\p{Nd}\p{Pc}]+[\t-\r\x{85}\p{Z}][^\p{L}\p{M}\p{Nd}\p{Pc}][^\t-\r\x{85}\p{Z}]`},
+		{`[\w.-]+`, `(?m)[\p{L}\p{M}\p{Nd}\p{Pc}.-]+`},
+		{`[^]a]\[\]`, `(?m)[^]a]\[\]`},
+		{`(?i:error)|(?m:a.b)|(?-m)`, `(?m)(?i:error)|(?s:a.b)|(?-s)`},
+		{`a{2,3}b{2}c{2,}?\p{L}\x{41}?`, `(?m)a{2,3}b{2}c{2,}?\p{L}\x{41}?`},
+		{`(?:a)(?<![0-9])(?>a)`, `(?m)(?:a)(?<![0-9])(?>a)`}, // Go's regexp.Compile() rejects look-behind and atomic groups
+	} {
+		result, err := re2Syntax(data.regex, true)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", data.regex, err)
+		}
+		if result != data.expected {
+			t.Fatalf("%v: expected %v but got %v", data.regex, data.expected, result)
+		}
+	}
+	for _, regex := range []string{`(a)\1`, `[[:alpha:]]`, `[a-z&&[^aeiou]]`, `[\W]`, `a{,3}`, `a{3}?`, `\Qa.b\E`} {
+		_, err := re2Syntax(regex, true)
+		if err == nil {
+			t.Fatalf("%v: expected error", regex)
+		}
+	}
+	// Go's word boundaries are for ASCII word characters only
+	_, err := re2Syntax(`\bword\b`, true)
+	if err == nil {
+		t.Fatal("expected error for \\b")
+	}
+	result, err := re2Syntax(`\bword\b`, false)
+	if err != nil || result != `(?m)\bword\b` {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+}
+
+func TestRegexEngines(t *testing.T) {
+	patterns := loadPatternDir(t)
+	for _, data := range []struct {
+		pattern string
+		engine  RegexEngine // expected engine for Auto
+		re2     bool        // true if the pattern can be compiled with RE2
+		lines   []string
+	}{
+		{
+			pattern: `^user %{USER:user} id %{INT:id}$`,
+			engine:  RE2,
+			re2:     true,
+			lines:   []string{"user alice id 3", "user jürgen id 3", "user bob id x", "user bob id 3\nuser charly id 4"},
+		},
+		{
+			pattern: `user=%{USER:user}( id=%{INT:id})?(?m:.*)end`,
+			engine:  RE2,
+			re2:     true,
+			lines:   []string{"user=alice end", "user=bob id=-42\nend", "user=charly id=x end", "id=3"},
+		},
+		{
+			pattern: `%{LOGLEVEL:level} \[%{DATA:thread}\] %{GREEDYDATA:message}`,
+			engine:  RE2,
+			re2:     true,
+			lines:   []string{"2020-01-01 ERROR [main] failed: ａｂｃ", "Info [] ok", "debug main ok"},
+		},
+		{
+			pattern: `%{WORD:user} logged in from %{HOSTNAME:host}`,
+			engine:  Oniguruma, // uses \b
+			re2:     true,
+			lines:   []string{"alice logged in from example.com", "jürgen logged in from 10.0.0.1.", "ｊｏｅ logged in from x", "logged in from example.com"},
+		},
+		{
+			pattern: `%{IP:client} %{NUMBER:duration}`,
+			engine:  Oniguruma, // uses look-behind
+			re2:     false,
+			lines:   []string{"10.1.2.3 0.25", "::1 3", "a 3"},
+		},
+	} {
+		onig, err := Compile(data.pattern, patterns, Oniguruma)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auto, err := Compile(data.pattern, patterns, Auto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auto.Engine() != data.engine {
+			t.Fatalf("%v: expected engine %v but got %v", data.pattern, data.engine, auto.Engine())
+		}
+		_, err = Compile(data.pattern, patterns, RE2)
+		if data.re2 && err != nil {
+			t.Fatalf("%v: unexpected error: %v", data.pattern, err)
+		}
+		if !data.re2 && (err == nil || !strings.Contains(err.Error(), "re2")) {
+			t.Fatalf("%v: expected error, but got %v", data.pattern, err)
+		}
+		for _, line := range data.lines {
+			expectSameResult(t, data.pattern, onig, auto, line)
+		}
+		onig.Free()
+		auto.Free()
+	}
+}
+
+func expectSameResult(t *testing.T, pattern string, expected, actual Regex, line string) {
+	expectedResult, err := expected.Search(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expectedResult.Free()
+	actualResult, err := actual.Search(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer actualResult.Free()
+	if expectedResult.IsMatch() != actualResult.IsMatch() {
+		t.Fatalf("%v: %q: expected match %v but got %v", pattern, line, expectedResult.IsMatch(), actualResult.IsMatch())
+	}
+	for _, field := range []string{"user", "host", "id", "level", "thread", "message", "client", "duration"} {
+		if !expected.HasCaptureGroup(field) {
+			continue
+		}
+		expectedValue, err := expectedResult.GetCaptureGroupByName(field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actualValue, err := actualResult.GetCaptureGroupByName(field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expectedValue != actualValue {
+			t.Fatalf("%v: %q: expected %v=%q but got %q", pattern, line, field, expectedValue, actualValue)
+		}
+	}
+}
+
+type countingRegex struct {
+	Regex
+	searches int
+	frees    int
+}
+
+func (r *countingRegex) Search(input string) (SearchResult, error) {
+	r.searches++
+	return r.Regex.Search(input)
+}
+
+func (r *countingRegex) Free() {
+	r.frees++
+	r.Regex.Free()
+}
+
+func TestShared(t *testing.T) {
+	regex, err := Compile(`%{WORD:method} %{NUMBER:bytes}`, loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingRegex{Regex: regex}
+	shared := Shared(counting)
+	defer shared.Free()
+	for _, data := range []struct {
+		line, expected string
+	}{
+		{"GET 512", "512"},
+		{"GET 512", "512"},
+		{"POST 1024", "1024"},
+	} {
+		for i := 0; i < 3; i++ { // like three metrics of a metrics.metrics block
+			searchResult, err := shared.Search(data.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bytes, err := searchResult.GetCaptureGroupByName("bytes")
+			if err != nil || bytes != data.expected {
+				t.Fatalf("%v: expected bytes %v, but got %v, %v", data.line, data.expected, bytes, err)
+			}
+			searchResult.Free()
+		}
+	}
+	if counting.searches != 2 {
+		t.Fatalf("expected 2 searches, but got %v", counting.searches)
+	}
+}
+
+func TestSharedFree(t *testing.T) {
+	regex, err := Compile(`%{WORD:method} %{NUMBER:bytes}`, loadPatternDir(t), Oniguruma)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingRegex{Regex: regex}
+	first := Shared(counting)
+	second := Shared(first) // like the second metric of a metrics.metrics block
+	if first != second {
+		t.Fatalf("expected the metrics to share the regex")
+	}
+	first.Free()
+	searchResult, err := second.Search("GET 512")
+	if err != nil || !searchResult.IsMatch() {
+		t.Fatalf("expected the regex to match after the first metric was freed, but got %v", err)
+	}
+	searchResult.Free()
+	if counting.frees != 0 {
+		t.Fatalf("expected the regex to be freed with the last metric, but it was freed %v times", counting.frees)
+	}
+	second.Free()
+	if counting.frees != 1 {
+		t.Fatalf("expected the regex to be freed once, but it was freed %v times", counting.frees)
+	}
+}
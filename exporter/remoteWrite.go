@@ -0,0 +1,378 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/fstab/grok_exporter/config/v3"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriter sends the metrics to a Prometheus remote write endpoint, like Mimir, Thanos Receive, or VictoriaMetrics,
+// for environments where grok_exporter cannot be scraped.
+type RemoteWriter struct {
+	cfg           config.RemoteWriteEndpointConfig
+	gatherer      prometheus.Gatherer
+	client        *http.Client
+	samples       prometheus.Counter
+	failedSamples prometheus.Counter
+	stop          chan struct{}
+	stopped       chan struct{}
+	mutex         sync.Mutex       // send() is called by the ticker and by Stop()
+	lastTimestamp map[string]int64 // samples with a log timestamp are only sent if the timestamp changed, see use_log_timestamp
+	now           func() time.Time // time.Now, except in tests
+}
+
+type remoteWriteSeries struct {
+	labels    []*io_prometheus_client.LabelPair // sorted by name, including __name__
+	value     float64
+	timestamp int64 // milliseconds
+}
+
+// NewRemoteWriters creates a RemoteWriter for each endpoint in the remote_write section, and registers the counters of the sent and failed samples.
+func NewRemoteWriters(cfg config.RemoteWriteConfig, gatherer prometheus.Gatherer, registry prometheus.Registerer) ([]*RemoteWriter, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	samples := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_remote_write_samples_total",
+		Help: "Number of samples sent to the remote_write url.",
+	}, []string{"url"})
+	failedSamples := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_remote_write_failed_samples_total",
+		Help: "Number of samples that could not be sent to the remote_write url and were dropped.",
+	}, []string{"url"})
+	registry.MustRegister(samples)
+	registry.MustRegister(failedSamples)
+	result := make([]*RemoteWriter, 0, len(cfg))
+	for _, endpoint := range cfg {
+		client, err := newRemoteWriteClient(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		urlLabel := redactedUrl(endpoint.URL)
+		result = append(result, &RemoteWriter{
+			cfg:           endpoint,
+			gatherer:      gatherer,
+			client:        client,
+			samples:       samples.WithLabelValues(urlLabel),
+			failedSamples: failedSamples.WithLabelValues(urlLabel),
+			stop:          make(chan struct{}),
+			stopped:       make(chan struct{}),
+			lastTimestamp: make(map[string]int64),
+			now:           time.Now,
+		})
+	}
+	return result, nil
+}
+
+func newRemoteWriteClient(cfg config.RemoteWriteEndpointConfig) (*http.Client, error) {
+	tlsCfg, err := newClientTLSConfig(cfg.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("remote_write %v: %v", redactedUrl(cfg.URL), err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return &http.Client{
+		Transport: transport,
+		Timeout:   cfg.RemoteTimeout,
+	}, nil
+}
+
+// newClientTLSConfig creates the TLS config for connecting to the remote_write and otlp endpoints.
+func newClientTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if len(cfg.CAFile) > 0 {
+		data, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %v", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("failed to read certificates from the ca_file")
+		}
+	}
+	if len(cfg.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading cert_file or key_file: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// Start sends the metrics every interval until Stop() is called.
+func (w *RemoteWriter) Start() {
+	go func() {
+		defer close(w.stopped)
+		ticker := time.NewTicker(w.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.send(w.stop)
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop sends the metrics a last time, so that the final values are not lost on shutdown or at the end of '-oneshot'.
+// The final send is not retried.
+func (w *RemoteWriter) Stop() {
+	close(w.stop)
+	<-w.stopped
+	w.send(nil)
+}
+
+// send gathers the metrics and sends them in batches of max_samples_per_send. A failed batch is retried
+// until the next interval, the retries are canceled when cancel is closed.
+func (w *RemoteWriter) send(cancel <-chan struct{}) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	metricFamilies, err := w.gatherer.Gather()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: remote_write %v: failed to gather metrics: %v\n", redactedUrl(w.cfg.URL), err)
+		if len(metricFamilies) == 0 {
+			return
+		}
+	}
+	series := w.toRemoteWriteSeries(metricFamilies)
+	deadline := w.now().Add(w.cfg.Interval)
+	for start := 0; start < len(series); start += w.cfg.QueueConfig.MaxSamplesPerSend {
+		end := start + w.cfg.QueueConfig.MaxSamplesPerSend
+		if end > len(series) {
+			end = len(series)
+		}
+		batch := series[start:end]
+		body := encodeWriteRequest(batch)
+		err = retryWithBackoff(func() (bool, error) {
+			return w.post(body)
+		}, w.cfg.QueueConfig.MinBackoff, w.cfg.QueueConfig.MaxBackoff, deadline, w.now, cancel)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: remote_write %v: dropping %v samples: %v\n", redactedUrl(w.cfg.URL), len(batch), err)
+			w.failedSamples.Add(float64(len(batch)))
+			continue
+		}
+		w.samples.Add(float64(len(batch)))
+	}
+}
+
+// toRemoteWriteSeries converts the metric families to samples like in the text format, i.e. histograms and summaries become
+// the _bucket, _sum, and _count series. Samples without a log timestamp get the current time.
+func (w *RemoteWriter) toRemoteWriteSeries(metricFamilies []*io_prometheus_client.MetricFamily) []remoteWriteSeries {
+	now := w.now().UnixNano() / int64(time.Millisecond)
+	var result []remoteWriteSeries
+	lastTimestamp := make(map[string]int64) // only the current series, so that deleted series are removed
+	defer func() {
+		w.lastTimestamp = lastTimestamp
+	}()
+	for _, metricFamily := range metricFamilies {
+		name := metricFamily.GetName()
+		for _, m := range metricFamily.Metric {
+			timestamp := now
+			if m.TimestampMs != nil {
+				key := seriesKey(name, m.Label)
+				last, exists := w.lastTimestamp[key]
+				lastTimestamp[key] = m.GetTimestampMs()
+				if exists && last == m.GetTimestampMs() {
+					continue // already sent, receivers reject duplicate samples
+				}
+				timestamp = m.GetTimestampMs()
+			}
+			add := func(suffix string, value float64, extraLabel ...string) {
+				labels := append([]*io_prometheus_client.LabelPair{labelPair("__name__", name+suffix)}, m.Label...)
+				if len(extraLabel) == 2 {
+					labels = append(labels, labelPair(extraLabel[0], extraLabel[1]))
+				}
+				sort.Slice(labels, func(i, j int) bool {
+					return labels[i].GetName() < labels[j].GetName()
+				})
+				result = append(result, remoteWriteSeries{labels: labels, value: value, timestamp: timestamp})
+			}
+			switch {
+			case m.Counter != nil:
+				add("", m.Counter.GetValue())
+			case m.Gauge != nil:
+				add("", m.Gauge.GetValue())
+			case m.Untyped != nil:
+				add("", m.Untyped.GetValue())
+			case m.Histogram != nil:
+				for _, bucket := range m.Histogram.Bucket {
+					add("_bucket", float64(bucket.GetCumulativeCount()), "le", formatFloat(bucket.GetUpperBound()))
+				}
+				add("_bucket", float64(m.Histogram.GetSampleCount()), "le", "+Inf")
+				add("_sum", m.Histogram.GetSampleSum())
+				add("_count", float64(m.Histogram.GetSampleCount()))
+			case m.Summary != nil:
+				for _, q := range m.Summary.Quantile {
+					add("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add("_sum", m.Summary.GetSampleSum())
+				add("_count", float64(m.Summary.GetSampleCount()))
+			}
+		}
+	}
+	return result
+}
+
+// retryWithBackoff calls f until it succeeds or returns retry=false, waiting minBackoff before the first retry and doubling
+// the wait for each retry up to maxBackoff. It gives up if the next retry would be after the deadline, or when cancel is closed.
+// If cancel is nil, f is not retried.
+func retryWithBackoff(f func() (retry bool, err error), minBackoff, maxBackoff time.Duration, deadline time.Time, now func() time.Time, cancel <-chan struct{}) error {
+	backoff := minBackoff
+	for {
+		retry, err := f()
+		if err == nil || !retry || cancel == nil || now().Add(backoff).After(deadline) {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-cancel:
+			return err
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// post returns retry=true for errors that might be temporary. Like in Prometheus, 5xx and 429 responses are retried,
+// other 4xx responses are not, because the receiver would reject the samples again.
+func (w *RemoteWriter) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(snappy.Encode(nil, body)))
+	if err != nil {
+		return false, err
+	}
+	for name, value := range w.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "grok_exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if len(w.cfg.BasicAuth.Username) > 0 {
+		password := w.cfg.BasicAuth.Password
+		if len(w.cfg.BasicAuth.PasswordFile) > 0 {
+			data, err := ioutil.ReadFile(w.cfg.BasicAuth.PasswordFile)
+			if err != nil {
+				return false, fmt.Errorf("failed to read password_file: %v", err)
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		req.SetBasicAuth(w.cfg.BasicAuth.Username, password)
+	}
+	if len(w.cfg.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+w.cfg.BearerToken)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("server returned HTTP status %v: %v", resp.Status, strings.TrimSpace(string(msg)))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// encodeWriteRequest encodes the prometheus.WriteRequest protobuf message of the remote write protocol:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []remoteWriteSeries) []byte {
+	var result []byte
+	for _, s := range series {
+		var ts []byte
+		for _, label := range s.labels {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label.GetName())
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label.GetValue())
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+		result = protowire.AppendTag(result, 1, protowire.BytesType)
+		result = protowire.AppendBytes(result, ts)
+	}
+	return result
+}
+
+func labelPair(name, value string) *io_prometheus_client.LabelPair {
+	return &io_prometheus_client.LabelPair{Name: &name, Value: &value}
+}
+
+func seriesKey(name string, labels []*io_prometheus_client.LabelPair) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, label := range labels {
+		sb.WriteString(fmt.Sprintf("\xff%v\xff%v", label.GetName(), label.GetValue()))
+	}
+	return sb.String()
+}
+
+// formatFloat formats the le and quantile labels like the text format, e.g. 0.5 and +Inf.
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// redactedUrl removes the password from the URL for log messages and labels.
+func redactedUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	return u.Redacted()
+}
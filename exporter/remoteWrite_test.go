@@ -0,0 +1,207 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/fstab/grok_exporter/config/v3"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		requests []string // decoded samples of each request
+		status   = []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusBadRequest}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if user, password, _ := r.BasicAuth(); user != "alice" || password != "secret" {
+			t.Errorf("unexpected basic auth %v:%v", user, password)
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Errorf("failed to decode snappy: %v", err)
+		}
+		requests = append(requests, decodeWriteRequest(t, data))
+		w.WriteHeader(status[0])
+		status = status[1:]
+	}))
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "lines_total", Help: "h"}, []string{"city"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "temperature", Help: "h", Buckets: []float64{10, 20}})
+	registry.MustRegister(counter, histogram)
+	counter.WithLabelValues("Berlin").Add(3)
+	histogram.Observe(15)
+
+	cfg := config.RemoteWriteEndpointConfig{
+		URL:           server.URL,
+		Interval:      time.Minute,
+		RemoteTimeout: time.Second,
+		BasicAuth:     config.BasicAuthConfig{Username: "alice", Password: "secret"},
+		QueueConfig: config.QueueConfig{
+			MaxSamplesPerSend: 5,
+			MinBackoff:        time.Millisecond,
+			MaxBackoff:        time.Millisecond,
+		},
+	}
+	writers, err := NewRemoteWriters(config.RemoteWriteConfig{cfg}, registry, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := writers[0]
+	writer.now = func() time.Time {
+		return time.Unix(1000, 0)
+	}
+	writer.send(make(chan struct{}))
+
+	// The first batch is retried after the 503, the second batch is dropped after the 400.
+	expected := []string{
+		`{__name__="lines_total", city="Berlin"} 3 @1000000, {__name__="temperature_bucket", le="10"} 0 @1000000, {__name__="temperature_bucket", le="20"} 1 @1000000, {__name__="temperature_bucket", le="+Inf"} 1 @1000000, {__name__="temperature_sum"} 15 @1000000`,
+		`{__name__="lines_total", city="Berlin"} 3 @1000000, {__name__="temperature_bucket", le="10"} 0 @1000000, {__name__="temperature_bucket", le="20"} 1 @1000000, {__name__="temperature_bucket", le="+Inf"} 1 @1000000, {__name__="temperature_sum"} 15 @1000000`,
+		`{__name__="temperature_count"} 1 @1000000`,
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected %v requests, but got %v: %v", len(expected), len(requests), requests)
+	}
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Errorf("request %v: expected %v, but got %v", i, expected[i], requests[i])
+		}
+	}
+	if sent, failed := counterValue(t, writer.samples), counterValue(t, writer.failedSamples); sent != 5 || failed != 1 {
+		t.Errorf("expected 5 sent and 1 failed sample, but got %v and %v", sent, failed)
+	}
+}
+
+func TestRemoteWriteLogTimestamps(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "temperature", Help: "h"})
+	gauge.Set(32)
+	timestamp := time.Unix(500, 0)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&timestampCollector{collector: gauge, timestamp: &timestamp})
+	writer := &RemoteWriter{gatherer: registry, lastTimestamp: make(map[string]int64), now: time.Now}
+	for i, expected := range []int{1, 0} {
+		metricFamilies, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if series := writer.toRemoteWriteSeries(metricFamilies); len(series) != expected || (expected > 0 && series[0].timestamp != 500000) {
+			t.Fatalf("send %v: expected %v samples with the log timestamp, but got %v", i, expected, series)
+		}
+	}
+}
+
+// timestampCollector adds the timestamp to the samples, like metrics with use_log_timestamp.
+type timestampCollector struct {
+	collector prometheus.Collector
+	timestamp *time.Time
+}
+
+func (c *timestampCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.collector.Describe(ch)
+}
+
+func (c *timestampCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric, 1)
+	c.collector.Collect(metrics)
+	close(metrics)
+	for m := range metrics {
+		ch <- prometheus.NewMetricWithTimestamp(*c.timestamp, m)
+	}
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	m := io_prometheus_client.Metric{}
+	if err := counter.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// decodeWriteRequest formats the samples of the WriteRequest message like {__name__="a", b="c"} 1 @1000, see encodeWriteRequest().
+func decodeWriteRequest(t *testing.T, data []byte) string {
+	var result []string
+	forEachField(t, data, func(num protowire.Number, value []byte) {
+		var (
+			labels []string
+			sample string
+		)
+		forEachField(t, value, func(num protowire.Number, value []byte) {
+			switch num {
+			case 1:
+				var name, labelValue string
+				forEachField(t, value, func(num protowire.Number, value []byte) {
+					if num == 1 {
+						name = string(value)
+					} else {
+						labelValue = string(value)
+					}
+				})
+				labels = append(labels, fmt.Sprintf("%v=%q", name, labelValue))
+			case 2:
+				v, _, n := protowire.ConsumeTag(value)
+				bits, m := protowire.ConsumeFixed64(value[n:])
+				_, _, k := protowire.ConsumeTag(value[n+m:])
+				timestamp, _ := protowire.ConsumeVarint(value[n+m+k:])
+				if v != 1 {
+					t.Fatalf("unexpected sample field %v", v)
+				}
+				sample = fmt.Sprintf("%v @%v", math.Float64frombits(bits), int64(timestamp))
+			}
+		})
+		if !sort.StringsAreSorted(labels) {
+			t.Errorf("labels are not sorted: %v", labels)
+		}
+		result = append(result, fmt.Sprintf("{%v} %v", strings.Join(labels, ", "), sample))
+	})
+	return strings.Join(result, ", ")
+}
+
+// forEachField calls f for each length-delimited field of the message.
+func forEachField(t *testing.T, data []byte, f func(num protowire.Number, value []byte)) {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 || typ != protowire.BytesType {
+			t.Fatalf("unexpected field type %v", typ)
+		}
+		value, m := protowire.ConsumeBytes(data[n:])
+		if m < 0 {
+			t.Fatalf("invalid field %v", num)
+		}
+		f(num, value)
+		data = data[n+m:]
+	}
+}
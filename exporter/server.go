@@ -85,35 +85,61 @@ XLgD9hrDBrTbnKBHHQ6MHpT6ILi4w/e4+5XEUUOBf44ZJE71uRr4ZUA=
 -----END RSA PRIVATE KEY-----
 `
 
-func RunHttpsServer(cfg config.ServerConfig, httpHandlers []HttpServerPathHandler) error {
-	err := tryOpenPort(cfg.Host, cfg.Port)
-	if err != nil {
-		return listenFailedError(cfg.Host, cfg.Port, err)
-	}
+// NewServeMux returns the handler for all listeners, so that each path is only registered once.
+func NewServeMux(httpHandlers []HttpServerPathHandler) *http.ServeMux {
+	mux := http.NewServeMux()
 	for _, httpHandler := range httpHandlers {
-		http.Handle(httpHandler.Path, httpHandler.Handler)
+		mux.Handle(httpHandler.Path, httpHandler.Handler)
+	}
+	return mux
+}
+
+func RunHttpsServer(cfg config.ListenerConfig, handler http.Handler) error {
+	ln, err := listen(cfg)
+	if err != nil {
+		return err
 	}
 	tlsCfg, err := makeTLSConfig(cfg)
 	if err != nil {
+		ln.Close()
 		return err
 	}
 	server := &http.Server{
-		Addr:      fmt.Sprintf("%v:%v", cfg.Host, cfg.Port),
+		Handler:   handler,
 		TLSConfig: tlsCfg,
 	}
-	return server.ListenAndServeTLS("", "")
+	return server.ServeTLS(ln, "", "")
 }
 
-func RunHttpServer(host string, port int, httpHandlers []HttpServerPathHandler) error {
-	err := tryOpenPort(host, port)
+func RunHttpServer(cfg config.ListenerConfig, handler http.Handler) error {
+	ln, err := listen(cfg)
 	if err != nil {
-		return listenFailedError(host, port, err)
-	}
-	for _, httpHandler := range httpHandlers {
-		http.Handle(httpHandler.Path, httpHandler.Handler)
+		return err
 	}
+	return http.Serve(ln, handler)
+}
 
-	return http.ListenAndServe(fmt.Sprintf("%v:%v", host, port), nil)
+func listen(cfg config.ListenerConfig) (net.Listener, error) {
+	if len(cfg.UnixSocket) > 0 {
+		// A socket file left over from a previous run would make the listen fail.
+		if info, err := os.Stat(cfg.UnixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(cfg.UnixSocket)
+		}
+		ln, err := net.Listen("unix", cfg.UnixSocket)
+		if err != nil {
+			return nil, fmt.Errorf("cannot listen on unix socket %v: %v", cfg.UnixSocket, err)
+		}
+		return ln, nil
+	}
+	err := tryOpenPort(cfg.Host, cfg.Port)
+	if err != nil {
+		return nil, listenFailedError(cfg.Host, cfg.Port, err)
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf("%v:%v", cfg.Host, cfg.Port))
+	if err != nil {
+		return nil, listenFailedError(cfg.Host, cfg.Port, err)
+	}
+	return ln, nil
 }
 
 // Golang's http.ListenAndServe() has an unexpected behaviour when the port is in use:
@@ -153,7 +179,7 @@ func createTempFile(prefix string, data []byte) (string, error) {
 }
 
 // Assuming serverCfg is valid.
-func makeTLSConfig(cfg config.ServerConfig) (*tls.Config, error) {
+func makeTLSConfig(cfg config.ListenerConfig) (*tls.Config, error) {
 	var (
 		result = &tls.Config{}
 		cert   tls.Certificate
@@ -187,14 +213,21 @@ func makeTLSConfig(cfg config.ServerConfig) (*tls.Config, error) {
 	switch cfg.ClientAuth {
 	case "RequestClientCert":
 		result.ClientAuth = tls.RequestClientCert
-	case "RequireClientCert":
+	case "RequireAnyClientCert":
 		result.ClientAuth = tls.RequireAnyClientCert
 	case "VerifyClientCertIfGiven":
 		result.ClientAuth = tls.VerifyClientCertIfGiven
 	case "RequireAndVerifyClientCert":
 		result.ClientAuth = tls.RequireAndVerifyClientCert
-	case "", "NoClientCert":
+	case "NoClientCert":
 		result.ClientAuth = tls.NoClientCert
+	case "":
+		// If a client_ca is configured, only clients with a valid certificate are allowed by default.
+		if len(cfg.ClientCA) > 0 {
+			result.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			result.ClientAuth = tls.NoClientCert
+		}
 	}
 	return result, nil
 }
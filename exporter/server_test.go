@@ -0,0 +1,60 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+
+	config "github.com/fstab/grok_exporter/config/v3"
+)
+
+func TestTLSClientAuth(t *testing.T) {
+	// The built-in certificate is self-signed, so it can be used as client CA in the test.
+	clientCA, err := createTempFile("client_ca", []byte(defaultCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(clientCA)
+	for _, data := range []struct {
+		clientCA   string
+		clientAuth string
+		expected   tls.ClientAuthType
+	}{
+		{"", "", tls.NoClientCert},
+		{clientCA, "", tls.RequireAndVerifyClientCert},
+		{clientCA, "NoClientCert", tls.NoClientCert},
+		{clientCA, "RequestClientCert", tls.RequestClientCert},
+		{clientCA, "RequireAnyClientCert", tls.RequireAnyClientCert},
+		{clientCA, "VerifyClientCertIfGiven", tls.VerifyClientCertIfGiven},
+		{clientCA, "RequireAndVerifyClientCert", tls.RequireAndVerifyClientCert},
+	} {
+		tlsCfg, err := makeTLSConfig(config.ListenerConfig{
+			Protocol:   "https",
+			ClientCA:   data.clientCA,
+			ClientAuth: data.clientAuth,
+		})
+		if err != nil {
+			t.Fatalf("client_auth '%v': unexpected error: %v", data.clientAuth, err)
+		}
+		if tlsCfg.ClientAuth != data.expected {
+			t.Errorf("client_auth '%v' with client_ca '%v': expected %v, but got %v", data.clientAuth, data.clientCA, data.expected, tlsCfg.ClientAuth)
+		}
+		if len(data.clientCA) > 0 && tlsCfg.ClientCAs == nil {
+			t.Errorf("client_auth '%v': client CA not loaded", data.clientAuth)
+		}
+	}
+}
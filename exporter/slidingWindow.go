@@ -0,0 +1,70 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// slidingWindow is the max_age window of distinct and aggregate metrics. Like the age buckets of a summary,
+// the window is divided into age_buckets sub-windows, and the oldest sub-window is cleared when the window moves forward.
+// The metrics keep their values in a slice with one entry per sub-window, index current is the one new values are added to.
+type slidingWindow struct {
+	size           int // number of sub-windows
+	bucketDuration time.Duration
+	current        int
+	currentExpiry  time.Time // when the window moves forward to the next sub-window
+}
+
+// newSlidingWindow uses the defaults of summaries if maxAge or ageBuckets is 0.
+func newSlidingWindow(now time.Time, maxAge time.Duration, ageBuckets int) slidingWindow {
+	if maxAge == 0 {
+		maxAge = prometheus.DefMaxAge
+	}
+	if ageBuckets == 0 {
+		ageBuckets = prometheus.DefAgeBuckets
+	}
+	bucketDuration := maxAge / time.Duration(ageBuckets)
+	return slidingWindow{
+		size:           ageBuckets,
+		bucketDuration: bucketDuration,
+		currentExpiry:  now.Add(bucketDuration),
+	}
+}
+
+// rotate moves the window forward to now, reset is called for each sub-window that is cleared.
+func (w *slidingWindow) rotate(now time.Time, reset func(bucket int)) {
+	for i := 0; !now.Before(w.currentExpiry); i++ {
+		if i >= w.size {
+			// All sub-windows expired, move the window directly to now.
+			w.currentExpiry = w.currentExpiry.Add(now.Sub(w.currentExpiry).Truncate(w.bucketDuration) + w.bucketDuration)
+			break
+		}
+		w.current = (w.current + 1) % w.size
+		reset(w.current)
+		w.currentExpiry = w.currentExpiry.Add(w.bucketDuration)
+	}
+}
+
+// orderedLabelValues returns the values of the labels in the order of the labelNames, for prometheus.MustNewConstMetric().
+func orderedLabelValues(labelNames []string, labels map[string]string) []string {
+	result := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		result[i] = labels[name]
+	}
+	return result
+}
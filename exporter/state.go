@@ -0,0 +1,259 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v2"
+)
+
+type stateFileContent struct {
+	Metrics map[string]metricState `yaml:"metrics"`
+}
+
+type metricState struct {
+	Type   string        `yaml:"type"`
+	Series []seriesState `yaml:"series"`
+}
+
+type seriesState struct {
+	Labels map[string]string `yaml:"labels,omitempty"` // without the const_labels
+	Value  float64           `yaml:"value"`
+	// LastTotal is the last total in the log line for counters with value_is_total, so that the next total is not counted from zero.
+	LastTotal *float64 `yaml:"last_total,omitempty"`
+}
+
+// persistentMetric is implemented by the metrics whose values are saved in the global.state_file, i.e. counters and gauges.
+type persistentMetric interface {
+	state() (metricState, error)
+	restore(state metricState)
+}
+
+// LoadState restores the values of the counters and gauges from the state file written by SaveState().
+// Metrics that are no longer configured, and time series whose type or label names changed, are ignored.
+func LoadState(path string, metrics []Metric) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	content := &stateFileContent{}
+	err = yaml.Unmarshal(data, content)
+	if err != nil {
+		return fmt.Errorf("%v: invalid state file: %v", path, err)
+	}
+	for _, metric := range metrics {
+		state, exists := content.Metrics[metric.Name()]
+		if p, ok := metric.(persistentMetric); ok && exists {
+			p.restore(state)
+		}
+	}
+	return nil
+}
+
+// SaveState writes the values of the counters and gauges to the state file. The file is replaced atomically,
+// so that it is not corrupted if grok_exporter is killed while writing.
+func SaveState(path string, metrics []Metric) error {
+	content := &stateFileContent{
+		Metrics: make(map[string]metricState),
+	}
+	for _, metric := range metrics {
+		if p, ok := metric.(persistentMetric); ok {
+			state, err := p.state()
+			if err != nil {
+				return fmt.Errorf("failed to save the state of metric %v: %v", metric.Name(), err)
+			}
+			content.Metrics[metric.Name()] = state
+		}
+	}
+	data, err := yaml.Marshal(content)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	return nil
+}
+
+func (m *counterMetric) state() (metricState, error) {
+	series, err := collectSeries(m.counter, nil)
+	m.lastTotals.save(series)
+	return metricState{Type: "counter", Series: series}, err
+}
+
+func (m *counterMetric) restore(state metricState) {
+	if state.Type == "counter" && len(state.Series) == 1 && len(state.Series[0].Labels) == 0 && state.Series[0].Value >= 0 {
+		m.counter.Add(state.Series[0].Value)
+		m.lastTotals.restore(state.Series[0])
+	}
+}
+
+func (m *counterVecMetric) state() (metricState, error) {
+	series, err := collectSeries(m.counterVec, m.labelNames())
+	m.lastTotals.save(series)
+	return metricState{Type: "counter", Series: series}, err
+}
+
+func (m *counterVecMetric) restore(state metricState) {
+	if state.Type != "counter" {
+		return
+	}
+	m.restoreSeries(state.Series, func(labels map[string]string, value float64) bool {
+		counter, err := m.counterVec.GetMetricWith(labels)
+		if err != nil || value < 0 {
+			return false
+		}
+		counter.Add(value)
+		return true
+	})
+	for _, series := range state.Series {
+		if m.labelValueTracker.Contains(series.Labels) {
+			m.lastTotals.restore(series)
+		}
+	}
+}
+
+func (m *gaugeMetric) state() (metricState, error) {
+	series, err := collectSeries(m.gauge, nil)
+	return metricState{Type: "gauge", Series: series}, err
+}
+
+func (m *gaugeMetric) restore(state metricState) {
+	if state.Type == "gauge" && len(state.Series) == 1 && len(state.Series[0].Labels) == 0 {
+		m.gauge.Set(state.Series[0].Value)
+	}
+}
+
+func (m *gaugeVecMetric) state() (metricState, error) {
+	series, err := collectSeries(m.gaugeVec, m.labelNames())
+	return metricState{Type: "gauge", Series: series}, err
+}
+
+func (m *gaugeVecMetric) restore(state metricState) {
+	if state.Type != "gauge" {
+		return
+	}
+	m.restoreSeries(state.Series, func(labels map[string]string, value float64) bool {
+		gauge, err := m.gaugeVec.GetMetricWith(labels)
+		if err != nil {
+			return false
+		}
+		gauge.Set(value)
+		return true
+	})
+}
+
+// save sets the LastTotal of the series, nothing happens if t is nil, i.e. if the counter doesn't have value_is_total.
+func (t *lastTotals) save(series []seriesState) {
+	if t == nil {
+		return
+	}
+	for i := range series {
+		if total, ok := t.totals[labelsKey(series[i].Labels)]; ok {
+			series[i].LastTotal = &total
+		}
+	}
+}
+
+func (t *lastTotals) restore(series seriesState) {
+	if t != nil && series.LastTotal != nil {
+		t.totals[labelsKey(series.Labels)] = *series.LastTotal
+	}
+}
+
+func (m *metricWithLabels) labelNames() []string {
+	result := make([]string, 0, len(m.labelTemplates))
+	for _, t := range m.labelTemplates {
+		result = append(result, t.Name())
+	}
+	return result
+}
+
+// restoreSeries calls set for each time series within max_series, and observes the label values for retention and delete_match.
+// set returns false if the labels don't match the metric's labels.
+func (m *metricWithLabels) restoreSeries(series []seriesState, set func(labels map[string]string, value float64) bool) {
+	for _, s := range series {
+		if m.maxSeries > 0 && m.labelValueTracker.Len() >= m.maxSeries {
+			return
+		}
+		if len(s.Labels) != len(m.labelTemplates) || !set(s.Labels, s.Value) {
+			continue
+		}
+		m.labelValueTracker.Observe(s.Labels)
+	}
+}
+
+// collectSeries returns the values of the counter or gauge collector. Only the labels in labelNames are kept, so the const_labels are removed.
+func collectSeries(collector prometheus.Collector, labelNames []string) ([]seriesState, error) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+	var (
+		result []seriesState
+		err    error
+	)
+	for collected := range ch {
+		m := io_prometheus_client.Metric{}
+		if writeErr := collected.Write(&m); writeErr != nil {
+			err = writeErr
+			continue
+		}
+		series := seriesState{
+			Value: m.GetGauge().GetValue(),
+		}
+		if m.Counter != nil {
+			series.Value = m.Counter.GetValue()
+		}
+		for _, label := range m.Label {
+			for _, name := range labelNames {
+				if label.GetName() == name {
+					if series.Labels == nil {
+						series.Labels = make(map[string]string)
+					}
+					series.Labels[name] = label.GetValue()
+				}
+			}
+		}
+		result = append(result, series)
+	}
+	return result, err
+}
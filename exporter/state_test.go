@@ -0,0 +1,134 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.yml")
+	regex := initGaugeRegex(t)
+	newMetrics := func() []Metric {
+		return []Metric{
+			NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+				Name: "measurements_total",
+				Labels: map[string]string{
+					"city": "{{.city}}",
+				},
+				ConstLabels: map[string]string{
+					"app": "weather",
+				},
+			}), regex, nil),
+			NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+				Name:         "temperature_sum_total",
+				Value:        "{{.temperature}}",
+				ValueIsTotal: true,
+			}), regex, nil),
+			NewGaugeMetric(newMetricConfig(t, &configuration.MetricConfig{
+				Name:  "temperature",
+				Value: "{{.temperature}}",
+				Labels: map[string]string{
+					"city": "{{.city}}",
+				},
+			}), regex, nil),
+		}
+	}
+	metrics := newMetrics()
+	if err = LoadState(path, metrics); err != nil {
+		t.Fatalf("expected no error if the state file does not exist, but got %v", err)
+	}
+	for _, line := range []string{"Temperature in Berlin: 32", "Temperature in Moscow: 10", "Temperature in Berlin: 31"} {
+		for _, metric := range metrics {
+			if _, err = metric.ProcessMatch(line, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = SaveState(path, metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newMetrics()
+	if err = LoadState(path, restarted); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]float64{
+		"measurements_total":    {"Berlin": 2, "Moscow": 1},
+		"temperature_sum_total": {"": 63}, // 32, then 10 because the total decreased, then 21
+		"temperature":           {"Berlin": 31, "Moscow": 10},
+	}
+	for _, metric := range restarted {
+		if actual := collectValues(t, metric); !equalValues(actual, expected[metric.Name()]) {
+			t.Errorf("%v: expected %v after restart, but got %v", metric.Name(), expected[metric.Name()], actual)
+		}
+	}
+	// The last total is restored, so the value_is_total counter increases by the difference only.
+	if _, err = restarted[1].ProcessMatch("Temperature in Berlin: 35", nil); err != nil {
+		t.Fatal(err)
+	}
+	if actual := collectValues(t, restarted[1]); actual[""] != 67 {
+		t.Errorf("expected 67 after the next total, but got %v", actual[""])
+	}
+}
+
+// collectValues maps the city label to the value.
+func collectValues(t *testing.T, metric Metric) map[string]float64 {
+	ch := make(chan prometheus.Metric, 10)
+	metric.Collector().Collect(ch)
+	close(ch)
+	result := make(map[string]float64)
+	for collected := range ch {
+		m := io_prometheus_client.Metric{}
+		if err := collected.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		city := ""
+		for _, label := range m.Label {
+			if label.GetName() == "city" {
+				city = label.GetValue()
+			}
+		}
+		result[city] = m.GetCounter().GetValue()
+		if m.Gauge != nil {
+			result[city] = m.Gauge.GetValue()
+		}
+	}
+	return result
+}
+
+func equalValues(a, b map[string]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
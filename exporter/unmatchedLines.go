@@ -0,0 +1,91 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// UnmatchedLinesPath is the path of the endpoint listing the recent lines that matched no metric, see server.unmatched_lines.
+const UnmatchedLinesPath = "/debug/unmatched"
+
+type UnmatchedLine struct {
+	Time  time.Time `json:"time"`
+	Input string    `json:"input"`
+	File  string    `json:"file,omitempty"`
+	Line  string    `json:"line"`
+}
+
+// UnmatchedLines keeps the most recent lines that matched no metric in a ring buffer, and counts the unmatched lines per input.
+// Lines are added by the main loop and read by the HTTP handler, so access is synchronized.
+type UnmatchedLines struct {
+	mutex  sync.Mutex
+	lines  []UnmatchedLine
+	next   int // index in lines where the next line is stored, once the buffer is full
+	counts map[string]uint64
+}
+
+func NewUnmatchedLines(size int) *UnmatchedLines {
+	return &UnmatchedLines{
+		lines:  make([]UnmatchedLine, 0, size),
+		counts: make(map[string]uint64),
+	}
+}
+
+// Add stores the line, replacing the oldest line if the buffer is full.
+func (u *UnmatchedLines) Add(input, file, line string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.counts[input]++
+	unmatched := UnmatchedLine{Time: time.Now(), Input: input, File: file, Line: line}
+	if len(u.lines) < cap(u.lines) {
+		u.lines = append(u.lines, unmatched)
+		return
+	}
+	u.lines[u.next] = unmatched
+	u.next = (u.next + 1) % len(u.lines)
+}
+
+// Lines returns the stored lines, oldest first, and the number of unmatched lines per input since grok_exporter was started.
+func (u *UnmatchedLines) Lines() ([]UnmatchedLine, map[string]uint64) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	lines := make([]UnmatchedLine, 0, len(u.lines))
+	lines = append(lines, u.lines[u.next:]...)
+	lines = append(lines, u.lines[:u.next]...)
+	counts := make(map[string]uint64, len(u.counts))
+	for input, count := range u.counts {
+		counts[input] = count
+	}
+	return lines, counts
+}
+
+// ServeHTTP responds with the stored lines and the counts per input as JSON.
+func (u *UnmatchedLines) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lines, counts := u.Lines()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Counts map[string]uint64 `json:"counts"`
+		Lines  []UnmatchedLine   `json:"lines"`
+	}{counts, lines})
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestUnmatchedLines(t *testing.T) {
+	unmatched := NewUnmatchedLines(2)
+	unmatched.Add("app", "/var/log/app.log", "line 1")
+	unmatched.Add("app", "/var/log/app.log", "line 2")
+	unmatched.Add("syslog", "", "line 3")
+	lines, counts := unmatched.Lines()
+	if len(lines) != 2 || lines[0].Line != "line 2" || lines[1].Line != "line 3" || lines[1].Input != "syslog" {
+		t.Fatalf("expected the two most recent lines, but got %v", lines)
+	}
+	if !reflect.DeepEqual(counts, map[string]uint64{"app": 2, "syslog": 1}) {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+	recorder := httptest.NewRecorder()
+	unmatched.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, UnmatchedLinesPath, nil))
+	var response struct {
+		Counts map[string]uint64
+		Lines  []UnmatchedLine
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Counts["app"] != 2 || len(response.Lines) != 2 || response.Lines[0].File != "/var/log/app.log" {
+		t.Fatalf("unexpected response %v", recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	unmatched.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, UnmatchedLinesPath, nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %v for POST, but got %v", http.StatusMethodNotAllowed, recorder.Code)
+	}
+}
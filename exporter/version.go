@@ -22,14 +22,15 @@ import (
 // The following strings are populated during build time with release.sh:
 // go build -ldflags "-X importpath.name=value"
 var (
-	Version   string
-	BuildDate string
-	Branch    string
-	Revision  string
-	GoVersion = runtime.Version()
-	Platform  = runtime.GOOS + "-" + runtime.GOARCH
+	Version         string
+	BuildDate       string
+	Branch          string
+	Revision        string
+	PatternsVersion string // logstash-patterns-core version in the release's patterns directory
+	GoVersion       = runtime.Version()
+	Platform        = runtime.GOOS + "-" + runtime.GOARCH
 )
 
 func VersionString() string {
-	return fmt.Sprintf("grok_exporter version: %v (build date: %v, branch: %v, revision: %v, go version: %v, platform: %v)", Version, BuildDate, Branch, Revision, GoVersion, Platform)
+	return fmt.Sprintf("grok_exporter version: %v (build date: %v, branch: %v, revision: %v, patterns version: %v, go version: %v, platform: %v)", Version, BuildDate, Branch, Revision, PatternsVersion, GoVersion, Platform)
 }
@@ -0,0 +1,429 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package geoip reads MaxMind DB files like GeoLite2-City.mmdb and GeoLite2-ASN.mmdb,
+// see https://maxmind.github.io/MaxMind-DB/ for the file format.
+package geoip
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strconv"
+)
+
+// The metadata is at the end of the file, after the last occurrence of this marker.
+var metadataStartMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// The data section starts after the search tree and 16 zero bytes.
+const dataSectionSeparatorSize = 16
+
+// Fields are the values that can be looked up, with their path in the GeoIP2 and GeoLite2 records.
+var fields = map[string][]interface{}{
+	"country":      {"country", "iso_code"},
+	"country_name": {"country", "names", "en"},
+	"continent":    {"continent", "code"},
+	"subdivision":  {"subdivisions", 0, "iso_code"},
+	"city":         {"city", "names", "en"},
+	"asn":          {"autonomous_system_number"},
+	"asn_org":      {"autonomous_system_organization"},
+}
+
+// IsField is true for the field names supported by LookupField, like "country" or "asn".
+func IsField(field string) bool {
+	_, ok := fields[field]
+	return ok
+}
+
+type Reader struct {
+	path         string
+	buffer       []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	ipv4Start    uint // the node for ::/96 in IPv6 databases, where IPv4 addresses are stored
+	dataSection  []byte
+}
+
+// Open reads the database file into memory.
+func Open(path string) (*Reader, error) {
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geoip database: %v", err.Error())
+	}
+	r, err := newReader(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read geoip database %v: %v", path, err.Error())
+	}
+	r.path = path
+	return r, nil
+}
+
+func newReader(buffer []byte) (*Reader, error) {
+	metadataStart := bytes.LastIndex(buffer, metadataStartMarker)
+	if metadataStart < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB file: metadata not found")
+	}
+	metadataStart += len(metadataStartMarker)
+	metadata, _, err := (&decoder{buffer: buffer[metadataStart:]}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err.Error())
+	}
+	metadataMap, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata: expected a map")
+	}
+	r := &Reader{buffer: buffer}
+	for key, result := range map[string]*uint{"node_count": &r.nodeCount, "record_size": &r.recordSize, "ip_version": &r.ipVersion} {
+		value, ok := metadataMap[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("invalid metadata: %v is missing", key)
+		}
+		*result = uint(value)
+	}
+	r.databaseType, _ = metadataMap["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %v", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %v", r.ipVersion)
+	}
+	searchTreeSize := r.nodeCount * r.recordSize / 4
+	if searchTreeSize+dataSectionSeparatorSize > uint(metadataStart-len(metadataStartMarker)) {
+		return nil, fmt.Errorf("invalid metadata: the search tree is larger than the file")
+	}
+	r.dataSection = buffer[searchTreeSize+dataSectionSeparatorSize : metadataStart-len(metadataStartMarker)]
+	if r.ipVersion == 6 {
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.readRecord(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+func (r *Reader) Path() string {
+	return r.path
+}
+
+// DatabaseType is the type from the metadata, like "GeoLite2-City".
+func (r *Reader) DatabaseType() string {
+	return r.databaseType
+}
+
+// LookupField returns the field for the IP address, like "DE" for the "country" field.
+// The result is false if the IP address or the field is not in the database.
+func (r *Reader) LookupField(ip net.IP, field string) (string, bool, error) {
+	path, ok := fields[field]
+	if !ok {
+		return "", false, fmt.Errorf("unknown geoip field %v", field)
+	}
+	offset, found, err := r.lookupOffset(ip)
+	if err != nil || !found {
+		return "", false, err
+	}
+	d := &decoder{buffer: r.dataSection}
+	return d.decodePath(offset, path)
+}
+
+// lookupOffset walks the search tree and returns the offset of the IP's record in the data section.
+func (r *Reader) lookupOffset(ip net.IP) (uint, bool, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return 0, false, nil
+	}
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.readRecord(node, bit)
+	}
+	switch {
+	case node == r.nodeCount: // empty record
+		return 0, false, nil
+	case node > r.nodeCount:
+		offset := node - r.nodeCount - dataSectionSeparatorSize
+		if offset >= uint(len(r.dataSection)) {
+			return 0, false, fmt.Errorf("invalid search tree: data offset %v is out of range", offset)
+		}
+		return offset, true, nil
+	default:
+		return 0, false, nil // address shorter than the tree, cannot happen for valid databases
+	}
+}
+
+// readRecord returns the left (bit 0) or right (bit 1) record of the node.
+func (r *Reader) readRecord(node, bit uint) uint {
+	b := r.buffer[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b = b[bit*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+// Data types in the data section.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+type decoder struct {
+	buffer []byte
+}
+
+// decodeControl returns the type, the size, and the offset of the value after the control byte.
+// For pointers, the size is the pointer value.
+func (d *decoder) decodeControl(offset uint) (int, uint, uint, error) {
+	b, offset, err := d.read(offset, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	dataType := int(b[0] >> 5)
+	if dataType == typePointer {
+		pointerSize := uint(b[0]>>3) & 0x3
+		p, offset, err := d.read(offset, pointerSize+1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		prefix := uint(b[0] & 0x7)
+		if pointerSize == 3 {
+			prefix = 0
+		}
+		pointer := toUint(prefix, p)
+		pointer += []uint{0, 2048, 526336, 0}[pointerSize]
+		return dataType, pointer, offset, nil
+	}
+	if dataType == typeExtended {
+		var t []byte
+		t, offset, err = d.read(offset, 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		dataType = int(t[0]) + 7
+	}
+	size := uint(b[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		var s []byte
+		s, offset, err = d.read(offset, n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		size = toUint(0, s) + []uint{0, 29, 285, 65821}[n]
+	}
+	return dataType, size, offset, nil
+}
+
+// decodePath follows the map keys and array indexes in path, and returns the value at the end of the path as a string.
+func (d *decoder) decodePath(offset uint, path []interface{}) (string, bool, error) {
+	for _, elem := range path {
+		dataType, size, next, err := d.decodeControl(offset)
+		if err != nil {
+			return "", false, err
+		}
+		if dataType == typePointer {
+			dataType, size, next, err = d.decodeControl(size)
+			if err != nil {
+				return "", false, err
+			}
+		}
+		found := false
+		switch key := elem.(type) {
+		case string:
+			if dataType != typeMap {
+				return "", false, nil
+			}
+			for i := uint(0); i < size && !found; i++ {
+				var k interface{}
+				k, next, err = d.decode(next)
+				if err != nil {
+					return "", false, err
+				}
+				if k == key {
+					offset, found = next, true
+				} else if next, err = d.skip(next); err != nil {
+					return "", false, err
+				}
+			}
+		case int:
+			if dataType != typeArray || uint(key) >= size {
+				return "", false, nil
+			}
+			for i := 0; i < key; i++ {
+				if next, err = d.skip(next); err != nil {
+					return "", false, err
+				}
+			}
+			offset, found = next, true
+		}
+		if !found {
+			return "", false, nil
+		}
+	}
+	value, _, err := d.decode(offset)
+	if err != nil {
+		return "", false, err
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true, nil
+	case uint64:
+		return strconv.FormatUint(v, 10), true, nil
+	case int64:
+		return strconv.FormatInt(v, 10), true, nil
+	case map[string]interface{}, []interface{}:
+		return "", false, nil
+	default:
+		return fmt.Sprint(v), true, nil
+	}
+}
+
+// decode returns the value at offset, and the offset after the value.
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	dataType, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if dataType == typePointer {
+		value, _, err := d.decode(size)
+		return value, offset, err
+	}
+	switch dataType {
+	case typeMap:
+		result := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("invalid data section: map key is not a string")
+			}
+			result[keyString] = value
+		}
+		return result, offset, nil
+	case typeArray:
+		result := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			result = append(result, value)
+		}
+		return result, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+	b, next, err := d.read(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch dataType {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte{}, b...), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid data section: integer with %v bytes", size)
+		}
+		return uint64(toUint(0, b)), next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid data section: int32 with %v bytes", size)
+		}
+		return int64(int32(toUint(0, b))), next, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), next, nil
+	case typeDouble, typeFloat:
+		return nil, next, nil // not used in the geoip fields
+	default:
+		return nil, 0, fmt.Errorf("invalid data section: unknown data type %v", dataType)
+	}
+}
+
+// skip returns the offset after the value, without decoding it.
+func (d *decoder) skip(offset uint) (uint, error) {
+	dataType, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return 0, err
+	}
+	switch dataType {
+	case typePointer, typeBool:
+		return offset, nil
+	case typeMap, typeArray:
+		n := size
+		if dataType == typeMap {
+			n *= 2
+		}
+		for i := uint(0); i < n; i++ {
+			if offset, err = d.skip(offset); err != nil {
+				return 0, err
+			}
+		}
+		return offset, nil
+	default:
+		_, offset, err = d.read(offset, size)
+		return offset, err
+	}
+}
+
+func (d *decoder) read(offset, n uint) ([]byte, uint, error) {
+	if offset+n > uint(len(d.buffer)) {
+		return nil, 0, fmt.Errorf("invalid data section: unexpected end of data")
+	}
+	return d.buffer[offset : offset+n], offset + n, nil
+}
+
+func toUint(prefix uint, b []byte) uint {
+	result := prefix
+	for _, c := range b {
+		result = result<<8 | uint(c)
+	}
+	return result
+}
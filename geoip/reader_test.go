@@ -0,0 +1,273 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package geoip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestLookupField(t *testing.T) {
+	for _, ipVersion := range []uint{4, 6} {
+		for _, recordSize := range []uint{24, 28, 32} {
+			r, err := newReader(buildTestDatabase(t, ipVersion, recordSize))
+			if err != nil {
+				t.Fatalf("ip version %v, record size %v: %v", ipVersion, recordSize, err)
+			}
+			if r.DatabaseType() != "Test-City" {
+				t.Fatalf("expected database type Test-City, but got %v", r.DatabaseType())
+			}
+			us := "" // IPv6 networks are not in IPv4 databases
+			if ipVersion == 6 {
+				us = "US"
+			}
+			for _, data := range []struct {
+				ip, field, expected string
+				found               bool
+			}{
+				{"81.2.69.160", "country", "GB", true},
+				{"81.2.69.160", "country_name", "United Kingdom", true},
+				{"81.2.69.160", "continent", "EU", true},
+				{"81.2.69.160", "city", "London", true},
+				{"81.2.69.160", "subdivision", "ENG", true},
+				{"81.2.69.160", "asn", "", false},
+				{"81.2.69.255", "asn", "20712", true},
+				{"81.2.69.255", "asn_org", "Andrews & Arnold Ltd", true},
+				{"81.2.69.255", "country", "GB", true},
+				{"81.2.70.1", "country", "", false},
+				{"2001:480::1", "country", us, ipVersion == 6},
+				{"2001:481::1", "country", "", false},
+			} {
+				value, found, err := r.LookupField(net.ParseIP(data.ip), data.field)
+				if err != nil {
+					t.Fatalf("ip version %v, record size %v: %v %v: %v", ipVersion, recordSize, data.ip, data.field, err)
+				}
+				if value != data.expected || found != data.found {
+					t.Fatalf("ip version %v, record size %v: %v %v: expected %q, %v, but got %q, %v", ipVersion, recordSize, data.ip, data.field, data.expected, data.found, value, found)
+				}
+			}
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.mmdb")
+	if err = ioutil.WriteFile(path, buildTestDatabase(t, 6, 28), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Path() != path {
+		t.Fatalf("expected path %v, but got %v", path, r.Path())
+	}
+	if err = ioutil.WriteFile(path, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(path); err == nil {
+		t.Fatal("expected error opening an invalid database")
+	}
+}
+
+// testPointer is encoded as a pointer into the data section.
+type testPointer uint
+
+type testNode struct {
+	children [2]*testNode
+	data     int // offset in the data section for leaf nodes, -1 for internal nodes
+	number   uint
+}
+
+// buildTestDatabase writes a MaxMind DB file with a few networks, using the same layout as GeoLite2 databases.
+func buildTestDatabase(t *testing.T, ipVersion, recordSize uint) []byte {
+	data := &bytes.Buffer{}
+	unitedKingdom := uint(data.Len())
+	encodeTestValue(data, map[string]interface{}{
+		"iso_code": "GB",
+		"names":    map[string]interface{}{"en": "United Kingdom", "de": "Vereinigtes Königreich"},
+	})
+	europe := uint(data.Len())
+	encodeTestValue(data, map[string]interface{}{"code": "EU"})
+	networks := []struct {
+		cidr   string
+		record map[string]interface{}
+	}{
+		{"81.2.69.128/26", map[string]interface{}{
+			"city":         map[string]interface{}{"names": map[string]interface{}{"en": "London"}},
+			"continent":    testPointer(europe),
+			"country":      testPointer(unitedKingdom),
+			"location":     map[string]interface{}{"accuracy_radius": uint16(100), "metro_code": int32(-1)},
+			"subdivisions": []interface{}{map[string]interface{}{"iso_code": "ENG"}},
+		}},
+		{"81.2.69.192/26", map[string]interface{}{
+			"autonomous_system_number":       uint32(20712),
+			"autonomous_system_organization": "Andrews & Arnold Ltd",
+			"country":                        testPointer(unitedKingdom),
+		}},
+		{"2001:480::/32", map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "US"},
+		}},
+	}
+	root := &testNode{data: -1}
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipNet.IP
+		prefixLen, _ := ipNet.Mask.Size()
+		if ip.To4() != nil && ipVersion == 6 {
+			ip, prefixLen = append(make(net.IP, 12), ip.To4()...), prefixLen+96 // ::81.2.69.128, not ::ffff:81.2.69.128
+		} else if ip.To4() == nil && ipVersion == 4 {
+			continue
+		}
+		offset := data.Len()
+		encodeTestValue(data, network.record)
+		node := root
+		for i := 0; i < prefixLen; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if i == prefixLen-1 {
+				node.children[bit] = &testNode{data: offset}
+			} else if node.children[bit] == nil {
+				node.children[bit] = &testNode{data: -1}
+			}
+			node = node.children[bit]
+		}
+	}
+	var nodes []*testNode
+	for queue := []*testNode{root}; len(queue) > 0; queue = queue[1:] {
+		queue[0].number = uint(len(nodes))
+		nodes = append(nodes, queue[0])
+		for _, child := range queue[0].children {
+			if child != nil && child.data < 0 {
+				queue = append(queue, child)
+			}
+		}
+	}
+	nodeCount := uint(len(nodes))
+	record := func(child *testNode) uint {
+		switch {
+		case child == nil:
+			return nodeCount
+		case child.data >= 0:
+			return nodeCount + dataSectionSeparatorSize + uint(child.data)
+		default:
+			return child.number
+		}
+	}
+	result := &bytes.Buffer{}
+	for _, node := range nodes {
+		left, right := record(node.children[0]), record(node.children[1])
+		switch recordSize {
+		case 24:
+			result.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			result.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(left>>20)&0xF0 | byte(right>>24)&0x0F, byte(right >> 16), byte(right >> 8), byte(right)})
+		default:
+			result.Write([]byte{byte(left >> 24), byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 24), byte(right >> 16), byte(right >> 8), byte(right)})
+		}
+	}
+	result.Write(make([]byte, dataSectionSeparatorSize))
+	result.Write(data.Bytes())
+	result.Write(metadataStartMarker)
+	encodeTestValue(result, map[string]interface{}{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               "Test-City",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"languages":                   []interface{}{"en"},
+	})
+	return result.Bytes()
+}
+
+func encodeTestValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		encodeTestControl(buf, typeString, uint(len(v)))
+		buf.WriteString(v)
+	case uint16:
+		encodeTestUint(buf, typeUint16, uint(v))
+	case uint32:
+		encodeTestUint(buf, typeUint32, uint(v))
+	case int32:
+		encodeTestControl(buf, typeInt32, 4)
+		buf.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	case testPointer:
+		if v < 2048 {
+			buf.Write([]byte{typePointer<<5 | byte(v>>8), byte(v)})
+		} else {
+			v -= 2048
+			buf.Write([]byte{typePointer<<5 | 1<<3 | byte(v>>16), byte(v >> 8), byte(v)})
+		}
+	case []interface{}:
+		encodeTestControl(buf, typeArray, uint(len(v)))
+		for _, elem := range v {
+			encodeTestValue(buf, elem)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		encodeTestControl(buf, typeMap, uint(len(v)))
+		for _, key := range keys {
+			encodeTestValue(buf, key)
+			encodeTestValue(buf, v[key])
+		}
+	}
+}
+
+func encodeTestUint(buf *bytes.Buffer, dataType int, v uint) {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	encodeTestControl(buf, dataType, uint(len(b)))
+	buf.Write(b)
+}
+
+func encodeTestControl(buf *bytes.Buffer, dataType int, size uint) {
+	ctrlType, extended := byte(dataType), []byte{}
+	if dataType > 7 {
+		ctrlType, extended = 0, []byte{byte(dataType - 7)}
+	}
+	switch {
+	case size < 29:
+		buf.WriteByte(ctrlType<<5 | byte(size))
+		buf.Write(extended)
+	case size < 285:
+		buf.WriteByte(ctrlType<<5 | 29)
+		buf.Write(extended)
+		buf.WriteByte(byte(size - 29))
+	default:
+		buf.WriteByte(ctrlType<<5 | 30)
+		buf.Write(extended)
+		buf.Write([]byte{byte((size - 285) >> 8), byte(size - 285)})
+	}
+}
@@ -15,21 +15,26 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/fstab/grok_exporter/config"
 	"github.com/fstab/grok_exporter/config/v3"
 	"github.com/fstab/grok_exporter/exporter"
-	"github.com/fstab/grok_exporter/oniguruma"
 	"github.com/fstab/grok_exporter/tailer"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding"
 )
 
 var (
@@ -37,24 +42,49 @@ var (
 	configPath             = flag.String("config", "", "Path to the config file. Try '-config ./example/config.yml' to get started.")
 	showConfig             = flag.Bool("showconfig", false, "Print the current configuration to the console. Example: 'grok_exporter -showconfig -config ./example/config.yml'")
 	disableExporterMetrics = flag.Bool("disable-exporter-metrics", false, "If this flag is set, the metrics about the exporter itself (go_*, process_*, promhttp_*) will be excluded from /metrics")
+	oneshot                = flag.Bool("oneshot", false, "Read the inputs to the end, print the metrics to the console, and exit. No HTTP server is started. Only the file and stdin input types are supported.")
+	pushgateway            = flag.String("pushgateway", "", "URL of a Prometheus Pushgateway. With '-oneshot', the metrics are pushed there instead of printed to the console.")
+	pushgatewayJob         = flag.String("pushgateway-job", "grok_exporter", "Job name for pushing the metrics to the Pushgateway.")
+	dryRun                 = flag.Bool("dry-run", false, "Process the file given with '-replay' and print a report with the matches per metric, the time spent matching, and the most frequent unmatched lines. No HTTP server is started.")
+	replayPath             = flag.String("replay", "", "Log file for '-dry-run'. The lines are processed like lines of the first input.")
 )
 
 var (
 	logfile = "logfile"
 	extra   = "extra"
+	inputId = "input"
+	offset  = "offset"
+	logTime = exporter.LogTimeField
 )
 
 const (
-	number_of_lines_matched_label = "matched"
-	number_of_lines_ignored_label = "ignored"
+	number_of_lines_matched_label  = "matched"
+	number_of_lines_ignored_label  = "ignored"
+	number_of_lines_filtered_label = "filtered"
+	number_of_lines_too_old_label  = "too_old"
 )
 
 var additionalFieldDefinitions = map[string]string{
 	logfile: "full path of the log file",
 	extra:   "full json log object",
+	inputId: "id of the input",
+	offset:  "byte offset of the line in the log file",
+	logTime: "log time of the line in seconds since the epoch",
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		exitOnError(runTestCommand(os.Args[2:], os.Stdin, os.Stdout))
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "explain" {
+		exitOnError(runExplainCommand(os.Args[2:], os.Stdout))
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		exitOnError(runLintCommand(os.Args[2:], os.Stdout))
+		return
+	}
 	flag.Parse()
 	if *printVersion {
 		fmt.Printf("%v\n", exporter.VersionString())
@@ -71,125 +101,405 @@ func main() {
 		fmt.Printf("%v\n", cfg)
 		return
 	}
+	if *dryRun {
+		exitOnError(runDryRun(cfg, *replayPath, os.Stdout))
+		return
+	}
+	if *oneshot {
+		exitOnError(validateOneshotInputs(cfg))
+	}
 	registry := prometheus.NewRegistry()
+	// The global.labels are added to all metrics registered with the registerer.
+	registerer := prometheus.WrapRegistererWith(cfg.Global.Labels, registry)
 	if !*disableExporterMetrics {
 		// init like the default registry, see client_golang/prometheus/registry.go init()
-		registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
-		registry.MustRegister(prometheus.NewGoCollector())
+		registerer.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+		registerer.MustRegister(prometheus.NewGoCollector())
 	}
-	patterns, err := initPatterns(cfg)
+	exitOnError(exporter.SetMatchTimeout(cfg.Global.MatchTimeout))
+	patterns, bundledPatterns, err := initPatterns(cfg)
 	exitOnError(err)
 	metrics, err := createMetrics(cfg, patterns)
 	exitOnError(err)
-	for _, m := range metrics {
-		registry.MustRegister(m.Collector())
+	definitions, err := metricDefinitions(cfg, patterns)
+	exitOnError(err)
+	filter, err := exporter.NewFilter(cfg.Filter, patterns, exporter.RegexEngine(cfg.Global.RegexEngine))
+	exitOnError(err)
+	if cfg.Global.StateFile != "" {
+		exitOnError(exporter.LoadState(cfg.Global.StateFile, metrics))
+	}
+	metricsCollector := exporter.NewMetricsCollector(metrics)
+	registerer.MustRegister(metricsCollector)
+	nLinesTotal, nAttemptsByMetric, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric, nTimeoutsByMetric, nLinesTruncated, lineDelaySeconds, logTimeLagSeconds := initSelfMonitoring(metrics, bundledPatterns, registerer)
+	lastReloadSuccessful, lastReloadSuccessTimestamp := initReloadMonitoring(registerer)
+	nExpiredByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_series_expired_total",
+		Help: "Number of label value combinations that were deleted from the metric, because they were not updated within the metric's retention.",
+	}, []string{"metric"})
+	registerer.MustRegister(nExpiredByMetric)
+	nDeleteMatchesByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_lines_matching_delete_total",
+		Help: "Number of lines that matched the metric's delete_match, and deleted the time series with the delete_labels.",
+	}, []string{"metric"})
+	registerer.MustRegister(nDeleteMatchesByMetric)
+	nOverflowByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_series_overflow_total",
+		Help: "Number of matching lines with new label values after the metric reached its max_series, which were dropped or recorded with the label values 'other'.",
+	}, []string{"metric"})
+	registerer.MustRegister(nOverflowByMetric)
+	nDeniedByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_label_values_denied_total",
+		Help: "Number of matching lines with a label value that is not allowed by the metric's label_values, which were dropped or recorded with the label value 'other'.",
+	}, []string{"metric"})
+	registerer.MustRegister(nDeniedByMetric)
+	metricsByInput := routeMetrics(cfg, metrics)
+	inputsWithMatch := make(map[string]bool) // the inputs don't change on reload
+	for _, input := range cfg.AllInputs() {
+		inputsWithMatch[input.Id] = input.Match != ""
 	}
-	nLinesTotal, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric := initSelfMonitoring(metrics, registry)
+	lookupTables := exporter.NewLookupTables()
+	exitOnError(lookupTables.Load(cfg.LookupTables))
+	exitOnError(exporter.LoadGeoIPDatabases(cfg.GeoIP))
+	var lookupTablesTicker *time.Ticker
+	var lookupTablesCheck <-chan time.Time // nil if there are no lookup tables, so it is never selected
+	resetLookupTablesTicker := func() {
+		if lookupTablesTicker != nil {
+			lookupTablesTicker.Stop()
+		}
+		lookupTablesTicker, lookupTablesCheck = nil, nil
+		if interval := lookupTables.CheckInterval(); interval > 0 {
+			lookupTablesTicker = time.NewTicker(interval)
+			lookupTablesCheck = lookupTablesTicker.C
+		}
+	}
+	resetLookupTablesTicker()
 
-	tail, err := startTailer(cfg, registry)
+	// On SIGHUP or a request to /-/reload, the patterns, metrics, filter, lookup tables, and geoip databases are replaced.
+	// The tailers keep running, and metrics with an unchanged definition keep their values.
+	reload := func() error {
+		newCfg, newMetrics, newDefinitions, newFilter, err := reloadConfig(cfg, metrics, definitions, lookupTables, nAttemptsByMetric, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric, nTimeoutsByMetric)
+		if err != nil {
+			lastReloadSuccessful.Set(0)
+			fmt.Fprintf(os.Stderr, "WARNING: failed to reload the config, keeping the current config: %v\n", err.Error())
+			return err
+		}
+		filter.Free()
+		cfg, metrics, definitions, filter = newCfg, newMetrics, newDefinitions, newFilter
+		metricsByInput = routeMetrics(cfg, metrics)
+		metricsCollector.SetMetrics(metrics)
+		resetLookupTablesTicker()
+		lastReloadSuccessful.Set(1)
+		lastReloadSuccessTimestamp.SetToCurrentTime()
+		fmt.Fprintf(os.Stderr, "reloaded the config from %v\n", *configPath)
+		return nil
+	}
+	reloadRequests := make(chan chan error)
+	deleteRequests := make(chan deleteRequest)
+	dropOlderThan := make(map[string]time.Duration)
+	for _, input := range cfg.AllInputs() {
+		dropOlderThan[input.Id] = input.DropOlderThan
+	}
+
+	tail, stopInputs, err := startTailer(cfg, patterns, registerer, *oneshot)
 	exitOnError(err)
 
 	// gather up the handlers with which to start the webserver
 	var httpHandlers []exporter.HttpServerPathHandler
 	metricsHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	if !*disableExporterMetrics {
-		metricsHandler = promhttp.InstrumentMetricHandler(registry, metricsHandler)
+		metricsHandler = promhttp.InstrumentMetricHandler(registerer, metricsHandler)
 	}
 	httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
 		Path:    cfg.Server.Path,
-		Handler: metricsHandler,
+		Handler: exporter.NewAuthHandler(cfg.Server, metricsHandler),
 	})
-	if cfg.Input.Type == "webhook" {
+	var unmatchedLines *exporter.UnmatchedLines // nil if server.unmatched_lines is not configured
+	if cfg.Server.UnmatchedLines > 0 {
+		unmatchedLines = exporter.NewUnmatchedLines(cfg.Server.UnmatchedLines)
+		httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
+			Path:    exporter.UnmatchedLinesPath,
+			Handler: exporter.NewAuthHandler(cfg.Server, unmatchedLines),
+		})
+	}
+	if len(cfg.Server.ReloadToken) > 0 {
+		httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
+			Path:    reloadPath,
+			Handler: reloadHandler(cfg.Server.ReloadToken, reloadRequests),
+		})
+	}
+	if len(cfg.Server.AdminToken) > 0 {
 		httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
-			Path:    cfg.Input.WebhookPath,
-			Handler: tailer.WebhookHandler(),
+			Path:    deletePath,
+			Handler: deleteHandler(cfg.Server.AdminToken, deleteRequests),
 		})
 	}
+	for _, input := range cfg.AllInputs() {
+		if input.Type == "webhook" {
+			httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
+				Path:    input.WebhookPath,
+				Handler: tailer.WebhookHandler(),
+			})
+		}
+	}
 
-	fmt.Print(startMsg(cfg, httpHandlers))
-	serverErrors := startServer(cfg.Server, httpHandlers)
+	var serverErrors chan error // nil in oneshot mode, so it is never selected
+	if !*oneshot {
+		fmt.Print(startMsg(cfg, httpHandlers))
+		serverErrors = startServer(cfg.Server, httpHandlers)
+	}
 
 	retentionTicker := time.NewTicker(cfg.Global.RetentionCheckInterval)
 
+	var stateSync <-chan time.Time // nil if global.state_file is not configured, so it is never selected
+	saveState := func() {
+		if cfg.Global.StateFile == "" {
+			return
+		}
+		if err := exporter.SaveState(cfg.Global.StateFile, metrics); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err.Error())
+		}
+	}
+	if cfg.Global.StateFile != "" {
+		stateSync = time.NewTicker(cfg.Global.StateSyncInterval).C
+	}
+
+	remoteWriters, err := exporter.NewRemoteWriters(cfg.RemoteWrite, registry, registerer)
+	exitOnError(err)
+	for _, remoteWriter := range remoteWriters {
+		remoteWriter.Start()
+	}
+	otlpExporters, err := exporter.NewOTLPExporters(cfg.OTLP, registry, registerer)
+	exitOnError(err)
+	for _, otlpExporter := range otlpExporters {
+		otlpExporter.Start()
+	}
+	stopPushing := func() {
+		for _, remoteWriter := range remoteWriters {
+			remoteWriter.Stop()
+		}
+		for _, otlpExporter := range otlpExporters {
+			otlpExporter.Stop()
+		}
+	}
+
+	// On SIGINT or SIGTERM, we stop reading new lines, but we process the lines that were already read before we exit.
+	// Otherwise they would be lost, because the saved positions are after these lines.
+	shutdownSignals := make(chan os.Signal, 1)
+	signal.Notify(shutdownSignals, syscall.SIGINT, syscall.SIGTERM)
+	shuttingDown := false
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+
 	for {
 		select {
+		case sig := <-shutdownSignals:
+			if shuttingDown {
+				exitOnError(fmt.Errorf("received %v while processing the remaining log lines, exiting immediately", sig))
+			}
+			fmt.Fprintf(os.Stderr, "received %v, processing the remaining log lines before shutting down\n", sig)
+			shuttingDown = true
+			stopInputs()
+		case <-reloadSignals:
+			reload()
+		case result := <-reloadRequests:
+			result <- reload()
+		case request := <-deleteRequests:
+			deleted, err := deleteSeries(metrics, request)
+			request.result <- deleteResult{deleted: deleted, err: err}
 		case err := <-serverErrors:
 			exitOnError(fmt.Errorf("server error: %v", err.Error()))
 		case err := <-tail.Errors():
-			if err.Type() == fswatcher.FileNotFound || os.IsNotExist(err.Cause()) {
+			if err.Type() == fswatcher.FileNotFound || err.Type() == fswatcher.DirectoryNotFound || os.IsNotExist(err.Cause()) {
 				exitOnError(fmt.Errorf("error reading log lines: %v: use 'fail_on_missing_logfile: false' in the input configuration if you want grok_exporter to start even though the logfile is missing", err))
 			} else {
 				exitOnError(fmt.Errorf("error reading log lines: %v", err.Error()))
 			}
-		case line := <-tail.Lines():
-			matched := false
-			for _, metric := range metrics {
+		case line, open := <-tail.Lines():
+			if !open && *oneshot {
+				saveState()
+				stopPushing()
+				exitOnError(finishOneshot(registry))
+				return
+			}
+			if !open && shuttingDown {
+				saveState()
+				stopPushing()
+				return
+			}
+			if !open {
+				exitOnError(fmt.Errorf("error reading log lines: the input was closed"))
+			}
+			repeat := 1 // the number of identical lines this line stands for, see input.dedup_window
+			if line.Repeat > 1 {
+				repeat = line.Repeat
+			}
+			if line.Truncated {
+				nLinesTruncated.Inc()
+			}
+			if !line.ReadTime.IsZero() {
+				lineDelaySeconds.Add(time.Since(line.ReadTime).Seconds())
+			}
+			if !line.LogTime.IsZero() {
+				lag := time.Since(line.LogTime)
+				logTimeLagSeconds.WithLabelValues(line.Input).Set(lag.Seconds())
+				if maxAge := dropOlderThan[line.Input]; maxAge > 0 && lag > maxAge {
+					nLinesTotal.WithLabelValues(number_of_lines_too_old_label).Add(float64(repeat))
+					continue
+				}
+			}
+			accepted, err := filter.Accept(line.Line)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: skipping log line: error processing filter: %v\n", err.Error())
+				fmt.Fprintf(os.Stderr, "%v\n", line.Line)
+			}
+			if !accepted {
+				nLinesTotal.WithLabelValues(number_of_lines_filtered_label).Add(float64(repeat))
+				continue
+			}
+			if line.Captures == nil && inputsWithMatch[line.Input] {
+				nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Add(float64(repeat))
+				if unmatchedLines != nil {
+					unmatchedLines.Add(line.Input, line.File, line.Line)
+				}
+				continue
+			}
+			matched, unsampled := false, false
+			for _, metric := range metricsByInput[line.Input] {
 				start := time.Now()
 				if !metric.PathMatches(line.File) {
 					continue
 				}
-				match, err := metric.ProcessMatch(line.Line, makeAdditionalFields(line))
+				nAttemptsByMetric.WithLabelValues(metric.Name()).Add(float64(repeat))
+				match, err := metric.ProcessRepeatedMatch(line.Line, makeAdditionalFields(line), repeat)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "WARNING: skipping log line: %v\n", err.Error())
 					fmt.Fprintf(os.Stderr, "%v\n", line.Line)
 					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
+					if errors.Is(err, exporter.ErrMatchTimeout) {
+						nTimeoutsByMetric.WithLabelValues(metric.Name()).Inc()
+					}
+				} else if match != nil && match.Unsampled {
+					unsampled = true
 				} else if match != nil {
-					nMatchesByMetric.WithLabelValues(metric.Name()).Inc()
+					if match.Overflow {
+						nOverflowByMetric.WithLabelValues(metric.Name()).Add(float64(repeat))
+					}
+					if match.Denied {
+						nDeniedByMetric.WithLabelValues(metric.Name()).Add(float64(repeat))
+					}
+					nMatchesByMetric.WithLabelValues(metric.Name()).Add(float64(repeat))
 					procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(float64(time.Since(start).Nanoseconds() / int64(1000)))
 					matched = true
 				}
-				_, err = metric.ProcessDeleteMatch(line.Line, makeAdditionalFields(line))
+				deleteMatch, err := metric.ProcessDeleteMatch(line.Line, makeAdditionalFields(line))
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "WARNING: skipping log line: %v\n", err.Error())
 					fmt.Fprintf(os.Stderr, "%v\n", line.Line)
 					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
+					if errors.Is(err, exporter.ErrMatchTimeout) {
+						nTimeoutsByMetric.WithLabelValues(metric.Name()).Inc()
+					}
+				} else if deleteMatch != nil {
+					nDeleteMatchesByMetric.WithLabelValues(metric.Name()).Add(float64(repeat))
 				}
-				// TODO: create metric to monitor number of matching delete_patterns
 			}
-			if matched {
-				nLinesTotal.WithLabelValues(number_of_lines_matched_label).Inc()
-			} else {
-				nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Inc()
+			status := lineStatus(matched, unsampled)
+			nLinesTotal.WithLabelValues(status).Add(float64(repeat))
+			// Lines that a metric skipped because of sample_rate are not known to be unmatched.
+			if status == number_of_lines_ignored_label && unmatchedLines != nil {
+				unmatchedLines.Add(line.Input, line.File, line.Line)
 			}
+		case <-lookupTablesCheck:
+			lookupTables.Reload()
+		case <-stateSync:
+			saveState()
 		case <-retentionTicker.C:
 			for _, metric := range metrics {
-				err = metric.ProcessRetention()
+				nExpired, err := metric.ProcessRetention()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "WARNING: error while processing retention on metric %v: %v", metric.Name(), err)
 					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
 				}
+				if nExpired > 0 {
+					nExpiredByMetric.WithLabelValues(metric.Name()).Add(float64(nExpired))
+				}
+			}
+		}
+	}
+}
+
+// lineStatus returns the status label of grok_exporter_lines_total for a line that was tried on the metrics.
+// A line that a metric skipped because of sample_rate counts as matched, because the metric's patterns were not tried,
+// so the line is not known to be ignored. Otherwise, with sample_rate: 0.1, most matching lines would be counted as ignored.
+func lineStatus(matched, unsampled bool) string {
+	if matched || unsampled {
+		return number_of_lines_matched_label
+	}
+	return number_of_lines_ignored_label
+}
+
+// routeMetrics maps each input id to the metrics that apply to that input,
+// so that lines are only matched against the metrics configured for their input.
+func routeMetrics(cfg *v3.Config, metrics []exporter.Metric) map[string][]exporter.Metric {
+	result := make(map[string][]exporter.Metric)
+	for _, input := range cfg.AllInputs() {
+		result[input.Id] = []exporter.Metric{}
+		for _, metric := range metrics {
+			if metric.SourceMatches(input.Id) {
+				result[input.Id] = append(result[input.Id], metric)
 			}
-			// TODO: create metric to monitor number of metrics cleaned up via retention
 		}
 	}
+	return result
 }
 
 func makeAdditionalFields(line *fswatcher.Line) map[string]interface{} {
-	return map[string]interface{}{
+	var lineLogTime interface{} // nil if the line has no log time
+	if !line.LogTime.IsZero() {
+		lineLogTime = float64(line.LogTime.UnixNano()) / float64(time.Second)
+	}
+	result := map[string]interface{}{
 		logfile: line.File,
 		extra:   line.Extra,
+		inputId: line.Input,
+		offset:  line.Offset,
+		logTime: lineLogTime,
+	}
+	for name, value := range line.Captures {
+		result[name] = value // the fields of the input's match pattern, see inputFieldDefinitions()
 	}
+	return result
 }
 
 func startMsg(cfg *v3.Config, httpHandlers []exporter.HttpServerPathHandler) string {
+	var sb strings.Builder
+	sb.WriteString("Starting server on")
+	for i, listener := range cfg.Server.AllListeners() {
+		if i > 0 {
+			sb.WriteString(" and")
+		}
+		for _, httpHandler := range httpHandlers {
+			sb.WriteString(fmt.Sprintf(" %v%v", baseUrl(listener), httpHandler.Path))
+		}
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+func baseUrl(listener v3.ListenerConfig) string {
+	if len(listener.UnixSocket) > 0 {
+		return fmt.Sprintf("%v://unix:%v:", listener.Protocol, listener.UnixSocket)
+	}
 	host := "localhost"
-	if len(cfg.Server.Host) > 0 {
-		host = cfg.Server.Host
+	if len(listener.Host) > 0 {
+		host = listener.Host
 	} else {
 		hostname, err := os.Hostname()
 		if err == nil {
 			host = hostname
 		}
 	}
-
-	var sb strings.Builder
-	baseUrl := fmt.Sprintf("%v://%v:%v", cfg.Server.Protocol, host, cfg.Server.Port)
-	sb.WriteString("Starting server on")
-	for _, httpHandler := range httpHandlers {
-		sb.WriteString(fmt.Sprintf(" %v%v", baseUrl, httpHandler.Path))
-	}
-	sb.WriteString("\n")
-	return sb.String()
+	return fmt.Sprintf("%v://%v:%v", listener.Protocol, host, listener.Port)
 }
 
 func exitOnError(err error) {
@@ -204,25 +514,69 @@ func validateCommandLineOrExit() {
 		if *showConfig {
 			fmt.Fprint(os.Stderr, "Usage: grok_exporter -showconfig -config <path>\n")
 		} else {
-			fmt.Fprint(os.Stderr, "Usage: grok_exporter -config <path>\n")
+			fmt.Fprint(os.Stderr, "Usage: grok_exporter -config <path>\n       grok_exporter test -config <path> [<file>]\n")
 		}
 		os.Exit(-1)
 	}
+	if len(*pushgateway) > 0 && !*oneshot {
+		fmt.Fprint(os.Stderr, "Usage: grok_exporter -oneshot -pushgateway <url> -config <path>\n")
+		os.Exit(-1)
+	}
+	if *dryRun != (len(*replayPath) > 0) {
+		fmt.Fprint(os.Stderr, "Usage: grok_exporter -dry-run -replay <file> -config <path>\n")
+		os.Exit(-1)
+	}
+}
+
+func validateOneshotInputs(cfg *v3.Config) error {
+	for _, input := range cfg.AllInputs() {
+		if input.Type != "file" && input.Type != "stdin" {
+			return fmt.Errorf("Configuration error: '-oneshot' supports only the file and stdin input types, but input type is %v", input.Type)
+		}
+	}
+	return nil
+}
+
+// finishOneshot pushes the metrics to the Pushgateway if '-pushgateway' is set, otherwise the metrics are printed to the console.
+func finishOneshot(registry *prometheus.Registry) error {
+	if len(*pushgateway) > 0 {
+		err := push.New(*pushgateway, *pushgatewayJob).Gatherer(registry).Push()
+		if err != nil {
+			return fmt.Errorf("failed to push metrics to %v: %v", *pushgateway, err)
+		}
+		return nil
+	}
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %v", err)
+	}
+	for _, metricFamily := range metricFamilies {
+		_, err = expfmt.MetricFamilyToText(os.Stdout, metricFamily)
+		if err != nil {
+			return fmt.Errorf("failed to print metrics: %v", err)
+		}
+	}
+	return nil
 }
 
-func initPatterns(cfg *v3.Config) (*exporter.Patterns, error) {
+// initPatterns returns the grok patterns and the bundled pattern set that was loaded, or "" if no bundled patterns were loaded.
+func initPatterns(cfg *v3.Config) (*exporter.Patterns, string, error) {
 	patterns := exporter.InitPatterns()
+	bundledPatterns, err := addBundledPatterns(patterns, cfg.Global.BundledPatterns)
+	if err != nil {
+		return nil, "", err
+	}
 	for _, importedPatterns := range cfg.Imports {
 		if importedPatterns.Type == "grok_patterns" {
 			if len(importedPatterns.Dir) > 0 {
 				err := patterns.AddDir(importedPatterns.Dir)
 				if err != nil {
-					return nil, err
+					return nil, "", err
 				}
 			} else if len(importedPatterns.File) > 0 {
 				err := patterns.AddGlob(importedPatterns.File)
 				if err != nil {
-					return nil, err
+					return nil, "", err
 				}
 			}
 		}
@@ -230,33 +584,119 @@ func initPatterns(cfg *v3.Config) (*exporter.Patterns, error) {
 	for _, pattern := range cfg.GrokPatterns {
 		err := patterns.AddPattern(pattern)
 		if err != nil {
-			return nil, err
+			return nil, "", err
+		}
+	}
+	for name, regex := range cfg.AdditionalPatterns {
+		err := patterns.AddDefinition(name, regex)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return patterns, bundledPatterns, nil
+}
+
+// addBundledPatterns loads the logstash-patterns-core library shipped with grok_exporter, so that the imported patterns can override them.
+// If 'global.bundled_patterns' is not configured, the legacy patterns are loaded if they are installed, i.e. not if grok_exporter was built from source.
+func addBundledPatterns(patterns *exporter.Patterns, set string) (string, error) {
+	if set == "none" {
+		return "", nil
+	}
+	dir, err := exporter.BundledPatternsDir()
+	if set == "" {
+		if err != nil {
+			return "", nil
 		}
+		if _, err = os.Stat(dir); err != nil {
+			return "", nil
+		}
+		set = exporter.BundledLegacy
+	} else if err != nil {
+		return "", err
+	}
+	err = patterns.AddBundled(dir, set)
+	if err != nil {
+		return "", err
 	}
-	return patterns, nil
+	return set, nil
 }
 
-func createMetrics(cfg *v3.Config, patterns *exporter.Patterns) ([]exporter.Metric, error) {
-	result := make([]exporter.Metric, 0, len(cfg.AllMetrics))
-	for _, m := range cfg.AllMetrics {
+func createMetrics(cfg *v3.Config, patterns *exporter.Patterns) (metrics []exporter.Metric, err error) {
+	var (
+		result             = make([]exporter.Metric, 0, len(cfg.AllMetrics))
+		regex, deleteRegex exporter.Regex // of the metric that is created, owned by the metric when it is added to result
+		engine             = exporter.RegexEngine(cfg.Global.RegexEngine)
+		prefixTree         = exporter.NewPrefixTree(sharablePatterns(cfg), patterns, engine)
+	)
+	defer prefixTree.Free() // the gates are freed with the last metric using them
+	defer func() {
+		if err != nil {
+			freeRegexes(regex, deleteRegex)
+			freeMetrics(result)
+		}
+	}()
+	inputFields, err := inputFieldDefinitions(cfg, patterns)
+	if err != nil {
+		return nil, err
+	}
+	shared := make(map[string]exporter.Regex) // metrics.metrics blocks: MatchGroup -> regex
+	for i, m := range cfg.AllMetrics {
 		var (
-			regex, deleteRegex *oniguruma.Regex
-			err                error
+			err    error
+			fields = fieldDefinitions(cfg, &m, inputFields)
 		)
-		regex, err = exporter.Compile(m.Match, patterns)
-		if err != nil {
-			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+		regex, deleteRegex = nil, nil
+		if m.MatchGrokField != "" && fields[m.MatchGrokField] != inputFieldDescription {
+			return nil, fmt.Errorf("failed to initialize metric %v: match_grok_field %v is not defined in the match pattern of each of the metric's inputs", m.Name, m.MatchGrokField)
+		}
+		if sharedRegex, ok := shared[m.MatchGroup]; ok {
+			regex = exporter.Shared(sharedRegex)
+		} else {
+			matches := make([]string, 0, len(m.Matches)+1)
+			for _, match := range append([]string{m.Match}, m.Matches...) {
+				if len(match) > 0 {
+					matches = append(matches, exporter.Anchor(exporter.WithFlags(match, m.RegexFlags), m.Anchor))
+				}
+			}
+			if len(matches) > 0 {
+				regex, err = exporter.CompileAlternatives(matches, patterns, engine)
+				if err != nil {
+					return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+				}
+				regex = prefixTree.Gate(i, regex)
+			} else {
+				regex = exporter.MatchAll() // match_field without match, the metric matches all lines with that field
+			}
+			if len(m.DropIfMatch) > 0 {
+				dropRegex, err := exporter.Compile(exporter.WithFlags(m.DropIfMatch, m.RegexFlags), patterns, engine)
+				if err != nil {
+					return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+				}
+				regex = exporter.Exclude(regex, dropRegex)
+			}
+			if m.MatchGroup != "" {
+				regex = exporter.Shared(regex)
+				shared[m.MatchGroup] = regex
+			}
 		}
 		if len(m.DeleteMatch) > 0 {
-			deleteRegex, err = exporter.Compile(m.DeleteMatch, patterns)
+			deleteRegex, err = exporter.Compile(exporter.Anchor(exporter.WithFlags(m.DeleteMatch, m.RegexFlags), m.Anchor), patterns, engine)
 			if err != nil {
 				return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
 			}
 		}
-		err = exporter.VerifyFieldNames(&m, regex, deleteRegex, additionalFieldDefinitions)
+		err = exporter.VerifyFieldNames(&m, regex, deleteRegex, fields)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+		}
+		err = exporter.VerifyFieldDefaults(&m, regex, deleteRegex)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
 		}
+		regex = exporter.WithDefaults(regex, m.FieldDefaults)
+		if deleteRegex != nil {
+			deleteRegex = exporter.WithDefaults(deleteRegex, m.FieldDefaults)
+		}
 		switch m.Type {
 		case "counter":
 			result = append(result, exporter.NewCounterMetric(&m, regex, deleteRegex))
@@ -266,6 +706,14 @@ func createMetrics(cfg *v3.Config, patterns *exporter.Patterns) ([]exporter.Metr
 			result = append(result, exporter.NewHistogramMetric(&m, regex, deleteRegex))
 		case "summary":
 			result = append(result, exporter.NewSummaryMetric(&m, regex, deleteRegex))
+		case "distinct":
+			result = append(result, exporter.NewDistinctMetric(&m, regex, deleteRegex))
+		case "aggregate":
+			result = append(result, exporter.NewAggregateMetric(&m, regex, deleteRegex))
+		case "quantile":
+			result = append(result, exporter.NewQuantileMetric(&m, regex, deleteRegex))
+		case "info":
+			result = append(result, exporter.NewInfoMetric(&m, regex, deleteRegex))
 		default:
 			return nil, fmt.Errorf("Failed to initialize metrics: Metric type %v is not supported.", m.Type)
 		}
@@ -273,15 +721,104 @@ func createMetrics(cfg *v3.Config, patterns *exporter.Patterns) ([]exporter.Metr
 	return result, nil
 }
 
-func initSelfMonitoring(metrics []exporter.Metric, registry prometheus.Registerer) (*prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec) {
+// freeMetrics releases the compiled patterns of the metrics, see exporter.Metric.Free().
+func freeMetrics(metrics []exporter.Metric) {
+	for _, m := range metrics {
+		m.Free()
+	}
+}
+
+func freeRegexes(regexes ...exporter.Regex) {
+	for _, regex := range regexes {
+		if regex != nil {
+			regex.Free()
+		}
+	}
+}
+
+// inputFieldDefinitions returns the fields of the match pattern of each input, see exporter.InputMatch.
+func inputFieldDefinitions(cfg *v3.Config, patterns *exporter.Patterns) (map[string][]string, error) {
+	result := make(map[string][]string)
+	for _, input := range cfg.AllInputs() {
+		if input.Match == "" {
+			continue
+		}
+		inputMatch, err := exporter.NewInputMatch(input.Match, patterns, exporter.RegexEngine(cfg.Global.RegexEngine))
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize input %v: failed to compile match: %v", input.Id, err)
+		}
+		result[input.Id] = inputMatch.Fields()
+		inputMatch.Free()
+		for _, field := range result[input.Id] {
+			if description, ok := additionalFieldDefinitions[field]; ok {
+				return nil, fmt.Errorf("failed to initialize input %v: field name %v in match is reserved for the %v", input.Id, field, description)
+			}
+		}
+	}
+	return result, nil
+}
+
+const inputFieldDescription = "match pattern of the input"
+
+// fieldDefinitions returns the fields that the metric's templates can use in addition to the fields of its own patterns:
+// the additionalFieldDefinitions, and the fields of the match patterns of the inputs, if all of the metric's inputs have them.
+func fieldDefinitions(cfg *v3.Config, m *v3.MetricConfig, inputFields map[string][]string) map[string]string {
+	count := make(map[string]int)
+	nInputs := 0
+	for _, input := range cfg.AllInputs() {
+		applies := len(m.Sources) == 0
+		for _, source := range m.Sources {
+			applies = applies || source == input.Id
+		}
+		if !applies {
+			continue
+		}
+		nInputs++
+		for _, field := range inputFields[input.Id] {
+			count[field]++
+		}
+	}
+	result := make(map[string]string, len(additionalFieldDefinitions)+len(count))
+	for field, description := range additionalFieldDefinitions {
+		result[field] = description
+	}
+	for field, n := range count {
+		if n == nInputs {
+			result[field] = inputFieldDescription
+		}
+	}
+	return result
+}
+
+// sharablePatterns returns the match pattern of each metric for the PrefixTree, or "" for metrics with alternatives in matches.
+// The regex_flags are applied, so that metrics with different flags don't share a prefix.
+func sharablePatterns(cfg *v3.Config) []string {
+	result := make([]string, len(cfg.AllMetrics))
+	for i, m := range cfg.AllMetrics {
+		if len(m.Matches) == 0 && len(m.Match) > 0 {
+			result[i] = exporter.WithFlags(m.Match, m.RegexFlags)
+		}
+	}
+	return result
+}
+
+func initSelfMonitoring(metrics []exporter.Metric, bundledPatterns string, registry prometheus.Registerer) (*prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec, prometheus.Counter, prometheus.Counter, *prometheus.GaugeVec) {
 	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "grok_exporter_build_info",
 		Help: "A metric with a constant '1' value labeled by version, builddate, branch, revision, goversion, and platform on which grok_exporter was built.",
 	}, []string{"version", "builddate", "branch", "revision", "goversion", "platform"})
+	bundledPatternsInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grok_exporter_bundled_patterns_info",
+		Help: "A metric with a constant '1' value labeled by the logstash-patterns-core version and the pattern set loaded from the bundled patterns.",
+	}, []string{"version", "set"})
 	nLinesTotal := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "grok_exporter_lines_total",
 		Help: "Total number of log lines processed by grok_exporter.",
 	}, []string{"status"})
+	nAttemptsByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_lines_attempted_total",
+		Help: "Number of lines that were matched against each metric's patterns, i.e. lines from the metric's inputs and paths. Compare with grok_exporter_lines_matching_total to detect patterns that stopped matching.",
+	}, []string{"metric"})
 	nMatchesByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "grok_exporter_lines_matching_total",
 		Help: "Number of lines matched for each metric. Note that one line can be matched by multiple metrics.",
@@ -294,70 +831,418 @@ func initSelfMonitoring(metrics []exporter.Metric, registry prometheus.Registere
 		Name: "grok_exporter_line_processing_errors_total",
 		Help: "Number of errors for each metric. If this is > 0 there is an error in the configuration file. Check grok_exporter's console output.",
 	}, []string{"metric"})
+	nTimeoutsByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_match_timeouts_total",
+		Help: "Number of lines for each metric where the match was aborted, because the pattern backtracked for longer than global.match_timeout.",
+	}, []string{"metric"})
+	nLinesTruncated := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "grok_exporter_lines_truncated_total",
+		Help: "Number of log lines that were longer than max_line_length and were truncated or split.",
+	})
+	lineDelaySeconds := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "grok_exporter_lines_delay_seconds_total",
+		Help: "Total time in seconds between reading the log lines and processing them. Divide by grok_exporter_lines_total to get the average delay for one log line.",
+	})
+	logTimeLagSeconds := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "grok_exporter_log_time_lag_seconds",
+		Help: "Time in seconds between the log time of the last line with a timestamp and processing it, for inputs with a timestamp_pattern.",
+	}, []string{"input"})
 
 	registry.MustRegister(buildInfo)
+	registry.MustRegister(bundledPatternsInfo)
 	registry.MustRegister(nLinesTotal)
+	registry.MustRegister(nAttemptsByMetric)
 	registry.MustRegister(nMatchesByMetric)
 	registry.MustRegister(procTimeMicrosecondsByMetric)
 	registry.MustRegister(nErrorsByMetric)
+	registry.MustRegister(nTimeoutsByMetric)
+	registry.MustRegister(nLinesTruncated)
+	registry.MustRegister(lineDelaySeconds)
+	registry.MustRegister(logTimeLagSeconds)
+	registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "grok_exporter_files_truncated_total",
+		Help: "Number of times a log file was truncated and grok_exporter started reading it from the beginning.",
+	}, func() float64 {
+		return float64(fswatcher.TruncatedFilesTotal())
+	}))
+	registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "grok_exporter_watch_overflows_total",
+		Help: "Number of times file system events were lost and grok_exporter re-read all watched directories and files.",
+	}, func() float64 {
+		return float64(fswatcher.WatchOverflowsTotal())
+	}))
 
 	buildInfo.WithLabelValues(exporter.Version, exporter.BuildDate, exporter.Branch, exporter.Revision, exporter.GoVersion, exporter.Platform).Set(1)
+	if bundledPatterns != "" {
+		bundledPatternsInfo.WithLabelValues(exporter.PatternsVersion, bundledPatterns).Set(1)
+	}
 	// Initializing a value with zero makes the label appear. Otherwise the label is not shown until the first value is observed.
 	nLinesTotal.WithLabelValues(number_of_lines_matched_label).Add(0)
 	nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Add(0)
+	nLinesTotal.WithLabelValues(number_of_lines_filtered_label).Add(0)
+	nLinesTotal.WithLabelValues(number_of_lines_too_old_label).Add(0)
 	for _, metric := range metrics {
+		nAttemptsByMetric.WithLabelValues(metric.Name()).Add(0)
 		nMatchesByMetric.WithLabelValues(metric.Name()).Add(0)
 		procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(0)
 		nErrorsByMetric.WithLabelValues(metric.Name()).Add(0)
+		nTimeoutsByMetric.WithLabelValues(metric.Name()).Add(0)
 	}
-	return nLinesTotal, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric
+	return nLinesTotal, nAttemptsByMetric, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric, nTimeoutsByMetric, nLinesTruncated, lineDelaySeconds, logTimeLagSeconds
 }
 
 func startServer(cfg v3.ServerConfig, httpHandlers []exporter.HttpServerPathHandler) chan error {
 	serverErrors := make(chan error)
-	go func() {
-		switch {
-		case cfg.Protocol == "http":
-			serverErrors <- exporter.RunHttpServer(cfg.Host, cfg.Port, httpHandlers)
-		case cfg.Protocol == "https":
-			serverErrors <- exporter.RunHttpsServer(cfg, httpHandlers)
-		default:
-			// This cannot happen, because cfg.validate() makes sure that protocol is either http or https.
-			serverErrors <- fmt.Errorf("Configuration error: Invalid 'server.protocol': '%v'. Expecting 'http' or 'https'.", cfg.Protocol)
-		}
-	}()
+	mux := exporter.NewServeMux(httpHandlers)
+	for _, listener := range cfg.AllListeners() {
+		go func(listener v3.ListenerConfig) {
+			switch {
+			case listener.Protocol == "http":
+				serverErrors <- exporter.RunHttpServer(listener, mux)
+			case listener.Protocol == "https":
+				serverErrors <- exporter.RunHttpsServer(listener, mux)
+			default:
+				// This cannot happen, because cfg.validate() makes sure that protocol is either http or https.
+				serverErrors <- fmt.Errorf("Configuration error: Invalid 'server.protocol': '%v'. Expecting 'http' or 'https'.", listener.Protocol)
+			}
+		}(listener)
+	}
 	return serverErrors
 }
 
-func startTailer(cfg *v3.Config, registry prometheus.Registerer) (fswatcher.FileTailer, error) {
+// In oneshot mode, the tailers close their lines channel at the end of the input.
+// stopInputs() closes the inputs, but not the tailers wrapping them, so that the lines that were already read
+// are still processed. The lines channel is closed when all of them are processed.
+func startTailer(cfg *v3.Config, patterns *exporter.Patterns, registry prometheus.Registerer, oneshot bool) (fswatcher.FileTailer, func(), error) {
 	var (
-		tail fswatcher.FileTailer
-		err  error
+		ids              []string
+		inputs           []fswatcher.FileTailer
+		tailers          []fswatcher.FileTailer
+		maxLinesInBuffer int
+		engine           = exporter.RegexEngine(cfg.Global.RegexEngine)
 	)
 	logger := logrus.New()
 	logger.Level = logrus.WarnLevel
+	nLinesDropped := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_lines_dropped_total",
+		Help: "Number of log lines that were dropped because the input's rate_limit was exceeded or its line buffer was full.",
+	}, []string{"input"})
+	registry.MustRegister(nLinesDropped)
+	nLinesDeduplicated := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grok_exporter_lines_deduplicated_total",
+		Help: "Number of log lines that were not processed individually, because they were identical to the previous line within the input's dedup_window.",
+	}, []string{"input"})
+	registry.MustRegister(nLinesDeduplicated)
+	for i, input := range cfg.AllInputs() {
+		tail, err := runTailer(input, patterns, engine, logger, oneshot)
+		if err == nil {
+			inputs = append(inputs, tail)
+		}
+		if err == nil {
+			tail, err = parsingTailer(tail, input, patterns, engine)
+		}
+		if err == nil && input.DedupWindow > 0 {
+			deduplicated := nLinesDeduplicated.WithLabelValues(input.Id)
+			tail = tailer.DedupTailer(tail, input.DedupWindow, func(n int) { deduplicated.Add(float64(n)) })
+		}
+		if err == nil && (input.RateLimit > 0 || input.LineBufferSize > 0) {
+			dropped := nLinesDropped.WithLabelValues(input.Id)
+			tail = tailer.RateLimitedTailer(tail, input.RateLimit, input.LineBufferSize, input.BackpressureAction == "drop", dropped.Inc)
+		}
+		if err != nil {
+			for _, t := range tailers {
+				t.Close()
+			}
+			return nil, nil, err
+		}
+		ids = append(ids, input.Id)
+		tailers = append(tailers, tail)
+		// All inputs share a single line buffer. The limit is the sum of the limits of all inputs,
+		// and there is no limit if any of the inputs has no limit.
+		if i == 0 || (maxLinesInBuffer > 0 && input.MaxLinesInBuffer > 0) {
+			maxLinesInBuffer += input.MaxLinesInBuffer
+		} else {
+			maxLinesInBuffer = 0
+		}
+	}
+	bufferLoadMetric := exporter.NewBufferLoadMetric(logger, maxLinesInBuffer > 0, registry)
+	stopInputs := func() {
+		for _, input := range inputs {
+			input.Close()
+		}
+	}
+	return tailer.BufferedTailerWithMetrics(tailer.MultiTailer(ids, tailers), bufferLoadMetric, logger, maxLinesInBuffer), stopInputs, nil
+}
+
+// parsingTailer merges multiline records, parses the log time and the json or csv format of the lines,
+// and matches the input's match pattern, as configured for the input.
+func parsingTailer(tail fswatcher.FileTailer, input *v3.InputConfig, patterns *exporter.Patterns, engine exporter.RegexEngine) (fswatcher.FileTailer, error) {
+	var err error
+	if input.MultilineStartPattern != "" {
+		tail, err = multilineTailer(tail, input, patterns, engine)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if input.TimestampPattern != "" {
+		tail, err = logTimeTailer(tail, input, patterns, engine)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if input.Match != "" {
+		tail, err = captureTailer(tail, input, patterns, engine)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch input.Format {
+	case "json":
+		tail = tailer.JsonTailer(tail)
+	case "csv":
+		tail = tailer.CsvTailer(tail, input.CsvDelimiterRune(), input.CsvFields)
+	}
+	return tail, nil
+}
+
+func multilineTailer(tail fswatcher.FileTailer, input *v3.InputConfig, patterns *exporter.Patterns, engine exporter.RegexEngine) (fswatcher.FileTailer, error) {
+	regex, err := exporter.Compile(input.MultilineStartPattern, patterns, engine)
+	if err != nil {
+		tail.Close()
+		return nil, fmt.Errorf("failed to compile multiline_start_pattern: %v", err)
+	}
+	isStart := func(line string) bool {
+		searchResult, err := regex.Search(line)
+		if err != nil {
+			return true // start a new record, so that the line is not merged into a record it doesn't belong to
+		}
+		defer searchResult.Free()
+		return searchResult.IsMatch()
+	}
+	return tailer.MultilineTailer(tail, isStart, input.MultilineTimeout, input.MultilineMaxLines), nil
+}
+
+func captureTailer(tail fswatcher.FileTailer, input *v3.InputConfig, patterns *exporter.Patterns, engine exporter.RegexEngine) (fswatcher.FileTailer, error) {
+	inputMatch, err := exporter.NewInputMatch(input.Match, patterns, engine)
+	if err != nil {
+		tail.Close()
+		return nil, fmt.Errorf("failed to compile match: %v", err)
+	}
+	return tailer.CaptureTailer(tail, inputMatch.Captures), nil
+}
+
+func startPosition(input *v3.InputConfig, patterns *exporter.Patterns, engine exporter.RegexEngine) (fswatcher.StartPosition, error) {
+	switch input.StartPositionType {
+	case "beginning":
+		return fswatcher.StartPosition{Type: fswatcher.Beginning}, nil
+	case "byte":
+		return fswatcher.StartPosition{Type: fswatcher.ByteOffset, Offset: input.StartPositionOffset}, nil
+	case "line":
+		return fswatcher.StartPosition{Type: fswatcher.LineOffset, Offset: input.StartPositionOffset}, nil
+	case "timestamp":
+		isBefore, err := isBeforeStartFrom(input, patterns, engine)
+		if err != nil {
+			return fswatcher.StartPosition{}, err
+		}
+		return fswatcher.StartPosition{Type: fswatcher.Timestamp, IsBefore: isBefore}, nil
+	default:
+		return fswatcher.StartPosition{Type: fswatcher.End}, nil
+	}
+}
+
+func isBeforeStartFrom(input *v3.InputConfig, patterns *exporter.Patterns, engine exporter.RegexEngine) (func(line string) (bool, bool), error) {
+	parse, err := timestampParser("start_from_pattern", input.StartFromPattern, input.StartFromLayout, time.UTC, patterns, engine)
+	if err != nil {
+		return nil, err
+	}
+	return func(line string) (bool, bool) {
+		timestamp, ok := parse(line)
+		if !ok {
+			return false, false
+		}
+		return timestamp.Before(input.StartFrom), true
+	}, nil
+}
+
+func logTimeTailer(tail fswatcher.FileTailer, input *v3.InputConfig, patterns *exporter.Patterns, engine exporter.RegexEngine) (fswatcher.FileTailer, error) {
+	parse, err := timestampParser("timestamp_pattern", input.TimestampPattern, input.TimestampLayout, input.TimestampLocation(), patterns, engine)
+	if err != nil {
+		tail.Close()
+		return nil, err
+	}
+	return tailer.LogTimeTailer(tail, parse), nil
+}
+
+// timestampParser returns a function that finds the timestamp in a line with a grok pattern with a 'timestamp' field.
+// The result is false if the line doesn't match the pattern or if the timestamp cannot be parsed with the layout.
+// Timestamps without time zone are in the location.
+func timestampParser(name, pattern, layout string, location *time.Location, patterns *exporter.Patterns, engine exporter.RegexEngine) (func(line string) (time.Time, bool), error) {
+	regex, err := exporter.Compile(pattern, patterns, engine)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile %v: %v", name, err)
+	}
+	if !regex.HasCaptureGroup("timestamp") {
+		regex.Free()
+		return nil, fmt.Errorf("failed to compile %v: the pattern has no field named 'timestamp'", name)
+	}
+	return func(line string) (time.Time, bool) {
+		searchResult, err := regex.Search(line)
+		if err != nil {
+			return time.Time{}, false
+		}
+		defer searchResult.Free()
+		if !searchResult.IsMatch() {
+			return time.Time{}, false
+		}
+		value, err := searchResult.GetCaptureGroupByName("timestamp")
+		if err != nil {
+			return time.Time{}, false
+		}
+		timestamp, err := time.ParseInLocation(layout, value, location)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return timestamp, true
+	}, nil
+}
+
+func lineFormat(input *v3.InputConfig) (fswatcher.LineFormat, error) {
+	var (
+		delimiter *fswatcher.Delimiter
+		err       error
+	)
+	switch {
+	case input.LineDelimiterPattern != "":
+		delimiter, err = fswatcher.NewRegexDelimiter(input.LineDelimiterPattern)
+		if err != nil {
+			return fswatcher.LineFormat{}, err
+		}
+	case input.LineDelimiter != "":
+		delimiter = fswatcher.NewDelimiter(input.LineDelimiter)
+	}
+	var charset encoding.Encoding
+	if input.Charset != "" {
+		charset, err = fswatcher.LookupCharset(input.Charset)
+		if err != nil {
+			return fswatcher.LineFormat{}, err
+		}
+	}
+	return fswatcher.NewLineFormat(delimiter, charset, input.MaxLineLength, input.MaxLineLengthAction == "split")
+}
+
+func runTailer(input *v3.InputConfig, patterns *exporter.Patterns, engine exporter.RegexEngine, logger logrus.FieldLogger, oneshot bool) (fswatcher.FileTailer, error) {
+	var (
+		tail fswatcher.FileTailer
+		err  error
+	)
+	format, err := lineFormat(input)
+	if err != nil {
+		return nil, err
+	}
 	switch {
-	case cfg.Input.Type == "file":
-		if cfg.Input.PollInterval == 0 {
-			tail, err = fswatcher.RunFileTailer(cfg.Input.Globs, cfg.Input.Readall, cfg.Input.FailOnMissingLogfile, logger)
+	case input.Type == "file" && oneshot:
+		start, err := startPosition(input, patterns, engine)
+		if err != nil {
+			return nil, err
+		}
+		tail, err = fswatcher.RunOneshotFileTailer(input.Globs, input.Exclude, start, input.ReadCompressedBackups, input.Olddir, input.FailOnMissingLogfile, format, logger)
+		if err != nil {
+			return nil, err
+		}
+	case input.Type == "stdin" && oneshot:
+		tail = tailer.RunOneshotStdinTailer(format)
+	case input.Type == "file":
+		var positions *fswatcher.PositionsFile
+		if input.PositionsFile != "" {
+			if input.RestorePositions {
+				positions, err = fswatcher.LoadPositionsFile(input.PositionsFile, input.PositionsSyncInterval)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				positions = fswatcher.NewPositionsFile(input.PositionsFile, input.PositionsSyncInterval)
+			}
+		}
+		start, err := startPosition(input, patterns, engine)
+		if err != nil {
+			return nil, err
+		}
+		opts := fswatcher.Options{
+			Exclude:               input.Exclude,
+			Start:                 start,
+			ReadCompressedBackups: input.ReadCompressedBackups,
+			Olddir:                input.Olddir,
+			FollowPath:            input.FollowPath,
+			FailOnMissingFile:     input.FailOnMissingLogfile,
+			Positions:             positions,
+			Format:                format,
+			IdleTimeout:           input.IdleTimeout,
+			PartialLineTimeout:    input.PartialLineTimeout,
+			PollInterval:          input.PollInterval,
+		}
+		if input.PollInterval == 0 {
+			tail, err = fswatcher.RunFileTailer(input.Globs, opts, logger)
 			if err != nil {
 				return nil, err
 			}
 		} else {
-			tail, err = fswatcher.RunPollingFileTailer(cfg.Input.Globs, cfg.Input.Readall, cfg.Input.FailOnMissingLogfile, cfg.Input.PollInterval, logger)
+			tail, err = fswatcher.RunPollingFileTailer(input.Globs, opts, logger)
 			if err != nil {
 				return nil, err
 			}
 		}
-	case cfg.Input.Type == "stdin":
-		tail = tailer.RunStdinTailer()
-	case cfg.Input.Type == "webhook":
-		tail = tailer.InitWebhookTailer(&cfg.Input)
-	case cfg.Input.Type == "kafka":
-		tail = tailer.RunKafkaTailer(&cfg.Input)
+	case input.Type == "stdin":
+		tail = tailer.RunStdinTailer(format)
+	case input.Type == "webhook":
+		tail = tailer.InitWebhookTailer(input)
+	case input.Type == "kafka":
+		tail = tailer.RunKafkaTailer(input)
+	case input.Type == "journald":
+		tail, err = tailer.RunJournaldTailer(input)
+		if err != nil {
+			return nil, err
+		}
+	case input.Type == "syslog":
+		tail, err = tailer.RunSyslogTailer(input)
+		if err != nil {
+			return nil, err
+		}
+	case input.Type == "kubernetes":
+		tail, err = tailer.RunKubernetesTailer(input)
+		if err != nil {
+			return nil, err
+		}
+	case input.Type == "socket":
+		tail, err = tailer.RunSocketTailer(input)
+		if err != nil {
+			return nil, err
+		}
+	case input.Type == "gelf":
+		tail, err = tailer.RunGelfTailer(input)
+		if err != nil {
+			return nil, err
+		}
+	case input.Type == "s3":
+		tail, err = tailer.RunS3Tailer(input)
+		if err != nil {
+			return nil, err
+		}
+	case input.Type == "nats":
+		tail, err = tailer.RunNatsTailer(input)
+		if err != nil {
+			return nil, err
+		}
+	case input.Type == "mqtt":
+		tail, err = tailer.RunMqttTailer(input)
+		if err != nil {
+			return nil, err
+		}
 	default:
-		return nil, fmt.Errorf("Config error: Input type '%v' unknown.", cfg.Input.Type)
+		return nil, fmt.Errorf("Config error: Input type '%v' unknown.", input.Type)
+	}
+	if input.Type != "file" {
+		// The file tailers close their lines channel themselves when they are closed, after saving their positions.
+		tail = tailer.ClosableTailer(tail)
 	}
-	bufferLoadMetric := exporter.NewBufferLoadMetric(logger, cfg.Input.MaxLinesInBuffer > 0, registry)
-	return tailer.BufferedTailerWithMetrics(tail, bufferLoadMetric, logger, cfg.Input.MaxLinesInBuffer), nil
+	return tail, nil
 }
@@ -0,0 +1,122 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+)
+
+const sampleRateConfig = `
+global:
+    config_version: 3
+input:
+    type: stdin
+metrics:
+    - type: counter
+      name: debug_lines_total
+      help: Sampled debug lines.
+      match: 'DEBUG cache miss'
+      sample_rate: 0.1
+`
+
+func TestLinesTotalWithSampleRate(t *testing.T) {
+	cfg, err := v3.Unmarshal([]byte(sampleRateConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns, bundledPatterns, err := initPatterns(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := createMetrics(cfg, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nLinesTotal, _, _, _, _, _, _, _, _ := initSelfMonitoring(metrics, bundledPatterns, prometheus.NewRegistry())
+	nSampled := 0
+	for i := 0; i < 1000; i++ {
+		match, err := metrics[0].ProcessMatch("DEBUG cache miss", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matched := match != nil && !match.Unsampled
+		if matched {
+			nSampled++
+		}
+		nLinesTotal.WithLabelValues(lineStatus(matched, match != nil && match.Unsampled)).Inc()
+	}
+	if nSampled == 0 || nSampled > 200 {
+		t.Fatalf("expected about 100 of 1000 lines to be sampled, but got %v", nSampled)
+	}
+	if matched := counterValue(t, nLinesTotal.WithLabelValues(number_of_lines_matched_label)); matched != 1000 {
+		t.Fatalf("expected all 1000 lines to be counted as matched, but got %v", matched)
+	}
+	if ignored := counterValue(t, nLinesTotal.WithLabelValues(number_of_lines_ignored_label)); ignored != 0 {
+		t.Fatalf("expected no lines to be counted as ignored, but got %v", ignored)
+	}
+	if status := lineStatus(false, false); status != number_of_lines_ignored_label {
+		t.Fatalf("expected a line that no metric matched or skipped to be %v, but got %v", number_of_lines_ignored_label, status)
+	}
+}
+
+func TestDryRunUnmatchedWithSampleRate(t *testing.T) {
+	cfg, err := v3.Unmarshal([]byte(sampleRateConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns, _, err := initPatterns(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := createMetrics(cfg, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := exporter.NewFilter(cfg.Filter, patterns, exporter.RegexEngine(cfg.Global.RegexEngine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filter.Free()
+	stats := &replayStats{
+		metrics:   map[string]*metricStats{metrics[0].Name(): {}},
+		unmatched: make(map[string]*unmatchedLines),
+	}
+	for i := 0; i < 100; i++ {
+		err = stats.process(&fswatcher.Line{Line: "DEBUG cache miss"}, cfg.AllInputs()[0], filter, metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats.matched != 100 || stats.ignored != 0 || len(stats.unmatched) != 0 {
+		t.Fatalf("expected 100 matched lines and no unmatched lines, but got %v matched, %v ignored, and unmatched lines %v", stats.matched, stats.ignored, stats.unmatched)
+	}
+	if n := stats.metrics[metrics[0].Name()].matches; n == 0 || n > 50 {
+		t.Fatalf("expected about 10 of 100 lines to match the sampled metric, but got %v", n)
+	}
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var m io_prometheus_client.Metric
+	if err := counter.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.Counter.GetValue()
+}
@@ -2,11 +2,18 @@
 
 set -e
 
-if [[ $(go version) != *"go1.11"* && $(go version) != *"go1.12"* && $(go version) != *"go1.13"* && $(go version) != *"go1.14"* && $(go version) != *"go1.15"* ]] ; then
-    echo "grok_exporter uses Go 1.11 Modules. Please use Go version >= 1.11." >&2
-    echo "Version found is $(go version)" >&2
-    exit 1
-fi
+# The vendored dependencies, like client_golang with native histograms, require Go 1.17 or later.
+function check_go_version {
+    local minor
+    minor=$(echo "$1" | sed -n 's/.* go1\.\([0-9]*\).*/\1/p')
+    if [[ -z "$minor" || "$minor" -lt 17 ]] ; then
+        echo "grok_exporter requires Go version >= 1.17." >&2
+        echo "Version found is $1" >&2
+        exit 1
+    fi
+}
+
+check_go_version "$(go version)"
 
 if git status | grep example/ ; then
     echo "error: untracked files in example directory" >&2
@@ -30,6 +37,7 @@ export VERSION_FLAGS="\
         -X github.com/fstab/grok_exporter/exporter.BuildDate=$(date +%Y-%m-%d)
         -X github.com/fstab/grok_exporter/exporter.Branch=$(git rev-parse --abbrev-ref HEAD)
         -X github.com/fstab/grok_exporter/exporter.Revision=$(git rev-parse --short HEAD)
+        -X github.com/fstab/grok_exporter/exporter.PatternsVersion=$(git -C logstash-patterns-core describe --tags --always)
 "
 
 #--------------------------------------------------------------
@@ -76,7 +84,13 @@ function create_zip_file {
     cd ..
 }
 
+# The Docker images have their own Go toolchain, which must be at least the version checked above.
+function check_docker_go_version {
+    check_go_version "$(docker run --net none --rm "$1" go version)"
+}
+
 function run_docker_linux_amd64 {
+    check_docker_go_version "fstab/grok_exporter-compiler-amd64:v$VERSION"
     docker run \
         -v $GOPATH/src/github.com/fstab/grok_exporter:/go/src/github.com/fstab/grok_exporter \
         --net none \
@@ -86,6 +100,7 @@ function run_docker_linux_amd64 {
 }
 
 function run_docker_windows_amd64 {
+    check_docker_go_version "fstab/grok_exporter-compiler-amd64:v$VERSION"
     docker run \
         -v $GOPATH/src/github.com/fstab/grok_exporter:/go/src/github.com/fstab/grok_exporter \
         --net none \
@@ -95,6 +110,7 @@ function run_docker_windows_amd64 {
 }
 
 function run_docker_linux_arm64v8 {
+    check_docker_go_version "fstab/grok_exporter-compiler-arm64v8:v$VERSION"
     docker run \
         -v $GOPATH/src/github.com/fstab/grok_exporter:/go/src/github.com/fstab/grok_exporter \
         --net none \
@@ -104,6 +120,7 @@ function run_docker_linux_arm64v8 {
 }
 
 function run_docker_linux_arm32v6 {
+    check_docker_go_version "fstab/grok_exporter-compiler-arm32v6:v$VERSION"
     docker run \
         -v $GOPATH/src/github.com/fstab/grok_exporter:/go/src/github.com/fstab/grok_exporter \
         --net none \
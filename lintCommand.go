@@ -0,0 +1,201 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/fstab/grok_exporter/config"
+	"github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/exporter"
+)
+
+const lintUsage = `Usage: grok_exporter lint -config <path> [-strict]
+
+Checks the config without starting the exporter, and prints the errors and
+warnings found: invalid options and templates, duplicate metric names, unknown
+grok patterns, fields that are not defined by the patterns, unanchored
+patterns that may match anywhere in a line, and patterns that may backtrack
+catastrophically. The exit code is non-zero if there are errors, or if there
+are warnings and -strict is given.
+`
+
+var grokReferenceRegex = regexp.MustCompile(exporter.PATTERN_RE)
+
+type lintFindings struct {
+	errors, warnings []string
+}
+
+// runLintCommand implements 'grok_exporter lint'. A config that cannot be loaded is reported as the returned error,
+// because the other checks need the loaded config.
+func runLintCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, lintUsage)
+		flags.PrintDefaults()
+	}
+	lintConfigPath := flags.String("config", "", "Path to the config file.")
+	strict := flags.Bool("strict", false, "Fail if there are warnings.")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		os.Exit(-1) // the flag package already printed the error and the usage
+	}
+	if *lintConfigPath == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(-1)
+	}
+	findings := &lintFindings{}
+	cfg, warn, err := config.LoadConfigFile(*lintConfigPath)
+	if len(warn) > 0 {
+		findings.warnf("%v", warn)
+	}
+	if err != nil {
+		return err
+	}
+	patterns, _, err := initPatterns(cfg)
+	if err != nil {
+		return err
+	}
+	lintConfig(cfg, patterns, findings)
+	for _, e := range findings.errors {
+		fmt.Fprintf(out, "error: %v\n", e)
+	}
+	for _, w := range findings.warnings {
+		fmt.Fprintf(out, "warning: %v\n", w)
+	}
+	fmt.Fprintf(out, "%v: %v errors, %v warnings\n", *lintConfigPath, len(findings.errors), len(findings.warnings))
+	if len(findings.errors) > 0 || (*strict && len(findings.warnings) > 0) {
+		return fmt.Errorf("grok_exporter lint: %v failed the checks", *lintConfigPath)
+	}
+	return nil
+}
+
+// lintConfig runs the checks that the config validation doesn't cover, because they need the grok patterns.
+// Each metric is initialized on its own, so that the errors of all metrics are reported, not only the first one.
+func lintConfig(cfg *v3.Config, patterns *exporter.Patterns, findings *lintFindings) {
+	engine := exporter.RegexEngine(cfg.Global.RegexEngine)
+	for i, m := range cfg.AllMetrics {
+		where := fmt.Sprintf("metric %v", m.Name)
+		single := *cfg
+		single.AllMetrics = cfg.AllMetrics[i : i+1]
+		metrics, err := createMetrics(&single, patterns)
+		if err != nil {
+			findings.errorf("%v", err)
+			continue
+		}
+		freeMetrics(metrics)
+		unanchored := m.MatchField == "" && m.MatchGrokField == "" && (m.Anchor == "" || m.Anchor == v3.AnchorNone)
+		lintPattern(where+": match", m.Match, m.RegexFlags, unanchored, patterns, engine, findings)
+		for j, match := range m.Matches {
+			lintPattern(fmt.Sprintf("%v: matches[%v]", where, j), match, m.RegexFlags, unanchored, patterns, engine, findings)
+		}
+		lintPattern(where+": delete_match", m.DeleteMatch, m.RegexFlags, unanchored, patterns, engine, findings)
+		lintPattern(where+": drop_if_match", m.DropIfMatch, m.RegexFlags, false, patterns, engine, findings)
+	}
+	for _, input := range cfg.AllInputs() {
+		where := "input"
+		if input.Id != "" {
+			where = fmt.Sprintf("input %v", input.Id)
+		}
+		lintPattern(where+": multiline_start_pattern", input.MultilineStartPattern, nil, false, patterns, engine, findings)
+		lintPattern(where+": timestamp_pattern", input.TimestampPattern, nil, false, patterns, engine, findings)
+		lintPattern(where+": start_from_pattern", input.StartFromPattern, nil, false, patterns, engine, findings)
+		lintPattern(where+": match", input.Match, nil, false, patterns, engine, findings)
+	}
+	for j, include := range cfg.Filter.Include {
+		lintPattern(fmt.Sprintf("filter: include[%v]", j), include, nil, false, patterns, engine, findings)
+	}
+	for j, exclude := range cfg.Filter.Exclude {
+		lintPattern(fmt.Sprintf("filter: exclude[%v]", j), exclude, nil, false, patterns, engine, findings)
+	}
+}
+
+// lintPattern reports if the grok pattern cannot be compiled, if it is unanchored and may match anywhere in a line,
+// and if it may backtrack catastrophically when matched with Oniguruma. The flags are the metric's regex_flags.
+func lintPattern(where string, pattern string, flags []string, unanchored bool, patterns *exporter.Patterns, engine exporter.RegexEngine, findings *lintFindings) {
+	if pattern == "" {
+		return
+	}
+	regex, err := exporter.Compile(exporter.WithFlags(pattern, flags), patterns, engine)
+	if err != nil {
+		findings.errorf("%v: %v", where, err)
+		return
+	}
+	defer regex.Free()
+	expanded, err := exporter.Expand(exporter.WithFlags(pattern, flags), patterns)
+	if err != nil {
+		findings.errorf("%v: %v", where, err)
+		return
+	}
+	// Case insensitive literals also restrict where the pattern may match, so the literals are checked without ignore_case.
+	caseSensitive, _ := exporter.Expand(exporter.WithFlags(pattern, without(flags, v3.RegexFlagIgnoreCase)), patterns)
+	if unanchored && !strings.HasPrefix(caseSensitive, "^") && !strings.HasPrefix(caseSensitive, `\A`) && !exporter.RequiresLiteral(caseSensitive) {
+		findings.warnf("%v: the pattern has no literal text and is not anchored, so it may match a part of an unrelated line, like %%{INT} matches the 1 in /v1/users. Consider anchor: start or full.", where)
+	}
+	if regex.Engine() == exporter.Oniguruma && exporter.HasBacktrackingRisk(expanded) {
+		if references := riskyReferences(pattern, patterns); len(references) > 0 {
+			findings.warnf("%v: %v may backtrack catastrophically on lines that almost match. Consider setting global.match_timeout.", where, strings.Join(references, ", "))
+		} else {
+			findings.warnf("%v: the pattern may backtrack catastrophically on lines that almost match, because it repeats a repetition that can match the same text in several ways, like (\\w+\\s?)*. Consider an atomic group (?>...), or setting global.match_timeout.", where)
+		}
+	}
+}
+
+// riskyReferences returns the %{...} references in the grok pattern that may backtrack catastrophically on their own.
+func riskyReferences(pattern string, patterns *exporter.Patterns) []string {
+	var result []string
+	for _, match := range grokReferenceRegex.FindAllStringSubmatch(pattern, -1) {
+		reference := "%{" + strings.SplitN(match[1], ":", 2)[0] + "}"
+		if regex, err := exporter.Expand(reference, patterns); err == nil && exporter.HasBacktrackingRisk(regex) {
+			result = appendUnique(result, reference)
+		}
+	}
+	return result
+}
+
+// errorf adds an error, unless the same error was already reported, like for an input's match pattern used by several metrics.
+func (f *lintFindings) errorf(format string, args ...interface{}) {
+	f.errors = appendUnique(f.errors, fmt.Sprintf(format, args...))
+}
+
+func (f *lintFindings) warnf(format string, args ...interface{}) {
+	f.warnings = appendUnique(f.warnings, fmt.Sprintf(format, args...))
+}
+
+func without(list []string, s string) []string {
+	var result []string
+	for _, existing := range list {
+		if existing != s {
+			result = append(result, existing)
+		}
+	}
+	return result
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -27,6 +27,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -123,7 +124,7 @@ func (regex *Regex) searchWithOffset(input string, offset int) (*SearchResult, e
 	inputStart, inputEnd := pointers(input)
 	defer free(inputStart, inputEnd)
 	searchStart := offsetPointer(inputStart, offset)
-	r := C.onig_search(regex.regex, inputStart, inputEnd, searchStart, inputEnd, region, C.ONIG_OPTION_NONE)
+	r := search(regex.regex, inputStart, inputEnd, searchStart, region, atomic.LoadUint64(&retryLimit))
 	if r == C.ONIG_MISMATCH {
 		C.onig_region_free(region, 1)
 		return &SearchResult{
@@ -132,7 +133,7 @@ func (regex *Regex) searchWithOffset(input string, offset int) (*SearchResult, e
 	} else if r < 0 {
 		C.onig_region_free(region, 1)
 		if C.oniguruma_helper_is_retry_limit_error(r) != 0 {
-			return nil, fmt.Errorf("the match takes too long to process: the oniguruma regular expression library aborted the match with error: %v", errMsg(r))
+			return nil, fmt.Errorf("%w: the oniguruma regular expression library aborted the match with error: %v", ErrMatchTimeout, errMsg(r))
 		}
 		return nil, errors.New(errMsg(r))
 	} else {
@@ -145,6 +146,14 @@ func (regex *Regex) searchWithOffset(input string, offset int) (*SearchResult, e
 	}
 }
 
+// search returns the result of onig_search(). If limit is not 0, the search is aborted after limit backtracking steps.
+func search(regex C.OnigRegex, inputStart, inputEnd, searchStart *C.OnigUChar, region *C.OnigRegion, limit uint64) C.int {
+	if limit > 0 {
+		return C.oniguruma_helper_search_with_retry_limit(regex, inputStart, inputEnd, searchStart, inputEnd, region, C.ulong(limit))
+	}
+	return C.onig_search(regex, inputStart, inputEnd, searchStart, inputEnd, region, C.ONIG_OPTION_NONE)
+}
+
 func (m *SearchResult) IsMatch() bool {
 	return m.match
 }
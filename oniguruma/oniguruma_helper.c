@@ -12,6 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+#include <stdlib.h>
 #include "oniguruma_helper.h"
 
 // CGO does not support C preprocessor instructions (#if, #else, #endif).
@@ -44,9 +45,38 @@ int oniguruma_helper_error_code_to_str(UChar* err_buf, int err_code) {
 }
 
 int oniguruma_helper_is_retry_limit_error(int err_code) {
+    #ifdef ONIGERR_RETRY_LIMIT_IN_SEARCH_OVER
+        if (err_code == ONIGERR_RETRY_LIMIT_IN_SEARCH_OVER) {
+            return 1;
+        }
+    #endif
     #ifdef ONIGERR_RETRY_LIMIT_IN_MATCH_OVER
         return err_code == ONIGERR_RETRY_LIMIT_IN_MATCH_OVER;
     #else
         return 0;
     #endif
 }
+
+// The retry limit in search is available since Oniguruma 6.9.5. Older versions search without limit.
+
+int oniguruma_helper_search_with_retry_limit(OnigRegex reg, UChar* str, UChar* end, UChar* start, UChar* range, OnigRegion* region, unsigned long limit) {
+    #ifdef ONIGERR_RETRY_LIMIT_IN_SEARCH_OVER
+        OnigMatchParam* mp = onig_new_match_param();
+        if (mp != NULL) {
+            int result;
+            onig_set_retry_limit_in_search_of_match_param(mp, limit);
+            result = onig_search_with_param(reg, str, end, start, range, region, ONIG_OPTION_NONE, mp);
+            onig_free_match_param(mp);
+            return result;
+        }
+    #endif
+    return onig_search(reg, str, end, start, range, region, ONIG_OPTION_NONE);
+}
+
+int oniguruma_helper_has_retry_limit_in_search() {
+    #ifdef ONIGERR_RETRY_LIMIT_IN_SEARCH_OVER
+        return 1;
+    #else
+        return 0;
+    #endif
+}
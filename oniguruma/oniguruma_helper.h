@@ -18,3 +18,5 @@ extern int oniguruma_helper_initialize(OnigEncoding encodings[], int n);
 extern int oniguruma_helper_error_code_with_info_to_str(UChar* err_buf, int err_code, OnigErrorInfo *errInfo);
 extern int oniguruma_helper_error_code_to_str(UChar* err_buf, int err_code);
 extern int oniguruma_helper_is_retry_limit_error(int err_code);
+extern int oniguruma_helper_search_with_retry_limit(OnigRegex reg, UChar* str, UChar* end, UChar* start, UChar* range, OnigRegion* region, unsigned long limit);
+extern int oniguruma_helper_has_retry_limit_in_search();
@@ -15,7 +15,10 @@
 package oniguruma
 
 import (
+	"errors"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestInvalidPatterns(t *testing.T) {
@@ -126,3 +129,28 @@ func TestInvalidCaptureGroups(t *testing.T) {
 	}
 	match.Free()
 }
+
+func TestMatchTimeout(t *testing.T) {
+	regex, err := Compile(`^(\w+\s?)*$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regex.Free()
+	if err := SetMatchTimeout(10 * time.Millisecond); err != nil {
+		t.Skip(err) // Oniguruma is older than 6.9.5
+	}
+	defer SetMatchTimeout(0)
+	start := time.Now()
+	_, err = regex.Search(strings.Repeat("word ", 30) + "!")
+	if !errors.Is(err, ErrMatchTimeout) {
+		t.Fatalf("expected a match timeout, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the match to be aborted after about 10ms, but it took %v", elapsed)
+	}
+	result, err := regex.Search("word word")
+	if err != nil || !result.IsMatch() {
+		t.Fatalf("expected a match within the timeout, but got %v", err)
+	}
+	result.Free()
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oniguruma
+
+/*
+#include <oniguruma.h>
+#include "oniguruma_helper.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMatchTimeout is returned by Search() if Oniguruma aborted the match, because the pattern backtracks pathologically on the input.
+var ErrMatchTimeout = errors.New("the match takes too long to process")
+
+var (
+	retryLimit       uint64 // backtracking steps per search, 0 means that only Oniguruma's limit per match position applies
+	calibration      sync.Once
+	retriesPerSecond float64
+)
+
+// SetMatchTimeout limits the time a search may take, 0 means no limit. Oniguruma cannot measure the time of a search,
+// so the timeout is converted to a limit of backtracking steps, based on how many steps per second Oniguruma performs on this machine.
+func SetMatchTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		atomic.StoreUint64(&retryLimit, 0)
+		return nil
+	}
+	if C.oniguruma_helper_has_retry_limit_in_search() == 0 {
+		return fmt.Errorf("a match timeout requires Oniguruma 6.9.5 or newer, but the Oniguruma version is %v", Version())
+	}
+	calibration.Do(calibrate)
+	limit := uint64(timeout.Seconds() * retriesPerSecond)
+	if limit == 0 {
+		limit = 1
+	}
+	atomic.StoreUint64(&retryLimit, limit)
+	return nil
+}
+
+// calibrate measures retriesPerSecond with a pattern that backtracks exponentially until it reaches the retry limit.
+// The measurement is repeated, and the fastest run is used, so that a slow run doesn't make the limit too strict.
+func calibrate() {
+	const steps = 1000000
+	regex, err := Compile(`^(?:a|a)*$`)
+	if err != nil {
+		panic(fmt.Sprintf("failed to compile the calibration pattern: %v", err))
+	}
+	defer regex.Free()
+	inputStart, inputEnd := pointers(strings.Repeat("a", 64) + "!")
+	defer free(inputStart, inputEnd)
+	region := C.onig_region_new()
+	defer C.onig_region_free(region, 1)
+	var fastest time.Duration
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		search(regex.regex, inputStart, inputEnd, inputStart, region, steps)
+		if elapsed := time.Since(start); i == 0 || elapsed < fastest {
+			fastest = elapsed
+		}
+	}
+	retriesPerSecond = steps / fastest.Seconds()
+}
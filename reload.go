@@ -0,0 +1,203 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/fstab/grok_exporter/config"
+	"github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+const reloadPath = "/-/reload"
+
+// metricDefinitions returns a definition for each metric in cfg.AllMetrics. When the config is reloaded,
+// a metric with an unchanged definition is taken over from the current config, so that its values are kept.
+// The grok patterns are part of the definition in their expanded form, so changing a pattern changes all metrics using it.
+func metricDefinitions(cfg *v3.Config, patterns *exporter.Patterns) ([]string, error) {
+	result := make([]string, 0, len(cfg.AllMetrics))
+	for _, m := range cfg.AllMetrics {
+		definition, err := yaml.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+		}
+		parts := []string{cfg.Global.RegexEngine, string(definition)}
+		for _, pattern := range append([]string{m.Match, m.DropIfMatch, m.DeleteMatch}, m.Matches...) {
+			regex, err := exporter.Expand(pattern, patterns)
+			if err != nil {
+				return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
+			}
+			parts = append(parts, regex)
+		}
+		result = append(result, strings.Join(parts, "\n"))
+	}
+	return result, nil
+}
+
+// reloadConfig loads the config file again and returns the new config, metrics, metric definitions, and filter.
+// The inputs keep running, so changes in the input and server sections are not applied until grok_exporter is restarted.
+// If the new config is invalid, an error is returned and the current config remains active.
+// The lookup tables and geoip databases are loaded again, including the files that did not change, and the match_timeout is applied.
+// They are applied after everything was loaded, so that an error doesn't leave a mix of the current and the new config.
+// The metrics that are replaced or removed are freed, so the current metrics must not be used if the reload was successful.
+// metricCounters are the self-monitoring metrics with a 'metric' label, the labels of removed metrics are deleted.
+func reloadConfig(cfg *v3.Config, metrics []exporter.Metric, definitions []string, lookupTables *exporter.LookupTables, metricCounters ...*prometheus.CounterVec) (*v3.Config, []exporter.Metric, []string, *exporter.Filter, error) {
+	newCfg, warn, err := config.LoadConfigFile(*configPath)
+	if len(warn) > 0 {
+		fmt.Fprintf(os.Stderr, "%v\n", warn)
+	}
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if requiresRestart(cfg, newCfg) {
+		fmt.Fprintf(os.Stderr, "WARNING: changes in the input, server, remote_write, and otlp configuration and in global.retention_check_interval, global.labels, and global.state_file are not applied until grok_exporter is restarted\n")
+	}
+	newCfg.Input, newCfg.Inputs, newCfg.Server = cfg.Input, cfg.Inputs, cfg.Server
+	newCfg.Global.RetentionCheckInterval, newCfg.Global.Labels = cfg.Global.RetentionCheckInterval, cfg.Global.Labels
+	newCfg.Global.StateFile, newCfg.Global.StateSyncInterval = cfg.Global.StateFile, cfg.Global.StateSyncInterval
+	newCfg.RemoteWrite, newCfg.OTLP = cfg.RemoteWrite, cfg.OTLP
+	patterns, _, err := initPatterns(newCfg)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	newDefinitions, err := metricDefinitions(newCfg, patterns)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	current := make(map[string]exporter.Metric, len(metrics))
+	for i, definition := range definitions {
+		current[definition] = metrics[i]
+	}
+	changedCfg := *newCfg
+	changedCfg.AllMetrics = nil
+	for i, definition := range newDefinitions {
+		if _, ok := current[definition]; !ok {
+			changedCfg.AllMetrics = append(changedCfg.AllMetrics, newCfg.AllMetrics[i])
+		}
+	}
+	created, err := createMetrics(&changedCfg, patterns)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	filter, err := exporter.NewFilter(newCfg.Filter, patterns, exporter.RegexEngine(newCfg.Global.RegexEngine))
+	if err != nil {
+		freeMetrics(created)
+		return nil, nil, nil, nil, err
+	}
+	applyLookupTables, err := lookupTables.Prepare(newCfg.LookupTables)
+	if err != nil {
+		freeMetrics(created)
+		filter.Free()
+		return nil, nil, nil, nil, err
+	}
+	applyGeoIPDatabases, err := exporter.PrepareGeoIPDatabases(newCfg.GeoIP)
+	if err != nil {
+		freeMetrics(created)
+		filter.Free()
+		return nil, nil, nil, nil, err
+	}
+	// The match_timeout is the last step that may fail. If it fails, the current timeout remains active.
+	err = exporter.SetMatchTimeout(newCfg.Global.MatchTimeout)
+	if err != nil {
+		freeMetrics(created)
+		filter.Free()
+		return nil, nil, nil, nil, err
+	}
+	applyLookupTables()
+	applyGeoIPDatabases()
+	newMetrics := make([]exporter.Metric, 0, len(newDefinitions))
+	kept := make(map[string]bool, len(newDefinitions))
+	names := make(map[string]bool, len(newDefinitions))
+	for _, definition := range newDefinitions {
+		if m, ok := current[definition]; ok {
+			newMetrics = append(newMetrics, m)
+			kept[definition] = true
+		} else {
+			newMetrics = append(newMetrics, created[0])
+			created = created[1:]
+		}
+		names[newMetrics[len(newMetrics)-1].Name()] = true
+	}
+	for i, definition := range definitions {
+		if !kept[definition] {
+			metrics[i].Free()
+		}
+	}
+	for _, counter := range metricCounters {
+		for i, definition := range definitions {
+			if !kept[definition] && !names[metrics[i].Name()] {
+				counter.DeleteLabelValues(metrics[i].Name())
+			}
+		}
+		for _, m := range newMetrics {
+			counter.WithLabelValues(m.Name()).Add(0)
+		}
+	}
+	return newCfg, newMetrics, newDefinitions, filter, nil
+}
+
+func requiresRestart(cfg, newCfg *v3.Config) bool {
+	marshal := func(cfg *v3.Config) string {
+		result, _ := yaml.Marshal([]interface{}{cfg.Input, cfg.Inputs, cfg.Server, cfg.Global.RetentionCheckInterval, cfg.Global.Labels, cfg.Global.StateFile, cfg.Global.StateSyncInterval, cfg.RemoteWrite, cfg.OTLP})
+		return string(result)
+	}
+	return marshal(cfg) != marshal(newCfg)
+}
+
+func initReloadMonitoring(registry prometheus.Registerer) (prometheus.Gauge, prometheus.Gauge) {
+	lastReloadSuccessful := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grok_exporter_config_last_reload_successful",
+		Help: "Whether the last reload of the config was successful, 1 for success and 0 for failure.",
+	})
+	lastReloadSuccessTimestamp := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grok_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful reload of the config, or of the start of grok_exporter if the config was not reloaded.",
+	})
+	registry.MustRegister(lastReloadSuccessful)
+	registry.MustRegister(lastReloadSuccessTimestamp)
+	lastReloadSuccessful.Set(1)
+	lastReloadSuccessTimestamp.SetToCurrentTime()
+	return lastReloadSuccessful, lastReloadSuccessTimestamp
+}
+
+// reloadHandler serves the /-/reload endpoint. The metrics are only used in the main loop,
+// so the reload is sent to the main loop, and the handler waits for the result.
+func reloadHandler(token string, reloadRequests chan<- chan error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "use POST or PUT to reload the config", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		result := make(chan error, 1)
+		reloadRequests <- result
+		if err := <-result; err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload the config: %v", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "config reloaded\n")
+	})
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fstab/grok_exporter/config"
+	"github.com/fstab/grok_exporter/exporter"
+)
+
+const reloadConfigTemplate = `
+global:
+    config_version: 3
+input:
+    type: stdin
+lookup_tables:
+    - name: dc_map
+      file: %v
+      reload_interval: %v
+geoip:
+    databases: [%v]
+metrics:
+    - type: counter
+      name: %v
+      help: Cache misses.
+      match: 'DEBUG cache miss'
+`
+
+func TestReloadConfigError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lookupTableFile := filepath.Join(dir, "dc.csv")
+	writeFile(t, lookupTableFile, "10.0.0.1,dc1\n")
+	originalConfigPath := *configPath
+	defer func() { *configPath = originalConfigPath }()
+	*configPath = filepath.Join(dir, "config.yml")
+
+	writeFile(t, *configPath, fmt.Sprintf(reloadConfigTemplate, lookupTableFile, "1m", "", "cache_misses_total"))
+	cfg, _, err := config.LoadConfigFile(*configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns, _, err := initPatterns(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := createMetrics(cfg, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	definitions, err := metricDefinitions(cfg, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupTables := exporter.NewLookupTables()
+	if err = lookupTables.Load(cfg.LookupTables); err != nil {
+		t.Fatal(err)
+	}
+	defer lookupTables.Load(nil)
+
+	// the geoip database cannot be read, so the lookup tables and metrics must not be replaced
+	writeFile(t, *configPath, fmt.Sprintf(reloadConfigTemplate, lookupTableFile, "1h", filepath.Join(dir, "missing.mmdb"), "misses_total"))
+	_, _, _, _, err = reloadConfig(cfg, metrics, definitions, lookupTables)
+	if err == nil {
+		t.Fatal("expected error, because the geoip database does not exist")
+	}
+	if lookupTables.CheckInterval() != time.Minute {
+		t.Fatalf("expected the current lookup tables to remain active, but the reload_interval is %v", lookupTables.CheckInterval())
+	}
+	match, err := metrics[0].ProcessMatch("DEBUG cache miss", nil)
+	if err != nil || match == nil {
+		t.Fatalf("expected the current metric to remain usable, but got %v, %v", match, err)
+	}
+
+	writeFile(t, *configPath, fmt.Sprintf(reloadConfigTemplate, lookupTableFile, "1h", "", "misses_total"))
+	_, newMetrics, _, filter, err := reloadConfig(cfg, metrics, definitions, lookupTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filter.Free()
+	defer freeMetrics(newMetrics)
+	if lookupTables.CheckInterval() != time.Hour {
+		t.Fatalf("expected the new lookup tables to be active, but the reload_interval is %v", lookupTables.CheckInterval())
+	}
+	if len(newMetrics) != 1 || newMetrics[0].Name() != "misses_total" {
+		t.Fatalf("expected the metric to be replaced, but got %v", newMetrics)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
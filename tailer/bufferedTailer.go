@@ -121,7 +121,8 @@ func BufferedTailerWithMetrics(orig fswatcher.FileTailer, bufferLoadMetric Buffe
 				buffer.Push(line)
 				bufferLoadMetric.Inc()
 			} else {
-				buffer.Close()
+				// The lines that are still in the buffer are sent before the nil line makes the consumer close the out channel.
+				buffer.Push(nil)
 				bufferLoadMetric.Stop()
 				return
 			}
@@ -133,7 +134,7 @@ func BufferedTailerWithMetrics(orig fswatcher.FileTailer, bufferLoadMetric Buffe
 		for {
 			line := buffer.BlockingPop()
 			if line == nil {
-				// buffer closed
+				// orig was closed
 				close(out)
 				return
 			}
@@ -0,0 +1,72 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"sync"
+)
+
+// implements fswatcher.FileTailer
+type closableTailer struct {
+	out       chan *fswatcher.Line
+	orig      fswatcher.FileTailer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *closableTailer) Lines() chan *fswatcher.Line {
+	return t.out
+}
+
+func (t *closableTailer) Errors() chan fswatcher.Error {
+	return t.orig.Errors()
+}
+
+func (t *closableTailer) Close() {
+	t.closeOnce.Do(func() {
+		t.orig.Close()
+		close(t.done)
+	})
+}
+
+// ClosableTailer closes the lines channel when Close() is called, for tailers that don't close it themselves.
+// This way the tailers wrapping it, like the multiline tailer, see the end of the input and process the lines they already received.
+// Lines that the original tailer sends after Close() was called are dropped, except for a line that was already received.
+func ClosableTailer(orig fswatcher.FileTailer) fswatcher.FileTailer {
+	t := &closableTailer{
+		out:  make(chan *fswatcher.Line),
+		orig: orig,
+		done: make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *closableTailer) run() {
+	defer close(t.out)
+	for {
+		select {
+		case line, ok := <-t.orig.Lines():
+			if !ok {
+				return
+			}
+			// The line is sent even if Close() was called meanwhile, so that it is processed during a graceful shutdown.
+			t.out <- line
+		case <-t.done:
+			return
+		}
+	}
+}
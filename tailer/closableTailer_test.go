@@ -0,0 +1,51 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"testing"
+	"time"
+)
+
+// like the network tailers, Close() doesn't close the lines channel
+type nonClosingTailer struct {
+	lines chan *fswatcher.Line
+}
+
+func (tail *nonClosingTailer) Lines() chan *fswatcher.Line {
+	return tail.lines
+}
+
+func (tail *nonClosingTailer) Errors() chan fswatcher.Error {
+	return nil
+}
+
+func (tail *nonClosingTailer) Close() {}
+
+func TestClosableTailer(t *testing.T) {
+	src := &nonClosingTailer{lines: make(chan *fswatcher.Line)}
+	input := ClosableTailer(src)
+	tail := MultilineTailer(input, startsWithDate, time.Minute, 0)
+	for _, line := range []string{"2020-01-01 a", "b"} {
+		src.lines <- &fswatcher.Line{Line: line}
+	}
+	input.Close()
+	// the pending record is sent when the input is closed, not after the timeout
+	expectLine(t, receiveLine(t, tail), "2020-01-01 a\nb")
+	if _, open := <-tail.Lines(); open {
+		t.Fatal("multiline tailer was not closed")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"reflect"
+	"time"
+)
+
+// implements fswatcher.FileTailer
+type dedupTailer struct {
+	out          chan *fswatcher.Line
+	orig         fswatcher.FileTailer
+	done         chan struct{}
+	window       time.Duration
+	deduplicated func(n int)
+}
+
+func (t *dedupTailer) Lines() chan *fswatcher.Line {
+	return t.out
+}
+
+func (t *dedupTailer) Errors() chan fswatcher.Error {
+	return t.orig.Errors()
+}
+
+func (t *dedupTailer) Close() {
+	t.orig.Close()
+	close(t.done)
+}
+
+// DedupTailer collapses identical consecutive lines, like syslog's "last message repeated N times".
+// Each line is passed on without delay. The lines identical to it that follow are counted, and passed on as a single line
+// with Repeat set to their number when a different line is read, when the window since the first of them has passed,
+// or when the original tailer is closed. Lines are identical if they have the same text, file, and extra object.
+// deduplicated(n) is called with the number of lines that were not passed on for each collapsed line, i.e. Repeat - 1.
+func DedupTailer(orig fswatcher.FileTailer, window time.Duration, deduplicated func(n int)) fswatcher.FileTailer {
+	t := &dedupTailer{
+		out:          make(chan *fswatcher.Line),
+		orig:         orig,
+		done:         make(chan struct{}),
+		window:       window,
+		deduplicated: deduplicated,
+	}
+	go t.run()
+	return t
+}
+
+func (t *dedupTailer) run() {
+	defer close(t.out)
+	var (
+		last     fswatcher.Line  // copy of the last line passed on, as the passed on line belongs to the receiver
+		started  bool            // false until the first line is passed on
+		repeated *fswatcher.Line // the lines identical to last that were not passed on yet, nil if there are none
+		timer    *time.Timer
+		expired  <-chan time.Time // nil if there are no repeated lines, so it is never selected
+	)
+	// flush passes on the repeated lines, it returns false if the tailer was closed
+	flush := func() bool {
+		if repeated == nil {
+			return true
+		}
+		timer.Stop()
+		line := repeated
+		repeated, expired = nil, nil
+		t.deduplicated(line.Repeat - 1)
+		return t.send(line)
+	}
+	for {
+		select {
+		case line, ok := <-t.orig.Lines():
+			if !ok {
+				flush()
+				return
+			}
+			if started && line.Line == last.Line && line.File == last.File && reflect.DeepEqual(line.Extra, last.Extra) {
+				if repeated == nil {
+					repeated = line
+					repeated.Repeat = 1
+					timer = time.NewTimer(t.window)
+					expired = timer.C
+				} else {
+					repeated.Repeat++
+					repeated.ReadTime = line.ReadTime // for grok_exporter_lines_delay_seconds_total
+				}
+				continue
+			}
+			last, started = *line, true
+			if !flush() || !t.send(line) {
+				return
+			}
+		case <-expired:
+			if !flush() {
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// send returns false if the tailer was closed
+func (t *dedupTailer) send(line *fswatcher.Line) bool {
+	select {
+	case t.out <- line:
+		return true
+	case <-t.done:
+		return false
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	deduplicated := 0
+	tail := DedupTailer(src, time.Minute, func(n int) { deduplicated += n })
+	go func() {
+		for _, line := range []string{"a", "b", "b", "b", "b", "c", "c", "a"} {
+			src.lines <- &fswatcher.Line{Line: line}
+		}
+		src.lines <- &fswatcher.Line{Line: "a", File: "other.log"}
+		close(src.lines)
+	}()
+	for _, expected := range []struct {
+		line   string
+		repeat int
+	}{{"a", 0}, {"b", 0}, {"b", 3}, {"c", 0}, {"c", 1}, {"a", 0}, {"a", 0}} {
+		line := receiveLine(t, tail)
+		expectLine(t, line, expected.line)
+		if line.Repeat != expected.repeat {
+			t.Fatalf("%v: expected repeat %v, but got %v", expected.line, expected.repeat, line.Repeat)
+		}
+	}
+	if _, open := <-tail.Lines(); open {
+		t.Fatal("dedup tailer was not closed")
+	}
+	if deduplicated != 2 {
+		t.Fatalf("expected 2 deduplicated lines, but got %v", deduplicated)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := DedupTailer(src, 100*time.Millisecond, func(int) {})
+	defer tail.Close()
+	go func() {
+		for i := 0; i < 3; i++ {
+			src.lines <- &fswatcher.Line{Line: "storm"}
+		}
+	}()
+	expectLine(t, receiveLine(t, tail), "storm")
+	// the 2 repeated lines are passed on when the window has passed, even though no other line is read
+	line := receiveLine(t, tail)
+	expectLine(t, line, "storm")
+	if line.Repeat != 2 {
+		t.Fatalf("expected repeat 2, but got %v", line.Repeat)
+	}
+}
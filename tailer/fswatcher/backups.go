@@ -0,0 +1,238 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"compress/gzip"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// readCompressedBackups reads the gzip compressed backups of the log files in dir, oldest first.
+// Backups are files like logfile.log.1.gz or logfile.log-20200101.gz, as created by logrotate with the compress option,
+// see isBackupOf(). They are searched in dir and in the olddir, if configured.
+// This is done only once on startup, before the log files themselves are read.
+// The lines are reported with the path of the log file, so that they are processed like the lines of the log file.
+func (t *fileTailer) readCompressedBackups(dir *Dir, log logrus.FieldLogger) Error {
+	fileInfos, err := ioutil.ReadDir(dir.Path())
+	if err != nil {
+		return NewErrorf(NotSpecified, err, "%v: failed to read directory", dir.Path())
+	}
+	for _, fileInfo := range fileInfos {
+		filePath := filepath.Join(dir.Path(), fileInfo.Name())
+		if fileInfo.IsDir() || !t.isIncluded(filePath) {
+			continue
+		}
+		if t.positions != nil && t.positions.has(filePath) {
+			continue // the backups were already read before the position was saved
+		}
+		backups, Err := t.findCompressedBackups(filePath)
+		if Err != nil {
+			return Err
+		}
+		for _, backup := range backups {
+			backupLogger := log.WithField("file", backup)
+			backupLogger.Info("reading compressed backup")
+			Err = t.readCompressedFile(backup, filePath, backupLogger)
+			if Err != nil {
+				return Err
+			}
+		}
+	}
+	return nil
+}
+
+type backup struct {
+	path     string
+	fileInfo os.FileInfo
+}
+
+// findBackups returns the backups of logfile in its directory and in the olddir.
+func (t *fileTailer) findBackups(logfile string) ([]backup, Error) {
+	var result []backup
+	for _, dir := range t.backupDirs(filepath.Dir(logfile)) {
+		fileInfos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) && dir != filepath.Dir(logfile) {
+				continue // logrotate does not create the olddir unless createolddir is configured
+			}
+			return nil, NewErrorf(NotSpecified, err, "%v: failed to read directory", dir)
+		}
+		for _, fileInfo := range fileInfos {
+			if !fileInfo.IsDir() && isBackupOf(filepath.Base(logfile), fileInfo.Name()) {
+				result = append(result, backup{path: filepath.Join(dir, fileInfo.Name()), fileInfo: fileInfo})
+			}
+		}
+	}
+	return result, nil
+}
+
+// backupDirs returns the directories where logrotate puts the backups of the log files in dir:
+// dir itself, and the olddir if configured. A relative olddir is relative to dir, like in logrotate.
+func (t *fileTailer) backupDirs(dir string) []string {
+	if t.olddir == "" {
+		return []string{dir}
+	}
+	olddir := t.olddir
+	if !filepath.IsAbs(olddir) {
+		olddir = filepath.Join(dir, olddir)
+	}
+	if olddir == dir {
+		return []string{dir}
+	}
+	return []string{dir, olddir}
+}
+
+// isBackupOf is true if name looks like a backup of logfile created by logrotate, optionally with a .gz suffix:
+// logfile.log.1 or logfile.log-20200101, or logfile.1.log or logfile-20200101.log with logrotate's extension option.
+// With the extension option, only numbers and dates are accepted before the extension,
+// so that app.access.log is not mistaken for a backup of app.log.
+func isBackupOf(logfile string, name string) bool {
+	name = strings.TrimSuffix(name, ".gz")
+	if len(name) <= len(logfile)+1 {
+		return false
+	}
+	if strings.HasPrefix(name, logfile+".") || strings.HasPrefix(name, logfile+"-") {
+		return true
+	}
+	ext := filepath.Ext(logfile)
+	if ext == "" || !strings.HasPrefix(name, strings.TrimSuffix(logfile, ext)) || !strings.HasSuffix(name, ext) {
+		return false
+	}
+	suffix := name[len(logfile)-len(ext) : len(name)-len(ext)] // like .1 or -20200101
+	if suffix[0] != '.' && suffix[0] != '-' {
+		return false
+	}
+	hasDigit := false
+	for _, c := range suffix[1:] {
+		switch {
+		case c >= '0' && c <= '9':
+			hasDigit = true
+		case c != '.' && c != '-' && c != '_':
+			return false
+		}
+	}
+	return hasDigit
+}
+
+// findCompressedBackups returns the paths of the gzip compressed backups of logfile, sorted by modification time.
+func (t *fileTailer) findCompressedBackups(logfile string) ([]string, Error) {
+	backups, Err := t.findBackups(logfile)
+	if Err != nil {
+		return nil, Err
+	}
+	var compressed []backup
+	for _, b := range backups {
+		if strings.HasSuffix(b.path, ".gz") {
+			compressed = append(compressed, b)
+		}
+	}
+	sort.SliceStable(compressed, func(i, j int) bool {
+		return compressed[i].fileInfo.ModTime().Before(compressed[j].fileInfo.ModTime())
+	})
+	result := make([]string, 0, len(compressed))
+	for _, b := range compressed {
+		result = append(result, b.path)
+	}
+	return result, nil
+}
+
+// findRotatedFile returns the path of the uncompressed backup of logfile with the inode ino, or "" if there is none.
+// This is the old log file if logrotate moved it while grok_exporter was not running.
+func (t *fileTailer) findRotatedFile(logfile string, ino uint64) (string, Error) {
+	backups, Err := t.findBackups(logfile)
+	if Err != nil {
+		return "", Err
+	}
+	for _, b := range backups {
+		if strings.HasSuffix(b.path, ".gz") {
+			continue // compressing creates a new file, so the inode cannot match
+		}
+		file, Err := open(b.path)
+		if Err != nil {
+			if Err.Type() == FileNotFound {
+				continue
+			}
+			return "", Err
+		}
+		backupIno, err := inode(file)
+		file.Close()
+		if err != nil {
+			return "", NewErrorf(NotSpecified, err, "%v: stat failed", b.path)
+		}
+		if backupIno == ino {
+			return b.path, nil
+		}
+	}
+	return "", nil
+}
+
+// readRotatedFile reads the lines of a backup from offset to the end. The lines are reported with the path of the log file.
+func (t *fileTailer) readRotatedFile(path string, logfile string, offset int64) Error {
+	file, err := os.Open(path)
+	if err != nil {
+		return NewError(NotSpecified, os.NewSyscallError("open", err), path)
+	}
+	defer file.Close()
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return NewError(NotSpecified, os.NewSyscallError("seek", err), path)
+	}
+	return t.readToEOF(file, path, logfile, offset)
+}
+
+func (t *fileTailer) readCompressedFile(path string, logfile string, log logrus.FieldLogger) Error {
+	file, err := os.Open(path)
+	if err != nil {
+		return NewError(NotSpecified, os.NewSyscallError("open", err), path)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return NewErrorf(NotSpecified, err, "%v: failed to decompress file", path)
+	}
+	defer gz.Close()
+	reader := NewLineReader(t.format)
+	for {
+		line, eof, err := reader.ReadLine(gz)
+		if err != nil {
+			return NewErrorf(NotSpecified, err, "%v: failed to decompress file", path)
+		}
+		offset := reader.LastLineOffset()
+		if eof {
+			// the backup is complete, so the last line is sent even if it is not terminated with a delimiter
+			offset = reader.Position()
+			line = reader.Remaining()
+			if len(line) == 0 {
+				return nil
+			}
+		}
+		log.Debugf("read line %q", line)
+		select {
+		case <-t.done:
+			return nil
+		case t.lines <- &Line{Line: line, File: logfile, Truncated: !eof && reader.Truncated(), ReadTime: time.Now(), Offset: offset}:
+		}
+		if eof {
+			return nil
+		}
+	}
+}
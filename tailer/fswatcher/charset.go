@@ -0,0 +1,35 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// LookupCharset returns the encoding for an IANA charset name like UTF-16LE, ISO-8859-1, or Shift_JIS.
+// Matching is case-insensitive.
+func LookupCharset(name string) (encoding.Encoding, error) {
+	charset, err := ianaindex.IANA.Encoding(name)
+	if err != nil || charset == nil {
+		return nil, fmt.Errorf("%v is not a supported charset", name)
+	}
+	// Lines are decoded one by one, so the byte order mark at the beginning of the file cannot define the byte order of the following lines.
+	if canonicalName, _ := ianaindex.IANA.Name(charset); canonicalName == "UTF-16" {
+		return nil, fmt.Errorf("use UTF-16LE or UTF-16BE instead of %v", name)
+	}
+	return charset, nil
+}
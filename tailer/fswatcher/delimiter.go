@@ -0,0 +1,103 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/text/encoding"
+	"regexp"
+	"strings"
+)
+
+// Delimiter separates the lines in a log file.
+// The default delimiter is '\n', where a trailing '\r' is removed from each line so that Windows line endings work as well.
+type Delimiter struct {
+	literal []byte
+	regex   *regexp.Regexp
+	align   int  // size of a code unit in the file's charset, a delimiter must start at a multiple of align
+	stripCR bool // true for '\n'
+}
+
+var newline = NewDelimiter("\n")
+
+// NewDelimiter creates a delimiter that is a fixed string, like "\r\n" or "\x00".
+func NewDelimiter(delimiter string) *Delimiter {
+	return &Delimiter{literal: []byte(delimiter), align: 1, stripCR: delimiter == "\n"}
+}
+
+// NewRegexDelimiter creates a delimiter that is a regular expression in Go's regexp syntax.
+// Matches are searched in the data that was read so far, so a delimiter like '\n+' may be split
+// if the file is written while it is read.
+func NewRegexDelimiter(pattern string) (*Delimiter, error) {
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if regex.MatchString("") {
+		return nil, fmt.Errorf("%v: delimiter must not match the empty string", pattern)
+	}
+	return &Delimiter{regex: regex, align: 1}, nil
+}
+
+// encode returns the delimiter in the given charset.
+// Regular expressions are matched against the raw bytes, so they are not converted.
+func (d *Delimiter) encode(charset encoding.Encoding) (*Delimiter, error) {
+	if d.regex != nil {
+		return d, nil
+	}
+	literal, err := charset.NewEncoder().Bytes(d.literal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode delimiter %q: %v", d.literal, err)
+	}
+	// The size of a code unit is the size of the encoded '\n', for example 2 for UTF-16.
+	newline, err := charset.NewEncoder().Bytes([]byte{'\n'})
+	if err != nil || len(newline) == 0 {
+		return nil, fmt.Errorf("failed to encode delimiter %q: the charset has no newline", d.literal)
+	}
+	return &Delimiter{literal: literal, align: len(newline), stripCR: d.stripCR}, nil
+}
+
+// find returns the start and end of the first delimiter in data, or -1, -1 if data contains no delimiter.
+func (d *Delimiter) find(data []byte) (int, int) {
+	if d.regex == nil {
+		for offset := 0; offset < len(data); {
+			pos := bytes.Index(data[offset:], d.literal)
+			if pos < 0 {
+				return -1, -1
+			}
+			pos += offset
+			if pos%d.align == 0 {
+				return pos, pos + len(d.literal)
+			}
+			offset = pos + 1
+		}
+		return -1, -1
+	}
+	for _, match := range d.regex.FindAllIndex(data, -1) {
+		if match[1] > match[0] {
+			return match[0], match[1]
+		}
+	}
+	return -1, -1
+}
+
+// stripLine removes the trailing '\r' from a decoded line if the delimiter is '\n'.
+func (d *Delimiter) stripLine(line string) string {
+	if d.stripCR {
+		return strings.TrimSuffix(line, "\r")
+	}
+	return line
+}
@@ -22,6 +22,7 @@ const (
 	NotSpecified = iota
 	DirectoryNotFound
 	FileNotFound
+	WatchFailed // setting up file system notifications failed, the tailer falls back to polling
 
 	// The WinFileRemoved Error should never be seen, because it is handled internally in the FileTailer.
 	// TODO: Refactor error handling such that this is not part of the public interface.
@@ -42,7 +42,7 @@ func (d *Dir) ls() ([]os.FileInfo, Error) {
 	if err != nil {
 		return nil, NewError(NotSpecified, os.NewSyscallError("readdir", err), d.file.Name())
 	}
-	return fileInfos, nil
+	return resolveSymlinks(d.file.Name(), fileInfos), nil
 }
 
 func NewFile(orig *os.File, newPath string) (*os.File, error) {
@@ -56,6 +56,28 @@ func NewFile(orig *os.File, newPath string) (*os.File, error) {
 	return os.NewFile(uintptr(fd), newPath), nil
 }
 
+// networkFilesystem returns the file system type if path is on a network or FUSE file system,
+// where kevent does not report changes made by other hosts.
+func networkFilesystem(path string) (string, bool) {
+	var st syscall.Statfs_t
+	if syscall.Statfs(path, &st) != nil {
+		return "", false
+	}
+	var fsType []byte
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		fsType = append(fsType, byte(c))
+	}
+	switch string(fsType) {
+	case "nfs", "smbfs", "afpfs", "webdav", "osxfuse", "macfuse":
+		return string(fsType), true
+	default:
+		return "", false
+	}
+}
+
 func open(path string) (*os.File, Error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -67,3 +89,25 @@ func open(path string) (*os.File, Error) {
 	}
 	return file, nil
 }
+
+func inode(file *os.File) (uint64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fileInfo.Sys().(*syscall.Stat_t).Ino), nil
+}
+
+func device(file *os.File) (uint64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fileInfo.Sys().(*syscall.Stat_t).Dev), nil
+}
+
+// isDeleted is true if the file was removed, and false if it was only moved to another name, like by logrotate.
+func isDeleted(file *os.File) bool {
+	fileInfo, err := file.Stat()
+	return err == nil && fileInfo.Sys().(*syscall.Stat_t).Nlink == 0
+}
@@ -45,7 +45,7 @@ func (d *Dir) ls() ([]os.FileInfo, Error) {
 	if err != nil {
 		return nil, NewErrorf(NotSpecified, err, "%q: failed to read directory", d.path)
 	}
-	return fileInfos, nil
+	return resolveSymlinks(d.path, fileInfos), nil
 }
 
 func NewFile(orig *os.File, newPath string) (*os.File, error) {
@@ -59,6 +59,32 @@ func NewFile(orig *os.File, newPath string) (*os.File, error) {
 	return os.NewFile(uintptr(fd), newPath), nil
 }
 
+// networkFilesystem returns the file system type if path is on a network or FUSE file system,
+// where inotify does not report changes made by other hosts.
+func networkFilesystem(path string) (string, bool) {
+	var st syscall.Statfs_t
+	if syscall.Statfs(path, &st) != nil {
+		return "", false
+	}
+	// magic numbers from statfs(2)
+	switch uint32(st.Type) {
+	case 0x6969:
+		return "nfs", true
+	case 0xFF534D42, 0xFE534D42, 0x517B:
+		return "cifs/smb", true
+	case 0x65735546:
+		return "fuse", true
+	case 0x01021997:
+		return "9p", true
+	case 0x5346414F:
+		return "afs", true
+	case 0x73757245:
+		return "coda", true
+	default:
+		return "", false
+	}
+}
+
 func open(path string) (*os.File, Error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -70,3 +96,25 @@ func open(path string) (*os.File, Error) {
 	}
 	return file, nil
 }
+
+func inode(file *os.File) (uint64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fileInfo.Sys().(*syscall.Stat_t).Ino), nil
+}
+
+func device(file *os.File) (uint64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fileInfo.Sys().(*syscall.Stat_t).Dev), nil
+}
+
+// isDeleted is true if the file was removed, and false if it was only moved to another name, like by logrotate.
+func isDeleted(file *os.File) bool {
+	fileInfo, err := file.Stat()
+	return err == nil && fileInfo.Sys().(*syscall.Stat_t).Nlink == 0
+}
@@ -34,7 +34,8 @@ type File struct {
 }
 
 type Dir struct {
-	path string
+	path  string
+	watch *dirWatch
 }
 
 func (d *Dir) Path() string {
@@ -178,6 +179,17 @@ func (f *File) CheckMoved() (bool, error) {
 	return false, nil
 }
 
+// isDeleted is true if the file was removed. As the file is not kept open, it can only be found
+// if followRotatedFile() updated the path after it was moved, like by logrotate.
+func isDeleted(file *File) bool {
+	f, Err := file.reopen()
+	if Err != nil {
+		return true
+	}
+	f.Close()
+	return false
+}
+
 // The semantics of openWithBackoff() function is similar to os.Open().
 // If the file is currently locked by a logger or virus scanner,
 // CreateFile() might fail (the logfile is being used by another program).
@@ -233,3 +245,18 @@ func (f *File) reopen() (*os.File, Error) {
 	}
 	return file, Err
 }
+
+// networkFilesystem is not implemented on Windows, use poll_interval for network shares.
+func networkFilesystem(path string) (string, bool) {
+	return "", false
+}
+
+// Windows has no inodes, the file index identifies the file instead.
+func inode(file *File) (uint64, error) {
+	return uint64(file.fileIndexHigh)<<32 | uint64(file.fileIndexLow), nil
+}
+
+// device is always 0 on Windows. The file index is unique on its volume, and files are only compared within the same directory.
+func device(_ *File) (uint64, error) {
+	return 0, nil
+}
@@ -28,7 +28,8 @@ type keventloop struct {
 
 // Terminate the kevent loop.
 // If the loop hangs in syscall.Kevent(), it will keep hanging there until the next event is read.
-// Therefore, after the consumer called Close(), it should interrupt the kevent() call by closing the kq descriptor.
+// Therefore, after the consumer called Close(), it should interrupt the kevent() call by triggering the EVFILT_USER
+// wakeup event and closing the kq descriptor. See watcher.Close().
 func (p *keventloop) Close() {
 	close(p.done)
 }
@@ -74,6 +75,10 @@ func runKeventLoop(kq int) *keventloop {
 				return
 			} else {
 				for i = 0; i < n; i++ {
+					if eventBuf[i].Filter == syscall.EVFILT_USER {
+						// wakeup event, i.e. Close() was called.
+						return
+					}
 					select {
 					case <-l.done:
 						return
@@ -16,6 +16,7 @@ package fswatcher
 
 import (
 	"fmt"
+	"golang.org/x/sys/unix"
 	"strings"
 	"syscall"
 	"time"
@@ -24,6 +25,7 @@ import (
 
 type inotifyloop struct {
 	fd     int
+	wakeup int // write end of the pipe for interrupting poll() in Close()
 	events chan fsevent
 	errors chan Error
 	done   chan struct{}
@@ -43,16 +45,19 @@ func (l *inotifyloop) Errors() chan Error {
 }
 
 // Terminate the inotify loop.
-// If the loop hangs in syscall.Read(), it will keep hanging there until the next event is read.
-// Therefore, after the consumer called Close(), it should generate an artificial IN_IGNORE event to
-// interrupt syscall.Read(). This can be done by calling inotify_rm_watch() on one of the watched directories.
+// The loop waits in poll() for the inotify file descriptor and the read end of the wakeup pipe,
+// so writing to the pipe makes the loop terminate even if no more inotify events are generated.
+// The pipe is closed by the watcher.
 func (l *inotifyloop) Close() {
 	close(l.done)
+	_, _ = syscall.Write(l.wakeup, []byte{0})
 }
 
-func runInotifyLoop(fd int) *inotifyloop {
+// runInotifyLoop reads the events from the inotify file descriptor fd. wakeup is the pipe for interrupting the loop, wakeup[0] is the read end.
+func runInotifyLoop(fd int, wakeup [2]int) *inotifyloop {
 	var result = &inotifyloop{
 		fd:     fd,
+		wakeup: wakeup[1],
 		events: make(chan fsevent),
 		errors: make(chan Error),
 		done:   make(chan struct{}),
@@ -69,8 +74,26 @@ func runInotifyLoop(fd int) *inotifyloop {
 			close(result.errors)
 			close(result.events)
 		}()
+		pollFds := []unix.PollFd{
+			{Fd: int32(l.fd), Events: unix.POLLIN},
+			{Fd: int32(wakeup[0]), Events: unix.POLLIN},
+		}
 		for {
-			n, err = syscall.Read(l.fd, buf)
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			_, err = unix.Poll(pollFds, -1)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err == nil && pollFds[1].Revents != 0 {
+				return // Close() was called
+			}
+			if err == nil {
+				n, err = syscall.Read(l.fd, buf)
+			}
 			if err != nil {
 				// Getting an err might be part of the shutdown, when l.fd is closed.
 				// We decide whether it is an actual error or not by checking if l.done is closed.
@@ -102,14 +125,6 @@ func runInotifyLoop(fd int) *inotifyloop {
 				case <-l.done:
 					return
 				}
-				if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED {
-					// IN_IGNORED event can have two reasons:
-					// 1) The consumer loop is shutting down and called inotify_rm_watch() to interrupt syscall.Read()
-					// 2) The watched directory was deleted. fswatcher will report an error and terminate if that happens.
-					// In both cases, we should terminate here and not call syscall.Read() again, as the next
-					// call might block forever as we don't receive events anymore.
-					return
-				}
 				offset += syscall.SizeofInotifyEvent + int(event.Len)
 			}
 		}
@@ -166,5 +181,8 @@ func flags2string(event syscall.InotifyEvent) string {
 	if event.Mask&syscall.IN_OPEN == syscall.IN_OPEN {
 		result = append(result, "IN_OPEN")
 	}
+	if event.Mask&syscall.IN_Q_OVERFLOW == syscall.IN_Q_OVERFLOW {
+		result = append(result, "IN_Q_OVERFLOW")
+	}
 	return strings.Join(result, ", ")
 }
@@ -14,7 +14,25 @@
 
 package fswatcher
 
-import "golang.org/x/exp/winfsnotify"
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Size of the buffer for ReadDirectoryChangesW(). If more changes happen while we process the previous ones,
+// the changes are lost and we get an actionOverflow event. 64 KB is the maximum for directories on network shares.
+const dirWatchBufferSize = 64 * 1024
+
+const dirWatchFilter = syscall.FILE_NOTIFY_CHANGE_FILE_NAME | syscall.FILE_NOTIFY_CHANGE_DIR_NAME | syscall.FILE_NOTIFY_CHANGE_SIZE | syscall.FILE_NOTIFY_CHANGE_LAST_WRITE
+
+// Pseudo actions in addition to the syscall.FILE_ACTION_* values reported by ReadDirectoryChangesW().
+const (
+	actionOverflow   uint32 = 0x100 // the buffer overflowed, changes were lost
+	actionDirRemoved uint32 = 0x101 // the watched directory was removed
+)
 
 type winwatcherloop struct {
 	events chan fsevent
@@ -22,6 +40,20 @@ type winwatcherloop struct {
 	done   chan struct{}
 }
 
+type winEvent struct {
+	dir    string // path of the watched directory, as passed to watchDir()
+	name   string // file name relative to dir, empty for the pseudo actions
+	action uint32
+}
+
+// dirWatch calls ReadDirectoryChangesW() for a single directory in its own goroutine.
+type dirWatch struct {
+	path    string
+	handle  syscall.Handle
+	done    chan struct{} // closed by stop()
+	stopped chan struct{} // closed when the goroutine terminated
+}
+
 func (l *winwatcherloop) Events() chan fsevent {
 	return l.events
 }
@@ -30,42 +62,153 @@ func (l *winwatcherloop) Errors() chan Error {
 	return l.errors
 }
 
+// Close terminates the goroutines that are currently sending events.
+// The goroutines waiting in ReadDirectoryChangesW() are terminated when the consumer calls unwatchDir().
 func (l *winwatcherloop) Close() {
 	close(l.done)
 }
 
-func runWinWatcherLoop(w *winfsnotify.Watcher) *winwatcherloop {
+func (e *winEvent) String() string {
+	var action string
+	switch e.action {
+	case syscall.FILE_ACTION_ADDED:
+		action = "FILE_ACTION_ADDED"
+	case syscall.FILE_ACTION_REMOVED:
+		action = "FILE_ACTION_REMOVED"
+	case syscall.FILE_ACTION_MODIFIED:
+		action = "FILE_ACTION_MODIFIED"
+	case syscall.FILE_ACTION_RENAMED_OLD_NAME:
+		action = "FILE_ACTION_RENAMED_OLD_NAME"
+	case syscall.FILE_ACTION_RENAMED_NEW_NAME:
+		action = "FILE_ACTION_RENAMED_NEW_NAME"
+	case actionOverflow:
+		action = "overflow"
+	case actionDirRemoved:
+		action = "directory removed"
+	default:
+		action = fmt.Sprintf("0x%x", e.action)
+	}
+	return fmt.Sprintf("%v: %v %v", action, e.dir, e.name)
+}
+
+// watchDirectoryChanges opens the directory and starts the goroutine reading its changes.
+// The directory is opened with FILE_SHARE_DELETE, so that other programs can still rename and remove it.
+func watchDirectoryChanges(path string, events chan fsevent, errors chan Error, loopDone chan struct{}) (*dirWatch, Error) {
+	pathP, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, NewErrorf(NotSpecified, err, "%v: path contains an illegal character", path)
+	}
+	handle, err := syscall.CreateFile(
+		pathP,
+		syscall.FILE_LIST_DIRECTORY,
+		uint32(syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE),
+		nil,
+		syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS, // required for opening directories
+		0)
+	if err != nil {
+		return nil, NewErrorf(WatchFailed, os.NewSyscallError("CreateFile", err), "%q: failed to open directory", path)
+	}
+	w := &dirWatch{
+		path:    path,
+		handle:  handle,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run(events, errors, loopDone)
+	return w, nil
+}
+
+func (w *dirWatch) run(events chan fsevent, errors chan Error, loopDone chan struct{}) {
 	var (
-		events = make(chan fsevent)
-		errors = make(chan Error)
-		done   = make(chan struct{})
+		n   uint32
+		buf = make([]byte, dirWatchBufferSize)
+		err error
 	)
-	go func() {
-		for {
+	defer close(w.stopped)
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		err = syscall.ReadDirectoryChanges(w.handle, &buf[0], uint32(len(buf)), false, dirWatchFilter, &n, nil, 0)
+		switch {
+		case err == syscall.ERROR_OPERATION_ABORTED:
+			continue // interrupted by stop()
+		case err == syscall.ERROR_ACCESS_DENIED:
+			// The directory was removed. We get no more events, so the goroutine terminates.
+			w.send(events, &winEvent{dir: w.path, action: actionDirRemoved}, loopDone)
+			return
+		case err != nil:
 			select {
-			case event := <-w.Event:
-				select {
-				case events <- event:
-				case <-done:
-					w.Close()
-					return
-				}
-			case err := <-w.Error:
-				select {
-				case errors <- NewError(NotSpecified, err, ""):
-				case <-done:
-					w.Close()
+			case errors <- NewErrorf(NotSpecified, os.NewSyscallError("ReadDirectoryChangesW", err), "%q: failed to read directory changes", w.path):
+			case <-w.done:
+			case <-loopDone:
+			}
+			return
+		case n == 0:
+			if !w.send(events, &winEvent{dir: w.path, action: actionOverflow}, loopDone) {
+				return
+			}
+		default:
+			for _, event := range parseNotifications(w.path, buf[:n]) {
+				if !w.send(events, event, loopDone) {
 					return
 				}
-			case <-done:
-				w.Close()
-				return
 			}
 		}
-	}()
-	return &winwatcherloop{
-		events: events,
-		errors: errors,
-		done:   done,
 	}
 }
+
+// send returns false if the watch was stopped or the loop was closed.
+func (w *dirWatch) send(events chan fsevent, event *winEvent, loopDone chan struct{}) bool {
+	select {
+	case events <- event:
+		return true
+	case <-w.done:
+		return false
+	case <-loopDone:
+		return false
+	}
+}
+
+func parseNotifications(dir string, buf []byte) []*winEvent {
+	var (
+		result []*winEvent
+		offset uint32
+	)
+	for {
+		raw := (*syscall.FileNotifyInformation)(unsafe.Pointer(&buf[offset]))
+		nameLen := raw.FileNameLength / 2
+		name := (*[dirWatchBufferSize / 2]uint16)(unsafe.Pointer(&raw.FileName))[:nameLen:nameLen]
+		result = append(result, &winEvent{
+			dir:    dir,
+			name:   syscall.UTF16ToString(name),
+			action: raw.Action,
+		})
+		if raw.NextEntryOffset == 0 {
+			return result
+		}
+		offset += raw.NextEntryOffset
+	}
+}
+
+// stop terminates the goroutine and closes the directory handle.
+// CancelIoEx() has no effect if the goroutine has not entered ReadDirectoryChangesW() yet, so we repeat it until the goroutine terminated.
+func (w *dirWatch) stop() error {
+	close(w.done)
+	for stopped := false; !stopped; {
+		syscall.CancelIoEx(w.handle, nil)
+		select {
+		case <-w.stopped:
+			stopped = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	err := syscall.CloseHandle(w.handle)
+	if err != nil {
+		return fmt.Errorf("%q: failed to close directory handle: %v", w.path, os.NewSyscallError("CloseHandle", err))
+	}
+	return nil
+}
@@ -17,11 +17,12 @@ package fswatcher
 import (
 	"fmt"
 	"github.com/fstab/grok_exporter/tailer/glob"
-	"github.com/prometheus/common/log"
 	"github.com/sirupsen/logrus"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,6 +36,22 @@ type Line struct {
 	Line  string
 	File  string
 	Extra interface{}
+	Input string // id of the input the line was read from, empty unless configured
+	// Truncated is true if the line was longer than the maximum line length, and only the beginning of the line is included.
+	Truncated bool
+	// ReadTime is when the line was read, like for measuring how long lines wait until they are processed.
+	ReadTime time.Time
+	// Offset is the position of the first byte of the line in File. For compressed backups, this is the position in the
+	// uncompressed content. Offset is only set for input type file, and 0 for the other inputs.
+	Offset int64
+	// LogTime is the timestamp found in the line, see tailer.LogTimeTailer(). It is zero if the line has no timestamp.
+	LogTime time.Time
+	// Captures are the fields of the input's match pattern, see tailer.CaptureTailer(). It is nil if the input has no match
+	// pattern or if the line doesn't match it.
+	Captures map[string]interface{}
+	// Repeat is the number of identical consecutive lines that this line stands for, see tailer.DedupTailer().
+	// It is 0 for lines that were not deduplicated, which stand for one line.
+	Repeat int
 }
 
 // ideas how this might look like in the config file:
@@ -47,14 +64,39 @@ type Line struct {
 // Heads up: filters use globs while matches use regular expressions.
 // Moreover, we should provide vars {{.filename}} and {{.filepath}} for labels.
 
+// If fail_on_missing_logfile is false, directories that do not exist yet are checked periodically.
+var missingDirCheckInterval = time.Second
+
+// Number of times a watched file was truncated, see TruncatedFilesTotal().
+var truncatedFiles uint64
+
+// Number of times file system events were lost, see WatchOverflowsTotal().
+var watchOverflows uint64
+
+// Poll interval if file system notifications cannot be used.
+const fallbackPollInterval = time.Second
+
+// Maximum number of lines read from a file before the other files get their turn, see readNewLines().
+const linesPerTurn = 100
+
 type fileTailer struct {
-	globs        []glob.Glob
-	watchedDirs  []*Dir
-	watchedFiles map[string]*fileWithReader // path -> fileWithReader
-	osSpecific   fswatcher
-	lines        chan *Line
-	errors       chan Error
-	done         chan struct{}
+	globs              []glob.Glob
+	exclude            []string // patterns for file names that are not read even if they match one of the globs
+	olddir             string   // logrotate's olddir, relative to the log file's directory if not absolute. Empty if backups stay in the same directory.
+	followPath         bool     // continue files that are replaced at the same path, see continueReplacedFile()
+	watchedDirs        []*Dir
+	missingDirs        []string                   // directories that did not exist on startup, watched as soon as they are created
+	watchedFiles       map[string]*fileWithReader // path -> fileWithReader
+	positions          *PositionsFile             // nil if read positions are not persisted
+	format             LineFormat
+	idleTimeout        time.Duration        // zero if idle files are kept open
+	idleFiles          map[string]*idleFile // path -> watched file that was closed, because it was idle
+	partialLineTimeout time.Duration        // zero if incomplete lines wait for the delimiter until it is written
+	unfinished         []*fileWithReader    // watched files that may have more lines, in the order they get their next turn
+	osSpecific         fswatcher
+	lines              chan *Line
+	errors             chan Error
+	done               chan struct{}
 }
 
 type fswatcher interface {
@@ -90,24 +132,70 @@ func (t *fileTailer) Errors() chan Error {
 // Close() triggers the shutdown of the file tailer.
 // The file tailer will eventually terminate,
 // but after Close() returns it might still be running in the background for a few milliseconds.
+// The lines channel is closed when the positions are saved and the files are closed.
 func (t *fileTailer) Close() {
 	// Closing the done channel will stop the consumer loop.
 	// Deferred functions within the consumer loop will close the producer loop.
 	close(t.done)
 }
 
-func RunFileTailer(globs []glob.Glob, readall bool, failOnMissingFile bool, log logrus.FieldLogger) (FileTailer, error) {
-	return runFileTailer(initWatcher, globs, readall, failOnMissingFile, log)
+// Options configure the file tailer. The zero value reads the files from the beginning, and does not fail if no file is found.
+type Options struct {
+	Exclude               []string       // file names matching one of the patterns are not read, like "*.gz" for rotated backups
+	Start                 StartPosition  // where to start reading the files that exist on startup
+	ReadCompressedBackups bool           // if Start is Beginning, read the gzip compressed backups of the log files on startup
+	Olddir                string         // the directory where logrotate moves the backups with its olddir option, if any
+	FollowPath            bool           // continue a file that is replaced by a new file with the same content at the same path
+	FailOnMissingFile     bool           // fail if no file matches one of the globs
+	Positions             *PositionsFile // if not nil, files continue at the position where the last run of grok_exporter stopped reading
+	Format                LineFormat     // how the log files are split into lines
+	IdleTimeout           time.Duration  // if not zero, close files that got no lines for IdleTimeout, and open them again when they change
+	PartialLineTimeout    time.Duration  // if not zero, send a line that is not completed within PartialLineTimeout anyway
+	PollInterval          time.Duration  // only for RunPollingFileTailer()
+}
+
+// RunFileTailer uses the operating system's file system notifications.
+// If the log files are on a network file system, or if setting up the notifications fails,
+// it falls back to polling, because notifications would not be reliable.
+// If logrotate moves the backups to another directory, opts.Olddir is used to find them for opts.ReadCompressedBackups,
+// and for reading the lines a rotated file got before it was moved.
+// With opts.FollowPath, directories that are removed or unmounted are watched again when they are back.
+// Incomplete lines wait for the delimiter. With opts.PartialLineTimeout, they are sent when the timeout is over,
+// as well as the incomplete last line of a rotated file.
+func RunFileTailer(globs []glob.Glob, opts Options, log logrus.FieldLogger) (FileTailer, error) {
+	fallbackOpts := opts
+	fallbackOpts.PollInterval = fallbackPollInterval
+	dirPaths, _, _ := uniqueDirs(globs) // errors are reported by runFileTailer()
+	for _, dirPath := range dirPaths {
+		if fsType, isNetworkFs := networkFilesystem(dirPath); isNetworkFs {
+			log.Warnf("%v is on a %v file system, where file system notifications are unreliable: polling for changes every %v", dirPath, fsType, fallbackPollInterval)
+			return RunPollingFileTailer(globs, fallbackOpts, log)
+		}
+	}
+	tailer, Err := runFileTailer(initWatcher, globs, opts, log)
+	if Err != nil && Err.Type() == WatchFailed {
+		log.Warnf("%v: polling for changes every %v", Err, fallbackPollInterval)
+		return RunPollingFileTailer(globs, fallbackOpts, log)
+	}
+	if Err != nil {
+		return nil, Err
+	}
+	return tailer, nil
 }
 
-func RunPollingFileTailer(globs []glob.Glob, readall bool, failOnMissingFile bool, pollInterval time.Duration, log logrus.FieldLogger) (FileTailer, error) {
+// RunPollingFileTailer checks the files for changes every opts.PollInterval.
+func RunPollingFileTailer(globs []glob.Glob, opts Options, log logrus.FieldLogger) (FileTailer, error) {
 	initFunc := func() (fswatcher, Error) {
-		return initPollingWatcher(pollInterval)
+		return initPollingWatcher(opts.PollInterval)
+	}
+	tailer, Err := runFileTailer(initFunc, globs, opts, log)
+	if Err != nil {
+		return nil, Err
 	}
-	return runFileTailer(initFunc, globs, readall, failOnMissingFile, log)
+	return tailer, nil
 }
 
-func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readall bool, failOnMissingFile bool, log logrus.FieldLogger) (FileTailer, error) {
+func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, opts Options, log logrus.FieldLogger) (FileTailer, Error) {
 
 	var (
 		t   *fileTailer
@@ -115,11 +203,19 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 	)
 
 	t = &fileTailer{
-		globs:        globs,
-		watchedFiles: make(map[string]*fileWithReader),
-		lines:        make(chan *Line),
-		errors:       make(chan Error),
-		done:         make(chan struct{}),
+		globs:              globs,
+		exclude:            opts.Exclude,
+		olddir:             opts.Olddir,
+		followPath:         opts.FollowPath,
+		watchedFiles:       make(map[string]*fileWithReader),
+		positions:          opts.Positions,
+		format:             opts.Format,
+		idleTimeout:        opts.IdleTimeout,
+		idleFiles:          make(map[string]*idleFile),
+		partialLineTimeout: opts.PartialLineTimeout,
+		lines:              make(chan *Line),
+		errors:             make(chan Error),
+		done:               make(chan struct{}),
 	}
 
 	t.osSpecific, Err = initFunc()
@@ -127,26 +223,34 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 		return nil, Err
 	}
 
+	// Watch the directories before starting the goroutine, so that RunFileTailer() can fall back to polling if this fails.
+	Err = t.watchDirs(opts.FailOnMissingFile, log)
+	if Err != nil {
+		t.shutdown()
+		return nil, Err
+	}
+
 	go func() {
 
 		defer t.shutdown()
 
-		Err = t.watchDirs(log)
-		if Err != nil {
-			select {
-			case <-t.done:
-			case t.errors <- Err:
-			}
-			return
-		}
-
 		eventProducerLoop := t.osSpecific.runFseventProducerLoop()
 		defer eventProducerLoop.Close()
 
 		for _, dir := range t.watchedDirs {
 			dirLogger := log.WithField("directory", dir.Path())
 			dirLogger.Debugf("initializing directory")
-			Err = t.syncFilesInDir(dir, readall, dirLogger) // This may already write lines to the lines channel, so we will not go past this line unless the consumer starts reading lines.
+			if opts.Start.Type == Beginning && opts.ReadCompressedBackups {
+				Err = t.readCompressedBackups(dir, dirLogger)
+				if Err != nil {
+					select {
+					case <-t.done:
+					case t.errors <- Err:
+					}
+					return
+				}
+			}
+			Err = t.syncFilesInDir(dir, opts.Start, dirLogger) // This may already write lines to the lines channel, so we will not go past this line unless the consumer starts reading lines.
 			if Err != nil {
 				select {
 				case <-t.done:
@@ -157,7 +261,7 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 		}
 
 		// make sure at least one logfile was found for each glob
-		if failOnMissingFile {
+		if opts.FailOnMissingFile {
 			missingFileError := t.checkMissingFile()
 			if missingFileError != nil {
 				select {
@@ -168,10 +272,87 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 			}
 		}
 
+		var positionsSync <-chan time.Time // nil if positions are not persisted
+		if t.positions != nil {
+			ticker := time.NewTicker(t.positions.syncInterval)
+			defer ticker.Stop()
+			positionsSync = ticker.C
+			defer t.savePositions(log) // runs before t.shutdown() closes the files
+		}
+
+		// With followPath, directories may go missing later, so the ticker is created even if no directories are missing yet.
+		missingDirTicker := time.NewTicker(missingDirCheckInterval)
+		defer missingDirTicker.Stop()
+
+		var idleCheck <-chan time.Time // nil if idle files are kept open
+		if t.idleTimeout > 0 {
+			ticker := time.NewTicker(idleCheckInterval(t.idleTimeout))
+			defer ticker.Stop()
+			idleCheck = ticker.C
+		}
+
+		var partialLineCheck <-chan time.Time // nil if incomplete lines wait for the delimiter
+		if t.partialLineTimeout > 0 {
+			ticker := time.NewTicker(partialLineCheckInterval(t.partialLineTimeout))
+			defer ticker.Stop()
+			partialLineCheck = ticker.C
+		}
+
+		// ready is always ready, it is selected instead of nil if there are unfinished files
+		ready := make(chan struct{})
+		close(ready)
+
 		for { // event consumer loop
+			var unfinishedFiles chan struct{} // nil if all files were read to the end
+			if len(t.unfinished) > 0 {
+				unfinishedFiles = ready
+			}
+			var missingDirCheck <-chan time.Time // nil if there are no missing directories
+			if len(t.missingDirs) > 0 {
+				missingDirCheck = missingDirTicker.C
+			}
 			select {
 			case <-t.done:
 				return
+			case <-unfinishedFiles:
+				Err = t.readUnfinishedFile(log)
+				if Err != nil {
+					select {
+					case <-t.done:
+					case t.errors <- Err:
+					}
+					return
+				}
+			case <-positionsSync:
+				t.savePositions(log)
+			case <-missingDirCheck:
+				Err = t.watchMissingDirs(log)
+				if Err != nil {
+					select {
+					case <-t.done:
+					case t.errors <- Err:
+					}
+					return
+				}
+			case <-idleCheck:
+				t.closeIdleFiles(log)
+				Err = t.syncChangedIdleFiles(log)
+				if Err != nil {
+					select {
+					case <-t.done:
+					case t.errors <- Err:
+					}
+					return
+				}
+			case <-partialLineCheck:
+				Err = t.flushIncompleteLines(log)
+				if Err != nil {
+					select {
+					case <-t.done:
+					case t.errors <- Err:
+					}
+					return
+				}
 			case event, open := <-eventProducerLoop.Events():
 				if !open {
 					return
@@ -199,13 +380,11 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 	return t, nil
 }
 
+// shutdown closes the lines and errors channels last, so when the lines channel is closed, the files and watches are closed as well.
 func (t *fileTailer) shutdown() {
 
-	close(t.lines)
-	close(t.errors)
-
 	warnf := func(format string, args ...interface{}) {
-		log.Warnf("error while shutting down the file system watcher: %v", fmt.Sprintf(format, args))
+		logrus.Warnf("error while shutting down the file system watcher: %v", fmt.Sprintf(format, args...))
 	}
 
 	for _, dir := range t.watchedDirs {
@@ -226,18 +405,31 @@ func (t *fileTailer) shutdown() {
 			warnf("close(%q) failed: %v", file.file.Name(), err)
 		}
 	}
+
+	close(t.lines)
+	close(t.errors)
 }
 
-func (t *fileTailer) watchDirs(log logrus.FieldLogger) Error {
+func (t *fileTailer) watchDirs(failOnMissingFile bool, log logrus.FieldLogger) Error {
 	var (
-		Err      Error
-		dirPaths []string
-		dirPath  string
+		Err         Error
+		dirPaths    []string
+		missingDirs []string
+		dirPath     string
 	)
-	dirPaths, Err = uniqueDirs(t.globs)
+	dirPaths, missingDirs, Err = uniqueDirs(t.globs)
 	if Err != nil {
 		return Err
 	}
+	if len(missingDirs) > 0 {
+		if failOnMissingFile {
+			return NewErrorf(DirectoryNotFound, nil, "%q: no such directory", missingDirs[0])
+		}
+		for _, dirPath = range missingDirs {
+			log.Warnf("directory %v does not exist, waiting for it to be created", dirPath)
+		}
+		t.missingDirs = missingDirs
+	}
 	for _, dirPath = range dirPaths {
 		log.Debugf("watching directory %v", dirPath)
 		dir, Err := t.osSpecific.watchDir(dirPath)
@@ -249,26 +441,113 @@ func (t *fileTailer) watchDirs(log logrus.FieldLogger) Error {
 	return nil
 }
 
-func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogger) Error {
+// watchMissingDirs starts watching the directories from t.missingDirs that have been created in the meantime.
+// Files in these directories are new, so they are read from the beginning.
+func (t *fileTailer) watchMissingDirs(log logrus.FieldLogger) Error {
+	var stillMissing []string
+	for _, dirPath := range t.missingDirs {
+		dirInfo, err := os.Stat(dirPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				stillMissing = append(stillMissing, dirPath)
+				continue
+			}
+			return NewErrorf(NotSpecified, err, "%q: stat() failed", dirPath)
+		}
+		if !dirInfo.IsDir() {
+			return NewErrorf(NotSpecified, nil, "%q is not a directory", dirPath)
+		}
+		dirLogger := log.WithField("directory", dirPath)
+		dirLogger.Info("directory was created, start watching")
+		dir, Err := t.osSpecific.watchDir(dirPath)
+		if Err != nil {
+			return Err
+		}
+		t.watchedDirs = append(t.watchedDirs, dir)
+		Err = t.syncFilesInDir(dir, fromBeginning, dirLogger)
+		if Err != nil {
+			return Err
+		}
+		if !t.isWatchedDir(dirPath) {
+			stillMissing = append(stillMissing, dirPath) // removed again with followPath, see waitForRemovedDir()
+			continue
+		}
+		for path, file := range t.watchedFiles {
+			if filepath.Dir(path) != dirPath {
+				continue
+			}
+			// With followPath, the file may have been continued before the directory was watched again, so we might have missed writes.
+			Err = t.readNewLines(file, dirLogger.WithField("file", filepath.Base(path)))
+			if Err != nil {
+				return Err
+			}
+		}
+	}
+	t.missingDirs = stillMissing
+	return nil
+}
+
+func (t *fileTailer) syncFilesInDir(dir *Dir, start StartPosition, log logrus.FieldLogger) Error {
+	fileInfos, Err := dir.ls()
+	if Err != nil {
+		_, err := os.Stat(dir.Path())
+		if os.IsNotExist(err) && !t.isBaseDir(dir.Path()) {
+			// subdirectory for a recursive glob was removed, but we did not get the event for the removal yet
+			t.unwatchRemovedDir(dir.Path(), log)
+			return nil
+		}
+		if err != nil && t.followPath {
+			t.waitForRemovedDir(dir, log)
+			return nil
+		}
+		return Err
+	}
+	var subdirs []string
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			subdirs = append(subdirs, fileInfo.Name())
+		}
+	}
+	t.unwatchRemovedSubdirs(dir, subdirs, log)
 	watchedFilesAfter := make(map[string]*fileWithReader)
 	for path, file := range t.watchedFiles {
 		if filepath.Dir(path) != dir.Path() {
 			watchedFilesAfter[path] = file
 		}
 	}
-	fileInfos, Err := dir.ls()
+	stillMatching := make(map[*fileWithReader]bool)
+	foundIdleFiles := make(map[string]bool)
+	var newSubdirs []string // subdirectories that may contain files matching a recursive glob
+	for _, fileInfo := range fileInfos {
+		filePath := filepath.Join(dir.Path(), fileInfo.Name())
+		if fileInfo.IsDir() || !t.isIncluded(filePath) {
+			continue
+		}
+		alreadyWatched, Err := findSameFile(t, fileInfo, filePath)
+		if Err != nil {
+			return Err
+		}
+		if alreadyWatched != nil {
+			stillMatching[alreadyWatched] = true
+		}
+	}
+	Err = t.catchUp(dir, stillMatching, log)
 	if Err != nil {
 		return Err
 	}
 	for _, fileInfo := range fileInfos {
 		filePath := filepath.Join(dir.Path(), fileInfo.Name())
 		fileLogger := log.WithField("file", fileInfo.Name())
-		if !anyGlobMatches(t.globs, filePath) {
-			fileLogger.Debug("skipping file, because file name does not match")
+		if fileInfo.IsDir() {
+			if !anyGlobIncludesSubdir(t.globs, filePath) || t.isWatchedDir(filePath) {
+				fileLogger.Debug("skipping, because it is a directory")
+				continue
+			}
+			newSubdirs = append(newSubdirs, filePath)
 			continue
 		}
-		if fileInfo.IsDir() {
-			fileLogger.Debug("skipping, because it is a directory")
+		if !t.isIncluded(filePath) {
+			fileLogger.Debug("skipping file, because file name does not match or is excluded")
 			continue
 		}
 		alreadyWatched, Err := findSameFile(t, fileInfo, filePath)
@@ -301,6 +580,11 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 			}
 			continue
 		}
+		if t.isUnchangedIdleFile(filePath, fileInfo.Size()) {
+			fileLogger.Debug("skipping, because file is idle")
+			foundIdleFiles[filePath] = true
+			continue
+		}
 		newFile, Err := open(filePath)
 		if Err != nil {
 			if Err.Type() == FileNotFound {
@@ -310,15 +594,56 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 				return Err
 			}
 		}
-		if !readall {
-			_, err := newFile.Seek(0, io.SeekEnd)
-			if err != nil {
+		ino, err := inode(newFile)
+		if err != nil {
+			newFile.Close()
+			return NewErrorf(NotSpecified, err, "%v: stat failed", filePath)
+		}
+		dev, err := device(newFile)
+		if err != nil {
+			newFile.Close()
+			return NewErrorf(NotSpecified, err, "%v: stat failed", filePath)
+		}
+		newFileWithReader := &fileWithReader{file: newFile, reader: NewLineReader(t.format), lastRead: time.Now()}
+		if idle := t.takeIdleFile(dir, ino, dev); idle != nil {
+			fileLogger = fileLogger.WithField("fd", newFile.Fd())
+			fileLogger.Info("opening idle file again")
+			Err = resumeIdleFile(newFileWithReader, idle, fileLogger)
+			if Err != nil {
 				newFile.Close()
-				return NewError(NotSpecified, os.NewSyscallError("seek", err), filePath)
+				return Err
+			}
+		} else {
+			continued := false
+			if replaced := t.watchedFiles[filePath]; t.followPath && replaced != nil && !stillMatching[replaced] {
+				continued, Err = continueReplacedFile(newFileWithReader, replaced, fileLogger)
+				if Err != nil {
+					newFile.Close()
+					return Err
+				}
+			}
+			if !continued {
+				offset, whence, Err := t.initialPosition(filePath, ino, start, fileLogger)
+				if Err != nil {
+					newFile.Close()
+					return Err
+				}
+				if offset != 0 || whence != io.SeekStart {
+					pos, err := newFile.Seek(offset, whence)
+					if err != nil {
+						newFile.Close()
+						return NewError(NotSpecified, os.NewSyscallError("seek", err), filePath)
+					}
+					newFileWithReader.reader.SetPosition(pos)
+				}
+			}
+			fileLogger = fileLogger.WithField("fd", newFile.Fd())
+			if continued {
+				fileLogger.Info("file was replaced by a file with the same content, continuing where the old file was read")
+			} else {
+				fileLogger.Info("watching new file")
 			}
 		}
-		fileLogger = fileLogger.WithField("fd", newFile.Fd())
-		fileLogger.Info("watching new file")
 
 		Err = t.osSpecific.watchFile(newFile)
 		if Err != nil {
@@ -326,7 +651,6 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 			return Err
 		}
 
-		newFileWithReader := &fileWithReader{file: newFile, reader: NewLineReader()}
 		Err = t.readNewLines(newFileWithReader, fileLogger)
 		if Err != nil {
 			newFile.Close()
@@ -337,21 +661,332 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 	for _, f := range t.watchedFiles {
 		if !contains(watchedFilesAfter, f) {
 			fileLogger := log.WithField("file", filepath.Base(f.file.Name())).WithField("fd", f.file.Fd())
-			fileLogger.Info("file was removed, closing and un-watching")
+			if isDeleted(f.file) {
+				fileLogger.Info("file was removed, closing and un-watching")
+			} else {
+				fileLogger.Info("file was rotated or moved, closing and un-watching")
+			}
 			f.file.Close()
 		}
 	}
 	t.watchedFiles = watchedFilesAfter
+	t.removeIdleFiles(dir, foundIdleFiles, log)
+	return t.watchSubdirs(newSubdirs, start, log)
+}
+
+// watchSubdirs starts watching new subdirectories for recursive globs.
+// The subdirectory is synced with the same start position as its parent,
+// i.e. on startup we use the configured start position, and later the files are new and are read from the beginning.
+func (t *fileTailer) watchSubdirs(paths []string, start StartPosition, log logrus.FieldLogger) Error {
+	for _, path := range paths {
+		dirLogger := log.WithField("directory", path)
+		dirLogger.Info("watching new directory")
+		dir, Err := t.osSpecific.watchDir(path)
+		if Err != nil {
+			return Err
+		}
+		t.watchedDirs = append(t.watchedDirs, dir)
+		Err = t.syncFilesInDir(dir, start, dirLogger)
+		if Err != nil {
+			return Err
+		}
+	}
+	return nil
+}
+
+// unwatchRemovedSubdirs stops watching the subdirectories of dir that are no longer there.
+func (t *fileTailer) unwatchRemovedSubdirs(dir *Dir, subdirs []string, log logrus.FieldLogger) {
+	for _, watchedDir := range t.watchedDirs {
+		if filepath.Dir(watchedDir.Path()) == dir.Path() && !t.isBaseDir(watchedDir.Path()) && !containsString(subdirs, filepath.Base(watchedDir.Path())) {
+			t.unwatchRemovedDir(watchedDir.Path(), log)
+		}
+	}
+}
+
+// unwatchRemovedDir stops watching a subdirectory that was removed, including its subdirectories and files.
+func (t *fileTailer) unwatchRemovedDir(path string, log logrus.FieldLogger) {
+	isRemoved := func(p string) bool {
+		return p == path || strings.HasPrefix(p, path+string(filepath.Separator))
+	}
+	watchedDirsAfter := make([]*Dir, 0, len(t.watchedDirs))
+	for _, dir := range t.watchedDirs {
+		if !isRemoved(dir.Path()) {
+			watchedDirsAfter = append(watchedDirsAfter, dir)
+			continue
+		}
+		log.WithField("directory", dir.Path()).Info("directory was removed, un-watching")
+		err := t.osSpecific.unwatchDir(dir)
+		if err != nil {
+			// The watch may already be gone with the directory.
+			log.WithField("directory", dir.Path()).Debugf("%v", err)
+		}
+	}
+	t.watchedDirs = watchedDirsAfter
+	for filePath, file := range t.watchedFiles {
+		if isRemoved(filepath.Dir(filePath)) {
+			log.WithField("file", filePath).WithField("fd", file.file.Fd()).Info("file was removed, closing and un-watching")
+			file.file.Close()
+			delete(t.watchedFiles, filePath)
+		}
+	}
+	for filePath := range t.idleFiles {
+		if isRemoved(filepath.Dir(filePath)) {
+			delete(t.idleFiles, filePath)
+		}
+	}
+}
+
+// isBaseDir is true if path is the directory of a glob. Subdirectories for recursive globs are not base directories.
+func (t *fileTailer) isBaseDir(path string) bool {
+	for _, g := range t.globs {
+		if g.Dir() == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fileTailer) isWatchedDir(path string) bool {
+	for _, dir := range t.watchedDirs {
+		if dir.Path() == path {
+			return true
+		}
+	}
+	return false
+}
+
+// initialPosition returns where to start reading a newly opened file, as arguments for Seek().
+// This is the position saved in the positions file, or the start position otherwise.
+func (t *fileTailer) initialPosition(path string, ino uint64, start StartPosition, log logrus.FieldLogger) (int64, int, Error) {
+	if t.positions != nil {
+		if pos, ok := t.positions.restore(path); ok {
+			fileInfo, err := os.Stat(path)
+			if err != nil {
+				return 0, 0, NewErrorf(NotSpecified, err, "%v: stat failed", path)
+			}
+			switch {
+			case ino != pos.Inode:
+				backup, Err := t.findRotatedFile(path, pos.Inode)
+				if Err != nil {
+					return 0, 0, Err
+				}
+				if backup == "" {
+					log.Info("file was replaced while grok_exporter was not running, reading from the beginning")
+					return 0, io.SeekStart, nil
+				}
+				log.Infof("file was rotated to %v while grok_exporter was not running, reading the remaining lines of the old file before the new file", backup)
+				Err = t.readRotatedFile(backup, path, pos.Offset)
+				if Err != nil {
+					return 0, 0, Err
+				}
+				return 0, io.SeekStart, nil
+			case fileInfo.Size() < pos.Offset:
+				log.Info("file was truncated while grok_exporter was not running, reading from the beginning")
+				countTruncatedFile()
+				return 0, io.SeekStart, nil
+			default:
+				log.Infof("continuing at saved position %v", pos.Offset)
+				return pos.Offset, io.SeekStart, nil
+			}
+		}
+	}
+	return start.offset(path, t.format)
+}
+
+// savePositions writes the position after the last line that was read for each watched file.
+func (t *fileTailer) savePositions(log logrus.FieldLogger) {
+	positions := make(map[string]Position, len(t.watchedFiles))
+	for path, file := range t.watchedFiles {
+		ino, err := inode(file.file)
+		if err != nil {
+			log.Warnf("%v: failed to get inode for positions file: %v", path, err)
+			continue
+		}
+		currentPos, Err := file.file.Seek(0, io.SeekCurrent)
+		if Err != nil {
+			log.Warnf("%v: failed to get position for positions file: %v", path, Err)
+			continue
+		}
+		positions[path] = Position{Inode: ino, Offset: currentPos - int64(file.reader.Buffered()) - file.unsent}
+	}
+	for path, idle := range t.idleFiles {
+		positions[path] = Position{Inode: idle.inode, Offset: idle.offset - int64(idle.reader.Buffered())}
+	}
+	err := t.positions.write(positions)
+	if err != nil {
+		log.Warnf("%v", err)
+	}
+}
+
+// catchUp reads the lines that were written to the watched files in dir since the last read,
+// if the files were moved or removed so that they will no longer be watched.
+// This is called before the directory is synced, so if logrotate moved or removed a file,
+// the remaining lines of the old file are processed before the new file is opened.
+func (t *fileTailer) catchUp(dir *Dir, stillMatching map[*fileWithReader]bool, log logrus.FieldLogger) Error {
+	for path, file := range t.watchedFiles {
+		if filepath.Dir(path) != dir.Path() || stillMatching[file] {
+			continue
+		}
+		fileLogger := log.WithField("file", filepath.Base(path))
+		found, Err := followRotatedFile(dir, file)
+		if Err == nil && !found {
+			found, Err = t.followRotatedFileToOlddir(dir, file)
+		}
+		if Err != nil {
+			return Err
+		}
+		if !found {
+			fileLogger.Debug("file was removed, cannot read remaining lines")
+			continue
+		}
+		Err = t.readRemainingLines(file, fileLogger)
+		if Err != nil && t.followPath {
+			// The file may be on a file system that was unmounted, like an overlayfs that was remounted.
+			fileLogger.Warnf("cannot read remaining lines: %v", Err)
+			continue
+		}
+		if Err != nil {
+			return Err
+		}
+		if t.partialLineTimeout > 0 {
+			// The rotated file will not be written any more, so its last line will not be completed.
+			t.flushIncompleteLine(file, fileLogger)
+		}
+	}
+	return nil
+}
+
+// followRotatedFileToOlddir looks for a rotated file in the olddir, if followRotatedFile() did not find it in dir.
+func (t *fileTailer) followRotatedFileToOlddir(dir *Dir, file *fileWithReader) (bool, Error) {
+	backupDirs := t.backupDirs(dir.Path())
+	if len(backupDirs) < 2 {
+		return false, nil
+	}
+	if _, err := os.Stat(backupDirs[1]); err != nil {
+		return false, nil
+	}
+	olddir, Err := newDir(backupDirs[1])
+	if Err != nil {
+		return false, Err
+	}
+	return followRotatedFile(olddir, file)
+}
+
+// continueReplacedFile is used with followPath if a watched file was replaced by newFile at the same path, like when a directory
+// was remounted and the file got a new inode. If newFile starts with the same content, newFile is positioned where the replaced
+// file was read, and true is returned. Otherwise, newFile is a new log file that is read from the beginning.
+// If the replaced file cannot be read any more, like after an unmount, only the sizes are compared.
+func continueReplacedFile(newFile *fileWithReader, replaced *fileWithReader, log logrus.FieldLogger) (bool, Error) {
+	pos := replaced.reader.Position() + int64(replaced.reader.Buffered())
+	fileInfo, err := os.Stat(newFile.file.Name())
+	if err != nil {
+		return false, NewErrorf(NotSpecified, err, "%v: stat failed", newFile.file.Name())
+	}
+	if pos == 0 || fileInfo.Size() < pos {
+		return false, nil
+	}
+	newFingerprint, err := fingerprint(newFile, pos)
+	if err != nil {
+		return false, NewErrorf(NotSpecified, err, "%v: read() failed", newFile.file.Name())
+	}
+	replacedFingerprint, err := fingerprint(replaced, pos)
+	if err != nil {
+		log.Debugf("cannot read the replaced file, assuming it had the same content: %v", err)
+	}
+	if err == nil && replacedFingerprint != newFingerprint {
+		_, seekErr := newFile.file.Seek(0, io.SeekStart)
+		if seekErr != nil {
+			return false, NewErrorf(NotSpecified, seekErr, "%v: seek() failed", newFile.file.Name())
+		}
+		return false, nil
+	}
+	_, seekErr := newFile.file.Seek(pos, io.SeekStart)
+	if seekErr != nil {
+		return false, NewErrorf(NotSpecified, seekErr, "%v: seek() failed", newFile.file.Name())
+	}
+	newFile.reader = replaced.reader
+	return true, nil
+}
+
+// waitForRemovedDir is used with followPath if a base directory was removed or unmounted. The directory is watched again
+// when it is back, see watchMissingDirs(). Its files are kept open, so that they can be continued if they are back at the same path.
+func (t *fileTailer) waitForRemovedDir(dir *Dir, log logrus.FieldLogger) {
+	log.Warn("directory was removed or unmounted, waiting for it to be back")
+	watchedDirsAfter := make([]*Dir, 0, len(t.watchedDirs))
+	for _, watchedDir := range t.watchedDirs {
+		if watchedDir != dir {
+			watchedDirsAfter = append(watchedDirsAfter, watchedDir)
+		}
+	}
+	t.watchedDirs = watchedDirsAfter
+	err := t.osSpecific.unwatchDir(dir)
+	if err != nil {
+		log.Debugf("%v", err) // the watch is usually gone with the directory
+	}
+	if !containsString(t.missingDirs, dir.Path()) {
+		t.missingDirs = append(t.missingDirs, dir.Path())
+	}
+}
+
+// restartTruncatedFile continues at the beginning of a file that was truncated in place, like with 'truncate -s 0 logfile'.
+// The file is no longer read from the old position, because the lines written after the truncation would be lost until
+// the file grows past that position again.
+func (t *fileTailer) restartTruncatedFile(file *fileWithReader, log logrus.FieldLogger) Error {
+	log.WithField("file", file.file.Name()).Info("file was truncated, reading from the beginning")
+	_, err := file.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return NewErrorf(NotSpecified, err, "%v: seek() failed", file.file.Name())
+	}
+	file.reader.SetPosition(0)
+	countTruncatedFile()
 	return nil
 }
 
+func countTruncatedFile() {
+	atomic.AddUint64(&truncatedFiles, 1)
+}
+
+// TruncatedFilesTotal is the number of times a file was truncated while it was tailed,
+// or while grok_exporter was not running if the file has a saved position.
+// This is a global number for all file tailers.
+func TruncatedFilesTotal() uint64 {
+	return atomic.LoadUint64(&truncatedFiles)
+}
+
+func countWatchOverflow() {
+	atomic.AddUint64(&watchOverflows, 1)
+}
+
+// WatchOverflowsTotal is the number of times the operating system reported that file system events were lost,
+// like when the inotify event queue overflowed. This is a global number for all file tailers.
+func WatchOverflowsTotal() uint64 {
+	return atomic.LoadUint64(&watchOverflows)
+}
+
+// readNewLines reads up to linesPerTurn lines of the file. If the end of the file is not reached, the file is queued
+// and the event consumer loop continues reading it after the other unfinished files had their turn.
+// Otherwise, if one file is written faster than grok_exporter processes the lines, the other files would never be read.
 func (t *fileTailer) readNewLines(file *fileWithReader, log logrus.FieldLogger) Error {
+	return t.readLines(file, linesPerTurn, log)
+}
+
+// readRemainingLines reads the file to the end, like before a rotated file is closed.
+func (t *fileTailer) readRemainingLines(file *fileWithReader, log logrus.FieldLogger) Error {
+	return t.readLines(file, 0, log)
+}
+
+// readLines reads up to maxLines lines of the file, 0 means until the end of the file.
+func (t *fileTailer) readLines(file *fileWithReader, maxLines int, log logrus.FieldLogger) Error {
 	var (
 		line string
 		eof  bool
 		err  error
 	)
-	for {
+	for n := 0; ; n++ {
+		if maxLines > 0 && n == maxLines {
+			t.queueUnfinishedFile(file)
+			return nil
+		}
 		line, eof, err = file.reader.ReadLine(file.file)
 		if err != nil {
 			return NewErrorf(NotSpecified, err, "%v: read() failed", file.file.Name())
@@ -360,14 +995,43 @@ func (t *fileTailer) readNewLines(file *fileWithReader, log logrus.FieldLogger)
 			return nil
 		}
 		log.Debugf("read line %q", line)
+		file.lastRead = time.Now()
 		select {
 		case <-t.done:
+			// The line is read again after a restart, because it is not included in the saved position.
+			file.unsent = file.reader.LastLineLength()
 			return nil
-		case t.lines <- &Line{Line: line, File: file.file.Name()}:
+		case t.lines <- &Line{Line: line, File: file.file.Name(), Truncated: file.reader.Truncated(), ReadTime: file.lastRead, Offset: file.reader.LastLineOffset()}:
 		}
 	}
 }
 
+func (t *fileTailer) queueUnfinishedFile(file *fileWithReader) {
+	for _, f := range t.unfinished {
+		if f == file {
+			return // the file keeps its place in the queue
+		}
+	}
+	t.unfinished = append(t.unfinished, file)
+}
+
+// readUnfinishedFile continues reading the next file in the queue of unfinished files.
+func (t *fileTailer) readUnfinishedFile(log logrus.FieldLogger) Error {
+	file := t.unfinished[0]
+	t.unfinished = t.unfinished[1:]
+	if !contains(t.watchedFiles, file) {
+		return nil // the file was closed in the meantime
+	}
+	Err := t.readNewLines(file, log.WithField("file", file.file.Name()))
+	if Err != nil {
+		if cause, ok := Err.Cause().(Error); ok && cause.Type() == WinFileRemoved {
+			return nil // the file was moved or removed, it is read when we process the event for the directory
+		}
+		return Err
+	}
+	return nil
+}
+
 func (t *fileTailer) checkMissingFile() Error {
 OUTER:
 	for _, g := range t.globs {
@@ -384,31 +1048,43 @@ OUTER:
 }
 
 // Gets the directory paths from the glob expressions,
-// and makes sure these directories exist.
-func uniqueDirs(globs []glob.Glob) ([]string, Error) {
+// separated into directories that exist and directories that don't exist.
+func uniqueDirs(globs []glob.Glob) ([]string, []string, Error) {
 	var (
 		result  = make([]string, 0, len(globs))
+		missing []string
 		g       glob.Glob
 		dirInfo os.FileInfo
 		err     error
 	)
 	for _, g = range globs {
-		if containsString(result, g.Dir()) {
+		if containsString(result, g.Dir()) || containsString(missing, g.Dir()) {
 			continue
 		}
 		dirInfo, err = os.Stat(g.Dir())
 		if err != nil {
 			if os.IsNotExist(err) {
-				return nil, NewErrorf(DirectoryNotFound, nil, "%q: no such directory", g.Dir())
+				missing = append(missing, g.Dir())
+				continue
 			}
-			return nil, NewErrorf(NotSpecified, err, "%q: stat() failed", g.Dir())
+			return nil, nil, NewErrorf(NotSpecified, err, "%q: stat() failed", g.Dir())
 		}
 		if !dirInfo.IsDir() {
-			return nil, NewErrorf(NotSpecified, nil, "%q is not a directory", g.Dir())
+			return nil, nil, NewErrorf(NotSpecified, nil, "%q is not a directory", g.Dir())
 		}
 		result = append(result, g.Dir())
 	}
-	return result, nil
+	return result, missing, nil
+}
+
+// isIncluded is true if path matches one of the globs, but none of the exclude patterns.
+func (t *fileTailer) isIncluded(path string) bool {
+	for _, pattern := range t.exclude {
+		if matched, _ := filepath.Match(pattern, filepath.Base(path)); matched {
+			return false
+		}
+	}
+	return anyGlobMatches(t.globs, path)
 }
 
 func anyGlobMatches(globs []glob.Glob, path string) bool {
@@ -420,6 +1096,15 @@ func anyGlobMatches(globs []glob.Glob, path string) bool {
 	return false
 }
 
+func anyGlobIncludesSubdir(globs []glob.Glob, path string) bool {
+	for _, pattern := range globs {
+		if pattern.IncludesSubdir(path) {
+			return true
+		}
+	}
+	return false
+}
+
 func containsString(list []string, s string) bool {
 	for _, existing := range list {
 		if existing == s {
@@ -20,6 +20,7 @@ import (
 	"io"
 	"os"
 	"syscall"
+	"time"
 )
 
 type watcher struct {
@@ -27,8 +28,10 @@ type watcher struct {
 }
 
 type fileWithReader struct {
-	file   *os.File
-	reader *lineReader
+	file     *os.File
+	reader   *lineReader
+	lastRead time.Time // for closing idle files
+	unsent   int64     // length of the last line read if it was not sent because the tailer was closed
 }
 
 func (w *watcher) unwatchDir(dir *Dir) error {
@@ -41,9 +44,14 @@ func (w *watcher) unwatchDir(dir *Dir) error {
 }
 
 func (w *watcher) Close() error {
-	// After calling keventProducerLoop.Close(), we need to close the kq descriptor
-	// in order to interrupt the kevent() system call. See keventProducerLoop.Close().
+	// After calling keventProducerLoop.Close(), we need to interrupt the kevent() system call. See keventProducerLoop.Close().
+	// Closing the kq descriptor does not reliably interrupt a kevent() call in another thread, so we trigger the wakeup event first.
+	zeroTimeout := syscall.NsecToTimespec(0) // timeout zero means non-blocking kevent() call
+	_, triggerErr := syscall.Kevent(w.kq, []syscall.Kevent_t{makeWakeupEvent(0, syscall.NOTE_TRIGGER)}, nil, &zeroTimeout)
 	err := syscall.Close(w.kq)
+	if triggerErr != nil {
+		return fmt.Errorf("triggering the kevent wakeup event failed: %v", triggerErr)
+	}
 	if err != nil {
 		return fmt.Errorf("closing the kevent file descriptor failed: %v", err)
 	} else {
@@ -58,7 +66,13 @@ func (w *watcher) runFseventProducerLoop() fseventProducerLoop {
 func initWatcher() (fswatcher, Error) {
 	kq, err := syscall.Kqueue()
 	if err != nil {
-		return nil, NewError(NotSpecified, err, "kqueue() failed")
+		return nil, NewError(WatchFailed, err, "kqueue() failed")
+	}
+	zeroTimeout := syscall.NsecToTimespec(0) // timeout zero means non-blocking kevent() call
+	_, err = syscall.Kevent(kq, []syscall.Kevent_t{makeWakeupEvent(syscall.EV_ADD|syscall.EV_CLEAR, 0)}, nil, &zeroTimeout)
+	if err != nil {
+		syscall.Close(kq)
+		return nil, NewError(WatchFailed, err, "failed to register the kevent wakeup event")
 	}
 	return &watcher{kq: kq}, nil
 }
@@ -77,7 +91,7 @@ func (w *watcher) watchDir(path string) (*Dir, Error) {
 	_, err = syscall.Kevent(w.kq, []syscall.Kevent_t{makeEvent(dir.file)}, nil, &zeroTimeout)
 	if err != nil {
 		dir.file.Close()
-		return nil, NewErrorf(NotSpecified, err, "%v: kevent() failed", path)
+		return nil, NewErrorf(WatchFailed, err, "%v: kevent() failed", path)
 	}
 	return dir, nil
 }
@@ -142,11 +156,21 @@ func (w *watcher) processDirEvent(t *fileTailer, kevent syscall.Kevent_t, dir *D
 		// NOTE_WRITE on the directory's fd means a file was created, deleted, or moved. This covers inotify's MOVED_TO.
 		// NOTE_EXTEND reports that a directory entry was added	or removed as the result of rename operation.
 		dirLogger.Debugf("checking for new/deleted/moved files")
-		err := t.syncFilesInDir(dir, true, dirLogger)
+		err := t.syncFilesInDir(dir, fromBeginning, dirLogger)
 		if err != nil {
 			return NewErrorf(NotSpecified, err, "%v: failed to update list of files in directory", dir.file.Name())
 		}
 	}
+	if (kevent.Fflags&syscall.NOTE_DELETE == syscall.NOTE_DELETE || kevent.Fflags&syscall.NOTE_RENAME == syscall.NOTE_RENAME) && !t.isBaseDir(dir.file.Name()) {
+		t.unwatchRemovedDir(dir.file.Name(), dirLogger) // subdirectory for a recursive glob was removed or moved away
+		return nil
+	}
+	if kevent.Fflags&(syscall.NOTE_DELETE|syscall.NOTE_RENAME|syscall.NOTE_REVOKE) != 0 && t.followPath {
+		if t.isWatchedDir(dir.file.Name()) { // otherwise syncFilesInDir() already found out that the directory is gone
+			t.waitForRemovedDir(dir, dirLogger)
+		}
+		return t.watchMissingDirs(dirLogger) // the directory may be back already, like after a remount
+	}
 	if kevent.Fflags&syscall.NOTE_DELETE == syscall.NOTE_DELETE {
 		return NewErrorf(NotSpecified, nil, "%v: directory was deleted", dir.file.Name())
 	}
@@ -167,18 +191,17 @@ func (w *watcher) processFileEvent(t *fileTailer, kevent syscall.Kevent_t, file
 		readErr   Error
 	)
 
-	// Handle truncate events.
-	if kevent.Fflags&syscall.NOTE_ATTRIB == syscall.NOTE_ATTRIB {
+	// Handle truncate events. If the file was truncated and written to before we got the event, we might only see NOTE_WRITE.
+	if kevent.Fflags&syscall.NOTE_ATTRIB == syscall.NOTE_ATTRIB || kevent.Fflags&syscall.NOTE_WRITE == syscall.NOTE_WRITE {
 		truncated, err = isTruncated(file.file)
 		if err != nil {
 			return NewErrorf(NotSpecified, err, "%v: seek() or stat() failed", file.file.Name())
 		}
 		if truncated {
-			_, err = file.file.Seek(0, io.SeekStart)
-			if err != nil {
-				return NewErrorf(NotSpecified, err, "%v: seek() failed", file.file.Name())
+			readErr = t.restartTruncatedFile(file, log)
+			if readErr != nil {
+				return readErr
 			}
-			file.reader.Clear()
 		}
 	}
 
@@ -210,6 +233,11 @@ func isTruncated(file *os.File) (bool, error) {
 	return currentPos > fileInfo.Size(), nil
 }
 
+// followRotatedFile is a no-op, because the file descriptor can still be read after the file was moved or removed.
+func followRotatedFile(_ *Dir, _ *fileWithReader) (bool, Error) {
+	return true, nil
+}
+
 func findSameFile(t *fileTailer, file os.FileInfo, _ string) (*fileWithReader, Error) {
 	var (
 		fileInfo os.FileInfo
@@ -218,7 +246,7 @@ func findSameFile(t *fileTailer, file os.FileInfo, _ string) (*fileWithReader, E
 	for _, watchedFile := range t.watchedFiles {
 		fileInfo, err = watchedFile.file.Stat()
 		if err != nil {
-			return nil, NewErrorf(NotSpecified, err, "%v: stat failed", watchedFile.file.Name())
+			continue // like a stale file handle after an unmount, so it's not the same file
 		}
 		if os.SameFile(fileInfo, file) {
 			return watchedFile, nil
@@ -258,3 +286,13 @@ func makeEvent(file withFd) syscall.Kevent_t {
 		Udata:  nil,
 	}
 }
+
+// makeWakeupEvent creates the user event that is triggered in Close() to terminate the kevent loop.
+func makeWakeupEvent(flags uint16, fflags uint32) syscall.Kevent_t {
+	return syscall.Kevent_t{
+		Ident:  0, // idents are per filter, so this does not clash with file descriptor 0
+		Filter: syscall.EVFILT_USER,
+		Flags:  flags,
+		Fflags: fflags,
+	}
+}
@@ -1,4 +1,5 @@
-// Copyright 2020 The Prometheus Authors
+// Copyright 2020 The grok_exporter Authors
+//
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
 // You may obtain a copy of the License at
@@ -11,8 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// +build linux
-
-package procfs
+package fswatcher
 
-var parseCPUInfo = parseCPUInfoMips
+func fdToInt(fd uintptr) uint64 {
+	return uint64(fd)
+}
@@ -22,15 +22,22 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 )
 
+const watchDirMask = syscall.IN_MODIFY | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_CREATE
+
 type watcher struct {
-	fd int
+	fd             int
+	wakeup         [2]int           // pipe for interrupting the inotify loop, see inotifyloop.Close()
+	symlinkTargets map[int][]string // watch descriptor of a symlink's target -> paths of the symlinks
 }
 
 type fileWithReader struct {
-	file   *os.File
-	reader *lineReader
+	file     *os.File
+	reader   *lineReader
+	lastRead time.Time // for closing idle files
+	unsent   int64     // length of the last line read if it was not sent because the tailer was closed
 }
 
 func (w *watcher) unwatchDir(dir *Dir) error {
@@ -45,6 +52,8 @@ func (w *watcher) unwatchDir(dir *Dir) error {
 }
 
 func (w *watcher) Close() error {
+	_ = syscall.Close(w.wakeup[0])
+	_ = syscall.Close(w.wakeup[1])
 	err := syscall.Close(w.fd)
 	if err != nil {
 		return fmt.Errorf("failed to close the inotify file descriptor: %v", err)
@@ -54,9 +63,13 @@ func (w *watcher) Close() error {
 }
 
 func unwatchDirByEvent(t *fileTailer, event inotifyEvent) {
+	unwatchDirByWd(t, int(event.Wd))
+}
+
+func unwatchDirByWd(t *fileTailer, wd int) {
 	watchedDirsAfter := make([]*Dir, 0, len(t.watchedDirs)-1)
 	for _, existing := range t.watchedDirs {
-		if existing.wd != int(event.Wd) {
+		if existing.wd != wd {
 			watchedDirsAfter = append(watchedDirsAfter, existing)
 		}
 	}
@@ -64,15 +77,21 @@ func unwatchDirByEvent(t *fileTailer, event inotifyEvent) {
 }
 
 func (w *watcher) runFseventProducerLoop() fseventProducerLoop {
-	return runInotifyLoop(w.fd)
+	return runInotifyLoop(w.fd, w.wakeup)
 }
 
 func initWatcher() (fswatcher, Error) {
 	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
 	if err != nil {
-		return nil, NewError(NotSpecified, err, "inotify_init1() failed")
+		return nil, NewError(WatchFailed, err, "inotify_init1() failed")
+	}
+	result := &watcher{fd: fd, symlinkTargets: make(map[int][]string)}
+	err = syscall.Pipe2(result.wakeup[:], syscall.O_CLOEXEC)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, NewError(WatchFailed, err, "pipe2() failed")
 	}
-	return &watcher{fd: fd}, nil
+	return result, nil
 }
 
 func (w *watcher) watchDir(path string) (*Dir, Error) {
@@ -85,9 +104,12 @@ func (w *watcher) watchDir(path string) (*Dir, Error) {
 	if Err != nil {
 		return nil, Err
 	}
-	dir.wd, err = syscall.InotifyAddWatch(w.fd, path, syscall.IN_MODIFY|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO|syscall.IN_DELETE|syscall.IN_CREATE)
+	dir.wd, err = syscall.InotifyAddWatch(w.fd, path, watchDirMask)
+	if err == syscall.ENOSPC {
+		return nil, NewErrorf(WatchFailed, err, "%q: inotify_add_watch() failed: the maximum number of inotify watches is reached, see sysctl fs.inotify.max_user_watches", path)
+	}
 	if err != nil {
-		return nil, NewErrorf(NotSpecified, err, "%q: inotify_add_watch() failed", path)
+		return nil, NewErrorf(WatchFailed, err, "%q: inotify_add_watch() failed", path)
 	}
 	return dir, nil
 }
@@ -96,11 +118,65 @@ func newDir(path string) (*Dir, Error) {
 	return &Dir{path: path}, nil
 }
 
-func (w *watcher) watchFile(_ fileMeta) Error {
-	// nothing to do, because on Linux we watch the directory and don't need to watch individual files.
+func (w *watcher) watchFile(file fileMeta) Error {
+	// Usually there is nothing to do, because on Linux we watch the directory and don't need to watch individual files.
+	// However, if the file is a symlink, the IN_MODIFY events are reported for the target's name in the target's directory.
+	// We watch the target to get these events. inotify_add_watch() follows the symlink.
+	if !isSymlink(file.Name()) {
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, file.Name(), syscall.IN_MODIFY)
+	if err != nil {
+		return NewErrorf(WatchFailed, err, "%q: inotify_add_watch() failed", file.Name())
+	}
+	for _, path := range w.symlinkTargets[wd] {
+		if path == file.Name() {
+			return nil
+		}
+	}
+	w.symlinkTargets[wd] = append(w.symlinkTargets[wd], file.Name())
 	return nil
 }
 
+// processSymlinkTargetEvent reads new lines from the symlinks pointing to a modified target.
+// If none of the symlinks is watched anymore, because they point to other files now, the target is unwatched.
+func (w *watcher) processSymlinkTargetEvent(t *fileTailer, event inotifyEvent, paths []string, log logrus.FieldLogger) Error {
+	log.Debugf("received event for symlink target: %v", event)
+	if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED {
+		delete(w.symlinkTargets, int(event.Wd))
+		return nil
+	}
+	if event.Mask&syscall.IN_MODIFY != syscall.IN_MODIFY {
+		return nil
+	}
+	watched := false
+	for _, path := range paths {
+		file, ok := t.watchedFiles[path]
+		if !ok {
+			continue
+		}
+		watched = true
+		Err := readModifiedFile(t, file, log.WithField("file", path))
+		if Err != nil {
+			return Err
+		}
+	}
+	if !watched {
+		// IN_IGNORED will be sent when the watch is removed, so we keep the entry in symlinkTargets until then.
+		syscall.InotifyRmWatch(w.fd, uint32(event.Wd))
+	}
+	return nil
+}
+
+func isWatched(t *fileTailer, event inotifyEvent) bool {
+	for _, dir := range t.watchedDirs {
+		if dir.wd == int(event.Wd) {
+			return true
+		}
+	}
+	return false
+}
+
 func findDir(t *fileTailer, event inotifyEvent) (*Dir, Error) {
 	for _, dir := range t.watchedDirs {
 		if dir.wd == int(event.Wd) {
@@ -132,33 +208,43 @@ func (w *watcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldL
 	if !ok {
 		return NewErrorf(NotSpecified, nil, "received a file system event of unknown type %T", event)
 	}
+	if event.Mask&syscall.IN_Q_OVERFLOW == syscall.IN_Q_OVERFLOW {
+		return w.recoverFromOverflow(t, log)
+	}
+	if paths, ok := w.symlinkTargets[int(event.Wd)]; ok {
+		return w.processSymlinkTargetEvent(t, event, paths, log)
+	}
+	if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED && !isWatched(t, event) {
+		log.Debugf("received event for a directory that is no longer watched: %v", event)
+		return nil // subdirectory that was un-watched by unwatchRemovedDir()
+	}
 	dir, Err := findDir(t, event)
 	if Err != nil {
 		return Err
 	}
 	dirLogger := log.WithField("directory", dir.path)
 	dirLogger.Debugf("received event: %v", event)
+	if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED && !t.isBaseDir(dir.path) {
+		t.unwatchRemovedDir(dir.path, dirLogger) // subdirectory for a recursive glob was removed
+		return nil
+	}
+	if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED && t.followPath {
+		t.waitForRemovedDir(dir, dirLogger) // the directory may be back already, like after a remount
+		return t.watchMissingDirs(log)
+	}
 	if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED {
 		unwatchDirByEvent(t, event) // need to remove it from watchedDirs, because otherwise we close the removed dir on shutdown which causes an error
 		return NewErrorf(NotSpecified, nil, "%s: directory was removed while being watched", dir.path)
 	}
 	if event.Mask&syscall.IN_MODIFY == syscall.IN_MODIFY {
 		file, ok := t.watchedFiles[filepath.Join(dir.path, event.Name)]
+		if !ok && t.idleFiles[filepath.Join(dir.path, event.Name)] != nil {
+			return t.syncFilesInDir(dir, fromBeginning, dirLogger) // opens the idle file again
+		}
 		if !ok {
 			return nil // unrelated file was modified
 		}
-		truncated, err := isTruncated(file.file)
-		if err != nil {
-			return NewErrorf(NotSpecified, err, "%v: seek() or stat() failed", file.file.Name())
-		}
-		if truncated {
-			_, err = file.file.Seek(0, io.SeekStart)
-			if err != nil {
-				return NewErrorf(NotSpecified, err, "%v: seek() failed", file.file.Name())
-			}
-			file.reader.Clear()
-		}
-		readErr := t.readNewLines(file, dirLogger)
+		readErr := readModifiedFile(t, file, dirLogger)
 		if readErr != nil {
 			return readErr
 		}
@@ -171,7 +257,7 @@ func (w *watcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldL
 		// Trying to figure out what happened from the events would be error prone.
 		// Therefore, we don't care which of the above events we received, we just update our watched files with the current
 		// state of the watched directory.
-		err := t.syncFilesInDir(dir, true, dirLogger)
+		err := t.syncFilesInDir(dir, fromBeginning, dirLogger)
 		if err != nil {
 			return err
 		}
@@ -179,6 +265,63 @@ func (w *watcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldL
 	return nil
 }
 
+// recoverFromOverflow is called when the kernel's inotify event queue overflowed, so some events were lost.
+// We don't know what happened in the meantime: The directories are watched again, because they might have been removed and re-created,
+// the files in the directories are synced, and all watched files are read.
+func (w *watcher) recoverFromOverflow(t *fileTailer, log logrus.FieldLogger) Error {
+	log.Warn("inotify event queue overflow, some file system events were lost: re-reading all watched directories and files")
+	countWatchOverflow()
+	dirs := make([]*Dir, len(t.watchedDirs))
+	copy(dirs, t.watchedDirs) // unwatchRemovedDir() modifies t.watchedDirs
+	for _, dir := range dirs {
+		dirLogger := log.WithField("directory", dir.path)
+		if !t.isWatchedDir(dir.path) {
+			continue // removed with its parent directory
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dir.path, watchDirMask)
+		if err != nil && !t.isBaseDir(dir.path) {
+			t.unwatchRemovedDir(dir.path, dirLogger) // subdirectory for a recursive glob was removed
+			continue
+		}
+		if err != nil {
+			unwatchDirByWd(t, dir.wd)
+			return NewErrorf(NotSpecified, err, "%s: failed to watch directory again after inotify event queue overflow", dir.path)
+		}
+		// If the directory was re-created, the old watch descriptor is ignored when its IN_IGNORED event arrives, see isWatched().
+		dir.wd = wd
+		Err := t.syncFilesInDir(dir, fromBeginning, dirLogger)
+		if Err != nil {
+			return Err
+		}
+	}
+	for path, file := range t.watchedFiles {
+		fileLogger := log.WithField("file", path)
+		Err := w.watchFile(file.file) // symlink targets might have changed
+		if Err != nil {
+			return Err
+		}
+		Err = readModifiedFile(t, file, fileLogger)
+		if Err != nil {
+			return Err
+		}
+	}
+	return nil
+}
+
+func readModifiedFile(t *fileTailer, file *fileWithReader, log logrus.FieldLogger) Error {
+	truncated, err := isTruncated(file.file)
+	if err != nil {
+		return NewErrorf(NotSpecified, err, "%v: seek() or stat() failed", file.file.Name())
+	}
+	if truncated {
+		Err := t.restartTruncatedFile(file, log)
+		if Err != nil {
+			return Err
+		}
+	}
+	return t.readNewLines(file, log)
+}
+
 func isTruncated(file *os.File) (bool, error) {
 	currentPos, err := file.Seek(0, io.SeekCurrent)
 	if err != nil {
@@ -191,6 +334,11 @@ func isTruncated(file *os.File) (bool, error) {
 	return currentPos > fileInfo.Size(), nil
 }
 
+// followRotatedFile is a no-op, because the file descriptor can still be read after the file was moved or removed.
+func followRotatedFile(_ *Dir, _ *fileWithReader) (bool, Error) {
+	return true, nil
+}
+
 func findSameFile(t *fileTailer, file os.FileInfo, _ string) (*fileWithReader, Error) {
 	var (
 		fileInfo os.FileInfo
@@ -199,7 +347,7 @@ func findSameFile(t *fileTailer, file os.FileInfo, _ string) (*fileWithReader, E
 	for _, watchedFile := range t.watchedFiles {
 		fileInfo, err = watchedFile.file.Stat()
 		if err != nil {
-			return nil, NewErrorf(NotSpecified, err, "%v: stat failed", watchedFile.file.Name())
+			continue // like a stale file handle after an unmount, so it's not the same file
 		}
 		if os.SameFile(fileInfo, file) {
 			return watchedFile, nil
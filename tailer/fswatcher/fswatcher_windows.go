@@ -15,23 +15,23 @@
 package fswatcher
 
 import (
-	"fmt"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/exp/winfsnotify"
-	"io"
-	"os"
 	"path/filepath"
-	"strings"
 	"syscall"
+	"time"
 )
 
 type watcher struct {
-	winWatcher *winfsnotify.Watcher
+	events chan fsevent
+	errors chan Error
+	done   chan struct{} // closed when the fsevent producer loop is closed
 }
 
 type fileWithReader struct {
-	file   *File
-	reader *lineReader
+	file     *File
+	reader   *lineReader
+	lastRead time.Time // for closing idle files
+	unsent   int64     // length of the last line read if it was not sent because the tailer was closed
 }
 
 type fileInfo struct {
@@ -43,48 +43,47 @@ func (f *fileInfo) Name() string {
 	return f.filename
 }
 
+func (f *fileInfo) Size() int64 {
+	return int64(f.ffd.FileSizeHigh)<<32 | int64(f.ffd.FileSizeLow)
+}
+
 func (f *fileInfo) IsDir() bool {
 	return f.ffd.FileAttributes&syscall.FILE_ATTRIBUTE_DIRECTORY == syscall.FILE_ATTRIBUTE_DIRECTORY
 }
 
 func (w *watcher) unwatchDir(dir *Dir) error {
-	return nil
+	return dir.watch.stop()
 }
 
 func (w *watcher) Close() error {
-	err := w.winWatcher.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close winfsnotify.Watcher: %v", err)
-	} else {
-		return nil
-	}
+	// nothing to do, the directory handles are closed in unwatchDir()
+	return nil
 }
 
 func (w *watcher) runFseventProducerLoop() fseventProducerLoop {
-	return runWinWatcherLoop(w.winWatcher)
+	return &winwatcherloop{
+		events: w.events,
+		errors: w.errors,
+		done:   w.done,
+	}
 }
 
 func initWatcher() (fswatcher, Error) {
-	winWatcher, err := winfsnotify.NewWatcher()
-	if err != nil {
-		return nil, NewError(NotSpecified, err, "failed to initialize file system watcher")
-	}
-	return &watcher{winWatcher: winWatcher}, nil
+	return &watcher{
+		events: make(chan fsevent),
+		errors: make(chan Error),
+		done:   make(chan struct{}),
+	}, nil
 }
 
 func (w *watcher) watchDir(path string) (*Dir, Error) {
-	var (
-		dir *Dir
-		err error
-		Err Error
-	)
-	dir, Err = newDir(path)
+	dir, Err := newDir(path)
 	if Err != nil {
 		return nil, Err
 	}
-	err = w.winWatcher.Watch(path)
-	if err != nil {
-		return nil, NewErrorf(NotSpecified, err, "%v: failed to watch directory", path)
+	dir.watch, Err = watchDirectoryChanges(path, w.events, w.errors, w.done)
+	if Err != nil {
+		return nil, Err
 	}
 	return dir, nil
 }
@@ -99,61 +98,137 @@ func (w *watcher) watchFile(_ fileMeta) Error {
 }
 
 func (w *watcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldLogger) Error {
-	event, ok := fsevent.(*winfsnotify.Event)
+	event, ok := fsevent.(*winEvent)
 	if !ok {
 		return NewErrorf(NotSpecified, nil, "received a file system event of unknown type %T", event)
 	}
-
-	dir, fileName := dirAndFile(t, event.Name)
+	dir := findDir(t, event.dir)
 	if dir == nil {
-		return NewError(NotSpecified, nil, "watch list inconsistent: received a file system event for an unknown directory")
+		log.Debugf("received event for a directory that is no longer watched: %v", event)
+		return nil // subdirectory that was un-watched by unwatchRemovedDir()
 	}
-	log.WithField("directory", dir.path).Debugf("received event: %v", event)
-	if event.Mask&winfsnotify.FS_MODIFY == winfsnotify.FS_MODIFY {
-		file, ok := t.watchedFiles[filepath.Join(dir.path, fileName)]
-		if !ok {
-			return nil // unrelated file was modified
+	dirLogger := log.WithField("directory", dir.path)
+	dirLogger.Debugf("received event: %v", event)
+	switch event.action {
+	case actionDirRemoved:
+		if !t.isBaseDir(dir.path) {
+			t.unwatchRemovedDir(dir.path, dirLogger) // subdirectory for a recursive glob was removed
+			return nil
+		}
+		if t.followPath {
+			t.waitForRemovedDir(dir, dirLogger) // the directory may be back already, like after a remount
+			return t.watchMissingDirs(log)
 		}
-		truncated, Err := file.file.CheckTruncated()
+		unwatchRemovedBaseDir(t, dir, dirLogger) // need to remove it from watchedDirs, because otherwise we close the removed dir on shutdown
+		return NewErrorf(NotSpecified, nil, "%s: directory was removed while being watched", dir.path)
+	case actionOverflow:
+		// Changes were lost, so we update our watched files with the current state of the directory and read all of them.
+		dirLogger.Warn("overflow of the directory change buffer, some file system events were lost")
+		countWatchOverflow()
+		Err := t.syncFilesInDir(dir, fromBeginning, dirLogger)
 		if Err != nil {
-			if Err.Type() == WinFileRemoved {
-				return t.syncFilesInDir(dir, true, log)
-			} else {
-				return Err
-			}
+			return Err
 		}
-		if truncated {
-			_, err := file.file.Seek(0, io.SeekStart)
-			if err != nil {
-				return NewError(NotSpecified, os.NewSyscallError("seek", err), file.file.Name())
+		for path, file := range t.watchedFiles {
+			if filepath.Dir(path) == dir.path {
+				Err = readModifiedFile(t, dir, file, dirLogger)
+				if Err != nil {
+					return Err
+				}
 			}
-			file.reader.Clear()
 		}
-		Err = t.readNewLines(file, log)
-		if Err != nil {
-			return Err
+	case syscall.FILE_ACTION_MODIFIED:
+		file, ok := t.watchedFiles[filepath.Join(dir.path, event.name)]
+		if !ok && t.idleFiles[filepath.Join(dir.path, event.name)] != nil {
+			return t.syncFilesInDir(dir, fromBeginning, dirLogger) // opens the idle file again
 		}
-	}
-	if event.Mask&winfsnotify.FS_MOVED_FROM == winfsnotify.FS_MOVED_FROM || event.Mask&winfsnotify.FS_DELETE == winfsnotify.FS_DELETE || event.Mask&winfsnotify.FS_CREATE == winfsnotify.FS_CREATE || event.Mask&winfsnotify.FS_MOVED_TO == winfsnotify.FS_MOVED_TO {
+		if !ok {
+			return nil // unrelated file was modified
+		}
+		return readModifiedFile(t, dir, file, dirLogger)
+	case syscall.FILE_ACTION_ADDED, syscall.FILE_ACTION_REMOVED, syscall.FILE_ACTION_RENAMED_OLD_NAME, syscall.FILE_ACTION_RENAMED_NEW_NAME:
 		// There are a lot of corner cases here:
-		// * a file is renamed, but still matches the pattern so we continue watching it (MOVED_FROM followed by MOVED_TO)
+		// * a file is renamed, but still matches the pattern so we continue watching it (RENAMED_OLD_NAME followed by RENAMED_NEW_NAME)
 		// * a file is created overwriting an existing file
 		// * a file is moved to the watched directory overwriting an existing file
 		// Trying to figure out what happened from the events would be error prone.
 		// Therefore, we don't care which of the above events we received, we just update our watched files with the current
-		// state of the watched directory.
-		err := t.syncFilesInDir(dir, true, log)
-		if err != nil {
-			return err
-		}
+		// state of the watched directory. Renamed files are found by their file index, see followRotatedFile().
+		return t.syncFilesInDir(dir, fromBeginning, dirLogger)
 	}
 	return nil
 }
 
+// readModifiedFile reads the new lines of a watched file.
+// If the file was renamed or removed since we last read it, the directory is synced to find out what happened.
+func readModifiedFile(t *fileTailer, dir *Dir, file *fileWithReader, log logrus.FieldLogger) Error {
+	truncated, Err := file.file.CheckTruncated()
+	if Err != nil {
+		if Err.Type() == WinFileRemoved {
+			return t.syncFilesInDir(dir, fromBeginning, log)
+		} else {
+			return Err
+		}
+	}
+	if truncated {
+		Err = t.restartTruncatedFile(file, log)
+		if Err != nil {
+			return Err
+		}
+	}
+	Err = t.readNewLines(file, log)
+	if Err != nil {
+		if cause, ok := Err.Cause().(Error); ok && cause.Type() == WinFileRemoved {
+			// The file was renamed or removed after CheckTruncated(), while we were reading it.
+			return t.syncFilesInDir(dir, fromBeginning, log)
+		}
+	}
+	return Err
+}
+
 func isTruncated(file *File) (bool, Error) {
 	return file.CheckTruncated()
 }
 
+// followRotatedFile finds a watched file that might have been renamed by logrotate.
+// Files are closed after each read on Windows, so the file must be found by its file index.
+// The return value is false if the file was removed.
+func followRotatedFile(dir *Dir, file *fileWithReader) (bool, Error) {
+	current, Err := open(file.file.Name())
+	if Err == nil && current.SameFile(file.file) {
+		return true, nil
+	}
+	if Err != nil && Err.Type() != FileNotFound {
+		return false, Err
+	}
+	fileInfos, Err := dir.ls()
+	if Err != nil {
+		return false, Err
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir.Path(), fileInfo.Name())
+		candidate, Err := open(path)
+		if Err != nil {
+			if Err.Type() == FileNotFound {
+				continue
+			}
+			return false, Err
+		}
+		if candidate.SameFile(file.file) {
+			renamedFile, err := NewFile(file.file, path)
+			if err != nil {
+				return false, NewErrorf(NotSpecified, err, "%v: failed to follow moved file", path)
+			}
+			file.file = renamedFile
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func findSameFile(t *fileTailer, newFileInfo *fileInfo, path string) (*fileWithReader, Error) {
 	newFile, Err := open(path)
 	if Err != nil {
@@ -172,16 +247,25 @@ func findSameFile(t *fileTailer, newFileInfo *fileInfo, path string) (*fileWithR
 	return nil, nil
 }
 
-func dirAndFile(t *fileTailer, fileOrDir string) (*Dir, string) {
-	var (
-		found *Dir
-	)
+func findDir(t *fileTailer, path string) *Dir {
 	for _, dir := range t.watchedDirs {
-		if strings.HasPrefix(fileOrDir, dir.path) {
-			if found == nil || len(dir.path) > len(found.path) {
-				found = dir
-			}
+		if dir.path == path {
+			return dir
+		}
+	}
+	return nil
+}
+
+func unwatchRemovedBaseDir(t *fileTailer, dir *Dir, log logrus.FieldLogger) {
+	err := t.osSpecific.unwatchDir(dir)
+	if err != nil {
+		log.Debugf("%v", err)
+	}
+	watchedDirsAfter := make([]*Dir, 0, len(t.watchedDirs)-1)
+	for _, existing := range t.watchedDirs {
+		if existing != dir {
+			watchedDirsAfter = append(watchedDirsAfter, existing)
 		}
 	}
-	return found, strings.TrimLeft(fileOrDir[len(found.path):], "\\/")
+	t.watchedDirs = watchedDirsAfter
 }
@@ -0,0 +1,187 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// idleFile is a watched file that was closed because no lines were written for the idle timeout.
+// It is opened again when the file size changes. The lineReader is kept, because it may contain the beginning of a line.
+type idleFile struct {
+	inode       uint64
+	device      uint64
+	offset      int64  // position of the file descriptor when the file was closed
+	fingerprint uint32 // checksum of the beginning of the file, see fingerprint()
+	reader      *lineReader
+}
+
+// Number of bytes at the beginning of an idle file that are compared when the file is opened again.
+// The inode number alone does not identify the file: If the file is removed and a new file is created,
+// like by logrotate with the copy option, the new file often gets the inode number of the removed file.
+const fingerprintSize = 1024
+
+// idleCheckInterval is how often we look for idle files, and for changes of the idle files.
+func idleCheckInterval(idleTimeout time.Duration) time.Duration {
+	if idleTimeout/2 < time.Second {
+		return idleTimeout / 2
+	}
+	return time.Second
+}
+
+// closeIdleFiles closes the watched files that were not written to for the idle timeout.
+func (t *fileTailer) closeIdleFiles(log logrus.FieldLogger) {
+	now := time.Now()
+	for path, file := range t.watchedFiles {
+		if now.Sub(file.lastRead) < t.idleTimeout {
+			continue
+		}
+		fileLogger := log.WithField("file", path).WithField("fd", file.file.Fd())
+		ino, err := inode(file.file)
+		if err != nil {
+			fileLogger.Warnf("failed to get inode, keeping the idle file open: %v", err)
+			continue
+		}
+		dev, err := device(file.file)
+		if err != nil {
+			fileLogger.Warnf("failed to get device, keeping the idle file open: %v", err)
+			continue
+		}
+		offset, seekErr := file.file.Seek(0, io.SeekCurrent)
+		if seekErr != nil {
+			fileLogger.Warnf("failed to get position, keeping the idle file open: %v", seekErr)
+			continue
+		}
+		fp, err := fingerprint(file, offset)
+		if err != nil {
+			fileLogger.Warnf("failed to read the beginning of the file, keeping the idle file open: %v", err)
+			continue
+		}
+		fileLogger.Infof("closing file, because it was idle for %v", t.idleTimeout)
+		file.file.Close()
+		delete(t.watchedFiles, path)
+		t.idleFiles[path] = &idleFile{inode: ino, device: dev, offset: offset, fingerprint: fp, reader: file.reader}
+	}
+}
+
+// syncChangedIdleFiles syncs the directories with idle files that were written to, truncated, or removed.
+// Syncing the directory opens the changed idle files again, see resumeIdleFile().
+func (t *fileTailer) syncChangedIdleFiles(log logrus.FieldLogger) Error {
+	for _, dir := range t.watchedDirs {
+		changed := false
+		for path, idle := range t.idleFiles {
+			if filepath.Dir(path) != dir.Path() {
+				continue
+			}
+			fileInfo, err := os.Stat(path)
+			if err != nil || fileInfo.Size() != idle.offset {
+				changed = true
+				break
+			}
+		}
+		if changed {
+			Err := t.syncFilesInDir(dir, fromBeginning, log.WithField("directory", dir.Path()))
+			if Err != nil {
+				return Err
+			}
+		}
+	}
+	return nil
+}
+
+// isUnchangedIdleFile is true if path is an idle file and its size did not change since it was closed.
+func (t *fileTailer) isUnchangedIdleFile(path string, size int64) bool {
+	idle, ok := t.idleFiles[path]
+	return ok && idle.offset == size
+}
+
+// resumeIdleFile continues reading an idle file that was opened again, where it was closed.
+// If the file was truncated or replaced while it was closed, it is read from the beginning.
+func resumeIdleFile(file *fileWithReader, idle *idleFile, log logrus.FieldLogger) Error {
+	file.reader = idle.reader
+	fileInfo, err := os.Stat(file.file.Name())
+	if err != nil {
+		return NewErrorf(NotSpecified, err, "%v: stat failed", file.file.Name())
+	}
+	if fileInfo.Size() < idle.offset {
+		log.Info("idle file was truncated, reading from the beginning")
+		countTruncatedFile()
+		file.reader.SetPosition(0)
+		return nil
+	}
+	fp, err := fingerprint(file, idle.offset)
+	if err != nil {
+		return NewErrorf(NotSpecified, err, "%v: read() failed", file.file.Name())
+	}
+	if fp != idle.fingerprint {
+		log.Info("idle file was replaced by a new file with the same inode number, reading from the beginning")
+		file.reader.SetPosition(0)
+		_, seekErr := file.file.Seek(0, io.SeekStart)
+		if seekErr != nil {
+			return NewErrorf(NotSpecified, seekErr, "%v: seek() failed", file.file.Name())
+		}
+		return nil
+	}
+	_, seekErr := file.file.Seek(idle.offset, io.SeekStart)
+	if seekErr != nil {
+		return NewErrorf(NotSpecified, seekErr, "%v: seek() failed", file.file.Name())
+	}
+	return nil
+}
+
+// takeIdleFile finds the idle file for a newly opened file and removes it from the idle files.
+// The idle file may have been renamed while it was closed, so it is found by its inode and device.
+func (t *fileTailer) takeIdleFile(dir *Dir, ino uint64, dev uint64) *idleFile {
+	for path, idle := range t.idleFiles {
+		if filepath.Dir(path) == dir.Path() && idle.inode == ino && idle.device == dev {
+			delete(t.idleFiles, path)
+			return idle
+		}
+	}
+	return nil
+}
+
+// removeIdleFiles forgets the idle files in dir that were not found when the directory was synced.
+func (t *fileTailer) removeIdleFiles(dir *Dir, found map[string]bool, log logrus.FieldLogger) {
+	for path := range t.idleFiles {
+		if filepath.Dir(path) == dir.Path() && !found[path] {
+			log.WithField("file", filepath.Base(path)).Info("idle file was removed")
+			delete(t.idleFiles, path)
+		}
+	}
+}
+
+// fingerprint returns the checksum of the first min(offset, fingerprintSize) bytes of the file.
+// The file's position is changed.
+func fingerprint(file *fileWithReader, offset int64) (uint32, error) {
+	if offset > fingerprintSize {
+		offset = fingerprintSize
+	}
+	_, seekErr := file.file.Seek(0, io.SeekStart)
+	if seekErr != nil {
+		return 0, seekErr
+	}
+	buf := make([]byte, offset)
+	_, err := io.ReadFull(file.file, buf)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(buf), nil
+}
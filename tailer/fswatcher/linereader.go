@@ -15,24 +15,79 @@
 package fswatcher
 
 import (
-	"bytes"
+	"golang.org/x/text/encoding"
 	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+// LineFormat defines how the bytes read from a log file are split into lines.
+// The zero value means UTF-8 lines separated by '\n' without a length limit.
+type LineFormat struct {
+	delimiter      *Delimiter        // nil means '\n'. The delimiter is encoded in the charset.
+	charset        encoding.Encoding // nil means the lines are not decoded
+	maxLineLength  int               // in bytes before decoding, 0 means no limit
+	splitLongLines bool              // if false, the rest of a long line is discarded
+}
+
+// NewLineFormat creates a format for lines that are separated by delimiter and encoded in charset.
+// If delimiter is nil, lines are separated by '\n'. If charset is nil, lines are expected to be UTF-8.
+// Otherwise, the lines are converted from charset to UTF-8.
+// Lines longer than maxLineLength bytes are truncated, or split into multiple lines if splitLongLines is true.
+// This limits the memory used for files with very long lines, like binary files. 0 means no limit.
+func NewLineFormat(delimiter *Delimiter, charset encoding.Encoding, maxLineLength int, splitLongLines bool) (LineFormat, error) {
+	var err error
+	if delimiter == nil {
+		delimiter = newline
+	}
+	if charset != nil {
+		delimiter, err = delimiter.encode(charset)
+		if err != nil {
+			return LineFormat{}, err
+		}
+	}
+	return LineFormat{
+		delimiter:      delimiter,
+		charset:        charset,
+		maxLineLength:  maxLineLength,
+		splitLongLines: splitLongLines,
+	}, nil
+}
+
 type lineReader struct {
+	delimiter                  *Delimiter
+	decoder                    *encoding.Decoder // nil if the lines are not decoded
+	maxLineLength              int
+	splitLongLines             bool
+	discarding                 bool      // true while skipping the rest of a truncated line
+	truncated                  bool      // true if the last line returned was truncated or split
+	position                   int64     // position of remainingBytesFromLastRead[0] in the file, see SetPosition()
+	lastLineLength             int64     // number of bytes of the last line returned, including the delimiter
+	incompleteSince            time.Time // when the end of the file was reached in the middle of a line, zero if the last line was complete
 	remainingBytesFromLastRead []byte
 }
 
-func NewLineReader() *lineReader {
-	return &lineReader{
+func NewLineReader(format LineFormat) *lineReader {
+	result := &lineReader{
+		delimiter:                  format.delimiter,
+		maxLineLength:              format.maxLineLength,
+		splitLongLines:             format.splitLongLines,
 		remainingBytesFromLastRead: []byte{},
 	}
+	if result.delimiter == nil {
+		result.delimiter = newline
+	}
+	if format.charset != nil {
+		result.decoder = format.charset.NewDecoder()
+	}
+	return result
 }
 
 // read the next line from the file.
 // return values are (line, eof, err).
 // * line is the line read.
-// * eof is a boolean indicating if the end of file was reached before getting to the next '\n'.
+// * eof is a boolean indicating if the end of file was reached before getting to the next delimiter.
 // * err is set if an error other than io.EOF has occurred. err is never io.EOF.
 // if eof is true, line is always "" and err always is nil.
 // if eof is false and err is nil, an empty line means that there actually was an empty line in the file.
@@ -41,18 +96,43 @@ func (r *lineReader) ReadLine(file io.Reader) (string, bool, error) {
 		err error
 		buf = make([]byte, 512)
 		n   = 0
+		// the rest of a truncated line is not part of the line returned, so this is reset when discarding ends
+		start = r.position
 	)
 	for {
-		newlinePos := bytes.IndexByte(r.remainingBytesFromLastRead, '\n')
-		if newlinePos >= 0 {
-			l := len(r.remainingBytesFromLastRead)
-			result := make([]byte, newlinePos)
-			copy(result, r.remainingBytesFromLastRead[:newlinePos])
-			copy(r.remainingBytesFromLastRead, r.remainingBytesFromLastRead[newlinePos+1:])
-			r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:l-(newlinePos+1)]
-			return string(stripWindowsLineEnding(result)), false, nil
-		} else if err != nil {
+		delimiterStart, delimiterEnd := r.delimiter.find(r.remainingBytesFromLastRead)
+		if r.discarding && delimiterStart >= 0 {
+			r.discarding = false
+			r.consume(delimiterEnd)
+			start = r.position
+			continue
+		} else if r.discarding {
+			// Keep the last bytes, they might be the beginning of the delimiter.
+			if keep := r.maxLineLength; len(r.remainingBytesFromLastRead) > keep {
+				r.consume(len(r.remainingBytesFromLastRead) - keep)
+			}
+		} else if r.maxLineLength > 0 && (delimiterStart > r.maxLineLength || (delimiterStart < 0 && len(r.remainingBytesFromLastRead) > r.maxLineLength)) {
+			length := r.truncatedLength()
+			result := r.decode(r.remainingBytesFromLastRead[:length])
+			r.consume(length)
+			r.discarding = !r.splitLongLines
+			r.truncated = true
+			r.lastLineLength = r.position - start
+			r.incompleteSince = time.Time{}
+			return result, false, nil
+		} else if delimiterStart >= 0 {
+			result := r.decode(r.remainingBytesFromLastRead[:delimiterStart])
+			r.consume(delimiterEnd)
+			r.truncated = false
+			r.lastLineLength = r.position - start
+			r.incompleteSince = time.Time{}
+			return result, false, nil
+		}
+		if err != nil {
 			if err == io.EOF {
+				if len(r.remainingBytesFromLastRead) > 0 && !r.discarding && r.incompleteSince.IsZero() {
+					r.incompleteSince = time.Now()
+				}
 				return "", true, nil
 			} else {
 				return "", false, err
@@ -67,14 +147,109 @@ func (r *lineReader) ReadLine(file io.Reader) (string, bool, error) {
 	}
 }
 
-func stripWindowsLineEnding(s []byte) []byte {
-	if len(s) > 0 && s[len(s)-1] == '\r' {
-		return s[:len(s)-1]
-	} else {
-		return s
+// Truncated returns true if the last line returned by ReadLine() was longer than the maximum line length.
+func (r *lineReader) Truncated() bool {
+	return r.truncated
+}
+
+// truncatedLength returns the maximum line length, reduced so that truncating doesn't split a character.
+// For charsets other than UTF-8, only split code units (like half of a UTF-16 code unit) are prevented.
+func (r *lineReader) truncatedLength() int {
+	length := r.maxLineLength - r.maxLineLength%r.delimiter.align
+	if r.decoder == nil {
+		for length > 0 && !utf8.RuneStart(r.remainingBytesFromLastRead[length]) {
+			length--
+		}
+	}
+	if length == 0 {
+		return r.maxLineLength
+	}
+	return length
+}
+
+func (r *lineReader) consume(n int) {
+	l := len(r.remainingBytesFromLastRead)
+	copy(r.remainingBytesFromLastRead, r.remainingBytesFromLastRead[n:])
+	r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:l-n]
+	r.position += int64(n)
+}
+
+func (r *lineReader) decode(line []byte) string {
+	if r.decoder == nil {
+		return r.delimiter.stripLine(string(line))
+	}
+	decoded, err := r.decoder.Bytes(line)
+	if err != nil {
+		// don't stop tailing because of a single broken line
+		return r.delimiter.stripLine(strings.ToValidUTF8(string(line), "\uFFFD"))
+	}
+	// Files in UTF-16 usually start with a byte order mark.
+	return r.delimiter.stripLine(strings.TrimPrefix(string(decoded), "\uFEFF"))
+}
+
+// LastLineLength returns the number of bytes in the file of the last line returned by ReadLine(), including the delimiter.
+func (r *lineReader) LastLineLength() int64 {
+	return r.lastLineLength
+}
+
+// LastLineOffset returns the position in the file of the first byte of the last line returned by ReadLine().
+func (r *lineReader) LastLineOffset() int64 {
+	return r.position - r.lastLineLength
+}
+
+// Position returns the position in the file of the first byte that was not yet returned as a line.
+func (r *lineReader) Position() int64 {
+	return r.position
+}
+
+// SetPosition clears the bytes that were not yet returned as a line, because the file was positioned at pos.
+// The reader doesn't know where it starts reading, so this must be called whenever the file is positioned
+// somewhere else than at the beginning. Otherwise LastLineOffset() is relative to where the reader started.
+func (r *lineReader) SetPosition(pos int64) {
+	r.Clear()
+	r.position = pos
+}
+
+// Buffered returns the number of bytes that were read from the file but not yet returned as a line.
+func (r *lineReader) Buffered() int {
+	return len(r.remainingBytesFromLastRead)
+}
+
+// Remaining returns the bytes that were read from the file but not yet returned as a line, and clears them.
+// This is used to get the last line of a file that is not terminated with a delimiter.
+func (r *lineReader) Remaining() string {
+	if r.discarding {
+		r.Clear() // the rest of a truncated line
+		return ""
+	}
+	result := r.decode(r.remainingBytesFromLastRead)
+	r.Clear()
+	return result
+}
+
+// IncompleteSince returns when ReadLine() reached the end of the file in the middle of a line,
+// i.e. since when the beginning of the line has been waiting for the delimiter. The zero time means there is no incomplete line.
+func (r *lineReader) IncompleteSince() time.Time {
+	return r.incompleteSince
+}
+
+// Flush returns the incomplete line as if it was terminated with the delimiter, and continues after it like ReadLine().
+// This is used if the writer of a log file did not complete the last line in time. ok is false if there is no incomplete line.
+func (r *lineReader) Flush() (line string, ok bool) {
+	if r.discarding || len(r.remainingBytesFromLastRead) == 0 {
+		return "", false
 	}
+	start := r.position
+	line = r.decode(r.remainingBytesFromLastRead)
+	r.consume(len(r.remainingBytesFromLastRead))
+	r.truncated = false
+	r.lastLineLength = r.position - start
+	r.incompleteSince = time.Time{}
+	return line, true
 }
 
 func (r *lineReader) Clear() {
 	r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:0]
+	r.discarding = false
+	r.incompleteSince = time.Time{}
 }
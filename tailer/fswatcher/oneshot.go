@@ -0,0 +1,187 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"github.com/fstab/grok_exporter/tailer/glob"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RunOneshotFileTailer reads the log files matching the globs once, and closes the lines channel when all files were read to the end.
+// This is for batch processing of historical logs, the files are not watched for changes.
+// The files are read one after the other in lexical order. The start position applies to each file,
+// except that End is treated like Beginning, because there would be nothing to read.
+// If the start position is Beginning and readCompressedBackups is true, the gzip compressed backups of each file are read before the file itself.
+// The backups are searched in the file's directory, and in olddir if it is not empty (relative to the file's directory, like logrotate's olddir).
+func RunOneshotFileTailer(globs []glob.Glob, exclude []string, start StartPosition, readCompressedBackups bool, olddir string, failOnMissingFile bool, format LineFormat, log logrus.FieldLogger) (FileTailer, error) {
+	dirPaths, missingDirs, Err := uniqueDirs(globs)
+	if Err != nil {
+		return nil, Err
+	}
+	if len(missingDirs) > 0 {
+		if failOnMissingFile {
+			return nil, NewErrorf(DirectoryNotFound, nil, "%q: no such directory", missingDirs[0])
+		}
+		for _, dirPath := range missingDirs {
+			log.Warnf("directory %v does not exist, skipping", dirPath)
+		}
+	}
+	if start.Type == End {
+		start = fromBeginning
+	}
+	t := &fileTailer{
+		globs:   globs,
+		exclude: exclude,
+		olddir:  olddir,
+		format:  format,
+		lines:   make(chan *Line),
+		errors:  make(chan Error),
+		done:    make(chan struct{}),
+	}
+	paths, Err := t.findFiles(dirPaths)
+	if Err != nil {
+		return nil, Err
+	}
+	go func() {
+		defer close(t.lines)
+		for _, path := range paths {
+			select {
+			case <-t.done:
+				return
+			default:
+			}
+			var readErr Error
+			fileLogger := log.WithField("file", path)
+			if start.Type == Beginning && readCompressedBackups {
+				readErr = t.readCompressedBackupsOf(path, fileLogger)
+			}
+			if readErr == nil {
+				readErr = t.readFileToEOF(path, start, fileLogger)
+			}
+			if readErr != nil {
+				select {
+				case t.errors <- readErr:
+				case <-t.done:
+				}
+				return
+			}
+		}
+	}()
+	return t, nil
+}
+
+// findFiles returns the sorted paths of the files in the directories and their subdirectories that match the globs.
+func (t *fileTailer) findFiles(dirPaths []string) ([]string, Error) {
+	var result []string
+	for _, dirPath := range dirPaths {
+		err := filepath.Walk(dirPath, func(path string, fileInfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fileInfo.IsDir() {
+				if path != dirPath && !anyGlobIncludesSubdir(t.globs, path) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !t.isIncluded(path) || containsString(result, path) {
+				return nil
+			}
+			if fileInfo.Mode()&os.ModeSymlink != 0 {
+				target, err := os.Stat(path)
+				if err != nil || target.IsDir() {
+					return nil // broken symlink or symlink to a directory
+				}
+			}
+			result = append(result, path)
+			return nil
+		})
+		if err != nil {
+			return nil, NewErrorf(NotSpecified, err, "%v: failed to read directory", dirPath)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (t *fileTailer) readCompressedBackupsOf(path string, log logrus.FieldLogger) Error {
+	backups, Err := t.findCompressedBackups(path)
+	if Err != nil {
+		return Err
+	}
+	for _, backupPath := range backups {
+		log.WithField("backup", backupPath).Info("reading compressed backup")
+		Err = t.readCompressedFile(backupPath, path, log)
+		if Err != nil {
+			return Err
+		}
+	}
+	return nil
+}
+
+// readFileToEOF sends the lines of the file from the start position to the end.
+// The last line is sent even if it is not terminated with a delimiter.
+func (t *fileTailer) readFileToEOF(path string, start StartPosition, log logrus.FieldLogger) Error {
+	offset, whence, Err := start.offset(path, t.format)
+	if Err != nil {
+		return Err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return NewError(NotSpecified, os.NewSyscallError("open", err), path)
+	}
+	defer file.Close()
+	pos, err := file.Seek(offset, whence)
+	if err != nil {
+		return NewError(NotSpecified, os.NewSyscallError("seek", err), path)
+	}
+	log.Info("reading file")
+	return t.readToEOF(file, path, path, pos)
+}
+
+// readToEOF sends the lines from the current position of file to the end, reported with the path of logfile.
+// pos is the current position of file, the offsets of the lines are relative to the beginning of file.
+// The last line is sent even if it is not terminated with a delimiter.
+func (t *fileTailer) readToEOF(file io.Reader, path string, logfile string, pos int64) Error {
+	reader := NewLineReader(t.format)
+	reader.SetPosition(pos)
+	for {
+		line, eof, err := reader.ReadLine(file)
+		if err != nil {
+			return NewErrorf(NotSpecified, err, "%v: read() failed", path)
+		}
+		offset := reader.LastLineOffset()
+		if eof {
+			offset = reader.Position()
+			line = reader.Remaining()
+			if len(line) == 0 {
+				return nil
+			}
+		}
+		select {
+		case <-t.done:
+			return nil
+		case t.lines <- &Line{Line: line, File: logfile, Truncated: !eof && reader.Truncated(), ReadTime: time.Now(), Offset: offset}:
+		}
+		if eof {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// Incomplete lines are not processed until the delimiter is written, because the writer may still be writing them,
+// and metrics should not be updated from half a line. If partialLineTimeout is not zero, a line that is not completed
+// within partialLineTimeout is processed anyway, like the last line of a file that is not terminated with a newline.
+
+// partialLineCheckInterval is how often we look for incomplete lines that reached the partial line timeout.
+func partialLineCheckInterval(partialLineTimeout time.Duration) time.Duration {
+	if partialLineTimeout/2 < time.Second {
+		return partialLineTimeout / 2
+	}
+	return time.Second
+}
+
+// flushIncompleteLines processes the incomplete last lines of the watched files that reached the partial line timeout.
+// The files are read first, because the line may have been completed and we did not process the event yet.
+func (t *fileTailer) flushIncompleteLines(log logrus.FieldLogger) Error {
+	now := time.Now()
+	for path, file := range t.watchedFiles {
+		since := file.reader.IncompleteSince()
+		if since.IsZero() || now.Sub(since) < t.partialLineTimeout {
+			continue
+		}
+		fileLogger := log.WithField("file", path)
+		Err := t.readNewLines(file, fileLogger)
+		if Err != nil {
+			if cause, ok := Err.Cause().(Error); ok && cause.Type() == WinFileRemoved {
+				continue // the file was moved or removed, it is read when we process the event for the directory
+			}
+			return Err
+		}
+		if !file.reader.IncompleteSince().Equal(since) {
+			continue // the line was completed
+		}
+		t.flushIncompleteLine(file, fileLogger)
+	}
+	return nil
+}
+
+// flushIncompleteLine sends the incomplete last line of the file, if there is one.
+func (t *fileTailer) flushIncompleteLine(file *fileWithReader, log logrus.FieldLogger) {
+	line, ok := file.reader.Flush()
+	if !ok {
+		return
+	}
+	log.Debugf("line was not completed within %v: %q", t.partialLineTimeout, line)
+	file.lastRead = time.Now()
+	select {
+	case <-t.done:
+		// The line is read again after a restart, because it is not included in the saved position.
+		file.unsent = file.reader.LastLineLength()
+	case t.lines <- &Line{Line: line, File: file.file.Name(), ReadTime: file.lastRead, Offset: file.reader.LastLineOffset()}:
+	}
+}
@@ -16,7 +16,7 @@ package fswatcher
 
 import (
 	"github.com/sirupsen/logrus"
-	"io"
+	"path/filepath"
 	"time"
 )
 
@@ -35,23 +35,27 @@ func (w *pollingWatcher) runFseventProducerLoop() fseventProducerLoop {
 }
 
 func (w *pollingWatcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldLogger) Error {
-	for _, dir := range t.watchedDirs {
-		err := t.syncFilesInDir(dir, true, log)
+	// Subdirectories for recursive globs may be added to or removed from t.watchedDirs while we iterate.
+	// They always come after their parent directory, so looping by index visits each remaining directory.
+	for i := 0; i < len(t.watchedDirs); i++ {
+		err := t.syncFilesInDir(t.watchedDirs[i], fromBeginning, log)
 		if err != nil {
 			return err
 		}
 	}
-	for _, file := range t.watchedFiles {
+	for path, file := range t.watchedFiles {
+		if containsString(t.missingDirs, filepath.Dir(path)) {
+			continue // with followPath, the file is kept open while its directory is removed or unmounted
+		}
 		truncated, err := isTruncated(file.file)
 		if err != nil {
 			return NewErrorf(NotSpecified, err, "%v: seek() or stat() failed", file.file.Name())
 		}
 		if truncated {
-			_, err = file.file.Seek(0, io.SeekStart)
-			if err != nil {
-				return NewErrorf(NotSpecified, err, "%v: seek() failed", file.file.Name())
+			Err := t.restartTruncatedFile(file, log)
+			if Err != nil {
+				return Err
 			}
-			file.reader.Clear()
 		}
 		readErr := t.readNewLines(file, log)
 		if readErr != nil {
@@ -0,0 +1,118 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PositionsFile stores the read position of each log file, so that grok_exporter
+// continues where it left off after a restart.
+// It is only used from the file tailer's consumer loop, so there is no locking.
+type PositionsFile struct {
+	path         string
+	syncInterval time.Duration
+	saved        map[string]Position // positions from the file, removed when they are restored
+}
+
+// Position is the inode of a file and the offset after the last line that was read.
+// On Windows, the file index is used as inode.
+type Position struct {
+	Inode  uint64 `yaml:"inode"`
+	Offset int64  `yaml:"offset"`
+}
+
+type positionsFileContent struct {
+	Positions map[string]Position `yaml:"positions"`
+}
+
+// NewPositionsFile starts with no positions, the existing positions file is overwritten.
+func NewPositionsFile(path string, syncInterval time.Duration) *PositionsFile {
+	return &PositionsFile{
+		path:         path,
+		syncInterval: syncInterval,
+		saved:        make(map[string]Position),
+	}
+}
+
+// LoadPositionsFile reads the positions file. If the file does not exist yet, it starts with no positions.
+// The positions are written to the file every syncInterval and when the tailer shuts down.
+func LoadPositionsFile(path string, syncInterval time.Duration) (*PositionsFile, error) {
+	result := NewPositionsFile(path, syncInterval)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, fmt.Errorf("failed to read positions file: %v", err)
+	}
+	content := &positionsFileContent{}
+	err = yaml.Unmarshal(data, content)
+	if err != nil {
+		return nil, fmt.Errorf("%v: invalid positions file: %v", path, err)
+	}
+	for filePath, pos := range content.Positions {
+		result.saved[filePath] = pos
+	}
+	return result, nil
+}
+
+// restore returns the saved position of a file that is opened for the first time.
+// Each position is restored only once, files that are created later are read from the beginning.
+func (p *PositionsFile) restore(path string) (Position, bool) {
+	pos, ok := p.saved[path]
+	if ok {
+		delete(p.saved, path)
+	}
+	return pos, ok
+}
+
+func (p *PositionsFile) has(path string) bool {
+	_, ok := p.saved[path]
+	return ok
+}
+
+// write replaces the positions file atomically, so that a crash never leaves a partially written file.
+func (p *PositionsFile) write(positions map[string]Position) error {
+	data, err := yaml.Marshal(&positionsFileContent{Positions: positions})
+	if err != nil {
+		return fmt.Errorf("failed to marshal positions: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write positions file: %v", err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write positions file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"io"
+	"os"
+)
+
+type StartPositionType int
+
+const (
+	Beginning  StartPositionType = iota // read the whole file
+	End                                 // read only lines that are written after the tailer was started
+	ByteOffset                          // start reading at Offset bytes
+	LineOffset                          // start reading at line number Offset, the first line is 1
+	Timestamp                           // start reading at the first line that was not written before the start time, see IsBefore
+)
+
+// StartPosition defines where the tailer starts reading the log files that exist on startup.
+// Files that are created later are always read from the beginning.
+// If a positions file is used, files with a saved position continue there instead.
+type StartPosition struct {
+	Type   StartPositionType
+	Offset int64
+	// IsBefore returns true if the line was written before the start time. If the line has no timestamp, ok is false.
+	IsBefore func(line string) (before bool, ok bool)
+}
+
+var fromBeginning = StartPosition{Type: Beginning}
+
+// offset returns the arguments for Seek() to move a newly opened file to the start position.
+// Offsets that are past the end of the file are moved to the end of the file.
+func (p StartPosition) offset(path string, format LineFormat) (int64, int, Error) {
+	switch p.Type {
+	case End:
+		return 0, io.SeekEnd, nil
+	case ByteOffset:
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return 0, 0, NewErrorf(NotSpecified, err, "%v: stat failed", path)
+		}
+		if p.Offset > fileInfo.Size() {
+			return 0, io.SeekEnd, nil
+		}
+		return p.Offset, io.SeekStart, nil
+	case LineOffset:
+		offset, err := findLine(path, p.Offset, format)
+		if err != nil {
+			return 0, 0, NewErrorf(NotSpecified, err, "%v: read() failed", path)
+		}
+		return offset, io.SeekStart, nil
+	case Timestamp:
+		offset, err := findTimestamp(path, p.IsBefore, format)
+		if err != nil {
+			return 0, 0, NewErrorf(NotSpecified, err, "%v: read() failed", path)
+		}
+		return offset, io.SeekStart, nil
+	default:
+		return 0, io.SeekStart, nil
+	}
+}
+
+// findLine returns the byte offset where the line with the given line number starts.
+// If the file has fewer lines, the result is the offset after the last complete line.
+func findLine(path string, lineNumber int64, format LineFormat) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := NewLineReader(format)
+	for line := int64(1); line < lineNumber; line++ {
+		_, eof, err := reader.ReadLine(file)
+		if err != nil {
+			return 0, err
+		}
+		if eof {
+			break
+		}
+	}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	return offset - int64(reader.Buffered()), nil
+}
+
+// findTimestamp scans the file and returns the byte offset where the first line starts that was not written before the start time.
+// Lines without timestamp, like the lines of a stack trace, are skipped. If all lines are older, the result is the offset after the last complete line.
+func findTimestamp(path string, isBefore func(line string) (bool, bool), format LineFormat) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := NewLineReader(format)
+	var lineStart int64
+	for {
+		line, eof, err := reader.ReadLine(file)
+		if err != nil {
+			return 0, err
+		}
+		if eof {
+			return lineStart, nil
+		}
+		if before, ok := isBefore(line); ok && !before {
+			return lineStart, nil
+		}
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		lineStart = offset - int64(reader.Buffered())
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// resolveSymlinks replaces the symbolic links in a directory listing with the files they point to,
+// so that a link like current.log is treated like the file it points to. The name is still the name of the link.
+// When the link is changed to point to another file, the next sync finds a new file for the link's path,
+// reads the remaining lines of the old file, and then continues with the new file.
+// Broken links are skipped, because there is nothing to read. Links to directories are skipped as well,
+// so that recursive globs don't run into loops.
+// This is used on Linux and macOS. On Windows, files are opened by path to identify them, which follows links anyway.
+func resolveSymlinks(dirPath string, fileInfos []os.FileInfo) []os.FileInfo {
+	result := make([]os.FileInfo, 0, len(fileInfos))
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(filepath.Join(dirPath, fileInfo.Name())) // os.Stat() reports the name of the link
+			if err != nil || target.IsDir() {
+				continue
+			}
+			fileInfo = target
+		}
+		result = append(result, fileInfo)
+	}
+	return result
+}
+
+// isSymlink returns true if path is a symbolic link.
+func isSymlink(path string) bool {
+	fileInfo, err := os.Lstat(path)
+	return err == nil && fileInfo.Mode()&os.ModeSymlink != 0
+}
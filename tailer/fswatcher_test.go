@@ -15,10 +15,15 @@
 package tailer
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
 	"github.com/fstab/grok_exporter/tailer/glob"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
@@ -248,6 +253,602 @@ func TestFileMissingOnStartup(t *testing.T) {
 	runTest(t, "fail on missing startup", closeFileAfterEachLine, fseventTailer, _nocreate, mv, test)
 }
 
+// test the "fail_on_missing_logfile: false" configuration if the directory does not exist either
+func TestDirectoryMissingOnStartup(t *testing.T) {
+	test := [][]string{
+		{"start file tailer", "fail_on_missing_logfile=false", "logdir/test.log"},
+		{"sleep", "200"},
+		{"mkdir", "logdir"},
+		{"log", "line 1", "logdir/test.log"},
+		{"expect", "line 1", "logdir/test.log"},
+		{"log", "line 2", "logdir/test.log"},
+		{"expect", "line 2", "logdir/test.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "directory missing on startup", closeFileAfterEachLine, tailerOpt, _nocreate, mv, test)
+	}
+}
+
+// test that lines written right before logrotate are read from the old file before switching to the new file
+func TestCatchUpBeforeLogrotate(t *testing.T) {
+	test := [][]string{
+		{"log", "line 1", "test.log"},
+		{"start file tailer", "readall=true", "test.log"},
+		{"expect", "line 1", "test.log"},
+		{"sleep", "100"}, // make sure the tailer is idle, so that the rotation is detected before line 2 is read
+		{"log", "line 2", "test.log"},
+		{"logrotate", "test.log", "test.log.1"},
+		{"log", "line 3", "test.log"},
+		{"expect", "line 2", "test.log"},
+		{"expect", "line 3", "test.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "catch up before logrotate", closeFileAfterEachLine, tailerOpt, _create, mv, test)
+	}
+}
+
+// test that compressed backups are read on startup, oldest first
+func TestReadCompressedBackups(t *testing.T) {
+	test := [][]string{
+		{"log", "line 1", "test.log"},
+		{"logrotate", "test.log", "test.log.2"},
+		{"gzip", "test.log.2"},
+		{"sleep", "10"},
+		{"log", "line 2", "test.log"},
+		{"logrotate", "test.log", "test.log.1"},
+		{"gzip", "test.log.1"},
+		{"log", "line 3", "test.log"},
+		{"start file tailer", "readall=true", "read_compressed_backups", "test.log"},
+		{"expect", "line 1", "test.log"},
+		{"expect", "line 2", "test.log"},
+		{"expect", "line 3", "test.log"},
+		{"log", "line 4", "test.log"},
+		{"expect", "line 4", "test.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "read compressed backups", closeFileAfterEachLine, tailerOpt, _create, mv, test)
+	}
+}
+
+// test reading from a byte offset or line number on startup
+func TestStartPosition(t *testing.T) {
+	for _, startPosition := range []string{"start_position=byte:7", "start_position=line:2"} {
+		test := [][]string{
+			{"log", "line 1", "test.log"}, // 7 bytes including the newline
+			{"log", "line 2", "test.log"},
+			{"log", "line 3", "test.log"},
+			{"start file tailer", startPosition, "test.log"},
+			{"expect", "line 2", "test.log"},
+			{"expect", "line 3", "test.log"},
+			{"log", "line 4", "test.log"},
+			{"expect", "line 4", "test.log"},
+		}
+		for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+			runTest(t, "start position "+startPosition, closeFileAfterEachLine, tailerOpt, _nocreate, mv, test)
+		}
+	}
+}
+
+// test that a restarted tailer continues at the position saved in the positions file
+func TestPositionsFile(t *testing.T) {
+	test := [][]string{
+		{"log", "line 1", "test.log"},
+		{"start file tailer", "readall=true", "positions_file", "test.log"},
+		{"expect", "line 1", "test.log"},
+		{"stop file tailer"},
+		{"log", "line 2", "test.log"},
+		{"start file tailer", "readall=true", "positions_file", "test.log"},
+		{"expect", "line 2", "test.log"},
+		{"log", "line 3", "test.log"},
+		{"expect", "line 3", "test.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "positions file", closeFileAfterEachLine, tailerOpt, _nocreate, mv, test)
+	}
+}
+
+// test that the lines written before logrotate moved the file while the tailer was not running are read from the backup,
+// for backups with a date suffix in the same directory as well as for backups in logrotate's olddir
+func TestPositionsFileAfterLogrotate(t *testing.T) {
+	for _, backup := range []string{"test.log-20200101", "test-20200101.log", "old/test.log.1"} {
+		test := [][]string{
+			{"mkdir", "old"},
+			{"log", "line 1", "test.log"},
+			{"start file tailer", "readall=true", "positions_file", "olddir=old", "exclude=*-*.log", "test.log"},
+			{"expect", "line 1", "test.log"},
+			{"stop file tailer"},
+			{"log", "line 2", "test.log"},
+			{"logrotate", "test.log", backup},
+			{"log", "line 3", "test.log"},
+			{"start file tailer", "readall=true", "positions_file", "olddir=old", "exclude=*-*.log", "*.log"},
+			{"expect", "line 2", "test.log"},
+			{"expect", "line 3", "test.log"},
+			{"log", "line 4", "test.log"},
+			{"expect", "line 4", "test.log"},
+		}
+		for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+			runTest(t, "positions file after logrotate to "+backup, closeFileAfterEachLine, tailerOpt, _create, mv, test)
+		}
+	}
+}
+
+// test that compressed backups are found in logrotate's olddir
+func TestReadCompressedBackupsFromOlddir(t *testing.T) {
+	test := [][]string{
+		{"mkdir", "old"},
+		{"log", "line 1", "test.log"},
+		{"logrotate", "test.log", "old/test.log-20200101"},
+		{"gzip", "old/test.log-20200101"},
+		{"log", "line 2", "test.log"},
+		{"start file tailer", "readall=true", "read_compressed_backups", "olddir=old", "test.log"},
+		{"expect", "line 1", "test.log"},
+		{"expect", "line 2", "test.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "read compressed backups from olddir", closeFileAfterEachLine, tailerOpt, _create, mv, test)
+	}
+}
+
+// test that a symlink is followed to its target, and that the new target is read when the symlink is changed
+func TestSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks are not supported on Windows")
+	}
+	test := [][]string{
+		{"mkdir", "archive"},
+		{"log", "line 1", "app-1.log"},
+		{"symlink", "app-1.log", "current.log"},
+		{"start file tailer", "readall=true", "current.log"},
+		{"expect", "line 1", "current.log"},
+		{"log", "line 2", "app-1.log"},
+		{"expect", "line 2", "current.log"},
+		{"log", "line 3", "app-2.log"},
+		{"symlink", "app-2.log", "current.log"},
+		{"expect", "line 3", "current.log"},
+		{"log", "line 4", "app-2.log"},
+		{"expect", "line 4", "current.log"},
+		{"log", "line 5", "archive/app-3.log"},
+		{"symlink", "archive/app-3.log", "current.log"},
+		{"expect", "line 5", "current.log"},
+		{"log", "line 6", "archive/app-3.log"},
+		{"expect", "line 6", "current.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "symlink", closeFileAfterEachLine, tailerOpt, _nocreate, mv, test)
+	}
+}
+
+// test that '**' matches files in subdirectories, including subdirectories that are created while the tailer is running
+func TestRecursiveGlob(t *testing.T) {
+	test := [][]string{
+		{"mkdir", "logs"},
+		{"mkdir", "logs/pod-1"},
+		{"log", "line 1", "logs/app.log"},
+		{"log", "line 2", "logs/pod-1/app.log"},
+		{"log", "ignored", "logs/pod-1/app.txt"},
+		{"start file tailer", "readall=true", "logs/**/*.log"},
+		{"expect", "line 1", "logs/app.log"},
+		{"expect", "line 2", "logs/pod-1/app.log"},
+		{"mkdir", "logs/pod-2"},
+		{"mkdir", "logs/pod-2/nested"},
+		{"log", "line 3", "logs/pod-2/nested/app.log"},
+		{"expect", "line 3", "logs/pod-2/nested/app.log"},
+		{"log", "line 4", "logs/pod-2/nested/app.log"},
+		{"expect", "line 4", "logs/pod-2/nested/app.log"},
+		{"log", "line 5", "logs/pod-1/app.log"},
+		{"expect", "line 5", "logs/pod-1/app.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "recursive glob", closeFileAfterEachLine, tailerOpt, _nocreate, mv, test)
+	}
+}
+
+// test that subdirectories for '**' can be removed and created again
+func TestRecursiveGlobRemoveDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("removing a watched directory fails on Windows")
+	}
+	test := [][]string{
+		{"mkdir", "logs"},
+		{"mkdir", "logs/pod-1"},
+		{"log", "line 1", "logs/pod-1/app.log"},
+		{"start file tailer", "readall=true", "logs/**/*.log"},
+		{"expect", "line 1", "logs/pod-1/app.log"},
+		{"rmdir", "logs/pod-1"},
+		{"sleep", "100"},
+		{"mkdir", "logs/pod-1"},
+		{"log", "line 2", "logs/pod-1/app.log"},
+		{"expect", "line 2", "logs/pod-1/app.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "recursive glob remove dir", closeFileAfterEachLine, tailerOpt, _nocreate, mv, test)
+	}
+}
+
+// test that excluded files are neither read on startup nor when they are created later
+func TestExclude(t *testing.T) {
+	test := [][]string{
+		{"log", "line 1", "test.log"},
+		{"log", "old line", "test.log.1"},
+		{"start file tailer", "readall=true", "exclude=*.1", "exclude=*.gz", "test.log*"},
+		{"expect", "line 1", "test.log"},
+		{"log", "new line", "test.log.gz"},
+		{"log", "line 2", "test.log"},
+		{"expect", "line 2", "test.log"},
+		{"log", "line 3", "test.log.2"},
+		{"expect", "line 3", "test.log.2"},
+		{"expect no more lines"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "exclude", closeFileAfterEachLine, tailerOpt, _nocreate, mv, test)
+	}
+}
+
+// test that idle files are closed, and opened again when lines are written
+func TestIdleTimeout(t *testing.T) {
+	test := [][]string{
+		{"log", "line 1", "test.log"},
+		{"start file tailer", "readall=true", "idle_timeout=50ms", "test.log"},
+		{"expect", "line 1", "test.log"},
+		{"sleep", "200"},
+		{"expect closed", "test.log"},
+		{"log", "line 2", "test.log"},
+		{"expect", "line 2", "test.log"},
+		{"sleep", "200"},
+		{"expect closed", "test.log"},
+		{"logrotate", "test.log", "test.log.1"},
+		{"log", "line 3", "test.log"},
+		{"expect", "line 3", "test.log"},
+		{"expect no more lines"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "idle timeout", closeFileAfterEachLine, tailerOpt, _create, mv, test)
+	}
+}
+
+// test that an idle file that is removed and created again is read from the beginning, even if the new file gets the old file's inode number
+func TestIdleFileReplaced(t *testing.T) {
+	test := [][]string{
+		{"log", "line 1", "test.log"},
+		{"start file tailer", "readall=true", "idle_timeout=50ms", "test.log"},
+		{"expect", "line 1", "test.log"},
+		{"sleep", "200"},
+		{"expect closed", "test.log"},
+		{"logrotate", "test.log", "test.log.1"},
+		{"log", "line 2", "test.log"},
+		{"log", "line 3", "test.log"},
+		{"expect", "line 2", "test.log"},
+		{"expect", "line 3", "test.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "idle file replaced", closeFileAfterEachLine, tailerOpt, _create, rm, test)
+	}
+}
+
+// test that incomplete lines wait for the newline, and are sent after the partial line timeout
+func TestPartialLineTimeout(t *testing.T) {
+	test := [][]string{
+		{"log", "line 1", "test.log"},
+		{"start file tailer", "readall=true", "partial_line_timeout=300ms", "test.log"},
+		{"expect", "line 1", "test.log"},
+		{"log incomplete", "line", "test.log"},
+		{"expect no more lines"},
+		{"log", " 2", "test.log"},
+		{"expect", "line 2", "test.log"},
+		{"log incomplete", "line 3", "test.log"},
+		{"sleep", "500"},
+		{"expect", "line 3", "test.log"},
+		{"log", "line 4", "test.log"},
+		{"expect", "line 4", "test.log"},
+		{"expect no more lines"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "partial line timeout", closeFileAfterEachLine, tailerOpt, _create, mv, test)
+	}
+}
+
+// test that the incomplete last line of a rotated file is sent, because it will not be completed any more
+func TestPartialLineRotated(t *testing.T) {
+	test := [][]string{
+		{"log", "line 1", "test.log"},
+		{"start file tailer", "readall=true", "partial_line_timeout=1h", "test.log"},
+		{"expect", "line 1", "test.log"},
+		{"log incomplete", "line 2", "test.log"},
+		{"expect no more lines"},
+		{"logrotate", "test.log", "test.log.1"},
+		{"log", "line 3", "test.log"},
+		{"expect", "line 2", "test.log"},
+		{"expect", "line 3", "test.log"},
+		{"expect no more lines"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "partial line rotated", closeFileAfterEachLine, tailerOpt, _create, mv, test)
+	}
+}
+
+// With follow_path, a file that gets a new inode with the same content is continued where the old file was read.
+func TestFollowPath(t *testing.T) {
+	test := [][]string{
+		{"mkdir", "logdir"},
+		{"log", "line 1", "logdir/test.log"},
+		{"start file tailer", "readall=true", "follow_path", "logdir/*.log"},
+		{"expect", "line 1", "logdir/test.log"},
+		{"replace", "logdir/test.log"},
+		{"log", "line 2", "logdir/test.log"},
+		{"expect", "line 2", "logdir/test.log"},
+		{"remount", "logdir"},
+		{"log", "line 3", "logdir/test.log"},
+		{"expect", "line 3", "logdir/test.log"},
+		{"logrotate", "logdir/test.log", "logdir/test.log.1"},
+		{"log", "line 4", "logdir/test.log"},
+		{"expect", "line 4", "logdir/test.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		runTest(t, "follow path", closeFileAfterEachLine, tailerOpt, _create, rm, test)
+	}
+}
+
+// test that the oneshot tailer reads all files to the end and then closes the lines channel
+func TestOneshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"b.log":     "b1\nb2", // the last line is read even without a newline
+		"a.log":     "a1\n",
+		"a.log.txt": "not matching\n",
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("failed to write %v: %v", name, err)
+		}
+	}
+	parsedGlob, err := glob.Parse(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatalf("failed to parse glob: %v", err)
+	}
+	// start position End is treated like Beginning
+	tailer, err := fswatcher.RunOneshotFileTailer([]glob.Glob{parsedGlob}, nil, fswatcher.StartPosition{Type: fswatcher.End}, false, "", true, fswatcher.LineFormat{}, logrus.New())
+	if err != nil {
+		t.Fatalf("failed to start oneshot tailer: %v", err)
+	}
+	var lines []string
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case line, open := <-tailer.Lines():
+			if !open {
+				done = true
+				break
+			}
+			lines = append(lines, filepath.Base(line.File)+": "+line.Line)
+		case err := <-tailer.Errors():
+			t.Fatalf("unexpected error: %v", err)
+		case <-timeout:
+			t.Fatalf("timeout while waiting for the oneshot tailer to finish, got lines %v", lines)
+		}
+	}
+	expected := []string{"a.log: a1", "b.log: b1", "b.log: b2"}
+	if strings.Join(lines, ", ") != strings.Join(expected, ", ") {
+		t.Fatalf("expected lines %v, but got %v", expected, lines)
+	}
+}
+
+func TestStartFromTimestamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	content := "2024-01-01 old line\n  no timestamp\n2024-01-02 new line\n  no timestamp\n2024-01-01 out of order\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "test.log"), []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test.log: %v", err)
+	}
+	parsedGlob, err := glob.Parse(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatalf("failed to parse glob: %v", err)
+	}
+	isBefore := func(line string) (bool, bool) {
+		if !strings.HasPrefix(line, "2024") {
+			return false, false
+		}
+		return line < "2024-01-02", true
+	}
+	tailer, err := fswatcher.RunOneshotFileTailer([]glob.Glob{parsedGlob}, nil, fswatcher.StartPosition{Type: fswatcher.Timestamp, IsBefore: isBefore}, false, "", true, fswatcher.LineFormat{}, logrus.New())
+	if err != nil {
+		t.Fatalf("failed to start oneshot tailer: %v", err)
+	}
+	var lines []string
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case line, open := <-tailer.Lines():
+			if !open {
+				done = true
+				break
+			}
+			lines = append(lines, line.Line)
+		case err := <-tailer.Errors():
+			t.Fatalf("unexpected error: %v", err)
+		case <-timeout:
+			t.Fatalf("timeout while waiting for the oneshot tailer to finish, got lines %v", lines)
+		}
+	}
+	// processing starts at the first new line, later lines are not filtered
+	expected := []string{"2024-01-02 new line", "  no timestamp", "2024-01-01 out of order"}
+	if strings.Join(lines, ", ") != strings.Join(expected, ", ") {
+		t.Fatalf("expected lines %v, but got %v", expected, lines)
+	}
+}
+
+// test that a line that was read but not sent when the tailer was closed is read again after a restart
+func TestPositionOfUnsentLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	logfile := filepath.Join(dir, "test.log")
+	positionsFile := filepath.Join(dir, "positions.yaml")
+	err = ioutil.WriteFile(logfile, []byte("line 1\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test.log: %v", err)
+	}
+	parsedGlob, err := glob.Parse(logfile)
+	if err != nil {
+		t.Fatalf("failed to parse glob: %v", err)
+	}
+	tailer, err := fswatcher.RunFileTailer([]glob.Glob{parsedGlob}, fswatcher.Options{FailOnMissingFile: true, Positions: fswatcher.NewPositionsFile(positionsFile, time.Hour)}, logrus.New())
+	if err != nil {
+		t.Fatalf("failed to start tailer: %v", err)
+	}
+	expectNextLine(t, tailer, "line 1")
+	file, err := os.OpenFile(logfile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open test.log: %v", err)
+	}
+	_, err = file.WriteString("line 2\n")
+	file.Close()
+	if err != nil {
+		t.Fatalf("failed to write test.log: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	// tailer is now trying to write line 2 to the Lines channel, but we are not reading it
+	tailer.Close()
+	for range tailer.Lines() {
+		// wait until the positions are saved and the lines channel is closed
+	}
+	positions, err := fswatcher.LoadPositionsFile(positionsFile, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to load positions file: %v", err)
+	}
+	tailer, err = fswatcher.RunFileTailer([]glob.Glob{parsedGlob}, fswatcher.Options{Start: fswatcher.StartPosition{Type: fswatcher.End}, FailOnMissingFile: true, Positions: positions}, logrus.New())
+	if err != nil {
+		t.Fatalf("failed to restart tailer: %v", err)
+	}
+	defer tailer.Close()
+	expectNextLine(t, tailer, "line 2")
+}
+
+func expectNextLine(t *testing.T, tailer fswatcher.FileTailer, expected string) {
+	select {
+	case line := <-tailer.Lines():
+		if line.Line != expected {
+			t.Fatalf("expected %q, but got %q", expected, line.Line)
+		}
+	case err := <-tailer.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for %q", expected)
+	}
+}
+
+// test that a file that is truncated in place is read from the beginning
+func TestTruncate(t *testing.T) {
+	test := [][]string{
+		{"log", "line 1", "test.log"},
+		{"log", "line 2", "test.log"},
+		{"start file tailer", "readall=true", "test.log"},
+		{"expect", "line 1", "test.log"},
+		{"expect", "line 2", "test.log"},
+		{"truncate", "test.log"},
+		{"sleep", "100"},
+		{"log", "line 3", "test.log"},
+		{"expect", "line 3", "test.log"},
+	}
+	for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+		before := fswatcher.TruncatedFilesTotal()
+		runTest(t, "truncate", closeFileAfterEachLine, tailerOpt, _nocreate, mv, test)
+		if fswatcher.TruncatedFilesTotal() != before+1 {
+			t.Errorf("%v: expected the truncation to be counted once, but got %v", tailerOpt, fswatcher.TruncatedFilesTotal()-before)
+		}
+	}
+}
+
+// test lines that are separated by other delimiters than '\n', that are not encoded in UTF-8, or that are too long
+func TestLineFormat(t *testing.T) {
+	regexDelimiter, err := fswatcher.NewRegexDelimiter(`\n-{3,}\n`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utf16le := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder()
+	for _, data := range []struct {
+		name          string
+		delimiter     *fswatcher.Delimiter
+		charset       encoding.Encoding
+		maxLineLength int
+		split         bool
+		before        string // written before the tailer is started
+		after         string // written while the tailer is running
+		expected      []string
+	}{
+		{"nul", fswatcher.NewDelimiter("\x00"), nil, 0, false, "line 1\x00line 2\x00", "line 3\x00", []string{"line 1", "line 2", "line 3"}},
+		{"crlf", fswatcher.NewDelimiter("\r\n"), nil, 0, false, "line 1\nstill line 1\r\n", "line 2\r\n", []string{"line 1\nstill line 1", "line 2"}},
+		{"regex", regexDelimiter, nil, 0, false, "line 1\nstill line 1\n---\n", "line 2\n------\n", []string{"line 1\nstill line 1", "line 2"}},
+		{"latin1", nil, charmap.ISO8859_1, 0, false, "caf\xe9\n", "na\xefve\n", []string{"café", "naïve"}},
+		// "\u0a41\u0100" is "A\n\x00\x01" in UTF-16LE, which must not be split at the '\n' in the middle.
+		{"utf16le", nil, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), 0, false, mustEncode(t, utf16le, "\uFEFFline 1\r\n\u0a41\u0100\n"), mustEncode(t, utf16le, "zoë\r\n"), []string{"line 1", "\u0a41\u0100", "zoë"}},
+		{"truncate", nil, nil, 6, false, "line 1 is long\nline 2\n", "line 3" + strings.Repeat(" is long", 1000) + "\nline 4\n", []string{"line 1", "line 2", "line 3", "line 4"}},
+		{"split", nil, nil, 6, true, "line 1 is long\n", "line 2\n", []string{"line 1", " is lo", "ng", "line 2"}},
+		{"truncate utf8", nil, nil, 6, false, "zzzzzë\n", "line 2\n", []string{"zzzzz", "line 2"}}, // 'ë' is 2 bytes and must not be split
+		{"truncate utf16le", nil, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), 7, false, mustEncode(t, utf16le, "line 1\n"), mustEncode(t, utf16le, "line 2\n"), []string{"lin", "lin"}},
+	} {
+		for _, tailerOpt := range []fileTailerConfig{fseventTailer, pollingTailer} {
+			t.Run(data.name+"("+tailerOpt.String()+")", func(t *testing.T) {
+				ctx := setUp(t, "line delimiter "+data.name, closeFileAfterEachLine, tailerOpt, _nocreate, mv)
+				defer tearDown(t, ctx)
+				logfile := filepath.Join(ctx.basedir, "test.log")
+				err := ioutil.WriteFile(logfile, []byte(data.before), 0644)
+				if err != nil {
+					fatalf(t, ctx, "%v", err)
+				}
+				parsedGlob, err := glob.Parse(logfile)
+				if err != nil {
+					fatalf(t, ctx, "%v", err)
+				}
+				format, err := fswatcher.NewLineFormat(data.delimiter, data.charset, data.maxLineLength, data.split)
+				if err != nil {
+					fatalf(t, ctx, "%v", err)
+				}
+				start := fswatcher.StartPosition{Type: fswatcher.Beginning}
+				if tailerOpt == fseventTailer {
+					ctx.tailer, err = fswatcher.RunFileTailer([]glob.Glob{parsedGlob}, fswatcher.Options{Start: start, FailOnMissingFile: true, Format: format}, ctx.log)
+				} else {
+					ctx.tailer, err = fswatcher.RunPollingFileTailer([]glob.Glob{parsedGlob}, fswatcher.Options{Start: start, FailOnMissingFile: true, Format: format, PollInterval: 10 * time.Millisecond}, ctx.log)
+				}
+				if err != nil {
+					fatalf(t, ctx, "failed to start tailer: %v", err)
+				}
+				ctx.linesFromTailer = makeLinesFromTailer(ctx.tailer)
+				f, err := os.OpenFile(logfile, os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					fatalf(t, ctx, "%v", err)
+				}
+				_, err = f.WriteString(data.after)
+				f.Close()
+				if err != nil {
+					fatalf(t, ctx, "%v", err)
+				}
+				for _, line := range data.expected {
+					expect(t, ctx, line, "test.log")
+				}
+				closeTailer(t, ctx, false)
+			})
+		}
+	}
+}
+
+func mustEncode(t *testing.T, encoder *encoding.Encoder, s string) string {
+	result, err := encoder.String(s)
+	if err != nil {
+		t.Fatalf("failed to encode %q: %v", s, err)
+	}
+	return result
+}
+
 func skip(config testConfigType, loggerCfg loggerConfig, logrotateCfg logrotateConfig, logrotateMvCfg logrotateMoveConfig) bool {
 	if len(config.ParamFilters["loggerCfg"]) > 0 && !containsAsString(loggerCfg, config.ParamFilters["loggerCfg"]) {
 		return true
@@ -281,7 +882,7 @@ func runTest(t *testing.T, testName string, loggerCfg loggerConfig, tailerCfg fi
 	})
 }
 
-func executeCommands(t *testing.T, ctx *context, cmds [][]string) {
+func executeCommands(t *testing.T, ctx *testContext, cmds [][]string) {
 	nGoroutinesBefore := runtime.NumGoroutine()
 	for _, cmd := range cmds {
 		exec(t, ctx, cmd)
@@ -298,7 +899,7 @@ func executeCommands(t *testing.T, ctx *context, cmds [][]string) {
 	}
 }
 
-func closeTailer(t *testing.T, ctx *context, ignoreUnexpectedLines bool) {
+func closeTailer(t *testing.T, ctx *testContext, ignoreUnexpectedLines bool) {
 	// Note: This function checks if the Lines() channel gets closed.
 	// While it's good to check this, it doesn't guarantee that the tailer is
 	// fully shut down. There might be an fseventProducerLoop running in the
@@ -321,7 +922,7 @@ func closeTailer(t *testing.T, ctx *context, ignoreUnexpectedLines bool) {
 	}
 }
 
-func assertGoroutinesTerminated(t *testing.T, ctx *context, nGoroutinesBefore int) {
+func assertGoroutinesTerminated(t *testing.T, ctx *testContext, nGoroutinesBefore int) {
 	// Timeout of 2 seconds, because after FileTailer.Close() returns the tailer is still
 	// shutting down in the background.
 	timeout := 2 * time.Second
@@ -336,8 +937,8 @@ func assertGoroutinesTerminated(t *testing.T, ctx *context, nGoroutinesBefore in
 	}
 }
 
-func setUp(t *testing.T, testName string, loggerCfg loggerConfig, tailerCfg fileTailerConfig, logrotateCfg logrotateConfig, logrotateMvCfg logrotateMoveConfig) *context {
-	ctx := &context{
+func setUp(t *testing.T, testName string, loggerCfg loggerConfig, tailerCfg fileTailerConfig, logrotateCfg logrotateConfig, logrotateMvCfg logrotateMoveConfig) *testContext {
+	ctx := &testContext{
 		logFileWriters: make(map[string]logFileWriter),
 		testName:       testName,
 		loggerCfg:      loggerCfg,
@@ -357,12 +958,12 @@ func setUp(t *testing.T, testName string, loggerCfg loggerConfig, tailerCfg file
 	return ctx
 }
 
-func params(ctx *context) string {
+func params(ctx *testContext) string {
 	params := []fmt.Stringer{ctx.loggerCfg, ctx.tailerCfg, ctx.logrotateCfg, ctx.logrotateMvCfg}
 	return join(params, ",")
 }
 
-type context struct {
+type testContext struct {
 	basedir         string
 	logFileWriters  map[string]logFileWriter // path -> writer
 	testName        string
@@ -375,11 +976,13 @@ type context struct {
 	linesFromTailer *linesFromTailer
 }
 
-func exec(t *testing.T, ctx *context, cmd []string) {
+func exec(t *testing.T, ctx *testContext, cmd []string) {
 	ctx.log.Debug(printCmd(cmd))
 	switch cmd[0] {
 	case "mkdir":
 		mkdir(t, ctx, cmd[1])
+	case "rmdir":
+		rmdir(t, ctx, cmd[1])
 	case "log":
 		writer, exists := ctx.logFileWriters[cmd[2]]
 		if !exists {
@@ -387,12 +990,32 @@ func exec(t *testing.T, ctx *context, cmd []string) {
 			ctx.logFileWriters[cmd[2]] = writer
 		}
 		writer.writeLine(t, ctx, cmd[1])
+	case "log incomplete":
+		appendOrFail(t, ctx, cmd[1], cmd[2])
 	case "start file tailer":
 		startFileTailer(t, ctx, cmd[1:])
+	case "stop file tailer":
+		closeTailer(t, ctx, false)
+		time.Sleep(100 * time.Millisecond) // the tailer saves the positions file while shutting down
+		ctx.tailer = nil
 	case "expect":
 		expect(t, ctx, cmd[1], cmd[2])
+	case "expect no more lines":
+		expectNoMoreLines(t, ctx)
+	case "expect closed":
+		expectClosed(t, ctx, cmd[1])
 	case "logrotate":
 		rotate(t, ctx, cmd[1], cmd[2])
+	case "gzip":
+		gzipOrFail(t, ctx, cmd[1])
+	case "truncate":
+		truncateOrFail(t, ctx, cmd[1])
+	case "replace":
+		replaceOrFail(t, ctx, cmd[1])
+	case "remount":
+		remountOrFail(t, ctx, cmd[1])
+	case "symlink":
+		symlinkOrFail(t, ctx, cmd[1], cmd[2])
 	case "sleep":
 		duration, err := strconv.Atoi(cmd[1])
 		if err != nil {
@@ -404,7 +1027,7 @@ func exec(t *testing.T, ctx *context, cmd []string) {
 	}
 }
 
-func rotate(t *testing.T, ctx *context, from string, to string) {
+func rotate(t *testing.T, ctx *testContext, from string, to string) {
 	fullpath := filepath.Join(ctx.basedir, from)
 	fromDir := filepath.Dir(fullpath)
 	filenameFrom := filepath.Base(fullpath)
@@ -444,7 +1067,7 @@ func rotate(t *testing.T, ctx *context, from string, to string) {
 	ctx.log.Debugf("file list after logrotate: %#v", filenames(ls(t, ctx, fromDir)))
 }
 
-func ls(t *testing.T, ctx *context, path string) []os.FileInfo {
+func ls(t *testing.T, ctx *testContext, path string) []os.FileInfo {
 	result, err := ioutil.ReadDir(path)
 	if err != nil {
 		fatalf(t, ctx, "%v: Failed to list directory: %v", path, err.Error())
@@ -461,7 +1084,7 @@ func containsFile(files []os.FileInfo, filename string) bool {
 	return false
 }
 
-func moveOrFail(t *testing.T, ctx *context, from, to string) {
+func moveOrFail(t *testing.T, ctx *testContext, from, to string) {
 	fromPath := filepath.Join(ctx.basedir, from)
 	fromDir := filepath.Dir(fromPath)
 	fromFilename := filepath.Base(fromPath)
@@ -492,7 +1115,7 @@ func filenames(fileInfos []os.FileInfo) []string {
 	return result
 }
 
-func mvOrFail(t *testing.T, ctx *context, from, to string) {
+func mvOrFail(t *testing.T, ctx *testContext, from, to string) {
 	fromPath := filepath.Join(ctx.basedir, from)
 	toPath := filepath.Join(ctx.basedir, to)
 	err := os.Rename(fromPath, toPath)
@@ -501,7 +1124,21 @@ func mvOrFail(t *testing.T, ctx *context, from, to string) {
 	}
 }
 
-func cpOrFail(t *testing.T, ctx *context, from, to string) {
+// like ln -sfn: create or replace the symlink atomically
+func symlinkOrFail(t *testing.T, ctx *testContext, target, link string) {
+	linkPath := filepath.Join(ctx.basedir, link)
+	tmpPath := linkPath + ".tmp"
+	err := os.Symlink(filepath.Join(ctx.basedir, target), tmpPath)
+	if err != nil {
+		fatalf(t, ctx, "%v: Failed to create symlink: %v", linkPath, err.Error())
+	}
+	err = os.Rename(tmpPath, linkPath)
+	if err != nil {
+		fatalf(t, ctx, "%v: Failed to replace symlink: %v", linkPath, err.Error())
+	}
+}
+
+func cpOrFail(t *testing.T, ctx *testContext, from, to string) {
 	fromPath := filepath.Join(ctx.basedir, from)
 	toPath := filepath.Join(ctx.basedir, to)
 	data, err := ioutil.ReadFile(fromPath)
@@ -514,7 +1151,29 @@ func cpOrFail(t *testing.T, ctx *context, from, to string) {
 	}
 }
 
-func rmOrFail(t *testing.T, ctx *context, from string) {
+// like the gzip command: compress the file and remove the original
+func gzipOrFail(t *testing.T, ctx *testContext, from string) {
+	fromPath := filepath.Join(ctx.basedir, from)
+	data, err := ioutil.ReadFile(fromPath)
+	if err != nil {
+		fatalf(t, ctx, "%v: gzip failed, cannot read file: %v", fromPath, err.Error())
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err = gz.Write(data)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = ioutil.WriteFile(fromPath+".gz", buf.Bytes(), 0644)
+	}
+	if err != nil {
+		fatalf(t, ctx, "%v: gzip failed: %v", fromPath, err.Error())
+	}
+	rmOrFail(t, ctx, from)
+}
+
+func rmOrFail(t *testing.T, ctx *testContext, from string) {
 	fromPath := filepath.Join(ctx.basedir, from)
 	err := os.Remove(fromPath)
 	if err != nil {
@@ -522,7 +1181,7 @@ func rmOrFail(t *testing.T, ctx *context, from string) {
 	}
 }
 
-func createOrFail(t *testing.T, ctx *context, from string) {
+func createOrFail(t *testing.T, ctx *testContext, from string) {
 	fromPath := filepath.Join(ctx.basedir, from)
 	dir := filepath.Dir(fromPath)
 	filename := filepath.Base(fromPath)
@@ -544,7 +1203,7 @@ func createOrFail(t *testing.T, ctx *context, from string) {
 	}
 }
 
-func createFromTemp(t *testing.T, ctx *context, from string) {
+func createFromTemp(t *testing.T, ctx *testContext, from string) {
 	fromPath := filepath.Join(ctx.basedir, from)
 	dir := filepath.Dir(fromPath)
 	filename := filepath.Base(fromPath)
@@ -571,7 +1230,7 @@ func createFromTemp(t *testing.T, ctx *context, from string) {
 	}
 }
 
-func truncateOrFail(t *testing.T, ctx *context, from string) {
+func truncateOrFail(t *testing.T, ctx *testContext, from string) {
 	fromPath := filepath.Join(ctx.basedir, from)
 	err := os.Truncate(fromPath, 0)
 	if err != nil {
@@ -579,7 +1238,42 @@ func truncateOrFail(t *testing.T, ctx *context, from string) {
 	}
 }
 
-func mkdir(t *testing.T, ctx *context, dirname string) {
+// write text without a newline, like a log line that is not completely written yet
+func appendOrFail(t *testing.T, ctx *testContext, text string, file string) {
+	path := filepath.Join(ctx.basedir, file)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		fatalf(t, ctx, "%v: Failed to open file for writing: %v", path, err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(text)
+	if err != nil {
+		fatalf(t, ctx, "%v: Failed to write to file: %v", path, err)
+	}
+}
+
+// replace the file with a new file with the same content, so the file gets a new inode
+func replaceOrFail(t *testing.T, ctx *testContext, from string) {
+	cpOrFail(t, ctx, from, from+".tmp")
+	moveOrFail(t, ctx, from+".tmp", from)
+}
+
+// like an overlayfs that is remounted: the directory and its files are back with the same content, but with new inodes
+func remountOrFail(t *testing.T, ctx *testContext, dirname string) {
+	fullpath := filepath.Join(ctx.basedir, dirname)
+	tmpDir := dirname + ".remount"
+	mkdir(t, ctx, tmpDir)
+	for _, fileInfo := range ls(t, ctx, fullpath) {
+		cpOrFail(t, ctx, filepath.Join(dirname, fileInfo.Name()), filepath.Join(tmpDir, fileInfo.Name()))
+	}
+	rmdir(t, ctx, dirname)
+	err := os.Rename(filepath.Join(ctx.basedir, tmpDir), fullpath)
+	if err != nil {
+		fatalf(t, ctx, "remount %v failed: %v", dirname, err)
+	}
+}
+
+func mkdir(t *testing.T, ctx *testContext, dirname string) {
 	var (
 		fullpath string
 		err      error
@@ -594,25 +1288,68 @@ func mkdir(t *testing.T, ctx *context, dirname string) {
 	}
 }
 
-func startFileTailer(t *testing.T, ctx *context, params []string) {
+// like rm -r
+func rmdir(t *testing.T, ctx *testContext, dirname string) {
+	fullpath := filepath.Join(ctx.basedir, dirname)
+	err := os.RemoveAll(fullpath)
+	if err != nil {
+		fatalf(t, ctx, "rm -r %v failed: %v", dirname, err)
+	}
+}
+
+func startFileTailer(t *testing.T, ctx *testContext, params []string) {
 	var (
-		parsedGlobs       []glob.Glob
-		tailer            fswatcher.FileTailer
-		readall           = false
-		failOnMissingFile = true
-		globs             []string
-		err               error
+		parsedGlobs           []glob.Glob
+		tailer                fswatcher.FileTailer
+		start                 = fswatcher.StartPosition{Type: fswatcher.End}
+		readCompressedBackups = false
+		olddir                string
+		followPath            = false
+		failOnMissingFile     = true
+		positions             *fswatcher.PositionsFile
+		globs                 []string
+		exclude               []string
+		idleTimeout           time.Duration
+		partialLineTimeout    time.Duration
+		err                   error
 	)
 	for _, p := range params {
-		switch p {
-		case "readall=true":
-			readall = true
-		case "readall=false":
-			readall = false
-		case "fail_on_missing_logfile=true":
+		switch {
+		case p == "readall=true":
+			start = fswatcher.StartPosition{Type: fswatcher.Beginning}
+		case p == "readall=false":
+			start = fswatcher.StartPosition{Type: fswatcher.End}
+		case strings.HasPrefix(p, "start_position=byte:"):
+			start = fswatcher.StartPosition{Type: fswatcher.ByteOffset, Offset: parseOffset(t, ctx, p)}
+		case strings.HasPrefix(p, "start_position=line:"):
+			start = fswatcher.StartPosition{Type: fswatcher.LineOffset, Offset: parseOffset(t, ctx, p)}
+		case strings.HasPrefix(p, "exclude="):
+			exclude = append(exclude, strings.TrimPrefix(p, "exclude="))
+		case strings.HasPrefix(p, "idle_timeout="):
+			idleTimeout, err = time.ParseDuration(strings.TrimPrefix(p, "idle_timeout="))
+			if err != nil {
+				fatalf(t, ctx, "syntax error in test: %v: %v", p, err)
+			}
+		case strings.HasPrefix(p, "partial_line_timeout="):
+			partialLineTimeout, err = time.ParseDuration(strings.TrimPrefix(p, "partial_line_timeout="))
+			if err != nil {
+				fatalf(t, ctx, "syntax error in test: %v: %v", p, err)
+			}
+		case p == "read_compressed_backups":
+			readCompressedBackups = true
+		case strings.HasPrefix(p, "olddir="):
+			olddir = strings.TrimPrefix(p, "olddir=")
+		case p == "follow_path":
+			followPath = true
+		case p == "fail_on_missing_logfile=true":
 			failOnMissingFile = true
-		case "fail_on_missing_logfile=false":
+		case p == "fail_on_missing_logfile=false":
 			failOnMissingFile = false
+		case p == "positions_file":
+			positions, err = fswatcher.LoadPositionsFile(filepath.Join(ctx.basedir, "positions.yaml"), 10*time.Millisecond)
+			if err != nil {
+				fatalf(t, ctx, "%v", err)
+			}
 		default:
 			globs = append(globs, p)
 		}
@@ -624,10 +1361,22 @@ func startFileTailer(t *testing.T, ctx *context, params []string) {
 		}
 		parsedGlobs = append(parsedGlobs, parsedGlob)
 	}
+	opts := fswatcher.Options{
+		Exclude:               exclude,
+		Start:                 start,
+		ReadCompressedBackups: readCompressedBackups,
+		Olddir:                olddir,
+		FollowPath:            followPath,
+		FailOnMissingFile:     failOnMissingFile,
+		Positions:             positions,
+		IdleTimeout:           idleTimeout,
+		PartialLineTimeout:    partialLineTimeout,
+	}
 	if ctx.tailerCfg == fseventTailer {
-		tailer, err = fswatcher.RunFileTailer(parsedGlobs, readall, failOnMissingFile, ctx.log)
+		tailer, err = fswatcher.RunFileTailer(parsedGlobs, opts, ctx.log)
 	} else {
-		tailer, err = fswatcher.RunPollingFileTailer(parsedGlobs, readall, failOnMissingFile, 10*time.Millisecond, ctx.log)
+		opts.PollInterval = 10 * time.Millisecond
+		tailer, err = fswatcher.RunPollingFileTailer(parsedGlobs, opts, ctx.log)
 	}
 	if err != nil {
 		fatalf(t, ctx, "%v", err)
@@ -637,7 +1386,15 @@ func startFileTailer(t *testing.T, ctx *context, params []string) {
 	ctx.linesFromTailer = makeLinesFromTailer(tailer)
 }
 
-func expect(t *testing.T, ctx *context, line string, file string) {
+func parseOffset(t *testing.T, ctx *testContext, param string) int64 {
+	offset, err := strconv.ParseInt(param[strings.LastIndex(param, ":")+1:], 10, 64)
+	if err != nil {
+		fatalf(t, ctx, "syntax error in test: %v: %v", param, err)
+	}
+	return offset
+}
+
+func expect(t *testing.T, ctx *testContext, line string, file string) {
 	actualLine, err := ctx.linesFromTailer.nextLine(filepath.Join(ctx.basedir, file), 500*time.Millisecond)
 	if err != nil {
 		fatalf(t, ctx, "%v: failed to read line %q: %v", file, line, err)
@@ -647,7 +1404,39 @@ func expect(t *testing.T, ctx *context, line string, file string) {
 	}
 }
 
-func fatalf(t *testing.T, ctx *context, format string, args ...interface{}) {
+// check that no lines were read that were not expected yet, for files that should not be read
+func expectNoMoreLines(t *testing.T, ctx *testContext) {
+	for file, lines := range ctx.linesFromTailer.buf {
+		if len(lines) > 0 {
+			fatalf(t, ctx, "%v: read unexpected line %q", file, lines[0])
+		}
+	}
+	select {
+	case line := <-ctx.tailer.Lines():
+		fatalf(t, ctx, "%v: read unexpected line %q", line.File, line.Line)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// check that the tailer has no open file descriptor for the file. This is only checked on Linux.
+func expectClosed(t *testing.T, ctx *testContext, file string) {
+	if runtime.GOOS != "linux" {
+		return
+	}
+	path := filepath.Join(ctx.basedir, file)
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		fatalf(t, ctx, "failed to list open file descriptors: %v", err)
+	}
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && target == path {
+			fatalf(t, ctx, "%v: file is still open", file)
+		}
+	}
+}
+
+func fatalf(t *testing.T, ctx *testContext, format string, args ...interface{}) {
 	ctx.log.Errorf(format, args...) // Don't use ctx.log.Fatalf() here because this calls logger.Exit()
 	t.Fatalf(format, args...)
 }
@@ -736,7 +1525,7 @@ func (opt fileTailerConfig) String() string {
 	}
 }
 
-func mkTempDir(t *testing.T, ctx *context) string {
+func mkTempDir(t *testing.T, ctx *testContext) string {
 	dir, err := ioutil.TempDir("", "grok_exporter")
 	if err != nil {
 		fatalf(t, ctx, "Failed to create test directory: %v", err.Error())
@@ -744,7 +1533,7 @@ func mkTempDir(t *testing.T, ctx *context) string {
 	return dir
 }
 
-func newLogFileWriter(t *testing.T, ctx *context, logfile string) logFileWriter {
+func newLogFileWriter(t *testing.T, ctx *testContext, logfile string) logFileWriter {
 	switch {
 	case ctx.loggerCfg == closeFileAfterEachLine:
 		return newCloseFileAfterEachLineLogFileWriter(t, logfile)
@@ -757,8 +1546,8 @@ func newLogFileWriter(t *testing.T, ctx *context, logfile string) logFileWriter
 }
 
 type logFileWriter interface {
-	writeLine(t *testing.T, ctx *context, line string)
-	close(t *testing.T, ctx *context)
+	writeLine(t *testing.T, ctx *testContext, line string)
+	close(t *testing.T, ctx *testContext)
 }
 
 type closeFileAfterEachLineLogFileWriter struct {
@@ -771,7 +1560,7 @@ func newCloseFileAfterEachLineLogFileWriter(t *testing.T, logfile string) logFil
 	}
 }
 
-func (l *closeFileAfterEachLineLogFileWriter) writeLine(t *testing.T, ctx *context, line string) {
+func (l *closeFileAfterEachLineLogFileWriter) writeLine(t *testing.T, ctx *testContext, line string) {
 	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		fatalf(t, ctx, "%v: Failed to open file for writing: %v", l.path, err.Error())
@@ -795,7 +1584,7 @@ func (l *closeFileAfterEachLineLogFileWriter) writeLine(t *testing.T, ctx *conte
 	ctx.log.Debugf("Wrote log line '%v' with closeFileAfterEachLineLogger.", line)
 }
 
-func (l *closeFileAfterEachLineLogFileWriter) close(t *testing.T, ctx *context) {
+func (l *closeFileAfterEachLineLogFileWriter) close(t *testing.T, ctx *testContext) {
 	// nothing to do
 }
 
@@ -803,7 +1592,7 @@ type keepOpenLogFileWriter struct {
 	file *os.File
 }
 
-func newKeepOpenLogFileWriter(t *testing.T, ctx *context, logfile string) logFileWriter {
+func newKeepOpenLogFileWriter(t *testing.T, ctx *testContext, logfile string) logFileWriter {
 	f, err := os.OpenFile(logfile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		fatalf(t, ctx, "%v: Failed to open file for writing: %v", logfile, err.Error())
@@ -813,7 +1602,7 @@ func newKeepOpenLogFileWriter(t *testing.T, ctx *context, logfile string) logFil
 	}
 }
 
-func (l *keepOpenLogFileWriter) writeLine(t *testing.T, ctx *context, line string) {
+func (l *keepOpenLogFileWriter) writeLine(t *testing.T, ctx *testContext, line string) {
 	_, err := l.file.WriteString(fmt.Sprintf("%v\n", line))
 	if err != nil {
 		fatalf(t, ctx, "%v: Failed to write to file: %v", l.file.Name(), err.Error())
@@ -825,22 +1614,22 @@ func (l *keepOpenLogFileWriter) writeLine(t *testing.T, ctx *context, line strin
 	ctx.log.Debugf("Wrote log line '%v' with keepOpenLogger.", line)
 }
 
-func (l *keepOpenLogFileWriter) close(t *testing.T, ctx *context) {
+func (l *keepOpenLogFileWriter) close(t *testing.T, ctx *testContext) {
 	err := l.file.Close()
 	if err != nil {
 		fatalf(t, ctx, "%v: Failed to close logfile: %v", l.file.Name(), err.Error())
 	}
 }
 
-func tearDown(t *testing.T, ctx *context) {
+func tearDown(t *testing.T, ctx *testContext) {
 	deleteRecursively(t, ctx, ctx.basedir)
 }
 
 // Verbose implementation of os.RemoveAll() to debug a Windows "Access is denied" issue.
-func deleteRecursively(t *testing.T, ctx *context, file string) {
-	fileInfo, err := os.Stat(file)
+func deleteRecursively(t *testing.T, ctx *testContext, file string) {
+	fileInfo, err := os.Lstat(file) // don't follow symlinks
 	if err != nil {
-		fatalf(t, ctx, "tearDown: stat(%q) failed: %v", file, err)
+		fatalf(t, ctx, "tearDown: lstat(%q) failed: %v", file, err)
 	}
 	if fileInfo.IsDir() {
 		for _, childInfo := range ls(t, ctx, file) {
@@ -852,7 +1641,7 @@ func deleteRecursively(t *testing.T, ctx *context, file string) {
 }
 
 // Verbose implementation of os.Remove() to debug a Windows "Access is denied" issue.
-func delete(t *testing.T, ctx *context, file string) {
+func delete(t *testing.T, ctx *testContext, file string) {
 	var (
 		err, statErr error
 		timeout      = 5 * time.Second
@@ -865,7 +1654,7 @@ func delete(t *testing.T, ctx *context, file string) {
 		if err == nil {
 			// Check if the file or directory is really removed. It seems that on Windows, os.Remove() sometimes
 			// returns no error while the file or directory is still there.
-			_, statErr = os.Stat(file)
+			_, statErr = os.Lstat(file)
 			if statErr != nil {
 				if os.IsNotExist(statErr) {
 					// os.Remove(file) was successful, the file or directory is gone.
@@ -930,7 +1719,7 @@ func TestShutdownDuringSendLine(t *testing.T) {
 func runTestShutdown(t *testing.T, mode string) {
 
 	if runtime.GOOS == "windows" {
-		t.Skip("The shutdown tests are flaky on Windows. We skip them until either golang.org/x/exp/winfsnotify is fixed, or until we do our own implementation. This shouldn't be a problem when running grok_exporter, because in grok_exporter the file system watcher is never stopped.")
+		t.Skip("The shutdown tests are flaky on Windows. This shouldn't be a problem when running grok_exporter, because in grok_exporter the file system watcher is never stopped.")
 		return
 	}
 
@@ -944,7 +1733,7 @@ func runTestShutdown(t *testing.T, mode string) {
 	if err != nil {
 		fatalf(t, ctx, "%q: failed to parse glob: %q", parsedGlob, err)
 	}
-	tailer, err := fswatcher.RunFileTailer([]glob.Glob{parsedGlob}, false, true, ctx.log)
+	tailer, err := fswatcher.RunFileTailer([]glob.Glob{parsedGlob}, fswatcher.Options{Start: fswatcher.StartPosition{Type: fswatcher.End}, FailOnMissingFile: true}, ctx.log)
 	if err != nil {
 		fatalf(t, ctx, "failed to start tailer: %v", err)
 	}
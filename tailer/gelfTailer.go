@@ -0,0 +1,284 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// See https://docs.graylog.org/en/latest/pages/gelf.html
+const (
+	maxGelfMessageSize  = 8 * 1024 * 1024 // limit for decompressed and re-assembled messages
+	maxGelfChunks       = 128
+	maxGelfPendingChunk = 1000 // maximum number of incomplete chunked messages
+	gelfChunkTimeout    = 5 * time.Second
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+type gelfTailer struct {
+	lines     chan *fswatcher.Line
+	errors    chan fswatcher.Error
+	packet    net.PacketConn // UDP
+	listener  net.Listener   // TCP
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// chunkedGelfMessage collects the chunks of a message sent in multiple UDP datagrams.
+type chunkedGelfMessage struct {
+	chunks    [][]byte
+	received  int
+	firstSeen time.Time
+}
+
+// gelfChunks maps message ids to incomplete messages.
+// Complete and expired messages are removed by rebuilding the map in expire().
+type gelfChunks struct {
+	messages   map[[8]byte]*chunkedGelfMessage
+	lastExpire time.Time
+}
+
+func (t *gelfTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *gelfTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *gelfTailer) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		if t.packet != nil {
+			_ = t.packet.Close()
+		}
+		if t.listener != nil {
+			_ = t.listener.Close()
+		}
+	})
+}
+
+// RunGelfTailer receives GELF messages from Graylog shippers. With UDP, messages may be chunked
+// and compressed with gzip or zlib. With TCP, messages are uncompressed and terminated by a null byte.
+// The short_message is the log line, and the entire GELF message is available as extra.
+func RunGelfTailer(cfg *configuration.InputConfig) (fswatcher.FileTailer, error) {
+	t := &gelfTailer{
+		lines:  make(chan *fswatcher.Line),
+		errors: make(chan fswatcher.Error),
+		done:   make(chan struct{}),
+	}
+	var err error
+	switch cfg.GelfProtocol {
+	case "udp":
+		t.packet, err = net.ListenPacket("udp", cfg.GelfAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for GELF messages on udp %v: %v", cfg.GelfAddress, err)
+		}
+		go t.receivePackets()
+	case "tcp":
+		t.listener, err = net.Listen("tcp", cfg.GelfAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for GELF messages on tcp %v: %v", cfg.GelfAddress, err)
+		}
+		go t.acceptConnections()
+	default:
+		return nil, fmt.Errorf("unsupported GELF protocol %q", cfg.GelfProtocol)
+	}
+	return t, nil
+}
+
+func (t *gelfTailer) receivePackets() {
+	buf := make([]byte, 64*1024)
+	chunks := &gelfChunks{messages: make(map[[8]byte]*chunkedGelfMessage)}
+	for {
+		n, addr, err := t.packet.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-t.done:
+			case t.errors <- fswatcher.NewError(fswatcher.NotSpecified, err, "gelf: failed to read udp packet"):
+			}
+			return
+		}
+		data := buf[:n]
+		if bytes.HasPrefix(data, gelfChunkMagic) {
+			data, err = chunks.add(data, time.Now())
+			if err != nil {
+				logrus.Warnf("gelf: dropping chunk from %v: %v", addr, err)
+				continue
+			}
+			if data == nil {
+				continue // message incomplete
+			}
+		}
+		line, err := parseGelfMessage(data)
+		if err != nil {
+			// Invalid messages are not sent to the errors channel, because they should not terminate grok_exporter.
+			logrus.Warnf("gelf: dropping message from %v: %v", addr, err)
+			continue
+		}
+		select {
+		case t.lines <- line:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// add adds a chunk, and returns the re-assembled message when all chunks are received.
+// The chunk header is the magic bytes, 8 bytes message id, 1 byte sequence number, and 1 byte sequence count.
+func (c *gelfChunks) add(chunk []byte, now time.Time) ([]byte, error) {
+	if now.Sub(c.lastExpire) > time.Second {
+		c.expire(now)
+	}
+	if len(chunk) < 12 {
+		return nil, fmt.Errorf("chunk too short")
+	}
+	var id [8]byte
+	copy(id[:], chunk[2:10])
+	seq, count := int(chunk[10]), int(chunk[11])
+	if count == 0 || count > maxGelfChunks || seq >= count {
+		return nil, fmt.Errorf("invalid chunk sequence number %v/%v", seq, count)
+	}
+	msg, exists := c.messages[id]
+	if !exists || msg.received == -1 {
+		if len(c.messages) >= maxGelfPendingChunk {
+			return nil, fmt.Errorf("too many incomplete chunked messages")
+		}
+		msg = &chunkedGelfMessage{chunks: make([][]byte, count), firstSeen: now}
+		c.messages[id] = msg
+	}
+	if len(msg.chunks) != count {
+		return nil, fmt.Errorf("inconsistent chunk sequence count")
+	}
+	if msg.chunks[seq] != nil {
+		return nil, nil // duplicate
+	}
+	// copy, because the chunk's underlying buffer is re-used for the next packet
+	msg.chunks[seq] = append([]byte{}, chunk[12:]...)
+	msg.received++
+	if msg.received < count {
+		return nil, nil
+	}
+	msg.received = -1 // mark as complete, will be removed in expire()
+	return bytes.Join(msg.chunks, nil), nil
+}
+
+func (c *gelfChunks) expire(now time.Time) {
+	messages := make(map[[8]byte]*chunkedGelfMessage, len(c.messages))
+	for id, msg := range c.messages {
+		if msg.received != -1 && now.Sub(msg.firstSeen) < gelfChunkTimeout {
+			messages[id] = msg
+		}
+	}
+	c.messages = messages
+	c.lastExpire = now
+}
+
+func (t *gelfTailer) acceptConnections() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.done:
+			case t.errors <- fswatcher.NewError(fswatcher.NotSpecified, err, "gelf: failed to accept tcp connection"):
+			}
+			return
+		}
+		go t.receiveStream(conn)
+	}
+}
+
+func (t *gelfTailer) receiveStream(conn net.Conn) {
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		// close the connection when the tailer is closed, so that the read below returns
+		select {
+		case <-t.done:
+		case <-connDone:
+		}
+		_ = conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		data, err := reader.ReadBytes(0)
+		data = bytes.TrimRight(data, "\x00\n")
+		if len(data) > 0 {
+			line, parseErr := parseGelfMessage(data)
+			if parseErr != nil {
+				logrus.Warnf("gelf: dropping message from %v: %v", conn.RemoteAddr(), parseErr)
+			} else {
+				select {
+				case t.lines <- line:
+				case <-t.done:
+					return
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// parseGelfMessage decompresses the message if necessary, and parses the JSON.
+func parseGelfMessage(data []byte) (*fswatcher.Line, error) {
+	var (
+		reader io.Reader
+		err    error
+	)
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) >= 2 && data[0] == 0x78 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		reader = bytes.NewReader(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %v", err)
+	}
+	data, err = ioutil.ReadAll(io.LimitReader(reader, maxGelfMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %v", err)
+	}
+	if len(data) > maxGelfMessageSize {
+		return nil, fmt.Errorf("message exceeds %v bytes", maxGelfMessageSize)
+	}
+	var msg map[string]interface{}
+	err = json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GELF message: %v", err)
+	}
+	shortMessage, ok := msg["short_message"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid GELF message: 'short_message' is missing")
+	}
+	return &fswatcher.Line{Line: shortMessage, Extra: msg, ReadTime: time.Now()}, nil
+}
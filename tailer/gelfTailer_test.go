@@ -0,0 +1,161 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"net"
+	"testing"
+	"time"
+)
+
+const gelfMessage = `{"version": "1.1", "host": "example.org", "short_message": "A short message", "level": 1, "_user_id": 9001}`
+
+func TestGelfUncompressed(t *testing.T) {
+	line, err := parseGelfMessage([]byte(gelfMessage))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectGelfLine(t, line.Line, line.Extra)
+}
+
+func TestGelfGzip(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(gelfMessage))
+	w.Close()
+	line, err := parseGelfMessage(buf.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectGelfLine(t, line.Line, line.Extra)
+}
+
+func TestGelfZlib(t *testing.T) {
+	line, err := parseGelfMessage(zlibCompress([]byte(gelfMessage)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectGelfLine(t, line.Line, line.Extra)
+}
+
+func TestGelfMissingShortMessage(t *testing.T) {
+	_, err := parseGelfMessage([]byte(`{"version": "1.1", "host": "example.org"}`))
+	if err == nil {
+		t.Fatal("expected error for message without short_message")
+	}
+}
+
+func TestGelfChunks(t *testing.T) {
+	chunks := &gelfChunks{messages: make(map[[8]byte]*chunkedGelfMessage)}
+	now := time.Now()
+	// chunks may arrive in any order
+	for _, chunk := range splitIntoGelfChunks([]byte(gelfMessage), 3, 1)[1:] {
+		msg, err := chunks.add(chunk, now)
+		if err != nil || msg != nil {
+			t.Fatalf("expected incomplete message, but got %q, %v", msg, err)
+		}
+	}
+	msg, err := chunks.add(splitIntoGelfChunks([]byte(gelfMessage), 3, 1)[0], now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(msg) != gelfMessage {
+		t.Fatalf("expected %q, but got %q", gelfMessage, msg)
+	}
+	// incomplete messages expire
+	chunks.add(splitIntoGelfChunks([]byte(gelfMessage), 3, 2)[0], now)
+	chunks.expire(now.Add(gelfChunkTimeout))
+	if len(chunks.messages) != 0 {
+		t.Fatalf("expected all messages to be expired, but found %v", len(chunks.messages))
+	}
+}
+
+func TestGelfUdp(t *testing.T) {
+	tail, err := RunGelfTailer(&configuration.InputConfig{GelfProtocol: "udp", GelfAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer tail.Close()
+	conn, err := net.Dial("udp", tail.(*gelfTailer).packet.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	for _, chunk := range splitIntoGelfChunks(zlibCompress([]byte(gelfMessage)), 2, 3) {
+		_, err = conn.Write(chunk)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	line := receiveLine(t, tail)
+	expectGelfLine(t, line.Line, line.Extra)
+}
+
+func TestGelfTcp(t *testing.T) {
+	tail, err := RunGelfTailer(&configuration.InputConfig{GelfProtocol: "tcp", GelfAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer tail.Close()
+	conn, err := net.Dial("tcp", tail.(*gelfTailer).listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(gelfMessage + "\x00" + gelfMessage + "\x00"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		line := receiveLine(t, tail)
+		expectGelfLine(t, line.Line, line.Extra)
+	}
+}
+
+func expectGelfLine(t *testing.T, line string, extra interface{}) {
+	if line != "A short message" {
+		t.Fatalf("expected line %q, but got %q", "A short message", line)
+	}
+	fields := extra.(map[string]interface{})
+	if fields["host"] != "example.org" || fields["_user_id"] != float64(9001) {
+		t.Fatalf("unexpected extra fields: %v", fields)
+	}
+}
+
+func zlibCompress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func splitIntoGelfChunks(data []byte, n int, id byte) [][]byte {
+	var result [][]byte
+	size := (len(data) + n - 1) / n
+	for i := 0; i < n; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := append([]byte{0x1e, 0x0f, id, 0, 0, 0, 0, 0, 0, 0, byte(i), byte(n)}, data[i*size:end]...)
+		result = append(result, chunk)
+	}
+	return result
+}
@@ -18,8 +18,12 @@ import (
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
+// recursiveWildcard is a directory in a glob that matches zero or more directories, like in /var/log/**/*.log
+const recursiveWildcard = "**"
+
 type Glob string
 
 func Parse(pattern string) (Glob, error) {
@@ -36,19 +40,74 @@ func Parse(pattern string) (Glob, error) {
 		return "", fmt.Errorf("%q: failed to find absolute path for glob pattern: %v", pattern, err)
 	}
 	result = Glob(absglob)
-	if containsWildcards(result.Dir()) {
-		return "", fmt.Errorf("%q: wildcards are only allowed in the file name, but not in the directory path", pattern)
+	if filepath.Base(absglob) == recursiveWildcard {
+		return "", fmt.Errorf("%q: '%v' matches directories, the glob pattern must end with a file name like '%v/*'", pattern, recursiveWildcard, recursiveWildcard)
+	}
+	for _, dir := range strings.Split(filepath.Dir(absglob), string(filepath.Separator)) {
+		if dir != recursiveWildcard && containsWildcards(dir) {
+			return "", fmt.Errorf("%q: wildcards are only allowed in the file name, but not in the directory path, except for '%v'", pattern, recursiveWildcard)
+		}
 	}
 	return result, nil
 }
 
+// Dir is the directory where the files matching the glob are located.
+// If the glob is recursive, this is the directory before the first '**', and matching files may also be in its subdirectories.
 func (g Glob) Dir() string {
+	dirs := strings.Split(string(g), string(filepath.Separator))
+	for i, dir := range dirs {
+		if dir == recursiveWildcard {
+			return filepath.Clean(strings.Join(dirs[:i], string(filepath.Separator)) + string(filepath.Separator))
+		}
+	}
 	return filepath.Dir(string(g))
 }
 
+// IsRecursive is true if the glob contains '**'.
+func (g Glob) IsRecursive() bool {
+	for _, dir := range strings.Split(string(g), string(filepath.Separator)) {
+		if dir == recursiveWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// IncludesSubdir is true if files in a subdirectory of g.Dir() may match the glob.
+func (g Glob) IncludesSubdir(path string) bool {
+	prefix := g.Dir()
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return g.IsRecursive() && strings.HasPrefix(path, prefix)
+}
+
 func (g Glob) Match(path string) bool {
-	matched, _ := filepath.Match(string(g), path)
-	return matched
+	if !g.IsRecursive() {
+		matched, _ := filepath.Match(string(g), path)
+		return matched
+	}
+	return matchDirs(strings.Split(string(g), string(filepath.Separator)), strings.Split(path, string(filepath.Separator)))
+}
+
+// matchDirs matches the path elements one by one, '**' matches any number of path elements.
+func matchDirs(pattern []string, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == recursiveWildcard {
+		for i := 0; i <= len(path); i++ {
+			if matchDirs(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	matched, _ := filepath.Match(pattern[0], path[0])
+	return matched && matchDirs(pattern[1:], path[1:])
 }
 
 func containsWildcards(pattern string) bool {
@@ -0,0 +1,75 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package glob
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRecursiveGlob(t *testing.T) {
+	g, err := Parse(filepath.FromSlash("/var/log/apps/**/*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := func(path string) string {
+		result, err := filepath.Abs(filepath.FromSlash(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if !g.IsRecursive() {
+		t.Fatalf("%v: expected recursive glob", g)
+	}
+	if g.Dir() != abs("/var/log/apps") {
+		t.Fatalf("%v: unexpected dir %v", g, g.Dir())
+	}
+	for path, expected := range map[string]bool{
+		"/var/log/apps/a.log":         true,
+		"/var/log/apps/pod-1/a.log":   true,
+		"/var/log/apps/pod-1/x/a.log": true,
+		"/var/log/apps/pod-1/a.txt":   false,
+		"/var/log/a.log":              false,
+		"/var/log/appsx/a.log":        false,
+	} {
+		if g.Match(abs(path)) != expected {
+			t.Errorf("%v: expected match %v to be %v", g, path, expected)
+		}
+	}
+	for path, expected := range map[string]bool{
+		"/var/log/apps/pod-1":   true,
+		"/var/log/apps/pod-1/x": true,
+		"/var/log/appsx":        false,
+		"/var/log":              false,
+	} {
+		if g.IncludesSubdir(abs(path)) != expected {
+			t.Errorf("%v: expected subdir %v to be %v", g, path, expected)
+		}
+	}
+}
+
+func TestInvalidRecursiveGlob(t *testing.T) {
+	for _, pattern := range []string{"/var/log/**", "/var/log/a**/*.log", "/var/*/**/*.log"} {
+		_, err := Parse(filepath.FromSlash(pattern))
+		if err == nil {
+			t.Errorf("%v: expected error", pattern)
+		}
+	}
+	_, err := Parse(filepath.FromSlash("/var/**/log/**/*.log"))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	osexec "os/exec"
+	"strings"
+	"time"
+)
+
+const maxJournalEntrySize = 1024 * 1024
+
+type journaldTailer struct {
+	lines  chan *fswatcher.Line
+	errors chan fswatcher.Error
+	cmd    *osexec.Cmd
+	done   chan struct{}
+}
+
+func (t *journaldTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *journaldTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *journaldTailer) Close() {
+	close(t.done)
+	if t.cmd.Process != nil {
+		_ = t.cmd.Process.Kill()
+	}
+}
+
+// RunJournaldTailer follows the systemd journal.
+// We run 'journalctl --follow --output=json' instead of using libsystemd's sd-journal API,
+// because we don't want another cgo dependency in addition to Oniguruma.
+func RunJournaldTailer(cfg *configuration.InputConfig) (fswatcher.FileTailer, error) {
+	t := &journaldTailer{
+		lines:  make(chan *fswatcher.Line),
+		errors: make(chan fswatcher.Error),
+		cmd:    osexec.Command("journalctl", journalctlArgs(cfg)...),
+		done:   make(chan struct{}),
+	}
+	stdout, err := t.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the output of journalctl: %v", err)
+	}
+	err = t.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run journalctl: %v", err)
+	}
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), maxJournalEntrySize)
+		for scanner.Scan() {
+			line, err := parseJournalEntry(scanner.Bytes())
+			if err != nil {
+				t.sendError(fswatcher.NewError(fswatcher.NotSpecified, err, "journald"))
+				return
+			}
+			select {
+			case t.lines <- line:
+			case <-t.done:
+				return
+			}
+		}
+		err := scanner.Err()
+		if waitErr := t.cmd.Wait(); err == nil {
+			err = waitErr
+		}
+		t.sendError(fswatcher.NewErrorf(fswatcher.NotSpecified, err, "journalctl terminated"))
+	}()
+	return t, nil
+}
+
+func (t *journaldTailer) sendError(err fswatcher.Error) {
+	select {
+	case t.errors <- err:
+	case <-t.done:
+	}
+}
+
+func journalctlArgs(cfg *configuration.InputConfig) []string {
+	args := []string{"--follow", "--output=json", "--no-pager"}
+	if cfg.Readall {
+		args = append(args, "--lines=all")
+	} else {
+		args = append(args, "--lines=0")
+	}
+	for _, unit := range cfg.JournaldUnits {
+		args = append(args, "--unit="+unit)
+	}
+	return args
+}
+
+// parseJournalEntry converts an entry of journalctl's JSON output into a line.
+// The MESSAGE field becomes the log line, all fields are available as extra (like _SYSTEMD_UNIT or PRIORITY).
+func parseJournalEntry(data []byte) (*fswatcher.Line, error) {
+	var entry map[string]interface{}
+	err := json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse journal entry: %v", err)
+	}
+	var message string
+	switch m := entry["MESSAGE"].(type) {
+	case string:
+		message = m
+	case []interface{}:
+		// journalctl encodes messages that are not valid UTF-8 as an array of bytes.
+		b := make([]byte, 0, len(m))
+		for _, n := range m {
+			if f, ok := n.(float64); ok {
+				b = append(b, byte(f))
+			}
+		}
+		message = string(b)
+	}
+	return &fswatcher.Line{Line: strings.TrimRight(message, "\r\n"), Extra: entry, ReadTime: time.Now()}, nil
+}
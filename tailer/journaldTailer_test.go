@@ -0,0 +1,77 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"strings"
+	"testing"
+)
+
+func TestJournaldStringMessage(t *testing.T) {
+	entry := `{"MESSAGE":"Accepted publickey for root from 10.0.0.1 port 22\n","_SYSTEMD_UNIT":"sshd.service","PRIORITY":"6"}`
+	line, err := parseJournalEntry([]byte(entry))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if line.Line != "Accepted publickey for root from 10.0.0.1 port 22" {
+		t.Fatalf("unexpected line: %q", line.Line)
+	}
+	extra, ok := line.Extra.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected extra to be the journal entry, but got %T", line.Extra)
+	}
+	if extra["_SYSTEMD_UNIT"] != "sshd.service" {
+		t.Fatalf("expected _SYSTEMD_UNIT to be sshd.service, but got %v", extra["_SYSTEMD_UNIT"])
+	}
+}
+
+func TestJournaldByteArrayMessage(t *testing.T) {
+	// "hello\xff"
+	entry := `{"MESSAGE":[104,101,108,108,111,255],"_SYSTEMD_UNIT":"test.service"}`
+	line, err := parseJournalEntry([]byte(entry))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if line.Line != "hello\xff" {
+		t.Fatalf("unexpected line: %q", line.Line)
+	}
+}
+
+func TestJournaldInvalidEntry(t *testing.T) {
+	_, err := parseJournalEntry([]byte(`{"MESSAGE":`))
+	if err == nil {
+		t.Fatal("expected error for invalid journal entry")
+	}
+}
+
+func TestJournalctlArgs(t *testing.T) {
+	args := journalctlArgs(&configuration.InputConfig{
+		Type:          "journald",
+		JournaldUnits: []string{"sshd.service", "nginx.service"},
+	})
+	expected := "--follow --output=json --no-pager --lines=0 --unit=sshd.service --unit=nginx.service"
+	if strings.Join(args, " ") != expected {
+		t.Fatalf("expected %q, but got %q", expected, strings.Join(args, " "))
+	}
+	args = journalctlArgs(&configuration.InputConfig{
+		Type:    "journald",
+		Readall: true,
+	})
+	expected = "--follow --output=json --no-pager --lines=all"
+	if strings.Join(args, " ") != expected {
+		t.Fatalf("expected %q, but got %q", expected, strings.Join(args, " "))
+	}
+}
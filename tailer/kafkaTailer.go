@@ -3,6 +3,7 @@ package tailer
 import (
 	ctx "context"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	configuration "github.com/fstab/grok_exporter/config/v3"
@@ -153,7 +154,7 @@ func (consumer *consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 	for message := range claim.Messages() {
 		logrus.Debugf("[Kafka] Message content: %s", string(message.Value))
 		session.MarkMessage(message, "")
-		consumer.lineChan <- &fswatcher.Line{Line: string(message.Value)}
+		consumer.lineChan <- &fswatcher.Line{Line: string(message.Value), ReadTime: time.Now()}
 	}
 
 	return nil
@@ -0,0 +1,328 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	ctx "context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesResyncInterval is how often the list of pods is refreshed. Variable so that tests can change it.
+var kubernetesResyncInterval = 10 * time.Second
+
+type kubernetesTailer struct {
+	lines   chan *fswatcher.Line
+	errors  chan fswatcher.Error
+	done    chan struct{}
+	ctx     ctx.Context // cancelled when the tailer is closed, so that pending requests return
+	cancel  ctx.CancelFunc
+	cfg     *configuration.InputConfig
+	baseUrl string
+	token   string
+	client  *http.Client
+	lock    sync.Mutex
+	streams map[string]*containerStream // key is namespace/pod/container
+	wg      sync.WaitGroup
+}
+
+type containerStream struct {
+	namespace, pod, container, node string
+	active                          bool      // guarded by kubernetesTailer.lock
+	since                           time.Time // timestamp of the last line read, zero if nothing was read yet
+	fromStart                       bool      // read the log from the beginning when the stream is started
+}
+
+// The subset of the Kubernetes API types we need.
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName   string `json:"nodeName"`
+			Containers []struct {
+				Name string `json:"name"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+func (t *kubernetesTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *kubernetesTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *kubernetesTailer) Close() {
+	close(t.done)
+	t.cancel()
+	t.wg.Wait()
+}
+
+// RunKubernetesTailer streams the logs of all pods matching the configured namespace and label selector.
+// We use the Kubernetes REST API directly rather than client-go, because client-go would add a huge dependency
+// for the two API calls we need. The namespace, pod, container, and node name are available as extra.
+func RunKubernetesTailer(cfg *configuration.InputConfig) (fswatcher.FileTailer, error) {
+	t := &kubernetesTailer{
+		lines:   make(chan *fswatcher.Line),
+		errors:  make(chan fswatcher.Error),
+		done:    make(chan struct{}),
+		cfg:     cfg,
+		streams: make(map[string]*containerStream),
+	}
+	t.ctx, t.cancel = ctx.WithCancel(ctx.Background())
+	err := t.initClient()
+	if err != nil {
+		t.cancel()
+		return nil, err
+	}
+	// Fail early if the API server is not reachable or if we are not allowed to list pods.
+	pods, err := t.listPods()
+	if err != nil {
+		t.cancel()
+		return nil, err
+	}
+	t.syncStreams(pods, cfg.Readall)
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(kubernetesResyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+				pods, err := t.listPods()
+				if err != nil {
+					// The API server might be temporarily unavailable, e.g. during a cluster upgrade.
+					logrus.Warnf("kubernetes: %v", err)
+					continue
+				}
+				t.syncStreams(pods, true)
+			}
+		}
+	}()
+	return t, nil
+}
+
+func (t *kubernetesTailer) initClient() error {
+	var (
+		tlsConfig = &tls.Config{}
+		err       error
+	)
+	t.baseUrl = t.cfg.KubernetesApiServer
+	if t.baseUrl == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return fmt.Errorf("kubernetes: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set. Either run grok_exporter within a Kubernetes pod, or configure 'input.kubernetes_api_server'")
+		}
+		t.baseUrl = "https://" + net.JoinHostPort(host, port)
+	}
+	t.baseUrl = strings.TrimSuffix(t.baseUrl, "/")
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err == nil {
+		t.token = strings.TrimSpace(string(token))
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("kubernetes: failed to read service account token: %v", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err == nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("kubernetes: failed to load %v/ca.crt", serviceAccountDir)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("kubernetes: failed to read service account CA certificate: %v", err)
+	}
+	// No timeout, because log streams are long-running requests.
+	t.client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment}}
+	return nil
+}
+
+func (t *kubernetesTailer) get(path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(t.ctx, "GET", t.baseUrl+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %v: %v: %v", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (t *kubernetesTailer) listPods() (*podList, error) {
+	path := "/api/v1/pods"
+	if t.cfg.KubernetesNamespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(t.cfg.KubernetesNamespace) + "/pods"
+	}
+	query := url.Values{}
+	if t.cfg.KubernetesLabelSelector != "" {
+		query.Set("labelSelector", t.cfg.KubernetesLabelSelector)
+	}
+	resp, err := t.get(path, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	defer resp.Body.Close()
+	result := &podList{}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	return result, nil
+}
+
+// syncStreams starts streaming logs of running containers that aren't streamed yet.
+// If fromStart is false, only lines written after grok_exporter started are read.
+func (t *kubernetesTailer) syncStreams(pods *podList, fromStart bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// Containers that are no longer listed are dropped from the map, so that we don't leak memory if pods come and go.
+	streams := make(map[string]*containerStream)
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Running" {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			if t.cfg.KubernetesContainer != "" && t.cfg.KubernetesContainer != container.Name {
+				continue
+			}
+			key := pod.Metadata.Namespace + "/" + pod.Metadata.Name + "/" + container.Name
+			stream, exists := t.streams[key]
+			if !exists {
+				stream = &containerStream{
+					namespace: pod.Metadata.Namespace,
+					pod:       pod.Metadata.Name,
+					container: container.Name,
+					node:      pod.Spec.NodeName,
+					fromStart: fromStart,
+				}
+			}
+			streams[key] = stream
+			if stream.active {
+				continue
+			}
+			stream.active = true
+			t.wg.Add(1)
+			go func() {
+				defer t.wg.Done()
+				err := t.follow(stream)
+				if err != nil {
+					logrus.Warnf("kubernetes: failed to read logs of %v/%v container %v: %v", stream.namespace, stream.pod, stream.container, err)
+				}
+				// The stream ends when the container terminates. If it is restarted, the next resync starts a new stream.
+				t.lock.Lock()
+				stream.active = false
+				stream.fromStart = true
+				t.lock.Unlock()
+			}()
+		}
+	}
+	t.streams = streams
+}
+
+func (t *kubernetesTailer) follow(stream *containerStream) error {
+	query := url.Values{}
+	query.Set("follow", "true")
+	query.Set("timestamps", "true")
+	query.Set("container", stream.container)
+	if !stream.since.IsZero() {
+		// sinceTime has a resolution of seconds, so we get some lines again and skip them below.
+		query.Set("sinceTime", stream.since.UTC().Format(time.RFC3339))
+	} else if !stream.fromStart {
+		query.Set("tailLines", "0")
+	}
+	resp, err := t.get("/api/v1/namespaces/"+url.PathEscape(stream.namespace)+"/pods/"+url.PathEscape(stream.pod)+"/log", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxJournalEntrySize)
+	for scanner.Scan() {
+		timestamp, line := splitKubernetesTimestamp(scanner.Text())
+		if !timestamp.IsZero() {
+			if !timestamp.After(stream.since) {
+				continue
+			}
+			stream.since = timestamp
+		}
+		select {
+		case t.lines <- &fswatcher.Line{Line: line, Extra: map[string]interface{}{
+			"namespace": stream.namespace,
+			"pod":       stream.pod,
+			"container": stream.container,
+			"node":      stream.node,
+		}, ReadTime: time.Now()}:
+		case <-t.done:
+			return nil
+		}
+	}
+	select {
+	case <-t.done:
+		return nil
+	default:
+		return scanner.Err()
+	}
+}
+
+// splitKubernetesTimestamp splits a line as returned with timestamps=true, like "2020-05-01T12:00:00.123456789Z message".
+func splitKubernetesTimestamp(line string) (time.Time, string) {
+	space := strings.IndexByte(line, ' ')
+	if space < 0 {
+		space = len(line)
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, line[:space])
+	if err != nil {
+		return time.Time{}, line
+	}
+	if space == len(line) {
+		return timestamp, ""
+	}
+	return timestamp, line[space+1:]
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const podListJson = `{"items": [
+	{"metadata": {"name": "web-1", "namespace": "shop"}, "spec": {"nodeName": "node-a", "containers": [{"name": "nginx"}, {"name": "sidecar"}]}, "status": {"phase": "Running"}},
+	{"metadata": {"name": "web-2", "namespace": "shop"}, "spec": {"nodeName": "node-b", "containers": [{"name": "nginx"}]}, "status": {"phase": "Pending"}}
+]}`
+
+func TestKubernetes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/shop/pods":
+			if r.URL.Query().Get("labelSelector") != "app=web" {
+				http.Error(w, "unexpected label selector", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, podListJson)
+		case "/api/v1/namespaces/shop/pods/web-1/log":
+			if r.URL.Query().Get("container") != "nginx" || r.URL.Query().Get("follow") != "true" {
+				http.Error(w, "unexpected query", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "2020-05-01T12:00:00.000000001Z GET /index.html 200\n")
+			fmt.Fprint(w, "2020-05-01T12:00:01.000000001Z GET /missing.html 404\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	tail, err := RunKubernetesTailer(&configuration.InputConfig{
+		Type:                    "kubernetes",
+		Readall:                 true,
+		KubernetesApiServer:     server.URL,
+		KubernetesNamespace:     "shop",
+		KubernetesLabelSelector: "app=web",
+		KubernetesContainer:     "nginx",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer tail.Close()
+	for _, expected := range []string{"GET /index.html 200", "GET /missing.html 404"} {
+		select {
+		case line := <-tail.Lines():
+			if line.Line != expected {
+				t.Fatalf("expected line %q, but got %q", expected, line.Line)
+			}
+			extra := line.Extra.(map[string]interface{})
+			if extra["namespace"] != "shop" || extra["pod"] != "web-1" || extra["container"] != "nginx" || extra["node"] != "node-a" {
+				t.Fatalf("unexpected extra fields: %v", extra)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout while waiting for line %q", expected)
+		}
+	}
+}
+
+func TestKubernetesForbidden(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "pods is forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+	_, err := RunKubernetesTailer(&configuration.InputConfig{
+		Type:                "kubernetes",
+		KubernetesApiServer: server.URL,
+	})
+	if err == nil {
+		t.Fatal("expected error when listing pods is forbidden")
+	}
+}
+
+func TestSplitKubernetesTimestamp(t *testing.T) {
+	timestamp, line := splitKubernetesTimestamp("2020-05-01T12:00:00.123456789Z hello world")
+	if line != "hello world" || timestamp.Nanosecond() != 123456789 {
+		t.Fatalf("unexpected result: %v %q", timestamp, line)
+	}
+	timestamp, line = splitKubernetesTimestamp("no timestamp")
+	if line != "no timestamp" || !timestamp.IsZero() {
+		t.Fatalf("unexpected result: %v %q", timestamp, line)
+	}
+}
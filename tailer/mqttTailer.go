@@ -0,0 +1,408 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types, see http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttKeepAlive  = 60 * time.Second
+	maxMqttMessage = 8 * 1024 * 1024
+)
+
+type mqttTailer struct {
+	lines     chan *fswatcher.Line
+	errors    chan fswatcher.Error
+	done      chan struct{}
+	closeOnce sync.Once
+	cfg       *configuration.InputConfig
+	url       *url.URL
+	clientId  string
+	lock      sync.Mutex
+	conn      net.Conn      // current connection, closed in Close() to interrupt reading
+	pending   []*mqttPacket // PUBLISH packets received before SUBACK
+}
+
+type mqttPacket struct {
+	header byte
+	body   []byte
+}
+
+func (t *mqttTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *mqttTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *mqttTailer) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if t.conn != nil {
+			_ = t.conn.Close()
+		}
+	})
+}
+
+// RunMqttTailer subscribes to MQTT topics, each message is a log line.
+// We implement the subset of MQTT 3.1.1 needed for subscribing directly, rather than adding a client library.
+// Messages are received with QoS 1. If a client id is configured, the session is kept on the broker,
+// so that messages published while grok_exporter is reconnecting are not lost.
+func RunMqttTailer(cfg *configuration.InputConfig) (fswatcher.FileTailer, error) {
+	u, err := url.Parse(cfg.MqttUrl)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: invalid url: %v", err)
+	}
+	t := &mqttTailer{
+		lines:    make(chan *fswatcher.Line),
+		errors:   make(chan fswatcher.Error),
+		done:     make(chan struct{}),
+		cfg:      cfg,
+		url:      u,
+		clientId: cfg.MqttClientId,
+	}
+	if t.clientId == "" {
+		random := make([]byte, 4)
+		_, _ = rand.Read(random)
+		t.clientId = "grok_exporter-" + hex.EncodeToString(random)
+	}
+	// Fail early if the initial connection fails, later connection errors are retried.
+	reader, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		delay := time.Second
+		for {
+			err := t.receive(reader)
+			select {
+			case <-t.done:
+				return
+			default:
+			}
+			logrus.Warnf("mqtt: connection to %v lost: %v", t.url.Host, err)
+			for {
+				select {
+				case <-t.done:
+					return
+				case <-time.After(delay):
+				}
+				reader, err = t.connect()
+				if err == nil {
+					delay = time.Second
+					break
+				}
+				logrus.Warnf("mqtt: %v", err)
+				if delay < maxReconnectDelay {
+					delay *= 2
+				}
+			}
+		}
+	}()
+	return t, nil
+}
+
+func (t *mqttTailer) connect() (*bufio.Reader, error) {
+	var (
+		conn net.Conn
+		err  error
+		host = t.url.Host
+		tlsc = t.url.Scheme == "ssl" || t.url.Scheme == "tls" || t.url.Scheme == "mqtts"
+	)
+	if t.url.Port() == "" {
+		port := "1883"
+		if tlsc {
+			port = "8883"
+		}
+		host = net.JoinHostPort(t.url.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if tlsc {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: t.url.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %v: %v", host, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// CONNECT
+	var flags byte = 0
+	if t.cfg.MqttClientId == "" {
+		// Clean session, because with a random client id the session could never be resumed.
+		flags |= 0x02
+	}
+	payload := mqttString(t.clientId)
+	if t.url.User != nil {
+		flags |= 0x80
+		payload = append(payload, mqttString(t.url.User.Username())...)
+		if password, ok := t.url.User.Password(); ok {
+			flags |= 0x40
+			payload = append(payload, mqttString(password)...)
+		}
+	}
+	variableHeader := append(mqttString("MQTT"), 4, flags, byte(mqttKeepAlive/time.Second>>8), byte(mqttKeepAlive/time.Second))
+	err = writeMqttPacket(conn, mqttConnect<<4, append(variableHeader, payload...))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%v: %v", host, err)
+	}
+	packetType, body, err := readMqttPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%v: %v", host, err)
+	}
+	if packetType>>4 != mqttConnack || len(body) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("%v: expected CONNACK from broker", host)
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("%v: connection refused: %v", host, mqttConnackError(body[1]))
+	}
+
+	// SUBSCRIBE
+	subscribe := []byte{0, 1} // packet identifier
+	for _, topic := range t.cfg.MqttTopics {
+		subscribe = append(subscribe, mqttString(topic)...)
+		subscribe = append(subscribe, 1) // QoS 1
+	}
+	err = writeMqttPacket(conn, mqttSubscribe<<4|0x02, subscribe)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%v: %v", host, err)
+	}
+	// The broker may send queued PUBLISH packets from the previous session before SUBACK.
+	var pending []*mqttPacket
+	for {
+		packetType, body, err = readMqttPacket(reader)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v: %v", host, err)
+		}
+		if packetType>>4 == mqttSuback {
+			break
+		}
+		if packetType>>4 == mqttPublish {
+			pending = append(pending, &mqttPacket{header: packetType, body: body})
+		}
+	}
+	if len(body) < 2 || !bytes.Equal(body[:2], []byte{0, 1}) {
+		conn.Close()
+		return nil, fmt.Errorf("%v: invalid SUBACK from broker", host)
+	}
+	for i, rc := range body[2:] {
+		if rc == 0x80 && i < len(t.cfg.MqttTopics) {
+			conn.Close()
+			return nil, fmt.Errorf("%v: subscription to topic %q refused by broker", host, t.cfg.MqttTopics[i])
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	select {
+	case <-t.done:
+		conn.Close()
+		return nil, fmt.Errorf("closed")
+	default:
+	}
+	t.conn = conn
+	t.pending = pending
+	return reader, nil
+}
+
+// receive reads messages until the connection fails.
+func (t *mqttTailer) receive(reader *bufio.Reader) error {
+	t.lock.Lock()
+	conn, pending := t.conn, t.pending
+	t.pending = nil
+	t.lock.Unlock()
+	stopPing := make(chan struct{})
+	var writeLock sync.Mutex // PINGREQ and PUBACK are written from different goroutines
+	defer func() {
+		close(stopPing)
+		conn.Close()
+	}()
+	go func() {
+		ticker := time.NewTicker(mqttKeepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopPing:
+				return
+			case <-ticker.C:
+				writeLock.Lock()
+				err := writeMqttPacket(conn, mqttPingreq<<4, nil)
+				writeLock.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+	for _, packet := range pending {
+		err := t.processPublish(conn, &writeLock, packet.header, packet.body)
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		// We send PINGREQ every mqttKeepAlive/2, so we should hear from the broker at least that often.
+		_ = conn.SetReadDeadline(time.Now().Add(mqttKeepAlive))
+		packetType, body, err := readMqttPacket(reader)
+		if err != nil {
+			return err
+		}
+		if packetType>>4 != mqttPublish {
+			continue // PINGRESP and others
+		}
+		err = t.processPublish(conn, &writeLock, packetType, body)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *mqttTailer) processPublish(conn net.Conn, writeLock *sync.Mutex, header byte, body []byte) error {
+	qos := (header >> 1) & 0x03
+	if len(body) < 2 {
+		return fmt.Errorf("invalid PUBLISH packet")
+	}
+	topicLength := int(body[0])<<8 | int(body[1])
+	rest := body[2:]
+	if len(rest) < topicLength {
+		return fmt.Errorf("invalid PUBLISH packet")
+	}
+	topic := string(rest[:topicLength])
+	rest = rest[topicLength:]
+	var packetId []byte
+	if qos > 0 {
+		if len(rest) < 2 {
+			return fmt.Errorf("invalid PUBLISH packet")
+		}
+		packetId, rest = rest[:2], rest[2:]
+	}
+	select {
+	case t.lines <- &fswatcher.Line{Line: string(bytes.TrimRight(rest, "\r\n")), Extra: map[string]interface{}{"topic": topic}, ReadTime: time.Now()}:
+	case <-t.done:
+		return nil
+	}
+	if qos == 1 {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		return writeMqttPacket(conn, mqttPuback<<4, packetId)
+	}
+	return nil
+}
+
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func writeMqttPacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	// remaining length is encoded with 7 bits per byte, the 8th bit indicates that more bytes follow
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readMqttPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, fmt.Errorf("invalid remaining length")
+		}
+	}
+	if length > maxMqttMessage {
+		return 0, nil, fmt.Errorf("packet exceeds %v bytes", maxMqttMessage)
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func mqttConnackError(rc byte) string {
+	switch rc {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client identifier rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad user name or password"
+	case 5:
+		return "not authorized"
+	default:
+		return fmt.Sprintf("return code %v", rc)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMqttRemainingLength(t *testing.T) {
+	for _, size := range []int{0, 127, 128, 16383, 16384, 2097152} {
+		var buf bytes.Buffer
+		err := writeMqttPacket(&buf, mqttPublish<<4, make([]byte, size))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		header, body, err := readMqttPacket(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatalf("unexpected error for size %v: %v", size, err)
+		}
+		if header != mqttPublish<<4 || len(body) != size {
+			t.Fatalf("expected PUBLISH packet with %v bytes, but got header %x with %v bytes", size, header, len(body))
+		}
+	}
+}
+
+func TestMqtt(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+	connectPacket := make(chan []byte, 1)
+	puback := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		_, body, err := readMqttPacket(reader)
+		if err != nil {
+			return
+		}
+		connectPacket <- body
+		writeMqttPacket(conn, mqttConnack<<4, []byte{0, 0})
+		_, body, err = readMqttPacket(reader)
+		if err != nil {
+			return
+		}
+		// a queued message from the previous session is delivered before SUBACK, with QoS 1
+		writeMqttPacket(conn, mqttPublish<<4|0x02, append(append(mqttString("logs/a/app"), 0, 7), "queued line"...))
+		writeMqttPacket(conn, mqttSuback<<4, []byte{body[0], body[1], 1})
+		writeMqttPacket(conn, mqttPublish<<4, append(mqttString("logs/b/app"), "new line\n"...))
+		for {
+			header, body, err := readMqttPacket(reader)
+			if err != nil {
+				return
+			}
+			if header>>4 == mqttPuback {
+				puback <- body
+			}
+		}
+	}()
+	tail, err := RunMqttTailer(&configuration.InputConfig{
+		MqttUrl:      "tcp://user:secret@" + l.Addr().String(),
+		MqttTopics:   []string{"logs/+/app"},
+		MqttClientId: "test-client",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer tail.Close()
+	body := <-connectPacket
+	if !bytes.Contains(body, mqttString("test-client")) || !bytes.Contains(body, mqttString("secret")) {
+		t.Fatalf("client id or password missing in CONNECT packet %q", body)
+	}
+	if flags := body[7]; flags != 0xc0 {
+		t.Fatalf("expected user name and password flags without clean session, but got %x", flags)
+	}
+	line := receiveLine(t, tail)
+	expectLine(t, line, "queued line")
+	expectFields(t, line, map[string]interface{}{"topic": "logs/a/app"})
+	line = receiveLine(t, tail)
+	expectLine(t, line, "new line")
+	expectFields(t, line, map[string]interface{}{"topic": "logs/b/app"})
+	select {
+	case id := <-puback:
+		if !bytes.Equal(id, []byte{0, 7}) {
+			t.Fatalf("expected PUBACK for packet id 7, but got %v", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for PUBACK")
+	}
+}
+
+func TestMqttConnectionRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		readMqttPacket(bufio.NewReader(conn))
+		writeMqttPacket(conn, mqttConnack<<4, []byte{0, 5})
+	}()
+	_, err = RunMqttTailer(&configuration.InputConfig{
+		MqttUrl:    "tcp://" + l.Addr().String(),
+		MqttTopics: []string{"logs/#"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatalf("expected connection refused error, but got %v", err)
+	}
+}
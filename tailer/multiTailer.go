@@ -0,0 +1,101 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"sync"
+)
+
+// implements fswatcher.FileTailer
+type multiTailer struct {
+	lines     chan *fswatcher.Line
+	errors    chan fswatcher.Error
+	done      chan struct{}
+	closeOnce sync.Once
+	tailers   []fswatcher.FileTailer
+}
+
+func (t *multiTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *multiTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *multiTailer) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		for _, tailer := range t.tailers {
+			tailer.Close()
+		}
+	})
+}
+
+// MultiTailer merges the lines and errors of multiple tailers.
+// Each line is tagged with the id of the input it was read from, ids[i] is the id of tailers[i].
+// The lines channel is closed when the lines channels of all tailers are closed.
+func MultiTailer(ids []string, tailers []fswatcher.FileTailer) fswatcher.FileTailer {
+	t := &multiTailer{
+		lines:   make(chan *fswatcher.Line),
+		errors:  make(chan fswatcher.Error),
+		done:    make(chan struct{}),
+		tailers: tailers,
+	}
+	var wg sync.WaitGroup
+	for i := range tailers {
+		wg.Add(1)
+		go func(id string, tailer fswatcher.FileTailer) {
+			defer wg.Done()
+			t.forward(id, tailer)
+		}(ids[i], tailers[i])
+	}
+	go func() {
+		wg.Wait()
+		close(t.lines)
+	}()
+	return t
+}
+
+func (t *multiTailer) forward(id string, tailer fswatcher.FileTailer) {
+	errors := tailer.Errors()
+	for {
+		select {
+		case line, ok := <-tailer.Lines():
+			if !ok {
+				return
+			}
+			line.Input = id
+			select {
+			case t.lines <- line:
+			case <-t.done:
+				return
+			}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil // stop receiving from the closed channel, but continue forwarding lines
+				continue
+			}
+			select {
+			case t.errors <- err:
+			case <-t.done:
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"errors"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"testing"
+)
+
+type sourceTailerWithErrors struct {
+	sourceTailer
+	errors chan fswatcher.Error
+}
+
+func (tail *sourceTailerWithErrors) Errors() chan fswatcher.Error {
+	return tail.errors
+}
+
+func TestMultiTailer(t *testing.T) {
+	src1 := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	src2 := &sourceTailerWithErrors{sourceTailer{lines: make(chan *fswatcher.Line)}, make(chan fswatcher.Error)}
+	tail := MultiTailer([]string{"nginx", "app"}, []fswatcher.FileTailer{src1, src2})
+
+	go func() { src1.lines <- &fswatcher.Line{Line: "line from nginx"} }()
+	line := receiveLine(t, tail)
+	expectLine(t, line, "line from nginx")
+	if line.Input != "nginx" {
+		t.Fatalf("expected input nginx, but got %q", line.Input)
+	}
+
+	go func() { src2.lines <- &fswatcher.Line{Line: "line from app"} }()
+	line = receiveLine(t, tail)
+	expectLine(t, line, "line from app")
+	if line.Input != "app" {
+		t.Fatalf("expected input app, but got %q", line.Input)
+	}
+
+	go func() { src2.errors <- fswatcher.NewError(fswatcher.NotSpecified, errors.New("test error"), "") }()
+	err := <-tail.Errors()
+	if err.Cause().Error() != "test error" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	tail.Close()
+	_, stillOpen := <-tail.Lines()
+	if stillOpen {
+		t.Fatal("multi tailer was not closed")
+	}
+}
+
+func TestMultiTailerClosesWhenAllSourcesAreDone(t *testing.T) {
+	src1 := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	src2 := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := MultiTailer([]string{"a", "b"}, []fswatcher.FileTailer{src1, src2})
+	close(src1.lines)
+	go func() { src2.lines <- &fswatcher.Line{Line: "still running"} }()
+	expectLine(t, receiveLine(t, tail), "still running")
+	close(src2.lines)
+	_, stillOpen := <-tail.Lines()
+	if stillOpen {
+		t.Fatal("multi tailer was not closed")
+	}
+}
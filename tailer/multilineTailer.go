@@ -0,0 +1,162 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"strings"
+	"time"
+)
+
+// implements fswatcher.FileTailer
+type multilineTailer struct {
+	out      chan *fswatcher.Line
+	orig     fswatcher.FileTailer
+	done     chan struct{}
+	isStart  func(line string) bool
+	timeout  time.Duration
+	maxLines int
+	pending  map[string]*multilineRecord // file -> record or nil, lines from different files are assembled separately
+}
+
+type multilineRecord struct {
+	first     *fswatcher.Line
+	lines     []string
+	truncated bool
+	deadline  time.Time
+}
+
+func (t *multilineTailer) Lines() chan *fswatcher.Line {
+	return t.out
+}
+
+func (t *multilineTailer) Errors() chan fswatcher.Error {
+	return t.orig.Errors()
+}
+
+func (t *multilineTailer) Close() {
+	t.orig.Close()
+	close(t.done)
+}
+
+// MultilineTailer merges lines into multi-line records, like Java stack traces.
+// A record starts with a line for which isStart returns true, and contains all following lines until the next start line.
+// The lines of a record are joined with "\n". A record is complete when the next record starts,
+// when no line was added for the timeout, or when it has maxLines lines (0 means no limit).
+func MultilineTailer(orig fswatcher.FileTailer, isStart func(line string) bool, timeout time.Duration, maxLines int) fswatcher.FileTailer {
+	t := &multilineTailer{
+		out:      make(chan *fswatcher.Line),
+		orig:     orig,
+		done:     make(chan struct{}),
+		isStart:  isStart,
+		timeout:  timeout,
+		maxLines: maxLines,
+		pending:  make(map[string]*multilineRecord),
+	}
+	go t.run()
+	return t
+}
+
+func (t *multilineTailer) run() {
+	defer close(t.out)
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-t.orig.Lines():
+			if !ok {
+				for file, record := range t.pending {
+					if record != nil && !t.flush(file) {
+						return
+					}
+				}
+				return
+			}
+			if !t.add(line) {
+				return
+			}
+		case <-timer.C:
+			now := time.Now()
+			for file, record := range t.pending {
+				if record != nil && !record.deadline.After(now) && !t.flush(file) {
+					return
+				}
+			}
+		case <-t.done:
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(t.nextDeadline())
+	}
+}
+
+// add returns false if the tailer was closed
+func (t *multilineTailer) add(line *fswatcher.Line) bool {
+	record := t.pending[line.File]
+	if record != nil && t.isStart(line.Line) {
+		if !t.flush(line.File) {
+			return false
+		}
+		record = nil
+	}
+	if record == nil {
+		record = &multilineRecord{first: line}
+		t.pending[line.File] = record
+	}
+	record.lines = append(record.lines, line.Line)
+	record.truncated = record.truncated || line.Truncated
+	record.deadline = time.Now().Add(t.timeout)
+	if t.maxLines > 0 && len(record.lines) >= t.maxLines {
+		return t.flush(line.File)
+	}
+	return true
+}
+
+// flush returns false if the tailer was closed
+func (t *multilineTailer) flush(file string) bool {
+	record := t.pending[file]
+	t.pending[file] = nil
+	line := *record.first
+	line.Line = strings.Join(record.lines, "\n")
+	line.Truncated = record.truncated
+	select {
+	case t.out <- &line:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+func (t *multilineTailer) nextDeadline() time.Duration {
+	result := t.timeout
+	now := time.Now()
+	for _, record := range t.pending {
+		if record == nil {
+			continue
+		}
+		if d := record.deadline.Sub(now); d < result {
+			result = d
+		}
+	}
+	if result < 0 {
+		return 0
+	}
+	return result
+}
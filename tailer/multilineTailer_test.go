@@ -0,0 +1,82 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startsWithDate(line string) bool {
+	return strings.HasPrefix(line, "2020-")
+}
+
+func TestMultiline(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := MultilineTailer(src, startsWithDate, 50*time.Millisecond, 0)
+	defer tail.Close()
+	go func() {
+		for _, line := range []string{
+			"2020-01-01 ERROR java.lang.NullPointerException",
+			"    at com.example.Main.main(Main.java:10)",
+			"    at com.example.Main.run(Main.java:20)",
+			"2020-01-01 INFO done",
+		} {
+			src.lines <- &fswatcher.Line{Line: line, File: "app.log"}
+		}
+	}()
+	line := receiveLine(t, tail)
+	expectLine(t, line, "2020-01-01 ERROR java.lang.NullPointerException\n    at com.example.Main.main(Main.java:10)\n    at com.example.Main.run(Main.java:20)")
+	if line.File != "app.log" {
+		t.Fatalf("expected file app.log, but got %q", line.File)
+	}
+	// the last record is complete after the timeout
+	start := time.Now()
+	expectLine(t, receiveLine(t, tail), "2020-01-01 INFO done")
+	if time.Since(start) < 40*time.Millisecond {
+		t.Fatalf("last record was sent before the timeout")
+	}
+}
+
+func TestMultilineMaxLines(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := MultilineTailer(src, startsWithDate, time.Minute, 2)
+	go func() {
+		for _, line := range []string{"2020-01-01 a", "b", "c"} {
+			src.lines <- &fswatcher.Line{Line: line}
+		}
+		close(src.lines)
+	}()
+	expectLine(t, receiveLine(t, tail), "2020-01-01 a\nb")
+	expectLine(t, receiveLine(t, tail), "c") // remaining record is sent when the source is closed
+	if _, open := <-tail.Lines(); open {
+		t.Fatal("multiline tailer was not closed")
+	}
+}
+
+func TestMultilineFilesAreSeparate(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := MultilineTailer(src, startsWithDate, time.Minute, 0)
+	defer tail.Close()
+	go func() {
+		src.lines <- &fswatcher.Line{Line: "2020-01-01 a1", File: "a.log"}
+		src.lines <- &fswatcher.Line{Line: "2020-01-01 b1", File: "b.log"}
+		src.lines <- &fswatcher.Line{Line: "a2", File: "a.log"}
+		src.lines <- &fswatcher.Line{Line: "2020-01-01 a3", File: "a.log"}
+	}()
+	expectLine(t, receiveLine(t, tail), "2020-01-01 a1\na2")
+}
@@ -0,0 +1,260 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxReconnectDelay = 30 * time.Second
+
+type natsTailer struct {
+	lines     chan *fswatcher.Line
+	errors    chan fswatcher.Error
+	done      chan struct{}
+	closeOnce sync.Once
+	cfg       *configuration.InputConfig
+	url       *url.URL
+	lock      sync.Mutex
+	conn      net.Conn // current connection, closed in Close() to interrupt reading
+}
+
+type natsServerInfo struct {
+	TlsRequired  bool `json:"tls_required"`
+	AuthRequired bool `json:"auth_required"`
+}
+
+func (t *natsTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *natsTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *natsTailer) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if t.conn != nil {
+			_ = t.conn.Close()
+		}
+	})
+}
+
+// RunNatsTailer subscribes to NATS subjects, each message is a log line.
+// We implement the NATS client protocol directly, because we only need to subscribe.
+// See https://docs.nats.io/nats-protocol/nats-protocol
+func RunNatsTailer(cfg *configuration.InputConfig) (fswatcher.FileTailer, error) {
+	u, err := url.Parse(cfg.NatsUrl)
+	if err != nil {
+		return nil, fmt.Errorf("nats: invalid url: %v", err)
+	}
+	t := &natsTailer{
+		lines:  make(chan *fswatcher.Line),
+		errors: make(chan fswatcher.Error),
+		done:   make(chan struct{}),
+		cfg:    cfg,
+		url:    u,
+	}
+	// Fail early if the initial connection fails, later connection errors are retried.
+	reader, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		delay := time.Second
+		for {
+			err := t.receive(reader)
+			select {
+			case <-t.done:
+				return
+			default:
+			}
+			logrus.Warnf("nats: connection to %v lost: %v", t.url.Host, err)
+			for {
+				select {
+				case <-t.done:
+					return
+				case <-time.After(delay):
+				}
+				reader, err = t.connect()
+				if err == nil {
+					delay = time.Second
+					break
+				}
+				logrus.Warnf("nats: %v", err)
+				if delay < maxReconnectDelay {
+					delay *= 2
+				}
+			}
+		}
+	}()
+	return t, nil
+}
+
+// connect connects to the server and subscribes to the subjects.
+func (t *natsTailer) connect() (*bufio.Reader, error) {
+	host := t.url.Host
+	if t.url.Port() == "" {
+		host = net.JoinHostPort(t.url.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %v: %v", host, err)
+	}
+	// The handshake must complete in time, after that the server pings us regularly.
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("%v: expected INFO from server, got %q: %v", host, line, err)
+	}
+	info := &natsServerInfo{}
+	err = json.Unmarshal([]byte(line[5:]), info)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%v: invalid INFO from server: %v", host, err)
+	}
+	if info.TlsRequired || t.url.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: t.url.Hostname()})
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v: tls handshake failed: %v", host, err)
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+	connectOptions := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "grok_exporter",
+		"lang":     "go",
+		"protocol": 1,
+	}
+	if t.url.User != nil {
+		if password, ok := t.url.User.Password(); ok {
+			connectOptions["user"] = t.url.User.Username()
+			connectOptions["pass"] = password
+		} else {
+			connectOptions["auth_token"] = t.url.User.Username()
+		}
+	}
+	connectJson, _ := json.Marshal(connectOptions)
+	var sb strings.Builder
+	sb.WriteString("CONNECT " + string(connectJson) + "\r\n")
+	for i, subject := range t.cfg.NatsSubjects {
+		if t.cfg.NatsQueueGroup != "" {
+			sb.WriteString(fmt.Sprintf("SUB %v %v %v\r\n", subject, t.cfg.NatsQueueGroup, i+1))
+		} else {
+			sb.WriteString(fmt.Sprintf("SUB %v %v\r\n", subject, i+1))
+		}
+	}
+	// The server responds to PING with PONG if CONNECT and SUB were successful, or with -ERR otherwise.
+	sb.WriteString("PING\r\n")
+	_, err = io.WriteString(conn, sb.String())
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%v: %v", host, err)
+	}
+	for {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v: %v", host, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, fmt.Errorf("%v: %v", host, line)
+		}
+		if line == "PONG" {
+			break
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	select {
+	case <-t.done:
+		conn.Close()
+		return nil, fmt.Errorf("closed")
+	default:
+	}
+	t.conn = conn
+	return reader, nil
+}
+
+// receive reads messages until the connection fails.
+func (t *natsTailer) receive(reader *bufio.Reader) error {
+	t.lock.Lock()
+	conn := t.conn
+	t.lock.Unlock()
+	defer conn.Close()
+	for {
+		// The server sends a PING every 2 minutes by default, so if we don't hear from the server for 5 minutes the connection is dead.
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			_, err = io.WriteString(conn, "PONG\r\n")
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				return fmt.Errorf("invalid message header %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return fmt.Errorf("invalid message header %q", line)
+			}
+			payload := make([]byte, size+2) // including \r\n
+			_, err = io.ReadFull(reader, payload)
+			if err != nil {
+				return err
+			}
+			select {
+			case t.lines <- &fswatcher.Line{Line: strings.TrimRight(string(payload[:size]), "\r\n"), Extra: map[string]interface{}{"subject": fields[1]}, ReadTime: time.Now()}:
+			case <-t.done:
+				return nil
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("%v", line)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeNatsServer accepts a single client and sends the messages after the client subscribed.
+func fakeNatsServer(t *testing.T, messages ...string) (net.Listener, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {\"server_id\":\"test\",\"auth_required\":true}\r\n"))
+		reader := bufio.NewReader(conn)
+		var commands []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if line == "PING" {
+				break
+			}
+			commands = append(commands, line)
+		}
+		received <- commands
+		conn.Write([]byte("PONG\r\nPING\r\n"))
+		for _, msg := range messages {
+			conn.Write([]byte(msg))
+		}
+		// wait for the client to close the connection
+		reader.ReadString('\n')
+		reader.ReadString('\n')
+	}()
+	return l, received
+}
+
+func TestNats(t *testing.T) {
+	l, received := fakeNatsServer(t,
+		"MSG logs.app1 1 18\r\nfirst line\nignored\r\n",
+		"MSG logs.app2.web 2 _INBOX.abc 11\r\nsecond line\r\n",
+	)
+	defer l.Close()
+	tail, err := RunNatsTailer(&configuration.InputConfig{
+		NatsUrl:        "nats://user:secret@" + l.Addr().String(),
+		NatsSubjects:   []string{"logs.app1", "logs.app2.>"},
+		NatsQueueGroup: "workers",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer tail.Close()
+	commands := <-received
+	if len(commands) != 3 {
+		t.Fatalf("expected CONNECT and two SUB commands, but got %v", commands)
+	}
+	if !strings.HasPrefix(commands[0], "CONNECT ") || !strings.Contains(commands[0], `"user":"user"`) || !strings.Contains(commands[0], `"pass":"secret"`) {
+		t.Fatalf("unexpected CONNECT command %q", commands[0])
+	}
+	if commands[1] != "SUB logs.app1 workers 1" || commands[2] != "SUB logs.app2.> workers 2" {
+		t.Fatalf("unexpected SUB commands %v", commands[1:])
+	}
+	line := receiveLine(t, tail)
+	expectLine(t, line, "first line\nignored")
+	expectFields(t, line, map[string]interface{}{"subject": "logs.app1"})
+	line = receiveLine(t, tail)
+	expectLine(t, line, "second line")
+	expectFields(t, line, map[string]interface{}{"subject": "logs.app2.web"})
+}
+
+func TestNatsSubscriptionError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {}\r\n"))
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+	}()
+	_, err = RunNatsTailer(&configuration.InputConfig{
+		NatsUrl:      "nats://" + l.Addr().String(),
+		NatsSubjects: []string{"logs"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Fatalf("expected authorization error, but got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"strings"
+	"time"
+)
+
+// implements fswatcher.FileTailer
+type parsingTailer struct {
+	out   chan *fswatcher.Line
+	orig  fswatcher.FileTailer
+	done  chan struct{}
+	parse func(line *fswatcher.Line)
+}
+
+func (t *parsingTailer) Lines() chan *fswatcher.Line {
+	return t.out
+}
+
+func (t *parsingTailer) Errors() chan fswatcher.Error {
+	return t.orig.Errors()
+}
+
+func (t *parsingTailer) Close() {
+	t.orig.Close()
+	close(t.done)
+}
+
+// JsonTailer parses each line as a JSON object and provides the object as the line's Extra field.
+// Numbers are json.Number values, so that they keep their original format, like 1000000 instead of 1e+06.
+// Lines that are not JSON objects are passed on with Extra set to nil.
+func JsonTailer(orig fswatcher.FileTailer) fswatcher.FileTailer {
+	return runParsingTailer(orig, func(line *fswatcher.Line) {
+		line.Extra = parseJsonObject(line.Line)
+	})
+}
+
+// CsvTailer splits each line into fields separated by the delimiter, and provides a map of field name -> value as the line's Extra field.
+// Fields can be quoted like in CSV files, and quoted fields may contain the delimiter, like "GET /index.html HTTP/1.1".
+// Values without a name in names, or with the name "" or "-", are skipped. Lines that cannot be parsed are passed on with Extra set to nil.
+func CsvTailer(orig fswatcher.FileTailer, delimiter rune, names []string) fswatcher.FileTailer {
+	return runParsingTailer(orig, func(line *fswatcher.Line) {
+		line.Extra = parseCsvFields(line.Line, delimiter, names)
+	})
+}
+
+// LogTimeTailer sets the line's LogTime field to the timestamp found by logTime.
+// Lines without a timestamp, i.e. if the second result of logTime is false, are passed on with a zero LogTime.
+func LogTimeTailer(orig fswatcher.FileTailer, logTime func(line string) (time.Time, bool)) fswatcher.FileTailer {
+	return runParsingTailer(orig, func(line *fswatcher.Line) {
+		if timestamp, ok := logTime(line.Line); ok {
+			line.LogTime = timestamp
+		}
+	})
+}
+
+// CaptureTailer sets the line's Captures field to the fields found by captures.
+// Lines that don't match, i.e. if the result of captures is nil, are passed on with Captures set to nil.
+func CaptureTailer(orig fswatcher.FileTailer, captures func(line string) map[string]interface{}) fswatcher.FileTailer {
+	return runParsingTailer(orig, func(line *fswatcher.Line) {
+		line.Captures = captures(line.Line)
+	})
+}
+
+func runParsingTailer(orig fswatcher.FileTailer, parse func(line *fswatcher.Line)) fswatcher.FileTailer {
+	t := &parsingTailer{
+		out:   make(chan *fswatcher.Line),
+		orig:  orig,
+		done:  make(chan struct{}),
+		parse: parse,
+	}
+	go t.run()
+	return t
+}
+
+func (t *parsingTailer) run() {
+	defer close(t.out)
+	for {
+		select {
+		case line, ok := <-t.orig.Lines():
+			if !ok {
+				return
+			}
+			t.parse(line)
+			select {
+			case t.out <- line:
+			case <-t.done:
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func parseJsonObject(line string) interface{} {
+	var result map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil || result == nil || decoder.More() {
+		return nil
+	}
+	return result
+}
+
+func parseCsvFields(line string, delimiter rune, names []string) interface{} {
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	values, err := reader.Read()
+	if err != nil {
+		return nil
+	}
+	result := make(map[string]interface{}, len(names))
+	for i, value := range values {
+		if i < len(names) && names[i] != "" && names[i] != "-" {
+			result[names[i]] = value
+		}
+	}
+	return result
+}
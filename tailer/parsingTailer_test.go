@@ -0,0 +1,114 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"encoding/json"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJson(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := JsonTailer(src)
+	go func() {
+		for _, line := range []string{
+			`{"level": "error", "http": {"status": 503, "bytes": 1000000}}`,
+			`not json`,
+			`[1, 2]`,
+			`{"a": 1} {"b": 2}`,
+		} {
+			src.lines <- &fswatcher.Line{Line: line, File: "app.log"}
+		}
+		close(src.lines)
+	}()
+	line := receiveLine(t, tail)
+	expectLine(t, line, `{"level": "error", "http": {"status": 503, "bytes": 1000000}}`)
+	obj, ok := line.Extra.(map[string]interface{})
+	if !ok || obj["level"] != "error" {
+		t.Fatalf("unexpected JSON object %#v", line.Extra)
+	}
+	http := obj["http"].(map[string]interface{})
+	if http["status"] != json.Number("503") || http["bytes"] != json.Number("1000000") {
+		t.Fatalf("unexpected JSON numbers %#v", http)
+	}
+	for _, text := range []string{`not json`, `[1, 2]`, `{"a": 1} {"b": 2}`} {
+		line = receiveLine(t, tail)
+		expectLine(t, line, text)
+		if line.Extra != nil {
+			t.Fatalf("%v: expected no JSON object, but got %#v", text, line.Extra)
+		}
+	}
+	if _, open := <-tail.Lines(); open {
+		t.Fatal("json tailer was not closed")
+	}
+}
+
+func TestCsv(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := CsvTailer(src, ' ', []string{"client", "-", "method", "status", "bytes"})
+	go func() {
+		for _, line := range []string{
+			`10.0.0.1 - GET 200 5120`,
+			`10.0.0.2 "a b" "POST /api HTTP/1.1" 201`,
+			``,
+		} {
+			src.lines <- &fswatcher.Line{Line: line}
+		}
+		close(src.lines)
+	}()
+	for _, expected := range []map[string]interface{}{
+		{"client": "10.0.0.1", "method": "GET", "status": "200", "bytes": "5120"},
+		{"client": "10.0.0.2", "method": "POST /api HTTP/1.1", "status": "201"},
+		nil,
+	} {
+		line := receiveLine(t, tail)
+		if expected == nil && line.Extra != nil {
+			t.Fatalf("%q: expected no fields, but got %#v", line.Line, line.Extra)
+		}
+		if expected != nil && !reflect.DeepEqual(line.Extra, expected) {
+			t.Fatalf("%q: expected %#v, but got %#v", line.Line, expected, line.Extra)
+		}
+	}
+}
+
+func TestLogTime(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := LogTimeTailer(src, func(line string) (time.Time, bool) {
+		timestamp, err := time.Parse("2006-01-02T15:04:05", strings.SplitN(line, " ", 2)[0])
+		return timestamp, err == nil
+	})
+	go func() {
+		for _, line := range []string{
+			"2020-01-01T10:00:00 started",
+			"    at Main.main()",
+		} {
+			src.lines <- &fswatcher.Line{Line: line}
+		}
+		close(src.lines)
+	}()
+	for _, expected := range []time.Time{
+		time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC),
+		{},
+	} {
+		line := receiveLine(t, tail)
+		if !line.LogTime.Equal(expected) {
+			t.Fatalf("%q: expected log time %v, but got %v", line.Line, expected, line.LogTime)
+		}
+	}
+}
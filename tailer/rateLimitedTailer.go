@@ -0,0 +1,139 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"time"
+)
+
+// implements fswatcher.FileTailer
+type rateLimitedTailer struct {
+	out     chan *fswatcher.Line
+	orig    fswatcher.FileTailer
+	done    chan struct{}
+	rate    float64 // lines per second, 0 means no limit
+	tokens  float64 // token bucket, holds up to one second of lines
+	last    time.Time
+	drop    bool
+	dropped func()
+}
+
+func (t *rateLimitedTailer) Lines() chan *fswatcher.Line {
+	return t.out
+}
+
+func (t *rateLimitedTailer) Errors() chan fswatcher.Error {
+	return t.orig.Errors()
+}
+
+func (t *rateLimitedTailer) Close() {
+	t.orig.Close()
+	close(t.done)
+}
+
+// RateLimitedTailer limits the number of lines per second (0 means no limit), and buffers up to bufferSize lines.
+// If drop is false, the original tailer is blocked while the rate limit is exceeded or the buffer is full.
+// If drop is true, these lines are dropped instead, and dropped() is called for each of them.
+// Without a buffer, lines are only dropped if the rate limit is exceeded.
+// Short bursts of up to linesPerSecond lines are passed through without delay.
+func RateLimitedTailer(orig fswatcher.FileTailer, linesPerSecond int, bufferSize int, drop bool, dropped func()) fswatcher.FileTailer {
+	t := &rateLimitedTailer{
+		out:     make(chan *fswatcher.Line, bufferSize),
+		orig:    orig,
+		done:    make(chan struct{}),
+		rate:    float64(linesPerSecond),
+		tokens:  float64(linesPerSecond),
+		last:    time.Now(),
+		drop:    drop,
+		dropped: dropped,
+	}
+	go t.run()
+	return t
+}
+
+func (t *rateLimitedTailer) run() {
+	defer close(t.out)
+	for {
+		select {
+		case line, ok := <-t.orig.Lines():
+			if !ok {
+				return
+			}
+			if !t.forward(line) {
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// forward returns false if the tailer was closed
+func (t *rateLimitedTailer) forward(line *fswatcher.Line) bool {
+	wait := t.take()
+	if wait > 0 && t.drop {
+		t.dropped()
+		return true
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-t.done:
+			timer.Stop()
+			return false
+		}
+	}
+	if t.drop && cap(t.out) > 0 {
+		select {
+		case t.out <- line:
+		case <-t.done:
+			return false
+		default:
+			t.dropped() // buffer is full
+		}
+		return true
+	}
+	select {
+	case t.out <- line:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// take removes a token from the bucket and returns how long to wait until the token is available.
+// If the caller drops the line instead of waiting, the token is not removed.
+func (t *rateLimitedTailer) take() time.Duration {
+	if t.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+	if t.tokens >= 1 {
+		t.tokens--
+		return 0
+	}
+	wait := time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+	if !t.drop {
+		t.tokens-- // the token becomes available while the caller waits
+	}
+	return wait
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"fmt"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"testing"
+	"time"
+)
+
+func TestRateLimitBlock(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	tail := RateLimitedTailer(src, 10, 0, false, func() { t.Error("line was dropped") })
+	defer tail.Close()
+	go func() {
+		for i := 1; i <= 15; i++ {
+			src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+		}
+	}()
+	start := time.Now()
+	for i := 1; i <= 15; i++ {
+		expectLine(t, receiveLine(t, tail), fmt.Sprintf("line %v", i))
+	}
+	// the first 10 lines are a burst, the remaining 5 lines take 0.5 seconds
+	if time.Since(start) < 400*time.Millisecond {
+		t.Fatalf("15 lines were read in %v, but rate limit is 10 lines per second", time.Since(start))
+	}
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	dropped := 0
+	tail := RateLimitedTailer(src, 5, 0, true, func() { dropped++ })
+	go func() {
+		for i := 1; i <= 20; i++ {
+			src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+		}
+		close(src.lines)
+	}()
+	received := 0
+	for range tail.Lines() {
+		received++
+	}
+	if received < 5 || received > 6 {
+		t.Fatalf("expected the burst of 5 lines to pass, but got %v lines", received)
+	}
+	if received+dropped != 20 {
+		t.Fatalf("expected %v dropped lines, but got %v", 20-received, dropped)
+	}
+}
+
+func TestBufferFullDrop(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	dropped := 0
+	tail := RateLimitedTailer(src, 0, 2, true, func() { dropped++ })
+	for i := 1; i <= 5; i++ {
+		src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+	}
+	close(src.lines)
+	expectLine(t, receiveLine(t, tail), "line 1")
+	expectLine(t, receiveLine(t, tail), "line 2")
+	if _, open := <-tail.Lines(); open {
+		t.Fatal("rate limited tailer was not closed")
+	}
+	if dropped != 3 {
+		t.Fatalf("expected 3 dropped lines, but got %v", dropped)
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // sha256 of ""
+
+type s3Tailer struct {
+	lines  chan *fswatcher.Line
+	errors chan fswatcher.Error
+	done   chan struct{}
+	client *s3Client
+	cfg    *configuration.InputConfig
+}
+
+// s3Client implements the two S3 API calls we need, ListObjectsV2 and GetObject.
+// We don't use the AWS SDK, because it would add a large dependency for two HTTP requests.
+type s3Client struct {
+	http         *http.Client
+	endpoint     *url.URL
+	pathStyle    bool // bucket in the path (for custom endpoints like MinIO) or in the host name (for AWS)
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	now          func() time.Time // for testing
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+}
+
+type listBucketResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+func (t *s3Tailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *s3Tailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *s3Tailer) Close() {
+	close(t.done)
+}
+
+// RunS3Tailer reads all objects in an S3 bucket matching the configured prefix and time range.
+// This is a batch input: When all objects are processed, no more lines are produced, but the metrics are still served.
+func RunS3Tailer(cfg *configuration.InputConfig) (fswatcher.FileTailer, error) {
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t := &s3Tailer{
+		lines:  make(chan *fswatcher.Line),
+		errors: make(chan fswatcher.Error),
+		done:   make(chan struct{}),
+		client: client,
+		cfg:    cfg,
+	}
+	go func() {
+		err := t.processBucket()
+		if err != nil {
+			select {
+			case t.errors <- fswatcher.NewError(fswatcher.NotSpecified, err, "s3"):
+			case <-t.done:
+			}
+		}
+	}()
+	return t, nil
+}
+
+func newS3Client(cfg *configuration.InputConfig) (*s3Client, error) {
+	c := &s3Client{
+		http:         &http.Client{},
+		bucket:       cfg.S3Bucket,
+		region:       cfg.S3Region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		now:          time.Now,
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("s3: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	var err error
+	if cfg.S3Endpoint != "" {
+		c.endpoint, err = url.Parse(cfg.S3Endpoint)
+		c.pathStyle = true
+	} else {
+		c.endpoint, err = url.Parse(fmt.Sprintf("https://%v.s3.%v.amazonaws.com", cfg.S3Bucket, cfg.S3Region))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("s3: invalid endpoint: %v", err)
+	}
+	return c, nil
+}
+
+func (t *s3Tailer) processBucket() error {
+	objects, err := t.client.listObjects(t.cfg.S3Prefix)
+	if err != nil {
+		return err
+	}
+	var selected []s3Object
+	for _, object := range objects {
+		if !t.cfg.S3StartTime.IsZero() && object.LastModified.Before(t.cfg.S3StartTime) {
+			continue
+		}
+		if !t.cfg.S3EndTime.IsZero() && !object.LastModified.Before(t.cfg.S3EndTime) {
+			continue
+		}
+		selected = append(selected, object)
+	}
+	// Process in chronological order, so that metrics like gauges end up with the most recent value.
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].LastModified.Before(selected[j].LastModified)
+	})
+	logrus.Infof("s3: processing %v objects in bucket %v", len(selected), t.cfg.S3Bucket)
+	for _, object := range selected {
+		err = t.processObject(object)
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Infof("s3: finished processing %v objects in bucket %v", len(selected), t.cfg.S3Bucket)
+	return nil
+}
+
+func (t *s3Tailer) processObject(object s3Object) error {
+	body, err := t.client.getObject(object.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	var reader io.Reader = bufio.NewReader(body)
+	// Most AWS services (ELB, CloudFront) write gzip compressed logs.
+	if magic, err := reader.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		reader, err = gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("%v: %v", object.Key, err)
+		}
+	}
+	file := "s3://" + t.cfg.S3Bucket + "/" + object.Key
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxJournalEntrySize)
+	for scanner.Scan() {
+		select {
+		case t.lines <- &fswatcher.Line{Line: strings.TrimRight(scanner.Text(), "\r"), File: file, ReadTime: time.Now()}:
+		case <-t.done:
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%v: %v", object.Key, err)
+	}
+	return nil
+}
+
+func (c *s3Client) listObjects(prefix string) ([]s3Object, error) {
+	var result []s3Object
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		resp, err := c.do(c.objectPath(""), query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in bucket %v: %v", c.bucket, err)
+		}
+		page := &listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in bucket %v: %v", c.bucket, err)
+		}
+		result = append(result, page.Contents...)
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return result, nil
+		}
+		continuationToken = page.NextContinuationToken
+	}
+}
+
+func (c *s3Client) getObject(key string) (io.ReadCloser, error) {
+	resp, err := c.do(c.objectPath(key), url.Values{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %v: %v", key, err)
+	}
+	return resp.Body, nil
+}
+
+func (c *s3Client) objectPath(key string) string {
+	path := strings.TrimSuffix(c.endpoint.Path, "/")
+	if c.pathStyle {
+		path += "/" + c.bucket
+	}
+	return path + "/" + key
+}
+
+func (c *s3Client) do(path string, query url.Values) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = path
+	u.RawPath = uriEncode(path, false) // make sure the path we send is the path we sign
+	u.RawQuery = canonicalQueryString(query)
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, emptyPayloadHash)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request.
+// All headers present in the request are signed. See https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery, // already canonical, see canonicalQueryString()
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSha256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSha256(key, c.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", c.accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQueryString(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode encodes everything except the unreserved characters A-Z, a-z, 0-9, '-', '.', '_', and '~'.
+// The '/' is encoded only if encodeSlash is true (i.e. in query parameters, but not in the path).
+func uriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && !encodeSlash) {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return sb.String()
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
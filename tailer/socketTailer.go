@@ -0,0 +1,165 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type socketTailer struct {
+	lines         chan *fswatcher.Line
+	errors        chan fswatcher.Error
+	listener      net.Listener
+	maxLineLength int
+	connections   chan struct{} // semaphore limiting the number of concurrent connections
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+func (t *socketTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *socketTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *socketTailer) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		_ = t.listener.Close()
+	})
+}
+
+// RunSocketTailer listens on a TCP port or a Unix domain socket, and treats each line received as a log line.
+func RunSocketTailer(cfg *configuration.InputConfig) (fswatcher.FileTailer, error) {
+	if cfg.SocketNetwork == "unix" {
+		err := removeStaleSocket(cfg.SocketAddress)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen(cfg.SocketNetwork, cfg.SocketAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %v %v: %v", cfg.SocketNetwork, cfg.SocketAddress, err)
+	}
+	t := &socketTailer{
+		lines:         make(chan *fswatcher.Line),
+		errors:        make(chan fswatcher.Error),
+		listener:      listener,
+		maxLineLength: cfg.SocketMaxLineLength,
+		connections:   make(chan struct{}, cfg.SocketMaxConnections),
+		done:          make(chan struct{}),
+	}
+	go t.acceptConnections()
+	return t, nil
+}
+
+// removeStaleSocket removes a socket file left over from a previous run that wasn't shut down cleanly.
+// Other files are not removed, because that's most likely a configuration error.
+func removeStaleSocket(path string) error {
+	fileInfo, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	if fileInfo.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v: file exists and is not a socket", path)
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("failed to remove stale socket: %v", err)
+	}
+	return nil
+}
+
+func (t *socketTailer) acceptConnections() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.done:
+			case t.errors <- fswatcher.NewError(fswatcher.NotSpecified, err, "socket: failed to accept connection"):
+			}
+			return
+		}
+		select {
+		case t.connections <- struct{}{}:
+			go t.receiveLines(conn)
+		default:
+			logrus.Warnf("socket: rejecting connection from %v: maximum number of %v connections reached", conn.RemoteAddr(), cap(t.connections))
+			_ = conn.Close()
+		}
+	}
+}
+
+func (t *socketTailer) receiveLines(conn net.Conn) {
+	connDone := make(chan struct{})
+	defer func() {
+		close(connDone)
+		<-t.connections
+	}()
+	go func() {
+		// close the connection when the tailer is closed, so that the read below returns
+		select {
+		case <-t.done:
+		case <-connDone:
+		}
+		_ = conn.Close()
+	}()
+	extra := map[string]interface{}{
+		"remote_addr": conn.RemoteAddr().String(),
+	}
+	reader := bufio.NewReaderSize(conn, t.maxLineLength)
+	for {
+		data, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			// The client closed the connection, or we closed it in Close().
+			return
+		}
+		line := string(data) // copy, because data is overwritten by the next read
+		if isPrefix {
+			logrus.Warnf("socket: truncating line from %v: line is longer than %v bytes", conn.RemoteAddr(), t.maxLineLength)
+			err = skipRestOfLine(reader)
+		}
+		select {
+		case t.lines <- &fswatcher.Line{Line: line, Extra: extra, ReadTime: time.Now()}:
+		case <-t.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func skipRestOfLine(reader *bufio.Reader) error {
+	for {
+		_, isPrefix, err := reader.ReadLine()
+		if err != nil || !isPrefix {
+			return err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocketTcp(t *testing.T) {
+	tail := runSocketTailerOrFail(t, "tcp", "127.0.0.1:0", 10, 1024)
+	defer tail.Close()
+	conn := dialOrFail(t, tail)
+	defer conn.Close()
+	writeOrFail(t, conn, "first line\r\nsecond line\nthird line")
+	expectLine(t, receiveLine(t, tail), "first line")
+	expectLine(t, receiveLine(t, tail), "second line")
+	// The last line is processed when the client closes the connection.
+	conn.Close()
+	expectLine(t, receiveLine(t, tail), "third line")
+}
+
+func TestSocketUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "grok_exporter.sock")
+	// Simulate a stale socket from a previous run.
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	tail := runSocketTailerOrFail(t, "unix", socket, 10, 1024)
+	defer tail.Close()
+	conn := dialOrFail(t, tail)
+	defer conn.Close()
+	writeOrFail(t, conn, "hello unix\n")
+	expectLine(t, receiveLine(t, tail), "hello unix")
+}
+
+func TestSocketMaxLineLength(t *testing.T) {
+	tail := runSocketTailerOrFail(t, "tcp", "127.0.0.1:0", 10, 16)
+	defer tail.Close()
+	conn := dialOrFail(t, tail)
+	defer conn.Close()
+	writeOrFail(t, conn, strings.Repeat("x", 100)+"\nshort\n")
+	expectLine(t, receiveLine(t, tail), strings.Repeat("x", 16))
+	expectLine(t, receiveLine(t, tail), "short")
+}
+
+func TestSocketMaxConnections(t *testing.T) {
+	tail := runSocketTailerOrFail(t, "tcp", "127.0.0.1:0", 1, 1024)
+	defer tail.Close()
+	conn1 := dialOrFail(t, tail)
+	defer conn1.Close()
+	writeOrFail(t, conn1, "from conn1\n")
+	expectLine(t, receiveLine(t, tail), "from conn1")
+	conn2 := dialOrFail(t, tail)
+	defer conn2.Close()
+	_ = conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn2.Read(make([]byte, 1))
+	if err == nil || isTimeout(err) {
+		t.Fatalf("expected second connection to be closed by the server, but got %v", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func runSocketTailerOrFail(t *testing.T, network, address string, maxConnections, maxLineLength int) *socketTailer {
+	tail, err := RunSocketTailer(&configuration.InputConfig{
+		SocketNetwork:        network,
+		SocketAddress:        address,
+		SocketMaxConnections: maxConnections,
+		SocketMaxLineLength:  maxLineLength,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return tail.(*socketTailer)
+}
+
+func dialOrFail(t *testing.T, tail *socketTailer) net.Conn {
+	addr := tail.listener.Addr()
+	conn, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return conn
+}
+
+func writeOrFail(t *testing.T, conn net.Conn, data string) {
+	_, err := conn.Write([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -15,10 +15,10 @@
 package tailer
 
 import (
-	"bufio"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"io"
 	"os"
-	"strings"
+	"time"
 )
 
 type stdinTailer struct {
@@ -38,19 +38,44 @@ func (t *stdinTailer) Close() {
 	// TODO: How to stop the go-routine reading on stdin?
 }
 
-func RunStdinTailer() fswatcher.FileTailer {
+// RunStdinTailer reads lines in the given format from stdin.
+func RunStdinTailer(format fswatcher.LineFormat) fswatcher.FileTailer {
+	return runReaderTailer(os.Stdin, format, false)
+}
+
+// RunOneshotStdinTailer reads lines in the given format from stdin, and closes the lines channel at the end of the input.
+func RunOneshotStdinTailer(format fswatcher.LineFormat) fswatcher.FileTailer {
+	return runReaderTailer(os.Stdin, format, true)
+}
+
+// RunOneshotReaderTailer reads lines in the given format from r, and closes the lines channel at the end of the input.
+func RunOneshotReaderTailer(r io.Reader, format fswatcher.LineFormat) fswatcher.FileTailer {
+	return runReaderTailer(r, format, true)
+}
+
+func runReaderTailer(r io.Reader, format fswatcher.LineFormat, closeAtEOF bool) fswatcher.FileTailer {
 	lineChan := make(chan *fswatcher.Line)
 	errorChan := make(chan fswatcher.Error)
 	go func() {
-		reader := bufio.NewReader(os.Stdin)
+		reader := fswatcher.NewLineReader(format)
 		for {
-			line, err := reader.ReadString('\n')
+			line, eof, err := reader.ReadLine(r)
+			if eof {
+				// When stdin is a pipe, the last line might not be terminated with a newline.
+				line = reader.Remaining()
+				err = io.EOF
+			}
+			if len(line) > 0 || (!eof && err == nil) {
+				lineChan <- &fswatcher.Line{Line: line, Truncated: !eof && reader.Truncated(), ReadTime: time.Now()}
+			}
+			if eof && closeAtEOF {
+				close(lineChan)
+				return
+			}
 			if err != nil {
 				errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
 				return
 			}
-			line = strings.TrimRight(line, "\r\n")
-			lineChan <- &fswatcher.Line{Line: line}
 		}
 	}()
 	return &stdinTailer{
@@ -0,0 +1,52 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+func TestStdinLastLineWithoutNewline(t *testing.T) {
+	tail := runReaderTailer(strings.NewReader("line 1\r\nline 2\nline 3"), fswatcher.LineFormat{}, false)
+	for _, expected := range []string{"line 1", "line 2", "line 3"} {
+		expectLine(t, receiveLine(t, tail), expected)
+	}
+	// Without -oneshot, the end of stdin is reported as an error after the last line.
+	select {
+	case err := <-tail.Errors():
+		if err.Cause() != io.EOF {
+			t.Fatalf("expected EOF, but got %v", err)
+		}
+	case line := <-tail.Lines():
+		t.Fatalf("unexpected line %q", line.Line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for EOF")
+	}
+}
+
+func TestOneshotStdinLastLineWithoutNewline(t *testing.T) {
+	tail := RunOneshotReaderTailer(strings.NewReader("line 1\nline 2"), fswatcher.LineFormat{})
+	for _, expected := range []string{"line 1", "line 2"} {
+		expectLine(t, receiveLine(t, tail), expected)
+	}
+	if _, open := <-tail.Lines(); open {
+		t.Fatal("lines channel was not closed at the end of the input")
+	}
+}
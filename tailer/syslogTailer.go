@@ -0,0 +1,334 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"fmt"
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxSyslogMessageSize = 64 * 1024
+
+type syslogTailer struct {
+	lines    chan *fswatcher.Line
+	errors   chan fswatcher.Error
+	packet   net.PacketConn // UDP
+	listener net.Listener   // TCP
+	done     chan struct{}
+	lock     sync.Mutex
+}
+
+func (t *syslogTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *syslogTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *syslogTailer) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	select {
+	case <-t.done:
+		return // already closed
+	default:
+	}
+	close(t.done)
+	if t.packet != nil {
+		_ = t.packet.Close()
+	}
+	if t.listener != nil {
+		_ = t.listener.Close()
+	}
+}
+
+// RunSyslogTailer listens for syslog messages on UDP or TCP.
+// Both RFC3164 (BSD syslog) and RFC5424 messages are supported, the message body is the log line
+// and the header fields are available as extra.
+func RunSyslogTailer(cfg *configuration.InputConfig) (fswatcher.FileTailer, error) {
+	t := &syslogTailer{
+		lines:  make(chan *fswatcher.Line),
+		errors: make(chan fswatcher.Error),
+		done:   make(chan struct{}),
+	}
+	var err error
+	switch cfg.SyslogProtocol {
+	case "udp":
+		t.packet, err = net.ListenPacket("udp", cfg.SyslogAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for syslog messages on udp %v: %v", cfg.SyslogAddress, err)
+		}
+		go t.receivePackets()
+	case "tcp":
+		t.listener, err = net.Listen("tcp", cfg.SyslogAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for syslog messages on tcp %v: %v", cfg.SyslogAddress, err)
+		}
+		go t.acceptConnections()
+	default:
+		return nil, fmt.Errorf("unsupported syslog protocol %q", cfg.SyslogProtocol)
+	}
+	return t, nil
+}
+
+func (t *syslogTailer) receivePackets() {
+	buf := make([]byte, maxSyslogMessageSize)
+	for {
+		n, _, err := t.packet.ReadFrom(buf)
+		if err != nil {
+			if !t.isClosed() {
+				t.sendError(fswatcher.NewError(fswatcher.NotSpecified, err, "syslog: failed to read udp packet"))
+			}
+			return
+		}
+		// A datagram contains exactly one message, but some senders terminate it with a newline.
+		if !t.send(parseSyslogMessage(strings.TrimRight(string(buf[:n]), "\r\n\x00"))) {
+			return
+		}
+	}
+}
+
+func (t *syslogTailer) acceptConnections() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if !t.isClosed() {
+				t.sendError(fswatcher.NewError(fswatcher.NotSpecified, err, "syslog: failed to accept tcp connection"))
+			}
+			return
+		}
+		go t.receiveStream(conn)
+	}
+}
+
+// receiveStream reads messages from a TCP connection. RFC6587 defines two framing methods:
+// octet counting ("<length> <message>") and non-transparent framing (messages terminated by newline).
+// We support both, and detect the method for each message by looking at the first character.
+func (t *syslogTailer) receiveStream(conn net.Conn) {
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		// close the connection when the tailer is closed, so that the read below returns
+		select {
+		case <-t.done:
+		case <-connDone:
+		}
+		_ = conn.Close()
+	}()
+	reader := bufio.NewReaderSize(conn, maxSyslogMessageSize)
+	for {
+		msg, err := readFrame(reader)
+		if len(msg) > 0 {
+			if !t.send(parseSyslogMessage(msg)) {
+				return
+			}
+		}
+		if err != nil {
+			// A client closing the connection is not an error.
+			// Invalid frames are not an error either, because we don't want to terminate grok_exporter
+			// when a client sends garbage. We just drop the connection.
+			return
+		}
+	}
+}
+
+func readFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		lengthString, err := reader.ReadString(' ')
+		if err != nil {
+			return "", err
+		}
+		length, err := strconv.Atoi(strings.TrimSuffix(lengthString, " "))
+		if err != nil || length > maxSyslogMessageSize {
+			return "", fmt.Errorf("invalid octet count %q", lengthString)
+		}
+		buf := make([]byte, length)
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	}
+	line, err := reader.ReadString('\n')
+	if err == io.EOF && len(line) > 0 {
+		// last message without terminating newline
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n\x00"), err
+}
+
+func (t *syslogTailer) send(line *fswatcher.Line) bool {
+	select {
+	case t.lines <- line:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+func (t *syslogTailer) sendError(err fswatcher.Error) {
+	select {
+	case t.errors <- err:
+	case <-t.done:
+	}
+}
+
+func (t *syslogTailer) isClosed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseSyslogMessage parses the syslog header. If the message is neither RFC5424 nor RFC3164,
+// the entire message is used as log line, so that lines from non-compliant senders are not lost.
+func parseSyslogMessage(msg string) *fswatcher.Line {
+	fields := make(map[string]interface{})
+	rest, ok := parsePriority(msg, fields)
+	if !ok {
+		return &fswatcher.Line{Line: msg, Extra: fields, ReadTime: time.Now()}
+	}
+	if strings.HasPrefix(rest, "1 ") {
+		if body, ok := parseRfc5424(rest[2:], fields); ok {
+			return &fswatcher.Line{Line: body, Extra: fields, ReadTime: time.Now()}
+		}
+	}
+	return &fswatcher.Line{Line: parseRfc3164(rest, fields), Extra: fields, ReadTime: time.Now()}
+}
+
+// parsePriority parses the "<PRI>" part, where PRI is facility * 8 + severity.
+func parsePriority(msg string, fields map[string]interface{}) (string, bool) {
+	if !strings.HasPrefix(msg, "<") {
+		return msg, false
+	}
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return msg, false
+	}
+	pri, err := strconv.Atoi(msg[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return msg, false
+	}
+	fields["priority"] = pri
+	fields["facility"] = pri / 8
+	fields["severity"] = pri % 8
+	return msg[end+1:], true
+}
+
+// parseRfc5424 parses "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]".
+// The "<PRI>1 " prefix is already stripped. The nil value "-" is ignored.
+func parseRfc5424(msg string, fields map[string]interface{}) (string, bool) {
+	parts := strings.SplitN(msg, " ", 6)
+	if len(parts) < 6 {
+		return "", false
+	}
+	for i, name := range []string{"timestamp", "hostname", "app_name", "proc_id", "msg_id"} {
+		if parts[i] != "-" {
+			fields[name] = parts[i]
+		}
+	}
+	sd, body, ok := splitStructuredData(parts[5])
+	if !ok {
+		return "", false
+	}
+	if sd != "-" {
+		fields["structured_data"] = sd
+	}
+	return strings.TrimPrefix(body, "\xEF\xBB\xBF"), true
+}
+
+// splitStructuredData splits "[id key="val"][id2 ...] MSG" into the structured data and the message.
+// Within param values, '"', '\' and ']' may be escaped with '\'.
+func splitStructuredData(s string) (string, string, bool) {
+	if strings.HasPrefix(s, "-") {
+		return "-", strings.TrimPrefix(s[1:], " "), true
+	}
+	inElement, inValue := false, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case inValue && c == '\\':
+			i++
+		case inValue && c == '"':
+			inValue = false
+		case inElement && c == '"':
+			inValue = true
+		case inElement && !inValue && c == ']':
+			inElement = false
+		case !inElement && c == '[':
+			inElement = true
+		case !inElement && c == ' ':
+			return s[:i], s[i+1:], true
+		case !inElement:
+			return "", "", false
+		}
+	}
+	if inElement {
+		return "", "", false
+	}
+	return s, "", true
+}
+
+// parseRfc3164 parses "Mmm dd hh:mm:ss HOSTNAME TAG: MSG". Many implementations don't follow RFC3164 exactly,
+// so we parse what we find and use the remainder as message.
+func parseRfc3164(msg string, fields map[string]interface{}) string {
+	const stampLen = len(time.Stamp)
+	if len(msg) > stampLen && msg[stampLen] == ' ' {
+		if _, err := time.Parse(time.Stamp, msg[:stampLen]); err == nil {
+			fields["timestamp"] = msg[:stampLen]
+			msg = msg[stampLen+1:]
+			if space := strings.IndexByte(msg, ' '); space > 0 && !strings.HasSuffix(msg[:space], ":") {
+				fields["hostname"] = msg[:space]
+				msg = msg[space+1:]
+			}
+		}
+	}
+	// The tag is terminated by ':' or '[' (followed by the pid and ']:').
+	for i := 0; i < len(msg) && i <= 48; i++ {
+		switch msg[i] {
+		case ':':
+			if i > 0 {
+				fields["app_name"] = msg[:i]
+				return strings.TrimPrefix(msg[i+1:], " ")
+			}
+			return msg
+		case '[':
+			end := strings.Index(msg[i:], "]:")
+			if i == 0 || end < 0 {
+				return msg
+			}
+			fields["app_name"] = msg[:i]
+			fields["proc_id"] = msg[i+1 : i+end]
+			return strings.TrimPrefix(msg[i+end+2:], " ")
+		case ' ':
+			return msg
+		}
+	}
+	return msg
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	configuration "github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSyslogRfc5424(t *testing.T) {
+	line := parseSyslogMessage(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high"] An application event log entry...`)
+	expectLine(t, line, "An application event log entry...")
+	expectFields(t, line, map[string]interface{}{
+		"priority":        165,
+		"facility":        20,
+		"severity":        5,
+		"timestamp":       "2003-10-11T22:14:15.003Z",
+		"hostname":        "mymachine.example.com",
+		"app_name":        "evntslog",
+		"msg_id":          "ID47",
+		"structured_data": `[exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high"]`,
+	})
+}
+
+func TestSyslogRfc5424NilValues(t *testing.T) {
+	line := parseSyslogMessage("<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - - - \xEF\xBB\xBF'su root' failed for lonvick on /dev/pts/8")
+	expectLine(t, line, "'su root' failed for lonvick on /dev/pts/8")
+	expectFields(t, line, map[string]interface{}{
+		"priority":  34,
+		"facility":  4,
+		"severity":  2,
+		"timestamp": "2003-10-11T22:14:15.003Z",
+		"hostname":  "mymachine.example.com",
+		"app_name":  "su",
+	})
+}
+
+func TestSyslogRfc5424EscapedStructuredData(t *testing.T) {
+	line := parseSyslogMessage(`<165>1 - - - - - [id key="a \"quoted\] value"] message`)
+	expectLine(t, line, "message")
+	expectFields(t, line, map[string]interface{}{
+		"priority":        165,
+		"facility":        20,
+		"severity":        5,
+		"structured_data": `[id key="a \"quoted\] value"]`,
+	})
+}
+
+func TestSyslogRfc3164(t *testing.T) {
+	line := parseSyslogMessage("<38>Oct  9 22:33:20 myhost sshd[1234]: Accepted publickey for root from 10.0.0.1 port 22")
+	expectLine(t, line, "Accepted publickey for root from 10.0.0.1 port 22")
+	expectFields(t, line, map[string]interface{}{
+		"priority":  38,
+		"facility":  4,
+		"severity":  6,
+		"timestamp": "Oct  9 22:33:20",
+		"hostname":  "myhost",
+		"app_name":  "sshd",
+		"proc_id":   "1234",
+	})
+}
+
+func TestSyslogRfc3164WithoutHostname(t *testing.T) {
+	line := parseSyslogMessage("<13>Feb 12 10:01:02 cron: job finished")
+	expectLine(t, line, "job finished")
+	expectFields(t, line, map[string]interface{}{
+		"priority":  13,
+		"facility":  1,
+		"severity":  5,
+		"timestamp": "Feb 12 10:01:02",
+		"app_name":  "cron",
+	})
+}
+
+func TestSyslogWithoutHeader(t *testing.T) {
+	line := parseSyslogMessage("just some text")
+	expectLine(t, line, "just some text")
+	expectFields(t, line, map[string]interface{}{})
+}
+
+func TestSyslogUdp(t *testing.T) {
+	tail, err := RunSyslogTailer(&configuration.InputConfig{SyslogProtocol: "udp", SyslogAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer tail.Close()
+	conn, err := net.Dial("udp", tail.(*syslogTailer).packet.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("<38>Oct  9 22:33:20 myhost sshd[1234]: hello udp\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectLine(t, receiveLine(t, tail), "hello udp")
+}
+
+func TestSyslogTcp(t *testing.T) {
+	tail, err := RunSyslogTailer(&configuration.InputConfig{SyslogProtocol: "tcp", SyslogAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer tail.Close()
+	conn, err := net.Dial("tcp", tail.(*syslogTailer).listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	// octet counting followed by non-transparent framing
+	_, err = conn.Write([]byte("36 <13>1 - myhost app - - - hello\nworld<13>Feb 12 10:01:02 cron: second\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectLine(t, receiveLine(t, tail), "hello\nworld")
+	expectLine(t, receiveLine(t, tail), "second")
+}
+
+func receiveLine(t *testing.T, tail fswatcher.FileTailer) *fswatcher.Line {
+	select {
+	case line := <-tail.Lines():
+		return line
+	case err := <-tail.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for syslog message")
+	}
+	return nil
+}
+
+func expectLine(t *testing.T, line *fswatcher.Line, expected string) {
+	if line.Line != expected {
+		t.Fatalf("expected line %q, but got %q", expected, line.Line)
+	}
+}
+
+func expectFields(t *testing.T, line *fswatcher.Line, expected map[string]interface{}) {
+	fields := line.Extra.(map[string]interface{})
+	if len(fields) != len(expected) {
+		t.Fatalf("expected fields %v, but got %v", expected, fields)
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Fatalf("expected %v=%v, but got %v=%v", key, value, key, fields[key])
+		}
+	}
+}
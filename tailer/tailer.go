@@ -0,0 +1,263 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"context"
+	"fmt"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/fstab/grok_exporter/tailer/glob"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding"
+	"sync"
+	"time"
+)
+
+// Tailer reads log lines from files, following them when they are rotated. Create a Tailer with New().
+type Tailer interface {
+	// Lines returns the lines read from the files. The channel is closed when the Tailer terminates.
+	Lines() <-chan Line
+	// Errors returns the errors that made the Tailer terminate. The channel is closed when the Tailer terminates.
+	Errors() <-chan error
+	// Close stops the Tailer and waits until it terminated, i.e. the positions were saved, the files were closed,
+	// and the Lines and Errors channels were closed. Lines that were not received before Close() are dropped.
+	Close()
+}
+
+// Line is a line read by a Tailer.
+type Line struct {
+	Text string
+	File string // path of the file the line was read from
+	// Truncated is true if the line was longer than Config.MaxLineLength, and only the beginning of the line is included.
+	Truncated bool
+	ReadTime  time.Time // when the line was read
+	Offset    int64     // position of the first byte of the line in File
+}
+
+// Config configures a Tailer. Only Paths is required.
+type Config struct {
+	// Paths of the log files. Glob patterns are supported for file names, like /var/log/*.log,
+	// and ** matches subdirectories, like /var/log/**/*.log.
+	Paths []string
+	// Exclude are glob patterns for file names that are not read, like *.gz for rotated backups.
+	Exclude []string
+	// StartPosition defines where to start reading the files that exist when the Tailer is created.
+	// The zero value reads the whole file. Files created later are always read from the beginning.
+	StartPosition fswatcher.StartPosition
+	// ReadCompressedBackups reads the gzip compressed backups created by logrotate before the log files, like app.log.1.gz.
+	// This requires StartPosition Beginning.
+	ReadCompressedBackups bool
+	// Olddir is where logrotate moves the backups, if it is configured with the olddir option.
+	// A relative path is relative to the directory of the log file. Empty means the backups stay in the same directory.
+	Olddir string
+	// FollowPath continues a file in the new file if it is replaced at the same path, and the new file starts with the same content,
+	// like when a directory is remounted and the files get new inodes. Directories that are removed or unmounted are watched again when they are back.
+	FollowPath bool
+	// FailOnMissingFile makes the Tailer fail if no file matches one of the Paths on startup. Otherwise, it waits until the files are created.
+	FailOnMissingFile bool
+	// PositionsFile is where the Tailer saves how far it has read each file, so that it continues there when it is created again.
+	// Files with a saved position ignore the StartPosition. Empty means positions are not saved.
+	PositionsFile string
+	// PositionsSyncInterval is how often the positions are written to the PositionsFile, default is 10 seconds.
+	// The positions are also written when the Tailer is closed.
+	PositionsSyncInterval time.Duration
+	// PollInterval enables polling for changes instead of file system notifications, 0 means notifications are used.
+	PollInterval time.Duration
+	// IdleTimeout closes files that were not written for the duration, and opens them again when they change.
+	// 0 means files are kept open.
+	IdleTimeout time.Duration
+	// PartialLineTimeout is how long an incomplete last line waits for the LineDelimiter. If the line is not completed in time,
+	// it is sent anyway. The incomplete last line of a rotated file is sent right away. 0 means incomplete lines wait until they are complete.
+	PartialLineTimeout time.Duration
+	// LineDelimiter separates the lines, default is "\n" with a trailing "\r" removed.
+	LineDelimiter string
+	// Charset of the files, like "UTF-16LE" or "ISO-8859-1". Lines are converted to UTF-8. Default is UTF-8.
+	Charset string
+	// MaxLineLength is the maximum number of bytes of a line, 0 means no limit.
+	// Longer lines are truncated, or split into multiple lines if SplitLongLines is true.
+	MaxLineLength  int
+	SplitLongLines bool
+	// Logger for messages about rotated files and the like. Default is a logrus logger that logs warnings only.
+	Logger logrus.FieldLogger
+}
+
+const defaultPositionsSyncInterval = 10 * time.Second
+
+// implements Tailer
+type tailer struct {
+	orig      fswatcher.FileTailer
+	lines     chan Line
+	errors    chan error
+	done      chan struct{} // closed by Close()
+	stopped   chan struct{} // closed when run() terminated
+	closeOnce sync.Once
+}
+
+// New starts a Tailer reading the files configured in cfg.
+func New(cfg Config) (Tailer, error) {
+	return NewWithContext(context.Background(), cfg)
+}
+
+// NewWithContext starts a Tailer reading the files configured in cfg. The Tailer is closed when ctx is done.
+func NewWithContext(ctx context.Context, cfg Config) (Tailer, error) {
+	if len(cfg.Paths) == 0 {
+		return nil, fmt.Errorf("tailer: no paths configured")
+	}
+	globs := make([]glob.Glob, 0, len(cfg.Paths))
+	for _, path := range cfg.Paths {
+		parsedGlob, err := glob.Parse(path)
+		if err != nil {
+			return nil, fmt.Errorf("tailer: %v", err)
+		}
+		globs = append(globs, parsedGlob)
+	}
+	if cfg.ReadCompressedBackups && cfg.StartPosition.Type != fswatcher.Beginning {
+		return nil, fmt.Errorf("tailer: reading compressed backups requires start position beginning")
+	}
+	format, err := newLineFormat(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("tailer: %v", err)
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		l := logrus.New()
+		l.Level = logrus.WarnLevel
+		logger = l
+	}
+	var positions *fswatcher.PositionsFile
+	if cfg.PositionsFile != "" {
+		syncInterval := cfg.PositionsSyncInterval
+		if syncInterval == 0 {
+			syncInterval = defaultPositionsSyncInterval
+		}
+		positions, err = fswatcher.LoadPositionsFile(cfg.PositionsFile, syncInterval)
+		if err != nil {
+			return nil, fmt.Errorf("tailer: %v", err)
+		}
+	}
+	opts := fswatcher.Options{
+		Exclude:               cfg.Exclude,
+		Start:                 cfg.StartPosition,
+		ReadCompressedBackups: cfg.ReadCompressedBackups,
+		Olddir:                cfg.Olddir,
+		FollowPath:            cfg.FollowPath,
+		FailOnMissingFile:     cfg.FailOnMissingFile,
+		Positions:             positions,
+		Format:                format,
+		IdleTimeout:           cfg.IdleTimeout,
+		PartialLineTimeout:    cfg.PartialLineTimeout,
+		PollInterval:          cfg.PollInterval,
+	}
+	var orig fswatcher.FileTailer
+	if cfg.PollInterval == 0 {
+		orig, err = fswatcher.RunFileTailer(globs, opts, logger)
+	} else {
+		orig, err = fswatcher.RunPollingFileTailer(globs, opts, logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &tailer{
+		orig:    orig,
+		lines:   make(chan Line),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go t.run()
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.Close()
+		case <-t.stopped:
+		}
+	}()
+	return t, nil
+}
+
+func newLineFormat(cfg Config) (fswatcher.LineFormat, error) {
+	var (
+		delimiter *fswatcher.Delimiter
+		charset   encoding.Encoding
+		err       error
+	)
+	if cfg.LineDelimiter != "" {
+		delimiter = fswatcher.NewDelimiter(cfg.LineDelimiter)
+	}
+	if cfg.Charset != "" {
+		charset, err = fswatcher.LookupCharset(cfg.Charset)
+		if err != nil {
+			return fswatcher.LineFormat{}, err
+		}
+	}
+	return fswatcher.NewLineFormat(delimiter, charset, cfg.MaxLineLength, cfg.SplitLongLines)
+}
+
+func (t *tailer) Lines() <-chan Line {
+	return t.lines
+}
+
+func (t *tailer) Errors() <-chan error {
+	return t.errors
+}
+
+func (t *tailer) Close() {
+	t.closeOnce.Do(func() {
+		t.orig.Close()
+		close(t.done)
+	})
+	<-t.stopped
+}
+
+func (t *tailer) run() {
+	defer close(t.stopped)
+	defer close(t.lines)
+	defer close(t.errors)
+	t.forward()
+	// The original tailer saves the positions before it closes its lines channel.
+	for range t.orig.Lines() {
+	}
+}
+
+// forward converts the lines and errors of the original tailer until it terminates or until Close() is called.
+func (t *tailer) forward() {
+	lines, errors := t.orig.Lines(), t.orig.Errors()
+	for lines != nil || errors != nil {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				lines = nil
+				continue
+			}
+			select {
+			case t.lines <- Line{Text: line.Line, File: line.File, Truncated: line.Truncated, ReadTime: line.ReadTime, Offset: line.Offset}:
+			case <-t.done:
+				return
+			}
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			select {
+			case t.errors <- err:
+			case <-t.done:
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"context"
+	"fmt"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	logfile := filepath.Join(dir, "test.log")
+	err = ioutil.WriteFile(logfile, []byte("line 1\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test.log: %v", err)
+	}
+	cfg := Config{
+		Paths:         []string{filepath.Join(dir, "*.log")},
+		PositionsFile: filepath.Join(dir, "positions.yaml"),
+	}
+	tail, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create tailer: %v", err)
+	}
+	expectTailerLine(t, tail, Line{Text: "line 1", File: logfile})
+	tail.Close() // saves the positions
+	err = ioutil.WriteFile(logfile, []byte("line 1\nline 2\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test.log: %v", err)
+	}
+	// the file has a saved position, so the start position is ignored
+	cfg.StartPosition = fswatcher.StartPosition{Type: fswatcher.End}
+	tail, err = New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create tailer: %v", err)
+	}
+	defer tail.Close()
+	expectTailerLine(t, tail, Line{Text: "line 2", File: logfile, Offset: 7})
+}
+
+func TestNewWithContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	logfile := filepath.Join(dir, "test.log")
+	err = ioutil.WriteFile(logfile, []byte("line 1\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test.log: %v", err)
+	}
+	goroutinesBefore := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	tail, err := NewWithContext(ctx, Config{Paths: []string{filepath.Join(dir, "*.log")}})
+	if err != nil {
+		t.Fatalf("failed to create tailer: %v", err)
+	}
+	expectTailerLine(t, tail, Line{Text: "line 1", File: logfile})
+	cancel()
+	select {
+	case _, open := <-tail.Lines():
+		if open {
+			t.Fatal("received line after the context was cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for the tailer to terminate")
+	}
+	tail.Close() // no-op, as the tailer is already closed
+	// the goroutine waiting for ctx.Done() may still be returning
+	for i := 0; runtime.NumGoroutine() > goroutinesBefore; i++ {
+		if i == 50 {
+			t.Fatalf("%v goroutines are still running after the tailer was closed", runtime.NumGoroutine()-goroutinesBefore)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLineOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	logfile := filepath.Join(dir, "test.log")
+	err = ioutil.WriteFile(logfile, []byte("line 1\r\nthis line is too long\nline 3\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test.log: %v", err)
+	}
+	tail, err := New(Config{Paths: []string{filepath.Join(dir, "*.log")}, MaxLineLength: 10, SplitLongLines: true})
+	if err != nil {
+		t.Fatalf("failed to create tailer: %v", err)
+	}
+	defer tail.Close()
+	expectTailerLine(t, tail, Line{Text: "line 1", File: logfile, Offset: 0})
+	expectTailerLine(t, tail, Line{Text: "this line ", File: logfile, Truncated: true, Offset: 8})
+	expectTailerLine(t, tail, Line{Text: "is too lon", File: logfile, Truncated: true, Offset: 18})
+	expectTailerLine(t, tail, Line{Text: "g", File: logfile, Offset: 28})
+	expectTailerLine(t, tail, Line{Text: "line 3", File: logfile, Offset: 30})
+	// after truncating, the offsets start at the beginning again
+	err = ioutil.WriteFile(logfile, []byte("line 4\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test.log: %v", err)
+	}
+	expectTailerLine(t, tail, Line{Text: "line 4", File: logfile, Offset: 0})
+}
+
+func TestBusyFileDoesNotDelayOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	busyLog, quietLog := filepath.Join(dir, "busy.log"), filepath.Join(dir, "quiet.log")
+	for _, logfile := range []string{busyLog, quietLog} {
+		err = ioutil.WriteFile(logfile, nil, 0644)
+		if err != nil {
+			t.Fatalf("failed to create %v: %v", logfile, err)
+		}
+	}
+	tail, err := New(Config{Paths: []string{filepath.Join(dir, "*.log")}})
+	if err != nil {
+		t.Fatalf("failed to create tailer: %v", err)
+	}
+	defer tail.Close()
+	var busyLines strings.Builder
+	for i := 1; i <= 5000; i++ {
+		fmt.Fprintf(&busyLines, "line %v\n", i)
+	}
+	err = ioutil.WriteFile(busyLog, []byte(busyLines.String()), 0644)
+	if err != nil {
+		t.Fatalf("failed to write busy.log: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond) // the tailer is now blocked sending the lines of busy.log
+	err = ioutil.WriteFile(quietLog, []byte("error\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write quiet.log: %v", err)
+	}
+	for n := 0; ; n++ {
+		select {
+		case line := <-tail.Lines():
+			if line.File == quietLog {
+				// Each file reads up to 100 lines per turn. The quiet file should be read after a few turns of the busy file.
+				if n > 2500 {
+					t.Fatalf("quiet.log was read after %v lines of busy.log", n)
+				}
+				return
+			}
+		case err := <-tail.Errors():
+			t.Fatalf("unexpected error: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout while waiting for the line of quiet.log")
+		}
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{},
+		{Paths: []string{"/var/log/*.log"}, Charset: "unknown"},
+		{Paths: []string{"/var/log/*.log"}, ReadCompressedBackups: true, StartPosition: fswatcher.StartPosition{Type: fswatcher.End}},
+	} {
+		_, err := New(cfg)
+		if err == nil {
+			t.Fatalf("expected error for config %#v", cfg)
+		}
+	}
+}
+
+func expectTailerLine(t *testing.T, tail Tailer, expected Line) {
+	select {
+	case line := <-tail.Lines():
+		if line.ReadTime.IsZero() || time.Since(line.ReadTime) > 5*time.Second {
+			t.Fatalf("%q: unexpected read time %v", line.Text, line.ReadTime)
+		}
+		line.ReadTime = time.Time{}
+		if line != expected {
+			t.Fatalf("expected %#v, but got %#v", expected, line)
+		}
+	case err := <-tail.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for %q", expected.Text)
+	}
+}
@@ -22,9 +22,11 @@ import (
 	configuration "github.com/fstab/grok_exporter/config/v3"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
 	"github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type context_string struct {
@@ -78,24 +80,42 @@ func (t WebhookTailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	wts := webhookTailerSingleton
 	lineChan := wts.lines
-	errorChan := wts.errors
 
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, fmt.Sprintf("method %v not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Errors in the request are reported to the client, but not sent to the errorChan,
+	// because a misbehaving client should not terminate grok_exporter.
 	if r.Body == nil {
 		err := errors.New("got empty request body")
 		logrus.Warn(err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
-		errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
 		return
 	}
 
-	b, err := ioutil.ReadAll(r.Body)
+	maxBodySize := wts.config.WebhookMaxBodySize
+	body := io.Reader(r.Body)
+	if maxBodySize > 0 {
+		// Limit the memory used by a single request. One more byte than the limit is read,
+		// so that a larger body can be told apart from a body of exactly maxBodySize bytes.
+		body = io.LimitReader(r.Body, int64(maxBodySize)+1)
+	}
+	b, err := ioutil.ReadAll(body)
 	if err != nil {
 		logrus.Warn(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
+	if maxBodySize > 0 && len(b) > maxBodySize {
+		err = fmt.Errorf("request body larger than webhook_max_body_size %v bytes", maxBodySize)
+		logrus.Warn(err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
 
 	context_strings := WebhookProcessBody(wts.config, b)
 	for _, context_string := range context_strings {
@@ -103,7 +123,7 @@ func (t WebhookTailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"line":  context_string.line,
 			"extra": context_string.extra,
 		}).Debug("Groking line")
-		lineChan <- &fswatcher.Line{Line: context_string.line, Extra: context_string.extra}
+		lineChan <- &fswatcher.Line{Line: context_string.line, Extra: context_string.extra, ReadTime: time.Now()}
 	}
 	return
 }
@@ -184,6 +204,11 @@ func WebhookProcessBody(c *configuration.InputConfig, b []byte) []context_string
 		}
 
 		for _, ei := range j.MustArray() {
+			// Entries may be plain strings, like ["first line", "second line"].
+			if line, ok := ei.(string); ok {
+				strs = append(strs, context_string{line: line})
+				continue
+			}
 			// Cast the entry interface{} back to the Json object.
 			//   Unfortunately, this is how the simplejson lib works.
 			ej := json.New()
@@ -17,6 +17,8 @@ package tailer
 import (
 	"fmt"
 	configuration "github.com/fstab/grok_exporter/config/v3"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 )
@@ -293,6 +295,61 @@ func TestArraySelector(t *testing.T) {
 	}
 }
 
+func TestWebhookJsonBulkStrings(t *testing.T) {
+	c := &configuration.InputConfig{
+		WebhookFormat:       "json_bulk",
+		WebhookJsonSelector: ".message",
+	}
+	lines := WebhookProcessBody(c, []byte(`["first line", "second line"]`))
+	if len(lines) != 2 || lines[0].line != "first line" || lines[1].line != "second line" {
+		t.Fatalf("Expected: []string{\"first line\", \"second line\"}, Actual: %#v", lines)
+	}
+}
+
+func TestWebhookJsonBulkExtra(t *testing.T) {
+	c := &configuration.InputConfig{
+		WebhookFormat:       "json_bulk",
+		WebhookJsonSelector: ".message",
+	}
+	lines := WebhookProcessBody(c, []byte(`[{"message": "Login occured", "user": "Skeen"}]`))
+	if len(lines) != 1 {
+		t.Fatal("Expected 1 line processed")
+	}
+	// Like in previous releases, the entry is wrapped in an object {"x": entry}, so templates use {{.extra.x.user}}.
+	entry, ok := lines[0].extra["x"].(map[string]interface{})
+	if !ok || entry["user"] != "Skeen" {
+		t.Fatalf("Expected extra to contain the json entry as x, but got %v", lines[0].extra)
+	}
+}
+
+func TestWebhookMethodNotAllowed(t *testing.T) {
+	InitWebhookTailer(&configuration.InputConfig{WebhookFormat: "text_single"})
+	w := httptest.NewRecorder()
+	WebhookHandler().ServeHTTP(w, httptest.NewRequest("GET", "/webhook", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %v, but got %v", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestWebhookMaxBodySize(t *testing.T) {
+	webhookTailerSingleton = nil
+	defer func() {
+		webhookTailerSingleton = nil
+	}()
+	tail := InitWebhookTailer(&configuration.InputConfig{WebhookFormat: "text_single", WebhookMaxBodySize: 10})
+	w := httptest.NewRecorder()
+	WebhookHandler().ServeHTTP(w, httptest.NewRequest("POST", "/webhook", strings.NewReader("this line is too long")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status %v, but got %v", http.StatusRequestEntityTooLarge, w.Code)
+	}
+	for _, body := range []string{"short line", "ten bytes!"} {
+		go WebhookHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/webhook", strings.NewReader(body)))
+		if line := <-tail.Lines(); line.Line != body {
+			t.Fatalf("Expected line %q, but got %q", body, line.Line)
+		}
+	}
+}
+
 func createJsonBlob(message string) string {
 	s := fmt.Sprintf(`{
   "message": "%v",
@@ -16,6 +16,7 @@ package template
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"strconv"
 	"text/template/parse"
@@ -25,7 +26,7 @@ func newAddFunc() functionWithValidator {
 	return functionWithValidator{
 		function: add,
 		staticValidator: func(cmd *parse.CommandNode) error {
-			return validate("add", cmd)
+			return validateAtLeast("add", cmd, 2)
 		},
 	}
 }
@@ -43,7 +44,7 @@ func newMultiplyFunc() functionWithValidator {
 	return functionWithValidator{
 		function: multiply,
 		staticValidator: func(cmd *parse.CommandNode) error {
-			return validate("multiply", cmd)
+			return validateAtLeast("multiply", cmd, 2)
 		},
 	}
 }
@@ -57,12 +58,41 @@ func newDivideFunc() functionWithValidator {
 	}
 }
 
-func add(a, b interface{}) (float64, error) {
-	aFloat, bFloat, err := toFloats(a, b)
+func newMaxFunc() functionWithValidator {
+	return functionWithValidator{
+		function: maxOf,
+		staticValidator: func(cmd *parse.CommandNode) error {
+			return validateAtLeast("max", cmd, 2)
+		},
+	}
+}
+
+func newMinFunc() functionWithValidator {
+	return functionWithValidator{
+		function: minOf,
+		staticValidator: func(cmd *parse.CommandNode) error {
+			return validateAtLeast("min", cmd, 2)
+		},
+	}
+}
+
+func newBucketFunc() functionWithValidator {
+	return functionWithValidator{
+		function:        bucket,
+		staticValidator: validateBucketCall,
+	}
+}
+
+func add(a, b interface{}, more ...interface{}) (float64, error) {
+	values, err := toFloatList(a, b, more)
 	if err != nil {
 		return 0, fmt.Errorf("error executing add function: %v", err)
 	}
-	return aFloat + bFloat, nil
+	result := 0.0
+	for _, value := range values {
+		result += value
+	}
+	return result, nil
 }
 
 func subtract(a, b interface{}) (float64, error) {
@@ -73,12 +103,16 @@ func subtract(a, b interface{}) (float64, error) {
 	return aFloat - bFloat, nil
 }
 
-func multiply(a, b interface{}) (float64, error) {
-	aFloat, bFloat, err := toFloats(a, b)
+func multiply(a, b interface{}, more ...interface{}) (float64, error) {
+	values, err := toFloatList(a, b, more)
 	if err != nil {
 		return 0, fmt.Errorf("error executing multiply function: %v", err)
 	}
-	return aFloat * bFloat, nil
+	result := 1.0
+	for _, value := range values {
+		result *= value
+	}
+	return result, nil
 }
 
 func divide(a, b interface{}) (float64, error) {
@@ -92,6 +126,61 @@ func divide(a, b interface{}) (float64, error) {
 	return aFloat / bFloat, nil
 }
 
+func maxOf(a, b interface{}, more ...interface{}) (float64, error) {
+	values, err := toFloatList(a, b, more)
+	if err != nil {
+		return 0, fmt.Errorf("error executing max function: %v", err)
+	}
+	result := values[0]
+	for _, value := range values[1:] {
+		result = math.Max(result, value)
+	}
+	return result, nil
+}
+
+func minOf(a, b interface{}, more ...interface{}) (float64, error) {
+	values, err := toFloatList(a, b, more)
+	if err != nil {
+		return 0, fmt.Errorf("error executing min function: %v", err)
+	}
+	result := values[0]
+	for _, value := range values[1:] {
+		result = math.Min(result, value)
+	}
+	return result, nil
+}
+
+// bucket maps a number to the name of its range, like {{bucket .bytes "<1KB" 1024 "1-10KB" 10240 ">10KB"}}.
+// The bounds are in increasing order between the names, a value equal to a bound is in the range above the bound.
+func bucket(value interface{}, namesAndBounds ...interface{}) (string, error) {
+	f, err := toFloat(value)
+	if err != nil {
+		return "", fmt.Errorf("error executing bucket function: cannot convert %v to floating point number: %v", value, err)
+	}
+	for i := 1; i < len(namesAndBounds); i += 2 {
+		bound, err := toFloat(namesAndBounds[i])
+		if err != nil {
+			return "", fmt.Errorf("error executing bucket function: cannot convert bound %v to floating point number: %v", namesAndBounds[i], err)
+		}
+		if f < bound {
+			return toString(namesAndBounds[i-1]), nil
+		}
+	}
+	return toString(namesAndBounds[len(namesAndBounds)-1]), nil
+}
+
+func toFloatList(a, b interface{}, more []interface{}) ([]float64, error) {
+	result := make([]float64, 0, 2+len(more))
+	for _, param := range append([]interface{}{a, b}, more...) {
+		f, err := toFloat(param)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %v to floating point number: %v", param, err)
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
 func toFloats(a, b interface{}) (float64, float64, error) {
 	floatA, err := toFloat(a)
 	if err != nil {
@@ -127,9 +216,52 @@ func validate(functionName string, cmd *parse.CommandNode) error {
 	if len(cmd.Args) != 3 {
 		return fmt.Errorf("%v: expected two parameters, but found %v parameters", prefix, len(cmd.Args)-1)
 	}
+	return validateNumbers(prefix, cmd)
+}
+
+// validateAtLeast validates functions with a variable number of parameters, like {{add .a .b .c}}.
+func validateAtLeast(functionName string, cmd *parse.CommandNode, minParams int) error {
+	prefix := fmt.Sprintf("syntax error in %v call", functionName)
+	if len(cmd.Args) < minParams+1 {
+		return fmt.Errorf("%v: expected at least %v parameters, but found %v parameters", prefix, minParams, len(cmd.Args)-1)
+	}
+	return validateNumbers(prefix, cmd)
+}
+
+func validateBucketCall(cmd *parse.CommandNode) error {
+	prefix := "syntax error in bucket call"
+	if len(cmd.Args) < 5 || len(cmd.Args)%2 == 0 {
+		return fmt.Errorf("%v: expected a value and names separated by bounds, like {{bucket .bytes \"<1KB\" 1024 \">=1KB\"}}, but found %v parameters", prefix, len(cmd.Args)-1)
+	}
+	previous := math.Inf(-1)
+	for paramPos := 3; paramPos < len(cmd.Args); paramPos += 2 {
+		var bound float64
+		switch param := cmd.Args[paramPos].(type) {
+		case *parse.NumberNode:
+			if !param.IsFloat {
+				return fmt.Errorf("%v: unable to parse bound %v as a floating point number", prefix, param)
+			}
+			bound = param.Float64
+		case *parse.StringNode:
+			var err error
+			if bound, err = strconv.ParseFloat(param.Text, 64); err != nil {
+				return fmt.Errorf("%v: unable to parse bound %v as a floating point number: %v", prefix, param, err)
+			}
+		default:
+			continue // a variable or function call, we cannot check this statically
+		}
+		if bound <= previous {
+			return fmt.Errorf("%v: the bounds must be in increasing order, but %v follows %v", prefix, bound, previous)
+		}
+		previous = bound
+	}
+	return nil
+}
+
+func validateNumbers(prefix string, cmd *parse.CommandNode) error {
 	// If a param is a string or number, we check if we can parse it.
 	// Otherwise it might be a variable of a function call, we cannot check this statically.
-	for _, paramPos := range []int{1, 2} {
+	for paramPos := 1; paramPos < len(cmd.Args); paramPos++ {
 		switch param := cmd.Args[paramPos].(type) {
 		case *parse.NumberNode:
 			if !param.IsFloat {
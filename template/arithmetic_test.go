@@ -33,6 +33,22 @@ func TestArithmeticFunctions(t *testing.T) {
 		{"{{divide 3.0 .val}}", "0", "", false, true},
 		{"{{multiply 3i .val}}", "2", "", true, false},
 		{"{{multiply 0 true}}", "2", "", false, true},
+		{"{{add .val 3 \"4.5\"}}", "2", "9.5", false, false},
+		{"{{multiply .val 3 0.5}}", "2", "3", false, false},
+		{"{{max 1 .val 1.5}}", "2", "2", false, false},
+		{"{{min 1 .val -1.5}}", "2", "-1.5", false, false},
+		{"{{max (add .val 1) 2}}", "2", "3", false, false},
+		{"{{max .val}}", "2", "", true, false},
+		{"{{min .val \"x\"}}", "2", "", true, false},
+		{"{{max .val .missing}}", "2", "", false, true},
+		{"{{bucket .val \"<1KB\" 1024 \"1-10KB\" 10240 \">10KB\"}}", "512", "<1KB", false, false},
+		{"{{bucket .val \"<1KB\" 1024 \"1-10KB\" 10240 \">10KB\"}}", "1024", "1-10KB", false, false},
+		{"{{bucket .val \"<1KB\" 1024 \"1-10KB\" 10240 \">10KB\"}}", "1e6", ">10KB", false, false},
+		{"{{bucket .val \"fast\" \"0.5\" \"slow\"}}", "-1", "fast", false, false},
+		{"{{bucket .val \"<1KB\" 1024 \">=1KB\"}}", "x", "", false, true},
+		{"{{bucket .val \"<1KB\" 1024}}", "2", "", true, false},
+		{"{{bucket .val \"small\" 10 \"medium\" 5 \"large\"}}", "2", "", true, false},
+		{"{{bucket .val \"small\" \"x\" \"large\"}}", "2", "", true, false},
 	} {
 		template, err := New("test", data.template)
 		if data.parseError {
@@ -23,12 +23,23 @@ var funcs functions = make(map[string]functionWithValidator)
 
 func init() {
 	funcs.add("timestamp", newTimestampFunc())
+	funcs.add("duration", newDurationFunc())
 	funcs.add("gsub", newGsubFunc())
 	funcs.add("add", newAddFunc())
 	funcs.add("subtract", newSubtractFunc())
 	funcs.add("multiply", newMultiplyFunc())
 	funcs.add("divide", newDivideFunc())
+	funcs.add("max", newMaxFunc())
+	funcs.add("min", newMinFunc())
+	funcs.add("bucket", newBucketFunc())
 	funcs.add("base", newBaseFunc())
+	funcs.add("toLower", newToLowerFunc())
+	funcs.add("toUpper", newToUpperFunc())
+	funcs.add("substr", newSubstrFunc())
+	funcs.add("regexMatch", newRegexMatchFunc())
+	funcs.add("regexReplaceAll", newRegexReplaceAllFunc())
+	funcs.add("lookup", newLookupFunc())
+	funcs.add("geoip", newGeoIPFunc())
 }
 
 type functions map[string]functionWithValidator
@@ -0,0 +1,86 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package template
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"text/template/parse"
+
+	"github.com/fstab/grok_exporter/geoip"
+)
+
+// The databases from the geoip section, used like {{geoip "country" .client_ip}}.
+// The databases are replaced when the config is reloaded, while the templates are executed, so access is synchronized.
+var (
+	geoIPMutex     sync.RWMutex
+	geoIPDatabases []*geoip.Reader
+)
+
+// SetGeoIPDatabases replaces the databases. A field is taken from the first database that has it,
+// so a city database and an ASN database can be combined.
+func SetGeoIPDatabases(databases []*geoip.Reader) {
+	geoIPMutex.Lock()
+	defer geoIPMutex.Unlock()
+	geoIPDatabases = databases
+}
+
+func newGeoIPFunc() functionWithValidator {
+	return functionWithValidator{
+		function:        geoIP,
+		staticValidator: validateGeoIPCall,
+	}
+}
+
+// geoIP returns the field for the IP address, or the empty string if the IP address is not in the databases,
+// or if the value is not an IP address, like "-" in access logs.
+func geoIP(field string, s interface{}) (string, error) {
+	geoIPMutex.RLock()
+	defer geoIPMutex.RUnlock()
+	if len(geoIPDatabases) == 0 {
+		return "", fmt.Errorf("error executing geoip function: no geoip database is loaded")
+	}
+	ip := net.ParseIP(strings.TrimSpace(toString(s)))
+	if ip == nil {
+		return "", nil
+	}
+	for _, db := range geoIPDatabases {
+		value, found, err := db.LookupField(ip, field)
+		if err != nil {
+			return "", fmt.Errorf("error executing geoip function: %v: %v", db.Path(), err)
+		}
+		if found {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+func validateGeoIPCall(cmd *parse.CommandNode) error {
+	prefix := "syntax error in geoip call"
+	if err := validateNumberOfParams("geoip", cmd, 2); err != nil {
+		return err
+	}
+	stringNode, ok := cmd.Args[1].(*parse.StringNode)
+	if !ok {
+		return fmt.Errorf("%v: the field must be a string constant", prefix)
+	}
+	if !geoip.IsField(stringNode.Text) {
+		return fmt.Errorf("%v: unknown field %q, expected one of \"country\", \"country_name\", \"continent\", \"subdivision\", \"city\", \"asn\", \"asn_org\"", prefix, stringNode.Text)
+	}
+	return nil
+}
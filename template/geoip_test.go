@@ -0,0 +1,56 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package template
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeoIP(t *testing.T) {
+	for template, expected := range map[string]bool{
+		`{{geoip "country" .client_ip}}`:                                true,
+		`{{if .client_ip}}{{toLower (geoip "city" .client_ip)}}{{end}}`: true,
+		`{{lookup "dc_map" .client_ip}}`:                                false,
+	} {
+		tmplt, err := New("geoip", template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tmplt.UsesGeoIP() != expected {
+			t.Fatalf("%v: expected UsesGeoIP() to be %v", template, expected)
+		}
+	}
+	tmplt, err := New("geoip", `{{geoip "asn" .client_ip}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tmplt.Execute(map[string]interface{}{"client_ip": "81.2.69.160"})
+	if err == nil || !strings.Contains(err.Error(), "no geoip database is loaded") {
+		t.Fatalf("expected error, because no database is loaded, but got %v", err)
+	}
+	for _, data := range []struct {
+		template, expectedError string
+	}{
+		{`{{geoip "country"}}`, "expected 2 parameters, but found 1"},
+		{`{{geoip .field .client_ip}}`, "the field must be a string constant"},
+		{`{{geoip "zip" .client_ip}}`, `unknown field "zip"`},
+	} {
+		_, err := New("test", data.template)
+		if err == nil || !strings.Contains(err.Error(), data.expectedError) {
+			t.Fatalf("%v: expected error containing %q, but got %v", data.template, data.expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package template
+
+import (
+	"fmt"
+	"sync"
+	"text/template/parse"
+)
+
+// The lookup tables from the lookup_tables section, used like {{lookup "dc_map" .client_ip}}.
+// The tables are replaced when their files change, while the templates are executed, so access is synchronized.
+var (
+	lookupTablesMutex sync.RWMutex
+	lookupTables      = make(map[string]lookupTable)
+)
+
+type lookupTable struct {
+	values       map[string]string
+	defaultValue string
+}
+
+// SetLookupTable adds or replaces the lookup table with the given name.
+// The defaultValue is the result for keys that are not in the table.
+func SetLookupTable(name string, values map[string]string, defaultValue string) {
+	lookupTablesMutex.Lock()
+	defer lookupTablesMutex.Unlock()
+	lookupTables[name] = lookupTable{
+		values:       values,
+		defaultValue: defaultValue,
+	}
+}
+
+// RemoveLookupTable removes the lookup table, like when it was removed from the config.
+func RemoveLookupTable(name string) {
+	lookupTablesMutex.Lock()
+	defer lookupTablesMutex.Unlock()
+	delete(lookupTables, name)
+}
+
+func lookupInTable(name string, key interface{}) (string, error) {
+	lookupTablesMutex.RLock()
+	defer lookupTablesMutex.RUnlock()
+	table, ok := lookupTables[name]
+	if !ok {
+		return "", fmt.Errorf("error executing lookup function: lookup table %v is not loaded", name)
+	}
+	if value, ok := table.values[toString(key)]; ok {
+		return value, nil
+	}
+	return table.defaultValue, nil
+}
+
+// isLookupTableCall is true for {{lookup "table" key}}. With more parameters, lookup maps the value with the given keys and values.
+func isLookupTableCall(cmd *parse.CommandNode) bool {
+	if len(cmd.Args) != 3 || !isFunctionCall(cmd, "lookup") {
+		return false
+	}
+	_, ok := cmd.Args[1].(*parse.StringNode)
+	return ok
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package template
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLookupTable(t *testing.T) {
+	tmplt, err := New("dc", `{{if .client_ip}}{{lookup "dc_map" .client_ip}}{{else}}{{lookup "team_map" (lookup .user "root" "admin")}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := tmplt.LookupTables()
+	if len(tables) != 2 || strings.Join(tables, ",") != "dc_map,team_map" && strings.Join(tables, ",") != "team_map,dc_map" {
+		t.Fatalf("expected lookup tables dc_map and team_map, but got %v", tables)
+	}
+	SetLookupTable("dc_map", map[string]string{"10.0.0.1": "dc1"}, "unknown")
+	SetLookupTable("team_map", map[string]string{"admin": "ops"}, "")
+	defer RemoveLookupTable("dc_map")
+	defer RemoveLookupTable("team_map")
+	for _, data := range []struct {
+		fields   map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"client_ip": "10.0.0.1"}, "dc1"},
+		{map[string]interface{}{"client_ip": "10.0.0.2"}, "unknown"},
+		{map[string]interface{}{"client_ip": "", "user": "root"}, "ops"},
+		{map[string]interface{}{"client_ip": "", "user": "alice"}, ""},
+	} {
+		result, err := tmplt.Execute(data.fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != data.expected {
+			t.Fatalf("%v: expected %q, but got %q", data.fields, data.expected, result)
+		}
+	}
+	SetLookupTable("dc_map", map[string]string{"10.0.0.2": "dc2"}, "unknown")
+	result, err := tmplt.Execute(map[string]interface{}{"client_ip": "10.0.0.2"})
+	if err != nil || result != "dc2" {
+		t.Fatalf("expected dc2 from the replaced table, but got %q, %v", result, err)
+	}
+	RemoveLookupTable("dc_map")
+	_, err = tmplt.Execute(map[string]interface{}{"client_ip": "10.0.0.2"})
+	if err == nil || !strings.Contains(err.Error(), "lookup table dc_map is not loaded") {
+		t.Fatalf("expected error for the removed table, but got %v", err)
+	}
+}
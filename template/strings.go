@@ -0,0 +1,180 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package template
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template/parse"
+)
+
+// Like in gsub, the regular expressions must be string constants, they are compiled when the template is parsed.
+var regexpCache = make(map[string]*regexp.Regexp)
+
+func newToLowerFunc() functionWithValidator {
+	return functionWithValidator{
+		function: func(s interface{}) string {
+			return strings.ToLower(toString(s))
+		},
+		staticValidator: func(cmd *parse.CommandNode) error {
+			return validateNumberOfParams("toLower", cmd, 1)
+		},
+	}
+}
+
+func newToUpperFunc() functionWithValidator {
+	return functionWithValidator{
+		function: func(s interface{}) string {
+			return strings.ToUpper(toString(s))
+		},
+		staticValidator: func(cmd *parse.CommandNode) error {
+			return validateNumberOfParams("toUpper", cmd, 1)
+		},
+	}
+}
+
+func newSubstrFunc() functionWithValidator {
+	return functionWithValidator{
+		function:        substr,
+		staticValidator: validateSubstrCall,
+	}
+}
+
+func newRegexMatchFunc() functionWithValidator {
+	return functionWithValidator{
+		function: regexMatch,
+		staticValidator: func(cmd *parse.CommandNode) error {
+			return validateRegexCall("regexMatch", cmd, 2)
+		},
+	}
+}
+
+func newRegexReplaceAllFunc() functionWithValidator {
+	return functionWithValidator{
+		function: regexReplaceAll,
+		staticValidator: func(cmd *parse.CommandNode) error {
+			return validateRegexCall("regexReplaceAll", cmd, 3)
+		},
+	}
+}
+
+func newLookupFunc() functionWithValidator {
+	return functionWithValidator{
+		function:        lookup,
+		staticValidator: validateLookupCall,
+	}
+}
+
+// substr returns the characters from start to end, like {{substr 0 1 .status}} for the first digit of the status.
+// If end is negative or beyond the end of the string, the result is the rest of the string.
+func substr(start, end int, s interface{}) string {
+	runes := []rune(toString(s))
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 || end > len(runes) {
+		end = len(runes)
+	}
+	if start >= end {
+		return ""
+	}
+	return string(runes[start:end])
+}
+
+func regexMatch(expr string, s interface{}) bool {
+	return regexpCache[expr].MatchString(toString(s))
+}
+
+// regexReplaceAll replaces all matches of the Go regular expression, the replacement may reference capture groups like ${1}.
+// Unlike gsub, this uses Go's regexp syntax, so the parameters have the same order and meaning as in Helm and Sprig templates.
+func regexReplaceAll(expr string, s interface{}, repl string) string {
+	return regexpCache[expr].ReplaceAllString(toString(s), repl)
+}
+
+// lookup maps a value with key/value pairs, and an optional default as the last parameter, like
+// {{lookup .method "GET" "read" "POST" "write" "other"}}. Without default, values that are not found are returned unchanged.
+// With two parameters, like {{lookup "dc_map" .client_ip}}, the value is looked up in a table from the lookup_tables section.
+func lookup(s interface{}, keysAndValues ...interface{}) (string, error) {
+	if len(keysAndValues) == 1 {
+		return lookupInTable(toString(s), keysAndValues[0])
+	}
+	key := toString(s)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if toString(keysAndValues[i]) == key {
+			return toString(keysAndValues[i+1]), nil
+		}
+	}
+	if len(keysAndValues)%2 == 1 {
+		return toString(keysAndValues[len(keysAndValues)-1]), nil
+	}
+	return key, nil
+}
+
+// toString converts grok fields to strings, including typed capture groups like %{INT:status:int}.
+func toString(s interface{}) string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprint(s)
+}
+
+func validateNumberOfParams(functionName string, cmd *parse.CommandNode, n int) error {
+	if len(cmd.Args) != n+1 {
+		return fmt.Errorf("syntax error in %v call: expected %v parameters, but found %v parameters", functionName, n, len(cmd.Args)-1)
+	}
+	return nil
+}
+
+func validateSubstrCall(cmd *parse.CommandNode) error {
+	prefix := "syntax error in substr call"
+	if err := validateNumberOfParams("substr", cmd, 3); err != nil {
+		return err
+	}
+	for _, paramPos := range []int{1, 2} {
+		if param, ok := cmd.Args[paramPos].(*parse.NumberNode); ok && !param.IsInt {
+			return fmt.Errorf("%v: %v is not an integer", prefix, param)
+		}
+	}
+	return nil
+}
+
+func validateRegexCall(functionName string, cmd *parse.CommandNode, n int) error {
+	prefix := fmt.Sprintf("syntax error in %v call", functionName)
+	if err := validateNumberOfParams(functionName, cmd, n); err != nil {
+		return err
+	}
+	stringNode, ok := cmd.Args[1].(*parse.StringNode)
+	if !ok {
+		return fmt.Errorf("%v: first parameter is not a valid regular expression", prefix)
+	}
+	regex, err := regexp.Compile(stringNode.Text)
+	if err != nil {
+		return fmt.Errorf("%v: '%v' is not a valid regular expression: %v", prefix, stringNode.Text, err)
+	}
+	regexpCache[stringNode.Text] = regex
+	return nil
+}
+
+func validateLookupCall(cmd *parse.CommandNode) error {
+	prefix := "syntax error in lookup call"
+	switch {
+	case len(cmd.Args) < 3:
+		return fmt.Errorf("%v: expected a table name and a key, or a value and keys and values, but found %v parameters", prefix, len(cmd.Args)-1)
+	case len(cmd.Args) == 3 && !isLookupTableCall(cmd):
+		return fmt.Errorf("%v: the name of the lookup table must be a string constant", prefix)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package template
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStringFunctions(t *testing.T) {
+	for _, data := range []struct {
+		template, expected string
+	}{
+		{`{{toLower .method}}`, "get"},
+		{`{{toUpper (toLower .method)}}`, "GET"},
+		{`{{substr 0 1 .status}}xx`, "5xx"},
+		{`{{substr 1 -1 .status}}`, "03"},
+		{`{{substr 2 10 .user}}`, "ĉu"},
+		{`{{substr 0 1 .int_status}}`, "5"},
+		{`{{if regexMatch "^5" .status}}server_error{{else}}ok{{end}}`, "server_error"},
+		{`{{if regexMatch "^5" .path}}server_error{{else}}ok{{end}}`, "ok"},
+		{`{{regexReplaceAll "/[0-9]+" .path "/:id"}}`, "/users/:id/orders/:id"},
+		{`{{regexReplaceAll "^/([a-z]+)/.*" .path "${1}"}}`, "users"},
+		{`{{lookup .method "GET" "read" "POST" "write" "other"}}`, "read"},
+		{`{{lookup .method "PUT" "update"}}`, "GET"},
+		{`{{lookup .method "PUT" "update" "other"}}`, "other"},
+		{`{{lookup .int_status 503 "unavailable"}}`, "unavailable"},
+		{`{{lookup (substr 0 1 .status) "5" "server_error" "4" "client_error" "other"}}`, "server_error"},
+	} {
+		tmplt, err := New("test", data.template)
+		if err != nil {
+			t.Fatalf("%v: unexpected error parsing template: %v", data.template, err)
+		}
+		result, err := tmplt.Execute(map[string]interface{}{
+			"method":     "GET",
+			"status":     "503",
+			"int_status": int64(503),
+			"user":       "aaĉu",
+			"path":       "/users/42/orders/7",
+		})
+		if err != nil {
+			t.Fatalf("%v: unexpected error executing template: %v", data.template, err)
+		}
+		if result != data.expected {
+			t.Fatalf("%v: expected %q, but got %q", data.template, data.expected, result)
+		}
+	}
+}
+
+func TestStringFunctionsInvalid(t *testing.T) {
+	for _, data := range []struct {
+		template, expectedError string
+	}{
+		{`{{toLower .method .path}}`, "expected 1 parameters, but found 2"},
+		{`{{substr 0.5 1 .status}}`, "0.5 is not an integer"},
+		{`{{regexMatch .pattern .status}}`, "first parameter is not a valid regular expression"},
+		{`{{regexReplaceAll "(" .path ""}}`, "'(' is not a valid regular expression"},
+		{`{{lookup .method}}`, "expected a table name and a key"},
+		{`{{lookup .table .client_ip}}`, "must be a string constant"},
+	} {
+		_, err := New("test", data.template)
+		if err == nil || !strings.Contains(err.Error(), data.expectedError) {
+			t.Fatalf("%v: expected error containing %q, but got %v", data.template, data.expectedError, err)
+		}
+	}
+}
@@ -28,12 +28,18 @@ import (
 type Template interface {
 	Execute(grokValues map[string]interface{}) (string, error)
 	ReferencedGrokFields() []string
+	// LookupTables returns the names of the lookup tables used in the template, like "dc_map" in {{lookup "dc_map" .client_ip}}.
+	LookupTables() []string
+	// UsesGeoIP is true if the template calls the geoip function, like {{geoip "country" .client_ip}}.
+	UsesGeoIP() bool
 	Name() string
 }
 
 type templateImpl struct {
 	template             *textTemplate.Template
 	referencedGrokFields map[string]bool // This map is used as a set. Value true indicates the string is present in the set.
+	lookupTables         map[string]bool
+	usesGeoIP            bool
 }
 
 func New(name, template string) (Template, error) {
@@ -50,6 +56,17 @@ func New(name, template string) (Template, error) {
 	if err != nil {
 		return nil, err
 	}
+	result.lookupTables = make(map[string]bool)
+	for _, t := range result.template.Templates() {
+		visitCommands(t.Root, func(cmd *parse.CommandNode) {
+			if isLookupTableCall(cmd) {
+				result.lookupTables[cmd.Args[1].(*parse.StringNode).Text] = true
+			}
+			if isFunctionCall(cmd, "geoip") {
+				result.usesGeoIP = true
+			}
+		})
+	}
 	return result, nil
 }
 
@@ -76,6 +93,61 @@ func (t *templateImpl) ReferencedGrokFields() []string {
 	return result
 }
 
+func (t *templateImpl) LookupTables() []string {
+	result := make([]string, 0, len(t.lookupTables))
+	for name := range t.lookupTables {
+		result = append(result, name)
+	}
+	return result
+}
+
+func (t *templateImpl) UsesGeoIP() bool {
+	return t.usesGeoIP
+}
+
+// visitCommands calls visit for each command in the parse tree, including nested commands like (lookup .user "root" "admin").
+func visitCommands(node parse.Node, visit func(cmd *parse.CommandNode)) {
+	switch t := node.(type) {
+	case *parse.ListNode:
+		if t != nil {
+			for _, n := range t.Nodes {
+				visitCommands(n, visit)
+			}
+		}
+	case *parse.ActionNode:
+		visitCommands(t.Pipe, visit)
+	case *parse.RangeNode:
+		visitCommandsInBranch(&t.BranchNode, visit)
+	case *parse.IfNode:
+		visitCommandsInBranch(&t.BranchNode, visit)
+	case *parse.WithNode:
+		visitCommandsInBranch(&t.BranchNode, visit)
+	case *parse.TemplateNode:
+		visitCommands(t.Pipe, visit)
+	case *parse.PipeNode:
+		if t == nil {
+			return
+		}
+		for _, cmd := range t.Cmds {
+			visit(cmd)
+			for _, arg := range cmd.Args {
+				visitCommands(arg, visit)
+			}
+		}
+	}
+}
+
+func visitCommandsInBranch(node *parse.BranchNode, visit func(cmd *parse.CommandNode)) {
+	visitCommands(node.Pipe, visit)
+	visitCommands(node.List, visit)
+	visitCommands(node.ElseList, visit)
+}
+
+func isFunctionCall(cmd *parse.CommandNode, functionName string) bool {
+	identifierNode, ok := cmd.Args[0].(*parse.IdentifierNode)
+	return ok && identifierNode.Ident == functionName
+}
+
 func referencedGrokFields(t *textTemplate.Template) (map[string]bool, error) {
 	var (
 		result = make(map[string]bool)
@@ -150,9 +222,8 @@ func extractGrokFieldsFromCmd(cmd *parse.CommandNode) (map[string]bool, error) {
 	result := make(map[string]bool)
 	for _, arg := range cmd.Args {
 		if fieldNode, ok := arg.(*parse.FieldNode); ok {
-			for _, ident := range fieldNode.Ident {
-				result[ident] = true
-			}
+			// For nested fields like {{.extra.http.status}}, only the first field name is a grok field.
+			result[fieldNode.Ident[0]] = true
 		}
 	}
 	return result, nil
@@ -65,6 +65,16 @@ func TestReferencedGrokFields(t *testing.T) {
 			},
 			expectedResult: "3 items are made of metal",
 		},
+		{
+			// {{pipeline}} with nested fields
+			template:           "{{.extra.http.status}} {{.material}}",
+			expectedGrokFields: []string{"extra", "material"},
+			example: map[string]interface{}{
+				"extra":    map[string]interface{}{"http": map[string]interface{}{"status": 503}},
+				"material": "metal",
+			},
+			expectedResult: "503 metal",
+		},
 		{
 			// {{pipeline}} with function call
 			template:           "{{.count_total}} items are made {{printf \"of %v\" .material}}",
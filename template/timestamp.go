@@ -40,6 +40,49 @@ func timestamp(layout, value string) (float64, error) {
 	return float64(result.UnixNano()) * time.Nanosecond.Seconds(), nil
 }
 
+// durationUnits are the units of the duration function, like in time.ParseDuration().
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+func newDurationFunc() functionWithValidator {
+	return functionWithValidator{
+		function:        duration,
+		staticValidator: validateDurationCall,
+	}
+}
+
+// duration returns the time from start to end in the unit, default is seconds.
+// Like {{subtract (timestamp layout end) (timestamp layout start)}}, but without rounding errors of the float64 timestamps.
+func duration(layout, start, end string, unit ...string) (float64, error) {
+	startLayout, start, err := fixCommas(layout, start)
+	if err != nil {
+		return 0, err
+	}
+	endLayout, end, err := fixCommas(layout, end)
+	if err != nil {
+		return 0, err
+	}
+	startTime, err := time.Parse(startLayout, start)
+	if err != nil {
+		return 0, err
+	}
+	endTime, err := time.Parse(endLayout, end)
+	if err != nil {
+		return 0, err
+	}
+	u := time.Second
+	if len(unit) > 0 {
+		u = durationUnits[unit[0]] // unit was checked in validateDurationCall()
+	}
+	return float64(endTime.Sub(startTime)) / float64(u), nil
+}
+
 // Cannot parse ISO 8601 timestamps (commonly used in log4j) with time.Parse()
 // because these timestamps use a comma separator between seconds and microseconds
 // while time.Parse() requires a dot separator between seconds and microseconds.
@@ -77,3 +120,28 @@ func validateTimestampCall(cmd *parse.CommandNode) error {
 	}
 	return nil
 }
+
+func validateDurationCall(cmd *parse.CommandNode) error {
+	prefix := "syntax error in duration call"
+	if len(cmd.Args) != 4 && len(cmd.Args) != 5 {
+		return fmt.Errorf("%v: expected three or four parameters, but found %v parameters.", prefix, len(cmd.Args)-1)
+	}
+	if stringNode, ok := cmd.Args[1].(*parse.StringNode); ok {
+		_, err := timestamp(stringNode.Text, stringNode.Text)
+		if err != nil {
+			return fmt.Errorf("%v: %v is not a valid reference timestamp: %v", prefix, stringNode.Text, err)
+		}
+	} else {
+		return fmt.Errorf("%v: first parameter is not a valid reference timestamp.", prefix)
+	}
+	if len(cmd.Args) == 5 {
+		stringNode, ok := cmd.Args[4].(*parse.StringNode)
+		if !ok {
+			return fmt.Errorf("%v: the unit must be a string constant.", prefix)
+		}
+		if _, ok := durationUnits[stringNode.Text]; !ok {
+			return fmt.Errorf("%v: unit %v is not one of ns, us, ms, s, m, or h.", prefix, stringNode.Text)
+		}
+	}
+	return nil
+}
@@ -57,6 +57,44 @@ func TestTimestampCommaError(t *testing.T) {
 	}
 }
 
+func TestDurationFunction(t *testing.T) {
+	for _, data := range []struct {
+		template string
+		expected float64
+	}{
+		{`{{duration "2006-01-02 15:04:05,000" .start .end}}`, 61.5},
+		{`{{duration "2006-01-02 15:04:05,000" .start .end "ms"}}`, 61500},
+		{`{{duration "2006-01-02 15:04:05,000" .start .end "m"}}`, 1.025},
+		{`{{duration "2006-01-02 15:04:05,000" .end .start "s"}}`, -61.5},
+	} {
+		template, err := New("duration", data.template)
+		if err != nil {
+			t.Fatalf("%v: unexpected error parsing template: %v", data.template, err)
+		}
+		resultString, err := template.Execute(map[string]interface{}{
+			"start": "2015-07-26 15:01:33,665",
+			"end":   "2015-07-26 15:02:35,165",
+		})
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", data.template, err)
+		}
+		if result, err := strconv.ParseFloat(resultString, 64); err != nil || result != data.expected {
+			t.Fatalf("%v: expected %v, but got %v", data.template, data.expected, resultString)
+		}
+	}
+	for _, invalid := range []string{
+		`{{duration "2006-01-02" .start}}`,
+		`{{duration .layout .start .end}}`,
+		`{{duration "2006-01-02" .start .end "days"}}`,
+		`{{duration "2006-01-02" .start .end .unit}}`,
+	} {
+		_, err := New("duration", invalid)
+		if err == nil {
+			t.Fatalf("%v: expected error, but got no error.", invalid)
+		}
+	}
+}
+
 func evalTimestamp(t *testing.T, template Template, value string) float64 {
 	resultString, err := template.Execute(map[string]interface{}{
 		"date": value,
@@ -0,0 +1,287 @@
+// Copyright 2020 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fstab/grok_exporter/config"
+	"github.com/fstab/grok_exporter/config/v3"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/fstab/grok_exporter/tailer"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+const testUsage = `Usage: grok_exporter test -config <path> [-input <id>] [<file>]
+       grok_exporter test -pattern <grok pattern> [-config <path>] [<file>]
+
+Reads sample lines from <file>, or from stdin if no file is given, and prints
+how they are processed: which metrics match, the captured fields, and the
+resulting labels and values. The exporter is not started.
+`
+
+// runTestCommand implements 'grok_exporter test'. With -config, the lines are processed like lines of the config's input
+// by the config's metrics. With -pattern, the lines are matched against a single grok pattern, using the config's patterns if -config is given.
+func runTestCommand(args []string, stdin io.Reader, out io.Writer) error {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, testUsage)
+		flags.PrintDefaults()
+	}
+	testConfigPath := flags.String("config", "", "Path to the config file.")
+	testPattern := flags.String("pattern", "", "Grok pattern to test instead of the config's metrics.")
+	testInputId := flags.String("input", "", "Id of the input whose line processing is used, default is the first input.")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		os.Exit(-1) // the flag package already printed the error and the usage
+	}
+	if (*testConfigPath == "" && *testPattern == "") || flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(-1)
+	}
+	var (
+		cfg      *v3.Config
+		input    = &v3.InputConfig{}
+		patterns *exporter.Patterns
+		engine   = exporter.Oniguruma
+		err      error
+	)
+	if *testConfigPath != "" {
+		var warn string
+		cfg, warn, err = config.LoadConfigFile(*testConfigPath)
+		if len(warn) > 0 {
+			fmt.Fprintf(os.Stderr, "%v\n", warn)
+		}
+		if err != nil {
+			return err
+		}
+		input, err = selectInput(cfg, *testInputId)
+		if err != nil {
+			return err
+		}
+		patterns, _, err = initPatterns(cfg)
+		engine = exporter.RegexEngine(cfg.Global.RegexEngine)
+	} else {
+		patterns = exporter.InitPatterns()
+		_, err = addBundledPatterns(patterns, "")
+	}
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		stdin = file
+	}
+	format, err := lineFormat(input)
+	if err != nil {
+		return err
+	}
+	tail, err := parsingTailer(tailer.RunOneshotReaderTailer(stdin, format), input, patterns, engine)
+	if err != nil {
+		return err
+	}
+	defer tail.Close()
+	if *testPattern != "" {
+		return testPatternOnLines(*testPattern, patterns, engine, tail, out)
+	}
+	return testMetricsOnLines(cfg, input, patterns, tail, out)
+}
+
+func selectInput(cfg *v3.Config, id string) (*v3.InputConfig, error) {
+	inputs := cfg.AllInputs()
+	if id == "" {
+		return inputs[0], nil
+	}
+	for _, input := range inputs {
+		if input.Id == id {
+			return input, nil
+		}
+	}
+	return nil, fmt.Errorf("grok_exporter test: the config has no input with id '%v'", id)
+}
+
+func testPatternOnLines(pattern string, patterns *exporter.Patterns, engine exporter.RegexEngine, tail fswatcher.FileTailer, out io.Writer) error {
+	regex, err := exporter.Compile(pattern, patterns, engine)
+	if err != nil {
+		return err
+	}
+	defer regex.Free()
+	return forEachLine(tail, out, func(line *fswatcher.Line) error {
+		searchResult, err := regex.Search(line.Line)
+		if err != nil {
+			return err
+		}
+		defer searchResult.Free()
+		if !searchResult.IsMatch() {
+			fmt.Fprintf(out, "    no match\n")
+			return nil
+		}
+		captures := make(map[string]string)
+		for _, name := range regex.CaptureGroupNames() {
+			captures[name], err = searchResult.GetCaptureGroupByName(name)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "    match\n")
+		printFields(out, "fields", captures)
+		return nil
+	})
+}
+
+func testMetricsOnLines(cfg *v3.Config, input *v3.InputConfig, patterns *exporter.Patterns, tail fswatcher.FileTailer, out io.Writer) error {
+	// sample_rate is ignored, so that each line shows which metrics match
+	unsampled := *cfg
+	unsampled.AllMetrics = append(v3.MetricsConfig{}, cfg.AllMetrics...)
+	for i := range unsampled.AllMetrics {
+		unsampled.AllMetrics[i].SampleRate = 0
+	}
+	metrics, err := createMetrics(&unsampled, patterns)
+	if err != nil {
+		return err
+	}
+	defer freeMetrics(metrics)
+	filter, err := exporter.NewFilter(cfg.Filter, patterns, exporter.RegexEngine(cfg.Global.RegexEngine))
+	if err != nil {
+		return err
+	}
+	defer filter.Free()
+	err = exporter.NewLookupTables().Load(cfg.LookupTables)
+	if err != nil {
+		return err
+	}
+	err = exporter.LoadGeoIPDatabases(cfg.GeoIP)
+	if err != nil {
+		return err
+	}
+	err = exporter.SetMatchTimeout(cfg.Global.MatchTimeout)
+	if err != nil {
+		return err
+	}
+	metricsForInput := routeMetrics(cfg, metrics)[input.Id]
+	return forEachLine(tail, out, func(line *fswatcher.Line) error {
+		line.Input = input.Id
+		if !line.LogTime.IsZero() {
+			fmt.Fprintf(out, "    log time %v\n", line.LogTime.Format(time.RFC3339Nano))
+			if input.DropOlderThan > 0 && time.Since(line.LogTime) > input.DropOlderThan {
+				fmt.Fprintf(out, "    dropped, older than drop_older_than %v\n", input.DropOlderThan)
+				return nil
+			}
+		}
+		accepted, err := filter.Accept(line.Line)
+		if err != nil {
+			return err
+		}
+		if !accepted {
+			fmt.Fprintf(out, "    dropped by the filter section\n")
+			return nil
+		}
+		if input.Match != "" {
+			if line.Captures == nil {
+				fmt.Fprintf(out, "    no match for the input's match pattern\n")
+				return nil
+			}
+			captures := make(map[string]string, len(line.Captures))
+			for name, value := range line.Captures {
+				captures[name] = fmt.Sprint(value)
+			}
+			fmt.Fprintf(out, "    input match\n")
+			printFields(out, "fields", captures)
+		}
+		matched := false
+		for _, metric := range metricsForInput {
+			if !metric.PathMatches(line.File) {
+				continue
+			}
+			additionalFields := makeAdditionalFields(line)
+			captures, err := metric.Captures(line.Line, additionalFields)
+			if err == nil && captures != nil {
+				var match *exporter.Match
+				match, err = metric.ProcessMatch(line.Line, additionalFields)
+				if err == nil && match != nil {
+					matched = true
+					fmt.Fprintf(out, "    metric %v matched, value %v\n", metric.Name(), match.Value)
+					printFields(out, "fields", captures)
+					printFields(out, "labels", match.Labels)
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(out, "    metric %v: %v\n", metric.Name(), err)
+				continue
+			}
+			deleteMatch, err := metric.ProcessDeleteMatch(line.Line, additionalFields)
+			if err != nil {
+				fmt.Fprintf(out, "    metric %v: %v\n", metric.Name(), err)
+			} else if deleteMatch != nil {
+				matched = true
+				fmt.Fprintf(out, "    metric %v matched delete_match\n", metric.Name())
+				printFields(out, "labels", deleteMatch.Labels)
+			}
+		}
+		if !matched {
+			fmt.Fprintf(out, "    no metric matched\n")
+		}
+		return nil
+	})
+}
+
+// forEachLine calls f for each line until the input ends. The line is printed before f is called,
+// so that f only has to print its results.
+func forEachLine(tail fswatcher.FileTailer, out io.Writer, f func(line *fswatcher.Line) error) error {
+	lineNumber := 0
+	for {
+		select {
+		case line, open := <-tail.Lines():
+			if !open {
+				return nil
+			}
+			lineNumber++
+			fmt.Fprintf(out, "line %v: %v\n", lineNumber, line.Line)
+			if err := f(line); err != nil {
+				return fmt.Errorf("line %v: %v", lineNumber, err)
+			}
+		case err := <-tail.Errors():
+			return fmt.Errorf("error reading log lines: %v", err.Error())
+		}
+	}
+}
+
+func printFields(out io.Writer, title string, fields map[string]string) {
+	if len(fields) == 0 {
+		return
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]string, 0, len(fields))
+	for _, name := range names {
+		values = append(values, fmt.Sprintf("%v=%q", name, fields[name]))
+	}
+	fmt.Fprintf(out, "        %v: %v\n", title, strings.Join(values, ", "))
+}